@@ -0,0 +1,295 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package coverage is the helper package, which applications instrumented by
+// gobinarycoverage can import in order to extend the coverage gathered.
+//
+// Importing the package has no effect on a regular build. When the binary is
+// instrumented, the coverage runtime picks up everything registered here, and
+// writes it to the sidecar next to the coverage profile.
+package coverage
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a named custom coverage point, such as "rollback-path-taken",
+// which counts the number of times a scenario is hit. It complements the
+// statement coverage, for scenarios which are not tied to a single statement.
+type Counter struct {
+	name string
+	hits atomic.Uint64
+}
+
+var (
+	countersMu sync.Mutex
+	counters   = make(map[string]*Counter)
+)
+
+// NewCounter registers the counter name, and returns it. Registering a name
+// which is registered already returns the existing counter, so counters can be
+// registered wherever they are needed. Counters registered, but never hit, are
+// reported with a count of zero.
+func NewCounter(name string) *Counter {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	if c, ok := counters[name]; ok {
+		return c
+	}
+	c := &Counter{name: name}
+	counters[name] = c
+	return c
+}
+
+// Name returns the name of the counter
+func (c *Counter) Name() string {
+	return c.name
+}
+
+// Hit increments the counter. It is safe to call from multiple goroutines.
+func (c *Counter) Hit() {
+	c.hits.Add(1)
+}
+
+// Add increments the counter by n. It is safe to call from multiple
+// goroutines.
+func (c *Counter) Add(n uint64) {
+	c.hits.Add(n)
+}
+
+// Hit increments the counter name, registering it first if needed.
+func Hit(name string) {
+	NewCounter(name).Hit()
+}
+
+// beforeExec hands the coverage over to the process the binary re-executes
+// itself as. It is registered by the coverage runtime of instrumented binaries.
+var beforeExec atomic.Pointer[func()]
+
+// RegisterBeforeExec registers the function handing the coverage over in
+// BeforeExec. It is called by the coverage runtime of instrumented binaries,
+// and is not meant to be called by the applications.
+func RegisterBeforeExec(f func()) {
+	beforeExec.Store(&f)
+}
+
+// BeforeExec hands the coverage gathered so far over to the process the binary
+// is about to re-execute itself as, e.g., through syscall.Exec, which would
+// otherwise lose it, so that the coverage of one logical run survives the
+// re-exec. Call it right before the exec, which needs to pass the environment
+// on to the new process:
+//
+//	coverage.BeforeExec()
+//	err := syscall.Exec(exe, os.Args, os.Environ())
+//
+// It has no effect on a regular build.
+func BeforeExec() {
+	if f := beforeExec.Load(); f != nil {
+		(*f)()
+	}
+}
+
+// flush writes the coverage profile. It is registered by the coverage runtime
+// of instrumented binaries.
+var flush atomic.Pointer[func()]
+
+// RegisterFlush registers the function writing the coverage profile in Flush.
+// It is called by the coverage runtime of instrumented binaries, and is not
+// meant to be called by the applications.
+func RegisterFlush(f func()) {
+	flush.Store(&f)
+}
+
+// Flush writes the coverage gathered so far to a new profile, as the binary
+// does when it exits through coverReport. It has no effect on a regular build.
+func Flush() {
+	if f := flush.Load(); f != nil {
+		(*f)()
+	}
+}
+
+// Shutdowner is a server which shuts down gracefully, such as *http.Server.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// Shutdown shuts srv down gracefully, and then writes the coverage, once the
+// requests in flight are done, so that their coverage is in the profile. The
+// coverage is written even if the shutdown fails, e.g., when ctx expires
+// first, and the error of the shutdown is returned. It replaces the call to
+// srv.Shutdown in the graceful shutdown of the application:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+//	defer cancel()
+//	err := coverage.Shutdown(ctx, srv)
+//
+// On a regular build, it only shuts srv down.
+func Shutdown(ctx context.Context, srv Shutdowner) error {
+	err := srv.Shutdown(ctx)
+	Flush()
+	return err
+}
+
+// GracefulStopper is a server which stops gracefully, such as *grpc.Server.
+type GracefulStopper interface {
+	GracefulStop()
+}
+
+// GracefulStop stops srv gracefully, and then writes the coverage, once the
+// RPCs in flight are done, as Shutdown. It replaces the call to
+// srv.GracefulStop in the graceful shutdown of the application. On a regular
+// build, it only stops srv.
+func GracefulStop(srv GracefulStopper) {
+	srv.GracefulStop()
+	Flush()
+}
+
+// Executor is a command line whose Execute runs the command given on it, such
+// as the root *cobra.Command.
+type Executor interface {
+	Execute() error
+}
+
+// Execute runs the command line cmd, through its Execute, and then writes the
+// coverage, once the command is done, whether it succeeds or not, and returns
+// the error of the command. It replaces the call to cmd.Execute in the main
+// function of the application:
+//
+//	if err := coverage.Execute(rootCmd); err != nil {
+//		os.Exit(1)
+//	}
+//
+// The binaries depending on a version of cobra with cobra.OnFinalize, i.e.,
+// 1.6.0, or later, write the coverage after every command without it, as they
+// are wired by the instrumentation. On a regular build, it only runs cmd.
+func Execute(cmd Executor) error {
+	err := cmd.Execute()
+	Flush()
+	return err
+}
+
+// Runner is a command line whose Run runs the command given by the arguments,
+// such as the *cli.App of urfave/cli.
+type Runner interface {
+	Run(args []string) error
+}
+
+// Run runs the command line app with args, through its Run, and then writes
+// the coverage, as Execute. It replaces the call to app.Run in the main
+// function of the application:
+//
+//	if err := coverage.Run(app, os.Args); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// On a regular build, it only runs app.
+func Run(app Runner, args []string) error {
+	err := app.Run(args)
+	Flush()
+	return err
+}
+
+// Profile is a coverage profile written by the instrumented binary, as given
+// to the sinks.
+type Profile struct {
+	Name    string // The path of the file the profile is written to, or empty if it could not be written
+	Data    []byte // The profile, in the text format of go test -coverprofile
+	Sidecar []byte // The sidecar of the profile, in JSON, with the mode, the build, and the tags of the profile
+}
+
+// Sink receives the coverage profiles written by the instrumented binary,
+// e.g., in order to publish them to a telemetry pipeline. Write is called
+// with every profile written, whether it could be written to a file, or not,
+// and Close once the binary writes its last profile, as it exits. The calls
+// are never concurrent.
+type Sink interface {
+	Write(p *Profile) error
+	Close() error
+}
+
+var (
+	sinksMu     sync.Mutex
+	sinks       []Sink
+	sinksClosed bool
+)
+
+// RegisterSink registers the sink s, which the profiles are written to from
+// then on, along with the files. The sinks are written to in the order they
+// are registered in. On a regular build, the sinks are never written to.
+func RegisterSink(s Sink) {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	sinks = append(sinks, s)
+}
+
+// HasSinks tells whether any sink is registered. It is called by the coverage
+// runtime of instrumented binaries, and is not meant to be called by the
+// applications.
+func HasSinks() bool {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	return len(sinks) > 0 && !sinksClosed
+}
+
+// WriteSinks writes p to all the sinks registered, unless they are closed,
+// and returns the first of the errors of the sinks failing, after writing it
+// to the rest of them. It is called by the coverage runtime of instrumented
+// binaries, and is not meant to be called by the applications.
+func WriteSinks(p *Profile) error {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	if sinksClosed {
+		return nil
+	}
+	var first error
+	for _, s := range sinks {
+		if err := s.Write(p); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// CloseSinks closes all the sinks registered, so that they are not written to
+// any more, and returns the first of the errors of the sinks failing, as
+// WriteSinks. It is called by the coverage runtime of instrumented binaries,
+// and is not meant to be called by the applications.
+func CloseSinks() error {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	if sinksClosed {
+		return nil
+	}
+	sinksClosed = true
+	var first error
+	for _, s := range sinks {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Counters returns a snapshot of the counts of all the registered counters.
+func Counters() map[string]uint64 {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	snapshot := make(map[string]uint64, len(counters))
+	for name, c := range counters {
+		snapshot[name] = c.hits.Load()
+	}
+	return snapshot
+}
@@ -1,3 +1,13 @@
 module github.com/mendersoftware/gobinarycoverage
 
-go 1.14
+go 1.22.0
+
+require (
+	golang.org/x/tools v0.26.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	golang.org/x/mod v0.21.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+)
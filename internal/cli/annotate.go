@@ -0,0 +1,111 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// annotateUsage is the help of the annotate subcommand.
+const annotateUsage = `
+   gobinarycoverage annotate [-o dir] profile.out [file...]
+
+       Writes copies of the source files in the profile, or the files
+       given, to dir (default ./coverage-annotated), with the coverage of
+       every line, like the .gcov files of gcov. The files are named as
+       in the profile, with .gcov appended.
+`
+
+// annotateCommand writes copies of the source files in a profile, with the
+// coverage of every line, in the format of the .gcov files written by gcov, as
+// configured by the arguments of the annotate subcommand.
+func annotateCommand(args []string) error {
+	fs := flag.NewFlagSet("annotate", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, annotateUsage)
+	out := fs.String("o", "coverage-annotated", "The directory to write the annotated sources to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: gobinarycoverage annotate [-o dir] profile.out [file...]")
+	}
+	p, err := loadProfile(fs.Args()[:1])
+	if err != nil {
+		return err
+	}
+	files, err := selectProfileFiles(p, fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+	paths, err := resolveProfileFiles(options{}.buildContext(), files)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		target := filepath.Join(*out, filepath.FromSlash(file)+".gcov")
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		bw := bufio.NewWriter(f)
+		err = annotateFile(bw, paths[file], file, fs.Arg(0), p.LineCounts(file))
+		if err == nil {
+			err = bw.Flush()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stderr, "Wrote the annotated source to the file: %s\n", target)
+	}
+	return nil
+}
+
+// annotateFile writes the source file at path, named file in the profile, to
+// w, with every line prefixed by its count, as gcov does, i.e., the count, or
+// '#####' for uncovered lines, or '-' for the lines holding no statements,
+// followed by the line number.
+func annotateFile(w io.Writer, path, file, profileName string, counts map[int]int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintf(w, "%9s:%5d:Source:%s\n", "-", 0, file)
+	fmt.Fprintf(w, "%9s:%5d:Profile:%s\n", "-", 0, profileName)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		count := "-"
+		if c, ok := counts[line]; ok {
+			count = "#####"
+			if c > 0 {
+				count = fmt.Sprint(c)
+			}
+		}
+		fmt.Fprintf(w, "%9s:%5d:%s\n", count, line, s.Text())
+	}
+	return s.Err()
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// apiCoverage is the coverage of the exported functions, and methods, of a
+// package, i.e., of its API, and of the unexported ones.
+type apiCoverage struct {
+	Package    string         `json:"package"`
+	Exported   profile.Totals `json:"exported"`
+	Unexported profile.Totals `json:"unexported"`
+}
+
+// apiReport is the coverage of the API of every package, and of all of them
+type apiReport struct {
+	Sample   float64       `json:"sample,omitempty"` // The percentage of the blocks sampled, if not all of them are
+	Packages []apiCoverage `json:"packages"`
+	Total    apiCoverage   `json:"total"`
+}
+
+// addFunc adds the statements of f to the exported, or the unexported totals
+func (a *apiCoverage) addFunc(f funcCoverage) {
+	t := &a.Unexported
+	if f.Exported {
+		t = &a.Exported
+	}
+	t.Add(f.Statements, f.Covered)
+}
+
+// summarizeAPI sums up the coverage of funcs, by package, and by whether they
+// are exported, see funcExported. The packages are sorted.
+func summarizeAPI(funcs []funcCoverage) *apiReport {
+	r := &apiReport{Total: apiCoverage{Package: "total"}}
+	packages := make(map[string]*apiCoverage)
+	for _, f := range funcs {
+		pkg := path.Dir(f.File)
+		a, ok := packages[pkg]
+		if !ok {
+			a = &apiCoverage{Package: pkg}
+			packages[pkg] = a
+		}
+		a.addFunc(f)
+		r.Total.addFunc(f)
+	}
+	for _, a := range packages {
+		r.Packages = append(r.Packages, *a)
+	}
+	sort.Slice(r.Packages, func(i, j int) bool { return r.Packages[i].Package < r.Packages[j].Package })
+	return r
+}
+
+// writeAPIReport writes the API coverage report r in the format, text, json or
+// csv. The rows of the text report are colored by the coverage of the exported
+// functions, if c is true.
+func writeAPIReport(w io.Writer, format string, r *apiReport, c colorizer) error {
+	rows := append(append([]apiCoverage(nil), r.Packages...), r.Total)
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"package", "exported statements", "exported covered", "exported percent",
+			"unexported statements", "unexported covered", "unexported percent"})
+		for _, a := range rows {
+			cw.Write([]string{
+				a.Package,
+				strconv.Itoa(a.Exported.Statements),
+				strconv.Itoa(a.Exported.Covered),
+				strconv.FormatFloat(a.Exported.Percent, 'f', 1, 64),
+				strconv.Itoa(a.Unexported.Statements),
+				strconv.Itoa(a.Unexported.Covered),
+				strconv.FormatFloat(a.Unexported.Percent, 'f', 1, 64),
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "text":
+	default:
+		return fmt.Errorf("the API report is written as text, json or csv, not %s", format)
+	}
+	if r.Sample > 0 {
+		fmt.Fprintln(w, sampledNote(r.Sample))
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	cell := func(t profile.Totals) string {
+		if t.Statements == 0 {
+			return "-\t"
+		}
+		return fmt.Sprintf("%d/%d\t%.1f%%", t.Covered, t.Statements, t.Percent)
+	}
+	fmt.Fprint(tw, c.row(colorDefault, "package\texported\t\tunexported\n"))
+	for _, a := range rows {
+		color := colorDefault
+		if a.Exported.Statements > 0 {
+			color = percentColor(a.Exported.Percent)
+		}
+		fmt.Fprint(tw, c.row(color, fmt.Sprintf("%s\t%s\t%s\n", a.Package, cell(a.Exported), cell(a.Unexported))))
+	}
+	return tw.Flush()
+}
+
+// reportAPI writes the API coverage report of the profiles, selected by sel,
+// in the format, to the file at out, or to w, colored if c is true, if out is
+// "". The sources of the profiles are found through go list, so it is run in
+// the module.
+func reportAPI(w io.Writer, out, format string, profiles []string, sel profileSelection, c colorizer) error {
+	merged, err := loadSelectedProfile(profiles, sel)
+	if err != nil {
+		return err
+	}
+	funcs, err := profileFuncCoverage(merged, "")
+	if err != nil {
+		return err
+	}
+	r := summarizeAPI(funcs)
+	r.Sample = merged.Sample
+	if out == "" {
+		return writeAPIReport(w, format, r, c)
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err = writeAPIReport(f, format, r, false); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
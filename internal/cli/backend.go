@@ -0,0 +1,244 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The backends building the coverage binaries, see resolveBackend
+const (
+	backendLegacy = "legacy" // Rewrite the sources, and merge the coverage runtime into the main file
+	backendNative = "native" // Build with go build -cover, and convert the GOCOVERDIR data with go tool covdata
+	backendAuto   = "auto"   // native, if the go toolchain supports it, and legacy otherwise
+)
+
+// nativeMinGoMinorVersion is the oldest Go toolchain building coverage
+// binaries natively, i.e., go1.20
+const nativeMinGoMinorVersion = 20
+
+// nativeFlags are the flags of the instrumentation which apply to the native
+// backend. The others configure the rewriting of the sources, or the coverage
+// runtime, which the native coverage does without.
+var nativeFlags = map[string]bool{
+	"backend":          true,
+	"mode":             true,
+	"race":             true,
+	"exclude-pkg":      true,
+	"include-pkg":      true,
+	"include-replaced": true,
+	"goos":             true,
+	"goarch":           true,
+	"tags":             true,
+	"force":            true,
+	"wait":             true,
+	"timeout":          true,
+	"retries":          true,
+}
+
+// resolveBackend returns the backend given, legacy if none is, or, for auto,
+// the one the go toolchain in the environment of ctx supports. The native
+// backend fails on the toolchains older than go1.20.
+func resolveBackend(ctx *build.Context, backend string) (string, error) {
+	switch backend {
+	case "", backendLegacy:
+		return backendLegacy, nil
+	case backendNative, backendAuto:
+	default:
+		return "", fmt.Errorf("unknown backend: %s, expected legacy, native or auto", backend)
+	}
+	toolchain, err := goEnvVar(ctx, "GOVERSION")
+	if err != nil {
+		return "", err
+	}
+	// The development versions are newer than any release
+	if minor, ok := goMinorVersion(toolchain); ok && minor < nativeMinGoMinorVersion {
+		if backend == backendAuto {
+			return backendLegacy, nil
+		}
+		return "", fmt.Errorf("the native backend needs go1.%d or later, the toolchain is %s", nativeMinGoMinorVersion, toolchain)
+	}
+	return backendNative, nil
+}
+
+// nativeBuildFlags returns the flags of go build building the coverage binary
+// of the main package mainPackage natively, covering the packages the legacy
+// backend instruments, as configured by opts, and the main package, as the
+// binaries whose main package is not covered write no coverage data. The mode
+// is atomic if the binary is built with -race, given, or in GOFLAGS.
+func nativeBuildFlags(mainPackage string, opts options) ([]string, error) {
+	packages, err := coverPackages(mainPackage, opts)
+	if err != nil {
+		return nil, err
+	}
+	ctx := opts.buildContext()
+	main, err := getFilesInPackage(mainPackage, ctx)
+	if err != nil {
+		return nil, err
+	}
+	packages = append([]string{main.ImportPath}, packages...)
+	mode := coverageMode(opts.mode, opts.race || goFlagsRace(ctx))
+	flags := []string{"-cover", "-covermode=" + mode, "-coverpkg=" + strings.Join(packages, ",")}
+	// The -race of GOFLAGS applies to go build as it is
+	if opts.race {
+		flags = append(flags, "-race")
+	}
+	if opts.tags != "" {
+		flags = append(flags, "-tags="+strings.Join(splitTags(opts.tags), ","))
+	}
+	return flags, nil
+}
+
+// nativeInstrument writes the go build command lines building the coverage
+// binaries of the main packages given by args natively, as the instrument
+// subcommand does with the native backend, to w. The flags given on the
+// command line, fs, have to apply to the native backend, see nativeFlags. The
+// tree is left untouched.
+func nativeInstrument(fs *flag.FlagSet, args []string, opts options, w io.Writer) error {
+	var unsupported []string
+	fs.Visit(func(f *flag.Flag) {
+		if !nativeFlags[f.Name] {
+			unsupported = append(unsupported, "-"+f.Name)
+		}
+	})
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("%s can not be given with the native backend", strings.Join(unsupported, ", "))
+	}
+	patterns, err := readPackageArgs(args, os.Stdin)
+	if err == nil {
+		patterns, err = expandPackages(patterns, opts)
+	}
+	if err != nil {
+		return err
+	}
+	if len(patterns) == 0 {
+		return errors.New("no packages given")
+	}
+	fmt.Fprintln(stderr, "The native backend leaves the tree untouched, build the coverage binaries with the commands below, "+
+		"and run them with gobinarycoverage run, which converts their coverage data into a profile, "+
+		"or with GOCOVERDIR set to a directory, which check, report and ci read as it is")
+	for _, mainPackage := range patterns {
+		flags, err := nativeBuildFlags(mainPackage, opts)
+		if err != nil {
+			return err
+		}
+		var env string
+		if opts.goos != "" {
+			env += "GOOS=" + opts.goos + " "
+		}
+		if opts.goarch != "" {
+			env += "GOARCH=" + opts.goarch + " "
+		}
+		fmt.Fprintf(w, "%sgo build %s %s\n", env, strings.Join(flags, " "), mainPackage)
+	}
+	return nil
+}
+
+// isCovdataDir returns true if the directory dir holds the coverage data
+// written by the binaries built natively, with GOCOVERDIR.
+func isCovdataDir(dir string) bool {
+	metas, _ := filepath.Glob(filepath.Join(dir, "covmeta.*"))
+	return len(metas) > 0
+}
+
+// covdataRunProfile converts the coverage data written into the directory dir,
+// by a binary built natively, and run by the run subcommand, into a new profile
+// in the directory the binaries of the legacy backend write theirs to, i.e.,
+// COVERAGE_FILEPATH, given the prefix of the variable, or the working
+// directory, and returns its path.
+func covdataRunProfile(dir, envPrefix string) (string, error) {
+	out := os.Getenv(envPrefix + "FILEPATH")
+	if out == "" || out == "-" {
+		out = "."
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return "", err
+	}
+	profile := filepath.Join(out, fmt.Sprintf("coverage%d-%d.out", os.Getpid(), time.Now().UnixNano()))
+	return profile, covdataProfile([]string{dir}, profile)
+}
+
+// covdataProfile converts the coverage data written by the binaries built
+// natively into the directories dirs, with GOCOVERDIR, into the text profile
+// out, merging the counters of all of them.
+func covdataProfile(dirs []string, out string) error {
+	for _, dir := range dirs {
+		metas, err := filepath.Glob(filepath.Join(dir, "covmeta.*"))
+		if err != nil {
+			return err
+		}
+		if len(metas) == 0 {
+			return fmt.Errorf("%s holds no coverage data, is the binary built with -cover, and run with GOCOVERDIR=%s?", dir, dir)
+		}
+	}
+	_, err := runCommand("", nil, "go", "tool", "covdata", "textfmt", "-i="+strings.Join(dirs, ","), "-o="+out)
+	return err
+}
+
+// covdataUsage is the help of the covdata subcommand.
+const covdataUsage = `
+   gobinarycoverage covdata [-o profile.out] dir [dir...]
+
+       Converts the coverage data written into the directories, by the
+       binaries built with go build -cover, and run with GOCOVERDIR set to
+       them, into a text profile, to profile.out, or stdout, merging the
+       counters of all of them, with go tool covdata textfmt, so that the
+       rest of the subcommands report on them as on the profiles of the
+       legacy backend.
+`
+
+// covdataCommand converts the coverage data of the binaries built natively
+// into a text profile, as configured by the arguments of the covdata
+// subcommand, so that the profiles of both backends are reported on alike.
+func covdataCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("covdata", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, covdataUsage)
+	out := fs.String("o", "", "Write the profile to this file, instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: gobinarycoverage covdata [-o profile.out] dir [dir...]")
+	}
+	if *out != "" {
+		return covdataProfile(fs.Args(), *out)
+	}
+	dir, err := ioutil.TempDir("", "gobinarycoverage-covdata")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	profile := filepath.Join(dir, "coverage.out")
+	if err = covdataProfile(fs.Args(), profile); err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(profile)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(contents)
+	return err
+}
@@ -0,0 +1,234 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// benchBinaryEnv is the environment variable holding the path of the binary
+// the workload of the bench subcommand is run against.
+const benchBinaryEnv = "GOBINARYCOVERAGE_BINARY"
+
+// benchResult is what is measured of one of the binaries of the bench
+// subcommand.
+type benchResult struct {
+	size     int64           // The size of the binary
+	runtimes []time.Duration // The wall clock time of every run of the workload
+	maxRSS   int64           // The largest resident set size of any run, or 0 if unknown
+}
+
+// median returns the median runtime of the workload
+func (r *benchResult) median() time.Duration {
+	runtimes := append([]time.Duration(nil), r.runtimes...)
+	sort.Slice(runtimes, func(i, j int) bool { return runtimes[i] < runtimes[j] })
+	return runtimes[len(runtimes)/2]
+}
+
+// benchUsage is the help of the bench subcommand.
+const benchUsage = `
+   gobinarycoverage bench [-runs n] [-mode mode] [-granularity block|func]
+           [-sample percent] [-keep] package -- workload [arg...]
+
+       Builds the main package both as is, and instrumented in a copy of
+       the main module, runs the workload against each binary n times
+       (default 5), in turns, and reports the difference in the size of
+       the binaries, the median runtime of the workload, and its largest
+       resident set size. The path of the binary replaces {} in the
+       arguments of the workload, and is set in GOBINARYCOVERAGE_BINARY.
+`
+
+// benchCommand builds the main package both with, and without the coverage
+// instrumentation, runs the workload against each, and reports the overhead
+// of the instrumentation, as configured by the arguments of the bench
+// subcommand. The instrumentation is done in a copy of the main module, so
+// that the tree is left untouched.
+func benchCommand(args []string, w io.Writer) (err error) {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, benchUsage)
+	runs := fs.Int("runs", 5, "The number of times the workload is run against each binary")
+	var opts options
+	fs.StringVar(&opts.mode, "mode", "", "The coverage mode: set, count or atomic")
+	fs.StringVar(&opts.granularity, "granularity", granularityBlock, "Instrument with a counter for every block, or for every function only: block or func")
+	fs.Float64Var(&opts.sample, "sample", 100, "The percentage of the blocks to instrument")
+	keep := fs.Bool("keep", false, "Keep the binaries, and the instrumented copy of the module")
+	if err = fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 || *runs < 1 {
+		return errors.New("usage: gobinarycoverage bench [-runs n] [-mode mode] [-granularity block|func] [-sample percent] [-keep] package -- workload [arg...]")
+	}
+	mainPackage, workload := fs.Arg(0), fs.Args()[1:]
+	// The flags end at the package, so the separator is left in the arguments
+	if workload[0] == "--" {
+		workload = workload[1:]
+	}
+	if len(workload) == 0 {
+		return errors.New("no workload given, after --")
+	}
+
+	dir, err := ioutil.TempDir("", "gobinarycoverage-bench")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil || *keep {
+			fmt.Fprintf(stderr, "bench: the binaries are kept in: %s\n", dir)
+			return
+		}
+		os.RemoveAll(dir)
+	}()
+
+	//
+	// Build the binary as is, and instrumented in a copy of the module
+	//
+	plain := filepath.Join(dir, "plain")
+	if _, err = runCommand("", nil, "go", "build", "-o", plain, mainPackage); err != nil {
+		return fmt.Errorf("build: %s", err.Error())
+	}
+	fmt.Fprintf(stderr, "bench: built %s\n", plain)
+	instrumented := filepath.Join(dir, "instrumented")
+	if err = buildInstrumentedCopy(filepath.Join(dir, "module"), mainPackage, instrumented, opts); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "bench: built %s\n", instrumented)
+
+	//
+	// Run the workload against the binaries in turns, so that anything else
+	// going on on the machine affects both of them alike
+	//
+	profiles := filepath.Join(dir, "profiles")
+	if err = os.MkdirAll(profiles, 0755); err != nil {
+		return err
+	}
+	results := []*benchResult{{}, {}}
+	for i, binary := range []string{plain, instrumented} {
+		info, err := os.Stat(binary)
+		if err != nil {
+			return err
+		}
+		results[i].size = info.Size()
+	}
+	for run := 1; run <= *runs; run++ {
+		for i, binary := range []string{plain, instrumented} {
+			elapsed, rss, err := runWorkload(workload, binary, defaultEnvPrefix+"FILEPATH="+profiles)
+			if err != nil {
+				return fmt.Errorf("workload against the %s binary: %s", filepath.Base(binary), err.Error())
+			}
+			results[i].runtimes = append(results[i].runtimes, elapsed)
+			if rss > results[i].maxRSS {
+				results[i].maxRSS = rss
+			}
+		}
+		fmt.Fprintf(stderr, "bench: run %d/%d\n", run, *runs)
+	}
+	return writeBenchReport(w, results[0], results[1])
+}
+
+// buildInstrumentedCopy copies the main module into dir, instruments the main
+// package mainPackage in the copy, as configured by opts, and builds it into
+// binary. The package is resolved relative to the same directory in the copy
+// as the working directory is in the module.
+func buildInstrumentedCopy(dir, mainPackage, binary string, opts options) error {
+	// The copy is thrown away, even if the module is in a git work tree
+	opts.force = true
+	_, workdir, err := inModuleCopy(dir, opts.buildContext(), func() error {
+		return instrument(mainPackage, opts)
+	})
+	if err != nil {
+		return fmt.Errorf("instrument: %s", err.Error())
+	}
+	if _, err = runCommand(workdir, nil, "go", "build", "-o", binary, mainPackage); err != nil {
+		return fmt.Errorf("build the instrumented copy: %s", err.Error())
+	}
+	return nil
+}
+
+// runWorkload runs the workload against binary, whose path replaces {} in the
+// arguments, and is set in GOBINARYCOVERAGE_BINARY, with env added to the
+// environment. It returns the wall clock time of the workload, and the largest
+// resident set size of it, and the processes it waited for, in bytes, which
+// is 0 where it is unknown.
+func runWorkload(workload []string, binary string, env ...string) (time.Duration, int64, error) {
+	args := make([]string, len(workload))
+	for i, arg := range workload {
+		args[i] = strings.ReplaceAll(arg, "{}", binary)
+	}
+	// The workload is the user's own, and runs for as long as it likes, so it
+	// is not run through runCommand, which retries
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(append(os.Environ(), benchBinaryEnv+"="+binary), env...)
+	cmd.Stdout, cmd.Stderr = ioutil.Discard, stderr
+	start := time.Now()
+	err := cmd.Run()
+	elapsed := time.Since(start)
+	if err != nil {
+		return 0, 0, err
+	}
+	return elapsed, maxRSS(cmd.ProcessState), nil
+}
+
+// writeBenchReport writes the size of the binaries, the median runtime of the
+// workload, and its largest resident set size, against the plain and the
+// instrumented binary, and the difference between them, as a table.
+func writeBenchReport(w io.Writer, plain, instrumented *benchResult) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tplain\tinstrumented\tdelta")
+	fmt.Fprintf(tw, "binary size\t%s\t%s\t%s\n",
+		formatBytes(plain.size), formatBytes(instrumented.size), benchDelta(plain.size, instrumented.size))
+	p, i := plain.median(), instrumented.median()
+	fmt.Fprintf(tw, "runtime (median of %d)\t%s\t%s\t%s\n",
+		len(plain.runtimes), p.Round(time.Millisecond), i.Round(time.Millisecond), benchDelta(int64(p), int64(i)))
+	if plain.maxRSS > 0 && instrumented.maxRSS > 0 {
+		fmt.Fprintf(tw, "max RSS\t%s\t%s\t%s\n",
+			formatBytes(plain.maxRSS), formatBytes(instrumented.maxRSS), benchDelta(plain.maxRSS, instrumented.maxRSS))
+	} else {
+		fmt.Fprintln(tw, "max RSS\tn/a\tn/a\t")
+	}
+	return tw.Flush()
+}
+
+// benchDelta returns the relative difference of instrumented to plain
+func benchDelta(plain, instrumented int64) string {
+	if plain == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.1f%%", 100*float64(instrumented-plain)/float64(plain))
+}
+
+// formatBytes returns n in the largest binary unit it is at least one of
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// blameLine is the last modification of a line, as told by git blame
+type blameLine struct {
+	commit string // "" if the line is not committed yet
+	author string
+	time   time.Time
+}
+
+// staleBlock is an uncovered block, and the last modification of any of its
+// lines
+type staleBlock struct {
+	profile.Block
+	blameLine
+}
+
+// blameUsage is the help of the blame subcommand.
+const blameUsage = `
+   gobinarycoverage blame [-pkg pattern] [-n count] [-oldest] profile.out [profile.out...]
+
+       Lists the uncovered blocks by the last modification of any of their
+       lines, as told by git blame, newest first, or oldest first with
+       -oldest, so that the new code which is not tested yet is told apart
+       from the old code which is likely dead. -pkg and -n are as for
+       uncovered.
+`
+
+// blameCommand lists the uncovered blocks by the age of their last
+// modification, as told by git blame, as configured by the arguments of the
+// blame subcommand, so that the new code, which is not tested yet, is told
+// apart from the old code, which is likely dead.
+func blameCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("blame", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, blameUsage)
+	pkg := fs.String("pkg", "", "Only list the blocks in the packages matching this pattern, e.g. example.com/app/...")
+	limit := fs.Int("n", 20, "The number of blocks to list, or 0 for all")
+	oldest := fs.Bool("oldest", false, "List the oldest blocks first, instead of the newest")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: gobinarycoverage blame [-pkg pattern] [-n count] [-oldest] profile.out [profile.out...]")
+	}
+	merged, err := loadProfile(fs.Args())
+	if err != nil {
+		return err
+	}
+	uncovered := make(map[string][]profile.Block)
+	var files []string
+	for _, b := range merged.Blocks {
+		if b.Count > 0 || *pkg != "" && !matchPackagePattern(*pkg, path.Dir(b.File)) {
+			continue
+		}
+		if _, ok := uncovered[b.File]; !ok {
+			files = append(files, b.File)
+		}
+		uncovered[b.File] = append(uncovered[b.File], b)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	sort.Strings(files)
+	paths, err := resolveProfileFiles(options{}.buildContext(), files)
+	if err != nil {
+		return err
+	}
+	var blocks []staleBlock
+	for _, file := range files {
+		lines, err := blameFile(paths[file])
+		if err != nil {
+			// E.g. the files of the dependencies, in the module cache
+			fmt.Fprintf(stderr, "blame: skipping the file %s. Error: %s\n", file, err.Error())
+			continue
+		}
+		for _, b := range uncovered[file] {
+			sb := staleBlock{Block: b}
+			for line := b.StartLine; line <= b.EndLine; line++ {
+				if l, ok := lines[line]; ok && newerBlame(l, sb.blameLine) {
+					sb.blameLine = l
+				}
+			}
+			blocks = append(blocks, sb)
+		}
+	}
+	sort.SliceStable(blocks, func(i, j int) bool {
+		if *oldest {
+			return newerBlame(blocks[j].blameLine, blocks[i].blameLine)
+		}
+		return newerBlame(blocks[i].blameLine, blocks[j].blameLine)
+	})
+	if *limit > 0 && len(blocks) > *limit {
+		blocks = blocks[:*limit]
+	}
+	now := time.Now()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, b := range blocks {
+		fmt.Fprintf(tw, "%s:%d-%d\t%d statements\t", b.File, b.StartLine, b.EndLine, b.NumStmt)
+		if b.commit == "" {
+			fmt.Fprintln(tw, "uncommitted")
+			continue
+		}
+		fmt.Fprintf(tw, "%s (%s)\t%.8s\t%s\n", b.time.Format("2006-01-02"), formatAge(now.Sub(b.time)), b.commit, b.author)
+	}
+	return tw.Flush()
+}
+
+// newerBlame returns whether the line a was modified after the line b. The
+// lines which are not committed yet are the newest, and the unknown ones,
+// the oldest.
+func newerBlame(a, b blameLine) bool {
+	if a.time.IsZero() || b.time.IsZero() {
+		return !a.time.IsZero() && b.time.IsZero()
+	}
+	if (a.commit == "") != (b.commit == "") {
+		return a.commit == ""
+	}
+	return a.time.After(b.time)
+}
+
+// blameFile returns the last modification of every line of the file at
+// filename, by its number, as told by git blame.
+func blameFile(filename string) (map[int]blameLine, error) {
+	out, err := runCommand(filepath.Dir(filename), nil, "git", "blame", "--line-porcelain", "--", filepath.Base(filename))
+	if err != nil {
+		return nil, err
+	}
+	lines := make(map[int]blameLine)
+	var current blameLine
+	number := 0
+	s := bufio.NewScanner(bytes.NewReader(out))
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		text := s.Text()
+		switch {
+		case strings.HasPrefix(text, "\t"):
+			// The contents of the line end the information about it
+			lines[number] = current
+			number, current = 0, blameLine{}
+		case number == 0:
+			// The header: the commit, the line number in the commit, and in
+			// the file
+			fields := strings.Fields(text)
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("unexpected output of git blame: %s", text)
+			}
+			if number, err = strconv.Atoi(fields[2]); err != nil {
+				return nil, fmt.Errorf("unexpected output of git blame: %s", text)
+			}
+			if strings.Trim(fields[0], "0") != "" {
+				current.commit = fields[0]
+			}
+		case strings.HasPrefix(text, "author "):
+			current.author = strings.TrimPrefix(text, "author ")
+		case strings.HasPrefix(text, "committer-time "):
+			seconds, err := strconv.ParseInt(strings.TrimPrefix(text, "committer-time "), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected output of git blame: %s", text)
+			}
+			current.time = time.Unix(seconds, 0)
+		}
+	}
+	return lines, s.Err()
+}
+
+// formatAge returns the age d in days, months or years, whichever is the
+// largest it is at least one of
+func formatAge(d time.Duration) string {
+	days := int(d.Hours() / 24)
+	switch {
+	case days < 1:
+		return "today"
+	case days < 2:
+		return "yesterday"
+	case days < 60:
+		return fmt.Sprintf("%d days ago", days)
+	case days < 730:
+		return fmt.Sprintf("%d months ago", days/30)
+	}
+	return fmt.Sprintf("%d years ago", days/365)
+}
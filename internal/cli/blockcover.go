@@ -0,0 +1,418 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+// The annotation of the blocks is adapted from cmd/cover, of the legacy mode
+// of go tool cover, which is
+//
+//    Copyright 2013 The Go Authors. All rights reserved.
+//    Use of this source code is governed by a BSD-style
+//    license that can be found in the LICENSE file of the Go distribution.
+
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"sort"
+	"strings"
+)
+
+// coverAtomicImport is the name sync/atomic is imported as by the files
+// instrumented in the atomic mode, which is unlikely to be shadowed
+const coverAtomicImport = "_cover_atomic_"
+
+// blockCover is the state of a file instrumented by coverBlocks
+type blockCover struct {
+	fset    *token.FileSet
+	content []byte
+	mode    string
+	varName string
+	inserts []blockInsert
+	blocks  [][5]int
+	seen    map[[4]int]bool // The positions of the blocks, see counter
+}
+
+// blockInsert is text inserted at offset in the source
+type blockInsert struct {
+	offset int
+	text   string
+}
+
+// coverBlocks instruments the file at src with a counter for every basic
+// block in it, in the variable varName, and writes it to dst, as go tool cover
+// does in its legacy mode, with -mode, -var, and -o, but in process, so that
+// the files are not instrumented by a go command each, and the instrumented
+// files are in the same form, whichever the version of the go command is.
+func coverBlocks(src, dst, mode, varName string) error {
+	if strings.ContainsAny(src, "\r\n") {
+		// The //line directive can not hold them
+		return fmt.Errorf("the path holds a newline: %q", src)
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, src, content, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return err
+	}
+	c := &blockCover{fset: fset, content: content, mode: mode, varName: varName, seen: make(map[[4]int]bool)}
+	if mode == "atomic" {
+		// sync/atomic is imported even if the file imports it already, as the
+		// name it is imported as may be shadowed where the counters are
+		c.insert(c.offset(f.Name.End()), fmt.Sprintf("; import %s %q", coverAtomicImport, "sync/atomic"))
+	}
+	ast.Walk(c, f)
+
+	sort.SliceStable(c.inserts, func(i, j int) bool { return c.inserts[i].offset < c.inserts[j].offset })
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "//line %s:1:1\n", src)
+	last := 0
+	for _, in := range c.inserts {
+		out.Write(content[last:in.offset])
+		out.WriteString(in.text)
+		last = in.offset
+	}
+	out.Write(content[last:])
+	out.WriteString("\n")
+	writeCoverVar(&out, varName, c.blocks)
+	if mode == "atomic" {
+		// The import is used, even if the file has no code
+		fmt.Fprintf(&out, "\nvar _ = %s.LoadUint32\n", coverAtomicImport)
+	}
+	return os.WriteFile(dst, out.Bytes(), 0644)
+}
+
+// insert inserts text at offset, after the text inserted there already
+func (c *blockCover) insert(offset int, text string) {
+	c.inserts = append(c.inserts, blockInsert{offset, text})
+}
+
+// offset returns the offset of pos in the file, whatever its //line
+// directives
+func (c *blockCover) offset(pos token.Pos) int {
+	return c.fset.PositionFor(pos, false).Offset
+}
+
+// Visit implements the ast.Visitor interface, adding the counters of the
+// blocks of the statement lists it walks.
+func (c *blockCover) Visit(node ast.Node) ast.Visitor {
+	switch n := node.(type) {
+	case *ast.BlockStmt:
+		// The body of a switch, or a select, is a list of clauses, which
+		// have the counters, rather than the body itself
+		if len(n.List) > 0 {
+			switch n.List[0].(type) {
+			case *ast.CaseClause:
+				for _, s := range n.List {
+					clause := s.(*ast.CaseClause)
+					c.addCounters(clause.Colon+1, clause.Colon+1, clause.End(), clause.Body, false)
+				}
+				return c
+			case *ast.CommClause:
+				for _, s := range n.List {
+					clause := s.(*ast.CommClause)
+					c.addCounters(clause.Colon+1, clause.Colon+1, clause.End(), clause.Body, false)
+				}
+				return c
+			}
+		}
+		// The block ends after its closing brace
+		c.addCounters(n.Lbrace, n.Lbrace+1, n.Rbrace+1, n.List, true)
+	case *ast.IfStmt:
+		if n.Init != nil {
+			ast.Walk(c, n.Init)
+		}
+		ast.Walk(c, n.Cond)
+		ast.Walk(c, n.Body)
+		if n.Else == nil {
+			return nil
+		}
+		// The else if needs a counter of its own, so it is put in a block of
+		// its own, i.e.,
+		//	} else if y {
+		// is instrumented as
+		//	} else {if y {
+		// with the block closed after it.
+		elseOffset := c.findText(n.Body.End(), "else")
+		if elseOffset < 0 {
+			panic("lost else")
+		}
+		c.insert(elseOffset+4, "{")
+		c.insert(c.offset(n.Else.End()), "}")
+
+		// The block starts after the else, so that its counter follows the
+		// brace inserted
+		pos := c.fset.File(n.Body.End()).Pos(elseOffset + 4)
+		switch stmt := n.Else.(type) {
+		case *ast.IfStmt:
+			n.Else = &ast.BlockStmt{Lbrace: pos, List: []ast.Stmt{stmt}, Rbrace: stmt.End()}
+		case *ast.BlockStmt:
+			stmt.Lbrace = pos
+		default:
+			panic("unexpected node type in if")
+		}
+		ast.Walk(c, n.Else)
+		return nil
+	case *ast.SelectStmt:
+		// An empty select has no clause to put the counter in
+		if n.Body == nil || len(n.Body.List) == 0 {
+			return nil
+		}
+	case *ast.SwitchStmt:
+		// Nor does an empty switch
+		if n.Body == nil || len(n.Body.List) == 0 {
+			if n.Init != nil {
+				ast.Walk(c, n.Init)
+			}
+			if n.Tag != nil {
+				ast.Walk(c, n.Tag)
+			}
+			return nil
+		}
+	case *ast.TypeSwitchStmt:
+		if n.Body == nil || len(n.Body.List) == 0 {
+			if n.Init != nil {
+				ast.Walk(c, n.Init)
+			}
+			ast.Walk(c, n.Assign)
+			return nil
+		}
+	case *ast.FuncDecl:
+		// The functions named _ are never run, and the ones without a body
+		// have no code
+		if n.Name.Name == "_" || n.Body == nil {
+			return nil
+		}
+	}
+	return c
+}
+
+// counter returns the statement incrementing the counter of a new block,
+// spanning the source from start to end, with numStmt statements.
+func (c *blockCover) counter(start, end token.Pos, numStmt int) string {
+	counter := fmt.Sprintf("%s.Count[%d]", c.varName, len(c.blocks))
+	stmt := counter + " = 1"
+	switch c.mode {
+	case "count":
+		stmt = counter + "++"
+	case "atomic":
+		stmt = fmt.Sprintf("%s.AddUint32(&%s, 1)", coverAtomicImport, counter)
+	}
+	s, e := c.fset.PositionFor(start, false), c.fset.PositionFor(end, false)
+	// The positions repeat when a //line directive has no column, and the
+	// file is not gofmt'ed, in which case the end is moved along, as by go
+	// tool cover, in order to keep the blocks apart
+	key := [4]int{s.Line, s.Column, e.Line, e.Column}
+	for c.seen[key] {
+		key[3]++
+	}
+	c.seen[key] = true
+	if numStmt > 1<<16-1 {
+		numStmt = 1<<16 - 1
+	}
+	c.blocks = append(c.blocks, [5]int{key[0], key[1], key[2], key[3], numStmt})
+	return stmt
+}
+
+// addCounters adds a counter at the beginning of every basic block in the
+// statement list, e.g., given
+//
+//	S1
+//	if cond {
+//		S2
+//	}
+//	S3
+//
+// before S1, and S3. The block holding S2 is visited on its own.
+func (c *blockCover) addCounters(pos, insertPos, blockEnd token.Pos, list []ast.Stmt, extendToClosingBrace bool) {
+	// An empty block gets a counter too, which the statements after, e.g.,
+	// a return, do not
+	if len(list) == 0 {
+		c.insert(c.offset(insertPos), c.counter(insertPos, blockEnd, 0)+";")
+		return
+	}
+	// The list is copied, as it is changed at the labels
+	list = append([]ast.Stmt(nil), list...)
+	for {
+		// The first statement changing the flow of control is the last one
+		// of the basic block
+		var last int
+		end := blockEnd
+		for last = 0; last < len(list); last++ {
+			stmt := list[last]
+			end = c.statementBoundary(stmt)
+			if c.endsBasicSourceBlock(stmt) {
+				// A label may be the target of a goto, and thus start a
+				// block, so
+				//	foo: stmt
+				// is instrumented as
+				//	foo: counter; stmt
+				// unless the statement labeled is one of control, which
+				// can not be parted from its label.
+				if label, isLabel := stmt.(*ast.LabeledStmt); isLabel && !isControl(label.Stmt) {
+					newLabel := *label
+					newLabel.Stmt = &ast.EmptyStmt{Semicolon: label.Stmt.Pos(), Implicit: true}
+					end = label.Pos()
+					list[last] = &newLabel
+					list = append(list, nil)
+					copy(list[last+1:], list[last:])
+					list[last+1] = label.Stmt
+				}
+				last++
+				extendToClosingBrace = false
+				break
+			}
+		}
+		if extendToClosingBrace {
+			end = blockEnd
+		}
+		// The blocks may abut, leaving nothing to cover
+		if pos != end {
+			c.insert(c.offset(insertPos), c.counter(pos, end, last)+";")
+		}
+		list = list[last:]
+		if len(list) == 0 {
+			break
+		}
+		pos = list[0].Pos()
+		insertPos = pos
+	}
+}
+
+// findText returns the offset of text in the source, from pos on, skipping
+// the comments, or -1 if it is not found.
+func (c *blockCover) findText(pos token.Pos, text string) int {
+	b := []byte(text)
+	s := c.content
+	for i := c.offset(pos); i < len(s); {
+		if bytes.HasPrefix(s[i:], b) {
+			return i
+		}
+		if i+2 <= len(s) && s[i] == '/' && s[i+1] == '/' {
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+			continue
+		}
+		if i+2 <= len(s) && s[i] == '/' && s[i+1] == '*' {
+			for i += 2; ; i++ {
+				if i+2 > len(s) {
+					return 0
+				}
+				if s[i] == '*' && s[i+1] == '/' {
+					i += 2
+					break
+				}
+			}
+			continue
+		}
+		i++
+	}
+	return -1
+}
+
+// statementBoundary returns the position in s ending the basic block it is
+// in: the opening brace of the body of a statement of control, or the body of
+// the first function literal in it, or its end.
+func (c *blockCover) statementBoundary(s ast.Stmt) token.Pos {
+	var parts []ast.Node
+	switch s := s.(type) {
+	case *ast.BlockStmt:
+		return s.Lbrace
+	case *ast.IfStmt:
+		parts = []ast.Node{s.Init, s.Cond, s.Body}
+	case *ast.ForStmt:
+		parts = []ast.Node{s.Init, s.Cond, s.Post, s.Body}
+	case *ast.LabeledStmt:
+		return c.statementBoundary(s.Stmt)
+	case *ast.RangeStmt:
+		parts = []ast.Node{s.X, s.Body}
+	case *ast.SwitchStmt:
+		parts = []ast.Node{s.Init, s.Tag, s.Body}
+	case *ast.SelectStmt:
+		return s.Body.Lbrace
+	case *ast.TypeSwitchStmt:
+		parts = []ast.Node{s.Init, s.Body}
+	default:
+		if pos := funcLiteral(s); pos != token.NoPos {
+			return pos
+		}
+		return s.End()
+	}
+	// The parts but the body may hold function literals
+	for _, part := range parts[:len(parts)-1] {
+		if pos := funcLiteral(part); pos != token.NoPos {
+			return pos
+		}
+	}
+	return parts[len(parts)-1].(*ast.BlockStmt).Lbrace
+}
+
+// endsBasicSourceBlock returns true if s changes the flow of control, e.g., a
+// break, or an if, or a call of panic, or holds a function literal, whose
+// body is a block of its own.
+func (c *blockCover) endsBasicSourceBlock(s ast.Stmt) bool {
+	switch s := s.(type) {
+	case *ast.BlockStmt, *ast.BranchStmt, *ast.ForStmt, *ast.IfStmt, *ast.RangeStmt,
+		*ast.SwitchStmt, *ast.SelectStmt, *ast.TypeSwitchStmt:
+		return true
+	case *ast.LabeledStmt:
+		// It may be the target of a goto
+		return true
+	case *ast.ExprStmt:
+		// panic is taken to be the builtin, without the types
+		if call, ok := s.X.(*ast.CallExpr); ok {
+			if ident, ok := call.Fun.(*ast.Ident); ok && ident.Name == "panic" && len(call.Args) == 1 {
+				return true
+			}
+		}
+	}
+	return funcLiteral(s) != token.NoPos
+}
+
+// isControl returns true if s is a statement of control, which can not be
+// parted from its label.
+func isControl(s ast.Stmt) bool {
+	switch s.(type) {
+	case *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.SelectStmt, *ast.TypeSwitchStmt:
+		return true
+	}
+	return false
+}
+
+// funcLiteral returns the position of the opening brace of the body of the
+// first function literal in n, or token.NoPos, if there is none.
+func funcLiteral(n ast.Node) token.Pos {
+	pos := token.NoPos
+	if n == nil {
+		return pos
+	}
+	ast.Inspect(n, func(node ast.Node) bool {
+		if pos != token.NoPos {
+			return false
+		}
+		if lit, ok := node.(*ast.FuncLit); ok {
+			pos = lit.Body.Lbrace
+			return false
+		}
+		return true
+	})
+	return pos
+}
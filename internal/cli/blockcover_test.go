@@ -0,0 +1,154 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// genericSource is a file using type parameters, in functions, methods,
+// types, constraints, and instantiations
+const genericSource = `package lib
+
+import "fmt"
+
+type Number interface {
+	~int | ~int64 | ~float64
+}
+
+type Stack[T any] struct {
+	items []T
+}
+
+func (s *Stack[T]) Push(v T) {
+	s.items = append(s.items, v)
+}
+
+func (s *Stack[T]) Pop() (T, bool) {
+	var zero T
+	if len(s.items) == 0 {
+		return zero, false
+	}
+	v := s.items[len(s.items)-1]
+	s.items = s.items[:len(s.items)-1]
+	return v, true
+}
+
+func Sum[T Number](values ...T) T {
+	var sum T
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+func Map[T, U any](values []T, f func(T) U) []U {
+	out := make([]U, 0, len(values))
+	for _, v := range values {
+		out = append(out, f(v))
+	}
+	return out
+}
+
+func Describe() string {
+	s := &Stack[string]{}
+	s.Push("a")
+	return fmt.Sprint(Sum(1, 2), Map([]int{1}, func(i int) string { return fmt.Sprint(i) }))
+}
+`
+
+// checkInstrumented type-checks the instrumented file at path
+func checkInstrumented(t *testing.T, path string) string {
+	t.Helper()
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, contents, 0)
+	if err != nil {
+		t.Fatalf("the instrumented file does not parse: %s\n%s", err, contents)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	if _, err = conf.Check("lib", fset, []*ast.File{f}, nil); err != nil {
+		t.Fatalf("the instrumented file does not type-check: %s\n%s", err, contents)
+	}
+	return string(contents)
+}
+
+func TestCoverGenerics(t *testing.T) {
+	instrumenters := map[string]func(src, dst, mode, varName string) error{
+		"blocks": coverBlocks,
+		"funcs":  coverFuncs,
+	}
+	for name, instrument := range instrumenters {
+		for _, mode := range []string{"set", "count", "atomic"} {
+			t.Run(name+"/"+mode, func(t *testing.T) {
+				dir := t.TempDir()
+				src := filepath.Join(dir, "lib.go")
+				if err := os.WriteFile(src, []byte(genericSource), 0644); err != nil {
+					t.Fatal(err)
+				}
+				dst := filepath.Join(dir, "lib.cover.go")
+				if err := instrument(src, dst, mode, "GoCover_0"); err != nil {
+					t.Fatal(err)
+				}
+				out := checkInstrumented(t, dst)
+				if !strings.HasPrefix(out, "//line "+src+":1:1\n") {
+					t.Errorf("the instrumented file does not start with a //line directive naming %s", src)
+				}
+			})
+		}
+	}
+}
+
+func TestCoverBlocksCounts(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		blocks int
+	}{
+		{"empty function", "package lib\n\nfunc F() {}\n", 1},
+		{"if", "package lib\n\nfunc F(b bool) int {\n\tif b {\n\t\treturn 1\n\t}\n\treturn 0\n}\n", 3},
+		{"generic function", "package lib\n\nfunc F[T any](v T) T {\n\treturn v\n}\n", 1},
+		{"generic switch", "package lib\n\nfunc F[T any](v T) int {\n\tswitch any(v).(type) {\n\tcase int:\n\t\treturn 1\n\t}\n\treturn 0\n}\n", 3},
+		{"function literal", "package lib\n\nvar F = func() int {\n\treturn 1\n}\n", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "lib.go")
+			if err := os.WriteFile(src, []byte(test.src), 0644); err != nil {
+				t.Fatal(err)
+			}
+			dst := filepath.Join(dir, "lib.cover.go")
+			if err := coverBlocks(src, dst, "set", "GoCover_0"); err != nil {
+				t.Fatal(err)
+			}
+			out := checkInstrumented(t, dst)
+			if n := strings.Count(out, "GoCover_0.Count["); n != test.blocks {
+				t.Errorf("%d counters, want %d in\n%s", n, test.blocks, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// platform is a target platform of the build subcommand, e.g., linux/arm/v7
+type platform struct {
+	goos, goarch string
+	goarm        string // The GOARM of linux/arm/v7, or ""
+}
+
+// String returns the platform as given on the command line
+func (p platform) String() string {
+	s := p.goos + "/" + p.goarch
+	if p.goarm != "" {
+		s += "/v" + p.goarm
+	}
+	return s
+}
+
+// platformManifest describes a binary built by the build subcommand. It is
+// written next to it, as <binary>.json.
+type platformManifest struct {
+	Platform string              `json:"platform"`
+	Binary   string              `json:"binary"`
+	Size     int64               `json:"size"`
+	SHA256   string              `json:"sha256"`
+	Settings *instrumentSettings `json:"settings"`          // As stamped into the binary, see stampSettings
+	Backend  string              `json:"backend,omitempty"` // native, if built with go build -cover, which stamps no settings
+}
+
+// parsePlatforms parses the comma separated list of platforms, given as
+// goos/goarch, or goos/arm/vN for the GOARM of 32-bit ARM.
+func parsePlatforms(list string) ([]platform, error) {
+	var platforms []platform
+	seen := make(map[platform]bool)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		parts := strings.Split(s, "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid platform: %s, expected goos/goarch, e.g. linux/arm64", s)
+		}
+		p := platform{goos: parts[0], goarch: parts[1]}
+		if len(parts) == 3 {
+			if p.goarch != "arm" || !strings.HasPrefix(parts[2], "v") {
+				return nil, fmt.Errorf("invalid platform: %s, only linux/arm takes a variant, e.g. linux/arm/v7", s)
+			}
+			p.goarm = strings.TrimPrefix(parts[2], "v")
+		}
+		if !seen[p] {
+			seen[p] = true
+			platforms = append(platforms, p)
+		}
+	}
+	if len(platforms) == 0 {
+		return nil, errors.New("no platforms given")
+	}
+	return platforms, nil
+}
+
+// platformFiles returns the files of the main package mainPackage, and of the
+// packages it imports, which are instrumented for the platform of the build
+// context ctx. The platforms with the same files share the instrumentation.
+func platformFiles(mainPackage string, ctx *build.Context) (string, error) {
+	packages, _, err := listPackagesImported(mainPackage, ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	var files []string
+	for _, pname := range packages {
+		p, err := getFilesInPackage(pname, ctx)
+		if err != nil {
+			return "", err
+		}
+		goFiles, err := selectGoFiles(ctx, p)
+		if err != nil {
+			return "", err
+		}
+		for _, name := range goFiles {
+			files = append(files, p.ImportPath+"/"+name)
+		}
+	}
+	return strings.Join(files, "\n"), nil
+}
+
+// buildUsage is the help of the build subcommand.
+const buildUsage = `
+   gobinarycoverage build -platforms goos/goarch[,goos/goarch...] [-o dir]
+           [-mode mode] [-granularity block|func] [-sample percent]
+           [-label label] [-tags tags] [-backend legacy|native|auto] [-keep] package
+
+       Instruments the main package in a copy of the main module, and
+       cross compiles the coverage binaries of it for every platform, e.g.,
+       linux/amd64,linux/arm/v7, into dir (default: dist), as
+       name_goos_goarch, each with a manifest, name_goos_goarch.json,
+       holding the platform, the sha256 of the binary, and the settings it
+       is instrumented with. The platforms which compile the same files
+       share the instrumentation, so it is done once for most of them.
+       The post_build hook of the configuration runs after every binary,
+       with its path, and the path of its manifest, in the environment.
+       With -backend native, or auto on Go 1.20 and later, the binaries
+       are built with go build -cover in the tree as it is instead, and
+       their manifests hold no settings.
+`
+
+// buildCommand instruments the main package, and cross compiles the coverage
+// binaries of it for every one of the platforms, into the output directory,
+// each with a manifest, as configured by the arguments of the build
+// subcommand. The instrumentation is done in a copy of the main module, so that
+// the tree is left untouched, and once for all the platforms, unless they
+// compile different files, as files which are not compiled must never be
+// instrumented, see selectGoFiles.
+func buildCommand(args []string, w io.Writer) (err error) {
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, buildUsage)
+	platformList := fs.String("platforms", "", "The comma separated platforms to build for, e.g. linux/amd64,linux/arm/v7")
+	out := fs.String("o", "dist", "The directory the binaries, and their manifests, are written to")
+	var opts options
+	fs.StringVar(&opts.mode, "mode", "", "The coverage mode: set, count or atomic")
+	fs.StringVar(&opts.granularity, "granularity", granularityBlock, "Instrument with a counter for every block, or for every function only: block or func")
+	fs.Float64Var(&opts.sample, "sample", 100, "The percentage of the blocks to instrument")
+	fs.StringVar(&opts.label, "label", "", "The project label in the coverage report (default: the main module path)")
+	fs.StringVar(&opts.tags, "tags", "", "Instrument, and build, with these comma separated build tags, instead of the ones in GOFLAGS")
+	fs.StringVar(&opts.backend, "backend", "", "Instrument the copies (legacy), build with go build -cover (native), or pick by the go toolchain (auto) (default legacy)")
+	keep := fs.Bool("keep", false, "Keep the instrumented copies of the module")
+	if err = fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *platformList == "" {
+		return errors.New("usage: gobinarycoverage build -platforms goos/goarch[,goos/goarch...] [-o dir] [-mode mode] [-granularity block|func] [-sample percent] [-label label] [-tags tags] [-backend legacy|native|auto] [-keep] package")
+	}
+	mainPackage := fs.Arg(0)
+	c, err := loadConfig(defaultConfigFile)
+	if err != nil {
+		return err
+	}
+	platforms, err := parsePlatforms(*platformList)
+	if err != nil {
+		return err
+	}
+	if *out, err = filepath.Abs(*out); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(*out, 0755); err != nil {
+		return err
+	}
+	if err = syncGoEnv(); err != nil {
+		return err
+	}
+	importPath, err := runCommand("", nil, "go", "list", "-f", "{{.ImportPath}}", mainPackage)
+	if err != nil {
+		return fmt.Errorf("go list %s: %s", mainPackage, err.Error())
+	}
+	name := path.Base(strings.TrimSpace(string(importPath)))
+	if opts.backend == "" {
+		opts.backend = c.Instrument.Backend
+	}
+	if opts.backend, err = resolveBackend(opts.buildContext(), opts.backend); err != nil {
+		return err
+	}
+	if opts.backend == backendNative {
+		return buildNative(mainPackage, name, *out, platforms, opts, c.Hooks, w)
+	}
+
+	//
+	// Group the platforms by the files instrumented for them
+	//
+	var groups [][]platform
+	groupOf := make(map[string]int)
+	for _, p := range platforms {
+		o := opts
+		o.goos, o.goarch = p.goos, p.goarch
+		files, err := platformFiles(mainPackage, o.buildContext())
+		if err != nil {
+			return fmt.Errorf("list the files for %s: %s", p, err.Error())
+		}
+		i, ok := groupOf[files]
+		if !ok {
+			i = len(groups)
+			groupOf[files] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], p)
+	}
+
+	dir, err := ioutil.TempDir("", "gobinarycoverage-build")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil || *keep {
+			fmt.Fprintf(stderr, "build: the instrumented copies are kept in: %s\n", dir)
+			return
+		}
+		os.RemoveAll(dir)
+	}()
+
+	//
+	// Instrument a copy of the module once for every group, and build the
+	// binaries of the platforms in it
+	//
+	for i, group := range groups {
+		o := opts
+		o.goos, o.goarch = group[0].goos, group[0].goarch
+		// The copy is thrown away, even if the module is in a git work tree
+		o.force = true
+		_, workdir, err := inModuleCopy(filepath.Join(dir, fmt.Sprintf("module%d", i)), o.buildContext(), func() error {
+			return instrument(mainPackage, o)
+		})
+		if err != nil {
+			return fmt.Errorf("instrument for %s: %s", group[0], err.Error())
+		}
+		var names []string
+		for _, p := range group {
+			names = append(names, p.String())
+		}
+		fmt.Fprintf(stderr, "build: instrumented once for %s\n", strings.Join(names, ", "))
+		for _, p := range group {
+			binary, manifest, err := buildPlatform(workdir, mainPackage, name, *out, p, opts, nil)
+			if err != nil {
+				return fmt.Errorf("build for %s: %s", p, err.Error())
+			}
+			if err = runHook(c.Hooks, hookPostBuild, benchBinaryEnv+"="+binary, hookManifestEnv+"="+manifest); err != nil {
+				return fmt.Errorf("build for %s: %s", p, err.Error())
+			}
+			fmt.Fprintf(w, "%s\t%s\n", p, binary)
+		}
+	}
+	return nil
+}
+
+// buildNative builds the coverage binaries of the main package mainPackage
+// for the platforms with go build -cover, in the tree as it is, into the
+// directory out, as buildCommand does with the native backend.
+func buildNative(mainPackage, name, out string, platforms []platform, opts options, hooks *hookConfig, w io.Writer) error {
+	if opts.granularity != granularityBlock || opts.sample != 100 {
+		return errors.New("-granularity, and -sample, can not be given with the native backend")
+	}
+	for _, p := range platforms {
+		o := opts
+		o.goos, o.goarch = p.goos, p.goarch
+		flags, err := nativeBuildFlags(mainPackage, o)
+		if err != nil {
+			return fmt.Errorf("list the packages for %s: %s", p, err.Error())
+		}
+		binary, manifest, err := buildPlatform("", mainPackage, name, out, p, opts, flags)
+		if err != nil {
+			return fmt.Errorf("build for %s: %s", p, err.Error())
+		}
+		if err = runHook(hooks, hookPostBuild, benchBinaryEnv+"="+binary, hookManifestEnv+"="+manifest); err != nil {
+			return fmt.Errorf("build for %s: %s", p, err.Error())
+		}
+		fmt.Fprintf(w, "%s\t%s\n", p, binary)
+	}
+	return nil
+}
+
+// buildPlatform builds the instrumented main package mainPackage, in the
+// working directory workdir, for the platform p, with the flags of go build
+// given, into the directory out, as name_goos_goarch, and writes the manifest
+// of it next to it. It returns the paths of the binary, and of the manifest.
+func buildPlatform(workdir, mainPackage, name, out string, p platform, opts options, flags []string) (string, string, error) {
+	opts.goos, opts.goarch = p.goos, p.goarch
+	env := goEnv(opts.buildContext())
+	base := name + "_" + p.goos + "_" + p.goarch
+	if p.goarm != "" {
+		env = append(env, "GOARM="+p.goarm)
+		base += "_v" + p.goarm
+	}
+	binary := filepath.Join(out, base)
+	if p.goos == "windows" {
+		binary += ".exe"
+	}
+	args := append([]string{"build", "-o", binary}, flags...)
+	if _, err := runCommand(workdir, env, "go", append(args, mainPackage)...); err != nil {
+		return "", "", err
+	}
+	contents, err := os.ReadFile(binary)
+	if err != nil {
+		return "", "", err
+	}
+	m := platformManifest{
+		Platform: p.String(),
+		Binary:   filepath.Base(binary),
+		Size:     int64(len(contents)),
+	}
+	sum := sha256.Sum256(contents)
+	m.SHA256 = hex.EncodeToString(sum[:])
+	if opts.backend == backendNative {
+		m.Backend = backendNative
+	} else if m.Settings, err = readSettings(contents); err != nil {
+		return "", "", err
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", "", err
+	}
+	manifestFile := filepath.Join(out, base+".json")
+	if err = os.WriteFile(manifestFile, append(manifest, '\n'), 0644); err != nil {
+		return "", "", err
+	}
+	return binary, manifestFile, nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// goFlags is GOFLAGS, as the go command reads it, in the environment, or set
+// with go env -w, once syncGoEnv is run.
+var goFlags = os.Getenv("GOFLAGS")
+
+// goContext is the build context the ones of buildContext are derived from.
+// It is build.Default, with the GOROOT, GOPATH and build tags of the go
+// command, once syncGoEnv is run. build.Default itself is never modified, as
+// it is shared with the rest of the process, e.g., the programs using
+// pkg/instrument.
+var goContext = build.Default
+
+// goCache is GOCACHE, the build cache of the go command, or "off", once
+// syncGoEnv is run, or "" if it is not known.
+var goCache string
+
+// buildContext returns the build context of the platform which the
+// instrumented binary is built for. By default this is the platform given by
+// GOOS, GOARCH and CGO_ENABLED in the environment, and the build tags given
+// through GOFLAGS, just like for `go build`, unless -goos, -goarch, or -tags,
+// are given. As for `go build`, cgo is disabled when cross compiling, unless
+// CGO_ENABLED is set explicitly.
+func (o options) buildContext() *build.Context {
+	ctx := goContext
+	if o.tags != "" {
+		ctx.BuildTags = splitTags(o.tags)
+	}
+	cross := false
+	if o.goos != "" && o.goos != ctx.GOOS {
+		ctx.GOOS = o.goos
+		cross = true
+	}
+	if o.goarch != "" && o.goarch != ctx.GOARCH {
+		ctx.GOARCH = o.goarch
+		cross = true
+	}
+	if cross && os.Getenv("CGO_ENABLED") == "" {
+		ctx.CgoEnabled = false
+	}
+	return &ctx
+}
+
+// syncGoEnv sets the GOROOT and GOPATH of goContext, and goFlags and goCache,
+// to the ones the go command uses. go/build takes them from the environment
+// only, ignoring the ones set with go env -w, and defaulting GOROOT to the one
+// gobinarycoverage is built with, and passes them on to the go command it runs
+// in module mode, e.g., for the source importer, which would then look for the
+// packages in another toolchain, or module cache. The build tags of goContext
+// are set to the ones given through GOFLAGS, which go/build ignores
+// altogether, so that the files selected are the ones go build compiles.
+func syncGoEnv() error {
+	out, err := runCommand("", nil, "go", "env", "GOROOT", "GOPATH", "GOFLAGS", "GOCACHE")
+	if err != nil {
+		fmt.Fprintf(stderr, "`go env GOROOT GOPATH GOFLAGS GOCACHE` failed. Error: %s\n", err.Error())
+		return err
+	}
+	// GOFLAGS is an empty line, if it is not set
+	lines := strings.Split(strings.TrimSuffix(strings.ReplaceAll(string(out), "\r\n", "\n"), "\n"), "\n")
+	if len(lines) != 4 {
+		return fmt.Errorf("unexpected output from go env: %q", out)
+	}
+	goContext.GOROOT = strings.TrimSpace(lines[0])
+	goContext.GOPATH = strings.TrimSpace(lines[1])
+	goFlags = strings.TrimSpace(lines[2])
+	goContext.BuildTags = goFlagsTags(goFlags)
+	goCache = strings.TrimSpace(lines[3])
+	return nil
+}
+
+// splitTags splits the build tags given as to go build -tags, i.e., comma
+// separated, or space separated, as before go1.13.
+func splitTags(tags string) []string {
+	return strings.FieldsFunc(tags, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// goFlagsTags returns the build tags given by -tags in the GOFLAGS flags, if
+// any.
+func goFlagsTags(flags string) []string {
+	var tags []string
+	for _, f := range strings.Fields(flags) {
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(f, "-"), "=")
+		if hasValue && (name == "tags" || name == "-tags") {
+			tags = splitTags(value)
+		}
+	}
+	return tags
+}
+
+// withTags returns the GOFLAGS flags, with the build tags replaced by tags.
+func withTags(flags string, tags []string) string {
+	var kept []string
+	for _, f := range strings.Fields(flags) {
+		name, _, _ := strings.Cut(strings.TrimPrefix(f, "-"), "=")
+		if name != "tags" && name != "-tags" {
+			kept = append(kept, f)
+		}
+	}
+	return strings.Join(append(kept, "-tags="+strings.Join(tags, ",")), " ")
+}
+
+// goFlagsRace returns true if the go command builds with the race detector
+// through GOFLAGS, in the environment, or set with go env -w.
+func goFlagsRace(ctx *build.Context) bool {
+	goFlags, err := goEnvVar(ctx, "GOFLAGS")
+	if err != nil {
+		return false
+	}
+	for _, f := range strings.Fields(goFlags) {
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(f, "-"), "=")
+		if name != "-race" && name != "race" {
+			continue
+		}
+		race := true
+		if hasValue {
+			race, _ = strconv.ParseBool(value)
+		}
+		return race
+	}
+	return false
+}
+
+// coverageMode returns the coverage mode to instrument in, given the one
+// chosen through -mode, if any, and whether the binary is built with the race
+// detector. The race detector reports the counters as data races, unless they
+// are incremented atomically, so the atomic mode is the default then.
+func coverageMode(mode string, race bool) string {
+	switch {
+	case mode == "" && race:
+		fmt.Fprintln(stderr, "The binary is built with -race, instrumenting in the atomic mode")
+		return "atomic"
+	case mode == "":
+		return "set"
+	case race && mode != "atomic":
+		fmt.Fprintf(stderr, "Warning: the binary is built with -race, but instrumented in the %s mode. "+
+			"The race detector reports the counters as data races, as they are not incremented atomically\n", mode)
+	}
+	return mode
+}
+
+// goEnv returns the environment which runs the go command for the platform,
+// and with the build tags, of the build context ctx. The tags are given
+// through GOFLAGS, along with the other flags in it, so that all the go
+// commands run, e.g., go list, go vet, and go build, select the same files.
+func goEnv(ctx *build.Context) []string {
+	cgo := "0"
+	if ctx.CgoEnabled {
+		cgo = "1"
+	}
+	env := append(os.Environ(),
+		"GOOS="+ctx.GOOS,
+		"GOARCH="+ctx.GOARCH,
+		"CGO_ENABLED="+cgo,
+	)
+	if len(ctx.BuildTags) > 0 {
+		env = append(env, "GOFLAGS="+withTags(goFlags, ctx.BuildTags))
+	}
+	return env
+}
+
+// selectGoFiles returns the Go files in the package p which are compiled for
+// the platform of the build context ctx, and hence are the ones to instrument.
+//
+// Files which are not compiled must never be instrumented, as the generated
+// main file would then refer to GoCover variables which do not exist in the
+// binary. go list reports the files according to the environment it is run
+// in, so all the files it knows of, compiled or ignored, are matched against
+// ctx explicitly.
+func selectGoFiles(ctx *build.Context, p *Package) ([]string, error) {
+	var files []string
+	for _, name := range append(append([]string(nil), p.GoFiles...), p.IgnoredGoFiles...) {
+		match, err := ctx.MatchFile(p.Dir, name)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to match the file %s against the build context. Error: %s\n",
+				name, err.Error())
+			return nil, err
+		}
+		if match {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"go/build"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSelectGoFiles(t *testing.T) {
+	files := map[string]string{
+		"lib.go":         "package lib\n",
+		"lib_linux.go":   "package lib\n",
+		"lib_windows.go": "package lib\n",
+		"lib_darwin.go":  "package lib\n",
+		"lib_arm64.go":   "package lib\n",
+		"unix.go":        "//go:build unix\n\npackage lib\n",
+		"extra.go":       "//go:build extra\n\npackage lib\n",
+		"ignored.go":     "//go:build ignore\n\npackage main\n",
+	}
+	dir := t.TempDir()
+	var names []string
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	// Which of the files go list reports as ignored depends on the platform
+	// it is run on, so all of them are given as both
+	p := &Package{Dir: dir, GoFiles: names[:len(names)/2], IgnoredGoFiles: names[len(names)/2:]}
+
+	tests := []struct {
+		goos, goarch string
+		tags         string
+		want         []string
+	}{
+		{"linux", "amd64", "", []string{"lib.go", "lib_linux.go", "unix.go"}},
+		{"windows", "amd64", "", []string{"lib.go", "lib_windows.go"}},
+		{"darwin", "arm64", "", []string{"lib.go", "lib_arm64.go", "lib_darwin.go", "unix.go"}},
+		{"linux", "amd64", "extra", []string{"extra.go", "lib.go", "lib_linux.go", "unix.go"}},
+		{"windows", "386", "extra,other", []string{"extra.go", "lib.go", "lib_windows.go"}},
+	}
+	for _, test := range tests {
+		t.Run(test.goos+"/"+test.goarch+"/"+test.tags, func(t *testing.T) {
+			ctx := options{goos: test.goos, goarch: test.goarch, tags: test.tags}.buildContext()
+			got, err := selectGoFiles(ctx, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("selectGoFiles() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildContextCgo(t *testing.T) {
+	t.Setenv("CGO_ENABLED", "")
+	native := options{}.buildContext()
+	tests := []struct {
+		name string
+		opts options
+		cgo  bool
+	}{
+		{"native", options{}, native.CgoEnabled},
+		{"same platform", options{goos: native.GOOS, goarch: native.GOARCH}, native.CgoEnabled},
+		{"cross", options{goos: "plan9", goarch: "amd64"}, false},
+	}
+	for _, test := range tests {
+		if ctx := test.opts.buildContext(); ctx.CgoEnabled != test.cgo {
+			t.Errorf("%s: CgoEnabled = %v, want %v", test.name, ctx.CgoEnabled, test.cgo)
+		}
+	}
+}
+
+func TestSyncGoEnv(t *testing.T) {
+	defaults := build.Default
+	saved, savedFlags, savedCache := goContext, goFlags, goCache
+	t.Cleanup(func() { goContext, goFlags, goCache = saved, savedFlags, savedCache })
+	gopath := filepath.Join(t.TempDir(), "gopath")
+	t.Setenv("GOPATH", gopath)
+	t.Setenv("GOFLAGS", "-tags=extra")
+	t.Setenv(listCacheEnv, "")
+	tests := []struct {
+		gocache string
+		list    string
+	}{
+		{filepath.Join(t.TempDir(), "cache"), filepath.Join("gobinarycoverage", "golist")},
+		{"off", ""},
+	}
+	for _, test := range tests {
+		t.Setenv("GOCACHE", test.gocache)
+		if err := syncGoEnv(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(build.Default, defaults) {
+			t.Errorf("build.Default is modified: %+v", build.Default)
+		}
+		ctx := options{}.buildContext()
+		if ctx.GOPATH != gopath || !reflect.DeepEqual(ctx.BuildTags, []string{"extra"}) {
+			t.Errorf("GOPATH = %q, and the tags %q, want %q, and extra", ctx.GOPATH, ctx.BuildTags, gopath)
+		}
+		want := test.list
+		if want != "" {
+			want = filepath.Join(test.gocache, want)
+		}
+		if dir := listCacheDir(); dir != want {
+			t.Errorf("GOCACHE=%s: go list is cached in %q, want %q", test.gocache, dir, want)
+		}
+	}
+}
+
+func TestGoFlagsTags(t *testing.T) {
+	tests := []struct {
+		flags string
+		tags  []string
+		with  string
+	}{
+		{"", nil, "-tags=a"},
+		{"-tags=x,y", []string{"x", "y"}, "-tags=a"},
+		{"-mod=mod --tags=x -trimpath", []string{"x"}, "-mod=mod -trimpath -tags=a"},
+		{"-tags=x -tags=z", []string{"z"}, "-tags=a"},
+		{"-race", nil, "-race -tags=a"},
+	}
+	for _, test := range tests {
+		if tags := goFlagsTags(test.flags); !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("goFlagsTags(%q) = %q, want %q", test.flags, tags, test.tags)
+		}
+		if with := withTags(test.flags, []string{"a"}); with != test.with {
+			t.Errorf("withTags(%q) = %q, want %q", test.flags, with, test.with)
+		}
+	}
+}
+
+func TestSplitTags(t *testing.T) {
+	tests := []struct {
+		tags string
+		want []string
+	}{
+		{"", []string{}},
+		{"a", []string{"a"}},
+		{"a,b", []string{"a", "b"}},
+		{"a b", []string{"a", "b"}},
+		{"a,,b ", []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		if got := splitTags(test.tags); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitTags(%q) = %q, want %q", test.tags, got, test.want)
+		}
+	}
+}
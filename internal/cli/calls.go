@@ -0,0 +1,78 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// callsUsage is the help of the calls subcommand.
+const callsUsage = `
+   gobinarycoverage calls [-pkg pattern] [-n count] profile.out [profile.out...]
+
+       Lists the functions called the most, by the count of their first
+       block, as a cheap profile of what the tests exercise. The binary
+       has to be instrumented with -mode count, or atomic. -pkg and -n
+       are as for uncovered.
+`
+
+// callsCommand lists the functions called the most, as approximated by the
+// count of their first block, as configured by the arguments of the calls
+// subcommand. The profiles have to be in the count, or atomic, mode.
+func callsCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("calls", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, callsUsage)
+	pkg := fs.String("pkg", "", "Only list the functions in the packages matching this pattern, e.g. example.com/app/...")
+	limit := fs.Int("n", 20, "The number of functions to list, or 0 for all")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: gobinarycoverage calls [-pkg pattern] [-n count] profile.out [profile.out...]")
+	}
+	merged, err := loadProfile(fs.Args())
+	if err != nil {
+		return err
+	}
+	if merged.Mode != "count" && merged.Mode != "atomic" {
+		return fmt.Errorf("the profile is in the %s mode, which does not count the calls, instrument with -mode count", merged.Mode)
+	}
+	all, err := profileFuncCoverage(merged, *pkg)
+	if err != nil {
+		return err
+	}
+	var funcs []funcCoverage
+	for _, f := range all {
+		if f.Calls > 0 {
+			funcs = append(funcs, f)
+		}
+	}
+	sort.SliceStable(funcs, func(i, j int) bool {
+		return funcs[i].Calls > funcs[j].Calls
+	})
+	if *limit > 0 && len(funcs) > *limit {
+		funcs = funcs[:*limit]
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, f := range funcs {
+		fmt.Fprintf(tw, "%s:%d\t%s\t%d calls\n", f.File, f.Line, f.Name, f.Calls)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// catUsage is the help of the cat subcommand.
+const catUsage = `
+   gobinarycoverage cat [-color auto|always|never] [-no-color] profile.out [file...]
+
+       Prints the source files in the profile, or the files given, with
+       the covered lines in green, and the uncovered ones in red. The
+       files are named as in the profile, or by a suffix of the name,
+       e.g., lib/lib.go. Run it in the module the profile is from.
+`
+
+// catCommand prints the source files in a profile, with the covered lines in
+// green, and the uncovered ones in red, as configured by the arguments of the
+// cat subcommand.
+func catCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("cat", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, catUsage)
+	colors := colorFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: gobinarycoverage cat [-color auto|always|never] [-no-color] profile.out [file...]")
+	}
+	colored, err := colors(w)
+	if err != nil {
+		return err
+	}
+
+	p, err := loadProfile(fs.Args()[:1])
+	if err != nil {
+		return err
+	}
+	files, err := selectProfileFiles(p, fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+	paths, err := resolveProfileFiles(options{}.buildContext(), files)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for _, file := range files {
+		if err = catFile(bw, paths[file], file, p.LineCounts(file), bool(colored)); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// catFile prints the source file at path, named file in the profile, with
+// every line prefixed by its number, and a marker: '+' for covered lines, '-'
+// for uncovered lines, and blank for the lines holding no statements.
+func catFile(w io.Writer, path, file string, counts map[int]int, colored bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintf(w, "%s\n", file)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		marker, start, end := " ", "", ""
+		if count, ok := counts[line]; ok {
+			marker, start = "+", colorGreen
+			if count == 0 {
+				marker, start = "-", colorRed
+			}
+			if colored {
+				end = colorReset
+			} else {
+				start = ""
+			}
+		}
+		fmt.Fprintf(w, "%5d %s %s%s%s\n", line, marker, start, s.Text(), end)
+	}
+	fmt.Fprintln(w)
+	return s.Err()
+}
+
+// isTerminal returns true if f is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// errBelowThreshold is returned by check when the coverage is below the
+// threshold, in order to exit with its own exit code.
+var errBelowThreshold = errors.New("the coverage is below the threshold")
+
+// checkUsage is the help of the check subcommand.
+const checkUsage = `
+   gobinarycoverage check [-config file] [-min percent] [-codeowners file] [-uninstrumented [-main package]]
+           [-notify url] [-report-url url] [-color auto|always|never] [-no-color] profile.out [profile.out...]
+
+       Checks the coverage of the merge of the profiles given against
+       the thresholds in the configuration file (default
+       ./.gobinarycoverage.yaml), mapping package patterns to minimum
+       percentages, with a default, and teams, as given by CODEOWNERS, to
+       minimum percentages. -min sets the minimum total coverage.
+       -codeowners overrides the CODEOWNERS file. -uninstrumented counts
+       the files which are not instrumented, as for report. Exits with 2 if the coverage is below a threshold, and with 1 on
+       errors. On a terminal, the rows which pass are colored green, and
+       the ones which fail red. -notify posts a summary, with the total,
+       what failed, and the link given with -report-url, to a webhook,
+       e.g. a Slack incoming webhook. GOBINARYCOVERAGE_WEBHOOK_URL sets
+       it, without -notify.
+`
+
+// checkCommand verifies the coverage of the merge of the profiles given
+// against the thresholds in the configuration, as configured by the arguments
+// of the check subcommand, and returns errBelowThreshold if it is below them.
+func checkCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, checkUsage)
+	configFile := fs.String("config", defaultConfigFile, "The configuration file holding the thresholds")
+	minTotal := fs.Float64("min", -1, "The minimum total coverage in percent, overriding the configuration")
+	codeownersFile := fs.String("codeowners", "", "The CODEOWNERS file the teams of the team thresholds are read from, overriding the configuration")
+	notify := notifyFlags(fs)
+	colors := colorFlags(fs)
+	addUninstrumented, _ := uninstrumentedFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: gobinarycoverage check [-config file] [-min percent] [-codeowners file] [-uninstrumented [-main package]] [-notify url] [-report-url url] [-color auto|always|never] [-no-color] profile.out [profile.out...]")
+	}
+	colored, err := colors(w)
+	if err != nil {
+		return err
+	}
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	thresholds := c.Thresholds
+	if *minTotal >= 0 {
+		thresholds.Total = minTotal
+	}
+	if thresholds.Total == nil && thresholds.Default == nil && len(thresholds.Packages) == 0 && len(thresholds.Teams) == 0 {
+		return fmt.Errorf("no thresholds given, through -min or in %s", *configFile)
+	}
+	merged, err := loadProfile(fs.Args())
+	if err != nil {
+		return err
+	}
+	r := profile.Summarize(merged)
+	if err = addUninstrumented(merged, r); err != nil {
+		return err
+	}
+	if r.Sample > 0 {
+		fmt.Fprintln(w, sampledNote(r.Sample))
+	}
+
+	failing, err := evaluateThresholds(w, r, &thresholds, codeownersPath(*codeownersFile, c), colored)
+	if err != nil {
+		return err
+	}
+	outcome := "ok"
+	if len(failing) > 0 {
+		outcome = "FAIL"
+	}
+	notify(&notification{
+		Text:    notificationText("check", outcome, fmt.Sprintf("total %.1f%%", r.Totals.Percent), failing),
+		Command: "check",
+		Passed:  len(failing) == 0,
+		Total:   r.Totals.Percent,
+		Failing: failing,
+	})
+	if len(failing) > 0 {
+		return errBelowThreshold
+	}
+	return nil
+}
+
+// codeownersPath returns the CODEOWNERS file the teams are read from: the one
+// given, or the one in the configuration c, or "" for the one in the
+// repository.
+func codeownersPath(given string, c *config) string {
+	if given != "" {
+		return given
+	}
+	return c.Codeowners
+}
+
+// evaluateThresholds writes the coverage of the packages, and the teams, with
+// thresholds, and of the total, in r against them to w, as a table, with the
+// rows colored if colored is true, and returns the ones below their threshold.
+// The teams are read from the CODEOWNERS file at codeownersFile, if any of
+// them has a threshold.
+func evaluateThresholds(w io.Writer, r *profile.Summary, thresholds *thresholdConfig, codeownersFile string, colored colorizer) ([]string, error) {
+	var failing []string
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	row := func(name string, t profile.Totals, threshold float64) {
+		status, color := "ok", colorGreen
+		if t.Percent < threshold {
+			status, color = "FAIL", colorRed
+			failing = append(failing, fmt.Sprintf("%s %.1f%% (min %.1f%%)", name, t.Percent, threshold))
+		}
+		fmt.Fprint(tw, colored.row(color,
+			fmt.Sprintf("%s\t%.1f%%\t(min %.1f%%)\t%s\n", name, t.Percent, threshold, status)))
+	}
+	for _, pr := range r.Packages {
+		if threshold, ok := thresholds.threshold(pr.ImportPath); ok {
+			row(pr.ImportPath, pr.Totals, threshold)
+		}
+	}
+	if len(thresholds.Teams) > 0 {
+		owners, err := loadCodeowners(codeownersFile)
+		if err != nil {
+			return nil, err
+		}
+		teams, err := summarizeTeams(r, owners)
+		if err != nil {
+			return nil, err
+		}
+		for _, tt := range thresholds.Teams {
+			for _, t := range teams {
+				if t.Team == tt.Team {
+					row("team "+t.Team, t.Totals, tt.Min)
+				}
+			}
+		}
+	}
+	if thresholds.Total != nil {
+		row("total", r.Totals, *thresholds.Total)
+	}
+	return failing, tw.Flush()
+}
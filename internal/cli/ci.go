@@ -0,0 +1,189 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// defaultCIDir is the directory the artifacts of ci are written to, unless
+// another one is given through -o
+const defaultCIDir = "coverage-ci"
+
+// ciSummary is the summary of the coverage written by ci, for the pipelines to
+// read the outcome from, without the blocks of the JSON report.
+type ciSummary struct {
+	Mode     string          `json:"mode"`
+	Sample   float64         `json:"sample,omitempty"`
+	Totals   profile.Totals  `json:"totals"`
+	Packages []ciPackage     `json:"packages"`
+	Check    *ciCheckOutcome `json:"check,omitempty"` // Only if any thresholds are given
+}
+
+type ciPackage struct {
+	ImportPath     string         `json:"import_path"`
+	Uninstrumented bool           `json:"uninstrumented,omitempty"`
+	Totals         profile.Totals `json:"totals"`
+}
+
+// ciCheckOutcome is the outcome of checking the coverage against the
+// thresholds, as by check
+type ciCheckOutcome struct {
+	Passed  bool     `json:"passed"`
+	Failing []string `json:"failing,omitempty"`
+}
+
+// ciUsage is the help of the ci subcommand.
+const ciUsage = `
+   gobinarycoverage ci [-o dir] [-config file] [-min percent] [-codeowners file] [-uninstrumented [-main package]]
+           [-tag key=value,...] profile.out|dir [profile.out|dir...]
+
+       Merges the profiles given, and writes the merged profile, the text,
+       html, json and cobertura reports, and summary.json, holding the
+       totals, and the outcome of the thresholds, into dir (default
+       ./coverage-ci), in a single step for pipelines. The coverage is
+       checked against the thresholds, as by check, if any are given, and
+       ci exits with 2 if it is below a threshold, once everything is
+       written. -uninstrumented counts the files which are not
+       instrumented, as for report.
+`
+
+// ciCommand merges the profiles given, and writes the merged profile, the
+// HTML, Cobertura, and JSON reports, and the summary, into a directory, and
+// checks the coverage against the thresholds in the configuration, as
+// configured by the arguments of the ci subcommand, so that a pipeline takes a
+// single step. It returns errBelowThreshold, once all the artifacts are
+// written, if the coverage is below a threshold.
+func ciCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("ci", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, ciUsage)
+	dir := fs.String("o", defaultCIDir, "Write the artifacts into this directory")
+	configFile := fs.String("config", defaultConfigFile, "The configuration file holding the thresholds")
+	minTotal := fs.Float64("min", -1, "The minimum total coverage in percent, overriding the configuration")
+	codeownersFile := fs.String("codeowners", "", "The CODEOWNERS file the teams of the team thresholds are read from, overriding the configuration")
+	selection := selectionFlags(fs)
+	addUninstrumented, _ := uninstrumentedFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: gobinarycoverage ci [-o dir] [-config file] [-min percent] [-codeowners file] [-uninstrumented [-main package]] [-tag key=value,...] profile.out|dir [profile.out|dir...]")
+	}
+	sel, err := selection()
+	if err != nil {
+		return err
+	}
+	if sel.facet != "" {
+		return errors.New("the artifacts are of a single group of profiles, -facet is not used")
+	}
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	thresholds := c.Thresholds
+	if *minTotal >= 0 {
+		thresholds.Total = minTotal
+	}
+	merged, err := loadSelectedProfile(fs.Args(), sel)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+
+	//
+	// The merged profile, and its sidecar, for the later steps, e.g., compare
+	//
+	name := filepath.Join(*dir, "coverage.out")
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err = merged.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if merged.Schema > 0 {
+		if err = merged.WriteSidecar(name + ".json"); err != nil {
+			return err
+		}
+	}
+
+	r := profile.Summarize(merged)
+	if err = addUninstrumented(merged, r); err != nil {
+		return err
+	}
+	for _, artifact := range []struct {
+		name  string
+		write func(w io.Writer, r *profile.Summary) error
+	}{
+		{"coverage.txt", writeTextReport},
+		{"coverage.html", writeHTMLReport},
+		{"coverage.json", writeJSONReport},
+		{"cobertura.xml", writeCoberturaReport},
+	} {
+		if err = writeReportFile(filepath.Join(*dir, artifact.name), artifact.write, r); err != nil {
+			return err
+		}
+	}
+
+	summary := &ciSummary{Mode: r.Mode, Sample: r.Sample, Totals: r.Totals}
+	for _, pr := range r.Packages {
+		summary.Packages = append(summary.Packages, ciPackage{ImportPath: pr.ImportPath, Uninstrumented: pr.Uninstrumented, Totals: pr.Totals})
+	}
+	if thresholds.Total != nil || thresholds.Default != nil || len(thresholds.Packages) > 0 || len(thresholds.Teams) > 0 {
+		var table bytes.Buffer
+		failing, err := evaluateThresholds(&table, r, &thresholds, codeownersPath(*codeownersFile, c), false)
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(filepath.Join(*dir, "check.txt"), table.Bytes(), 0644); err != nil {
+			return err
+		}
+		summary.Check = &ciCheckOutcome{Passed: len(failing) == 0, Failing: failing}
+	}
+	contents, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(*dir, "summary.json"), append(contents, '\n'), 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "total: %.1f%% of %d statements, the artifacts are in %s\n", r.Totals.Percent, r.Totals.Statements, *dir)
+	if summary.Check == nil {
+		return nil
+	}
+	for _, failed := range summary.Check.Failing {
+		fmt.Fprintf(w, "FAIL %s\n", failed)
+	}
+	if !summary.Check.Passed {
+		return errBelowThreshold
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"encoding/xml"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// coberturaCoverage is the root of the Cobertura XML report, as read by
+// GitLab, Jenkins, and Codecov. Only the lines are reported, as the profiles
+// hold no branches, and the statements of a line are covered together.
+type coberturaCoverage struct {
+	XMLName         xml.Name           `xml:"coverage"`
+	LineRate        float64            `xml:"line-rate,attr"`
+	BranchRate      float64            `xml:"branch-rate,attr"`
+	LinesCovered    int                `xml:"lines-covered,attr"`
+	LinesValid      int                `xml:"lines-valid,attr"`
+	BranchesCovered int                `xml:"branches-covered,attr"`
+	BranchesValid   int                `xml:"branches-valid,attr"`
+	Complexity      float64            `xml:"complexity,attr"`
+	Version         string             `xml:"version,attr"`
+	Timestamp       int64              `xml:"timestamp,attr"`
+	Sources         []string           `xml:"sources>source"`
+	Packages        []coberturaPackage `xml:"packages>package"`
+}
+
+type coberturaPackage struct {
+	Name       string           `xml:"name,attr"`
+	LineRate   float64          `xml:"line-rate,attr"`
+	BranchRate float64          `xml:"branch-rate,attr"`
+	Complexity float64          `xml:"complexity,attr"`
+	Classes    []coberturaClass `xml:"classes>class"`
+}
+
+// coberturaClass is a file, as Cobertura has no other unit for Go
+type coberturaClass struct {
+	Name       string          `xml:"name,attr"`
+	Filename   string          `xml:"filename,attr"`
+	LineRate   float64         `xml:"line-rate,attr"`
+	BranchRate float64         `xml:"branch-rate,attr"`
+	Complexity float64         `xml:"complexity,attr"`
+	Methods    struct{}        `xml:"methods"`
+	Lines      []coberturaLine `xml:"lines>line"`
+}
+
+type coberturaLine struct {
+	Number int `xml:"number,attr"`
+	Hits   int `xml:"hits,attr"`
+}
+
+// summaryLineCounts returns the count of every line of the blocks, as
+// profile.Profile.LineCounts.
+func summaryLineCounts(blocks []profile.BlockSummary) map[int]int {
+	counts := make(map[int]int)
+	for _, b := range blocks {
+		end := b.EndLine
+		if end > b.StartLine && b.EndCol <= 1 {
+			end--
+		}
+		for line := b.StartLine; line <= end; line++ {
+			if count, ok := counts[line]; !ok || b.Count < count {
+				counts[line] = b.Count
+			}
+		}
+	}
+	return counts
+}
+
+// lineRate returns the rate of the lines covered, 1 if there are none, as
+// Cobertura does.
+func lineRate(covered, valid int) float64 {
+	if valid == 0 {
+		return 1
+	}
+	return float64(covered) / float64(valid)
+}
+
+// coberturaSources returns the source the files in the report are relative
+// to, and the function naming them, so that the CI systems find them in the
+// repository: the top level of the git work tree, and the paths in it, if the
+// report is written in one, and the names in the profile otherwise.
+func coberturaSources() (string, func(file string) string) {
+	asIs := func(file string) string { return file }
+	top, err := runCommand("", nil, "git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return ".", asIs
+	}
+	modules, err := listRepoModules(options{}.buildContext(), strings.TrimSpace(string(top)))
+	if err != nil {
+		return ".", asIs
+	}
+	return strings.TrimSpace(string(top)), func(file string) string {
+		if name, ok := repoPath(modules, file); ok {
+			return name
+		}
+		return file
+	}
+}
+
+// writeCoberturaReport writes the coverage of every line as Cobertura XML, for
+// the coverage views of the CI systems.
+func writeCoberturaReport(w io.Writer, r *profile.Summary) error {
+	source, name := coberturaSources()
+	c := coberturaCoverage{Version: getVersionInfo().Version, Timestamp: time.Now().UnixNano() / int64(time.Millisecond), Sources: []string{source}}
+	for _, pr := range r.Packages {
+		pkg := coberturaPackage{Name: pr.ImportPath}
+		pkgCovered, pkgValid := 0, 0
+		for _, fr := range pr.Files {
+			class := coberturaClass{Name: path.Base(fr.Name), Filename: name(fr.Name)}
+			counts := summaryLineCounts(fr.Blocks)
+			covered := 0
+			for line, count := range counts {
+				class.Lines = append(class.Lines, coberturaLine{Number: line, Hits: count})
+				if count > 0 {
+					covered++
+				}
+			}
+			sort.Slice(class.Lines, func(i, j int) bool { return class.Lines[i].Number < class.Lines[j].Number })
+			class.LineRate = lineRate(covered, len(counts))
+			pkgCovered += covered
+			pkgValid += len(counts)
+			pkg.Classes = append(pkg.Classes, class)
+		}
+		pkg.LineRate = lineRate(pkgCovered, pkgValid)
+		c.LinesCovered += pkgCovered
+		c.LinesValid += pkgValid
+		c.Packages = append(c.Packages, pkg)
+	}
+	c.LineRate = lineRate(c.LinesCovered, c.LinesValid)
+	if _, err := io.WriteString(w, xml.Header+`<!DOCTYPE coverage SYSTEM "http://cobertura.sourceforge.net/xml/coverage-04.dtd">`+"\n"); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// cobraPackage is the import path of cobra, the commands of which are wired to
+// write the coverage once they are executed, see runtimesrc/cobra.go
+const cobraPackage = "github.com/spf13/cobra"
+
+// wireCobra returns true if the main package, depending on the packages deps,
+// sorted, depends on a version of cobra with OnFinalize, i.e., 1.6.0, or
+// later, so that the runtime can write the coverage once the command given is
+// executed. Cobra is looked up in its sources, rather than by its version, so
+// that forks, and vendored copies, are wired too.
+func wireCobra(ctx *build.Context, deps []string) (bool, error) {
+	if i := sort.SearchStrings(deps, cobraPackage); i == len(deps) || deps[i] != cobraPackage {
+		return false, nil
+	}
+	listed, err := listPackages(ctx, []string{cobraPackage})
+	if err != nil {
+		return false, err
+	}
+	for _, p := range listed {
+		for _, name := range p.GoFiles {
+			src, err := os.ReadFile(filepath.Join(p.Dir, name))
+			if err != nil {
+				return false, err
+			}
+			if bytes.Contains(src, []byte("\nfunc OnFinalize(")) {
+				return true, nil
+			}
+		}
+	}
+	fmt.Fprintf(stderr, "Warning: the version of cobra has no OnFinalize, so the coverage is not written once the command is executed, run it through coverage.Execute\n")
+	return false, nil
+}
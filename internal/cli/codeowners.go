@@ -0,0 +1,284 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// unownedTeam is the team the files without an owner in CODEOWNERS are
+// accounted to
+const unownedTeam = "(unowned)"
+
+// codeownersLocations are where CODEOWNERS is looked for in the root of the
+// repository, in the order GitHub looks for it.
+var codeownersLocations = []string{
+	".github/CODEOWNERS",
+	"CODEOWNERS",
+	"docs/CODEOWNERS",
+}
+
+// codeownersRule is a line of CODEOWNERS: the files matching a pattern, and
+// their owners
+type codeownersRule struct {
+	re     *regexp.Regexp
+	owners []string
+}
+
+// codeowners are the owners of the files in the repository at root, as given
+// by its CODEOWNERS file. As in GitHub, the last rule matching a file wins.
+type codeowners struct {
+	root  string
+	rules []codeownersRule
+}
+
+// loadCodeowners reads the CODEOWNERS file at path, or, if path is "", the one
+// in the root of the git work tree of the working directory.
+func loadCodeowners(path string) (*codeowners, error) {
+	if path == "" {
+		out, err := runCommand("", nil, "git", "rev-parse", "--show-toplevel")
+		if err != nil {
+			return nil, fmt.Errorf("no CODEOWNERS given, and not in a git work tree: %s", err.Error())
+		}
+		root := strings.TrimSpace(string(out))
+		for _, location := range codeownersLocations {
+			if _, err = os.Stat(filepath.Join(root, location)); err == nil {
+				path = filepath.Join(root, location)
+				break
+			}
+		}
+		if path == "" {
+			return nil, fmt.Errorf("no CODEOWNERS file in %s", root)
+		}
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// The patterns are relative to the root of the repository, which
+	// CODEOWNERS is in, or in the .github, or docs directory of
+	c := &codeowners{root: filepath.Dir(path)}
+	if base := filepath.Base(c.root); base == ".github" || base == "docs" {
+		c.root = filepath.Dir(c.root)
+	}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		re, err := codeownersPattern(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err.Error())
+		}
+		rule := codeownersRule{re: re}
+		for _, owner := range fields[1:] {
+			if strings.HasPrefix(owner, "#") {
+				break
+			}
+			rule.owners = append(rule.owners, owner)
+		}
+		c.rules = append(c.rules, rule)
+	}
+	return c, s.Err()
+}
+
+// codeownersPattern returns the regular expression matching the paths,
+// relative to the root of the repository, which the CODEOWNERS pattern
+// matches. The patterns are as in .gitignore: a pattern without a slash, but
+// at its end, matches at any depth, '*' does not match a slash, while '**'
+// does, and a directory matches all the files in it. As in GitHub, a pattern
+// ending in "/*", e.g., docs/*, matches the files directly in the directory
+// only, and not the ones in its subdirectories.
+func codeownersPattern(pattern string) (*regexp.Regexp, error) {
+	p := strings.TrimSuffix(pattern, "/")
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		return nil, fmt.Errorf("invalid pattern: %s", pattern)
+	}
+	var re strings.Builder
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(p); i++ {
+		switch {
+		case strings.HasPrefix(p[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case p[i] == '*':
+			re.WriteString("[^/]*")
+		case p[i] == '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	if !strings.HasSuffix(p, "/*") {
+		re.WriteString("(/.*)?")
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// owners returns the owners of the file at path, or nil if it has none
+func (c *codeowners) owners(path string) []string {
+	rel, err := filepath.Rel(c.root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil
+	}
+	rel = filepath.ToSlash(rel)
+	for i := len(c.rules) - 1; i >= 0; i-- {
+		if c.rules[i].re.MatchString(rel) {
+			return c.rules[i].owners
+		}
+	}
+	return nil
+}
+
+// teamCoverage is the coverage of the files owned by a team
+type teamCoverage struct {
+	Team   string         `json:"team"`
+	Totals profile.Totals `json:"totals"`
+}
+
+// summarizeTeams sums up the coverage of the files in the report r by the
+// teams owning them, as given by c. A file owned by several teams counts for
+// every one of them, and the files without an owner for unownedTeam. The
+// sources are found through go list. The teams are sorted.
+func summarizeTeams(r *profile.Summary, c *codeowners) ([]teamCoverage, error) {
+	var files []string
+	for _, pr := range r.Packages {
+		for _, fr := range pr.Files {
+			files = append(files, fr.Name)
+		}
+	}
+	paths, err := resolveProfileFiles(options{}.buildContext(), files)
+	if err != nil {
+		return nil, err
+	}
+	teams := make(map[string]*profile.Totals)
+	for _, pr := range r.Packages {
+		for _, fr := range pr.Files {
+			owners := c.owners(paths[fr.Name])
+			if len(owners) == 0 {
+				owners = []string{unownedTeam}
+			}
+			for _, owner := range owners {
+				t, ok := teams[owner]
+				if !ok {
+					t = &profile.Totals{}
+					teams[owner] = t
+				}
+				t.Add(fr.Totals.Statements, fr.Totals.Covered)
+			}
+		}
+	}
+	var coverage []teamCoverage
+	for team, t := range teams {
+		coverage = append(coverage, teamCoverage{Team: team, Totals: *t})
+	}
+	sort.Slice(coverage, func(i, j int) bool { return coverage[i].Team < coverage[j].Team })
+	return coverage, nil
+}
+
+// reportTeams writes the coverage of every team owning the files in the
+// profiles, selected by sel, as given by the CODEOWNERS file at
+// codeownersFile, in the format, text, json or csv, to the file at out, or to
+// w, colored if c is true, if out is "".
+func reportTeams(w io.Writer, out, format, codeownersFile string, profiles []string, sel profileSelection, c colorizer) error {
+	if format != "text" && format != "json" && format != "csv" {
+		return fmt.Errorf("the team report is written as text, json or csv, not %s", format)
+	}
+	owners, err := loadCodeowners(codeownersFile)
+	if err != nil {
+		return err
+	}
+	merged, err := loadSelectedProfile(profiles, sel)
+	if err != nil {
+		return err
+	}
+	teams, err := summarizeTeams(profile.Summarize(merged), owners)
+	if err != nil {
+		return err
+	}
+	if out != "" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		if err = writeTeamReport(f, format, teams, false); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	return writeTeamReport(w, format, teams, c)
+}
+
+// writeTeamReport writes the coverage of the teams in the format, text, json
+// or csv, colored by their coverage, if c is true.
+func writeTeamReport(w io.Writer, format string, teams []teamCoverage, c colorizer) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(teams)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"team", "statements", "covered", "percent"})
+		for _, t := range teams {
+			cw.Write([]string{
+				t.Team,
+				strconv.Itoa(t.Totals.Statements),
+				strconv.Itoa(t.Totals.Covered),
+				strconv.FormatFloat(t.Totals.Percent, 'f', 1, 64),
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "text":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		for _, t := range teams {
+			fmt.Fprint(tw, c.row(percentColor(t.Totals.Percent),
+				fmt.Sprintf("%s\t%d/%d\t%.1f%%\n", t.Team, t.Totals.Covered, t.Totals.Statements, t.Totals.Percent)))
+		}
+		return tw.Flush()
+	}
+	return errors.New("unknown format: " + format)
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCodeownersPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		matches []string
+		misses  []string
+	}{
+		{
+			pattern: "*",
+			matches: []string{"main.go", "cmd/app/main.go"},
+		},
+		{
+			pattern: "*.go",
+			matches: []string{"main.go", "cmd/app/main.go"},
+			misses:  []string{"main.go.orig", "Readme.md"},
+		},
+		{
+			pattern: "docs/*",
+			matches: []string{"docs/getting-started.md"},
+			misses:  []string{"docs/build-app/troubleshooting.md", "src/docs/a.md"},
+		},
+		{
+			pattern: "/docs/",
+			matches: []string{"docs/a.md", "docs/build-app/troubleshooting.md"},
+			misses:  []string{"src/docs/a.md"},
+		},
+		{
+			pattern: "apps/",
+			matches: []string{"apps/a.go", "src/apps/nested/a.go"},
+			misses:  []string{"myapps/a.go"},
+		},
+		{
+			pattern: "docs/**",
+			matches: []string{"docs/a.md", "docs/build-app/troubleshooting.md"},
+		},
+		{
+			pattern: "**/logs",
+			matches: []string{"logs/a.log", "build/logs/a.log", "deep/build/logs/nested/a.log"},
+			misses:  []string{"logsx/a.log"},
+		},
+		{
+			pattern: "/internal/cli/*.go",
+			matches: []string{"internal/cli/report.go"},
+			misses:  []string{"internal/cli/runtimesrc/report.go", "x/internal/cli/report.go"},
+		},
+		{
+			pattern: "lib/file?.go",
+			matches: []string{"lib/file1.go"},
+			misses:  []string{"lib/file10.go", "lib/file/.go"},
+		},
+		{
+			pattern: "ünï côde/",
+			matches: []string{"ünï côde/a b.go", "x/ünï côde/a.go"},
+			misses:  []string{"ünï/a.go"},
+		},
+		{
+			pattern: "a+b.go",
+			matches: []string{"a+b.go"},
+			misses:  []string{"aab.go"},
+		},
+	}
+	for _, test := range tests {
+		re, err := codeownersPattern(test.pattern)
+		if err != nil {
+			t.Fatalf("codeownersPattern(%q): %s", test.pattern, err)
+		}
+		for _, path := range test.matches {
+			if !re.MatchString(path) {
+				t.Errorf("%q does not match %q", test.pattern, path)
+			}
+		}
+		for _, path := range test.misses {
+			if re.MatchString(path) {
+				t.Errorf("%q matches %q", test.pattern, path)
+			}
+		}
+	}
+	for _, pattern := range []string{"/", "//"} {
+		if _, err := codeownersPattern(pattern); err == nil {
+			t.Errorf("codeownersPattern(%q) is not an error", pattern)
+		}
+	}
+}
+
+func TestCodeownersOwners(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "repo")
+	path := filepath.Join(root, ".github", "CODEOWNERS")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	contents := `# Owners of the repository
+*            @org/all
+*.md         @org/docs # The docs
+docs/*       @org/writers
+/internal/   @org/core @org/reviewers
+/internal/cli/generated.go
+`
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadCodeowners(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		file   string
+		owners []string
+	}{
+		{"main.go", []string{"@org/all"}},
+		{"Readme.md", []string{"@org/docs"}},
+		{"docs/index.md", []string{"@org/writers"}},
+		{"docs/nested/index.md", []string{"@org/docs"}},
+		{"internal/cli/report.go", []string{"@org/core", "@org/reviewers"}},
+		// The last matching pattern, which has no owners, wins
+		{"internal/cli/generated.go", nil},
+	}
+	for _, test := range tests {
+		owners := c.owners(filepath.Join(root, filepath.FromSlash(test.file)))
+		if !reflect.DeepEqual(owners, test.owners) {
+			t.Errorf("owners(%q) = %q, want %q", test.file, owners, test.owners)
+		}
+	}
+	if owners := c.owners(filepath.Join(filepath.Dir(root), "other", "main.go")); owners != nil {
+		t.Errorf("the file outside the repository is owned by %q", owners)
+	}
+}
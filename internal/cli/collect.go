@@ -0,0 +1,456 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// The files kept in the directory of the collector
+const (
+	collectUploadPattern = "upload-*.out"
+	collectMergedFile    = "merged.out"
+)
+
+// collector receives coverage profiles uploaded by the instrumented binaries,
+// and maintains the merge of all of them, per module, and build. The profiles
+// of a module are kept in the subdirectory named by its path, and the ones
+// uploaded without a module in the directory itself. The build of a profile
+// is kept in its sidecar, and the merge of every build in merged-<build>.out,
+// next to merged.out, which is the merge of the profiles of unknown builds.
+type collector struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	modules map[collectKey]*collectedModule
+}
+
+// collectKey identifies the merge the profiles of a module, and build, are
+// merged into. Either is empty if unknown.
+type collectKey struct {
+	module, build string
+}
+
+// collectedModule is the merge of the profiles uploaded for a module, and
+// build
+type collectedModule struct {
+	merged   *profile.Profile
+	blocks   map[string]map[profile.BlockKey]bool // The blocks of merged, by file, see checkBlocksLineUp
+	profiles int
+}
+
+// newCollectedModule returns the empty merge of a module, and build.
+func newCollectedModule() *collectedModule {
+	return &collectedModule{merged: &profile.Profile{}, blocks: make(map[string]map[profile.BlockKey]bool)}
+}
+
+// merge returns the merge of the profile p into the one of m, and its blocks,
+// by file, or an error if p can not be merged into it, as it is of another
+// mode, or build, or its blocks do not line up with the ones of m. m itself is
+// left as it is, so that nothing of the profiles rejected is merged.
+func (m *collectedModule) merge(p *profile.Profile) (*profile.Profile, map[string]map[profile.BlockKey]bool, error) {
+	if err := checkBuild(p.Build); err != nil {
+		return nil, nil, err
+	}
+	// The blocks of a file are never changed, but only added along with it
+	blocks := make(map[string]map[profile.BlockKey]bool, len(m.blocks))
+	for file, keys := range m.blocks {
+		blocks[file] = keys
+	}
+	if err := checkBlocksLineUp(blocks, p); err != nil {
+		return nil, nil, err
+	}
+	merged := &profile.Profile{}
+	err := merged.Merge(m.merged)
+	if err == nil {
+		err = merged.Merge(p)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return merged, blocks, nil
+}
+
+// collectSummary is the response of the summary endpoint, and an element of
+// the response of the builds endpoint
+type collectSummary struct {
+	Build    string  `json:"build,omitempty"`
+	Profiles int     `json:"profiles"`
+	Mode     string  `json:"mode,omitempty"`
+	Covered  int     `json:"covered"`
+	Total    int     `json:"total"`
+	Coverage float64 `json:"coverage"` // In percent
+}
+
+// collectUsage is the help of the collect subcommand.
+const collectUsage = `
+   gobinarycoverage collect [-listen addr] [-dir dir] [-max-size bytes] [-mqtt-broker host:port]
+
+       Runs the collector server, which receives the coverage profiles
+       uploaded by instrumented binaries over HTTP, on addr (default
+       :9099), and stores them in dir (default ./profiles). The profiles
+       are validated, and merged into dir/merged.out as they arrive.
+
+       POST /profiles   Upload a profile, as the body of the request
+       GET  /merged     The merged profile
+       GET  /summary    The coverage of the merged profile, as JSON
+       GET  /builds     The coverage of the merged profile of every build
+
+       The profiles of different builds of the binaries, e.g., firmware
+       versions, given by the build parameter of the upload, or the build
+       in the MQTT message, are never merged, but into their own
+       dir/merged-<build>.out, which /merged and /summary serve with the
+       build parameter.
+
+       With -mqtt-broker, the profiles published by binaries instrumented
+       with -mqtt-broker, on -mqtt-topic (default gobinarycoverage) followed
+       by the device, are ingested as well. -mqtt-username gives the user
+       on the broker, whose password is read from
+       GOBINARYCOVERAGE_MQTT_PASSWORD, and -meta the metadata decoding the
+       profiles published in the compact format.
+`
+
+// collect runs the collector server, as configured by the arguments of the
+// collect subcommand.
+func collect(args []string) error {
+	fs := flag.NewFlagSet("collect", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, collectUsage)
+	listen := fs.String("listen", ":9099", "The address to listen on")
+	dir := fs.String("dir", "profiles", "The directory to store the profiles in")
+	maxSize := fs.Int64("max-size", 64<<20, "The maximum size of an uploaded profile, in bytes")
+	broker := fs.String("mqtt-broker", "", "Ingest the profiles published to this MQTT broker as well, e.g. broker:1883")
+	topic := fs.String("mqtt-topic", "gobinarycoverage", "The topic the profiles are published to, followed by the device")
+	username := fs.String("mqtt-username", "", "The username on the MQTT broker, whose password is read from GOBINARYCOVERAGE_MQTT_PASSWORD")
+	metaFile := fs.String("meta", "", "Decode the profiles published in the compact format with this metadata")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := newCollector(*dir, *maxSize)
+	if err != nil {
+		return err
+	}
+	errs := make(chan error, 2)
+	if *broker != "" {
+		s := &mqttSubscriber{
+			broker:   *broker,
+			topic:    *topic + "/#",
+			username: *username,
+			password: os.Getenv("GOBINARYCOVERAGE_MQTT_PASSWORD"),
+		}
+		if *metaFile != "" {
+			contents, err := os.ReadFile(*metaFile)
+			if err != nil {
+				return err
+			}
+			s.meta = &compactMeta{}
+			if err = json.Unmarshal(contents, s.meta); err != nil {
+				return fmt.Errorf("%s: %s", *metaFile, err.Error())
+			}
+		}
+		go func() { errs <- s.run(c) }()
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/profiles", c.handleUpload)
+	mux.HandleFunc("/merged", c.handleMerged)
+	mux.HandleFunc("/summary", c.handleSummary)
+	mux.HandleFunc("/builds", c.handleBuilds)
+	fmt.Fprintf(stderr, "collect: listening on %s, storing the profiles in %s\n", *listen, *dir)
+	go func() { errs <- http.ListenAndServe(*listen, mux) }()
+	return <-errs
+}
+
+// newCollector creates the collector storing the profiles in dir, and merges
+// the profiles uploaded to it already, so that a restarted collector carries
+// on with the same aggregates.
+func newCollector(dir string, maxSize int64) (*collector, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &collector{dir: dir, maxSize: maxSize, modules: make(map[collectKey]*collectedModule)}
+	found, err := findProfiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	for module, uploads := range found {
+		if checkModuleDir(module) != nil {
+			continue
+		}
+		for _, upload := range uploads {
+			p, err := profile.ParseFile(upload)
+			key := collectKey{module, ""}
+			var m *collectedModule
+			var merged *profile.Profile
+			var blocks map[string]map[profile.BlockKey]bool
+			if err == nil {
+				key.build = p.Build
+				if m = c.modules[key]; m == nil {
+					m = newCollectedModule()
+				}
+				merged, blocks, err = m.merge(p)
+			}
+			if err != nil {
+				fmt.Fprintf(stderr, "collect: skipping the profile %s. Error: %s\n", upload, err.Error())
+				continue
+			}
+			m.merged, m.blocks = merged, blocks
+			m.profiles++
+			c.modules[key] = m
+		}
+	}
+	for key, m := range c.modules {
+		if m.profiles == 0 {
+			delete(c.modules, key)
+			continue
+		}
+		if err = c.writeMerged(key); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(stderr, "collect: merged %d profiles from %s\n", m.profiles, c.mergedFile(key))
+	}
+	return c, nil
+}
+
+// requestKey returns the module, and the build, given in the module, and the
+// build parameters of the request, which are empty if there are none.
+func requestKey(r *http.Request) (collectKey, error) {
+	key := collectKey{r.URL.Query().Get("module"), r.URL.Query().Get("build")}
+	err := checkModuleDir(key.module)
+	if err == nil {
+		err = checkBuild(key.build)
+	}
+	return key, err
+}
+
+// moduleDir returns the directory the profiles of module are kept in
+func (c *collector) moduleDir(module string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(module))
+}
+
+// handleUpload validates the profile in the body of the request, stores it,
+// and merges it into the aggregate.
+func (c *collector) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, c.maxSize))
+	if err != nil {
+		http.Error(w, "failed to read the profile: "+err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	p, err := profile.Parse(bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, "invalid profile: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name, err := c.ingest(key, p, body)
+	if errors.Is(err, errInvalidProfile) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to store the profile", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(stderr, "collect: received %s from %s\n", name, r.RemoteAddr)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// errInvalidProfile is returned by ingest for the profiles which can not be
+// merged into the aggregate of their module.
+var errInvalidProfile = errors.New("invalid profile")
+
+// ingest merges the profile p, with the contents body, received for the
+// module, and the build, of key, into their aggregate, and stores it. The
+// build, and the tags, are kept in the sidecar of the profile stored. The
+// profile is validated before anything is stored, and nothing is merged, or
+// left behind, if it fails to be. It returns the name of the file the profile
+// is stored in.
+func (c *collector) ingest(key collectKey, p *profile.Profile, body []byte) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p.Build = key.build
+	m, ok := c.modules[key]
+	if !ok {
+		m = newCollectedModule()
+	}
+	if m.merged.Mode != "" && m.merged.Mode != p.Mode {
+		return "", fmt.Errorf("%w: the profile is in mode %q, expected %q", errInvalidProfile, p.Mode, m.merged.Mode)
+	}
+	merged, blocks, err := m.merge(p)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", errInvalidProfile, err.Error())
+	}
+	name, err := c.store(key, p, body)
+	if err != nil {
+		fmt.Fprintf(stderr, "collect: failed to store the profile. Error: %s\n", err.Error())
+		return "", err
+	}
+	m.merged, m.blocks = merged, blocks
+	m.profiles++
+	c.modules[key] = m
+	if err = c.writeMerged(key); err != nil {
+		fmt.Fprintf(stderr, "collect: failed to write the merged profile. Error: %s\n", err.Error())
+	}
+	return filepath.Base(name), nil
+}
+
+// store writes the profile p, with the contents body, to a new file in the
+// directory of the module of key, along with its sidecar, if it has a build,
+// or tags, and returns the path of the file. Neither is left behind if it
+// fails.
+func (c *collector) store(key collectKey, p *profile.Profile, body []byte) (string, error) {
+	if err := os.MkdirAll(c.moduleDir(key.module), 0755); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(c.moduleDir(key.module), collectUploadPattern)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && (key.build != "" || len(p.Tags) > 0) {
+		err = p.WriteSidecar(f.Name() + ".json")
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		os.Remove(f.Name() + ".json")
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// handleMerged serves the merged profile
+func (c *collector) handleMerged(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.modules[key]
+	if !ok {
+		http.Error(w, "no profiles received yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	m.merged.Write(w)
+}
+
+// handleSummary serves the coverage of the merged profile, as JSON
+func (c *collector) handleSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	s := c.summary(key)
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// handleBuilds serves the coverage of the merged profile of every build of the
+// module, as JSON, sorted by build
+func (c *collector) handleBuilds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := requestKey(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	builds := []collectSummary{}
+	for k := range c.modules {
+		if k.module == key.module {
+			builds = append(builds, c.summary(k))
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(builds, func(i, j int) bool { return builds[i].Build < builds[j].Build })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(builds)
+}
+
+// summary returns the coverage of the merged profile of key. It must be called
+// with the lock held.
+func (c *collector) summary(key collectKey) collectSummary {
+	s := collectSummary{Build: key.build}
+	if m, ok := c.modules[key]; ok {
+		s.Profiles, s.Mode = m.profiles, m.merged.Mode
+		s.Covered, s.Total = m.merged.Coverage(m.merged.Counted)
+	}
+	if s.Total > 0 {
+		s.Coverage = 100 * float64(s.Covered) / float64(s.Total)
+	}
+	return s
+}
+
+// mergedFile returns the path of the merged profile of key, i.e., merged.out,
+// or merged-<build>.out, in the directory of the module.
+func (c *collector) mergedFile(key collectKey) string {
+	if key.build == "" {
+		return filepath.Join(c.moduleDir(key.module), collectMergedFile)
+	}
+	return filepath.Join(c.moduleDir(key.module), strings.TrimSuffix(collectMergedFile, ".out")+"-"+key.build+".out")
+}
+
+// writeMerged replaces the merged profile of key in the directory of the
+// module. It must be called with the lock held.
+func (c *collector) writeMerged(key collectKey) error {
+	path := c.mergedFile(key)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// writeFileAtomic keeps the mode of an existing file
+		if err = os.WriteFile(path, nil, 0644); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(path, c.modules[key].merged.Write)
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// TestCollectUpload uploads profiles to the collector, one after the other,
+// and verifies that the ones rejected are neither stored, nor merged.
+func TestCollectUpload(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newCollector(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads := []struct {
+		name   string
+		query  string
+		body   string
+		status int
+	}{
+		{
+			name:   "first",
+			body:   "mode: set\nexample.com/m/a.go:3.14,5.2 1 1\nexample.com/m/a.go:7.14,9.2 1 0\n",
+			status: http.StatusCreated,
+		},
+		{
+			name:   "same blocks",
+			body:   "mode: set\nexample.com/m/a.go:3.14,5.2 1 0\nexample.com/m/a.go:7.14,9.2 1 1\n",
+			status: http.StatusCreated,
+		},
+		{
+			name:   "other blocks",
+			body:   "mode: set\nexample.com/m/a.go:3.14,6.2 1 1\nexample.com/m/a.go:7.14,9.2 1 1\n",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "other mode",
+			body:   "mode: count\nexample.com/m/a.go:3.14,5.2 1 4\nexample.com/m/a.go:7.14,9.2 1 0\n",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "invalid build",
+			query:  "?build=..",
+			body:   "mode: set\nexample.com/m/a.go:3.14,5.2 1 1\nexample.com/m/a.go:7.14,9.2 1 0\n",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "invalid profile",
+			body:   "mode: set\nexample.com/m/a.go:3.14 1 1\n",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "build",
+			query:  "?build=v1",
+			body:   "mode: count\nexample.com/m/a.go:3.14,6.2 1 2\n",
+			status: http.StatusCreated,
+		},
+	}
+	for _, u := range uploads {
+		r := httptest.NewRequest(http.MethodPost, "/profiles"+u.query, strings.NewReader(u.body))
+		w := httptest.NewRecorder()
+		c.handleUpload(w, r)
+		if w.Code != u.status {
+			t.Errorf("%s: status %d, expected %d: %s", u.name, w.Code, u.status, w.Body.String())
+		}
+	}
+
+	stored, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, path := range stored {
+		name := filepath.Base(path)
+		if strings.HasPrefix(name, "upload-") {
+			name = "upload-" + name[strings.LastIndex(name, "."):]
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	expected := []string{"merged-v1.out", "merged.out", "upload-.json", "upload-.out", "upload-.out", "upload-.out"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("stored %v, expected %v", names, expected)
+	}
+
+	merged, err := profile.ParseFile(filepath.Join(dir, collectMergedFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if covered, total := merged.Coverage(merged.Counted); covered != 2 || total != 2 {
+		t.Errorf("merged %d of %d blocks covered, expected 2 of 2", covered, total)
+	}
+
+	// A restarted collector carries on with the profiles stored
+	c, err = newCollector(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []collectKey{{"", ""}, {"", "v1"}} {
+		s := c.summary(key)
+		expected := map[string]int{"": 2, "v1": 1}[key.build]
+		if s.Profiles != expected {
+			t.Errorf("build %q: %d profiles merged after the restart, expected %d", key.build, s.Profiles, expected)
+		}
+	}
+}
+
+// TestCollectStoreFails verifies that nothing is merged if the profile can not
+// be stored.
+func TestCollectStoreFails(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newCollector(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := profile.Parse(strings.NewReader("mode: set\nexample.com/m/a.go:3.14,5.2 1 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The directory of the module can not be created, as a file is in its way
+	c.dir = filepath.Join(dir, "file")
+	if err = os.WriteFile(c.dir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.ingest(collectKey{"example.com/m", ""}, p, []byte("mode: set\n")); err == nil {
+		t.Fatal("expected the profile to fail to be stored")
+	}
+	if s := c.summary(collectKey{"example.com/m", ""}); s.Profiles != 0 {
+		t.Errorf("%d profiles merged, expected none", s.Profiles)
+	}
+}
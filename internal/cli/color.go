@@ -0,0 +1,89 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The ANSI escape codes of the colors of the output. The colors are all of the
+// same length, so that the rows of a table, colored all alike, stay aligned by
+// tabwriter, which counts them as text.
+const (
+	colorGreen   = "\x1b[32m"
+	colorRed     = "\x1b[31m"
+	colorYellow  = "\x1b[33m"
+	colorDefault = "\x1b[39m"
+	colorReset   = "\x1b[0m"
+)
+
+// The coverage, in percent, at or above which the report colors a package, or
+// a file, green, and below which it colors it red, and yellow in between.
+const (
+	colorGoodPercent = 80
+	colorPoorPercent = 50
+)
+
+// colorizer colors the rows of the output, if it is true
+type colorizer bool
+
+// row returns row in color, before its trailing newline, if c is true. Every
+// row of a table has to be colored, with colorDefault for the ones without a
+// color of their own, for the table to stay aligned.
+func (c colorizer) row(color, row string) string {
+	if !c {
+		return row
+	}
+	text := strings.TrimSuffix(row, "\n")
+	return color + text + colorReset + row[len(text):]
+}
+
+// percentColor returns the color of the coverage percent
+func percentColor(percent float64) string {
+	switch {
+	case percent >= colorGoodPercent:
+		return colorGreen
+	case percent < colorPoorPercent:
+		return colorRed
+	}
+	return colorYellow
+}
+
+// colorFlags adds the -color, and -no-color flags to fs. The function returned
+// tells, once fs is parsed, whether to color the output written to w: always,
+// never, or by default, if w is a terminal, and NO_COLOR is not set.
+func colorFlags(fs *flag.FlagSet) func(w io.Writer) (colorizer, error) {
+	color := fs.String("color", "auto", "Color the output: auto, always or never")
+	noColor := fs.Bool("no-color", false, "Do not color the output, as -color never")
+	return func(w io.Writer) (colorizer, error) {
+		if *noColor {
+			return false, nil
+		}
+		switch *color {
+		case "always":
+			return true, nil
+		case "never":
+			return false, nil
+		case "auto":
+			f, ok := w.(*os.File)
+			return colorizer(ok && isTerminal(f) && os.Getenv("NO_COLOR") == ""), nil
+		}
+		return false, fmt.Errorf("invalid -color: %s", *color)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// compactMagic starts every compact profile, followed by the version of the
+// format. See runtimesrc/compact.go for the format.
+const compactMagic = "GBCC\x01"
+
+// compactMeta is the metadata of the compact profiles, which is written when
+// instrumenting, and kept on the host, in order to decode them. The files are
+// in the order their counters are written in.
+type compactMeta struct {
+	ID    string            `json:"id"`
+	Mode  string            `json:"mode"`
+	Files []compactMetaFile `json:"files"`
+}
+
+type compactMetaFile struct {
+	Name   string   `json:"name"`   // As in the profile
+	Blocks [][5]int `json:"blocks"` // Start line, start column, end line, end column, and statements
+}
+
+// writeCompactMeta writes the metadata of the compact profiles of the binary
+// instrumented as described by cover to path, and returns its ID. The ID is
+// derived from the blocks, so that the profiles of a binary instrumented
+// differently are never decoded with it.
+func writeCompactMeta(path string, cover *Cover) (string, error) {
+	meta := compactMeta{Mode: cover.Mode}
+	for _, ci := range cover.CoverInfo {
+		for _, cv := range ci.sortedVars() {
+			blocks, err := parseCoverBlocks(cv.Path, cv.Var)
+			if err != nil {
+				return "", fmt.Errorf("%s: %s", cv.Path, err.Error())
+			}
+			meta.Files = append(meta.Files, compactMetaFile{Name: cv.File, Blocks: blocks})
+		}
+	}
+	files, err := json.Marshal(meta.Files)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(files)
+	meta.ID = hex.EncodeToString(sum[:8])
+	contents, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	return meta.ID, os.WriteFile(path, append(contents, '\n'), 0644)
+}
+
+// readCompactMeta reads the metadata written by writeCompactMeta from path
+func readCompactMeta(path string) (*compactMeta, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	meta := &compactMeta{}
+	if err = json.Unmarshal(contents, meta); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return meta, nil
+}
+
+// parseCoverBlocks returns the blocks of the GoCover variable name, in the
+// file at path instrumented by go tool cover, from the Pos and NumStmt arrays
+// it is initialized with.
+func parseCoverBlocks(path, name string) ([][5]int, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	var pos, numStmt []int
+	ast.Inspect(f, func(n ast.Node) bool {
+		vs, ok := n.(*ast.ValueSpec)
+		if !ok || len(vs.Names) != 1 || vs.Names[0].Name != name || len(vs.Values) != 1 {
+			return true
+		}
+		lit, ok := vs.Values[0].(*ast.CompositeLit)
+		if !ok {
+			return false
+		}
+		for _, elt := range lit.Elts {
+			kv, ok := elt.(*ast.KeyValueExpr)
+			if !ok {
+				continue
+			}
+			key, _ := kv.Key.(*ast.Ident)
+			values, _ := kv.Value.(*ast.CompositeLit)
+			if key == nil || values == nil {
+				continue
+			}
+			ints := make([]int, 0, len(values.Elts))
+			for _, v := range values.Elts {
+				if bl, ok := v.(*ast.BasicLit); ok && bl.Kind == token.INT {
+					i, err := strconv.ParseUint(bl.Value, 0, 32)
+					if err == nil {
+						ints = append(ints, int(i))
+					}
+				}
+			}
+			switch key.Name {
+			case "Pos":
+				pos = ints
+			case "NumStmt":
+				numStmt = ints
+			}
+		}
+		return false
+	})
+	if len(pos) != 3*len(numStmt) {
+		return nil, fmt.Errorf("the blocks of %s are not found", name)
+	}
+	blocks := make([][5]int, len(numStmt))
+	for i := range numStmt {
+		// The columns are packed into the third value, as in coverRegisterFile
+		blocks[i] = [5]int{pos[3*i], pos[3*i+2] & 0xFFFF, pos[3*i+1], pos[3*i+2] >> 16, numStmt[i]}
+	}
+	return blocks, nil
+}
+
+// decodeCompactProfile reconstructs the full profile from the compact profile
+// in r, with the metadata meta. The format does not depend on the byte order,
+// or the word size, of the target which wrote it, see runtimesrc/compact.go.
+// The counters are 32 bit in the runtime, so a count beyond that is malformed.
+func decodeCompactProfile(r io.Reader, meta *compactMeta) (*profile.Profile, error) {
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(contents, []byte(compactMagic)) {
+		return nil, errors.New("not a compact profile")
+	}
+	contents = contents[len(compactMagic):]
+	if len(contents) < 8 || hex.EncodeToString(contents[:8]) != meta.ID {
+		return nil, errors.New("the profile is not of the binary the metadata is of")
+	}
+	buf := bytes.NewReader(contents[8:])
+	n, err := binary.ReadUvarint(buf)
+	if err != nil {
+		return nil, fmt.Errorf("truncated profile: %s", err.Error())
+	}
+	total := 0
+	for _, file := range meta.Files {
+		total += len(file.Blocks)
+	}
+	if n != uint64(total) {
+		return nil, fmt.Errorf("the profile holds %d counters, but the metadata has %d blocks", n, total)
+	}
+	counts := make([]int, total)
+	for i := 0; ; i++ {
+		skipped, err := binary.ReadUvarint(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("truncated profile: %s", err.Error())
+		}
+		count, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return nil, fmt.Errorf("truncated profile: %s", io.ErrUnexpectedEOF.Error())
+		}
+		if skipped >= uint64(total-i) {
+			return nil, errors.New("the profile holds more counters than the metadata")
+		}
+		if count > math.MaxUint32 {
+			return nil, fmt.Errorf("malformed count: %d", count)
+		}
+		i += int(skipped)
+		// An int is 32 bit on some hosts, where the largest counts saturate
+		if count > math.MaxInt {
+			count = math.MaxInt
+		}
+		counts[i] = int(count)
+	}
+
+	p := &profile.Profile{Mode: meta.Mode}
+	i := 0
+	for _, file := range meta.Files {
+		for _, b := range file.Blocks {
+			p.Blocks = append(p.Blocks, profile.Block{
+				File:      file.Name,
+				StartLine: b[0],
+				StartCol:  b[1],
+				EndLine:   b[2],
+				EndCol:    b[3],
+				NumStmt:   b[4],
+				Count:     counts[i],
+			})
+			i++
+		}
+	}
+	return p, nil
+}
+
+// decodeUsage is the help of the decode subcommand.
+const decodeUsage = `
+   gobinarycoverage decode -meta meta.json [-o file] profile.cov [profile.cov...]
+
+       Reconstructs the full profile from the compact profiles written by
+       a binary instrumented with -compact meta.json, merged, and writes
+       it to file, or stdout.
+`
+
+// decodeCommand reconstructs the profile from one or more compact profiles,
+// merged, as configured by the arguments of the decode subcommand.
+func decodeCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, decodeUsage)
+	metaFile := fs.String("meta", "", "The metadata written when instrumenting with -compact")
+	out := fs.String("o", "", "Write the profile to this file, instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *metaFile == "" || fs.NArg() < 1 {
+		return errors.New("usage: gobinarycoverage decode -meta meta.json [-o file] profile.cov [profile.cov...]")
+	}
+	meta, err := readCompactMeta(*metaFile)
+	if err != nil {
+		return err
+	}
+	merged := &profile.Profile{}
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		p, err := decodeCompactProfile(f, meta)
+		f.Close()
+		if err == nil {
+			err = merged.Merge(p)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	if *out == "" {
+		return merged.Write(w)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err = merged.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// compactTarget is a platform the compact profiles are written on, by its
+// byte order, and the size of its words, in bits
+type compactTarget struct {
+	name     string
+	order    binary.ByteOrder
+	wordSize int
+}
+
+var compactTargets = []compactTarget{
+	{"amd64", binary.LittleEndian, 64},
+	{"386", binary.LittleEndian, 32},
+	{"s390x", binary.BigEndian, 64},
+	{"mips", binary.BigEndian, 32},
+}
+
+// encodeCompact encodes the counters of the files, as coverWriteCompactProfile
+// does on the target: the counters are loaded from memory in the byte order of
+// the target, and the numbers are held in its words.
+func encodeCompact(target compactTarget, id string, files [][]uint32) []byte {
+	word := func(v uint64) uint64 {
+		if target.wordSize == 32 {
+			return uint64(uint32(v))
+		}
+		return v
+	}
+	var out bytes.Buffer
+	out.WriteString(compactMagic)
+	raw, _ := hex.DecodeString(id)
+	out.Write(raw)
+	uvarint := func(v uint64) {
+		v = word(v)
+		for v >= 0x80 {
+			out.WriteByte(byte(v) | 0x80)
+			v = word(v >> 7)
+		}
+		out.WriteByte(byte(v))
+	}
+	var n uint64
+	for _, counts := range files {
+		n = word(n + uint64(len(counts)))
+	}
+	uvarint(n)
+	var skipped uint64
+	for _, counts := range files {
+		// The counters as they are in the memory of the target
+		mem := make([]byte, 4*len(counts))
+		for i, count := range counts {
+			target.order.PutUint32(mem[4*i:], count)
+		}
+		for i := range counts {
+			count := target.order.Uint32(mem[4*i:])
+			if count == 0 {
+				skipped = word(skipped + 1)
+				continue
+			}
+			uvarint(skipped)
+			uvarint(uint64(count))
+			skipped = 0
+		}
+	}
+	return out.Bytes()
+}
+
+// compactTestMeta returns the metadata of files with the given numbers of
+// blocks
+func compactTestMeta(blocks ...int) *compactMeta {
+	meta := &compactMeta{ID: "0123456789abcdef", Mode: "count"}
+	for i, n := range blocks {
+		file := compactMetaFile{Name: "example.com/lib/f" + string(rune('a'+i)) + ".go"}
+		for j := 0; j < n; j++ {
+			file.Blocks = append(file.Blocks, [5]int{j + 1, 2, j + 1, 10, 1})
+		}
+		meta.Files = append(meta.Files, file)
+	}
+	return meta
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		files [][]uint32
+	}{
+		{"no files", nil},
+		{"no counters", [][]uint32{{}, {}}},
+		{"none hit", [][]uint32{{0, 0, 0}, {0}}},
+		{"all hit", [][]uint32{{1, 2, 3}, {4}}},
+		{"sparse", [][]uint32{{0, 0, 7, 0}, {0, 0, 0}, {0, 1}}},
+		{"multi-byte counts", [][]uint32{{127, 128, 300, 1 << 21, 1<<28 + 5}}},
+		{"largest count", [][]uint32{{math.MaxUint32, 0, math.MaxUint32 - 1}}},
+		{"long run skipped", [][]uint32{append(make([]uint32, 1000), 9)}},
+	}
+	for _, test := range tests {
+		var blocks []int
+		for _, counts := range test.files {
+			blocks = append(blocks, len(counts))
+		}
+		meta := compactTestMeta(blocks...)
+		var native []byte
+		for _, target := range compactTargets {
+			t.Run(test.name+"/"+target.name, func(t *testing.T) {
+				encoded := encodeCompact(target, meta.ID, test.files)
+				// Nothing depends on the byte order, or the word size
+				if native == nil {
+					native = encoded
+				} else if !bytes.Equal(encoded, native) {
+					t.Errorf("encoded as %x, and as %x on %s", encoded, native, compactTargets[0].name)
+				}
+				p, err := decodeCompactProfile(bytes.NewReader(encoded), meta)
+				if err != nil {
+					t.Fatal(err)
+				}
+				i := 0
+				for _, counts := range test.files {
+					for _, count := range counts {
+						b := p.Blocks[i]
+						// An int is 32 bit on some hosts, where the largest
+						// counts saturate
+						want := uint64(count)
+						if want > math.MaxInt {
+							want = math.MaxInt
+						}
+						if uint64(b.Count) != want {
+							t.Errorf("block %d of %s counted %d, want %d", i, b.File, b.Count, want)
+						}
+						i++
+					}
+				}
+				if i != len(p.Blocks) {
+					t.Errorf("decoded %d blocks, want %d", len(p.Blocks), i)
+				}
+			})
+		}
+	}
+}
+
+func TestCompactGolden(t *testing.T) {
+	// The counters 0, 5, 0, 0, 300 of two files, as written on every target:
+	// the magic, and version, the ID, 5 counters, and the pairs of counters
+	// skipped, and counts, as uvarints
+	golden := "GBCC\x01" + "\x01\x23\x45\x67\x89\xab\xcd\xef" + "\x05" + "\x01\x05" + "\x02\xac\x02"
+	files := [][]uint32{{0, 5, 0}, {0, 300}}
+	for _, target := range compactTargets {
+		if encoded := encodeCompact(target, "0123456789abcdef", files); string(encoded) != golden {
+			t.Errorf("%s: encoded as %x, want %x", target.name, encoded, golden)
+		}
+	}
+	p, err := decodeCompactProfile(strings.NewReader(golden), compactTestMeta(3, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counts []int
+	for _, b := range p.Blocks {
+		counts = append(counts, b.Count)
+	}
+	if want := []int{0, 5, 0, 0, 300}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("decoded the counts %v, want %v", counts, want)
+	}
+}
+
+func TestCompactDecodeErrors(t *testing.T) {
+	const header = "GBCC\x01\x01\x23\x45\x67\x89\xab\xcd\xef"
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"not compact", "mode: set\n", "not a compact profile"},
+		{"other version", "GBCC\x02\x01\x23\x45\x67\x89\xab\xcd\xef\x02", "not a compact profile"},
+		{"other binary", "GBCC\x01\x00\x00\x00\x00\x00\x00\x00\x00\x02", "not of the binary"},
+		{"no counters", header, "truncated profile"},
+		{"other number of counters", header + "\x03", "holds 3 counters, but the metadata has 2 blocks"},
+		{"count missing", header + "\x02\x00", "truncated profile"},
+		{"too many counters", header + "\x02\x02\x01", "more counters than the metadata"},
+		{"count too large", header + "\x02\x00\x80\x80\x80\x80\x10", "malformed count"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decodeCompactProfile(strings.NewReader(test.input), compactTestMeta(2))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("decodeCompactProfile() error = %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+// TestCompactHost instruments the selftest project with -compact, and runs it
+// on the host, so that the profile is written by the runtime itself, and
+// decoded. The selftest runs it through QEMU on the foreign targets as well.
+func TestCompactHost(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds, and runs, an instrumented binary")
+	}
+	target := runtime.GOOS + "/" + runtime.GOARCH
+	if err := selftestCompact(filepath.Join(t.TempDir(), "compact"), target); err != nil {
+		t.Fatal(err)
+	}
+}
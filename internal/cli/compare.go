@@ -0,0 +1,133 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// errRegression is returned by compare when the coverage dropped, in order to
+// exit with its own exit code.
+var errRegression = errors.New("the coverage dropped")
+
+// compareUsage is the help of the compare subcommand.
+const compareUsage = `
+   gobinarycoverage compare [-tolerance points] [-notify url] [-report-url url] [-color auto|always|never] [-no-color]
+           old.out new.out
+
+       Compares the coverage of two profiles, and reports the packages
+       and files whose coverage dropped by more than the tolerance in
+       percentage points (default 0), the blocks which were covered in
+       old.out, and no longer are, and the overall delta. Exits with 2 if
+       the coverage dropped, and with 1 on errors, for use as a CI gate.
+       On a terminal, the drops are colored red, and the total green, or
+       red if it dropped beyond the tolerance, or yellow within it.
+       -notify posts a summary to a webhook, as for check.
+`
+
+// compareCommand compares the coverage of two profiles, as configured by the
+// arguments of the compare subcommand, and returns errRegression if it
+// dropped.
+func compareCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, compareUsage)
+	tolerance := fs.Float64("tolerance", 0, "The drop in percentage points allowed, before it is a regression")
+	notify := notifyFlags(fs)
+	colors := colorFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("usage: gobinarycoverage compare [-tolerance points] [-notify url] [-report-url url] [-color auto|always|never] [-no-color] old.out new.out")
+	}
+	colored, err := colors(w)
+	if err != nil {
+		return err
+	}
+	oldProfile, err := loadProfile(fs.Args()[:1])
+	if err != nil {
+		return err
+	}
+	newProfile, err := loadProfile(fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+	d := profile.Compare(oldProfile, newProfile, *tolerance)
+
+	//
+	// Report
+	//
+	if d.Old.Sample > 0 {
+		fmt.Fprintln(w, sampledNote(d.Old.Sample))
+	}
+	if d.New.Sample > 0 && d.New.Sample != d.Old.Sample {
+		fmt.Fprintln(w, sampledNote(d.New.Sample))
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if len(d.Drops) > 0 {
+		fmt.Fprintln(tw, "Coverage dropped:")
+		for _, drop := range d.Drops {
+			fmt.Fprint(tw, colored.row(colorRed, fmt.Sprintf("    %s\t%.1f%%\t->  %.1f%%\t(%+.1f)\n",
+				drop.Name, drop.Old.Percent, drop.New.Percent, drop.New.Percent-drop.Old.Percent)))
+		}
+	}
+	if len(d.Uncovered) > 0 {
+		fmt.Fprintln(tw, "Newly uncovered blocks:")
+		for _, b := range d.Uncovered {
+			fmt.Fprint(tw, colored.row(colorRed, fmt.Sprintf("    %s:%d.%d,%d.%d\t%d statements\n",
+				b.File, b.StartLine, b.StartCol, b.EndLine, b.EndCol, b.NumStmt)))
+		}
+	}
+	// The total is yellow if it dropped within the tolerance
+	color := colorGreen
+	switch {
+	case d.Regressed(*tolerance):
+		color = colorRed
+	case d.Delta() < 0:
+		color = colorYellow
+	}
+	fmt.Fprint(tw, colored.row(color,
+		fmt.Sprintf("total\t%.1f%%\t->  %.1f%%\t(%+.1f)\n", d.Old.Totals.Percent, d.New.Totals.Percent, d.Delta())))
+	if err = tw.Flush(); err != nil {
+		return err
+	}
+	var failing []string
+	for _, drop := range d.Drops {
+		failing = append(failing, fmt.Sprintf("%s %.1f%% -> %.1f%%", drop.Name, drop.Old.Percent, drop.New.Percent))
+	}
+	outcome, delta := "ok", d.Delta()
+	if d.Regressed(*tolerance) {
+		outcome = "the coverage dropped"
+	}
+	notify(&notification{
+		Text: notificationText("compare", outcome,
+			fmt.Sprintf("total %.1f%% -> %.1f%% (%+.1f)", d.Old.Totals.Percent, d.New.Totals.Percent, delta), failing),
+		Command: "compare",
+		Passed:  !d.Regressed(*tolerance),
+		Total:   d.New.Totals.Percent,
+		Delta:   &delta,
+		Failing: failing,
+	})
+	if d.Regressed(*tolerance) {
+		return errRegression
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+)
+
+// completionShells are the shells completion scripts can be generated for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// completionFlag is a command line flag, as given to the completion templates.
+type completionFlag struct {
+	Name        string
+	Description string
+	File        bool // The flag takes a file name as its argument
+	Arg         bool // The flag takes an argument
+}
+
+// completionData is passed to the completion templates.
+type completionData struct {
+	Subcommands []subcommand
+	Flags       []completionFlag
+	Shells      []string
+}
+
+// isBoolFlag mirrors the flag package's check for flags without arguments.
+type isBoolFlag interface {
+	IsBoolFlag() bool
+}
+
+// completion writes the completion script for shell to w. The script completes
+// the subcommands, the flags, and the package patterns, where the packages are
+// listed by `go list ./...` at completion time.
+func completion(shell string, w io.Writer) error {
+	tmpl, ok := completionTemplates[shell]
+	if !ok {
+		return fmt.Errorf("unsupported shell: %q, expected one of: %s",
+			shell, strings.Join(completionShells, ", "))
+	}
+	data := completionData{Subcommands: subcommands, Shells: completionShells}
+	flag.VisitAll(func(f *flag.Flag) {
+		b, isBool := f.Value.(isBoolFlag)
+		data.Flags = append(data.Flags, completionFlag{
+			Name:        f.Name,
+			Description: f.Usage,
+			File:        fileFlags[f.Name],
+			Arg:         !isBool || !b.IsBoolFlag(),
+		})
+	})
+	t, err := template.New(shell).Funcs(template.FuncMap{
+		"join": strings.Join,
+		"quote": func(s string) string {
+			return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+		},
+		// Escape the characters which are special in zsh _arguments specs
+		"zshescape": strings.NewReplacer("[", `\[`, "]", `\]`, ":", `\:`).Replace,
+	}).Parse(tmpl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, data)
+}
+
+var completionTemplates = map[string]string{
+	"bash": `# bash completion for gobinarycoverage
+#
+# Install with: source <(gobinarycoverage completion bash)
+
+_gobinarycoverage() {
+	local cur prev
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	prev="${COMP_WORDS[COMP_CWORD-1]}"
+	case "$prev" in
+{{- range .Flags}}{{if .Arg}}
+	-{{.Name}}|--{{.Name}})
+		{{if .File}}COMPREPLY=($(compgen -f -- "$cur")){{else}}COMPREPLY=(){{end}}
+		return
+		;;
+{{- end}}{{end}}
+	completion)
+		COMPREPLY=($(compgen -W "{{join .Shells " "}}" -- "$cur"))
+		return
+		;;
+	esac
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W "{{range .Flags}}-{{.Name}} {{end}}" -- "$cur"))
+		return
+	fi
+	COMPREPLY=($(compgen -W "{{range .Subcommands}}{{.Name}} {{end}}$(go list -e ./... 2>/dev/null)" -- "$cur"))
+}
+
+complete -F _gobinarycoverage gobinarycoverage
+`,
+	"zsh": `#compdef gobinarycoverage
+#
+# Install with: gobinarycoverage completion zsh > "${fpath[1]}/_gobinarycoverage"
+
+_gobinarycoverage_packages() {
+	local -a packages
+	packages=(${(f)"$(go list -e ./... 2>/dev/null)"})
+	_describe -t packages 'package' packages
+}
+
+_gobinarycoverage() {
+	local -a subcommands
+	subcommands=(
+{{- range .Subcommands}}
+		{{quote (printf "%s:%s" .Name .Description)}}
+{{- end}}
+	)
+	local state
+	_arguments \
+{{- range .Flags}}
+		{{quote (printf "-%s[%s]%s" .Name (zshescape .Description) (or (and .File ":file:_files") (and .Arg ":value: ") ""))}} \
+{{- end}}
+		'1: :->first' \
+		'*:: :->args'
+	case $state in
+	first)
+		_describe -t subcommands 'subcommand' subcommands
+		_gobinarycoverage_packages
+		;;
+	args)
+		case $words[1] in
+		completion)
+			_values 'shell'{{range .Shells}} {{.}}{{end}}
+			;;
+		*)
+			_gobinarycoverage_packages
+			;;
+		esac
+		;;
+	esac
+}
+
+_gobinarycoverage "$@"
+`,
+	"fish": `# fish completion for gobinarycoverage
+#
+# Install with: gobinarycoverage completion fish > ~/.config/fish/completions/gobinarycoverage.fish
+
+complete -c gobinarycoverage -f
+{{- range .Subcommands}}
+complete -c gobinarycoverage -n __fish_use_subcommand -a {{.Name}} -d {{quote .Description}}
+{{- end}}
+complete -c gobinarycoverage -n __fish_use_subcommand -a '(go list -e ./... 2>/dev/null)' -d package
+complete -c gobinarycoverage -n '__fish_seen_subcommand_from completion' -a '{{join .Shells " "}}'
+{{- range .Flags}}
+complete -c gobinarycoverage -o {{.Name}}{{if .File}} -r -F{{else if .Arg}} -r{{end}} -d {{quote .Description}}
+{{- end}}
+`,
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strings"
+)
+
+// maxConcurrentListed is the number of the packages starting goroutines which
+// are named in the warning of warnConcurrentMode
+const maxConcurrentListed = 3
+
+// startsGoroutines returns true if any of the files of the package p has a go
+// statement.
+func startsGoroutines(p *Package) (bool, error) {
+	fset := token.NewFileSet()
+	for _, name := range p.GoFiles {
+		f, err := parser.ParseFile(fset, filepath.Join(p.Dir, name), nil, 0)
+		if err != nil {
+			return false, err
+		}
+		found := false
+		ast.Inspect(f, func(n ast.Node) bool {
+			if _, ok := n.(*ast.GoStmt); ok {
+				found = true
+			}
+			return !found
+		})
+		if found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// warnConcurrentMode warns if the main package, or any of the packages to be
+// instrumented, start goroutines, while the counters are not incremented
+// atomically, i.e., in the count mode, or in the set mode, unless it is given
+// explicitly through explicit. The counts of the blocks run concurrently are
+// lost in the count mode, and the counters are set in data races in the set
+// mode, so the atomic mode is suggested.
+func warnConcurrentMode(ctx *build.Context, mode string, explicit bool, main *Package, packages []string) error {
+	if mode == "atomic" || mode == "set" && explicit {
+		return nil
+	}
+	var concurrent []string
+	check := func(p *Package) error {
+		found, err := startsGoroutines(p)
+		if found {
+			concurrent = append(concurrent, p.ImportPath)
+		}
+		return err
+	}
+	if err := check(main); err != nil {
+		return err
+	}
+	for _, name := range packages {
+		p, err := getFilesInPackage(name, ctx)
+		if err != nil {
+			return err
+		}
+		if err = check(p); err != nil {
+			return err
+		}
+	}
+	if len(concurrent) == 0 {
+		return nil
+	}
+	listed := concurrent
+	if len(listed) > maxConcurrentListed {
+		listed = append(listed[:maxConcurrentListed:maxConcurrentListed], fmt.Sprintf("and %d more", len(concurrent)-maxConcurrentListed))
+	}
+	advice := "the counts of the blocks run concurrently are lost. Instrument with -mode atomic"
+	if mode == "set" {
+		advice = "the counters are set in data races. Instrument with -mode atomic, or give -mode set in order to keep it"
+	}
+	fmt.Fprintf(stderr, "Warning: goroutines are started in %s, and the counters are not incremented atomically in the %s mode, so %s\n",
+		strings.Join(listed, ", "), mode, advice)
+	return nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is the configuration file read from the working
+// directory, unless another one is given through -config, and written by init.
+const defaultConfigFile = ".gobinarycoverage.yaml"
+
+// defaultConfigFiles are the configuration files looked for in the working
+// directory, in order, when the default one is read. The JSON one is read as
+// YAML, which it is a subset of.
+var defaultConfigFiles = []string{defaultConfigFile, ".gobinarycoverage.yml", ".gobinarycoverage.json"}
+
+// config is the configuration file of gobinarycoverage
+type config struct {
+	Instrument instrumentConfig `json:"instrument" yaml:"instrument"`
+	Thresholds thresholdConfig  `json:"thresholds" yaml:"thresholds"`
+	Codeowners string           `json:"codeowners,omitempty" yaml:"codeowners,omitempty"` // The CODEOWNERS file the teams are read from, instead of the one in the repository
+	Hooks      *hookConfig      `json:"hooks,omitempty" yaml:"hooks,omitempty"`
+}
+
+// instrumentConfig holds the defaults of the options of the instrumentation,
+// which the ones given on the command line override.
+type instrumentConfig struct {
+	Mode          string   `json:"mode,omitempty" yaml:"mode,omitempty"`
+	ExcludePkg    []string `json:"exclude_pkg,omitempty" yaml:"exclude_pkg,omitempty"`       // As -exclude-pkg
+	IncludePkg    []string `json:"include_pkg,omitempty" yaml:"include_pkg,omitempty"`       // As -include-pkg
+	ExcludeFile   []string `json:"exclude_file,omitempty" yaml:"exclude_file,omitempty"`     // As -exclude-file
+	IncludeFile   []string `json:"include_file,omitempty" yaml:"include_file,omitempty"`     // As -include-file
+	TotalPkg      []string `json:"total_pkg,omitempty" yaml:"total_pkg,omitempty"`           // As -total-pkg
+	Dir           string   `json:"dir,omitempty" yaml:"dir,omitempty"`                       // As -dir
+	ReportFormats []string `json:"report_formats,omitempty" yaml:"report_formats,omitempty"` // As -report-formats
+	Backend       string   `json:"backend,omitempty" yaml:"backend,omitempty"`               // As -backend
+}
+
+// thresholdConfig holds the minimum coverage, in percent, of the packages,
+// and of the total.
+type thresholdConfig struct {
+	Total    *float64           `json:"total,omitempty" yaml:"total,omitempty"`
+	Default  *float64           `json:"default,omitempty" yaml:"default,omitempty"`
+	Packages []packageThreshold `json:"packages,omitempty" yaml:"packages,omitempty"`
+	Teams    []teamThreshold    `json:"teams,omitempty" yaml:"teams,omitempty"`
+}
+
+// packageThreshold is the minimum coverage of the packages matching Pattern.
+// The patterns are import paths, in which '...' matches any string, like in
+// the patterns of the go command, e.g., github.com/org/app/installer/...
+type packageThreshold struct {
+	Pattern string  `json:"pattern" yaml:"pattern"`
+	Min     float64 `json:"min" yaml:"min"`
+}
+
+// teamThreshold is the minimum coverage of the files owned by Team, as given
+// by CODEOWNERS, e.g. @org/team, or (unowned) for the files without an owner
+type teamThreshold struct {
+	Team string  `json:"team" yaml:"team"`
+	Min  float64 `json:"min" yaml:"min"`
+}
+
+// loadConfig reads the YAML configuration file at path. If path is the
+// default file, the first of the defaultConfigFiles found is read, and the
+// empty configuration is returned if there is none.
+func loadConfig(path string) (*config, error) {
+	c := &config{}
+	if path == defaultConfigFile {
+		found := false
+		for _, name := range defaultConfigFiles {
+			if _, err := os.Stat(name); err == nil {
+				path, found = name, true
+				break
+			}
+		}
+		if !found {
+			return c, nil
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if len(doc.Content) == 0 {
+		// The file is empty, or only holds comments
+		return c, nil
+	}
+	if err = expandConfigEnv(&doc); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if err = checkConfigFields(&doc, reflect.TypeOf(c)); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if err = doc.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return c, nil
+}
+
+// checkConfigFields returns an error on the first key in the YAML node n, or
+// in the ones nested in it, which is not a field of the type t, by its yaml
+// tag, so that the misspelled ones fail, rather than being ignored.
+func checkConfigFields(n *yaml.Node, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	switch n.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, item := range n.Content {
+			if err := checkConfigFields(item, t); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		fields := make(map[string]reflect.Type, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+			fields[name] = t.Field(i).Type
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			field, ok := fields[key.Value]
+			if !ok {
+				return fmt.Errorf("line %d: unknown field %q", key.Line, key.Value)
+			}
+			if err := checkConfigFields(n.Content[i+1], field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// configEnvRef matches the references to the environment variables in the
+// configuration, ${VAR}, or ${VAR:-default}, and the escaped ones, $${VAR}
+var configEnvRef = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandConfigEnv replaces the references to the environment variables in the
+// values of the YAML node n, and of the ones nested in it, by the values of
+// the variables, so that a single configuration is used across CI, and the
+// machines of the developers, e.g., dir: ${COVERAGE_DIR:-/var/lib/gobinarycoverage}.
+// The values are expanded once parsed, so that they need no quoting, and the
+// plain ones are typed by what they are expanded to, e.g., min: ${MIN:-80}.
+// The references to the variables which are not set, and have no default, are
+// errors. $${VAR} is left as ${VAR}, e.g., for the hooks to expand, as is $VAR.
+func expandConfigEnv(n *yaml.Node) error {
+	var unset []string
+	var expand func(n *yaml.Node)
+	expand = func(n *yaml.Node) {
+		for _, item := range n.Content {
+			expand(item)
+		}
+		if n.Kind != yaml.ScalarNode || !configEnvRef.MatchString(n.Value) {
+			return
+		}
+		n.Value = configEnvRef.ReplaceAllStringFunc(n.Value, func(ref string) string {
+			if strings.HasPrefix(ref, "$$") {
+				return ref[1:]
+			}
+			m := configEnvRef.FindStringSubmatch(ref)
+			if value, ok := os.LookupEnv(m[1]); ok && (value != "" || !strings.Contains(ref, ":-")) {
+				return value
+			} else if strings.Contains(ref, ":-") {
+				return m[3]
+			}
+			unset = append(unset, fmt.Sprintf("%s (line %d)", m[1], n.Line))
+			return ref
+		})
+		if n.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			// Resolved again, by the value expanded
+			n.Tag = ""
+		}
+	}
+	expand(n)
+	if len(unset) > 0 {
+		return fmt.Errorf("the environment variables referenced are not set: %s, "+
+			"set them, or give a default, as in ${VAR:-default}", strings.Join(unset, ", "))
+	}
+	return nil
+}
+
+// applyInstrumentConfig sets the options in opts which are not given on the
+// command line, as listed by the Visit of fs, to the ones in the configuration
+// file at path, if any.
+func applyInstrumentConfig(fs *flag.FlagSet, opts *options, path string) error {
+	c, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if !given["mode"] && c.Instrument.Mode != "" {
+		opts.mode = c.Instrument.Mode
+	}
+	if !given["exclude-pkg"] && len(c.Instrument.ExcludePkg) > 0 {
+		opts.excludePkg = strings.Join(c.Instrument.ExcludePkg, ",")
+	}
+	if !given["include-pkg"] && len(c.Instrument.IncludePkg) > 0 {
+		opts.includePkg = strings.Join(c.Instrument.IncludePkg, ",")
+	}
+	if !given["exclude-file"] && len(c.Instrument.ExcludeFile) > 0 {
+		opts.excludeFile = strings.Join(c.Instrument.ExcludeFile, ",")
+	}
+	if !given["include-file"] && len(c.Instrument.IncludeFile) > 0 {
+		opts.includeFile = strings.Join(c.Instrument.IncludeFile, ",")
+	}
+	if !given["total-pkg"] && len(c.Instrument.TotalPkg) > 0 {
+		opts.totalPkg = strings.Join(c.Instrument.TotalPkg, ",")
+	}
+	if !given["dir"] && c.Instrument.Dir != "" {
+		opts.dir = c.Instrument.Dir
+	}
+	if !given["report-formats"] && len(c.Instrument.ReportFormats) > 0 {
+		opts.reportFormats = strings.Join(c.Instrument.ReportFormats, ",")
+	}
+	if !given["backend"] && c.Instrument.Backend != "" {
+		opts.backend = c.Instrument.Backend
+	}
+	return nil
+}
+
+// threshold returns the minimum coverage of the package importPath, i.e., the
+// one of the first pattern matching it, or the default, and false if there is
+// none.
+func (t *thresholdConfig) threshold(importPath string) (float64, bool) {
+	for _, pt := range t.Packages {
+		if matchPackagePattern(pt.Pattern, importPath) {
+			return pt.Min, true
+		}
+	}
+	if t.Default != nil {
+		return *t.Default, true
+	}
+	return 0, false
+}
+
+// matchPackagePattern returns true if the import path matches pattern, in
+// which '...' matches any string, and a trailing '/...' matches the path
+// before it as well, just like in the patterns of the go command.
+func matchPackagePattern(pattern, importPath string) bool {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.ReplaceAll(re, `\.\.\.`, `.*`)
+	if strings.HasSuffix(re, `/.*`) {
+		re = strings.TrimSuffix(re, `/.*`) + `(/.*)?`
+	}
+	matched, _ := regexp.MatchString("^"+re+"$", importPath)
+	return matched
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("COVERAGE_TEST_DIR", "/data/coverage")
+	t.Setenv("COVERAGE_TEST_MIN", "75.5")
+	t.Setenv("COVERAGE_TEST_EMPTY", "")
+	min := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name string
+		src  string
+		want config
+		err  string
+	}{
+		{
+			name: "yaml",
+			src: "instrument:\n" +
+				"  mode: count\n" +
+				"  exclude_pkg:\n" +
+				"    - example.com/app/mocks\n" +
+				"  dir: /var/lib/gobinarycoverage\n" +
+				"thresholds:\n" +
+				"  total: 60\n" +
+				"  packages:\n" +
+				"    - pattern: example.com/app/installer/...\n" +
+				"      min: 90\n" +
+				"  teams:\n" +
+				"    - team: \"@org/client\"\n" +
+				"      min: 70\n" +
+				"hooks:\n" +
+				"  post_build: sign \"$GOBINARYCOVERAGE_BINARY\"\n",
+			want: config{
+				Instrument: instrumentConfig{Mode: "count", ExcludePkg: []string{"example.com/app/mocks"}, Dir: "/var/lib/gobinarycoverage"},
+				Thresholds: thresholdConfig{
+					Total:    min(60),
+					Packages: []packageThreshold{{"example.com/app/installer/...", 90}},
+					Teams:    []teamThreshold{{"@org/client", 70}},
+				},
+				Hooks: &hookConfig{PostBuild: `sign "$GOBINARYCOVERAGE_BINARY"`},
+			},
+		},
+		{
+			name: "json",
+			src:  `{"instrument": {"dir": "/tmp/cov"}, "thresholds": {"default": 30}}`,
+			want: config{Instrument: instrumentConfig{Dir: "/tmp/cov"}, Thresholds: thresholdConfig{Default: min(30)}},
+		},
+		{
+			name: "empty",
+			src:  "# Nothing configured yet\n",
+		},
+		{
+			name: "environment",
+			src: "instrument:\n" +
+				"  dir: ${COVERAGE_TEST_DIR}/${COVERAGE_TEST_UNSET:-default}\n" +
+				"  mode: ${COVERAGE_TEST_EMPTY:-atomic}\n" +
+				"thresholds:\n" +
+				"  total: ${COVERAGE_TEST_MIN}\n" +
+				"  default: ${COVERAGE_TEST_UNSET:-40}\n" +
+				"hooks:\n" +
+				"  post_build: echo $${COVERAGE_TEST_DIR} $COVERAGE_TEST_DIR\n",
+			want: config{
+				Instrument: instrumentConfig{Dir: "/data/coverage/default", Mode: "atomic"},
+				Thresholds: thresholdConfig{Total: min(75.5), Default: min(40)},
+				Hooks:      &hookConfig{PostBuild: "echo ${COVERAGE_TEST_DIR} $COVERAGE_TEST_DIR"},
+			},
+		},
+		{
+			name: "quoted value stays a string",
+			src:  "thresholds:\n  total: \"${COVERAGE_TEST_MIN}\"\n",
+			err:  "cannot unmarshal !!str `75.5`",
+		},
+		{
+			name: "variable unset",
+			src:  "instrument:\n  mode: set\n  dir: ${COVERAGE_TEST_UNSET}\n",
+			err:  "COVERAGE_TEST_UNSET (line 3)",
+		},
+		{
+			name: "unknown field",
+			src:  "instrument:\n  mode: set\n  exclude_pkgs: [example.com/app/mocks]\n",
+			err:  `line 3: unknown field "exclude_pkgs"`,
+		},
+		{
+			name: "unknown field in a list",
+			src:  "thresholds:\n  packages:\n    - pattern: example.com/...\n      minimum: 90\n",
+			err:  `line 4: unknown field "minimum"`,
+		},
+		{
+			name: "malformed",
+			src:  "instrument: [\n",
+			err:  "yaml:",
+		},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(test.name, " ", "_")+".yaml")
+			if err := os.WriteFile(path, []byte(test.src), 0644); err != nil {
+				t.Fatal(err)
+			}
+			c, err := loadConfig(path)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("loadConfig() error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*c, test.want) {
+				t.Errorf("loadConfig() = %+v, want %+v", *c, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadDefaultConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		dir   string
+	}{
+		{"none", nil, ""},
+		{"yaml", map[string]string{".gobinarycoverage.yaml": "instrument:\n  dir: yaml\n"}, "yaml"},
+		{"yml", map[string]string{".gobinarycoverage.yml": "instrument:\n  dir: yml\n"}, "yml"},
+		{"legacy json", map[string]string{".gobinarycoverage.json": `{"instrument": {"dir": "json"}}`}, "json"},
+		{"yaml first", map[string]string{
+			".gobinarycoverage.yaml": "instrument:\n  dir: yaml\n",
+			".gobinarycoverage.json": `{"instrument": {"dir": "json"}}`,
+		}, "yaml"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, src := range test.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			chdir(t, dir)
+			c, err := loadConfig(defaultConfigFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Instrument.Dir != test.dir {
+				t.Errorf("read the directory %q, want %q", c.Instrument.Dir, test.dir)
+			}
+		})
+	}
+}
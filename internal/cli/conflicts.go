@@ -0,0 +1,206 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// The resolutions of the conflicts between the generated main file, and the
+// main package, see resolveConflicts
+const (
+	conflictAbort  = "abort"
+	conflictRename = "rename"
+	conflictSkip   = "skip"
+	conflictAsk    = "ask"
+)
+
+// errConflictSkipped is returned by resolveConflicts if the main package is to
+// be left as it is
+var errConflictSkipped = errors.New("the conflicts with the generated code are skipped")
+
+// MergeConflict is a package level declaration of the generated main file,
+// whose name is declared in the main package it is merged into already.
+type MergeConflict struct {
+	Symbol   string
+	Location string // Of the declaration in the main package
+	Reason   string
+
+	ident *ast.Ident // The declaration in the generated main file
+}
+
+// ConflictError is returned when the generated main file conflicts with the
+// main package, and the conflicts are not resolved, see resolveConflicts.
+type ConflictError struct {
+	MainPackage string
+	Conflicts   []MergeConflict
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("the declarations of the generated code conflict with the main package %s, "+
+		"give -on-conflict rename to rename them, or skip to leave the main package as it is", e.MainPackage)
+}
+
+// findMergeConflicts returns the package level declarations of the generated
+// main file, with the type information info, which are declared in the main
+// package as well, as given by mainDecls. The init functions, and the blank
+// identifiers, may be declared any number of times.
+func findMergeConflicts(fset *token.FileSet, generated *ast.File, info *types.Info, mainDecls map[string]*ast.Ident) []MergeConflict {
+	var conflicts []MergeConflict
+	add := func(ident *ast.Ident) {
+		taken, ok := mainDecls[ident.Name]
+		if !ok || ident.Name == "_" || ident.Name == "init" {
+			return
+		}
+		conflicts = append(conflicts, MergeConflict{
+			Symbol:   ident.Name,
+			Location: fset.PositionFor(taken.Pos(), false).String(),
+			Reason:   fmt.Sprintf("declared as a %s in the main package, and as a %s by the generated code", identKind(taken), objectKind(info.Defs[ident])),
+			ident:    ident,
+		})
+	}
+	for _, decl := range generated.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil {
+				add(d.Name)
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.ValueSpec:
+					for _, n := range s.Names {
+						add(n)
+					}
+				case *ast.TypeSpec:
+					add(s.Name)
+				}
+			}
+		}
+	}
+	return conflicts
+}
+
+// identKind returns the kind of the declaration of ident, as resolved by the
+// parser, e.g., func, or var.
+func identKind(ident *ast.Ident) string {
+	if ident.Obj == nil {
+		return "declaration"
+	}
+	return ident.Obj.Kind.String()
+}
+
+// objectKind returns the kind of the declaration of obj, as in identKind.
+func objectKind(obj types.Object) string {
+	switch obj.(type) {
+	case *types.Func:
+		return "func"
+	case *types.Var:
+		return "var"
+	case *types.Const:
+		return "const"
+	case *types.TypeName:
+		return "type"
+	}
+	return "declaration"
+}
+
+// writeConflicts writes the conflicts as a table of the symbol, the location,
+// and the reason of every one of them.
+func writeConflicts(w io.Writer, mainPackage string, conflicts []MergeConflict) {
+	fmt.Fprintf(w, "The generated code conflicts with the declarations of the main package %s:\n", mainPackage)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, c := range conflicts {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", c.Symbol, c.Location, c.Reason)
+	}
+	tw.Flush()
+}
+
+// resolveConflicts resolves the conflicts of the generated main file with the
+// main package mainPackage, whose package level names are mainNames, as given
+// by how: abort fails, rename renames the declarations of the generated code,
+// and all the references to them, skip returns errConflictSkipped, so that the
+// main package is left as it is, and ask prompts for one of them for every
+// conflict on the terminal. The conflicts are reported on stderr. The names
+// of the generated declarations renamed are returned, by their original ones.
+func resolveConflicts(info *types.Info, mainPackage string, mainNames map[string]bool, conflicts []MergeConflict, how string) (map[string]string, error) {
+	renamed := make(map[string]string)
+	if len(conflicts) == 0 {
+		return renamed, nil
+	}
+	writeConflicts(stderr, mainPackage, conflicts)
+	var answers *bufio.Reader
+	if how == conflictAsk {
+		if !isTerminal(os.Stdin) {
+			return nil, errors.New("-on-conflict ask prompts on the terminal, and stdin is not one, give -on-conflict rename, skip or abort")
+		}
+		answers = bufio.NewReader(os.Stdin)
+	}
+	for _, c := range conflicts {
+		resolution := how
+		if answers != nil {
+			fmt.Fprintf(stderr, "%s: %s, [r]ename, [s]kip the main package, or [a]bort? ", c.Symbol, c.Location)
+			line, err := answers.ReadString('\n')
+			if err != nil && line == "" {
+				return nil, fmt.Errorf("failed to read the resolution of the conflict of %s: %w", c.Symbol, err)
+			}
+			switch strings.TrimSpace(strings.ToLower(line)) {
+			case "r", "rename":
+				resolution = conflictRename
+			case "s", "skip":
+				resolution = conflictSkip
+			default:
+				resolution = conflictAbort
+			}
+		}
+		switch resolution {
+		case conflictRename:
+			name := "_cover_" + c.Symbol
+			for i := 1; mainNames[name]; i++ {
+				name = "_cover_" + c.Symbol + strconv.Itoa(i)
+			}
+			renameDecl(info, c.ident, name)
+			renamed[c.Symbol] = name
+			fmt.Fprintf(stderr, "Renamed %s of the generated code to %s\n", c.Symbol, name)
+		case conflictSkip:
+			return nil, errConflictSkipped
+		default:
+			return nil, &ConflictError{MainPackage: mainPackage, Conflicts: conflicts}
+		}
+	}
+	return renamed, nil
+}
+
+// renameDecl renames the declaration ident, in the file checked with the type
+// information info, and all the references to it, to name.
+func renameDecl(info *types.Info, ident *ast.Ident, name string) {
+	obj := info.Defs[ident]
+	for id, o := range info.Uses {
+		if o == obj {
+			id.Name = name
+		}
+	}
+	ident.Name = name
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// coverPackages returns the packages which are instrumented along with the
+// main package mainPackage, as configured by opts, in the same way as
+// instrument selects them.
+func coverPackages(mainPackage string, opts options) ([]string, error) {
+	if err := syncGoEnv(); err != nil {
+		return nil, err
+	}
+	ctx := opts.buildContext()
+	var err error
+	if isDirArg(mainPackage) {
+		if mainPackage, err = resolvePackageDir(mainPackage, ctx, &opts); err != nil {
+			return nil, err
+		}
+	}
+	var replaced []string
+	if opts.includeReplaced {
+		if replaced, err = listLocallyReplacedModules(ctx); err != nil {
+			return nil, err
+		}
+	}
+	packages, _, err := listPackagesImported(mainPackage, ctx, replaced)
+	if err != nil {
+		return nil, err
+	}
+	if opts.excludePkg != "" {
+		packages = excludePackages(packages, strings.Split(opts.excludePkg, ","))
+	}
+	if opts.includePkg != "" {
+		return includePackages(packages, strings.Split(opts.includePkg, ","))
+	}
+	return packages, nil
+}
+
+// coverpkgsUsage is the help of the coverpkgs subcommand.
+const coverpkgsUsage = `
+   gobinarycoverage coverpkgs [-exclude-pkg patterns] [-include-pkg patterns] [-include-replaced]
+           [-goos os] [-goarch arch] [-tags tags] package [package...]
+
+       Prints the packages instrumented along with the main packages,
+       comma separated, as selected by instrument, and the exclude_pkg of
+       the configuration, for go build -cover -coverpkg, so that the
+       binaries built with the coverage of the go command, of Go 1.20 and
+       later, cover the same packages.
+`
+
+// coverpkgsCommand writes the packages instrumented along with the main
+// packages given, as configured by the arguments of the coverpkgs subcommand,
+// and the instrument section of the configuration, comma separated, for the
+// -coverpkg flag of go build -cover, so that the binaries built with the
+// coverage of the go command cover the same packages.
+func coverpkgsCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("coverpkgs", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, coverpkgsUsage)
+	var opts options
+	fs.StringVar(&opts.excludePkg, "exclude-pkg", "", "Do not list the packages matching these comma separated patterns")
+	fs.StringVar(&opts.includePkg, "include-pkg", "", "Only list the packages matching these comma separated patterns")
+	fs.BoolVar(&opts.includeReplaced, "include-replaced", false, "List the packages of the modules replaced by local directories as well")
+	fs.StringVar(&opts.goos, "goos", "", "List the packages for this GOOS, instead of the one in the environment")
+	fs.StringVar(&opts.goarch, "goarch", "", "List the packages for this GOARCH, instead of the one in the environment")
+	fs.StringVar(&opts.tags, "tags", "", "List the packages with these comma separated build tags, instead of the ones in GOFLAGS")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: gobinarycoverage coverpkgs [-exclude-pkg patterns] [-include-pkg patterns] [-include-replaced] [-goos os] [-goarch arch] [-tags tags] package [package...]")
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	c, err := loadConfig(defaultConfigFile)
+	if err != nil {
+		return err
+	}
+	if !given["exclude-pkg"] && len(c.Instrument.ExcludePkg) > 0 {
+		opts.excludePkg = strings.Join(c.Instrument.ExcludePkg, ",")
+	}
+	if !given["include-pkg"] && len(c.Instrument.IncludePkg) > 0 {
+		opts.includePkg = strings.Join(c.Instrument.IncludePkg, ",")
+	}
+	var all []string
+	seen := make(map[string]bool)
+	for _, mainPackage := range fs.Args() {
+		packages, err := coverPackages(mainPackage, opts)
+		if err != nil {
+			return err
+		}
+		for _, p := range packages {
+			if !seen[p] {
+				seen[p] = true
+				all = append(all, p)
+			}
+		}
+	}
+	if len(all) == 0 {
+		return errors.New("no packages are instrumented along with the main packages given")
+	}
+	_, err = fmt.Fprintln(w, strings.Join(all, ","))
+	return err
+}
@@ -0,0 +1,778 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// The reasons the statements of a block can not be covered by any run of the
+// binary
+const (
+	deadUnreachable   = "unreachable"
+	deadBuildExcluded = "build-excluded"
+)
+
+// srcPos is a position in a source file, as the starts and ends of the blocks
+// in the profiles
+type srcPos struct{ line, col int }
+
+func (a srcPos) before(b srcPos) bool {
+	return a.line < b.line || a.line == b.line && a.col < b.col
+}
+
+// deadRange is a range of a source file which no run of the binary covers,
+// and the blocks of the profile starting in it
+type deadRange struct {
+	file       string // As in the profile
+	start, end srcPos // The end is exclusive
+	reason     string
+	detail     string // Why, e.g., that the function is never called
+	statements int
+	blocks     []int // The indexes of the blocks in the profile
+}
+
+// parsedFile is a source file of a package analysed by deadCode
+type parsedFile struct {
+	name    string // As in the profile
+	ast     *ast.File
+	imports map[string]string // The import paths by the names they are imported as
+}
+
+// boolConst is a boolean constant, declared as true or false
+type boolConst struct {
+	value bool
+	spec  *ast.ValueSpec
+}
+
+// parsedPackage is a package analysed by deadCode
+type parsedPackage struct {
+	*Package
+	files []*parsedFile
+	// consts are the boolean constants of the package, which are declared in
+	// a single file, as the ones declared in several are set by build tags
+	// the binary may have been built with
+	consts map[string]boolConst
+	// external is whether the package is imported by packages which are not
+	// analysed, or dot imported, so that its exported functions may be
+	// called by code which is not seen
+	external   bool
+	dotImports []string // The packages dot imported by the package
+}
+
+// declaredFunc is a function, or a method, declared in a package analysed
+type declaredFunc struct {
+	pkg  *parsedPackage
+	file *parsedFile
+	decl *ast.FuncDecl
+}
+
+// deadCode is the analysis of the sources of the packages in a profile, which
+// finds the code which can not be covered, and the callers of the functions.
+// The analysis is syntactic, so it errs on the side of finding code
+// reachable: a function is reachable if its name is referenced by any
+// reachable code in its package, or through the name its package is imported
+// as, a method if any reachable code references its name, and every exported
+// method is, as it may implement an interface.
+type deadCode struct {
+	fset           *token.FileSet
+	goos, goarch   string // Unknown if empty, e.g., in the merge of the profiles of several platforms
+	packages       map[string]*parsedPackage
+	decls          map[*ast.FuncDecl]*declaredFunc
+	funcs          map[string]map[string]*declaredFunc // By package, and name, without the init functions
+	methods        map[string][]*declaredFunc          // By name
+	reached        map[*declaredFunc]bool
+	queue          []*declaredFunc
+	ranges         []deadRange
+	noReachability bool
+}
+
+// findDeadCode returns the ranges of the source files of the packages in the
+// profile p, listed for the platform of the build context ctx, which can not
+// be covered, as they are unreachable from the main and the init functions of
+// the binary built from the package mainPkg, which is not instrumented, and
+// thus not in the profile, follow a statement which never returns, or are
+// excluded by a condition which is constant in the build for the GOOS and
+// GOARCH given, if any. The functions are not checked for reachability if
+// mainPkg is not a main package.
+func findDeadCode(ctx *build.Context, goos, goarch, mainPkg string, p *profile.Profile) ([]deadRange, error) {
+	d, main, err := parseProfileSources(ctx, goos, goarch, mainPkg, p)
+	if err != nil {
+		return nil, err
+	}
+	if main.Name != "main" {
+		fmt.Fprintf(stderr, "Warning: %s is not a main package, so the functions are not checked for reachability\n", main.ImportPath)
+		d.noReachability = true
+	} else if err = d.findExternal(ctx, main.ImportPath); err != nil {
+		return nil, err
+	}
+	// The roots of the reachability are the functions run, or called, by
+	// code which is not seen, and the initializers of the variables
+	for _, pp := range d.packages {
+		for _, f := range pp.files {
+			for _, decl := range f.ast.Decls {
+				switch decl := decl.(type) {
+				case *ast.GenDecl:
+					if decl.Tok == token.VAR {
+						d.mark(pp, f, decl)
+					}
+				case *ast.FuncDecl:
+					if d.isRoot(pp, decl) {
+						d.reach(d.decls[decl])
+					}
+				}
+			}
+		}
+	}
+	for len(d.queue) > 0 {
+		fn := d.queue[len(d.queue)-1]
+		d.queue = d.queue[:len(d.queue)-1]
+		d.mark(fn.pkg, fn.file, fn.decl)
+	}
+
+	// The unreachable functions are added first, and the statements are only
+	// checked in the reachable ones, so that the blocks are of the outermost
+	// range they start in
+	var reachable []*declaredFunc
+	for _, pp := range d.packages {
+		for _, f := range pp.files {
+			for _, decl := range f.ast.Decls {
+				fn, ok := decl.(*ast.FuncDecl)
+				if !ok || fn.Body == nil {
+					continue
+				}
+				df := d.decls[fn]
+				if !d.reached[df] {
+					d.add(f, fn.Body.Lbrace, fn.Body.End(), deadUnreachable,
+						funcName(fn)+" is never called from main, or the init functions")
+					continue
+				}
+				reachable = append(reachable, df)
+			}
+		}
+	}
+	for _, fn := range reachable {
+		d.checkStatements(fn.pkg, fn.file, fn.decl.Body)
+	}
+	return d.ranges, nil
+}
+
+// parseProfileSources lists the packages of the files in the profile p, and
+// the package mainPkg, for the platform of the build context ctx, and parses
+// them for the analysis of the code for the GOOS and GOARCH given. It returns
+// the main package listed.
+func parseProfileSources(ctx *build.Context, goos, goarch, mainPkg string, p *profile.Profile) (*deadCode, *Package, error) {
+	listed, err := listPackages(ctx, []string{mainPkg})
+	if err != nil {
+		return nil, nil, err
+	}
+	main := listed[0]
+	paths := []string{main.ImportPath}
+	seen := map[string]bool{main.ImportPath: true}
+	for _, file := range p.Files() {
+		if pkg := path.Dir(file); !filepath.IsAbs(file) && !seen[pkg] {
+			seen[pkg] = true
+			paths = append(paths, pkg)
+		}
+	}
+	if listed, err = listPackages(ctx, paths); err != nil {
+		return nil, nil, err
+	}
+	names := make(map[string]string, len(listed))
+	for _, pkg := range listed {
+		names[pkg.ImportPath] = pkg.Name
+	}
+	d := &deadCode{
+		fset:     token.NewFileSet(),
+		goos:     goos,
+		goarch:   goarch,
+		packages: make(map[string]*parsedPackage),
+		decls:    make(map[*ast.FuncDecl]*declaredFunc),
+		funcs:    make(map[string]map[string]*declaredFunc),
+		methods:  make(map[string][]*declaredFunc),
+		reached:  make(map[*declaredFunc]bool),
+	}
+	for _, pkg := range listed {
+		pp, err := d.parsePackage(pkg, names)
+		if err != nil {
+			return nil, nil, err
+		}
+		d.packages[pkg.ImportPath] = pp
+	}
+	for _, pp := range d.packages {
+		for _, dot := range pp.dotImports {
+			if imported := d.packages[dot]; imported != nil {
+				imported.external = true
+			}
+		}
+	}
+	return d, main, nil
+}
+
+// parsePackage parses the Go files of the package listed, and indexes its
+// functions, and methods. names are the names of the packages listed, by
+// their import paths.
+func (d *deadCode) parsePackage(pkg *Package, names map[string]string) (*parsedPackage, error) {
+	pp := &parsedPackage{Package: pkg, consts: make(map[string]boolConst)}
+	d.funcs[pkg.ImportPath] = make(map[string]*declaredFunc)
+	declared := make(map[string]int)
+	for _, name := range pkg.GoFiles {
+		f, err := parser.ParseFile(d.fset, filepath.Join(pkg.Dir, name), nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		pf := &parsedFile{name: pkg.ImportPath + "/" + name, ast: f, imports: make(map[string]string)}
+		for _, spec := range f.Imports {
+			p, _ := strconv.Unquote(spec.Path.Value)
+			if mapped, ok := pkg.ImportMap[p]; ok {
+				p = mapped
+			}
+			name := path.Base(p)
+			if n, ok := names[p]; ok {
+				name = n
+			}
+			if spec.Name != nil {
+				name = spec.Name.Name
+			}
+			if name == "." {
+				pp.dotImports = append(pp.dotImports, p)
+				continue
+			}
+			pf.imports[name] = p
+		}
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.GenDecl:
+				if decl.Tok == token.CONST {
+					for _, spec := range decl.Specs {
+						spec := spec.(*ast.ValueSpec)
+						for i, n := range spec.Names {
+							declared[n.Name]++
+							if i >= len(spec.Values) {
+								continue
+							}
+							if v, ok := spec.Values[i].(*ast.Ident); ok && (v.Name == "true" || v.Name == "false") {
+								pp.consts[n.Name] = boolConst{v.Name == "true", spec}
+							}
+						}
+					}
+				}
+			case *ast.FuncDecl:
+				d.declare(pp, pf, decl)
+			}
+		}
+		pp.files = append(pp.files, pf)
+	}
+
+	// The constants declared in the files excluded from the build as well
+	// depend on the build tags
+	for _, name := range pkg.IgnoredGoFiles {
+		f, err := parser.ParseFile(token.NewFileSet(), filepath.Join(pkg.Dir, name), nil, parser.SkipObjectResolution)
+		if err != nil {
+			continue
+		}
+		for _, decl := range f.Decls {
+			if decl, ok := decl.(*ast.GenDecl); ok && decl.Tok == token.CONST {
+				for _, spec := range decl.Specs {
+					for _, n := range spec.(*ast.ValueSpec).Names {
+						declared[n.Name]++
+					}
+				}
+			}
+		}
+	}
+	for name := range pp.consts {
+		if declared[name] > 1 {
+			delete(pp.consts, name)
+		}
+	}
+	return pp, nil
+}
+
+// declare indexes the function fn declared in the file f of the package pp
+func (d *deadCode) declare(pp *parsedPackage, f *parsedFile, fn *ast.FuncDecl) {
+	df := &declaredFunc{pp, f, fn}
+	d.decls[fn] = df
+	if fn.Recv != nil {
+		d.methods[fn.Name.Name] = append(d.methods[fn.Name.Name], df)
+	} else if fn.Name.Name != "init" {
+		// The init functions can not be referenced, and there may be many
+		d.funcs[pp.ImportPath][fn.Name.Name] = df
+	}
+}
+
+// findExternal lists the dependencies of the main package, and marks the
+// packages analysed which are imported by the ones which are not.
+func (d *deadCode) findExternal(ctx *build.Context, mainPkg string) error {
+	out, err := cachedGoList(ctx, true, "-deps", "-json", mainPkg)
+	if err != nil {
+		fmt.Fprintf(stderr, "`go list -deps -json %s` failed. Error: %s\n", mainPkg, err.Error())
+		return err
+	}
+	deps, err := decodePackages(out)
+	if err != nil {
+		return err
+	}
+	for _, dep := range deps {
+		if d.packages[dep.ImportPath] != nil {
+			continue
+		}
+		for _, imp := range dep.Imports {
+			if pp := d.packages[imp]; pp != nil {
+				pp.external = true
+			}
+		}
+	}
+	return nil
+}
+
+// isRoot returns whether the function fn of the package pp is called by code
+// which is not seen, i.e., the runtime, the packages which are not analysed,
+// the interfaces, cgo, or the linker.
+func (d *deadCode) isRoot(pp *parsedPackage, fn *ast.FuncDecl) bool {
+	if d.noReachability {
+		return true
+	}
+	if fn.Recv == nil && (fn.Name.Name == "init" || fn.Name.Name == "main" && pp.Name == "main") {
+		return true
+	}
+	if fn.Name.IsExported() && (fn.Recv != nil || pp.external) {
+		return true
+	}
+	if fn.Doc != nil {
+		for _, c := range fn.Doc.List {
+			if strings.HasPrefix(c.Text, "//export ") || strings.HasPrefix(c.Text, "//go:linkname ") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reach marks the function fn as reachable, and queues it, in order to mark
+// the functions it references
+func (d *deadCode) reach(fn *declaredFunc) {
+	if !d.reached[fn] {
+		d.reached[fn] = true
+		d.queue = append(d.queue, fn)
+	}
+}
+
+// mark marks the functions referenced in node, in the file f of the package
+// pp, as reachable
+func (d *deadCode) mark(pp *parsedPackage, f *parsedFile, node ast.Node) {
+	d.references(pp, f, node, d.reach)
+}
+
+// references calls found with the functions referenced in node, in the file f
+// of the package pp, as many times as they are referenced. Every identifier
+// is taken to reference the function of the package, and the methods, of its
+// name, if any, regardless of its scope.
+func (d *deadCode) references(pp *parsedPackage, f *parsedFile, node ast.Node, found func(fn *declaredFunc)) {
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			if x, ok := n.X.(*ast.Ident); ok {
+				if fn := d.funcs[f.imports[x.Name]][n.Sel.Name]; fn != nil {
+					found(fn)
+				}
+			}
+		case *ast.Ident:
+			if fn := d.funcs[pp.ImportPath][n.Name]; fn != nil {
+				found(fn)
+			}
+			for _, fn := range d.methods[n.Name] {
+				found(fn)
+			}
+		}
+		return true
+	})
+}
+
+// add adds the range of the file f from start, up to end, if it is not empty
+func (d *deadCode) add(f *parsedFile, start, end token.Pos, reason, detail string) {
+	s, e := d.fset.Position(start), d.fset.Position(end)
+	d.ranges = append(d.ranges, deadRange{
+		file:   f.name,
+		start:  srcPos{s.Line, s.Column},
+		end:    srcPos{e.Line, e.Column},
+		reason: reason,
+		detail: detail,
+	})
+}
+
+// checkStatements adds the ranges of the body of a reachable function, which
+// follow a statement which never returns, or are excluded by a condition
+// which is constant in the build.
+func (d *deadCode) checkStatements(pp *parsedPackage, f *parsedFile, body *ast.BlockStmt) {
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.BlockStmt:
+			d.checkTerminating(f, n.List)
+		case *ast.CaseClause:
+			d.checkTerminating(f, n.Body)
+		case *ast.CommClause:
+			d.checkTerminating(f, n.Body)
+		case *ast.IfStmt:
+			value, detail, ok := d.constBool(pp, f, n.Cond)
+			if !ok {
+				break
+			}
+			if !value {
+				d.add(f, n.Body.Lbrace, n.Body.End(), deadBuildExcluded, detail)
+			} else if n.Else != nil {
+				d.add(f, n.Else.Pos(), n.Else.End(), deadBuildExcluded, detail)
+			}
+		case *ast.SwitchStmt:
+			d.checkPlatformSwitch(f, n)
+		}
+		return true
+	})
+}
+
+// checkTerminating adds the ranges of the statements in list which follow a
+// statement which never returns, up to the next label, which a goto may jump
+// to.
+func (d *deadCode) checkTerminating(f *parsedFile, list []ast.Stmt) {
+	for i := 0; i < len(list)-1; i++ {
+		what := d.terminating(f, list[i])
+		if what == "" {
+			continue
+		}
+		end := i + 1
+		for end < len(list) {
+			if _, ok := list[end].(*ast.LabeledStmt); ok {
+				break
+			}
+			end++
+		}
+		if end > i+1 {
+			line := d.fset.Position(list[i].Pos()).Line
+			d.add(f, list[i].End(), list[end-1].End(), deadUnreachable, fmt.Sprintf("follows the %s at line %d", what, line))
+		}
+		i = end - 1
+	}
+}
+
+// terminating returns what the statement is, if it never returns to the next
+// one, e.g. "return", or "os.Exit", or "" if it may.
+func (d *deadCode) terminating(f *parsedFile, stmt ast.Stmt) string {
+	switch s := stmt.(type) {
+	case *ast.ReturnStmt:
+		return "return"
+	case *ast.BranchStmt:
+		if s.Tok != token.FALLTHROUGH {
+			return s.Tok.String()
+		}
+	case *ast.ExprStmt:
+		call, ok := s.X.(*ast.CallExpr)
+		if !ok {
+			break
+		}
+		switch fun := call.Fun.(type) {
+		case *ast.Ident:
+			if fun.Name == "panic" && fun.Obj == nil {
+				return "panic"
+			}
+		case *ast.SelectorExpr:
+			if x, ok := fun.X.(*ast.Ident); ok && x.Obj == nil && routedExits[f.imports[x.Name]][fun.Sel.Name] != "" {
+				return x.Name + "." + fun.Sel.Name
+			}
+		}
+	}
+	return ""
+}
+
+// constBool returns the value of the condition e, and why it has it, if it is
+// constant in the build, as it is made of the boolean constants of the
+// package pp, and the comparisons of runtime.GOOS, and runtime.GOARCH, to
+// strings.
+func (d *deadCode) constBool(pp *parsedPackage, f *parsedFile, e ast.Expr) (value bool, detail string, ok bool) {
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return d.constBool(pp, f, e.X)
+	case *ast.Ident:
+		c, declared := pp.consts[e.Name]
+		switch {
+		case declared && (e.Obj == nil || e.Obj.Decl == c.spec):
+			return c.value, fmt.Sprintf("%s is %t", e.Name, c.value), true
+		case !declared && e.Obj == nil && (e.Name == "true" || e.Name == "false"):
+			return e.Name == "true", "the condition is " + e.Name, true
+		}
+	case *ast.UnaryExpr:
+		if e.Op == token.NOT {
+			value, detail, ok := d.constBool(pp, f, e.X)
+			return !value, detail, ok
+		}
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case token.LAND, token.LOR:
+			x, xDetail, xOk := d.constBool(pp, f, e.X)
+			y, yDetail, yOk := d.constBool(pp, f, e.Y)
+			// The value of one side decides the condition, if it is false
+			// for &&, or true for ||
+			decides := e.Op == token.LOR
+			switch {
+			case xOk && x == decides:
+				return x, xDetail, true
+			case yOk && y == decides:
+				return y, yDetail, true
+			case xOk && yOk:
+				return x, xDetail + ", and " + yDetail, true
+			}
+		case token.EQL, token.NEQ:
+			name, platform, known := d.platformValue(f, e.X)
+			s, isString := stringLit(e.Y)
+			if !known {
+				name, platform, known = d.platformValue(f, e.Y)
+				s, isString = stringLit(e.X)
+			}
+			if known && isString {
+				return (platform == s) == (e.Op == token.EQL), fmt.Sprintf("%s is %q", name, platform), true
+			}
+		}
+	}
+	return false, "", false
+}
+
+// platformValue returns the value of e, if it is runtime.GOOS, or
+// runtime.GOARCH, and it is known
+func (d *deadCode) platformValue(f *parsedFile, e ast.Expr) (name, value string, ok bool) {
+	sel, isSel := e.(*ast.SelectorExpr)
+	if !isSel {
+		return "", "", false
+	}
+	if x, isIdent := sel.X.(*ast.Ident); !isIdent || x.Obj != nil || f.imports[x.Name] != "runtime" {
+		return "", "", false
+	}
+	switch sel.Sel.Name {
+	case "GOOS":
+		value = d.goos
+	case "GOARCH":
+		value = d.goarch
+	}
+	return "runtime." + sel.Sel.Name, value, value != ""
+}
+
+// stringLit returns the value of e, if it is a string literal
+func stringLit(e ast.Expr) (string, bool) {
+	lit, ok := e.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	s, err := strconv.Unquote(lit.Value)
+	return s, err == nil
+}
+
+// checkPlatformSwitch adds the ranges of the clauses of a switch on
+// runtime.GOOS, or runtime.GOARCH, which are never selected in the build. The
+// clauses are only checked if they are made of string literals, and the
+// default one only if one of them is selected.
+func (d *deadCode) checkPlatformSwitch(f *parsedFile, s *ast.SwitchStmt) {
+	name, value, ok := d.platformValue(f, s.Tag)
+	if !ok {
+		return
+	}
+	detail := fmt.Sprintf("%s is %q", name, value)
+	// The clauses the previous one falls through to are run along with it
+	selected, fallsThrough := false, false
+	var defaultClause *ast.CaseClause
+	for _, stmt := range s.Body.List {
+		c := stmt.(*ast.CaseClause)
+		reached := fallsThrough
+		fallsThrough = false
+		if n := len(c.Body); n > 0 {
+			b, ok := c.Body[n-1].(*ast.BranchStmt)
+			fallsThrough = ok && b.Tok == token.FALLTHROUGH
+		}
+		if c.List == nil {
+			if !reached {
+				defaultClause = c
+			}
+			continue
+		}
+		literal, match := true, false
+		for _, e := range c.List {
+			lit, ok := stringLit(e)
+			literal = literal && ok
+			match = match || ok && lit == value
+		}
+		switch {
+		case match && literal:
+			selected = true
+		case literal && !reached:
+			d.add(f, c.Colon, c.End(), deadBuildExcluded, detail)
+		}
+	}
+	if selected && defaultClause != nil {
+		d.add(f, defaultClause.Colon, defaultClause.End(), deadBuildExcluded, detail)
+	}
+}
+
+// assignDeadBlocks adds the blocks of the profile p to the ranges they start
+// in, the outermost one if they are nested. The covered blocks are left out,
+// with a warning, as the analysis is mistaken about them, e.g., as the
+// sources changed since the profile was written.
+func assignDeadBlocks(p *profile.Profile, ranges []deadRange) {
+	byFile := make(map[string][]int)
+	for i, r := range ranges {
+		byFile[r.file] = append(byFile[r.file], i)
+	}
+	for i, b := range p.Blocks {
+		start := srcPos{b.StartLine, b.StartCol}
+		for _, j := range byFile[b.File] {
+			r := &ranges[j]
+			if start.before(r.start) || !start.before(r.end) {
+				continue
+			}
+			if b.Count > 0 {
+				fmt.Fprintf(stderr, "Warning: %s:%d.%d is covered, though it is found %s, so it is kept\n", b.File, b.StartLine, b.StartCol, r.reason)
+				break
+			}
+			r.statements += b.NumStmt
+			r.blocks = append(r.blocks, i)
+			break
+		}
+	}
+}
+
+// deadcodeUsage is the help of the deadcode subcommand.
+const deadcodeUsage = `
+   gobinarycoverage deadcode [-main package] [-pkg pattern] [-o file] [-tag key=value,...] profile.out|dir [profile.out|dir...]
+
+       Lists the code which no run of the binary can cover, as it is in
+       functions unreachable from main, and the init functions, of the
+       main package (default .), follows a return, a panic, or an exit,
+       or is excluded by a condition which is constant in the build, e.g.
+       on runtime.GOOS, along with the coverage of the rest. -o writes the
+       profile without it, for the other subcommands to report on. -pkg is
+       as for uncovered.
+`
+
+// deadcodeCommand lists the code of the packages in a profile which no run of
+// the binary can cover, and the coverage without it, as configured by the
+// arguments of the deadcode subcommand, so that the coverage reported is of
+// the code which can be covered. With -o, the profile is written without the
+// blocks of the code, for the other subcommands to report on.
+func deadcodeCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("deadcode", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, deadcodeUsage)
+	pkg := fs.String("pkg", "", "Only list the code in the packages matching this pattern, e.g. example.com/app/...")
+	out := fs.String("o", "", "Write the profile without the blocks of the code which can not be covered to this file")
+	mainPkg := fs.String("main", ".", "The main package the binary is built from")
+	selection := selectionFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: gobinarycoverage deadcode [-main package] [-pkg pattern] [-o file] [-tag key=value,...] profile.out|dir [profile.out|dir...]")
+	}
+	sel, err := selection()
+	if err != nil {
+		return err
+	}
+	if sel.facet != "" {
+		return errors.New("the code is found in a single group of profiles, -facet is not used")
+	}
+	p, err := loadSelectedProfile(fs.Args(), sel)
+	if err != nil {
+		return err
+	}
+	goos, goarch := p.Tags["goos"], p.Tags["goarch"]
+	ranges, err := findDeadCode(options{goos: goos, goarch: goarch}.buildContext(), goos, goarch, *mainPkg, p)
+	if err != nil {
+		return err
+	}
+	assignDeadBlocks(p, ranges)
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].file != ranges[j].file {
+			return ranges[i].file < ranges[j].file
+		}
+		return ranges[i].start.before(ranges[j].start)
+	})
+
+	dead := make(map[int]bool)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, r := range ranges {
+		for _, i := range r.blocks {
+			dead[i] = true
+		}
+		if r.statements == 0 || *pkg != "" && !matchPackagePattern(*pkg, path.Dir(r.file)) {
+			continue
+		}
+		fmt.Fprintf(tw, "%s:%d-%d\t%s\t%d statements\t%s\n", r.file, r.start.line, r.end.line, r.reason, r.statements, r.detail)
+	}
+	if err = tw.Flush(); err != nil {
+		return err
+	}
+	var all, coverable profile.Totals
+	for i, b := range p.Blocks {
+		if *pkg != "" && !matchPackagePattern(*pkg, path.Dir(b.File)) {
+			continue
+		}
+		covered := 0
+		if b.Count > 0 {
+			covered = b.NumStmt
+		}
+		all.Add(b.NumStmt, covered)
+		if !dead[i] {
+			coverable.Add(b.NumStmt, covered)
+		}
+	}
+	fmt.Fprintf(w, "total: %.1f%% of %d statements, %.1f%% of the %d statements which can be covered\n",
+		all.Percent, all.Statements, coverable.Percent, coverable.Statements)
+
+	if *out == "" {
+		return nil
+	}
+	blocks := make([]profile.Block, 0, len(p.Blocks)-len(dead))
+	for i, b := range p.Blocks {
+		if !dead[i] {
+			blocks = append(blocks, b)
+		}
+	}
+	p.Blocks = blocks
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err = p.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if p.Schema > 0 {
+		return p.WriteSidecar(*out + ".json")
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// TestDeadCode finds the code which can not be covered in a fixture module,
+// whose main package calls Used, which calls helper, while unused is called
+// by Unused only, which nothing calls.
+func TestDeadCode(t *testing.T) {
+	files := map[string]string{
+		"go.mod":  "module example.com/dead\n\ngo 1.18\n",
+		"main.go": "package main\n\nimport \"example.com/dead/lib\"\n\nfunc main() {\n\tprintln(lib.Used())\n}\n",
+		"lib/lib.go": "package lib\n\n" +
+			"const debug = false\n\n" +
+			"func Used() int {\n" +
+			"\tx := helper()\n" +
+			"\tif debug {\n" +
+			"\t\tx++\n" +
+			"\t}\n" +
+			"\treturn x\n" +
+			"}\n\n" +
+			"func helper() int {\n" +
+			"\treturn 1\n" +
+			"}\n\n" +
+			"func unused() int {\n" +
+			"\treturn 2\n" +
+			"}\n\n" +
+			"func Unused() int {\n" +
+			"\treturn unused()\n" +
+			"}\n",
+	}
+	root := t.TempDir()
+	for name, src := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chdir(t, root)
+	const blocks = "mode: set\n" +
+		"example.com/dead/lib/lib.go:5.18,7.11 2 1\n" +
+		"example.com/dead/lib/lib.go:7.11,9.3 1 0\n" +
+		"example.com/dead/lib/lib.go:10.2,10.10 1 1\n" +
+		"example.com/dead/lib/lib.go:13.20,15.2 1 1\n" +
+		"example.com/dead/lib/lib.go:17.20,19.2 1 0\n" +
+		"example.com/dead/lib/lib.go:21.20,23.2 1 0\n"
+	p, err := profile.Parse(strings.NewReader(blocks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges, err := findDeadCode(options{}.buildContext(), "", "", ".", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assignDeadBlocks(p, ranges)
+	var found []string
+	for _, r := range ranges {
+		found = append(found, fmt.Sprintf("%d-%d %s %s %v", r.start.line, r.end.line, r.reason, r.detail, r.blocks))
+	}
+	sort.Strings(found)
+	expected := []string{
+		"17-19 unreachable unused is never called from main, or the init functions [4]",
+		"21-23 unreachable Unused is never called from main, or the init functions [5]",
+		"7-9 build-excluded debug is false [1]",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("found\n\t%s\nexpected\n\t%s", strings.Join(found, "\n\t"), strings.Join(expected, "\n\t"))
+	}
+
+	// The coverage reported is of the code which can be covered
+	if err = os.WriteFile("coverage.out", []byte(blocks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = deadcodeCommand([]string{"-o", "coverable.out", "coverage.out"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "total: 57.1% of 7 statements, 100.0% of the 4 statements which can be covered") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+	coverable, err := profile.ParseFile("coverable.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range coverable.Blocks {
+		if b.StartLine == 7 || b.StartLine >= 17 {
+			t.Errorf("the block at line %d can not be covered, and is written", b.StartLine)
+		}
+	}
+	if len(coverable.Blocks) != 3 {
+		t.Errorf("%d blocks written, expected 3", len(coverable.Blocks))
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// diffContext is the number of the unchanged lines around the changes in the
+// hunks of the unified diffs
+const diffContext = 3
+
+// diffOp is a line of an edit script: kept as it is (' '), removed ('-'), or
+// added ('+')
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// splitLines splits contents into lines, keeping their line endings, so that a
+// missing newline at the end is kept track of.
+func splitLines(contents []byte) []string {
+	var lines []string
+	for len(contents) > 0 {
+		i := bytes.IndexByte(contents, '\n')
+		if i < 0 {
+			lines = append(lines, string(contents))
+			break
+		}
+		lines = append(lines, string(contents[:i+1]))
+		contents = contents[i+1:]
+	}
+	return lines
+}
+
+// diffLines returns the shortest edit script turning a into b, by the
+// algorithm of Myers, "An O(ND) Difference Algorithm and Its Variations".
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+	d := 0
+search:
+	for ; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Backtrack through the furthest reaching paths, from the end
+	var ops []diffOp
+	x, y := n, m
+	for ; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{' ', a[x]})
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, diffOp{'+', b[y]})
+		} else {
+			x--
+			ops = append(ops, diffOp{'-', a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		ops = append(ops, diffOp{' ', a[x]})
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// writeUnifiedDiff writes the unified diff from the contents a of the file
+// oldName to the contents b of the file newName, as diff -u, and git diff do.
+// It writes nothing if they are the same.
+func writeUnifiedDiff(w io.Writer, oldName, newName string, a, b []byte) error {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+	ops := diffLines(splitLines(a), splitLines(b))
+	if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", oldName, newName); err != nil {
+		return err
+	}
+	// The line numbers, in a and b, of every op
+	lineA, lineB := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		lineA[i+1], lineB[i+1] = lineA[i], lineB[i]
+		if op.kind != '+' {
+			lineA[i+1]++
+		}
+		if op.kind != '-' {
+			lineB[i+1]++
+		}
+	}
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// The hunk spans the changes less than twice the context apart
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*diffContext {
+				break
+			}
+		}
+		end += diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+		if _, err := fmt.Fprintf(w, "@@ -%s +%s @@\n",
+			hunkRange(lineA[start], lineA[end]), hunkRange(lineB[start], lineB[end])); err != nil {
+			return err
+		}
+		for _, op := range ops[start:end] {
+			line := op.line
+			if line[len(line)-1] != '\n' {
+				line += "\n\\ No newline at end of file\n"
+			}
+			if _, err := io.WriteString(w, string(op.kind)+line); err != nil {
+				return err
+			}
+		}
+		i = end
+	}
+	return nil
+}
+
+// hunkRange returns the range of the lines from, up to to, in the header of a
+// hunk, which is numbered from 1, and is the line before it if it is empty.
+func hunkRange(from, to int) string {
+	if to-from == 1 {
+		return fmt.Sprint(from + 1)
+	}
+	if to == from {
+		return fmt.Sprintf("%d,0", from)
+	}
+	return fmt.Sprintf("%d,%d", from+1, to-from)
+}
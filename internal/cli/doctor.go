@@ -0,0 +1,134 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// doctorCheck is one of the checks of the environment run by doctor. It
+// returns what it found, and an error if that keeps gobinarycoverage from
+// instrumenting the main module.
+type doctorCheck struct {
+	name  string
+	check func() (string, error)
+}
+
+// doctorUsage is the help of the doctor subcommand.
+const doctorUsage = `
+   gobinarycoverage doctor [-config file]
+
+       Checks the environment gobinarycoverage runs in: the go toolchain,
+       the main module, the configuration, the build cache, and whether
+       anything instrumented is left in the tree, and prints the outcome of
+       each check. Fails if any of them does.
+`
+
+// doctorCommand runs the checks of the environment, and prints their outcome
+// to w, as configured by the arguments of the doctor subcommand.
+func doctorCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, doctorUsage)
+	configFile := fs.String("config", defaultConfigFile, "The configuration file to check")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("usage: gobinarycoverage doctor [-config file]")
+	}
+	var root string
+	checks := []doctorCheck{
+		{"go toolchain", func() (string, error) {
+			if err := syncGoEnv(); err != nil {
+				return "", err
+			}
+			toolchain, err := goEnvVar(&goContext, "GOVERSION")
+			if err != nil {
+				return "", err
+			}
+			minor, ok := goMinorVersion(toolchain)
+			switch {
+			case !ok:
+				return toolchain + ", a development version", nil
+			case minor < minGoMinorVersion:
+				return "", fmt.Errorf("%s is not supported, go1.%d or later is", toolchain, minGoMinorVersion)
+			case minor < nativeMinGoMinorVersion:
+				return toolchain + ", without the native backend", nil
+			}
+			return toolchain, nil
+		}},
+		{"main module", func() (string, error) {
+			goMod, err := goEnvVar(&goContext, "GOMOD")
+			if err != nil {
+				return "", err
+			}
+			if goMod == "" || goMod == os.DevNull {
+				return "", errors.New("not in a module, go.mod is not found")
+			}
+			root, err = moduleRoot(&goContext)
+			return root, err
+		}},
+		{"configuration", func() (string, error) {
+			if _, err := loadConfig(*configFile); err != nil {
+				return "", err
+			}
+			return *configFile, nil
+		}},
+		{"build cache", func() (string, error) {
+			if goCache == "" || goCache == "off" {
+				return "", errors.New("GOCACHE is off")
+			}
+			f, err := os.CreateTemp(goCache, "doctor")
+			if err != nil {
+				return "", fmt.Errorf("%s is not writable: %w", goCache, err)
+			}
+			f.Close()
+			os.Remove(f.Name())
+			return goCache, nil
+		}},
+		{"leftovers", func() (string, error) {
+			if root == "" {
+				return "", errors.New("not checked, the main module is not found")
+			}
+			found, err := findInstrumented(root)
+			if err != nil {
+				return "", err
+			}
+			if len(found) > 0 {
+				return "", fmt.Errorf("run gobinarycoverage restore:\n    %s", strings.Join(found, "\n    "))
+			}
+			return "none", nil
+		}},
+	}
+	failed := 0
+	for _, c := range checks {
+		found, err := c.check()
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL %-14s %s\n", c.name+":", err.Error())
+			continue
+		}
+		fmt.Fprintf(w, "ok   %-14s %s\n", c.name+":", found)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of the %d checks failed", failed, len(checks))
+	}
+	return nil
+}
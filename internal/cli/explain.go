@@ -0,0 +1,183 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// errNotCovered is returned by explain if the line is not covered by any of
+// the profiles.
+var errNotCovered = errors.New("the line is not covered")
+
+// explainedRun is a profile, i.e., a run of an instrumented binary, or the
+// runs merged into it, and the blocks of it on the line explained.
+type explainedRun struct {
+	path    string
+	profile *profile.Profile
+	blocks  []profile.Block
+}
+
+// count returns the largest count of the blocks of the run on the line
+func (r *explainedRun) count() int {
+	count := 0
+	for _, b := range r.blocks {
+		if b.Count > count {
+			count = b.Count
+		}
+	}
+	return count
+}
+
+// label returns the build, and the tags, of the run, as told by the sidecar of
+// its profile, if any
+func (r *explainedRun) label() string {
+	var label []string
+	if r.profile.Build != "" {
+		label = append(label, "build "+r.profile.Build)
+	}
+	if tags := (profileSelection{tags: r.profile.Tags}).tagsString(); tags != "" {
+		label = append(label, tags)
+	}
+	return strings.Join(label, "  ")
+}
+
+// parsePosition parses a position, file.go:line, where the file is the name in
+// the profiles, or a suffix of it, as in selectProfileFiles.
+func parsePosition(pos string) (string, int, error) {
+	i := strings.LastIndex(pos, ":")
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid position: %q, expected file.go:line", pos)
+	}
+	line, err := strconv.Atoi(pos[i+1:])
+	if err != nil || line < 1 {
+		return "", 0, fmt.Errorf("invalid position: %q, expected file.go:line", pos)
+	}
+	return filepath.ToSlash(pos[:i]), line, nil
+}
+
+// explainUsage is the help of the explain subcommand.
+const explainUsage = `
+   gobinarycoverage explain file.go:line profile.out|dir [profile.out|dir...]
+
+       Tells whether the line is covered, and by which of the profiles
+       given, or found in the directories given, without merging them,
+       along with the build, and the tags, of every profile. The file is
+       the name in the profiles, or a suffix of it. Exits with 2 if the
+       line is not covered.
+`
+
+// explainCommand tells whether a line is covered, and by which of the profiles
+// given, as configured by the arguments of the explain subcommand, along with
+// their build, and tags, so that it is told which of the runs, e.g., of which
+// test scenario, or on which device, hit it. The profiles are not merged.
+func explainCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, explainUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return errors.New("usage: gobinarycoverage explain file.go:line profile.out|dir [profile.out|dir...]")
+	}
+	pattern, line, err := parsePosition(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	paths, err := profilePaths(mergeArgs(fs.Args()[1:]))
+	if err != nil {
+		return err
+	}
+
+	// The file is resolved in all the profiles, as it may be in some of them
+	// only, e.g., in the ones of another build
+	file := ""
+	var runs []*explainedRun
+	for _, path := range paths {
+		p, err := profile.ParseFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err.Error())
+		}
+		run := &explainedRun{path: path, profile: p}
+		for _, b := range p.Blocks {
+			if b.File != pattern && !strings.HasSuffix(b.File, "/"+pattern) {
+				continue
+			}
+			if file != "" && b.File != file {
+				return fmt.Errorf("%s matches both %s and %s, give more of the path", pattern, file, b.File)
+			}
+			file = b.File
+			if b.StartLine <= line && line <= b.EndLine {
+				run.blocks = append(run.blocks, b)
+			}
+		}
+		runs = append(runs, run)
+	}
+	if file == "" {
+		return fmt.Errorf("no file in the profiles matches %s", pattern)
+	}
+
+	var covered, uncovered, missing []*explainedRun
+	for _, run := range runs {
+		switch {
+		case len(run.blocks) == 0:
+			missing = append(missing, run)
+		case run.count() > 0:
+			covered = append(covered, run)
+		default:
+			uncovered = append(uncovered, run)
+		}
+	}
+	if len(missing) == len(runs) {
+		fmt.Fprintf(w, "%s:%d is not in any block, it has no statements\n", file, line)
+		return errNotCovered
+	}
+	sort.SliceStable(covered, func(i, j int) bool { return covered[i].count() > covered[j].count() })
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	if len(covered) > 0 {
+		fmt.Fprintf(tw, "%s:%d is covered by %d of %d runs:\n", file, line, len(covered), len(runs)-len(missing))
+		for _, run := range covered {
+			fmt.Fprintf(tw, "    %s\tcount %d\t%s\n", run.path, run.count(), run.label())
+		}
+		if len(uncovered) > 0 {
+			fmt.Fprintln(tw, "not covered by:")
+		}
+	} else {
+		fmt.Fprintf(tw, "%s:%d is not covered by any of %d runs:\n", file, line, len(uncovered))
+	}
+	for _, run := range uncovered {
+		fmt.Fprintf(tw, "    %s\t\t%s\n", run.path, run.label())
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(tw, "not in %d of the profiles, e.g., as they are of other builds\n", len(missing))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(covered) == 0 {
+		return errNotCovered
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// TestFlushRepeated instruments, and runs, a binary calling coverage.Flush
+// twice, with a statement covered in between, and verifies that every flush
+// writes a profile of the coverage gathered so far, rather than the first
+// one only.
+func TestFlushRepeated(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds, and runs, an instrumented binary")
+	}
+	root, err := filepath.Abs(filepath.Join("..", ".."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := os.ReadFile(filepath.Join(root, "go.sum"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"go.mod": "module example.com/flush\n\ngo 1.22\n\n" +
+			"require github.com/mendersoftware/gobinarycoverage v0.0.0\n\n" +
+			"replace github.com/mendersoftware/gobinarycoverage => " + root + "\n",
+		"go.sum": string(sum),
+		"main.go": "package main\n\n" +
+			"import (\n" +
+			"\t\"example.com/flush/lib\"\n" +
+			"\t\"github.com/mendersoftware/gobinarycoverage/coverage\"\n" +
+			")\n\n" +
+			"func main() {\n" +
+			"\tlib.First()\n" +
+			"\tcoverage.Flush()\n" +
+			"\tlib.Second()\n" +
+			"\tcoverage.Flush()\n" +
+			"}\n",
+		"lib/lib.go": "package lib\n\n" +
+			"var x int\n\n" +
+			"func First() {\n" +
+			"\tx = 1\n" +
+			"}\n\n" +
+			"func Second() {\n" +
+			"\tx = 2\n" +
+			"}\n",
+	}
+	dir := t.TempDir()
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chdir(t, dir)
+	if err = instrument("example.com/flush", options{force: true}); err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(dir, "flush")
+	if _, err = runCommand(dir, nil, "go", "build", "-o", binary, "."); err != nil {
+		t.Fatal(err)
+	}
+	env := append(os.Environ(), "COVERAGE_FILEPATH="+dir)
+	if _, err = runCommand(dir, env, binary); err != nil {
+		t.Fatal(err)
+	}
+
+	profiles, err := filepath.Glob(filepath.Join(dir, "coverage*.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each of the flushes, and the exit, write a profile
+	if len(profiles) != 3 {
+		t.Fatalf("expected 3 coverage profiles, found %d", len(profiles))
+	}
+	// The body of Second starts on line 9
+	var seconds []int
+	for _, name := range profiles {
+		p, err := profile.ParseFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range p.Blocks {
+			if b.File == "example.com/flush/lib/lib.go" && b.StartLine == 9 {
+				seconds = append(seconds, b.Count)
+			}
+		}
+	}
+	sort.Ints(seconds)
+	if len(seconds) != 3 || seconds[0] != 0 || seconds[1] != 1 || seconds[2] != 1 {
+		t.Errorf("Second is counted %v in the profiles, want [0 1 1]", seconds)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// binaryReportFormats are the reports the instrumented binary writes next to
+// every profile, as <profile><suffix>, with -report-formats, by their format.
+var binaryReportFormats = map[string]string{
+	"lcov":      ".info",
+	"cobertura": ".xml",
+	"json":      ".summary.json",
+}
+
+// checkReportFormats returns the comma separated formats in list, failing on
+// the ones the instrumented binary does not write.
+func checkReportFormats(list string) (string, error) {
+	var formats []string
+	for _, format := range strings.Split(list, ",") {
+		format = strings.TrimSpace(format)
+		if format == "" {
+			continue
+		}
+		if _, ok := binaryReportFormats[format]; !ok {
+			return "", fmt.Errorf("unknown report format: %s, expected lcov, cobertura, or json", format)
+		}
+		formats = append(formats, format)
+	}
+	return strings.Join(formats, ","), nil
+}
+
+// isProfileCompanion returns true if name is a file written next to the
+// profile given, i.e., its sidecar, or one of its reports.
+func isProfileCompanion(name string, given map[string]bool) bool {
+	suffixes := []string{".json"}
+	for _, suffix := range binaryReportFormats {
+		suffixes = append(suffixes, suffix)
+	}
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) && given[strings.TrimSuffix(name, suffix)] {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceDirs returns the directories of the covered packages, relative to the
+// root of the main module, as the comma separated import-path=dir, so that
+// the reports of the instrumented binary name the files by their paths in the
+// repository. The packages outside of root, e.g., of the modules replaced by
+// local directories, are named by their import paths.
+func sourceDirs(root string, covered []*coverInfo) string {
+	var dirs []string
+	for _, ci := range covered {
+		for _, cv := range ci.Vars {
+			rel, err := filepath.Rel(root, filepath.Dir(cv.Path))
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				dirs = append(dirs, ci.Package+"="+filepath.ToSlash(rel))
+			}
+			break
+		}
+	}
+	sort.Strings(dirs)
+	return strings.Join(dirs, ",")
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"sort"
+)
+
+// The granularities of the coverage, i.e., whether there is a counter for
+// every block, as instrumented by go tool cover, or for every function only.
+const (
+	granularityBlock = "block"
+	granularityFunc  = "func"
+)
+
+// funcBlock is a function instrumented with a single counter
+type funcBlock struct {
+	lbrace, rbrace token.Position
+	stmts          int
+}
+
+// coverFuncs instruments the file at src with a counter for every function,
+// and function literal, in it, in the variable varName, in the same form as go
+// tool cover instruments it with a counter for every block, so that the rest
+// of the instrumentation, and the runtime, do not tell them apart. Every
+// function is a single block, spanning its body, holding all of its
+// statements, except the ones of the function literals in it, which are
+// blocks of their own.
+func coverFuncs(src, dst, mode, varName string) error {
+	contents, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, src, contents, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return err
+	}
+	var funcs []funcBlock
+	ast.Inspect(f, func(n ast.Node) bool {
+		var body *ast.BlockStmt
+		switch n := n.(type) {
+		case *ast.FuncDecl:
+			body = n.Body
+		case *ast.FuncLit:
+			body = n.Body
+		}
+		if body != nil {
+			funcs = append(funcs, funcBlock{
+				lbrace: fset.Position(body.Lbrace),
+				rbrace: fset.Position(body.Rbrace),
+				stmts:  countStmts(body),
+			})
+		}
+		return true
+	})
+
+	// Insert the counters right after the opening braces, keeping the lines
+	// as they are
+	type insertion struct {
+		offset int
+		text   string
+	}
+	var inserts []insertion
+	for i, fn := range funcs {
+		counter := fmt.Sprintf("%s.Count[%d]", varName, i)
+		switch mode {
+		case "set":
+			counter += " = 1;"
+		case "count":
+			counter += "++;"
+		case "atomic":
+			counter = "_cover_atomic_.AddUint32(&" + counter + ", 1);"
+		}
+		inserts = append(inserts, insertion{fn.lbrace.Offset + 1, counter})
+	}
+	if mode == "atomic" {
+		inserts = append(inserts, insertion{fset.Position(f.Name.End()).Offset, `; import _cover_atomic_ "sync/atomic"`})
+	}
+	sort.SliceStable(inserts, func(i, j int) bool { return inserts[i].offset < inserts[j].offset })
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "//line %s:1:1\n", src)
+	last := 0
+	for _, in := range inserts {
+		out.Write(contents[last:in.offset])
+		out.WriteString(in.text)
+		last = in.offset
+	}
+	out.Write(contents[last:])
+
+	// The block of a function starts after its opening brace, and ends after
+	// its closing brace
+	blocks := make([][5]int, len(funcs))
+	for i, fn := range funcs {
+		blocks[i] = [5]int{fn.lbrace.Line, fn.lbrace.Column + 1, fn.rbrace.Line, fn.rbrace.Column + 1, fn.stmts}
+	}
+	out.WriteString("\n")
+	writeCoverVar(&out, varName, blocks)
+	if mode == "atomic" {
+		out.WriteString("\nvar _ = _cover_atomic_.LoadUint32\n")
+	}
+	return os.WriteFile(dst, out.Bytes(), 0644)
+}
+
+// writeCoverVar writes the declaration of the variable varName, holding the
+// counters of blocks, as written by go tool cover. The blocks are as returned
+// by parseCoverBlocks.
+func writeCoverVar(w io.Writer, varName string, blocks [][5]int) {
+	n := len(blocks)
+	fmt.Fprintf(w, "var %s = struct {\n\tCount     [%d]uint32\n\tPos       [3 * %d]uint32\n\tNumStmt   [%d]uint16\n} {\n",
+		varName, n, n, n)
+	fmt.Fprintf(w, "\tPos: [3 * %d]uint32{\n", n)
+	for i, b := range blocks {
+		// The columns are packed into the third value
+		fmt.Fprintf(w, "\t\t%d, %d, %#x, // [%d]\n", b[0], b[2], b[3]<<16|b[1]&0xFFFF, i)
+	}
+	fmt.Fprintf(w, "\t},\n\tNumStmt: [%d]uint16{\n", n)
+	for i, b := range blocks {
+		fmt.Fprintf(w, "\t\t%d, // %d\n", b[4], i)
+	}
+	io.WriteString(w, "\t},\n}\n")
+}
+
+// countStmts returns the number of statements in body, as counted by go tool
+// cover, without the ones in the function literals in it.
+func countStmts(body *ast.BlockStmt) int {
+	n := 0
+	ast.Inspect(body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.BlockStmt:
+			// The clauses of switch and select statements are not
+			// statements by themselves, only the ones in them are
+			for _, stmt := range node.List {
+				switch stmt.(type) {
+				case *ast.CaseClause, *ast.CommClause:
+				default:
+					n++
+				}
+			}
+		case *ast.CaseClause:
+			n += len(node.Body)
+		case *ast.CommClause:
+			n += len(node.Body)
+		}
+		return true
+	})
+	return n
+}
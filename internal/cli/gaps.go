@@ -0,0 +1,114 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// testGap is an uncovered function, and the number of functions calling it
+type testGap struct {
+	funcCoverage
+	Callers int
+}
+
+// score is the rank of the gap, the more uncovered statements, and the more
+// callers, the higher, as a test of it covers the most, and the failures in
+// it affect the most code
+func (g testGap) score() int {
+	return (g.Statements - g.Covered) * (g.Callers + 1)
+}
+
+// callers returns the number of the functions, and methods, which reference
+// every function, or method, declared in the packages analysed, by the name
+// of its file, as in the profile, and the line it is declared on.
+func (d *deadCode) callers() map[string]int {
+	counts := make(map[string]int)
+	for _, caller := range d.decls {
+		seen := map[*declaredFunc]bool{caller: true}
+		d.references(caller.pkg, caller.file, caller.decl, func(fn *declaredFunc) {
+			if !seen[fn] {
+				seen[fn] = true
+				counts[fmt.Sprintf("%s:%d", fn.file.name, d.fset.Position(fn.decl.Pos()).Line)]++
+			}
+		})
+	}
+	return counts
+}
+
+// gapsUsage is the help of the gaps subcommand.
+const gapsUsage = `
+   gobinarycoverage gaps [-main package] [-pkg pattern] [-partial] [-n count] profile.out [profile.out...]
+
+       Lists the uncovered functions to write tests for first, ranked by
+       their uncovered statements times the number of functions calling
+       them, plus one, as found in the sources of the packages, and of
+       the main package (default .). -pkg, -partial, and -n are as for
+       uncovered.
+`
+
+// gapsCommand lists the uncovered functions to write tests for first, ranked
+// by their uncovered statements, and their callers, as configured by the
+// arguments of the gaps subcommand.
+func gapsCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("gaps", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, gapsUsage)
+	mainPkg := fs.String("main", ".", "The main package the binary is built from, whose calls are counted as well")
+	pkg := fs.String("pkg", "", "Only list the functions in the packages matching this pattern, e.g. example.com/app/...")
+	partial := fs.Bool("partial", false, "List the partially covered functions as well, by their uncovered statements")
+	limit := fs.Int("n", 20, "The number of functions to list, or 0 for all")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: gobinarycoverage gaps [-main package] [-pkg pattern] [-partial] [-n count] profile.out [profile.out...]")
+	}
+	merged, err := loadProfile(fs.Args())
+	if err != nil {
+		return err
+	}
+	all, err := profileFuncCoverage(merged, *pkg)
+	if err != nil {
+		return err
+	}
+	goos, goarch := merged.Tags["goos"], merged.Tags["goarch"]
+	d, _, err := parseProfileSources(options{goos: goos, goarch: goarch}.buildContext(), goos, goarch, *mainPkg, merged)
+	if err != nil {
+		return err
+	}
+	callers := d.callers()
+	var gaps []testGap
+	for _, f := range all {
+		if f.Statements > f.Covered && (f.Covered == 0 || *partial) {
+			gaps = append(gaps, testGap{f, callers[fmt.Sprintf("%s:%d", f.File, f.Line)]})
+		}
+	}
+	sort.SliceStable(gaps, func(i, j int) bool {
+		return gaps[i].score() > gaps[j].score()
+	})
+	if *limit > 0 && len(gaps) > *limit {
+		gaps = gaps[:*limit]
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, g := range gaps {
+		fmt.Fprintf(tw, "%s:%d\t%s\t%d/%d uncovered\t%d callers\n", g.File, g.Line, g.Name, g.Statements-g.Covered, g.Statements, g.Callers)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,460 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// runtimeSources is the coverage runtime, which is copied into the generated
+// main file. See the runtimesrc package.
+//
+//go:embed runtimesrc/*.go
+var runtimeSources embed.FS
+
+// optionalRuntimeFiles are the runtime files which are only included in the
+// generated main file when the option enabling them is given.
+var optionalRuntimeFiles = map[string]func(cover *Cover) bool{
+	"runtimesrc/systemd.go": func(cover *Cover) bool { return cover.SystemdNotify },
+	"runtimesrc/signal.go": func(cover *Cover) bool {
+		return cover.FlushOnSIGTERM || cover.ExitSignals != "" || cover.FlushSignals != ""
+	},
+	"runtimesrc/dump.go":    func(cover *Cover) bool { return cover.DumpAddr != "" },
+	"runtimesrc/compact.go": func(cover *Cover) bool { return cover.CompactID != "" },
+	"runtimesrc/trigger.go": func(cover *Cover) bool { return cover.FlushTrigger != "" },
+	"runtimesrc/live.go":    func(cover *Cover) bool { return cover.LiveAddr != "" },
+	"runtimesrc/listen.go":  func(cover *Cover) bool { return cover.Serve },
+	"runtimesrc/formats.go": func(cover *Cover) bool { return cover.ReportFormats != "" },
+	"runtimesrc/expvar.go":  func(cover *Cover) bool { return cover.Expvar },
+	"runtimesrc/pprof.go":   func(cover *Cover) bool { return cover.Pprof },
+	"runtimesrc/rotate.go":  func(cover *Cover) bool { return cover.Rotate != "" },
+	"runtimesrc/syslog.go":  func(cover *Cover) bool { return cover.SyslogFallback },
+	"runtimesrc/mqtt.go":    func(cover *Cover) bool { return cover.MQTTBroker != "" },
+	"runtimesrc/persist.go": func(cover *Cover) bool { return cover.Persist != "" },
+	"runtimesrc/lock.go":    func(cover *Cover) bool { return cover.Lock },
+	"runtimesrc/retention.go": func(cover *Cover) bool {
+		return cover.MaxProfiles > 0 || cover.MaxProfilesSize > 0
+	},
+	"runtimesrc/serve.go": func(cover *Cover) bool {
+		return cover.DumpAddr != "" || cover.LiveAddr != "" || cover.Serve
+	},
+	"runtimesrc/cobra.go": func(cover *Cover) bool { return cover.Cobra },
+}
+
+// coverImportName returns the name the i'th covered package is imported as in
+// the generated main file.
+func coverImportName(i int) string {
+	return "_cover" + strconv.Itoa(i)
+}
+
+// generateMain constructs the AST of the generated main file. It consists of
+// the declarations in the coverage runtime, and a function registering the
+// GoCover variables from all the covered packages with the runtime.
+//
+// The registration is run from the initializer of the coverRegistered
+// variable, and not from an init function, since all the package level
+// variables are initialized before any of the init functions in the main
+// package run, regardless of the files they are declared in. The init
+// functions in the covered packages run before it, as they are imported, but
+// the counters they hit are the ones registered, so they are counted all the
+// same.
+//
+// Runtime files importing packages outside the standard library, i.e., the
+// helper package, are only included if the main package depends on the
+// packages already, so that no dependencies are added to the binary.
+func generateMain(fset *token.FileSet, cover *Cover) (*ast.File, error) {
+	imports := &ast.GenDecl{Tok: token.IMPORT}
+	f := &ast.File{
+		Name:  ast.NewIdent("main"),
+		Decls: []ast.Decl{imports},
+	}
+
+	//
+	// Copy the declarations from the runtime
+	//
+	names, err := fs.Glob(runtimeSources, "runtimesrc/*.go")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	deps := make(map[string]bool, len(cover.Deps))
+	for _, dep := range cover.Deps {
+		deps[dep] = true
+	}
+	imported := make(map[string]bool)
+	for _, name := range names {
+		if enabled, optional := optionalRuntimeFiles[name]; optional && !enabled(cover) {
+			continue
+		}
+		src, err := runtimeSources.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		rf, err := parser.ParseFile(fset, name, src, 0)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to parse the runtime source: %s. Error: %s\n", name, err.Error())
+			return nil, err
+		}
+		if !hasRuntimeDeps(rf, deps) {
+			continue
+		}
+		for _, spec := range rf.Imports {
+			if imported[spec.Path.Value] {
+				continue
+			}
+			imported[spec.Path.Value] = true
+			imports.Specs = append(imports.Specs, spec)
+			f.Imports = append(f.Imports, spec)
+		}
+		for _, decl := range rf.Decls {
+			if d, isDecl := decl.(*ast.GenDecl); isDecl && d.Tok == token.IMPORT {
+				continue
+			}
+			f.Decls = append(f.Decls, decl)
+		}
+	}
+
+	config := map[string]string{
+		"coverLabel":     cover.Label,
+		"coverEnvPrefix": cover.EnvPrefix,
+		"coverMode":      cover.Mode,
+		"coverModule":    cover.Module,
+		"coverSettings":  cover.Settings,
+		"coverTool":      getVersionInfo().Version,
+	}
+	if cover.DumpAddr != "" {
+		config["coverDumpAddr"] = cover.DumpAddr
+	}
+	if cover.LiveAddr != "" {
+		config["coverLiveAddr"] = cover.LiveAddr
+	}
+	if cover.FlushTrigger != "" {
+		config["coverFlushTrigger"] = cover.FlushTrigger
+	}
+	if cover.ReportFormats != "" {
+		config["coverReportFormats"] = cover.ReportFormats
+		config["coverSourceRoot"] = cover.SourceRoot
+		config["coverSourceDirs"] = cover.SourceDirs
+	}
+	if cover.ExitSignals != "" || cover.FlushSignals != "" {
+		config["coverExitSignals"] = cover.ExitSignals
+		config["coverFlushSignals"] = cover.FlushSignals
+	}
+	if cover.Rotate != "" {
+		config["coverRotate"] = cover.Rotate
+	}
+	if cover.MQTTBroker != "" {
+		config["coverMQTTBroker"] = cover.MQTTBroker
+		config["coverMQTTTopic"] = cover.MQTTTopic
+	}
+	if cover.SubcommandDepth > 0 {
+		config["coverSubcommandDepth"] = strconv.Itoa(cover.SubcommandDepth)
+	}
+	if cover.MaxProfiles > 0 {
+		config["coverMaxProfiles"] = strconv.Itoa(cover.MaxProfiles)
+	}
+	if cover.MaxProfilesSize > 0 {
+		config["coverMaxProfilesSize"] = strconv.FormatInt(cover.MaxProfilesSize, 10)
+	}
+	if cover.CompactID != "" {
+		config["coverCompactID"] = cover.CompactID
+	}
+	if cover.LogFile != "" {
+		config["coverLogFile"] = cover.LogFile
+	}
+	if cover.Dir != "" {
+		config["coverDir"] = cover.Dir
+	}
+	if cover.Persist != "" {
+		config["coverPersist"] = cover.Persist
+	}
+	if len(cover.TotalPackages) > 0 {
+		config["coverTotal"] = strings.Join(cover.TotalPackages, ",")
+	}
+	if cover.Sample > 0 && cover.Sample < 100 {
+		config["coverSample"] = strconv.FormatFloat(cover.Sample, 'g', -1, 64)
+	}
+	for name, value := range config {
+		if err := setRuntimeVar(f, name, &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(value)}); err != nil {
+			return nil, err
+		}
+	}
+
+	//
+	// Import all the GoCover variables from the packages which are coverage
+	// instrumented, and register them in init
+	//
+	register := &ast.BlockStmt{}
+	for i, ci := range cover.CoverInfo {
+		spec := &ast.ImportSpec{
+			Name: ast.NewIdent(coverImportName(i)),
+			Path: &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(cover.SourceImportPath(ci.Package))},
+		}
+		imports.Specs = append(imports.Specs, spec)
+		f.Imports = append(f.Imports, spec)
+
+		for _, cv := range ci.sortedVars() {
+			// _coverN.GoCoverM.<field>[:]
+			field := func(name string) ast.Expr {
+				return &ast.SliceExpr{
+					X: &ast.SelectorExpr{
+						X: &ast.SelectorExpr{
+							X:   ast.NewIdent(coverImportName(i)),
+							Sel: ast.NewIdent(cv.Var),
+						},
+						Sel: ast.NewIdent(name),
+					},
+				}
+			}
+			register.List = append(register.List, &ast.ExprStmt{
+				X: &ast.CallExpr{
+					Fun: ast.NewIdent("coverRegisterFile"),
+					Args: []ast.Expr{
+						&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(cv.File)},
+						field("Count"),
+						field("Pos"),
+						field("NumStmt"),
+					},
+				},
+			})
+		}
+	}
+	// func coverRegister() bool { ...; return true }
+	register.List = append(register.List, &ast.ReturnStmt{Results: []ast.Expr{ast.NewIdent("true")}})
+	f.Decls = append(f.Decls,
+		&ast.GenDecl{
+			Tok: token.VAR,
+			Specs: []ast.Spec{&ast.ValueSpec{
+				Names:  []*ast.Ident{ast.NewIdent("coverRegistered")},
+				Values: []ast.Expr{&ast.CallExpr{Fun: ast.NewIdent("coverRegister")}},
+			}},
+		},
+		&ast.FuncDecl{
+			Name: ast.NewIdent("coverRegister"),
+			Type: &ast.FuncType{
+				Params:  &ast.FieldList{},
+				Results: &ast.FieldList{List: []*ast.Field{{Type: ast.NewIdent("bool")}}},
+			},
+			Body: register,
+		})
+	return f, nil
+}
+
+// defaultEnvPrefix is the prefix of the environment variables read by the
+// instrumented binary, unless another one is given through -env-prefix.
+const defaultEnvPrefix = "COVERAGE_"
+
+// checkEnvPrefix verifies that prefix only holds the characters which are
+// portable in environment variable names, and returns the default prefix if
+// it is empty.
+func checkEnvPrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return defaultEnvPrefix, nil
+	}
+	for i, r := range prefix {
+		if !(r == '_' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || i > 0 && r >= '0' && r <= '9') {
+			return "", fmt.Errorf("%q is not a valid environment variable prefix, "+
+				"only letters, digits and underscores are allowed, and it can not start with a digit", prefix)
+		}
+	}
+	return prefix, nil
+}
+
+// checkRotate verifies that rotate is an interval the runtime rotates the
+// profiles at, i.e., hourly, daily, or a positive duration, if given.
+func checkRotate(rotate string) error {
+	switch rotate {
+	case "", "hourly", "daily":
+		return nil
+	}
+	if d, err := time.ParseDuration(rotate); err != nil || d <= 0 {
+		return fmt.Errorf("%q is not a valid interval, expected hourly, daily, or a positive duration, e.g. 30m", rotate)
+	}
+	return nil
+}
+
+// setRuntimeVar replaces the value of the package level variable name, copied
+// from the runtime into f, with value.
+func setRuntimeVar(f *ast.File, name string, value ast.Expr) error {
+	for _, decl := range f.Decls {
+		d, isDecl := decl.(*ast.GenDecl)
+		if !isDecl || d.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range d.Specs {
+			vs := spec.(*ast.ValueSpec)
+			for i, ident := range vs.Names {
+				if ident.Name == name && i < len(vs.Values) {
+					vs.Values[i] = value
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("the runtime variable %s is not found", name)
+}
+
+// hasRuntimeDeps returns true if all the packages outside the standard library
+// imported by the runtime file f are in deps.
+func hasRuntimeDeps(f *ast.File, deps map[string]bool) bool {
+	for _, spec := range f.Imports {
+		p, _ := strconv.Unquote(spec.Path.Value)
+		// Only the paths outside the standard library have a dot in their
+		// first element
+		if first, _, _ := strings.Cut(p, "/"); strings.Contains(first, ".") && !deps[p] {
+			return false
+		}
+	}
+	return true
+}
+
+// templateFuncs returns the functions available to the main file templates,
+// which follow the conventions of generateMain, so that the templates do not
+// have to re-implement them:
+//
+//	coverImport i     The name the i'th covered package is imported as, e.g., _cover0
+//	importPath pkg    The path the package pkg is imported as, see SourceImportPath
+//	coverVars ci      The GoCover variables of ci, in the order they are registered
+//	packagePath file  The import path of the package of the file file, as in the profile
+//	relPath file mod  The path of file relative to the module mod, or file if it is outside of it
+//	isSet, isCount, isAtomic
+//	                  Whether the coverage mode is set, count, or atomic
+//	envVar name       The name of the environment variable name, e.g., COVERAGE_FILEPATH for FILEPATH
+//	quote s           s as a Go string literal
+func templateFuncs(cover *Cover) template.FuncMap {
+	return template.FuncMap{
+		"coverImport": coverImportName,
+		"importPath":  cover.SourceImportPath,
+		"coverVars":   func(ci *coverInfo) []*CoverVar { return ci.sortedVars() },
+		"packagePath": path.Dir,
+		"relPath": func(file, module string) string {
+			if rel := strings.TrimPrefix(file, module+"/"); rel != file {
+				return rel
+			}
+			return file
+		},
+		"isSet":    func() bool { return cover.Mode == "set" },
+		"isCount":  func() bool { return cover.Mode == "count" },
+		"isAtomic": func() bool { return cover.Mode == "atomic" },
+		"envVar":   func(name string) string { return cover.EnvPrefix + name },
+		"quote":    strconv.Quote,
+	}
+}
+
+// generateMainFromTemplate generates the main file from the text/template in
+// templateFile, executed with cover as its data, and the functions of
+// templateFuncs. This overrides the generated main file constructed by
+// generateMain.
+func generateMainFromTemplate(fset *token.FileSet, cover *Cover, templateFile string) (*ast.File, error) {
+	tmplStr, err := os.ReadFile(templateFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read the main.go template. Error: %s\n", err.Error())
+		return nil, err
+	}
+	tmpl, err := template.New("Main").Funcs(templateFuncs(cover)).Parse(string(tmplStr))
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to parse the main.go template. Error: %s\n", err.Error())
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, cover); err != nil {
+		fmt.Fprintf(stderr, "Failed to execute the main.go template. Error: %s\n", err.Error())
+		return nil, err
+	}
+	// Parse the template file generated into an AST
+	f, err := parser.ParseFile(fset, templateFile, buf.String(), 0)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to parse the generated main file. Error: %s\n", err.Error())
+		return nil, err
+	}
+	return f, nil
+}
+
+// stubImporter imports the covered packages as stubs, only declaring their
+// GoCover variables, and everything else through the fallback importer, which
+// finds the helper package from source.
+type stubImporter struct {
+	fallback types.Importer
+	stubs    map[string]*types.Package
+}
+
+func (s *stubImporter) Import(path string) (*types.Package, error) {
+	if p, ok := s.stubs[path]; ok {
+		return p, nil
+	}
+	return s.fallback.Import(path)
+}
+
+// newStubImporter creates the stubs of the covered packages. The GoCover
+// variables are given the same structure as the one generated by go tool
+// cover, only with empty arrays, as the sizes are not needed to check the
+// generated main file.
+func newStubImporter(fset *token.FileSet, cover *Cover) *stubImporter {
+	s := &stubImporter{
+		fallback: newSourceImporter(fset),
+		stubs:    make(map[string]*types.Package),
+	}
+	array := func(kind types.BasicKind) *types.Array {
+		return types.NewArray(types.Typ[kind], 0)
+	}
+	for _, ci := range cover.CoverInfo {
+		p := types.NewPackage(cover.SourceImportPath(ci.Package), path.Base(ci.Package))
+		for _, cv := range ci.Vars {
+			goCover := types.NewStruct([]*types.Var{
+				types.NewField(token.NoPos, p, "Count", array(types.Uint32), false),
+				types.NewField(token.NoPos, p, "Pos", array(types.Uint32), false),
+				types.NewField(token.NoPos, p, "NumStmt", array(types.Uint16), false),
+			}, nil)
+			p.Scope().Insert(types.NewVar(token.NoPos, p, cv.Var, goCover))
+		}
+		p.MarkComplete()
+		s.stubs[p.Path()] = p
+	}
+	return s
+}
+
+// typeCheckMain type-checks the generated main file on its own, before it is
+// merged with the main file of the package, so that errors in it are reported
+// in the generated code, and not when building the instrumented binary.
+//
+// The returned type information is used to resolve the imports of the
+// generated file against the ones in the main file.
+func typeCheckMain(fset *token.FileSet, f *ast.File, cover *Cover) (*types.Info, error) {
+	conf := types.Config{Importer: newStubImporter(fset, cover)}
+	info := &types.Info{
+		Defs:      make(map[*ast.Ident]types.Object),
+		Uses:      make(map[*ast.Ident]types.Object),
+		Implicits: make(map[ast.Node]types.Object),
+	}
+	if _, err := conf.Check("main", fset, []*ast.File{f}, info); err != nil {
+		fmt.Fprintf(stderr, "The generated main file does not type-check. Error: %s\n", err.Error())
+		return nil, err
+	}
+	return info, nil
+}
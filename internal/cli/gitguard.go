@@ -0,0 +1,84 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// stashMessage is the message of the stash entry -stash saves the uncommitted
+// changes in.
+const stashMessage = "gobinarycoverage: the tree before instrumenting"
+
+// stashRestoreCommand restores the tree, and the changes saved with -stash, after
+// instrumenting.
+const stashRestoreCommand = "git reset -q -- . && git checkout -- . && git clean -fd -- . && git stash pop --index"
+
+// treePathspec limits the git commands to the tree of the main module,
+// leaving out the files of gobinarycoverage itself, such as the lock.
+var treePathspec = []string{"--", ".", ":(exclude).gobinarycoverage"}
+
+// ErrDirtyTree is returned when the tree to instrument has uncommitted changes
+var ErrDirtyTree = errors.New("the tree has uncommitted changes, " +
+	"which would be mixed up with the instrumented code beyond recovery. " +
+	"Commit them, or instrument with -stash in order to save a copy of them in the git stash, " +
+	"or with -force in order to instrument anyway")
+
+// gitStatus returns the changes in the tree at root, as listed by
+// git status --porcelain, leaving out the files of gobinarycoverage itself,
+// and false if root is not in a git work tree.
+func gitStatus(root string) (string, bool, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", false, nil
+	}
+	if _, err := runCommand(root, nil, "git", "rev-parse", "--is-inside-work-tree"); err != nil {
+		return "", false, nil
+	}
+	out, err := runCommand(root, nil, "git", append([]string{"status", "--porcelain"}, treePathspec...)...)
+	return string(out), true, err
+}
+
+// checkCleanTree refuses to instrument the tree at root if git reports
+// uncommitted changes in it, unless force is true. With stash, the changes are
+// saved in the git stash, and left in the tree, so that they can be recovered
+// after restoring it, see stashRestoreCommand.
+func checkCleanTree(root string, force, stash bool) error {
+	status, isRepo, err := gitStatus(root)
+	if err != nil || !isRepo || status == "" {
+		return err
+	}
+	if stash {
+		// git stash push cleans the tree, so the changes are applied back
+		// right away, keeping the stash entry
+		if _, err = runCommand(root, nil, "git", append([]string{"stash", "push", "--include-untracked",
+			"-m", stashMessage}, treePathspec...)...); err != nil {
+			return err
+		}
+		if _, err = runCommand(root, nil, "git", "stash", "apply", "--index"); err != nil {
+			return fmt.Errorf("failed to apply the stashed changes back, they are in the git stash. Error: %s", err.Error())
+		}
+		fmt.Fprintf(stderr, "Saved the uncommitted changes in the git stash, as %q. "+
+			"Restore the tree, and them, after instrumenting with: %s\n", stashMessage, stashRestoreCommand)
+		return nil
+	}
+	if force {
+		return nil
+	}
+	fmt.Fprintf(stderr, "Uncommitted changes in %s:\n%s", root, strings.TrimRight(status, "\n")+"\n")
+	return ErrDirtyTree
+}
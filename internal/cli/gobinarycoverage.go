@@ -0,0 +1,2302 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+//
+// Usage:
+//
+//    instrumentmain mainPackage
+//
+//        Enables coverage of all the files in the mainPackage listed,
+//        and outputs a dynamically generated new main file on stdout,
+//        which encorporates all the variables from the files that
+//        are to be analyzed for their coverage.
+//
+//     Note:
+//        The files in the packages listed will be changed locally.
+//
+//
+// Environment variables:
+//
+//  - COVERAGE_FILENAME: The suffix given to the coverage file created
+//  - COVERAGE_FILEPATH: The directory in which to put the coverage file
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	// Parse Go source code
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/token"
+)
+
+// usageString is the overview of gobinarycoverage, followed by the list of
+// the subcommands, see printUsage. The help of every subcommand is printed
+// with its flags, by subcommandUsage.
+var usageString string = `
+Usage:
+
+   gobinarycoverage [-timeout duration] [-retries n] subcommand [flags] [arguments]
+
+       Runs the subcommand, e.g., instrument, build, run, report or check,
+       listed below. The global flags, -timeout and -retries, are given
+       before the subcommand, and apply to all of them. A package given
+       instead of a subcommand is instrumented, as with instrument, with
+       its flags before the packages, for compatibility with the versions
+       before the subcommands. Run gobinarycoverage subcommand -h for the
+       help of the subcommand, and its flags.
+`
+
+// environmentUsage lists the environment variables read by the instrumented
+// binaries.
+const environmentUsage = `
+Environment variables:
+
+     - COVERAGE_FILENAME: The suffix given to the coverage file created
+     - COVERAGE_FILEPATH: The directory in which to put the coverage file,
+       or - to stream the profile to stderr, see extract
+     - COVERAGE_STREAM: stdout streams the profile to stdout instead
+     - COVERAGE_LABEL: The project label in the summary line of the report
+     - COVERAGE_BUILD: The build of the binary, e.g., the firmware version,
+       recorded in the sidecar of the profile (default: the version, or
+       the revision, of the main module)
+     - COVERAGE_DEVICE_ID: The identity of the device, put in the names of
+       the profiles, and recorded in their sidecars
+     - COVERAGE_TAGS: The comma separated tags, e.g., target=qemu,
+       recorded in the sidecars of the profiles
+     - COVERAGE_HANDOFF: Set by coverage.BeforeExec, for the re-executed binary
+     - COVERAGE_LOG: The file the messages of the binary are written to, or off
+     - COVERAGE_WRITE_RETRIES: The number of times writing the profile is
+       retried (default 3), with a backoff from 100ms
+     - COVERAGE_FALLBACK_FILEPATH: The directory the profile is written to if
+       all the retries fail (default: the temporary directory)
+
+     The COVERAGE_ prefix is replaced by the one given through -env-prefix.
+`
+
+// instrumentUsage is the help of the instrument subcommand.
+const instrumentUsage = `
+   gobinarycoverage instrument [flags] package|@file|- [package|@file|-]...
+   gobinarycoverage [-template file] [-mode set|count|atomic] [-race] [-goos os] [-goarch arch] [-tags tags] [-label label] [-env-prefix prefix] [-per-module] [-systemd-notify]
+                    [-flush-on-sigterm] [-exit-signals list] [-flush-signals list] [-dump-addr addr] [-flush-trigger path] [-live-addr addr] [-serve] [-report-formats list]
+                    [-expvar] [-pprof] [-subcommand-depth n] [-lock] [-log path|off] [-dir path] [-compact meta.json] [-include-replaced] [-exclude-pkg patterns] [-include-pkg patterns]
+                    [-exclude-file globs] [-include-file globs] [-total-pkg patterns] [-wait] [-force | -stash] [-skip-test-check]
+                    [-on-conflict abort|rename|skip|ask] [-keep-temp] [-j n] [-timeout duration] [-retries n] [-o path] [-emit-patch file] [-overlay dir] [-record file] [-manifest file] [-verify build|vet] [-backend legacy|native|auto]
+                    package|@file|- [package|@file|-]...
+   gobinarycoverage [-emit-patch file | -overlay dir] [-force | -stash] -replay file
+
+       Enables coverage of all the files in the packages listed,
+       and outputs a dynamically generated new main file on stdout,
+       which encorporates all the variables from the files that
+       are to be analyzed for their coverage. The package is given by
+       its import path, or by its directory, e.g., ./cmd/foo, or an
+       absolute path, which is resolved to the import path through go
+       list. A directory in another module than the working directory
+       is instrumented in that module.
+
+       Several main packages are instrumented one after the other, with
+       the packages they have in common instrumented once. @file is
+       replaced by the packages listed in file, and - by the ones read
+       from stdin, one per line, skipping the empty lines, and the ones
+       starting with #. The patterns with wildcards, e.g., ./cmd/...,
+       are replaced by the main packages they match.
+
+       The pre_instrument, and post_instrument, hooks of the configuration
+       run before, and after, the instrumentation, with the packages given
+       in the environment.
+
+    Note:
+       The files in the packages listed will be changed locally.
+
+       The coverage is written as main returns, or panics, and on the
+       os.Exit, log.Fatal, log.Fatalf and log.Fatalln of the main file,
+       which are routed through the runtime. The ones of the other files,
+       and of the other packages, instrumented or not, exit without
+       writing it, as the runtime is in the main file, which they can not
+       call, and neither do the Fatal methods of a *log.Logger. Return
+       from main instead, call coverReport() before them in the main
+       package, or write the coverage periodically, with -flush-signals,
+       or -flush-trigger. The Fatal of logrus writes it from any package.
+
+    Options:
+       -template file
+           Generate the main file from the text/template in file, instead
+           of the built in coverage runtime. The template is executed with
+           the coverage information (the Cover struct) as its data, and
+           the functions coverImport, importPath, coverVars, packagePath,
+           relPath, isSet, isCount, isAtomic, envVar and quote, following
+           the conventions of the generated code (see the Readme).
+
+       -o path
+           Write the merged main file to path, instead of over the main
+           file of the main package, the file declaring func main, which is
+           left as it is, e.g., for review, or out of tree builds. If path
+           is a directory, or ends in /, the main file is written into the
+           shadow directory of the main package in it, i.e.,
+           path/cmd/foo/main.go for the main file main.go of the main
+           package in cmd/foo of the main module.
+
+       -line-directives
+           Start the declarations of the main file, in the merged main
+           file, with a //line directive naming the main file by its
+           absolute path, and the line they start on in it, and the
+           generated code with one giving it the lines it is on in the
+           merged file, so that the stack traces, and the debugger, point
+           at the lines of the main file. Off by default, as the path is
+           the one of the checkout.
+
+       -emit-patch file
+           Write every change the instrumentation would make, to the
+           instrumented files, the merged main file, and go.mod, as a
+           unified diff to file, or to stdout if it is -, instead of making
+           them. The instrumentation is done in a temporary copy of the main
+           module, so the tree is left untouched. The paths are relative to
+           the root of the main module, so that the diff applies with
+           git apply, or patch -p1, in it, or with the apply subcommand,
+           which verifies the files against it.
+
+       -backend legacy|native|auto
+           legacy (default) rewrites the sources, and merges the coverage
+           runtime into the main file. native leaves the tree untouched,
+           and prints the go build -cover command line building the
+           coverage binary of every main package, with the toolchain of
+           Go 1.20 and later, covering the packages legacy instruments, and
+           the main package, in the atomic mode with -race, given, or in
+           GOFLAGS. The binaries write their coverage data into GOCOVERDIR,
+           which run sets, and converts into a profile, and which check,
+           report, compare and ci read as profiles, see covdata. Only
+           -mode, -race, -exclude-pkg, -include-pkg, -include-replaced,
+           -goos, -goarch, and -tags apply to it. auto is native if the go
+           toolchain supports it, and legacy otherwise.
+
+       -overlay dir
+           Write the files the instrumentation would change, at their paths
+           relative to the root of the main module, into dir, along with
+           dir/overlay.json, which maps the files of the tree to them, for
+           go build -overlay dir/overlay.json, instead of changing them. The
+           instrumentation is done in a temporary copy of the main module,
+           so the tree is left untouched, e.g., a read-only checkout. Keep
+           dir outside of the main module, or start its name with . or _,
+           so that the go command does not take the files for packages.
+
+       -record file
+           Record every decision of the instrumentation to file, as JSON:
+           the options, the packages, and the files, instrumented, the
+           GoCover variables of the files, the hot functions, the hash of
+           the template, and the hashes of the instrumented files, the main
+           file, and go.mod.
+
+       -replay file
+           Instrument the main packages recorded in file with -record, in
+           another checkout of the same commit, making the same decisions,
+           instead of listing the packages, selecting the files, or reading
+           the CPU profile, again, and fail unless the instrumented tree is
+           bit for bit the one recorded, but for the path of the checkout in
+           the //line directives. The options are the recorded ones.
+
+       -manifest file
+           Write every file the instrumentation changes to file, as JSON,
+           per main package: the merged main file, and the instrumented
+           files, with their packages, and GoCover variables, along with
+           the sha256 of every file as instrumented. The paths are
+           relative to the root of the main module.
+
+       -verify build|vet
+           Run go build, or go vet, on the instrumented main packages, and
+           the packages instrumented along with them, once they are all
+           instrumented, and fail unless they pass, reporting the errors,
+           at their positions in the sources before the instrumentation,
+           along with the lines they are on. The tree is left instrumented,
+           restore it, or fix it, before building again.
+
+       -mode set|count|atomic
+           The coverage mode, as for go test -covermode. set (the default)
+           records whether every block ran, count how many times it ran, and
+           atomic counts as well, safely in concurrent binaries, at a cost.
+           The atomic mode is the default for the binaries built with the
+           race detector, see -race. A warning is given if the packages
+           start goroutines in the count mode, or in the set mode, unless
+           it is given explicitly.
+
+       -race
+           The binary is built with the race detector, i.e., go build -race,
+           which is detected from GOFLAGS too. The counters are incremented
+           concurrently, which the race detector reports as data races,
+           unless they are incremented atomically, so the atomic mode is
+           selected, and a warning is given if another one is chosen.
+
+       -goos os, -goarch arch
+           Instrument the files compiled for this GOOS, and GOARCH, instead
+           of the ones in the environment, when cross compiling, e.g.,
+           -goos linux -goarch arm. Build with the same ones.
+
+       -tags tags
+           Instrument the files compiled with the comma separated build
+           tags, as for go build -tags, instead of the ones given through
+           GOFLAGS, which are honored otherwise. The tags are given to all
+           the go commands run, through GOFLAGS. Build with the same ones.
+
+       -granularity block|func
+           Instrument every block, as go tool cover does (the default), or
+           every function with a single counter only, for performance
+           sensitive binaries, which only need to tell which functions ran.
+           Every function is a single block in the profile, holding all of
+           its statements, so a function is either fully covered, or not.
+
+       -sample percent
+           Instrument only percent of the blocks (default 100), for always
+           on coverage with minimal overhead, e.g., in staging. The blocks
+           are selected by the hash of their position, so the same ones are
+           sampled every time. The profiles only hold the blocks sampled, and
+           record the percentage in their sidecar, <profile>.json, so that
+           the reports mark their coverage as extrapolated from the sample.
+           No profile is written if none of the blocks is sampled.
+
+       -hot-profile file
+           Keep the counters out of the hot functions in the CPU profile in
+           file, as written by pprof, e.g., from the /debug/pprof/profile
+           endpoint, for latency sensitive binaries. The functions whose own
+           share of the CPU, not counting the functions they call, is at
+           least -hot-threshold percent (default 1) are hot, along with the
+           function literals in them. With -hot-action exclude (the
+           default) they are not instrumented at all, and with
+           -hot-action func they are instrumented with a single counter,
+           as with -granularity func.
+
+       -label label
+           The project label in the summary line of the coverage report,
+           which defaults to the path of the main module. It is overridden
+           by COVERAGE_LABEL in the environment of the binary.
+
+       -env-prefix prefix
+           The prefix of the environment variables read by the instrumented
+           binary, instead of COVERAGE_, e.g., with MENDER_COV_ the binary
+           reads MENDER_COV_FILEPATH, MENDER_COV_FILENAME and so on.
+
+       -per-module
+           Write the profiles into the subdirectory of COVERAGE_FILEPATH
+           named by the path of the main module, e.g. example.com/app, so
+           that the profiles of the binaries of different modules in a
+           workspace are kept apart. The subcommands reading profiles take
+           such directories, and group the profiles by module.
+
+       -systemd-notify
+           Notify systemd through sd_notify, when the binary is run as a
+           service, while the coverage is written. The stop timeout of the
+           unit is extended by COVERAGE_SYSTEMD_EXTEND_TIMEOUT (default 30s)
+           before writing, and the status names the profile after.
+
+       -flush-on-sigterm
+           Write the coverage as soon as the binary receives SIGTERM, so
+           that it is written before the SIGKILL following in containers, and
+           then terminate the binary by SIGTERM, once it is written, or
+           COVERAGE_FLUSH_BUDGET (default 5s) is spent. Binaries handling
+           SIGTERM themselves through signal.Notify, or signal.NotifyContext,
+           in the main file, are left to shut down, and exit, on their own.
+
+       -exit-signals list
+           Write the coverage, and terminate the binary by the signal, as
+           soon as the binary receives any of the comma separated signals in
+           list, e.g., TERM,INT, as with -flush-on-sigterm. The signals are given by their names,
+           HUP, INT, QUIT, TERM, USR1, or USR2, with or without the SIG
+           prefix, or by their numbers, which are resolved for the GOOS, and
+           GOARCH, instrumented for. -flush-on-sigterm adds TERM.
+
+       -flush-signals list
+           Write the coverage, and keep running, whenever the binary receives
+           any of the signals in list, e.g., USR1, given as with -exit-signals,
+           in order to gather the coverage of a long running binary at any
+           point. A signal cannot be given to both.
+
+       -dump-addr addr
+           Serve an HTTP endpoint on addr, e.g. 127.0.0.1:9098, which
+           writes the coverage when requested at /coverage/dump, and only
+           responds once the profile is synced to disk, for use in a
+           Kubernetes preStop hook. COVERAGE_DUMP_ADDR overrides addr.
+
+       -flush-trigger path
+           Write the coverage whenever the file at path, e.g. /tmp/cov.flush,
+           is created, or touched, for environments where sending signals
+           into containers or to remote devices is awkward. The file is
+           polled every COVERAGE_FLUSH_TRIGGER_INTERVAL (default 1s), and
+           removed once the profile is written. COVERAGE_FLUSH_TRIGGER
+           overrides path.
+
+       -live-addr addr
+           Serve a continuously updated view of the coverage per package on
+           addr, e.g. 127.0.0.1:9097, at /coverage/live, and its snapshot as
+           JSON at /coverage/live.json, in order to watch the coverage fill
+           in during exploratory testing. COVERAGE_LIVE_ADDR overrides addr.
+           The endpoints share the server with the dump endpoint, if it is
+           served on the same address.
+
+       -serve
+           Merge the coverage server into the binary, which serves, on the
+           address in COVERAGE_LISTEN, e.g. 127.0.0.1:6061, if it is set,
+           the coverage profile at /coverage/profile, the coverage per
+           package at /coverage/summary, and resets the counters on POST
+           /coverage/reset, so that the coverage of the scenarios run against
+           a service is pulled without restarting it.
+
+       -report-formats list
+           Write the comma separated reports of list along with every
+           profile, so that they are fed to the CI systems without
+           converting the profiles: lcov, as <profile>.info, cobertura, as
+           Cobertura XML in <profile>.xml, and json, the percentage of the
+           statements covered per file, and in total, in
+           <profile>.summary.json. The files are named by their paths in the
+           main module. COVERAGE_REPORT_FORMATS overrides list, or turns the
+           reports off with off.
+
+       -expvar
+           Publish the statements covered, and in total, as the coverage
+           variable of expvar, so that binaries already serving /debug/vars
+           expose their coverage to the existing scraping infrastructure.
+
+       -pprof
+           List the coverage in the index of net/http/pprof, at
+           /debug/pprof/, for binaries serving it. Its page shows the
+           coverage, and has the buttons writing the profile, and resetting
+           the counters, through POST /debug/pprof/coverage/dump and
+           /debug/pprof/coverage/reset.
+
+       -rotate interval
+           Write the coverage into a new profile at the end of every
+           window of interval, i.e., hourly, daily, or a duration, e.g.
+           30m, and reset the counters, for soak tests running for days. The
+           windows are aligned to UTC, and the profiles are named by the
+           start of their window, e.g. coverage-20261015T140000Z-*.out, so
+           that they sort in time. COVERAGE_ROTATE overrides interval.
+
+       -subcommand-depth n
+           Record the subcommand the binary is run with, of at most n
+           words, e.g., install for mender install update.mender, in the
+           subcommand tag of the profile, and its name, e.g.,
+           coverage-install-*.out, so that the reports tell which commands
+           cover what, e.g., with report -facet subcommand. The words are
+           the arguments up to the first one which is not a name, e.g., a
+           path, skipping the flags. A flag with a separate value before
+           the subcommand has to be given as -flag=value.
+
+       -max-profiles n, -max-profiles-size bytes
+           Remove the oldest profiles, and their sidecars, in the coverage
+           directory whenever a profile is written, until at most n are
+           left, and they take at most bytes, so that long running binaries
+           flushing periodically do not fill small filesystems. The profile
+           just written is always kept. COVERAGE_MAX_PROFILES and
+           COVERAGE_MAX_PROFILES_SIZE override them.
+
+       -lock
+           Lock the coverage directory, through the file .coverage.lock in
+           it, while writing a profile, persisting the counters, and
+           pruning the profiles, so that the binaries sharing the directory
+           do so one at a time. The profiles never overwrite each other
+           without it, as they are named by the process, and the time, and
+           renamed into place once complete. A lock older than a minute is
+           broken, and the profile is written without the lock after
+           waiting for it for 30 seconds. COVERAGE_LOCK=off turns it off.
+
+       -syslog-fallback
+           Write the profile to syslog, or journald, through /dev/log, or
+           COVERAGE_SYSLOG_SOCKET, when neither the coverage directory, nor
+           the fallback directory, is writable, e.g., on devices with a
+           read-only root filesystem. The profile is compressed, and split
+           into messages tagged gobinarycoverage, which are reassembled by
+           gobinarycoverage scrape-journal.
+
+       -log path|off
+           Write the messages of the instrumented binary, e.g., "Wrote
+           coverage to the file", to the file at path, appending to it,
+           or nowhere with off, instead of stderr, so that they stay out
+           of the output of the binary, e.g., in the assertions of
+           acceptance tests. COVERAGE_LOG overrides it.
+
+       -persist path
+           Load the counters persisted in the file at path by an earlier
+           run of the binary at startup, and persist them to it whenever
+           the coverage is written, so that the profiles accumulate the
+           coverage across restarts, e.g., of a test spanning the reboots
+           of a device in an update. The counters of the files which have
+           changed since, e.g., in the update, are dropped. Can not be
+           combined with -rotate. COVERAGE_PERSIST overrides path.
+
+       -dir path
+           Write the profiles to the directory at path, instead of the
+           working directory of the binary, when COVERAGE_FILEPATH is not
+           set, e.g., /var/lib/gobinarycoverage on devices.
+
+       -mqtt-broker host:port, -mqtt-topic topic
+           Publish every profile written to the MQTT broker, with QoS 1, on
+           topic (default gobinarycoverage) followed by the identity of the
+           device, i.e., COVERAGE_DEVICE_ID, or the hostname, for device
+           fleets moving their data through MQTT already. The message is
+           JSON, holding the device, the module, the label, and the profile,
+           which gobinarycoverage collect -mqtt-broker ingests. The broker
+           is authenticated with COVERAGE_MQTT_USERNAME and
+           COVERAGE_MQTT_PASSWORD, and COVERAGE_MQTT_BROKER and
+           COVERAGE_MQTT_TOPIC override the flags.
+
+       -compact meta.json
+           Write the counters as a small packed blob (coverage*.cov),
+           instead of the text profile, for devices where flash writes are
+           expensive. The positions of the blocks are kept on the host, in
+           meta.json, and the profile is reconstructed from the blob with
+           gobinarycoverage decode.
+
+       -include-replaced
+           Instrument the packages of the modules which are replaced by a
+           local directory in go.mod (replace example.com/lib => ../lib) as
+           well. Note that the files in these directories are changed too.
+
+       -exclude-pkg patterns
+           Do not instrument the packages matching any of the comma
+           separated patterns, e.g., example.com/app/gen/...,.../mocks, in
+           which ... matches any string, as in the patterns of the go
+           command, so that they are left out of the profiles, and of the
+           totals, e.g., the generated API clients.
+
+       -include-pkg patterns
+           Only instrument the packages matching any of the comma separated
+           patterns, as for -exclude-pkg, of the ones imported, e.g.,
+           example.com/app/internal/..., after leaving out the ones
+           excluded.
+
+       -exclude-file globs
+           Do not instrument the files matching any of the comma separated
+           globs, matched against the name of the file, or its import path,
+           e.g., *_gen.go,*.pb.go,example.com/app/api/mock_*.go, so that
+           the generated code in the packages which are instrumented is
+           left out of the profiles.
+
+       -include-file globs
+           Only instrument the files matching any of the comma separated
+           globs, as for -exclude-file.
+
+       -total-pkg patterns
+           Only count the packages matching any of the comma separated
+           patterns, as for -exclude-pkg, in the totals, i.e., in the
+           coverage printed by the binary, and in the totals, and the
+           thresholds, of the reports, while the rest are instrumented, and
+           reported per package, as well.
+
+       -wait
+           Only one instrumentation can run in a tree at a time, and it is
+           locked through .gobinarycoverage/lock in the module root. Wait for
+           the lock to be released, instead of failing, if it is taken.
+
+       -force
+           The instrumentation refuses to change a git work tree with
+           uncommitted changes, as they would be mixed up with the
+           instrumented code beyond recovery, and a tree which is
+           instrumented already, as the instrumented code would be
+           instrumented again. Instrument it anyway.
+
+       -stash
+           Save the uncommitted changes in the git stash, as well as leaving
+           them in the tree, and instrument it. Restore the tree, and the
+           changes, afterwards with
+             git reset -q -- . && git checkout -- . && git clean -fd -- . &&
+             git stash pop --index
+
+       -skip-test-check
+           Skip running go vet on the instrumented packages, test files
+           included, after instrumenting them, which reports the packages
+           whose tests no longer compile, and the generated code causing it.
+
+       -on-conflict abort|rename|skip|ask
+           The declarations of the generated code whose names are declared
+           in the main package already, e.g., a coverReport of its own, are
+           reported with their symbol, location, and reason. abort (the
+           default) fails, rename renames the generated declarations, and
+           all the references to them, with a _cover_ prefix, skip leaves
+           the main package as it is, so its binary writes no coverage, and
+           ask prompts for one of them for every conflict on the terminal.
+
+       -keep-temp
+           The files are instrumented, as by go tool cover, into a temporary
+           directory, before they replace the sources, which is removed
+           afterwards. Keep it, and print its path, for debugging, also when
+           the instrumentation fails. The files are in the directories named
+           by the import paths of their packages.
+
+       -j n
+           Instrument up to n files at once (default GOMAXPROCS). The
+           GoCover variables are numbered alike however many files are
+           instrumented at once, so the instrumented tree, and the merged
+           main file, are the same in every run.
+
+       -timeout duration (global)
+           Kill the go commands run, such as go list, if they run for longer
+           than duration (default 5m). A timeout of 0 disables it.
+
+       -retries n (global)
+           Retry the go commands which fail transiently, i.e., time out or
+           fail on the network, up to n times (default 2).
+
+       The results of go list are cached in the build cache, GOCACHE,
+       for as long as the packages listed are unchanged.
+       GOBINARYCOVERAGE_CACHE sets another directory, or off disables it.
+`
+
+// The structure generated by go tool cover
+// var GoCover = struct {
+// 	Count     [117]uint32
+// 	Pos       [3 * 117]uint32
+// 	NumStmt   [117]uint16
+// }
+
+// coverInfo holds a map to the names of the cover variables
+type coverInfo struct {
+	Package  string
+	Vars     map[string]*CoverVar
+	Assembly []string // The functions implemented in assembly, which are not covered
+	Hot      []string // The hot functions, which are excluded, or instrumented with a single counter, see hotBlocks
+}
+
+// sortedVars returns the GoCover variables of the package, sorted by file,
+// which is the order they are registered with the runtime in.
+func (ci *coverInfo) sortedVars() []*CoverVar {
+	vars := make([]*CoverVar, 0, len(ci.Vars))
+	for _, cv := range ci.Vars {
+		vars = append(vars, cv)
+	}
+	sort.Slice(vars, func(i, j int) bool {
+		return vars[i].File < vars[j].File
+	})
+	return vars
+}
+
+// CoverVar is a simple set collecting the GoCover variable name along with its
+// source file
+type CoverVar struct {
+	File string
+	Var  string
+	Path string // The path of the instrumented file on disk
+}
+
+// ReplaceFilecontents replaces the dst file contents with the contents of src.
+func replaceFileContents(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// Package is for use with `go list -json`, and is what loadPackages loads of
+// the packages
+type Package struct {
+	Dir            string   // Directory containing the source files
+	Name           string   // The package name
+	GoFiles        []string // .go source files (excluding CgoFiles, TestGoFiles, XTestGoFiles)
+	CgoFiles       []string // .go source files that import "C"
+	IgnoredGoFiles []string // .go source files ignored due to build constraints
+	SFiles         []string // .s source files
+	ImportPath     string
+	Module         *Module // info about package's containing module, if any
+
+	Imports   []string          // imports used by this package
+	ImportMap map[string]string // map from source import to ImportPath (identity entries are omitted)
+
+	Deps []string
+
+	Error      *PackageError   // error loading package
+	Errors     []*PackageError // the errors loading the package after Error, if there are more
+	DepsErrors []*PackageError // errors loading dependencies
+}
+
+// PackageError is an error loading a package, as reported by go list -e, or
+// go/packages
+type PackageError struct {
+	ImportStack []string // shortest path from package named on command line to this one
+	Pos         string   // position of error, if present
+	Err         string   // the error itself
+	Kind        string   // The kind of the error: list, parse, type, or unknown, as of go/packages
+}
+
+func (e *PackageError) Error() string {
+	if e.Pos == "" {
+		return e.Err
+	}
+	return e.Pos + ": " + e.Err
+}
+
+// maxLoadErrors is the number of the errors loading the packages listed, see
+// loadError
+const maxLoadErrors = 5
+
+// loadError returns the errors loading the package p, and, with deps, its
+// dependencies, as a single error listing them with their positions, or nil
+// if there are none. The packages are loaded along with the errors, see
+// loadPackages, so that the ones which fail to load, e.g., as they import a
+// package which is not found, are reported, instead of being instrumented into
+// a tree which does not build.
+func loadError(p *Package, deps bool) error {
+	var errs []*PackageError
+	if p.Error != nil {
+		errs = append(errs, p.Error)
+	}
+	errs = append(errs, p.Errors...)
+	if deps {
+		errs = append(errs, p.DepsErrors...)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	lines := make([]string, 0, maxLoadErrors+1)
+	for i, e := range errs {
+		if i == maxLoadErrors {
+			lines = append(lines, fmt.Sprintf("and %d more", len(errs)-maxLoadErrors))
+			break
+		}
+		lines = append(lines, e.Error())
+	}
+	return fmt.Errorf("failed to load %s:\n\t%s", p.ImportPath, strings.Join(lines, "\n\t"))
+}
+
+// listPackagesImported lists the local packages imported by the main package
+// packageName, i.e., the ones in its module, or below its import path outside
+// of modules, along with the main package itself, when built for the platform
+// of the build context ctx. The library packages shared by the main packages
+// of a module, e.g., the ones of cmd/*, are thereby listed for all of them.
+// The packages of the modules listed in extraModules are included as well,
+// while the ones of the other modules nested below the main module are not.
+func listPackagesImported(packageName string, ctx *build.Context, extraModules []string) (packages []string, main *Package, err error) {
+	// The dependencies are of all the packages in the module, so they are
+	// cached for as long as none of them changes
+	p, err := loadPackage(ctx, true, packageName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = loadError(p, true); err != nil {
+		return nil, nil, err
+	}
+	// Filter all the non-local dependencies, and vendored packages
+	// i.e., remove all local libraries, and vendored packages
+	local, root := []string(nil), p.ImportPath
+	if p.Module != nil {
+		root = p.Module.Path
+	}
+	extra := make(map[string]bool)
+	for _, pName := range p.Deps {
+		if strings.Contains(pName, "/vendor/") {
+			continue
+		}
+		for _, m := range extraModules {
+			if inModule(pName, m) {
+				extra[pName] = true
+				break
+			}
+		}
+		if !extra[pName] && inModule(pName, root) {
+			local = append(local, pName)
+		}
+	}
+	// The packages below the main module may be in modules of their own,
+	// e.g., the tools of the repository, which are only instrumented if they
+	// are replaced locally, and given through extraModules
+	nested := make(map[string]bool)
+	if p.Module != nil && len(local) > 0 {
+		listed, err := listPackages(ctx, local)
+		if err != nil {
+			return nil, nil, err
+		}
+		var names []string
+		for _, dep := range listed {
+			if dep.Module != nil && dep.Module.Path != p.Module.Path {
+				nested[dep.ImportPath] = true
+				names = append(names, dep.ImportPath)
+			}
+		}
+		if len(names) > 0 {
+			fmt.Fprintf(stderr, "Left out the packages of the modules nested below %s: %s\n",
+				root, strings.Join(names, ", "))
+		}
+	}
+	var coverPackages []string
+	for _, pName := range p.Deps {
+		if extra[pName] || inModule(pName, root) && !nested[pName] && !strings.Contains(pName, "/vendor/") {
+			coverPackages = append(coverPackages, pName)
+		}
+	}
+	return coverPackages, p, nil
+}
+
+// getFilesInPackage loads the package packageName, in order to extract all
+// the files in it, when built for the platform of the build context ctx
+func getFilesInPackage(packageName string, ctx *build.Context) (p *Package, err error) {
+	if p, err = loadPackage(ctx, false, packageName); err != nil {
+		return nil, err
+	}
+	return p, loadError(p, false)
+}
+
+// loadPackage loads the single package packageName, see loadPackages
+func loadPackage(ctx *build.Context, tree bool, packageName string) (*Package, error) {
+	loaded, err := loadPackages(ctx, tree, packageName)
+	if err == nil && len(loaded) != 1 {
+		err = fmt.Errorf("%d packages match %s, rather than one", len(loaded), packageName)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to load the package %s. Error: %s\n", packageName, err.Error())
+		return nil, err
+	}
+	return loaded[0], nil
+}
+
+// isDirArg returns true if the package argument arg is a directory, such as
+// ./cmd/foo, or an absolute path, rather than an import path, as the go
+// command tells them apart.
+func isDirArg(arg string) bool {
+	if arg == "." || arg == ".." || filepath.IsAbs(arg) {
+		return true
+	}
+	for _, prefix := range []string{"./", "../", "." + string(filepath.Separator), ".." + string(filepath.Separator)} {
+		if strings.HasPrefix(arg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePackageDir returns the import path of the package in the directory
+// dir, as resolved by go list in it. If the directory is in another module
+// than the working directory, the working directory is changed to it, so that
+// the package is instrumented in the module it is in, and the file names in
+// opts are made absolute first.
+func resolvePackageDir(dir string, ctx *build.Context, opts *options) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	out, err := runCommand(dir, goEnv(ctx), "go", "list", "-f", "{{.ImportPath}}", ".")
+	if err != nil {
+		return "", err
+	}
+	importPath := strings.TrimSpace(string(out))
+
+	goMod, err := goEnvVar(ctx, "GOMOD")
+	if err != nil {
+		return "", err
+	}
+	out, err = runCommand(dir, goEnv(ctx), "go", "env", "GOMOD")
+	if err != nil {
+		return "", err
+	}
+	if dirGoMod := strings.TrimSpace(string(out)); dirGoMod != goMod {
+		for _, name := range []*string{&opts.templateFile, &opts.compactMeta, &opts.mainOutput} {
+			if *name != "" {
+				if *name, err = filepath.Abs(*name); err != nil {
+					return "", err
+				}
+			}
+		}
+		if err = os.Chdir(dir); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(stderr, "Instrumenting %s in the module of %s\n", importPath, filepath.Dir(dirGoMod))
+	}
+	return importPath, nil
+}
+
+// pendingPackage is a package whose files are being instrumented, by the jobs
+// of its files, see runCoverJobs.
+type pendingPackage struct {
+	cInfo    *coverInfo
+	recorded *recordedPackage // The decisions replayed, or nil
+	jobs     []*coverJob
+}
+
+// prepareFilesInPackage returns the jobs instrumenting all the go source files
+// in the named package, into the temporary directory tdir.
+// counter is the number of the next GoCover variable, and is shared between
+// all the packages instrumented, as the variables are exported, and would
+// collide if main dot-imports several of the packages. The files, and their
+// variables, are the ones recorded instead, if recorded is not nil, and the
+// ones selected by files otherwise. The variables are named in the order of
+// the packages, and of their files, so that they are numbered alike in every
+// run, however the jobs are scheduled.
+func prepareFilesInPackage(packageName string, ctx *build.Context, counter *int, recorded *recordedPackage, files fileFilter, tdir string) (*pendingPackage, error) {
+	// Store the package name along with the GoCover variable names
+	cInfo := &coverInfo{Package: packageName, Vars: make(map[string]*CoverVar)}
+	pending := &pendingPackage{cInfo: cInfo, recorded: recorded}
+
+	p, err := getFilesInPackage(packageName, ctx)
+	if err != nil {
+		return nil, err
+	}
+	var goFiles []string
+	recordedVars := make(map[string]string)
+	if recorded != nil {
+		for _, f := range recorded.Files {
+			goFiles = append(goFiles, f.Name)
+			recordedVars[f.Name] = f.Var
+		}
+	} else if goFiles, err = selectGoFiles(ctx, p); err != nil {
+		return nil, err
+	} else {
+		var kept, excluded []string
+		for _, name := range goFiles {
+			if files.skip(p.ImportPath, name) {
+				excluded = append(excluded, name)
+			} else {
+				kept = append(kept, name)
+			}
+		}
+		if len(excluded) > 0 {
+			fmt.Fprintf(stderr, "Excluded the files of %s: %s\n", packageName, strings.Join(excluded, ", "))
+		}
+		goFiles = kept
+	}
+
+	// covstructName is a function which generates the name of the coverage
+	// struct, with an integer suffix in order to differentiate amongst them
+	// globally.
+	covStructName := func(fileName, path string) string {
+		s, ok := recordedVars[filepath.Base(path)]
+		if !ok {
+			s = "GoCover" + strconv.Itoa(*counter)
+			*counter += 1
+		}
+		// Add the name of the variable to the coverInfo struct
+		cInfo.Vars[fileName] = &CoverVar{File: fileName, Var: s, Path: path}
+		return s
+	}
+
+	for _, name := range goFiles {
+		tname := filepath.Join(tdir, name)
+		fname := filepath.Join(p.Dir, name) // name with the full path prefixed
+		rname := p.ImportPath + "/" + name  // name with the relative import path for coverage output
+		// Skip the files without any code to cover, such as the ones only
+		// declaring the functions implemented in assembly
+		hasBodies, bodyless, err := scanFuncBodies(fname)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to parse the file: %s. Error: %s\n", fname, err.Error())
+			return nil, err
+		}
+		if len(p.SFiles) > 0 {
+			cInfo.Assembly = append(cInfo.Assembly, bodyless...)
+		}
+		if !hasBodies {
+			continue
+		}
+		pending.jobs = append(pending.jobs, &coverJob{
+			fname:      fname,
+			tname:      tname,
+			rname:      rname,
+			importPath: p.ImportPath,
+			varName:    covStructName(rname, fname),
+		})
+	}
+	return pending, nil
+}
+
+// finishFilesInPackage replaces the source files of the package pending with
+// the ones instrumented by its jobs, after backing them up, once all the jobs
+// are done, and returns the coverage information of the package.
+func finishFilesInPackage(pending *pendingPackage, sample float64, hot *hotFunctions, backup *treeBackup) (*coverInfo, error) {
+	cInfo := pending.cInfo
+	sampledBlocks, totalBlocks := 0, 0
+	for _, j := range pending.jobs {
+		cInfo.Hot = append(cInfo.Hot, j.hot...)
+		sampledBlocks += j.kept
+		totalBlocks += j.total
+		if err := backup.save(j.fname); err != nil {
+			fmt.Fprintf(stderr, "Failed to back up the file: %s. Error: %s\n", j.fname, err.Error())
+			return nil, err
+		}
+		if err := replaceFileContents(j.tname, j.fname); err != nil {
+			return nil, err
+		}
+	}
+	if sample < 100 {
+		fmt.Fprintf(stderr, "Sampled %d of the %d blocks of %s\n", sampledBlocks, totalBlocks, cInfo.Package)
+	}
+	if len(cInfo.Hot) > 0 {
+		verb := "Excluded"
+		if hot.action == hotActionFunc {
+			verb = "Instrumented with a single counter"
+		}
+		fmt.Fprintf(stderr, "%s the hot functions of %s: %s\n", verb, cInfo.Package, strings.Join(cInfo.Hot, ", "))
+	}
+	if len(cInfo.Assembly) > 0 {
+		fmt.Fprintf(stderr, "The functions of %s implemented in assembly are not covered: %s\n",
+			cInfo.Package, strings.Join(cInfo.Assembly, ", "))
+	}
+	return cInfo, nil
+}
+
+// scanFuncBodies returns whether the file at path has any function bodies,
+// i.e., any statements for go tool cover to instrument, and the functions it
+// declares without a body, which are implemented in assembly.
+func scanFuncBodies(path string) (hasBodies bool, bodyless []string, err error) {
+	f, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return false, nil, err
+	}
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok {
+			if fn.Body == nil {
+				bodyless = append(bodyless, funcName(fn))
+			} else {
+				hasBodies = true
+			}
+			continue
+		}
+		// Function literals in the initializers of package level variables
+		// are instrumented too
+		ast.Inspect(decl, func(n ast.Node) bool {
+			if _, ok := n.(*ast.FuncLit); ok {
+				hasBodies = true
+			}
+			return !hasBodies
+		})
+	}
+	return hasBodies, bodyless, nil
+}
+
+func parseMainGoFile(fset *token.FileSet, filePath string) (*ast.File, error) {
+	// fset := token.NewFileSet() // positions are relative to fset
+	// Parse src but stop after processing the imports.
+	f, err := parser.ParseFile(fset, filePath, nil, 0) // Parse all the things
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to parse the file: %s. Error: %s\n", filePath, err.Error())
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeImportDecl writes the import declaration of the import specs given to
+// w, sorted by their paths, as gofmt has it.
+func writeImportDecl(w io.Writer, specs []ast.Spec) error {
+	lines := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		is := spec.(*ast.ImportSpec)
+		line := is.Path.Value
+		if is.Name != nil {
+			line = is.Name.Name + " " + line
+		}
+		lines = append(lines, line)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		pi, pj := lines[i][strings.IndexByte(lines[i], '"'):], lines[j][strings.IndexByte(lines[j], '"'):]
+		if pi != pj {
+			return pi < pj
+		}
+		return lines[i] < lines[j]
+	})
+	_, err := fmt.Fprintf(w, "import (\n\t%s\n)\n", strings.Join(lines, "\n\t"))
+	return err
+}
+
+// mergeASTTrees takes two AST trees, and merges them (if possible) into a
+// single unified file, which is written to w, and named name. The merging is
+// naive, and does no fancy heurestics for resolving conflicts, which are
+// resolved before, see resolveConflicts, along with the imports of t1 which t2
+// has already, or whose names it takes, see resolveImports.
+//
+// Neither tree is printed as a whole. The main file, t2, is written as it is
+// in its source, up to the end of its imports, so that its comments, build
+// constraints, and cgo preamble are kept, and the lines keep their numbers.
+// The imports left in t1, the generated file, which it uses, follow in an
+// import declaration of their own. The declarations of the main file follow,
+// as they are in its source, with the edits applied. The other declarations
+// of the generated file come last, formatted by go/format.
+//
+// If lineDirectives is set, the declarations of the main file start with a
+// //line directive, so that the positions in the binary, e.g., in stack
+// traces, and in the debugger, are the ones in the main file, and the
+// generated declarations with one giving them the lines they are on in the
+// merged file itself, so that none of them take the lines of the main file.
+func mergeASTTrees(fset *token.FileSet, t1 *ast.File, t2 *ast.File, edits []sourceEdit, name string, lineDirectives bool, w io.Writer) error {
+	// Remove the imports which the generated declarations do not use
+	if err := pruneImports(fset, t1); err != nil {
+		return err
+	}
+	var specs []ast.Spec
+	var decls []ast.Decl
+	for _, decl := range t1.Decls {
+		if d, isDecl := decl.(*ast.GenDecl); isDecl && d.Tok == token.IMPORT {
+			specs = append(specs, d.Specs...)
+			continue
+		}
+		decls = append(decls, decl)
+	}
+	generated, err := formatGenerated(fset, decls)
+	if err != nil {
+		return err
+	}
+
+	// Find where the declarations after the imports start in the source of t2
+	start := t2.Name.End()
+	for _, decl := range t2.Decls {
+		if d, isDecl := decl.(*ast.GenDecl); isDecl && d.Tok == token.IMPORT {
+			start = d.End()
+		}
+	}
+	file := fset.File(t2.Package)
+	src, err := os.ReadFile(file.Name())
+	if err != nil {
+		return err
+	}
+	// The merged file is written to a buffer, in order to count its lines
+	var merged bytes.Buffer
+	offset := file.Offset(start)
+	merged.Write(src[:offset])
+	merged.WriteString("\n")
+	if len(specs) > 0 {
+		merged.WriteString("\n")
+		if err = writeImportDecl(&merged, specs); err != nil {
+			return err
+		}
+	}
+	for offset < len(src) && strings.ContainsRune(" \t\r\n", rune(src[offset])) {
+		offset++
+	}
+	merged.WriteString("\n")
+	if lineDirectives {
+		// The position is the one in the original source, if the main file
+		// is instrumented, and starts with a //line directive of its own
+		pos := fset.PositionFor(file.Pos(offset), true)
+		if pos.Column == 1 && pos.Line > 1 {
+			// The directive is followed by a blank line, which it gives the
+			// line before, as gofmt would otherwise move it into the doc
+			// comment of the declaration after it
+			fmt.Fprintf(&merged, "//line %s:%d:1\n\n", pos.Filename, pos.Line-1)
+		} else {
+			fmt.Fprintf(&merged, "//line %s:%d:%d\n", pos.Filename, pos.Line, pos.Column)
+		}
+	}
+	if err = writeEdited(&merged, src, offset, edits); err != nil {
+		return err
+	}
+	if len(generated) > 0 {
+		if !bytes.HasSuffix(merged.Bytes(), []byte("\n")) {
+			merged.WriteString("\n")
+		}
+		merged.WriteString("\n")
+		if lineDirectives {
+			// The directive names the merged file by its base name, which
+			// the compiler resolves against the directory of the file, and
+			// gives the line after it the number it has in the file
+			line := bytes.Count(merged.Bytes(), []byte("\n")) + 2
+			fmt.Fprintf(&merged, "//line %s:%d\n", filepath.Base(name), line)
+		}
+		merged.Write(generated)
+	}
+	_, err = w.Write(merged.Bytes())
+	return err
+}
+
+// formatGenerated formats the generated declarations decls, one after the
+// other, with a blank line between every two of them.
+func formatGenerated(fset *token.FileSet, decls []ast.Decl) ([]byte, error) {
+	var generated bytes.Buffer
+	for i, decl := range decls {
+		if i > 0 {
+			generated.WriteString("\n")
+		}
+		if err := format.Node(&generated, fset, decl); err != nil {
+			return nil, err
+		}
+		generated.WriteString("\n")
+	}
+	return generated.Bytes(), nil
+}
+
+// Cover is passed in to the main.go template, and expands all the needed
+// GoCover variables, and imports all the packages we are covering.
+type Cover struct {
+	CoverInfo []*coverInfo
+	Skipped   []*coverInfo      // The packages without any code to cover, e.g., with cgo files only, which are not imported
+	Imports   []string          // The packages the main file imports (generated by go list on the package provided no the CLI)
+	ImportMap map[string]string // Resolves the import paths in the dependencies back to the paths used in source, see SourceImportPath
+	Deps      []string          // All the packages the main package depends on, directly or indirectly
+	Label     string            // The project label in the summary line of the coverage report
+	Mode      string            // The coverage mode: set, count or atomic
+	EnvPrefix string            // The prefix of the environment variables read by the binary, e.g., COVERAGE_
+	Module    string            // The module whose subdirectory of COVERAGE_FILEPATH the profiles are written into, if any
+	Settings  string            // The settings stamped into the binary, see stampSettings
+
+	Granularity string  // A counter for every block, or for every function only
+	Sample      float64 // The percentage of the blocks instrumented
+
+	SystemdNotify  bool   // Notify systemd when the coverage is written
+	FlushOnSIGTERM bool   // Write the coverage, and exit, on SIGTERM
+	ExitSignals    string // Write the coverage, and exit, on the signals of these comma separated numbers
+	FlushSignals   string // Write the coverage, and keep running, on the signals of these comma separated numbers
+	DumpAddr       string // Serve the endpoint writing the coverage on this address
+	FlushTrigger   string // Write the coverage whenever this file is created, or touched
+	LiveAddr       string // Serve the live view of the coverage on this address
+	Serve          bool   // Serve the profile, the summary, and the reset of the coverage, on COVERAGE_LISTEN
+	ReportFormats  string // Write these comma separated reports along with every profile: lcov, cobertura, or json
+	SourceRoot     string // The root of the main module, which the files are named relative to in the reports
+	SourceDirs     string // The comma separated directories of the covered packages, as import-path=dir, relative to SourceRoot
+	Expvar         bool   // Publish the coverage through expvar
+	Pprof          bool   // Serve the page of the coverage next to the profiles of net/http/pprof
+	Rotate         string // Write the coverage, and reset the counters, at this interval
+	CompactID      string // Write the counters in the compact format, identified by this metadata ID
+
+	MaxProfiles     int   // Remove the oldest profiles beyond this many, if non-zero
+	MaxProfilesSize int64 // Remove the oldest profiles beyond this total size in bytes, if non-zero
+	Lock            bool  // Lock the coverage directory while writing the profiles
+	SyslogFallback  bool  // Write the profile to syslog when no directory is writable
+
+	MQTTBroker string // Publish the profiles to this MQTT broker
+	MQTTTopic  string // The topic the profiles are published to, followed by the device
+
+	LogFile string // Write the messages of the runtime to this file, or nowhere if off, instead of stderr
+
+	Dir string // Write the profiles to this directory, unless COVERAGE_FILEPATH is set
+
+	Persist string // Load the counters from this file at startup, and save them to it whenever the coverage is written
+
+	Cobra bool // Write the coverage once the cobra command given is executed, see wireCobra
+
+	SubcommandDepth int // Record the subcommand the binary is run with, of at most this many words, if non-zero
+
+	TotalPackages []string // Only count these packages in the totals, if any
+}
+
+// stderr is where the diagnostics, the warnings, and the failures, are
+// written. It is os.Stderr, but for the programs using pkg/instrument, which
+// may give a writer of their own, see LibraryOptions.Diagnostics.
+var stderr io.Writer = os.Stderr
+
+// subcommand is a subcommand, other than instrumenting the packages given
+type subcommand struct {
+	Name        string
+	Description string
+}
+
+// subcommands are all the subcommands, as listed by printUsage, and completed
+// by the completion scripts
+var subcommands = []subcommand{
+	{"instrument", "Instrument the main packages, and merge the coverage runtime into their main files"},
+	{"selftest", "Run the full pipeline against a sample project"},
+	{"completion", "Generate the completion script for a shell"},
+	{"version", "Print the version and the supported Go toolchains"},
+	{"collect", "Receive and merge the profiles uploaded by instrumented binaries"},
+	{"cat", "Print the source files in a profile, colored by their coverage"},
+	{"annotate", "Write copies of the source files in a profile, annotated with their coverage"},
+	{"report", "Report the coverage of one or more profiles, per package and file"},
+	{"merge", "Merge the profiles of the same instrumented build into one"},
+	{"compare", "Compare the coverage of two profiles, and fail if it dropped"},
+	{"check", "Check the coverage of the packages against the thresholds in the configuration"},
+	{"runs", "Index the profiles by the run they are tagged with, and query which runs cover what"},
+	{"explain", "Tell whether a line is covered, and by which of the profiles"},
+	{"ci", "Merge the profiles, and write all the reports, and the outcome of the thresholds, into a directory"},
+	{"lcov", "Write the lcov file of the profiles, for the coverage gutters of editors, as they change with -watch"},
+	{"uncovered", "List the uncovered functions, largest first"},
+	{"gaps", "List the uncovered functions to write tests for first, by their size and callers"},
+	{"deadcode", "List the code which can not be covered, and the coverage of the rest"},
+	{"calls", "List the functions called the most, from profiles in the count mode"},
+	{"trend", "Record the coverage in a history, and graph the history as SVG"},
+	{"blame", "List the uncovered blocks by the age of their last modification, as told by git blame"},
+	{"prune", "Remove the files which are no longer in the source tree from a profile"},
+	{"rebase", "Remap a profile collected on one commit onto the sources of another"},
+	{"decode", "Reconstruct the profile from the counters written in the compact format"},
+	{"scrape-journal", "Reassemble the profiles written to syslog, from the journal or log files"},
+	{"extract", "Reassemble the profiles streamed by the binaries with COVERAGE_FILEPATH=-, from the logs captured"},
+	{"run", "Run an instrumented binary, rendering its coverage on the terminal as it runs"},
+	{"inspect", "Print the settings an instrumented binary is instrumented with"},
+	{"symbolize", "Rewrite the stack traces of an instrumented binary to the local sources"},
+	{"restore", "Revert the files changed by the instrumentation to their backups"},
+	{"verify", "Fail if anything instrumented is left in the tree"},
+	{"doctor", "Check the go toolchain, the main module, the configuration and the build cache"},
+	{"init", "Write a starter configuration for the main module"},
+	{"bench", "Measure the overhead of the instrumentation on a workload"},
+	{"overhead", "Estimate the added memory and binary size of the instrumentation, per package"},
+	{"apply", "Apply a patch written by -emit-patch, verifying the files against it"},
+	{"coverpkgs", "Print the packages instrumented along with a main package, for go build -cover -coverpkg"},
+	{"build", "Instrument once, and build the coverage binaries for several platforms"},
+	{"covdata", "Convert the coverage data of the binaries built with go build -cover into a profile"},
+}
+
+// fileFlags are the flags which take a file name as their argument
+var fileFlags = map[string]bool{
+	"template":    true,
+	"compact":     true,
+	"hot-profile": true,
+	"o":           true,
+	"emit-patch":  true,
+	"overlay":     true,
+	"log":         true,
+	"persist":     true,
+	"record":      true,
+	"replay":      true,
+}
+
+// options holds the command line options
+type options struct {
+	templateFile   string // Generate the main file from this text/template
+	mainOutput     string // Write the merged main file to this path, or into this shadow directory, instead of over the main file
+	lineDirectives bool   // Start the declarations of the merged main file with //line directives
+	emitPatch      string // Write the changes as a unified diff to this file, instead of making them
+	overlay        string // Write the files changed, and the overlay file of go build -overlay, into this directory, instead of changing them
+	record         string // Record the decisions of the instrumentation to this file
+	replay         string // Replay the decisions recorded in this file, instead of making them
+	manifest       string // Write the manifest of the files changed to this file
+	verify         string // Check that the instrumented packages still build, or pass go vet: build, or vet
+	goos           string // Instrument for this GOOS, instead of the one in the environment
+	goarch         string // Instrument for this GOARCH, instead of the one in the environment
+	tags           string // Instrument with these comma separated build tags, instead of the ones in GOFLAGS
+
+	label     string // The project label in the coverage report, instead of the module path
+	mode      string // The coverage mode: set, count or atomic
+	envPrefix string // The prefix of the environment variables read by the binary
+	perModule bool   // Write the profiles into the subdirectory named by the main module
+
+	granularity string  // A counter for every block, or for every function only
+	sample      float64 // The percentage of the blocks instrumented
+
+	hotProfile   string  // Exclude the hot functions in this CPU profile
+	hotThreshold float64 // The share of the CPU, in percent, of the functions which are hot
+	hotAction    string  // Exclude the hot functions, or instrument them with a single counter
+
+	systemdNotify  bool   // Notify systemd when the coverage is written
+	flushOnSIGTERM bool   // Write the coverage, and exit, on SIGTERM
+	exitSignals    string // Write the coverage, and exit, on these comma separated signals
+	flushSignals   string // Write the coverage, and keep running, on these comma separated signals
+	dumpAddr       string // Serve the endpoint writing the coverage on this address
+	flushTrigger   string // Write the coverage whenever this file is created, or touched
+	liveAddr       string // Serve the live view of the coverage on this address
+	serve          bool   // Serve the profile, the summary, and the reset of the coverage, on COVERAGE_LISTEN
+	reportFormats  string // Write these comma separated reports along with every profile: lcov, cobertura, or json
+	expvar         bool   // Publish the coverage through expvar
+	pprof          bool   // Serve the page of the coverage next to the profiles of net/http/pprof
+	rotate         string // Write the coverage, and reset the counters, at this interval
+
+	subcommandDepth int // Record the subcommand the binary is run with, of at most this many words
+
+	maxProfiles     int   // Remove the oldest profiles beyond this many
+	maxProfilesSize int64 // Remove the oldest profiles beyond this total size in bytes
+	lock            bool  // Lock the coverage directory while writing the profiles
+	syslogFallback  bool  // Write the profile to syslog when no directory is writable
+
+	mqttBroker string // Publish the profiles to this MQTT broker
+	mqttTopic  string // The topic the profiles are published to, followed by the device
+
+	logFile string // Write the messages of the runtime to this file, or nowhere if off, instead of stderr
+
+	dir string // Write the profiles to this directory, unless COVERAGE_FILEPATH is set
+
+	persist string // Load the counters from this file at startup, and save them to it whenever the coverage is written
+
+	compactMeta string // Write the counters in the compact format, and the metadata decoding them to this file
+
+	excludePkg  string // The comma separated patterns of the packages not to instrument
+	includePkg  string // The comma separated patterns of the packages to instrument, if not all of them
+	excludeFile string // The comma separated globs of the files not to instrument, see fileFilter
+	includeFile string // The comma separated globs of the files to instrument, if not all of them
+	totalPkg    string // The comma separated patterns of the packages counted in the totals, if not all of them are
+
+	includeReplaced   bool   // Instrument the modules replaced by local directories as well
+	wait              bool   // Wait for other instrumentations of the tree to finish, instead of failing
+	race              bool   // The binary is built with the race detector
+	force             bool   // Instrument the tree even if it has uncommitted changes
+	allowInstrumented bool   // Instrument the files which are instrumented already, as -force does
+	backend           string // Rewrite the sources (legacy), build with go build -cover (native), or pick by the toolchain (auto)
+	skipTestCheck     bool   // Do not check that the tests of the instrumented packages still compile
+	stash             bool   // Save the uncommitted changes in the git stash before instrumenting
+
+	onConflict string // Abort, rename, skip, or ask, on the declarations of the generated code whose names are taken in the main package
+	keepTemp   bool   // Keep the files instrumented, instead of removing them
+	jobs       int    // The files instrumented at once, or GOMAXPROCS if 0
+
+	run *instrumentRun // Shared by the instrumentations of several main packages, see instrumentPackages
+}
+
+// instrumentFlags adds the flags of instrumenting the packages to fs, setting
+// the options in opts.
+func instrumentFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.templateFile, "template", "", "Generate the main file from this text/template")
+	fs.StringVar(&opts.emitPatch, "emit-patch", "", "Write every change as a unified diff to this file, or to stdout if -, leaving the tree untouched")
+	fs.StringVar(&opts.backend, "backend", "", "Rewrite the sources (legacy), print the go build -cover command lines (native), or pick by the go toolchain (auto) (default legacy)")
+	fs.StringVar(&opts.overlay, "overlay", "", "Write the files changed, and the overlay.json of go build -overlay, into this directory, leaving the tree untouched")
+	fs.StringVar(&opts.record, "record", "", "Record every decision of the instrumentation to this file, so that -replay makes the same ones in another checkout")
+	fs.StringVar(&opts.replay, "replay", "", "Replay the decisions recorded in this file, and verify that the instrumented tree is the one recorded")
+	fs.StringVar(&opts.manifest, "manifest", "", "Write the files changed, with their packages, GoCover variables and hashes, to this file, as JSON")
+	fs.StringVar(&opts.verify, "verify", "", "Check that the instrumented packages still build, or pass go vet, and fail unless they do: build or vet")
+	fs.StringVar(&opts.mainOutput, "o", "", "Write the merged main file to this path, or into this shadow directory if it ends in /, instead of over the main file")
+	fs.BoolVar(&opts.lineDirectives, "line-directives", false, "Start the declarations of the merged main file with //line directives, naming the main file by its absolute path")
+	fs.StringVar(&opts.mode, "mode", "", "The coverage mode: set, count or atomic (default: set, or atomic with -race)")
+	fs.StringVar(&opts.granularity, "granularity", granularityBlock, "Instrument with a counter for every block, or for every function only: block or func")
+	fs.Float64Var(&opts.sample, "sample", 100, "Instrument only this percentage of the blocks, selected deterministically, for minimal overhead")
+	fs.StringVar(&opts.hotProfile, "hot-profile", "", "Keep the counters out of the hot functions in this CPU profile, as written by pprof")
+	fs.Float64Var(&opts.hotThreshold, "hot-threshold", 1, "The share of the CPU, in percent, of the functions which are hot, not counting the functions they call")
+	fs.StringVar(&opts.hotAction, "hot-action", hotActionExclude, "Exclude the hot functions, or instrument them with a single counter: exclude or func")
+	fs.BoolVar(&opts.race, "race", false, "The binary is built with the race detector, so the counters are incremented atomically")
+	fs.StringVar(&opts.goos, "goos", "", "Instrument for this GOOS, instead of the one in the environment")
+	fs.StringVar(&opts.goarch, "goarch", "", "Instrument for this GOARCH, instead of the one in the environment")
+	fs.StringVar(&opts.tags, "tags", "", "Instrument the files compiled with these comma separated build tags, as for go build -tags, instead of the ones in GOFLAGS")
+	fs.StringVar(&opts.label, "label", "", "The project label in the coverage report (default: the main module path)")
+	fs.StringVar(&opts.envPrefix, "env-prefix", defaultEnvPrefix, "The prefix of the environment variables read by the instrumented binary")
+	fs.BoolVar(&opts.perModule, "per-module", false, "Write the profiles into a subdirectory named by the path of the main module")
+	fs.BoolVar(&opts.systemdNotify, "systemd-notify", false, "Notify systemd when the coverage is written, through sd_notify")
+	fs.BoolVar(&opts.flushOnSIGTERM, "flush-on-sigterm", false, "Write the coverage, and terminate the binary, when it receives SIGTERM")
+	fs.StringVar(&opts.exitSignals, "exit-signals", "", "Write the coverage, and terminate the binary, when it receives any of these comma separated signals, e.g., TERM,INT")
+	fs.StringVar(&opts.flushSignals, "flush-signals", "", "Write the coverage, and keep running, whenever the binary receives any of these comma separated signals, e.g., USR1")
+	fs.StringVar(&opts.dumpAddr, "dump-addr", "", "Serve the endpoint writing the coverage, e.g. for a preStop hook, on this address")
+	fs.StringVar(&opts.flushTrigger, "flush-trigger", "", "Write the coverage whenever this file is created, or touched, e.g. /tmp/cov.flush")
+	fs.StringVar(&opts.liveAddr, "live-addr", "", "Serve the live view of the coverage, for exploratory testing, on this address")
+	fs.BoolVar(&opts.serve, "serve", false, "Serve the coverage profile, summary and reset, on the address in COVERAGE_LISTEN, if set")
+	fs.StringVar(&opts.reportFormats, "report-formats", "", "Write these comma separated reports along with every profile: lcov, cobertura, or json")
+	fs.BoolVar(&opts.expvar, "expvar", false, "Publish the covered and total statements through expvar, in /debug/vars")
+	fs.BoolVar(&opts.pprof, "pprof", false, "Serve the page of the coverage, with the dump and reset endpoints, in the index of net/http/pprof")
+	fs.StringVar(&opts.rotate, "rotate", "", "Write the coverage into a new profile, and reset the counters, hourly, daily, or at this interval, e.g. 30m")
+	fs.IntVar(&opts.subcommandDepth, "subcommand-depth", 0, "Record the subcommand the binary is run with, of at most this many words, in the subcommand tag, and the names of the profiles (0 is off)")
+	fs.IntVar(&opts.maxProfiles, "max-profiles", 0, "Remove the oldest profiles in the coverage directory beyond this many, when writing one (0 is no limit)")
+	fs.Int64Var(&opts.maxProfilesSize, "max-profiles-size", 0, "Remove the oldest profiles in the coverage directory beyond this total size in bytes, when writing one (0 is no limit)")
+	fs.BoolVar(&opts.lock, "lock", false, "Lock the coverage directory while writing the profiles, for the binaries sharing it")
+	fs.BoolVar(&opts.syslogFallback, "syslog-fallback", false, "Write the profile to syslog, or journald, when no directory is writable")
+	fs.StringVar(&opts.mqttBroker, "mqtt-broker", "", "Publish the profiles to this MQTT broker, e.g. broker:1883")
+	fs.StringVar(&opts.mqttTopic, "mqtt-topic", "gobinarycoverage", "The MQTT topic the profiles are published to, followed by the identity of the device")
+	fs.StringVar(&opts.logFile, "log", "", "Write the messages of the instrumented binary to this file, or nowhere if off, instead of stderr")
+	fs.StringVar(&opts.dir, "dir", "", "The directory the instrumented binary writes the profiles to, unless COVERAGE_FILEPATH is set")
+	fs.StringVar(&opts.persist, "persist", "", "Load the counters from this file at startup, and save them to it whenever the coverage is written, accumulating the coverage across restarts")
+	fs.StringVar(&opts.compactMeta, "compact", "", "Write the counters in the compact format, and the metadata needed to decode them to this file")
+	fs.StringVar(&opts.excludePkg, "exclude-pkg", "", "Do not instrument the packages matching these comma separated patterns, e.g. example.com/app/gen/...,.../mocks")
+	fs.StringVar(&opts.includePkg, "include-pkg", "", "Only instrument the packages matching these comma separated patterns, e.g. example.com/app/internal/...")
+	fs.StringVar(&opts.includeFile, "include-file", "", "Only instrument the files matching these comma separated globs")
+	fs.StringVar(&opts.excludeFile, "exclude-file", "", "Do not instrument the files matching these comma separated globs, e.g. *_gen.go,*.pb.go")
+	fs.StringVar(&opts.totalPkg, "total-pkg", "", "Only count the packages matching these comma separated patterns in the totals, while instrumenting the rest as well")
+	fs.BoolVar(&opts.includeReplaced, "include-replaced", false, "Instrument the modules replaced by local directories as well")
+	fs.BoolVar(&opts.wait, "wait", false, "Wait for the lock on the tree, instead of failing")
+	fs.BoolVar(&opts.skipTestCheck, "skip-test-check", false, "Do not check that the tests of the instrumented packages still compile")
+	fs.BoolVar(&opts.keepTemp, "keep-temp", false, "Keep the files instrumented, as by go tool cover, by package and file, in a temporary directory, and print it, for debugging")
+	fs.IntVar(&opts.jobs, "j", 0, "Instrument up to this many files at once (default GOMAXPROCS)")
+	fs.StringVar(&opts.onConflict, "on-conflict", conflictAbort, "On the declarations of the generated code whose names are taken in the main package: abort, rename, skip or ask")
+	fs.BoolVar(&opts.force, "force", false, "Instrument the tree even if it has uncommitted changes, or is instrumented already")
+	fs.BoolVar(&opts.stash, "stash", false, "Save the uncommitted changes in the git stash before instrumenting, instead of failing")
+}
+
+// globalFlags adds the flags applying to all the subcommands to fs. They are
+// given before the subcommand, or after instrument.
+func globalFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&subprocessTimeout, "timeout", subprocessTimeout, "Kill the go commands run after this duration (0 disables it)")
+	fs.IntVar(&subprocessRetries, "retries", subprocessRetries, "Retry the go commands which fail transiently this many times")
+}
+
+// printUsage prints the overview of gobinarycoverage, the subcommands, and the
+// environment variables of the instrumented binaries, to w.
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "%s\nSubcommands:\n\n", usageString)
+	for _, s := range subcommands {
+		fmt.Fprintf(w, "   %-16s %s\n", s.Name, s.Description)
+	}
+	fmt.Fprintf(w, "%s\n", environmentUsage)
+}
+
+// subcommandUsage returns the usage function of the flags fs of a subcommand,
+// which prints its help, usage, followed by the flags, on -h, or on an invalid
+// flag, instead of the flags only.
+func subcommandUsage(fs *flag.FlagSet, usage string) func() {
+	return func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n%s\nFlags:\n\n", usage)
+		fs.PrintDefaults()
+	}
+}
+
+// exitFailed exits with 1, after reporting that the subcommand name failed with
+// err, or with 0, if err is flag.ErrHelp, as its help is printed already.
+func exitFailed(name string, err error) {
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	fmt.Fprintf(stderr, "%s failed. Error: %s\n", name, err.Error())
+	os.Exit(1)
+}
+
+// instrumentCommandLine parses the command line args of the instrument
+// subcommand into opts, and returns its flags, and the packages given. The
+// flags of instrument are given after it, along with the global ones.
+func instrumentCommandLine(args []string, opts *options) (*flag.FlagSet, []string, error) {
+	global := flag.NewFlagSet("global", flag.ContinueOnError)
+	globalFlags(global)
+	var given []string
+	flag.Visit(func(f *flag.Flag) {
+		if global.Lookup(f.Name) != nil {
+			return
+		}
+		given = append(given, "-"+f.Name)
+	})
+	if len(given) > 0 {
+		return nil, nil, fmt.Errorf("give %s after instrument, not before it", strings.Join(given, ", "))
+	}
+	fs := flag.NewFlagSet("instrument", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, instrumentUsage)
+	instrumentFlags(fs, opts)
+	globalFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if fs.NArg() < 1 && opts.replay == "" {
+		return nil, nil, errors.New("usage: gobinarycoverage [global flags] instrument [flags] package|@file|- [package|@file|-]...")
+	}
+	return fs, fs.Args(), nil
+}
+
+func Main() {
+	opts := options{}
+	instrumentFlags(flag.CommandLine, &opts)
+	globalFlags(flag.CommandLine)
+	flag.Usage = func() {
+		printUsage(os.Stderr)
+	}
+	flag.Parse()
+	// The packages are the ones recorded, when replaying
+	if flag.NArg() < 1 && opts.replay == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	// The flags, and the packages, instrumented without a subcommand, as before
+	// there were any
+	instrumentSet, packages := flag.CommandLine, flag.Args()
+	switch flag.Arg(0) {
+	case "instrument":
+		var err error
+		if instrumentSet, packages, err = instrumentCommandLine(flag.Args()[1:], &opts); err != nil {
+			exitFailed("instrument", err)
+		}
+	case "selftest":
+		if err := selftest(); err != nil {
+			exitFailed("selftest", err)
+		}
+		os.Exit(0)
+	case "version":
+		printVersion(os.Stdout)
+		os.Exit(0)
+	case "collect":
+		if err := collect(flag.Args()[1:]); err != nil {
+			exitFailed("collect", err)
+		}
+		os.Exit(0)
+	case "cat":
+		if err := catCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("cat", err)
+		}
+		os.Exit(0)
+	case "annotate":
+		if err := annotateCommand(flag.Args()[1:]); err != nil {
+			exitFailed("annotate", err)
+		}
+		os.Exit(0)
+	case "report":
+		if err := reportCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("report", err)
+		}
+		os.Exit(0)
+	case "compare":
+		if err := compareCommand(flag.Args()[1:], os.Stdout); err == errRegression {
+			os.Exit(2)
+		} else if err != nil {
+			exitFailed("compare", err)
+		}
+		os.Exit(0)
+	case "runs":
+		if err := runsCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("runs", err)
+		}
+		os.Exit(0)
+	case "ci":
+		if err := ciCommand(flag.Args()[1:], os.Stdout); err == errBelowThreshold {
+			os.Exit(2)
+		} else if err != nil {
+			exitFailed("ci", err)
+		}
+		os.Exit(0)
+	case "lcov":
+		if err := lcovCommand(flag.Args()[1:]); err != nil {
+			exitFailed("lcov", err)
+		}
+		os.Exit(0)
+	case "explain":
+		if err := explainCommand(flag.Args()[1:], os.Stdout); err == errNotCovered {
+			os.Exit(2)
+		} else if err != nil {
+			exitFailed("explain", err)
+		}
+		os.Exit(0)
+	case "check":
+		if err := checkCommand(flag.Args()[1:], os.Stdout); err == errBelowThreshold {
+			os.Exit(2)
+		} else if err != nil {
+			exitFailed("check", err)
+		}
+		os.Exit(0)
+	case "calls":
+		if err := callsCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("calls", err)
+		}
+		os.Exit(0)
+	case "trend":
+		if err := trendCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("trend", err)
+		}
+		os.Exit(0)
+	case "symbolize":
+		if err := symbolizeCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("symbolize", err)
+		}
+		os.Exit(0)
+	case "blame":
+		if err := blameCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("blame", err)
+		}
+		os.Exit(0)
+	case "uncovered":
+		if err := uncoveredCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("uncovered", err)
+		}
+		os.Exit(0)
+	case "gaps":
+		if err := gapsCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("gaps", err)
+		}
+		os.Exit(0)
+	case "deadcode":
+		if err := deadcodeCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("deadcode", err)
+		}
+		os.Exit(0)
+	case "run":
+		code, err := runCommandLine(flag.Args()[1:])
+		if err != nil {
+			exitFailed("run", err)
+		}
+		os.Exit(code)
+	case "decode":
+		if err := decodeCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("decode", err)
+		}
+		os.Exit(0)
+	case "scrape-journal":
+		if err := scrapeJournalCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("scrape-journal", err)
+		}
+		os.Exit(0)
+	case "extract":
+		if err := extractCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("extract", err)
+		}
+		os.Exit(0)
+	case "inspect":
+		if err := inspectCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("inspect", err)
+		}
+		os.Exit(0)
+	case "restore":
+		if err := restoreCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("restore", err)
+		}
+		os.Exit(0)
+	case "verify":
+		if err := verifyCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("verify", err)
+		}
+		os.Exit(0)
+	case "doctor":
+		if err := doctorCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("doctor", err)
+		}
+		os.Exit(0)
+	case "bench":
+		if err := benchCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("bench", err)
+		}
+		os.Exit(0)
+	case "merge":
+		if err := mergeCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("merge", err)
+		}
+		os.Exit(0)
+	case "prune":
+		if err := pruneCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("prune", err)
+		}
+		os.Exit(0)
+	case "rebase":
+		if err := rebaseCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("rebase", err)
+		}
+		os.Exit(0)
+	case "init":
+		if err := initCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("init", err)
+		}
+		os.Exit(0)
+	case "overhead":
+		if err := overheadCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("overhead", err)
+		}
+		os.Exit(0)
+	case "apply":
+		if err := applyCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("apply", err)
+		}
+		os.Exit(0)
+	case "covdata":
+		if err := covdataCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("covdata", err)
+		}
+		os.Exit(0)
+	case "coverpkgs":
+		if err := coverpkgsCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("coverpkgs", err)
+		}
+		os.Exit(0)
+	case "build":
+		if err := buildCommand(flag.Args()[1:], os.Stdout); err != nil {
+			exitFailed("build", err)
+		}
+		os.Exit(0)
+	case "completion":
+		if err := completion(flag.Arg(1), os.Stdout); err != nil {
+			fmt.Fprintf(stderr, "Failed to generate the completion script. Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	// The options replayed are the ones recorded, whatever the configuration
+	if opts.replay == "" {
+		if err := applyInstrumentConfig(instrumentSet, &opts, defaultConfigFile); err != nil {
+			fmt.Fprintf(stderr, "Failed to read the configuration. Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	// -force is set for the copies instrumented internally, but only the one
+	// given lets the files instrumented already be instrumented again
+	opts.allowInstrumented = opts.force
+	backend, err := resolveBackend(opts.buildContext(), opts.backend)
+	if err == nil && backend == backendNative {
+		err = nativeInstrument(instrumentSet, packages, opts, os.Stdout)
+		if err == nil {
+			os.Exit(0)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to instrument. Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if opts.emitPatch != "" {
+		if _, err := emitPatch(packages, opts.emitPatch, opts); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if opts.overlay != "" {
+		if _, err := instrumentOverlay(packages, opts.overlay, opts); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	c, err := loadConfig(defaultConfigFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read the configuration. Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	packagesEnv := hookPackagesEnv + "=" + strings.Join(packages, " ")
+	if err = runHook(c.Hooks, hookPreInstrument, packagesEnv); err != nil {
+		fmt.Fprintf(stderr, "Failed to instrument. Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if _, err = instrumentPackages(packages, opts); err != nil {
+		os.Exit(1)
+	}
+	if err = runHook(c.Hooks, hookPostInstrument, packagesEnv); err != nil {
+		fmt.Fprintf(stderr, "Failed to instrument. Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// instrument adds coverage functionality to all the packages imported by the
+// main package mainPackage, and merges the coverage utility functions into its
+// main file, the one declaring the main function, see findMainFile.
+func instrument(mainPackage string, opts options) error {
+	// Collect all coverage meta-data in the Cover struct. This is needed for the
+	// template generation of main later on.
+	cov := Cover{}
+	var err error
+	if cov.EnvPrefix, err = checkEnvPrefix(opts.envPrefix); err != nil {
+		fmt.Fprintf(stderr, "Invalid environment variable prefix. Error: %s\n", err.Error())
+		return err
+	}
+	switch opts.mode {
+	case "", "set", "count", "atomic":
+	default:
+		err = fmt.Errorf("unknown coverage mode: %s, expected set, count or atomic", opts.mode)
+		fmt.Fprintf(stderr, "Invalid coverage mode. Error: %s\n", err.Error())
+		return err
+	}
+	switch opts.granularity {
+	case "":
+		opts.granularity = granularityBlock
+	case granularityBlock, granularityFunc:
+	default:
+		err = fmt.Errorf("unknown granularity: %s, expected block or func", opts.granularity)
+		fmt.Fprintf(stderr, "Invalid coverage granularity. Error: %s\n", err.Error())
+		return err
+	}
+	cov.Granularity = opts.granularity
+	switch opts.onConflict {
+	case "":
+		opts.onConflict = conflictAbort
+	case conflictAbort, conflictRename, conflictSkip, conflictAsk:
+	default:
+		err = fmt.Errorf("unknown resolution: %s, expected abort, rename, skip or ask", opts.onConflict)
+		fmt.Fprintf(stderr, "Invalid resolution of the conflicts. Error: %s\n", err.Error())
+		return err
+	}
+	if opts.sample == 0 {
+		opts.sample = 100
+	}
+	if opts.sample < 0 || opts.sample > 100 {
+		err = fmt.Errorf("%g is not a percentage between 0 and 100", opts.sample)
+		fmt.Fprintf(stderr, "Invalid sample. Error: %s\n", err.Error())
+		return err
+	}
+	cov.Sample = opts.sample
+	var hot *hotFunctions
+	if opts.hotProfile != "" {
+		switch opts.hotAction {
+		case "":
+			opts.hotAction = hotActionExclude
+		case hotActionExclude, hotActionFunc:
+		default:
+			err = fmt.Errorf("unknown action: %s, expected exclude or func", opts.hotAction)
+			fmt.Fprintf(stderr, "Invalid action on the hot functions. Error: %s\n", err.Error())
+			return err
+		}
+		if hot, err = loadHotFunctions(opts.hotProfile, opts.hotThreshold, opts.hotAction); err != nil {
+			fmt.Fprintf(stderr, "Failed to read the CPU profile. Error: %s\n", err.Error())
+			return err
+		}
+	}
+	if err = checkRotate(opts.rotate); err != nil {
+		fmt.Fprintf(stderr, "Invalid rotation interval. Error: %s\n", err.Error())
+		return err
+	}
+	if opts.persist != "" && opts.rotate != "" {
+		err = fmt.Errorf("-persist accumulates the coverage across the runs, while -rotate resets it at every window")
+		fmt.Fprintf(stderr, "Invalid options. Error: %s\n", err.Error())
+		return err
+	}
+	if opts.subcommandDepth < 0 {
+		err = fmt.Errorf("-subcommand-depth can not be negative")
+		fmt.Fprintf(stderr, "Invalid subcommand depth. Error: %s\n", err.Error())
+		return err
+	}
+	if opts.jobs < 0 {
+		err = fmt.Errorf("-j can not be negative")
+		fmt.Fprintf(stderr, "Invalid number of jobs. Error: %s\n", err.Error())
+		return err
+	}
+	if opts.maxProfiles < 0 || opts.maxProfilesSize < 0 {
+		err = fmt.Errorf("-max-profiles and -max-profiles-size can not be negative")
+		fmt.Fprintf(stderr, "Invalid profile limits. Error: %s\n", err.Error())
+		return err
+	}
+	//
+	// Get all the packages imported by main
+	//
+	if err = syncGoEnv(); err != nil {
+		return err
+	}
+	ctx := opts.buildContext()
+	if isDirArg(mainPackage) {
+		dir := mainPackage
+		if mainPackage, err = resolvePackageDir(dir, ctx, &opts); err != nil {
+			fmt.Fprintf(stderr, "Failed to resolve the package in the directory: %s. Error: %s\n", dir, err.Error())
+			return err
+		}
+	}
+	cov.Mode = coverageMode(opts.mode, opts.race || goFlagsRace(ctx))
+	release, err := acquireLock(ctx, opts.wait)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to lock the tree for instrumentation. Error: %s\n", err.Error())
+		return err
+	}
+	defer release()
+	root, err := moduleRoot(ctx)
+	if err == nil {
+		err = checkCleanTree(root, opts.force, opts.stash)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to check the tree for uncommitted changes. Error: %s\n", err.Error())
+		return err
+	}
+	var replaced []string
+	if opts.includeReplaced {
+		if replaced, err = listLocallyReplacedModules(ctx); err != nil {
+			fmt.Fprintf(stderr, "Failed to list the modules replaced in go.mod. Error: %s\n", err.Error())
+			return err
+		}
+	}
+	packageList, mainPkg, err := listPackagesImported(mainPackage, ctx, replaced)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to list the packages imported by: %s. Error: %s\n", mainPackage, err.Error())
+		return err
+	}
+	if opts.excludePkg != "" {
+		packageList = excludePackages(packageList, strings.Split(opts.excludePkg, ","))
+	}
+	if opts.includePkg != "" {
+		if packageList, err = includePackages(packageList, strings.Split(opts.includePkg, ",")); err != nil {
+			fmt.Fprintf(stderr, "Failed to select the packages to instrument. Error: %s\n", err.Error())
+			return err
+		}
+	}
+	files, err := newFileFilter(opts.includeFile, opts.excludeFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to select the files to instrument. Error: %s\n", err.Error())
+		return err
+	}
+	// The packages, and the hot functions, are the ones recorded, when
+	// replaying the decisions
+	var recorded *recordedMain
+	if run := opts.run; run != nil && run.replay {
+		if recorded, err = run.record.main(mainPkg.ImportPath); err != nil {
+			fmt.Fprintf(stderr, "Failed to replay the decisions. Error: %s\n", err.Error())
+			return err
+		}
+		// The commit is unknown outside of git work trees, e.g., in the
+		// copy of -emit-patch
+		if head := gitHead(root); recorded.Commit != "" && head != "" && head != recorded.Commit {
+			err = fmt.Errorf("the decisions are recorded at the commit %s, and replayed at %s", recorded.Commit, head)
+			fmt.Fprintf(stderr, "Failed to replay the decisions. Error: %s\n", err.Error())
+			return err
+		}
+		packageList, hot = recorded.Packages, recorded.hotFunctions()
+	}
+	if err = checkImportable(mainPkg.ImportPath, packageList); err != nil {
+		return err
+	}
+	// The generated code is merged into the file declaring main
+	mainSource, err := findMainFile(mainPkg)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to find the main file of: %s. Error: %s\n", mainPkg.ImportPath, err.Error())
+		return err
+	}
+	if opts.totalPkg != "" {
+		if cov.TotalPackages, err = countedPackages(packageList, strings.Split(opts.totalPkg, ",")); err != nil {
+			fmt.Fprintf(stderr, "Failed to select the packages counted in the totals. Error: %s\n", err.Error())
+			return err
+		}
+	}
+	if err = warnConcurrentMode(ctx, cov.Mode, opts.mode != "", mainPkg, packageList); err != nil {
+		fmt.Fprintf(stderr, "Failed to look for goroutines in the packages. Error: %s\n", err.Error())
+		return err
+	}
+	if opts.perModule {
+		if mainPkg.Module == nil {
+			err = fmt.Errorf("%s is not in a module", mainPkg.ImportPath)
+			fmt.Fprintf(stderr, "Failed to write the profiles per module. Error: %s\n", err.Error())
+			return err
+		}
+		cov.Module = mainPkg.Module.Path
+	}
+	run := opts.run
+	if run == nil {
+		run = &instrumentRun{counter: 1, packages: make(map[string]*coverInfo), keepTemp: opts.keepTemp}
+		defer run.removeTemp()
+	}
+	if !opts.allowInstrumented {
+		if err = checkNotInstrumented(ctx, mainSource, packageList, run.packages); err != nil {
+			fmt.Fprintf(stderr, "Failed to instrument. Error: %s\n", err.Error())
+			return err
+		}
+	}
+	backup, err := openBackup(root)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read the backup of the tree. Error: %s\n", err.Error())
+		return err
+	}
+	if err = copyOnWriteModules(ctx, packageList, backup); err != nil {
+		fmt.Fprintf(stderr, "Failed to copy the packages out of the module cache. Error: %s\n", err.Error())
+		return err
+	}
+	cov.Imports = mainPkg.Imports
+	cov.ImportMap = mainPkg.ImportMap
+	cov.Deps = mainPkg.Deps
+	cov.SystemdNotify = opts.systemdNotify
+	cov.FlushOnSIGTERM = opts.flushOnSIGTERM
+	exitSignals := opts.exitSignals
+	if opts.flushOnSIGTERM {
+		exitSignals += ",TERM"
+	}
+	if cov.ExitSignals, err = resolveSignals(exitSignals, ctx.GOOS, ctx.GOARCH); err == nil {
+		cov.FlushSignals, err = resolveSignals(opts.flushSignals, ctx.GOOS, ctx.GOARCH)
+	}
+	if err == nil {
+		err = checkSignals(cov.ExitSignals, cov.FlushSignals)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid signals. Error: %s\n", err.Error())
+		return err
+	}
+	cov.DumpAddr = opts.dumpAddr
+	cov.FlushTrigger = opts.flushTrigger
+	cov.LiveAddr = opts.liveAddr
+	cov.Serve = opts.serve
+	if cov.ReportFormats, err = checkReportFormats(opts.reportFormats); err != nil {
+		fmt.Fprintf(stderr, "Invalid report formats. Error: %s\n", err.Error())
+		return err
+	}
+	cov.Expvar = opts.expvar
+	cov.Pprof = opts.pprof
+	cov.Rotate = opts.rotate
+	cov.SubcommandDepth = opts.subcommandDepth
+	cov.MaxProfiles = opts.maxProfiles
+	cov.MaxProfilesSize = opts.maxProfilesSize
+	cov.Lock = opts.lock
+	cov.SyslogFallback = opts.syslogFallback
+	cov.MQTTBroker = opts.mqttBroker
+	cov.MQTTTopic = opts.mqttTopic
+	cov.LogFile = opts.logFile
+	cov.Dir = opts.dir
+	cov.Persist = opts.persist
+	if cov.Pprof {
+		// The Deps listed by go list are sorted
+		if i := sort.SearchStrings(mainPkg.Deps, "net/http/pprof"); i == len(mainPkg.Deps) || mainPkg.Deps[i] != "net/http/pprof" {
+			fmt.Fprintf(stderr, "Warning: %s does not import net/http/pprof, so the coverage page is not listed in its index\n",
+				mainPkg.ImportPath)
+		}
+	}
+	if cov.Cobra, err = wireCobra(ctx, mainPkg.Deps); err != nil {
+		fmt.Fprintf(stderr, "Failed to look up cobra. Error: %s\n", err.Error())
+		return err
+	}
+	cov.Label = opts.label
+	if cov.Label == "" {
+		cov.Label = mainPkg.ImportPath
+		if mainPkg.Module != nil {
+			cov.Label = mainPkg.Module.Path
+		}
+	}
+	//
+	// Parse the main file
+	//
+	fset := token.NewFileSet() // positions are relative to fset
+	originalMainAST, err := parseMainGoFile(fset, mainSource)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to parse the main file: %s\nError: %s\n", mainSource, err.Error())
+		return err
+	}
+	//
+	// Instrument the source files in the given package with coverage functionality
+	//
+	var pending []*pendingPackage
+	for _, pname := range packageList {
+		// The packages shared with the main packages instrumented before are
+		// instrumented already
+		if _, ok := run.packages[pname]; ok {
+			continue
+		}
+		var recordedPkg *recordedPackage
+		if run.replay {
+			if recordedPkg, err = run.record.pkg(pname); err != nil {
+				fmt.Fprintf(stderr, "Failed to replay the decisions. Error: %s\n", err.Error())
+				return err
+			}
+		}
+		tdir, err := run.packageTempDir(pname)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to create the temporary directory. Error: %s\n", err.Error())
+			return err
+		}
+		pp, err := prepareFilesInPackage(pname, ctx, &run.counter, recordedPkg, files, tdir)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to instrument the files in package: %s\nError: %s\n",
+				mainPackage, err.Error())
+			return err
+		}
+		pending = append(pending, pp)
+	}
+	// The files of all the packages are instrumented concurrently, and only
+	// replace the sources once all of them are
+	var jobs []*coverJob
+	for _, pp := range pending {
+		jobs = append(jobs, pp.jobs...)
+	}
+	if err = runCoverJobs(jobs, opts.jobs, cov.Mode, cov.Granularity, cov.Sample, hot); err != nil {
+		fmt.Fprintf(stderr, "Failed to instrument the files in package: %s\nError: %s\n",
+			mainPackage, err.Error())
+		return err
+	}
+	for _, pp := range pending {
+		cInfo, err := finishFilesInPackage(pp, cov.Sample, hot, backup)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to instrument the files in package: %s\nError: %s\n",
+				mainPackage, err.Error())
+			return err
+		}
+		run.packages[cInfo.Package] = cInfo
+		if err = recordInstrumentedPackage(run, cInfo, pp.recorded, root); err != nil {
+			return err
+		}
+	}
+	var skipped []string
+	for _, pname := range packageList {
+		cInfo := run.packages[pname]
+		// The packages without any GoCover variables are left out of the
+		// generated main file, as there is nothing to register from them
+		if len(cInfo.Vars) == 0 {
+			cov.Skipped = append(cov.Skipped, cInfo)
+			skipped = append(skipped, pname)
+			continue
+		}
+		cov.CoverInfo = append(cov.CoverInfo, cInfo)
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(stderr, "Skipped the packages without any code to cover, e.g., with cgo files only: %s\n",
+			strings.Join(skipped, ", "))
+	}
+	if cov.ReportFormats != "" {
+		cov.SourceRoot, cov.SourceDirs = root, sourceDirs(root, cov.CoverInfo)
+	}
+	if opts.compactMeta != "" {
+		if cov.CompactID, err = writeCompactMeta(opts.compactMeta, &cov); err != nil {
+			fmt.Fprintf(stderr, "Failed to write the metadata of the compact format. Error: %s\n", err.Error())
+			return err
+		}
+	}
+	if cov.Settings, err = stampSettings(mainPkg.ImportPath, root, opts, &cov); err != nil {
+		fmt.Fprintf(stderr, "Failed to stamp the settings into the binary. Error: %s\n", err.Error())
+		return err
+	}
+	//
+	// Generate the main file, and verify it before merging
+	//
+	var generatedMainAST *ast.File
+	if opts.templateFile != "" {
+		generatedMainAST, err = generateMainFromTemplate(fset, &cov, opts.templateFile)
+	} else {
+		generatedMainAST, err = generateMain(fset, &cov)
+	}
+	if err != nil {
+		return err
+	}
+	info, err := typeCheckMain(fset, generatedMainAST, &cov)
+	if err != nil {
+		return err
+	}
+	//
+	// Resolve the imports of the generated file against the ones in main.go
+	//
+	mainDecls, err := packageScopeDecls(fset, mainPkg)
+	if err != nil {
+		return err
+	}
+	mainNames := make(map[string]bool, len(mainDecls))
+	for name := range mainDecls {
+		mainNames[name] = true
+	}
+	resolveImports(fset, generatedMainAST, originalMainAST, info, mainNames)
+	guardDotImports(fset, generatedMainAST, originalMainAST, info)
+	//
+	// Resolve the declarations of the generated file, whose names are taken
+	// in the main package, instead of writing a main file which does not build
+	//
+	conflicts := findMergeConflicts(fset, generatedMainAST, info, mainDecls)
+	renamed, err := resolveConflicts(info, mainPkg.ImportPath, mainNames, conflicts, opts.onConflict)
+	if err == errConflictSkipped {
+		fmt.Fprintf(stderr, "Warning: left the main package %s as it is, so its binary does not write any coverage\n", mainPkg.ImportPath)
+		if opts.run != nil {
+			opts.run.add(mainPkg.ImportPath, "", &cov)
+		}
+		if opts.run != nil && opts.run.manifest != nil {
+			if err = opts.run.addManifest(mainPkg.ImportPath, root, "", &cov); err != nil {
+				fmt.Fprintf(stderr, "Failed to list the files changed in the manifest. Error: %s\n", err.Error())
+				return err
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to merge the generated code into the main package. Error: %s\n", err.Error())
+		return err
+	}
+	//
+	// Run the main function from a generated one, writing the coverage as it
+	// returns, unless the main file is generated from a template, which may
+	// not have the runtime it calls
+	//
+	var edits []sourceEdit
+	if opts.templateFile == "" {
+		var wrapper *ast.FuncDecl
+		if edits, wrapper, err = wrapMain(fset, originalMainAST, mainNames, renamed, optionalRuntimeFiles["runtimesrc/signal.go"](&cov)); err != nil {
+			return err
+		}
+		if wrapper != nil {
+			generatedMainAST.Decls = append(generatedMainAST.Decls, wrapper)
+		}
+	}
+	//
+	// merge the two AST's, and replace the main file with the merged contents,
+	// unless it is written elsewhere
+	//
+	mainFile := mainSource
+	if opts.mainOutput != "" {
+		if mainFile, err = createMainOutput(opts.mainOutput, root, mainSource, backup); err != nil {
+			fmt.Fprintf(stderr, "Failed to create the main file: %s. Error: %s\n", opts.mainOutput, err.Error())
+			return err
+		}
+	}
+	if err = backup.save(mainFile); err != nil {
+		fmt.Fprintf(stderr, "Failed to back up the main file: %s. Error: %s\n", mainFile, err.Error())
+		return err
+	}
+	if err = writeFileAtomic(mainFile, func(w io.Writer) error {
+		return mergeASTTrees(fset, generatedMainAST, originalMainAST, edits, mainFile, opts.lineDirectives, w)
+	}); err != nil {
+		fmt.Fprintf(stderr, "Failed to merge the generated main file with the main file of the package: Error: %s\n", err.Error())
+		return err
+	}
+	if opts.run != nil {
+		opts.run.add(mainPkg.ImportPath, mainFile, &cov)
+	}
+	if opts.run != nil && opts.run.manifest != nil {
+		if err = opts.run.addManifest(mainPkg.ImportPath, root, mainFile, &cov); err != nil {
+			fmt.Fprintf(stderr, "Failed to list the files changed in the manifest. Error: %s\n", err.Error())
+			return err
+		}
+	}
+	if opts.run != nil && opts.run.record != nil {
+		if err = recordInstrumentedMain(opts.run, recorded, mainPkg.ImportPath, opts, &cov, hot, root, mainFile); err != nil {
+			return err
+		}
+	}
+	if !opts.skipTestCheck {
+		// The main package is left as it is, when its main file is written
+		// elsewhere
+		var packages []string
+		if opts.mainOutput == "" {
+			packages = append(packages, mainPkg.ImportPath)
+		}
+		for _, ci := range cov.CoverInfo {
+			packages = append(packages, ci.Package)
+		}
+		var report strings.Builder
+		if n, err := checkTests(ctx, mainFile, packages, &report); err != nil {
+			fmt.Fprintf(stderr, "Warning: failed to check that the tests still compile. Error: %s\n", err.Error())
+		} else if n > 0 {
+			fmt.Fprintf(stderr, "Warning: %d of the instrumented packages, or their tests, do not compile, "+
+				"so go test fails on them:\n%s", n, report.String())
+		}
+	}
+	return nil
+}
+
+// isDirOutput returns true if the -o path out names a shadow directory, rather
+// than the main file itself.
+func isDirOutput(out string) bool {
+	if strings.HasSuffix(out, "/") || strings.HasSuffix(out, string(filepath.Separator)) {
+		return true
+	}
+	info, err := os.Stat(out)
+	return err == nil && info.IsDir()
+}
+
+// createMainOutput returns the path the merged main file, of the main file
+// mainSource, is written to, as given by -o out, in the main module at root,
+// and creates it, along with its directory, if need be, backing it up.
+func createMainOutput(out, root, mainSource string, backup *treeBackup) (string, error) {
+	path := out
+	if isDirOutput(out) {
+		rel, err := filepath.Rel(root, mainSource)
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(out, rel)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := backup.save(path); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// writeFileAtomic keeps the mode of an existing file
+		if err = os.WriteFile(path, nil, 0644); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// writeFileAtomic replaces the contents of the file at path with the ones
+// written by write, which are streamed to a temporary file next to it first,
+// so that the file is left untouched if write fails.
+func writeFileAtomic(path string, write func(w io.Writer) error) (err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// Files starting with a '.' are ignored by the go command
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	w := bufio.NewWriter(f)
+	if err = write(w); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
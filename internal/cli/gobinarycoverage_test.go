@@ -0,0 +1,171 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// chdir changes the working directory to dir for the rest of the test, as go
+// list, and go/packages, resolve the packages relative to it
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestPathsInPackage(t *testing.T) {
+	files := map[string]string{
+		"go.mod":                         "module example.com/paths\n\ngo 1.18\n",
+		"lib/nested/pkg/plain.go":        "package pkg\n\nfunc Plain() int {\n\treturn 1\n}\n",
+		"lib/nested/pkg/with space.go":   "package pkg\n\nfunc Space() int {\n\treturn 2\n}\n",
+		"lib/nested/pkg/ünï côde.go":     "package pkg\n\nfunc Unicode() int {\n\treturn 3\n}\n",
+		"lib/nested/pkg/décl_only.go":    "package pkg\n\nconst X = 1\n",
+		"lib/nested/pkg/other/nested.go": "package other\n\nfunc Nested() {}\n",
+	}
+	// The directories have spaces, and non-ASCII letters, in their names
+	root := filepath.Join(t.TempDir(), "dír with spaces", "module")
+	for name, src := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chdir(t, root)
+	tdir := filepath.Join(t.TempDir(), "tmp dír")
+	if err := os.MkdirAll(tdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	const importPath = "example.com/paths/lib/nested/pkg"
+	counter := 0
+	pending, err := prepareFilesInPackage(importPath, options{}.buildContext(), &counter, nil, fileFilter{}, tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgDir := filepath.Join(root, "lib", "nested", "pkg")
+	want := []string{"plain.go", "with space.go", "ünï côde.go"}
+	var got []string
+	for _, j := range pending.jobs {
+		name := filepath.Base(j.fname)
+		got = append(got, name)
+		if j.fname != filepath.Join(pkgDir, name) {
+			t.Errorf("the file %q is read from %q", name, j.fname)
+		}
+		if j.tname != filepath.Join(tdir, name) {
+			t.Errorf("the file %q is instrumented into %q", name, j.tname)
+		}
+		if j.rname != importPath+"/"+name {
+			t.Errorf("the file %q is named %q in the profile", name, j.rname)
+		}
+	}
+	sort.Strings(got)
+	if len(got) != len(want) {
+		t.Fatalf("instrumented %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("instrumented %q, want %q", got, want)
+		}
+	}
+
+	// The positions in the instrumented files are the ones in the sources
+	for _, j := range pending.jobs {
+		if j.run("set", "", 100, nil); j.err != nil {
+			t.Fatalf("%s: %s", j.failed, j.err)
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, j.tname, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn := f.Decls[0].(*ast.FuncDecl)
+		if pos := fset.Position(fn.Pos()); pos.Filename != j.fname || pos.Line != 3 {
+			t.Errorf("the function of %q is at %s", j.fname, pos)
+		}
+	}
+}
+
+func TestDirectedSourceLine(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dír with spaces")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	main := filepath.Join(dir, "main.go")
+	other := filepath.Join(dir, "ünï côde:1.go")
+	src := "package main\n" +
+		"\n" +
+		"//line " + other + ":10\n" +
+		"func a() {}\n" +
+		"//line main.go:3\n" +
+		"func b() {}\n"
+	if err := os.WriteFile(main, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		line int
+		want string
+		ok   bool
+	}{
+		{1, "package main", true},
+		// Line 3 is the one the second directive directs to, not the
+		// directive itself
+		{3, "func b() {}", true},
+		{2, "", true},
+		{10, "", false},
+	}
+	for _, test := range tests {
+		got, ok := directedSourceLine(main, test.line)
+		if got != test.want || ok != test.ok {
+			t.Errorf("directedSourceLine(%d) = %q, %t, want %q, %t", test.line, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestIsDirArg(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want bool
+	}{
+		{".", true},
+		{"..", true},
+		{"./cmd/with space", true},
+		{"../ünï", true},
+		{string(filepath.Separator) + "abs", true},
+		{"example.com/app", false},
+		{"cmd/app", false},
+		{".hidden", false},
+	}
+	for _, test := range tests {
+		if got := isDirArg(test.arg); got != test.want {
+			t.Errorf("isDirArg(%q) = %t, want %t", test.arg, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// profileGroup is the merge of the profiles of a single module, and build. The
+// binaries instrumented with -per-module write their profiles into the
+// subdirectory named by the path of their module, and the profiles are grouped
+// by it, and by the build of the binary in their sidecars, so that the
+// profiles of different builds are never merged, and by the value of the
+// facet, if any.
+type profileGroup struct {
+	Module  string // Empty for the profiles outside of any module subdirectory
+	Build   string // Empty for the profiles of unknown builds
+	Facet   string // The tag, and its value, of the profiles, as key=value, if they are faceted
+	Profile *profile.Profile
+}
+
+// name returns the module, the build, and the facet, of the group, for
+// display
+func (g profileGroup) name() string {
+	name := g.Module
+	if name == "" {
+		name = "(no module)"
+	}
+	if g.Build != "" {
+		name += "@" + g.Build
+	}
+	if g.Facet != "" {
+		name += " [" + g.Facet + "]"
+	}
+	return name
+}
+
+// dir returns the directory the report of the group is written into, relative
+// to the directory of the report of all of them.
+func (g profileGroup) dir() string {
+	// The value of the tag is anything it is set to on the device
+	facet := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == filepath.Separator {
+			return '_'
+		}
+		return r
+	}, g.Facet)
+	return filepath.Join(filepath.FromSlash(g.Module), g.Build, facet)
+}
+
+// profileSelection selects the profiles loaded by loadProfileGroups by their
+// tags, see profile.Profile.Tags, and groups them by the value of a tag.
+type profileSelection struct {
+	tags  map[string]string // Only the profiles with all of these tags are loaded
+	facet string            // The profiles are grouped by the value of this tag, if not empty
+}
+
+// matches returns true if p has all the tags of s
+func (s profileSelection) matches(p *profile.Profile) bool {
+	for key, value := range s.tags {
+		if v, ok := p.Tags[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// tagsString returns the tags of s, sorted, as given on the command line
+func (s profileSelection) tagsString() string {
+	tags := make([]string, 0, len(s.tags))
+	for key, value := range s.tags {
+		tags = append(tags, key+"="+value)
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, ",")
+}
+
+// selectionFlags adds the -tag, and the -facet, flags to fs, and returns the
+// function returning the selection they give, once fs is parsed.
+func selectionFlags(fs *flag.FlagSet) func() (profileSelection, error) {
+	tags := fs.String("tag", "", "Only read the profiles with all of these comma separated tags, e.g. goarch=arm64,target=qemu")
+	facet := fs.String("facet", "", "Report the profiles by the value of this tag, e.g. goarch, or device")
+	return func() (profileSelection, error) {
+		sel := profileSelection{facet: *facet}
+		for _, tag := range strings.Split(*tags, ",") {
+			if strings.TrimSpace(tag) == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(tag, "=")
+			if !ok || strings.TrimSpace(key) == "" {
+				return sel, fmt.Errorf("invalid tag: %q, expected key=value", tag)
+			}
+			if sel.tags == nil {
+				sel.tags = make(map[string]string)
+			}
+			sel.tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		return sel, nil
+	}
+}
+
+// isProfileName returns true if name is the name of a profile written by an
+// instrumented binary, or stored by the collector.
+func isProfileName(name string) bool {
+	for _, pattern := range []string{"coverage*.out", collectUploadPattern} {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// findProfiles returns the paths of the profiles in the tree rooted at dir,
+// by the module subdirectory they are in, relative to dir, in slash form.
+func findProfiles(dir string) (map[string][]string, error) {
+	profiles := make(map[string][]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !isProfileName(d.Name()) {
+			return err
+		}
+		rel, err := filepath.Rel(dir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		module := filepath.ToSlash(rel)
+		if module == "." {
+			module = ""
+		}
+		profiles[module] = append(profiles[module], path)
+		return nil
+	})
+	return profiles, err
+}
+
+// profilePaths returns the paths of the profiles given, which are profile
+// files, or directories, in which all the profiles are found, sorted.
+func profilePaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		found, err := findProfiles(arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("no profiles found in %s", arg)
+		}
+		for _, profiles := range found {
+			paths = append(paths, profiles...)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// loadProfileGroups merges the profiles given, selected by sel, by module,
+// build, and the facet of sel. The arguments are profile files, which are
+// grouped on their own, or directories, in which all the profiles are found,
+// and grouped by the module subdirectory they are in, or the GOCOVERDIR of the
+// binaries built natively, which are converted. The profiles of unknown
+// builds are merged into the group of the only build of their module, if
+// there is a single one. The groups are sorted by module, build, and facet.
+// The sidecars given along with their profiles, e.g., by a glob, are skipped,
+// see mergeArgs.
+func loadProfileGroups(args []string, sel profileSelection) ([]profileGroup, error) {
+	args = mergeArgs(args)
+	paths := make(map[string][]string)
+	converted := ""
+	defer func() {
+		if converted != "" {
+			os.RemoveAll(converted)
+		}
+	}()
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths[""] = append(paths[""], arg)
+			continue
+		}
+		if isCovdataDir(arg) {
+			// The coverage data of the binaries built natively, converted
+			// into a profile
+			if converted == "" {
+				if converted, err = ioutil.TempDir("", "gobinarycoverage-covdata"); err != nil {
+					return nil, err
+				}
+			}
+			out := filepath.Join(converted, fmt.Sprintf("coverage%d.out", len(paths[""])))
+			if err = covdataProfile([]string{arg}, out); err != nil {
+				return nil, fmt.Errorf("%s: %s", arg, err.Error())
+			}
+			paths[""] = append(paths[""], out)
+			continue
+		}
+		found, err := findProfiles(arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("no profiles found in %s", arg)
+		}
+		for module, profiles := range found {
+			paths[module] = append(paths[module], profiles...)
+		}
+	}
+	var groups []profileGroup
+	for module, profiles := range paths {
+		// The profiles of the module, by the value of the facet
+		facets := make(map[string]map[string]*profile.Profile)
+		for _, name := range profiles {
+			p, err := profile.ParseFile(name)
+			if err == nil {
+				err = checkBuild(p.Build)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err.Error())
+			}
+			if !sel.matches(p) {
+				continue
+			}
+			facet := ""
+			if sel.facet != "" {
+				facet = sel.facet + "=" + p.Tags[sel.facet]
+			}
+			if facets[facet] == nil {
+				facets[facet] = make(map[string]*profile.Profile)
+			}
+			facets[facet][name] = p
+		}
+		for facet, profiles := range facets {
+			builds, err := mergeBuilds(profiles)
+			if err != nil {
+				return nil, err
+			}
+			for build, merged := range builds {
+				groups = append(groups, profileGroup{Module: module, Build: build, Facet: facet, Profile: merged})
+			}
+		}
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("no profiles tagged %s found", sel.tagsString())
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Module != groups[j].Module {
+			return groups[i].Module < groups[j].Module
+		}
+		if groups[i].Build != groups[j].Build {
+			return groups[i].Build < groups[j].Build
+		}
+		return groups[i].Facet < groups[j].Facet
+	})
+	return groups, nil
+}
+
+// mergeBuilds merges the profiles, by their path, by their build. The profiles
+// of unknown builds are merged into the only build, if there is a single one,
+// or into the unknown build, "", otherwise.
+func mergeBuilds(profiles map[string]*profile.Profile) (map[string]*profile.Profile, error) {
+	builds := make(map[string]*profile.Profile)
+	unknown := make(map[string]*profile.Profile)
+	for name, p := range profiles {
+		if p.Build == "" {
+			unknown[name] = p
+			continue
+		}
+		if builds[p.Build] == nil {
+			builds[p.Build] = &profile.Profile{}
+		}
+		if err := builds[p.Build].Merge(p); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	if len(unknown) > 0 {
+		merged := &profile.Profile{}
+		if len(builds) == 1 {
+			for _, p := range builds {
+				merged = p
+			}
+		} else {
+			builds[""] = merged
+		}
+		for name, p := range unknown {
+			if err := merged.Merge(p); err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err.Error())
+			}
+		}
+	}
+	return builds, nil
+}
+
+// loadProfile merges the profiles given, as found by loadProfileGroups, which
+// must all be of the same module, and build, so that the coverage of different
+// products, or of different versions of them, is never conflated.
+func loadProfile(args []string) (*profile.Profile, error) {
+	return loadSelectedProfile(args, profileSelection{})
+}
+
+// loadSelectedProfile merges the profiles given, as loadProfile, which are
+// selected by the tags of sel.
+func loadSelectedProfile(args []string, sel profileSelection) (*profile.Profile, error) {
+	groups, err := loadProfileGroups(args, sel)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) > 1 {
+		modules := make([]string, len(groups))
+		for i, g := range groups {
+			modules[i] = g.name()
+		}
+		return nil, fmt.Errorf("the profiles are of several modules, or builds: %s, give the ones of one of them",
+			strings.Join(modules, ", "))
+	}
+	return groups[0].Profile, nil
+}
+
+// checkBuild verifies that build is safe to use as the name of a file, or a
+// directory, i.e., a version, or a revision, without any path separators. The
+// empty build is the unknown one.
+func checkBuild(build string) error {
+	if build == "." || build == ".." {
+		return fmt.Errorf("invalid build: %q", build)
+	}
+	for _, r := range build {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-._~+", r)) {
+			return fmt.Errorf("invalid build: %q", build)
+		}
+	}
+	return nil
+}
+
+// checkModuleDir verifies that module is a path which is safe to use as a
+// subdirectory, i.e., a module path, without any empty, '.' or '..' elements.
+// The empty path is the directory itself.
+func checkModuleDir(module string) error {
+	if module == "" {
+		return nil
+	}
+	for _, elem := range strings.Split(module, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return fmt.Errorf("invalid module path: %q", module)
+		}
+		for _, r := range elem {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-._~", r)) {
+				return fmt.Errorf("invalid module path: %q", module)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// The hooks run around the steps of gobinarycoverage, see hookConfig
+const (
+	hookPreInstrument  = "pre_instrument"
+	hookPostInstrument = "post_instrument"
+	hookPostBuild      = "post_build"
+	hookPostRestore    = "post_restore"
+)
+
+// The environment variables the hooks are run with, along with benchBinaryEnv
+// for the binaries built
+const (
+	hookNameEnv     = "GOBINARYCOVERAGE_HOOK"
+	hookPackagesEnv = "GOBINARYCOVERAGE_PACKAGES"
+	hookManifestEnv = "GOBINARYCOVERAGE_MANIFEST"
+)
+
+// hookConfig holds the shell commands run around the steps of
+// gobinarycoverage, e.g., regenerating code before instrumenting, or signing
+// the binaries built.
+type hookConfig struct {
+	PreInstrument  string `json:"pre_instrument,omitempty" yaml:"pre_instrument,omitempty"`   // Before the tree is instrumented
+	PostInstrument string `json:"post_instrument,omitempty" yaml:"post_instrument,omitempty"` // After the tree is instrumented
+	PostBuild      string `json:"post_build,omitempty" yaml:"post_build,omitempty"`           // After every binary built by build, with its manifest
+	PostRestore    string `json:"post_restore,omitempty" yaml:"post_restore,omitempty"`       // After the tree is restored by restore
+}
+
+// command returns the shell command of the hook name, or the empty string if
+// there is none.
+func (h *hookConfig) command(name string) string {
+	if h == nil {
+		return ""
+	}
+	switch name {
+	case hookPreInstrument:
+		return h.PreInstrument
+	case hookPostInstrument:
+		return h.PostInstrument
+	case hookPostBuild:
+		return h.PostBuild
+	case hookPostRestore:
+		return h.PostRestore
+	}
+	return ""
+}
+
+// runHook runs the shell command of the hook name, if any, in the working
+// directory, with the name in GOBINARYCOVERAGE_HOOK, and env, added to the
+// environment. The output of the command goes to stderr, so that it is never
+// mixed up with the output of gobinarycoverage. The hook fails if the command
+// exits with a non-zero status.
+func runHook(hooks *hookConfig, name string, env ...string) error {
+	command := hooks.command(name)
+	if command == "" {
+		return nil
+	}
+	fmt.Fprintf(stderr, "Running the %s hook: %s\n", name, command)
+	// The hooks are the user's own, so they are not run through runCommand,
+	// which retries, and times out
+	cmd := exec.Command("sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	}
+	cmd.Env = append(append(os.Environ(), hookNameEnv+"="+name), env...)
+	cmd.Stdout, cmd.Stderr = stderr, stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("the %s hook failed: %s", name, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,389 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The actions taken on the hot functions, as given by -hot-action
+const (
+	hotActionExclude = "exclude" // The hot functions are not instrumented at all
+	hotActionFunc    = "func"    // The hot functions are instrumented with a single counter
+)
+
+// hotFunctions are the functions which take the largest share of the CPU in a
+// CPU profile, as written by pprof, which are not instrumented as the rest, in
+// order to keep the overhead of the counters out of the hot paths.
+type hotFunctions struct {
+	action string             // What is done to the hot functions: exclude, or func
+	share  map[string]float64 // The share of the CPU of the hot functions, in percent, by their name, see hotFuncName
+}
+
+// loadHotFunctions reads the CPU profile at path, and returns the functions
+// whose own share of the CPU, not counting the functions they call, is at
+// least threshold percent. The CPU spent in the function literals of a
+// function is counted as its own.
+func loadHotFunctions(path string, threshold float64, action string) (*hotFunctions, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(contents, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(contents))
+		if err != nil {
+			return nil, err
+		}
+		if contents, err = io.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	}
+	flat, total, err := parseCPUProfile(contents)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("%s: the profile holds no samples", path)
+	}
+	shares := make(map[string]float64)
+	for name, value := range flat {
+		shares[hotFuncName(name)] += 100 * float64(value) / float64(total)
+	}
+	hot := &hotFunctions{action: action, share: make(map[string]float64)}
+	for name, share := range shares {
+		if share >= threshold {
+			hot.share[name] = share
+		}
+	}
+	return hot, nil
+}
+
+// parseCPUProfile decodes the profile, in the protocol buffer format of
+// pprof, and returns the value of the samples, of the default sample type, or
+// the last one, by the function they were taken in, and the total of them. The
+// sample is taken in the innermost function of the location, when functions
+// are inlined into it.
+func parseCPUProfile(contents []byte) (flat map[string]int64, total int64, err error) {
+	type sample struct {
+		locations []uint64
+		values    []uint64
+	}
+	var (
+		samples       []sample
+		sampleTypes   []uint64              // The types of the values, as indexes in the string table
+		defaultType   uint64                // The default type, as an index in the string table
+		locations     = map[uint64]uint64{} // The innermost function of the location, by the id of it
+		functionNames = map[uint64]uint64{} // The name of the function, as an index in the string table, by the id of it
+		stringTable   []string
+	)
+	err = protoFields(contents, func(num int, v uint64, data []byte) error {
+		switch num {
+		case 1: // sample_type
+			return protoFields(data, func(num int, v uint64, _ []byte) error {
+				if num == 1 {
+					sampleTypes = append(sampleTypes, v)
+				}
+				return nil
+			})
+		case 2: // sample
+			var s sample
+			err := protoFields(data, func(num int, v uint64, data []byte) (err error) {
+				switch num {
+				case 1:
+					s.locations, err = protoVarints(s.locations, v, data)
+				case 2:
+					s.values, err = protoVarints(s.values, v, data)
+				}
+				return err
+			})
+			samples = append(samples, s)
+			return err
+		case 4: // location
+			var id, function uint64
+			err := protoFields(data, func(num int, v uint64, data []byte) error {
+				switch num {
+				case 1:
+					id = v
+				case 4:
+					// The lines are ordered from the innermost inlined
+					// function outwards
+					if function != 0 {
+						return nil
+					}
+					return protoFields(data, func(num int, v uint64, _ []byte) error {
+						if num == 1 {
+							function = v
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			locations[id] = function
+			return err
+		case 5: // function
+			var id, name uint64
+			err := protoFields(data, func(num int, v uint64, _ []byte) error {
+				switch num {
+				case 1:
+					id = v
+				case 2:
+					name = v
+				}
+				return nil
+			})
+			functionNames[id] = name
+			return err
+		case 6: // string_table
+			stringTable = append(stringTable, string(data))
+		case 14: // default_sample_type
+			defaultType = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(sampleTypes) == 0 {
+		return nil, 0, errors.New("no sample types, not a pprof profile")
+	}
+	value := len(sampleTypes) - 1
+	for i, t := range sampleTypes {
+		if defaultType != 0 && t == defaultType {
+			value = i
+		}
+	}
+	flat = make(map[string]int64)
+	for _, s := range samples {
+		if len(s.locations) == 0 || value >= len(s.values) {
+			continue
+		}
+		v := int64(s.values[value])
+		total += v
+		name, ok := functionNames[locations[s.locations[0]]]
+		if !ok || name >= uint64(len(stringTable)) {
+			continue
+		}
+		flat[stringTable[name]] += v
+	}
+	return flat, total, nil
+}
+
+// protoFields calls field with the number, and the value of every field of the
+// protocol buffer message. The value is v for the varint fields, and data for
+// the length delimited ones. The fixed size fields are skipped.
+func protoFields(b []byte, field func(num int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("malformed protocol buffer")
+		}
+		b = b[n:]
+		var v uint64
+		var data []byte
+		switch key & 7 {
+		case 0:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("malformed varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			b = b[8:]
+			continue
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errors.New("truncated field")
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return errors.New("truncated fixed32")
+			}
+			b = b[4:]
+			continue
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		if err := field(int(key>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protoVarints appends the values of a repeated varint field to vs, either
+// the single one v, or the ones packed in data.
+func protoVarints(vs []uint64, v uint64, data []byte) ([]uint64, error) {
+	if data == nil {
+		return append(vs, v), nil
+	}
+	for len(data) > 0 {
+		v, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("malformed packed varint")
+		}
+		vs = append(vs, v)
+		data = data[n:]
+	}
+	return vs, nil
+}
+
+// hotFuncSuffix matches the suffixes the compiler names the function literals
+// of a function with, and the numbers of the init functions, e.g. .func1,
+// .func1.2, .gowrap1, or .0
+var hotFuncSuffix = regexp.MustCompile(`\.(func|gowrap|deferwrap)?\d+$`)
+
+// hotFuncName returns the name of the function declaration name, as named in
+// a pprof profile, is in, without the type arguments, or the suffixes of its
+// function literals, e.g., example.com/lib.(*Stack).Push for
+// example.com/lib.(*Stack[...]).Push.func1.
+func hotFuncName(name string) string {
+	var b strings.Builder
+	depth := 0
+	for _, r := range name {
+		switch {
+		case r == '[':
+			depth++
+		case r == ']' && depth > 0:
+			depth--
+		case depth == 0:
+			b.WriteRune(r)
+		}
+	}
+	name = b.String()
+	for {
+		trimmed := hotFuncSuffix.ReplaceAllString(name, "")
+		if trimmed == name {
+			return name
+		}
+		name = trimmed
+	}
+}
+
+// hotDeclName returns the name of the function declaration fn, in the package
+// importPath, as returned by hotFuncName. The functions of the main packages
+// are in the package main in the profiles.
+func hotDeclName(importPath string, f *ast.File, fn *ast.FuncDecl) string {
+	if f.Name.Name == "main" {
+		importPath = "main"
+	}
+	name := funcName(fn)
+	// The methods of value receivers are named T.M, not (T).M
+	if strings.HasPrefix(name, "(") && !strings.HasPrefix(name, "(*") {
+		name = strings.Replace(strings.TrimPrefix(name, "("), ")", "", 1)
+	}
+	return importPath + "." + name
+}
+
+// hotBlocks rewrites the file at path, as instrumented by go tool cover, or
+// coverFuncs, with the variable varName, from the source file src of the
+// package importPath, so that the hot functions in it, along with the function
+// literals in them, are either not instrumented at all, or instrumented with
+// the single counter of the first block of their bodies, as hot.action
+// says. It returns the names of the hot functions in the file, with their
+// share of the CPU.
+func hotBlocks(path, src, importPath, varName string, hot *hotFunctions) ([]string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, src, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	type span struct{ start, end [2]int }
+	var names []string
+	var spans []span
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil {
+			continue
+		}
+		name := hotDeclName(importPath, f, fn)
+		share, ok := hot.share[name]
+		if !ok {
+			continue
+		}
+		lbrace, rbrace := fset.Position(fn.Body.Lbrace), fset.Position(fn.Body.Rbrace)
+		spans = append(spans, span{[2]int{lbrace.Line, lbrace.Column + 1}, [2]int{rbrace.Line, rbrace.Column + 1}})
+		names = append(names, fmt.Sprintf("%s (%.1f%%)", name[strings.LastIndex(name, "/")+1:], share))
+	}
+	if len(spans) == 0 {
+		return nil, nil
+	}
+	blocks, err := parseCoverBlocks(path, varName)
+	if err != nil {
+		return nil, err
+	}
+	less := func(a, b [2]int) bool { return a[0] < b[0] || a[0] == b[0] && a[1] < b[1] }
+	within := func(b [5]int) int {
+		for i, s := range spans {
+			if !less([2]int{b[0], b[1]}, s.start) && !less(s.end, [2]int{b[2], b[3]}) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	// The blocks of a hot function are all collapsed into the first one of
+	// its body, whose counter is incremented whenever the function is called,
+	// unless they are excluded
+	first := make(map[int]int) // The first block of the hot function, by the span
+	for i, b := range blocks {
+		if s := within(b); s >= 0 {
+			if j, ok := first[s]; !ok || less([2]int{b[0], b[1]}, [2]int{blocks[j][0], blocks[j][1]}) {
+				first[s] = i
+			}
+		}
+	}
+	index := make([]int, len(blocks))
+	entry := make(map[int]int) // The index of the block the function is collapsed into, in keep, by the span
+	var keep [][5]int
+	for i, b := range blocks {
+		index[i] = -1
+		s := within(b)
+		if s < 0 {
+			index[i] = len(keep)
+			keep = append(keep, b)
+		} else if hot.action == hotActionFunc && first[s] == i {
+			// The block spans the body, as the ones of coverFuncs
+			entry[s] = len(keep)
+			index[i] = len(keep)
+			keep = append(keep, [5]int{spans[s].start[0], spans[s].start[1], spans[s].end[0], spans[s].end[1], 0})
+		}
+	}
+	for _, b := range blocks {
+		if s := within(b); s >= 0 {
+			if k, ok := entry[s]; ok {
+				keep[k][4] += b[4]
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, keepBlocks(path, varName, index, keep)
+}
@@ -0,0 +1,442 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// SourceImportPath returns the path which the package with the given import
+// path has to be imported as in the main file.
+//
+// go list reports the dependencies of the main package by their resolved
+// import paths. These differ from the paths used in source for vendored
+// packages (e.g., example.com/app/vendor/example.com/lib is imported as
+// example.com/lib), and the ImportMap of the main package maps the paths used
+// in source to the resolved ones. If several source paths resolve to the same
+// package, the lexically first one is used.
+func (c *Cover) SourceImportPath(importPath string) string {
+	var paths []string
+	for src, resolved := range c.ImportMap {
+		if resolved == importPath {
+			paths = append(paths, src)
+		}
+	}
+	if len(paths) == 0 {
+		return importPath
+	}
+	sort.Strings(paths)
+	return paths[0]
+}
+
+// assumedPackageName returns the assumed name of the package with the given
+// import path, for packages which cannot be imported in order to find their
+// actual name. This is the same heuristic as the one used by goimports:
+// gopkg.in/yaml.v2 is yaml, github.com/org/go-lib/v2 is lib.
+func assumedPackageName(importPath string) string {
+	base := path.Base(importPath)
+	if strings.HasPrefix(base, "v") {
+		if _, err := strconv.Atoi(base[1:]); err == nil {
+			if dir := path.Dir(importPath); dir != "." {
+				base = path.Base(dir)
+			}
+		}
+	}
+	base = strings.TrimPrefix(base, "go-")
+	if i := strings.IndexFunc(base, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	}); i >= 0 {
+		base = base[:i]
+	}
+	return base
+}
+
+// importSpecName returns the name which the package imported by spec is
+// referred to by in the file. Packages which are not named in the import are
+// imported through imp in order to find their name, falling back to
+// assumedPackageName if this fails.
+func importSpecName(imp types.Importer, spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	p, err := strconv.Unquote(spec.Path.Value)
+	if err != nil {
+		return ""
+	}
+	if pkg, err := imp.Import(p); err == nil {
+		return pkg.Name()
+	}
+	return assumedPackageName(p)
+}
+
+// importedPkgName returns the package name object declared by spec.
+func importedPkgName(info *types.Info, spec *ast.ImportSpec) *types.PkgName {
+	var obj types.Object
+	if spec.Name != nil {
+		obj = info.Defs[spec.Name]
+	} else {
+		obj = info.Implicits[spec]
+	}
+	pkgName, _ := obj.(*types.PkgName)
+	return pkgName
+}
+
+// renamePkgName renames all the references to the imported package pkgName.
+func renamePkgName(info *types.Info, pkgName *types.PkgName, name string) {
+	for ident, obj := range info.Uses {
+		if obj == pkgName {
+			ident.Name = name
+		}
+	}
+}
+
+// removeImportSpec removes spec from the imports of the file f.
+func removeImportSpec(f *ast.File, spec *ast.ImportSpec) {
+	for i, s := range f.Imports {
+		if s == spec {
+			f.Imports = append(f.Imports[:i], f.Imports[i+1:]...)
+			break
+		}
+	}
+	for _, decl := range f.Decls {
+		d, isDecl := decl.(*ast.GenDecl)
+		if !isDecl || d.Tok != token.IMPORT {
+			continue
+		}
+		for i, s := range d.Specs {
+			if s == spec {
+				d.Specs = append(d.Specs[:i], d.Specs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// packageScopeDecls returns the identifiers of all the package level
+// declarations in the files of the package p, by their names.
+func packageScopeDecls(fset *token.FileSet, p *Package) (map[string]*ast.Ident, error) {
+	decls := make(map[string]*ast.Ident)
+	for _, name := range p.GoFiles {
+		fname := filepath.Join(p.Dir, name)
+		f, err := parser.ParseFile(fset, fname, nil, 0)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to parse the file: %s. Error: %s\n", fname, err.Error())
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if d.Recv == nil {
+					decls[d.Name.Name] = d.Name
+				}
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					switch s := spec.(type) {
+					case *ast.ValueSpec:
+						for _, n := range s.Names {
+							decls[n.Name] = n
+						}
+					case *ast.TypeSpec:
+						decls[s.Name.Name] = s.Name
+					}
+				}
+			}
+		}
+	}
+	return decls, nil
+}
+
+// resolveImports resolves the imports of the generated main file against the
+// imports of the original main file, with which it is to be merged, using the
+// type information from checking the generated file:
+//
+//   - Packages which the main file already imports are referred to by the name
+//     they have in the main file, and are not imported again. This includes the
+//     covered packages, when imported by main.
+//
+//   - Packages whose name is already taken in the main file, either by the
+//     import of another package, or by a package level declaration, are
+//     imported under an alias instead.
+//
+//   - Blank imports of packages which the main file already imports, in any
+//     way, are dropped.
+func resolveImports(fset *token.FileSet, generated, original *ast.File, info *types.Info, mainNames map[string]bool) {
+	imp := importer.ForCompiler(fset, "gc", nil)
+	byPath := make(map[string]string) // import path -> name in main
+	taken := make(map[string]bool)    // names of the packages imported in main
+	imported := make(map[string]bool) // import paths imported in main, in any way
+	for _, spec := range original.Imports {
+		p, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			continue
+		}
+		imported[p] = true
+		name := importSpecName(imp, spec)
+		if name == "_" || name == "." {
+			continue
+		}
+		taken[name] = true
+		if _, ok := byPath[p]; !ok {
+			byPath[p] = name
+		}
+	}
+	for _, spec := range append([]*ast.ImportSpec(nil), generated.Imports...) {
+		pkgName := importedPkgName(info, spec)
+		if pkgName == nil {
+			continue
+		}
+		if spec.Name != nil && spec.Name.Name == "_" {
+			// A blank import is only needed once
+			if imported[pkgName.Imported().Path()] {
+				removeImportSpec(generated, spec)
+			}
+			continue
+		}
+		if name, ok := byPath[pkgName.Imported().Path()]; ok {
+			renamePkgName(info, pkgName, name)
+			removeImportSpec(generated, spec)
+			continue
+		}
+		if !taken[pkgName.Name()] && !mainNames[pkgName.Name()] {
+			continue
+		}
+		alias := "_cover_" + pkgName.Name()
+		for i := 1; taken[alias] || mainNames[alias]; i++ {
+			alias = "_cover_" + pkgName.Name() + strconv.Itoa(i)
+		}
+		taken[alias] = true
+		spec.Name = ast.NewIdent(alias)
+		renamePkgName(info, pkgName, alias)
+	}
+}
+
+// sourceImporter imports the packages through the gc importer, which is fast,
+// but only finds the standard library, and falls back to importing them from
+// source, which handles modules.
+type sourceImporter struct {
+	gc     types.Importer
+	source types.Importer
+}
+
+func newSourceImporter(fset *token.FileSet) *sourceImporter {
+	return &sourceImporter{
+		gc:     importer.ForCompiler(fset, "gc", nil),
+		source: importer.ForCompiler(fset, "source", nil),
+	}
+}
+
+func (s *sourceImporter) Import(path string) (*types.Package, error) {
+	if p, err := s.gc.Import(path); err == nil {
+		return p, nil
+	}
+	return s.source.Import(path)
+}
+
+// guardDotImports renames the package level declarations in the generated main
+// file, which would collide with the exported names of the packages which the
+// original main file dot-imports. All references to the declarations are
+// renamed along with them.
+func guardDotImports(fset *token.FileSet, generated, original *ast.File, info *types.Info) {
+	dotNames := make(map[string]bool)
+	var imp types.Importer
+	for _, spec := range original.Imports {
+		if spec.Name == nil || spec.Name.Name != "." {
+			continue
+		}
+		if imp == nil {
+			imp = newSourceImporter(fset)
+		}
+		p, _ := strconv.Unquote(spec.Path.Value)
+		pkg, err := imp.Import(p)
+		if err != nil {
+			fmt.Fprintf(stderr, "Warning: failed to import the dot-imported package %s, "+
+				"in order to check for collisions with the generated code. Error: %s\n",
+				p, err.Error())
+			continue
+		}
+		for _, name := range pkg.Scope().Names() {
+			if ast.IsExported(name) {
+				dotNames[name] = true
+			}
+		}
+	}
+	if len(dotNames) == 0 {
+		return
+	}
+	for ident, obj := range info.Defs {
+		if obj == nil || !dotNames[ident.Name] || obj.Parent() != obj.Pkg().Scope() {
+			continue
+		}
+		name := "cover" + ident.Name
+		for i := 1; dotNames[name]; i++ {
+			name = "cover" + ident.Name + strconv.Itoa(i)
+		}
+		renameDecl(info, ident, name)
+	}
+}
+
+// listPackageNames returns the names of the packages with the given import
+// paths, as reported by `go list`. Packages which cannot be found are left out.
+func listPackageNames(paths []string) (map[string]string, error) {
+	names := make(map[string]string)
+	if len(paths) == 0 {
+		return names, nil
+	}
+	err := streamCommand("", nil, func(r io.Reader) error {
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) == 2 {
+				names[fields[0]] = fields[1]
+			}
+		}
+		return s.Err()
+	}, "go", append([]string{"list", "-e", "-f", "{{.ImportPath}} {{.Name}}"}, paths...)...)
+	if err != nil {
+		fmt.Fprintf(stderr, "`go list %s` failed. Error: %s\n", strings.Join(paths, " "), err.Error())
+		return nil, err
+	}
+	return names, nil
+}
+
+// nameImporter imports all packages as empty packages, only carrying the
+// package name. This is sufficient in order to find which imports are used,
+// as the type checker records the uses of an imported package, before looking
+// up the selected name in it.
+type nameImporter map[string]string
+
+func (n nameImporter) Import(path string) (*types.Package, error) {
+	name, ok := n[path]
+	if !ok {
+		return nil, fmt.Errorf("unknown package: %s", path)
+	}
+	p := types.NewPackage(path, name)
+	p.MarkComplete()
+	return p, nil
+}
+
+// pruneImports removes the imports of the file f which are not used in it,
+// so that merging never leaves the file with imports which are "imported and
+// not used". This includes both the imports of the generated code which it
+// does not need, and those of the original main file, which only the code
+// replaced by the merge used.
+//
+// Blank and dot imports are always kept, and so are imports of packages whose
+// name cannot be found, as it is then not known how they are referred to.
+func pruneImports(fset *token.FileSet, f *ast.File) error {
+	var specs []*ast.ImportSpec
+	var paths []string
+	for _, decl := range f.Decls {
+		d, isDecl := decl.(*ast.GenDecl)
+		if !isDecl || d.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range d.Specs {
+			is := spec.(*ast.ImportSpec)
+			p, err := strconv.Unquote(is.Path.Value)
+			if err != nil {
+				continue
+			}
+			specs = append(specs, is)
+			paths = append(paths, p)
+		}
+	}
+	names, err := listPackageNames(paths)
+	if err != nil {
+		return err
+	}
+	conf := types.Config{
+		Importer: nameImporter(names),
+		// All the names in the imported packages are undefined
+		Error: func(error) {},
+	}
+	info := &types.Info{
+		Defs:      make(map[*ast.Ident]types.Object),
+		Uses:      make(map[*ast.Ident]types.Object),
+		Implicits: make(map[ast.Node]types.Object),
+	}
+	conf.Check("main", fset, []*ast.File{f}, info)
+	used := make(map[types.Object]bool)
+	for _, obj := range info.Uses {
+		used[obj] = true
+	}
+	for i, spec := range specs {
+		if spec.Name != nil && (spec.Name.Name == "_" || spec.Name.Name == ".") {
+			continue
+		}
+		if _, ok := names[paths[i]]; !ok {
+			continue
+		}
+		if pkgName := importedPkgName(info, spec); pkgName != nil && !used[pkgName] {
+			removeImportSpec(f, spec)
+		}
+	}
+	return nil
+}
+
+// internalRoot returns the root of the tree which may import the package with
+// the given import path, if it is an internal package. This follows the rule
+// used by the go command, where the last internal element in the path is the
+// one which applies, as it is the most restrictive.
+func internalRoot(importPath string) (root string, internal bool) {
+	switch {
+	case strings.HasSuffix(importPath, "/internal"):
+		return strings.TrimSuffix(importPath, "/internal"), true
+	case strings.Contains(importPath, "/internal/"):
+		return importPath[:strings.LastIndex(importPath, "/internal/")], true
+	case importPath == "internal", strings.HasPrefix(importPath, "internal/"):
+		return "", true
+	}
+	return "", false
+}
+
+// checkImportable verifies that the main package can import all the covered
+// packages, as the generated main file has to import them in order to register
+// their GoCover variables. Internal packages are only importable from within
+// the tree rooted at the parent of the internal directory, which for instance
+// excludes the internal packages of modules included through
+// -include-replaced.
+func checkImportable(mainPackage string, covered []string) error {
+	for _, p := range covered {
+		root, internal := internalRoot(p)
+		if !internal || root == "" {
+			continue
+		}
+		if mainPackage == root || strings.HasPrefix(mainPackage, root+"/") {
+			continue
+		}
+		err := fmt.Errorf("the package %s is internal to %s, and can not be imported by the main package %s",
+			p, root, mainPackage)
+		fmt.Fprintf(stderr, "Error: %s.\n"+
+			"The generated main file has to import all the covered packages, in order to register their\n"+
+			"coverage variables, so the main package has to be located within %s in order to cover it.\n",
+			err.Error(), root)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// mergeImports merges the generated file generated into the main file main,
+// as instrument does, and returns the merged file.
+func mergeImports(t *testing.T, main, generated string) string {
+	t.Helper()
+	fset := token.NewFileSet()
+	mainFile := filepath.Join(t.TempDir(), "main.go")
+	if err := os.WriteFile(mainFile, []byte(main), 0644); err != nil {
+		t.Fatal(err)
+	}
+	original, err := parser.ParseFile(fset, mainFile, nil, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen, err := parser.ParseFile(fset, "generated.go", generated, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := types.Config{
+		Importer: importer.ForCompiler(fset, "source", nil),
+		// The imports which are not used are removed by the merge
+		Error: func(err error) {
+			if !strings.Contains(err.Error(), "not used") {
+				t.Error(err)
+			}
+		},
+	}
+	info := &types.Info{
+		Defs:      make(map[*ast.Ident]types.Object),
+		Uses:      make(map[*ast.Ident]types.Object),
+		Implicits: make(map[ast.Node]types.Object),
+	}
+	conf.Check("main", fset, []*ast.File{gen}, info)
+	mainNames := make(map[string]bool)
+	for _, obj := range original.Scope.Objects {
+		mainNames[obj.Name] = true
+	}
+	resolveImports(fset, gen, original, info, mainNames)
+	var merged bytes.Buffer
+	if err = mergeASTTrees(fset, gen, original, nil, mainFile, false, &merged); err != nil {
+		t.Fatal(err)
+	}
+	return merged.String()
+}
+
+// mergedImports returns the imports of the merged file src, as the name they
+// are imported under, if any, and their path
+func mergedImports(t *testing.T, src string) []string {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), "main.go", src, parser.ImportsOnly)
+	if err != nil {
+		t.Fatalf("the merged file does not parse: %s\n%s", err, src)
+	}
+	var imports []string
+	for _, spec := range f.Imports {
+		if spec.Name != nil {
+			imports = append(imports, spec.Name.Name+" "+spec.Path.Value)
+		} else {
+			imports = append(imports, spec.Path.Value)
+		}
+	}
+	sort.Strings(imports)
+	return imports
+}
+
+func TestMergeImports(t *testing.T) {
+	tests := []struct {
+		name      string
+		main      string
+		generated string
+		imports   []string
+		contains  []string
+	}{
+		{
+			name: "shared import",
+			main: `package main
+
+import "fmt"
+
+func main() { fmt.Println() }
+`,
+			generated: `package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func coverReport() { fmt.Fprintln(os.Stderr) }
+`,
+			imports:  []string{`"fmt"`, `"os"`},
+			contains: []string{"fmt.Fprintln(os.Stderr)"},
+		},
+		{
+			name: "import renamed in main",
+			main: `package main
+
+import f "fmt"
+
+func main() { f.Println() }
+`,
+			generated: `package main
+
+import "fmt"
+
+func coverReport() { fmt.Println() }
+`,
+			imports:  []string{`f "fmt"`},
+			contains: []string{"f.Println()"},
+		},
+		{
+			name: "name taken by a declaration",
+			main: `package main
+
+var os = 1
+
+func main() { println(os) }
+`,
+			generated: `package main
+
+import "os"
+
+func coverReport() { os.Exit(0) }
+`,
+			imports:  []string{`_cover_os "os"`},
+			contains: []string{"_cover_os.Exit(0)"},
+		},
+		{
+			name: "name taken by another import",
+			main: `package main
+
+import strings "fmt"
+
+func main() { strings.Println() }
+`,
+			generated: `package main
+
+import "strings"
+
+func coverReport() { _ = strings.TrimSpace("") }
+`,
+			imports:  []string{`_cover_strings "strings"`, `strings "fmt"`},
+			contains: []string{`_cover_strings.TrimSpace("")`},
+		},
+		{
+			name: "blank import imported in main",
+			main: `package main
+
+import "embed"
+
+var _ embed.FS
+
+func main() {}
+`,
+			generated: `package main
+
+import _ "embed"
+
+func coverReport() {}
+`,
+			imports: []string{`"embed"`},
+		},
+		{
+			name: "unused import",
+			main: `package main
+
+func main() {}
+`,
+			generated: `package main
+
+import (
+	"fmt"
+	"os"
+)
+
+var _ = fmt.Sprint
+
+func coverReport() {}
+`,
+			imports: []string{`"fmt"`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged := mergeImports(t, test.main, test.generated)
+			if imports := mergedImports(t, merged); !reflect.DeepEqual(imports, test.imports) {
+				t.Errorf("imports %q, want %q in\n%s", imports, test.imports, merged)
+			}
+			for _, s := range test.contains {
+				if !strings.Contains(merged, s) {
+					t.Errorf("%q not in\n%s", s, merged)
+				}
+			}
+		})
+	}
+}
+
+func TestSourceImportPath(t *testing.T) {
+	importMap := map[string]string{
+		"example.com/lib":  "example.com/app/vendor/example.com/lib",
+		"example.com/lib2": "example.com/app/vendor/example.com/lib",
+		"example.com/old":  "example.com/app/vendor/example.com/new",
+	}
+	tests := []struct {
+		importPath string
+		want       string
+	}{
+		{"example.com/app/vendor/example.com/lib", "example.com/lib"},
+		{"example.com/app/vendor/example.com/new", "example.com/old"},
+		{"example.com/app/internal/pkg", "example.com/app/internal/pkg"},
+		{"fmt", "fmt"},
+	}
+	c := &Cover{ImportMap: importMap}
+	for _, test := range tests {
+		if got := c.SourceImportPath(test.importPath); got != test.want {
+			t.Errorf("SourceImportPath(%q) = %q, want %q", test.importPath, got, test.want)
+		}
+	}
+}
+
+func TestAssumedPackageName(t *testing.T) {
+	tests := []struct {
+		importPath string
+		want       string
+	}{
+		{"fmt", "fmt"},
+		{"gopkg.in/yaml.v2", "yaml"},
+		{"github.com/org/go-lib/v2", "lib"},
+		{"github.com/org/lib-go", "lib"},
+		{"example.com/v1x", "v1x"},
+	}
+	for _, test := range tests {
+		if got := assumedPackageName(test.importPath); got != test.want {
+			t.Errorf("assumedPackageName(%q) = %q, want %q", test.importPath, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The starter configuration written by init, for the user to adjust
+const (
+	initDir     = "/var/lib/gobinarycoverage"
+	initTotal   = 50.0
+	initDefault = 30.0
+)
+
+// generatedMarkerLines is the number of lines at the start of a file which are
+// searched for the generated marker
+const generatedMarkerLines = 20
+
+// initExcludedNames are the last elements of the import paths of the packages
+// which are excluded by the starter configuration, as they are test helpers.
+var initExcludedNames = map[string]bool{
+	"mock": true, "mocks": true, "fake": true, "fakes": true, "testutil": true, "testutils": true,
+}
+
+// generatedMarker is the comment marking generated files, as documented by
+// the go command, see `go help generate`
+var generatedMarker = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// isGeneratedFile returns true if the file at path is generated, i.e., has
+// the generated marker before its package clause.
+func isGeneratedFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for i := 0; i < generatedMarkerLines && s.Scan(); i++ {
+		line := strings.TrimSpace(s.Text())
+		if generatedMarker.MatchString(line) {
+			return true, nil
+		}
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+	}
+	return false, s.Err()
+}
+
+// initUsage is the help of the init subcommand.
+const initUsage = `
+   gobinarycoverage init [-o file] [-force]
+
+       Writes a starter configuration, in YAML (default
+       ./.gobinarycoverage.yaml), for the main module, with the generated
+       packages, and the test helpers, e.g., mocks, excluded, the
+       directory of the profiles, and the thresholds, and lists the main
+       packages to instrument. Without -config, .gobinarycoverage.yaml,
+       .gobinarycoverage.yml, or the .gobinarycoverage.json of the
+       earlier versions, is read, whichever is found first. The
+       "instrument" section gives the defaults of -mode, -exclude-pkg,
+       -include-pkg, -exclude-file, -include-file, -total-pkg, -dir,
+       -report-formats and -backend, which the flags given override. The
+       values may reference the environment as ${VAR}, or
+       ${VAR:-default}, and fail if VAR is unset without a default.
+       $${VAR} is left as ${VAR}. Unknown fields are errors.
+`
+
+// initCommand inspects the main module, and writes a starter configuration
+// for it, as configured by the arguments of the init subcommand. The packages
+// which are generated, and the test helpers, are excluded, and the main
+// packages found are listed.
+func initCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, initUsage)
+	out := fs.String("o", defaultConfigFile, "Write the configuration to this file")
+	force := fs.Bool("force", false, "Overwrite the configuration file, if it exists")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("usage: gobinarycoverage init [-o file] [-force]")
+	}
+	if _, err := os.Stat(*out); err == nil && !*force {
+		return fmt.Errorf("%s exists, give -force in order to overwrite it", *out)
+	}
+	ctx := options{}.buildContext()
+	root, err := moduleRoot(ctx)
+	if err != nil {
+		return err
+	}
+	packages, err := listPackages(ctx, []string{"./..."})
+	if err != nil {
+		return err
+	}
+
+	c := &config{}
+	c.Instrument.Dir = initDir
+	total, def := initTotal, initDefault
+	c.Thresholds.Total, c.Thresholds.Default = &total, &def
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	var mains []string
+	for _, p := range packages {
+		if p.Name == "main" {
+			// As given to gobinarycoverage, from the working directory
+			rel, err := filepath.Rel(wd, p.Dir)
+			if err != nil {
+				return err
+			}
+			if rel = filepath.ToSlash(rel); !strings.HasPrefix(rel, ".") {
+				rel = "./" + rel
+			}
+			mains = append(mains, rel)
+			continue
+		}
+		if initExcludedNames[path.Base(p.ImportPath)] {
+			c.Instrument.ExcludePkg = append(c.Instrument.ExcludePkg, p.ImportPath)
+			continue
+		}
+		generated := len(p.GoFiles) > 0
+		for _, name := range p.GoFiles {
+			if generated, err = isGeneratedFile(filepath.Join(p.Dir, name)); err != nil {
+				return err
+			}
+			if !generated {
+				break
+			}
+		}
+		if generated {
+			c.Instrument.ExcludePkg = append(c.Instrument.ExcludePkg, p.ImportPath)
+		}
+	}
+
+	var contents bytes.Buffer
+	enc := yaml.NewEncoder(&contents)
+	enc.SetIndent(2)
+	if err = enc.Encode(c); err != nil {
+		return err
+	}
+	if err = enc.Close(); err != nil {
+		return err
+	}
+	if err = os.WriteFile(*out, contents.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Wrote the configuration to %s, adjust it to the project\n", *out)
+	if len(c.Instrument.ExcludePkg) > 0 {
+		fmt.Fprintf(w, "Excluded, as generated, or test helpers: %s\n", strings.Join(c.Instrument.ExcludePkg, ", "))
+	}
+	if _, err = os.Stat(filepath.Join(root, "vendor", "modules.txt")); err == nil {
+		fmt.Fprintln(w, "The module is vendored, the vendored packages are never instrumented")
+	}
+	if len(mains) == 0 {
+		fmt.Fprintln(w, "No main packages found")
+		return nil
+	}
+	fmt.Fprintf(w, "Main packages: %s\n", strings.Join(mains, ", "))
+	fmt.Fprintf(w, "Instrument them with: gobinarycoverage %s\n", strings.Join(mains, " "))
+	return nil
+}
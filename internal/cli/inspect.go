@@ -0,0 +1,317 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// settingsMarker precedes the settings stamped into the instrumented binaries,
+// in the string they are stored as, so that inspect finds them.
+const settingsMarker = "gobinarycoverage settings:"
+
+// instrumentSettings are the settings a binary is instrumented with, which are
+// stamped into it, so that it is always possible to tell how a given binary,
+// and the coverage it produces, came about.
+type instrumentSettings struct {
+	Tool            versionInfo         `json:"tool"`
+	MainPackage     string              `json:"main_package"`
+	Root            string              `json:"root,omitempty"` // The root of the main module, as instrumented, which the paths in the binary are under
+	Mode            string              `json:"mode"`
+	Granularity     string              `json:"granularity,omitempty"`
+	Sample          float64             `json:"sample,omitempty"` // The percentage of the blocks instrumented, if not all of them are
+	Label           string              `json:"label"`
+	EnvPrefix       string              `json:"env_prefix"`
+	Module          string              `json:"module,omitempty"`
+	IncludeReplaced bool                `json:"include_replaced,omitempty"`
+	Packages        []string            `json:"packages"`
+	Skipped         []string            `json:"skipped,omitempty"`  // The packages without any code to cover, which are not instrumented
+	Assembly        map[string][]string `json:"assembly,omitempty"` // The functions implemented in assembly, per package, which are not covered
+	SourcesHash     string              `json:"sources_hash"`       // The sha256 of the instrumented sources
+	Options         []string            `json:"options,omitempty"`  // The options of the runtime, as given on the command line
+	CompactID       string              `json:"compact_id,omitempty"`
+	HotAction       string              `json:"hot_action,omitempty"`
+	Hot             map[string][]string `json:"hot,omitempty"` // The hot functions, per package, which are excluded, or instrumented with a single counter
+}
+
+// stampSettings returns the settings the main package mainPackage is
+// instrumented with, as described by opts and cover, prefixed by
+// settingsMarker. It is stamped into the binary through coverSettings. The
+// sources are hashed with the root of the main module replaced, as it is in
+// their //line directives, so that the hash is the same in every checkout.
+func stampSettings(mainPackage, root string, opts options, cover *Cover) (string, error) {
+	s := instrumentSettings{
+		Tool:            getVersionInfo(),
+		MainPackage:     mainPackage,
+		Root:            root,
+		Mode:            cover.Mode,
+		Granularity:     cover.Granularity,
+		Label:           cover.Label,
+		EnvPrefix:       cover.EnvPrefix,
+		Module:          cover.Module,
+		IncludeReplaced: opts.includeReplaced,
+		CompactID:       cover.CompactID,
+	}
+	if cover.Sample < 100 {
+		s.Sample = cover.Sample
+	}
+	h := sha256.New()
+	for _, ci := range cover.CoverInfo {
+		s.Packages = append(s.Packages, ci.Package)
+		if len(ci.Assembly) > 0 {
+			if s.Assembly == nil {
+				s.Assembly = make(map[string][]string)
+			}
+			s.Assembly[ci.Package] = ci.Assembly
+		}
+		if len(ci.Hot) > 0 {
+			if s.Hot == nil {
+				s.Hot = make(map[string][]string)
+			}
+			s.Hot[ci.Package] = ci.Hot
+			s.HotAction = opts.hotAction
+		}
+		for _, cv := range ci.sortedVars() {
+			contents, err := os.ReadFile(cv.Path)
+			if err != nil {
+				return "", err
+			}
+			contents = bytes.ReplaceAll(contents, []byte(root), []byte(recordRootToken))
+			fmt.Fprintf(h, "%s %d\n", cv.File, len(contents))
+			h.Write(contents)
+		}
+	}
+	for _, ci := range cover.Skipped {
+		s.Skipped = append(s.Skipped, ci.Package)
+		if len(ci.Assembly) > 0 {
+			if s.Assembly == nil {
+				s.Assembly = make(map[string][]string)
+			}
+			s.Assembly[ci.Package] = ci.Assembly
+		}
+	}
+	s.SourcesHash = hex.EncodeToString(h.Sum(nil))
+	if cover.SystemdNotify {
+		s.Options = append(s.Options, "-systemd-notify")
+	}
+	if cover.FlushOnSIGTERM {
+		s.Options = append(s.Options, "-flush-on-sigterm")
+	}
+	if opts.exitSignals != "" {
+		s.Options = append(s.Options, "-exit-signals="+opts.exitSignals)
+	}
+	if opts.flushSignals != "" {
+		s.Options = append(s.Options, "-flush-signals="+opts.flushSignals)
+	}
+	if cover.DumpAddr != "" {
+		s.Options = append(s.Options, "-dump-addr="+cover.DumpAddr)
+	}
+	if cover.FlushTrigger != "" {
+		s.Options = append(s.Options, "-flush-trigger="+cover.FlushTrigger)
+	}
+	if cover.LiveAddr != "" {
+		s.Options = append(s.Options, "-live-addr="+cover.LiveAddr)
+	}
+	if cover.Serve {
+		s.Options = append(s.Options, "-serve")
+	}
+	if cover.ReportFormats != "" {
+		s.Options = append(s.Options, "-report-formats="+cover.ReportFormats)
+	}
+	if cover.Expvar {
+		s.Options = append(s.Options, "-expvar")
+	}
+	if cover.Pprof {
+		s.Options = append(s.Options, "-pprof")
+	}
+	if cover.Rotate != "" {
+		s.Options = append(s.Options, "-rotate="+cover.Rotate)
+	}
+	if cover.SyslogFallback {
+		s.Options = append(s.Options, "-syslog-fallback")
+	}
+	if cover.MQTTBroker != "" {
+		s.Options = append(s.Options, "-mqtt-broker="+cover.MQTTBroker, "-mqtt-topic="+cover.MQTTTopic)
+	}
+	if cover.SubcommandDepth > 0 {
+		s.Options = append(s.Options, "-subcommand-depth="+strconv.Itoa(cover.SubcommandDepth))
+	}
+	if cover.MaxProfiles > 0 {
+		s.Options = append(s.Options, "-max-profiles="+strconv.Itoa(cover.MaxProfiles))
+	}
+	if cover.MaxProfilesSize > 0 {
+		s.Options = append(s.Options, "-max-profiles-size="+strconv.FormatInt(cover.MaxProfilesSize, 10))
+	}
+	if cover.Lock {
+		s.Options = append(s.Options, "-lock")
+	}
+	if opts.tags != "" {
+		s.Options = append(s.Options, "-tags="+opts.tags)
+	}
+	if opts.excludePkg != "" {
+		s.Options = append(s.Options, "-exclude-pkg="+opts.excludePkg)
+	}
+	if opts.includePkg != "" {
+		s.Options = append(s.Options, "-include-pkg="+opts.includePkg)
+	}
+	if opts.excludeFile != "" {
+		s.Options = append(s.Options, "-exclude-file="+opts.excludeFile)
+	}
+	if opts.includeFile != "" {
+		s.Options = append(s.Options, "-include-file="+opts.includeFile)
+	}
+	if opts.totalPkg != "" {
+		s.Options = append(s.Options, "-total-pkg="+opts.totalPkg)
+	}
+	if cover.LogFile != "" {
+		s.Options = append(s.Options, "-log="+cover.LogFile)
+	}
+	if cover.Dir != "" {
+		s.Options = append(s.Options, "-dir="+cover.Dir)
+	}
+	if cover.Persist != "" {
+		s.Options = append(s.Options, "-persist="+cover.Persist)
+	}
+	if opts.templateFile != "" {
+		s.Options = append(s.Options, "-template="+opts.templateFile)
+	}
+	contents, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return settingsMarker + string(contents), nil
+}
+
+// readSettings returns the settings stamped into the binary in contents. The
+// marker is searched for, until the settings following it are decoded, as it
+// can be in the binary by itself too, e.g., in gobinarycoverage.
+func readSettings(contents []byte) (*instrumentSettings, error) {
+	for {
+		i := bytes.Index(contents, []byte(settingsMarker))
+		if i < 0 {
+			return nil, errors.New("no settings found, the binary is not instrumented, or by an older gobinarycoverage")
+		}
+		contents = contents[i+len(settingsMarker):]
+		s := &instrumentSettings{}
+		if err := json.NewDecoder(bytes.NewReader(contents)).Decode(s); err == nil {
+			return s, nil
+		}
+	}
+}
+
+// inspectUsage is the help of the inspect subcommand.
+const inspectUsage = `
+   gobinarycoverage inspect [-json] binary
+
+       Prints the settings an instrumented binary is instrumented with: the
+       version of gobinarycoverage, the mode, the packages instrumented,
+       the hash of their instrumented sources, and the options given.
+`
+
+// inspectCommand prints the settings stamped into an instrumented binary, as
+// configured by the arguments of the inspect subcommand.
+func inspectCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, inspectUsage)
+	asJSON := fs.Bool("json", false, "Print the settings as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: gobinarycoverage inspect [-json] binary")
+	}
+	contents, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	s, err := readSettings(contents)
+	if err != nil {
+		return fmt.Errorf("%s: %s", fs.Arg(0), err.Error())
+	}
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	}
+	tool := s.Tool.Version
+	if s.Tool.Commit != "" {
+		tool += " (" + s.Tool.Commit
+		if s.Tool.Modified {
+			tool += ", modified"
+		}
+		tool += ")"
+	}
+	fmt.Fprintf(w, "instrumented by:   gobinarycoverage %s, built with %s\n", tool, s.Tool.GoVersion)
+	fmt.Fprintf(w, "main package:      %s\n", s.MainPackage)
+	if s.Root != "" {
+		fmt.Fprintf(w, "root:              %s\n", s.Root)
+	}
+	fmt.Fprintf(w, "mode:              %s\n", s.Mode)
+	if s.Granularity != "" {
+		fmt.Fprintf(w, "granularity:       %s\n", s.Granularity)
+	}
+	if s.Sample > 0 {
+		fmt.Fprintf(w, "sample:            %g%% of the blocks\n", s.Sample)
+	}
+	fmt.Fprintf(w, "label:             %s\n", s.Label)
+	fmt.Fprintf(w, "env prefix:        %s\n", s.EnvPrefix)
+	if s.Module != "" {
+		fmt.Fprintf(w, "per module:        %s\n", s.Module)
+	}
+	if s.IncludeReplaced {
+		fmt.Fprintf(w, "include replaced:  yes\n")
+	}
+	if len(s.Options) > 0 {
+		fmt.Fprintf(w, "options:           %s\n", strings.Join(s.Options, " "))
+	}
+	if s.CompactID != "" {
+		fmt.Fprintf(w, "compact ID:        %s\n", s.CompactID)
+	}
+	fmt.Fprintf(w, "sources hash:      %s\n", s.SourcesHash)
+	fmt.Fprintf(w, "packages:          %d\n", len(s.Packages))
+	for _, p := range s.Packages {
+		fmt.Fprintf(w, "  %s\n", p)
+		if funcs := s.Assembly[p]; len(funcs) > 0 {
+			fmt.Fprintf(w, "    not covered, implemented in assembly: %s\n", strings.Join(funcs, ", "))
+		}
+		if funcs := s.Hot[p]; len(funcs) > 0 {
+			how := "excluded"
+			if s.HotAction == hotActionFunc {
+				how = "a single counter"
+			}
+			fmt.Fprintf(w, "    hot, %s: %s\n", how, strings.Join(funcs, ", "))
+		}
+	}
+	if len(s.Skipped) > 0 {
+		fmt.Fprintf(w, "skipped:           %d, without any code to cover\n", len(s.Skipped))
+		for _, p := range s.Skipped {
+			fmt.Fprintf(w, "  %s\n", p)
+			if funcs := s.Assembly[p]; len(funcs) > 0 {
+				fmt.Fprintf(w, "    not covered, implemented in assembly: %s\n", strings.Join(funcs, ", "))
+			}
+		}
+	}
+	return nil
+}
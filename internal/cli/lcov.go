@@ -0,0 +1,166 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// defaultLcovFile is the name of the lcov file written to the top level of the
+// repository, where the coverage plugins of the editors look for it
+const defaultLcovFile = "lcov.info"
+
+// writeLcov writes the lcov tracefile of the profile p, with the source files
+// at paths, keyed by their names in the profile, so that editors show the
+// coverage in the gutter. Only the lines are reported, as the profiles hold no
+// functions, or branches.
+func writeLcov(w io.Writer, p *profile.Profile, paths map[string]string) error {
+	for _, file := range p.Files() {
+		counts := p.LineCounts(file)
+		lines := make([]int, 0, len(counts))
+		for line := range counts {
+			lines = append(lines, line)
+		}
+		sort.Ints(lines)
+		fmt.Fprintf(w, "TN:\nSF:%s\n", paths[file])
+		hit := 0
+		for _, line := range lines {
+			fmt.Fprintf(w, "DA:%d,%d\n", line, counts[line])
+			if counts[line] > 0 {
+				hit++
+			}
+		}
+		if _, err := fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", len(lines), hit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lcovPath returns the default path of the lcov file, at the top level of the
+// git work tree, or in the root of the main module, outside of one.
+func lcovPath() (string, error) {
+	if top, err := runCommand("", nil, "git", "rev-parse", "--show-toplevel"); err == nil {
+		return filepath.Join(strings.TrimSpace(string(top)), defaultLcovFile), nil
+	}
+	root, err := moduleRoot(options{}.buildContext())
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, defaultLcovFile), nil
+}
+
+// updateLcov merges the profiles given by args, selected by sel, and writes
+// the lcov file of the merge over the one at path, atomically, so that the
+// editors watching it never read it half written.
+func updateLcov(path string, args []string, sel profileSelection) (int, error) {
+	p, err := loadSelectedProfile(args, sel)
+	if err != nil {
+		return 0, err
+	}
+	files := p.Files()
+	paths, err := resolveProfileFiles(options{}.buildContext(), files)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		err = os.WriteFile(path, nil, 0644)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(files), writeFileAtomic(path, func(w io.Writer) error {
+		return writeLcov(w, p, paths)
+	})
+}
+
+// lcovUsage is the help of the lcov subcommand.
+const lcovUsage = `
+   gobinarycoverage lcov [-o file] [-watch] [-tag key=value,...] profile.out|dir [profile.out|dir...]
+
+       Writes the lcov file of the merge of the profiles given (default
+       lcov.info in the top level of the repository), which the coverage
+       gutter plugins of the editors show. With -watch, it is written
+       again whenever the profiles change, or new ones land in the
+       directories given, until interrupted.
+`
+
+// lcovCommand writes the lcov file of the merge of the profiles given, as
+// configured by the arguments of the lcov subcommand. With -watch, it is
+// written again whenever the profiles change, or new ones land in the
+// directories given, so that the coverage gutters of the editors show the
+// coverage of the scenarios run locally against the binary, live.
+func lcovCommand(args []string) error {
+	fs := flag.NewFlagSet("lcov", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, lcovUsage)
+	out := fs.String("o", "", "Write the lcov file to this path, instead of lcov.info in the top level of the repository")
+	watch := fs.Bool("watch", false, "Write the lcov file again whenever the profiles change, until interrupted")
+	selection := selectionFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: gobinarycoverage lcov [-o file] [-watch] [-tag key=value,...] profile.out|dir [profile.out|dir...]")
+	}
+	sel, err := selection()
+	if err != nil {
+		return err
+	}
+	if sel.facet != "" {
+		return errors.New("the lcov file is of a single group of profiles, -facet is not used")
+	}
+	path := *out
+	if path == "" {
+		if path, err = lcovPath(); err != nil {
+			return err
+		}
+	}
+	if !*watch {
+		files, err := updateLcov(path, fs.Args(), sel)
+		if err == nil {
+			fmt.Fprintf(stderr, "Wrote the coverage of %d files to %s\n", files, path)
+		}
+		return err
+	}
+
+	// The profiles can not be read while they are written, or before the
+	// first one lands, so the errors are reported, and the last file kept
+	fmt.Fprintf(stderr, "Watching the profiles, and writing their coverage to %s\n", path)
+	signature := ""
+	for ; ; time.Sleep(reportWatchInterval) {
+		current := profilesSignature(fs.Args())
+		if current == signature {
+			continue
+		}
+		// Retried when the profiles change again, if it fails
+		signature = current
+		files, err := updateLcov(path, fs.Args(), sel)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to write the lcov file. Error: %s\n", err.Error())
+			continue
+		}
+		fmt.Fprintf(stderr, "Wrote the coverage of %d files to %s, at %s\n", files, path, time.Now().Format(time.RFC1123))
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// LibraryOptions are the options of instrumenting through the instrument
+// package, which converts its Options into them, as the flags of the same
+// names. The zero values are the defaults of the flags.
+type LibraryOptions struct {
+	Packages        []string
+	Mode            string
+	Race            bool
+	Granularity     string
+	Sample          float64
+	Label           string
+	EnvPrefix       string
+	PerModule       bool
+	ExcludePkg      []string
+	IncludePkg      []string
+	ExcludeFile     []string
+	IncludeFile     []string
+	TotalPkg        []string
+	IncludeReplaced bool
+	Template        string
+	Output          string
+	Overlay         string
+	GOOS            string
+	GOARCH          string
+	Tags            []string
+	Dir             string
+	FlushOnSIGTERM  bool
+	ExitSignals     []string
+	FlushSignals    []string
+	DumpAddr        string
+	Serve           bool
+	ReportFormats   []string
+	OnConflict      string
+	Force           bool
+	Wait            bool
+	SkipTestCheck   bool
+	KeepTemp        bool
+	Jobs            int
+	Manifest        string
+	Verify          string
+	Backend         string
+	EmitPatch       string
+	Record          string
+	Replay          string
+	Stash           bool
+	HotProfile      string
+	HotThreshold    float64
+	HotAction       string
+	SystemdNotify   bool
+	FlushTrigger    string
+	LiveAddr        string
+	Expvar          bool
+	Pprof           bool
+	Rotate          string
+	SubcommandDepth int
+	MaxProfiles     int
+	MaxProfilesSize int64
+	Lock            bool
+	SyslogFallback  bool
+	MQTTBroker      string
+	MQTTTopic       string
+	Log             string
+	Persist         string
+	Compact         string
+	Diagnostics     io.Writer
+}
+
+// libraryNativeOptions are the LibraryOptions which apply to the native
+// backend, as nativeFlags are the flags.
+var libraryNativeOptions = map[string]bool{
+	"Packages":        true,
+	"Backend":         true,
+	"Mode":            true,
+	"Race":            true,
+	"ExcludePkg":      true,
+	"IncludePkg":      true,
+	"IncludeReplaced": true,
+	"GOOS":            true,
+	"GOARCH":          true,
+	"Tags":            true,
+	"Force":           true,
+	"Wait":            true,
+	"Diagnostics":     true,
+}
+
+// Instrument instruments the main packages given by o, as the instrument
+// subcommand, but for the configuration file, which is not read, and returns
+// them. The diagnostics are written to o.Diagnostics, unless it is nil.
+func Instrument(o LibraryOptions) ([]InstrumentedMain, error) {
+	if o.Diagnostics != nil {
+		defer func(w io.Writer) { stderr = w }(stderr)
+		stderr = o.Diagnostics
+	}
+	opts := options{
+		mode:              o.Mode,
+		race:              o.Race,
+		granularity:       o.Granularity,
+		sample:            o.Sample,
+		label:             o.Label,
+		envPrefix:         o.EnvPrefix,
+		perModule:         o.PerModule,
+		excludePkg:        strings.Join(o.ExcludePkg, ","),
+		includePkg:        strings.Join(o.IncludePkg, ","),
+		excludeFile:       strings.Join(o.ExcludeFile, ","),
+		includeFile:       strings.Join(o.IncludeFile, ","),
+		totalPkg:          strings.Join(o.TotalPkg, ","),
+		includeReplaced:   o.IncludeReplaced,
+		templateFile:      o.Template,
+		mainOutput:        o.Output,
+		overlay:           o.Overlay,
+		goos:              o.GOOS,
+		goarch:            o.GOARCH,
+		tags:              strings.Join(o.Tags, ","),
+		dir:               o.Dir,
+		flushOnSIGTERM:    o.FlushOnSIGTERM,
+		exitSignals:       strings.Join(o.ExitSignals, ","),
+		flushSignals:      strings.Join(o.FlushSignals, ","),
+		dumpAddr:          o.DumpAddr,
+		serve:             o.Serve,
+		reportFormats:     strings.Join(o.ReportFormats, ","),
+		onConflict:        o.OnConflict,
+		force:             o.Force,
+		allowInstrumented: o.Force,
+		wait:              o.Wait,
+		skipTestCheck:     o.SkipTestCheck,
+		keepTemp:          o.KeepTemp,
+		jobs:              o.Jobs,
+		manifest:          o.Manifest,
+		verify:            o.Verify,
+		backend:           o.Backend,
+		emitPatch:         o.EmitPatch,
+		record:            o.Record,
+		replay:            o.Replay,
+		stash:             o.Stash,
+		hotProfile:        o.HotProfile,
+		hotThreshold:      o.HotThreshold,
+		hotAction:         o.HotAction,
+		systemdNotify:     o.SystemdNotify,
+		flushTrigger:      o.FlushTrigger,
+		liveAddr:          o.LiveAddr,
+		expvar:            o.Expvar,
+		pprof:             o.Pprof,
+		rotate:            o.Rotate,
+		subcommandDepth:   o.SubcommandDepth,
+		maxProfiles:       o.MaxProfiles,
+		maxProfilesSize:   o.MaxProfilesSize,
+		lock:              o.Lock,
+		syslogFallback:    o.SyslogFallback,
+		mqttBroker:        o.MQTTBroker,
+		mqttTopic:         o.MQTTTopic,
+		logFile:           o.Log,
+		persist:           o.Persist,
+		compactMeta:       o.Compact,
+	}
+	if opts.hotThreshold == 0 {
+		opts.hotThreshold = 1
+	}
+	if opts.mqttTopic == "" {
+		opts.mqttTopic = "gobinarycoverage"
+	}
+	backend, err := resolveBackend(opts.buildContext(), opts.backend)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case backend == backendNative:
+		return libraryNative(o, opts)
+	case o.EmitPatch != "":
+		return emitPatch(o.Packages, o.EmitPatch, opts)
+	case o.Overlay != "":
+		return instrumentOverlay(o.Packages, o.Overlay, opts)
+	}
+	return instrumentPackages(o.Packages, opts)
+}
+
+// libraryNative returns the main packages given by o, with the flags of go
+// build building their coverage binaries natively, as nativeInstrument prints
+// them. Only libraryNativeOptions may be given.
+func libraryNative(o LibraryOptions, opts options) ([]InstrumentedMain, error) {
+	var unsupported []string
+	v := reflect.ValueOf(o)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if !libraryNativeOptions[name] && !v.Field(i).IsZero() {
+			unsupported = append(unsupported, name)
+		}
+	}
+	if len(unsupported) > 0 {
+		return nil, fmt.Errorf("%s can not be given with the native backend", strings.Join(unsupported, ", "))
+	}
+	patterns, err := readPackageArgs(o.Packages, os.Stdin)
+	if err == nil {
+		patterns, err = expandPackages(patterns, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(patterns) == 0 {
+		return nil, errors.New("no packages given")
+	}
+	var mains []InstrumentedMain
+	for _, mainPackage := range patterns {
+		main, err := getFilesInPackage(mainPackage, opts.buildContext())
+		if err != nil {
+			return nil, err
+		}
+		flags, err := nativeBuildFlags(mainPackage, opts)
+		if err != nil {
+			return nil, err
+		}
+		mains = append(mains, InstrumentedMain{Package: main.ImportPath, BuildFlags: flags})
+	}
+	return mains, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInstrumentNative(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"go.mod":          "module example.com/native\n\ngo 1.20\n",
+		"cmd/app/main.go": "package main\n\nimport \"example.com/native/lib\"\n\nfunc main() { lib.F() }\n",
+		"lib/lib.go":      "package lib\n\nfunc F() {}\n",
+	}
+	for name, src := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chdir(t, root)
+	tests := []struct {
+		name    string
+		goFlags string
+		opts    LibraryOptions
+		flags   []string
+		err     string
+	}{
+		{
+			name:  "default",
+			opts:  LibraryOptions{Packages: []string{"./cmd/app"}, Backend: backendNative},
+			flags: []string{"-cover", "-covermode=set", "-coverpkg=example.com/native/cmd/app,example.com/native/lib"},
+		},
+		{
+			name:  "race",
+			opts:  LibraryOptions{Packages: []string{"./cmd/app"}, Backend: backendNative, Race: true, Tags: []string{"a", "b"}},
+			flags: []string{"-cover", "-covermode=atomic", "-coverpkg=example.com/native/cmd/app,example.com/native/lib", "-race", "-tags=a,b"},
+		},
+		{
+			name:    "race in GOFLAGS",
+			goFlags: "-race",
+			opts:    LibraryOptions{Packages: []string{"./cmd/app"}, Backend: backendNative},
+			flags:   []string{"-cover", "-covermode=atomic", "-coverpkg=example.com/native/cmd/app,example.com/native/lib"},
+		},
+		{
+			name:  "excluded",
+			opts:  LibraryOptions{Packages: []string{"./cmd/app"}, Backend: backendNative, Mode: "count", ExcludePkg: []string{".../lib"}},
+			flags: []string{"-cover", "-covermode=count", "-coverpkg=example.com/native/cmd/app"},
+		},
+		{
+			name: "unsupported",
+			opts: LibraryOptions{Packages: []string{"./cmd/app"}, Backend: backendNative, Label: "app", Expvar: true},
+			err:  "Label, Expvar can not be given with the native backend",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("GOFLAGS", test.goFlags)
+			mains, err := Instrument(test.opts)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Instrument() error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(mains) != 1 || mains[0].Package != "example.com/native/cmd/app" {
+				t.Fatalf("Instrument() = %+v, want example.com/native/cmd/app", mains)
+			}
+			if !reflect.DeepEqual(mains[0].BuildFlags, test.flags) {
+				t.Errorf("the build flags are %q, want %q", mains[0].BuildFlags, test.flags)
+			}
+		})
+	}
+	// The tree is left untouched
+	for name, src := range files {
+		contents, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil || string(contents) != src {
+			t.Errorf("%s is changed: %v", name, err)
+		}
+	}
+}
+
+// TestInstrumentDiagnostics verifies that the warnings of the instrumentation
+// are written to LibraryOptions.Diagnostics, rather than to stderr.
+func TestInstrumentDiagnostics(t *testing.T) {
+	if testing.Short() {
+		t.Skip("instruments a module")
+	}
+	root := t.TempDir()
+	files := map[string]string{
+		"go.mod":     "module example.com/diag\n\ngo 1.20\n",
+		"main.go":    "package main\n\nimport \"example.com/diag/lib\"\n\nfunc main() { lib.F() }\n",
+		"lib/lib.go": "package lib\n\nfunc F() {\n\tgo func() {}()\n}\n",
+	}
+	for name, src := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chdir(t, root)
+	var diagnostics bytes.Buffer
+	mains, err := Instrument(LibraryOptions{Packages: []string{"."}, Force: true, SkipTestCheck: true, Diagnostics: &diagnostics})
+	if err != nil {
+		t.Fatalf("%s\n%s", err, diagnostics.String())
+	}
+	if len(mains) != 1 || mains[0].Package != "example.com/diag" {
+		t.Fatalf("Instrument() = %+v, want example.com/diag", mains)
+	}
+	if !strings.Contains(diagnostics.String(), "Warning: goroutines are started in example.com/diag/lib") {
+		t.Errorf("the warning is not in the diagnostics:\n%s", diagnostics.String())
+	}
+	if stderr != os.Stderr {
+		t.Error("the diagnostics are not written to stderr again")
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listCacheEnv is the environment variable holding the directory the results
+// of go list are cached in, or off, in order not to cache them. By default,
+// they are cached along with the build cache, in GOCACHE.
+const listCacheEnv = "GOBINARYCOVERAGE_CACHE"
+
+// listCacheVersion is bumped whenever the entries change, in order not to read
+// the ones of older versions
+const listCacheVersion = "1"
+
+// listCacheMaxAge is how long an entry is kept, after it was last used
+const listCacheMaxAge = 30 * 24 * time.Hour
+
+// listCachePrune removes the old entries, once per process
+var listCachePrune sync.Once
+
+// listCacheEntry is the output of a go list command, along with the
+// fingerprint of the directories it was listed from. The entry is only used
+// as long as the fingerprint of the directories is the same, i.e., no file in
+// them is added, removed, or modified.
+type listCacheEntry struct {
+	Dirs        []string `json:"dirs,omitempty"`
+	Tree        string   `json:"tree,omitempty"` // The root of the module, every directory in which is fingerprinted
+	Fingerprint string   `json:"fingerprint"`
+	Output      []byte   `json:"output"`
+}
+
+// listCacheDir returns the directory the results of go list are cached in,
+// or "" if they are not cached. Unless listCacheEnv is set, they are cached in
+// GOCACHE, so that overriding it, e.g., in hermetic CI, where the home
+// directory may not be writable, moves them along, and turning the build cache
+// off, with GOCACHE=off, turns them off as well. The user's cache directory is
+// used if GOCACHE is not known, as syncGoEnv is not run.
+func listCacheDir() string {
+	dir := os.Getenv(listCacheEnv)
+	switch {
+	case dir == "off":
+		return ""
+	case dir != "":
+		return dir
+	case goCache == "off":
+		return ""
+	case goCache != "":
+		return filepath.Join(goCache, "gobinarycoverage", "golist")
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cache, "gobinarycoverage", "golist")
+}
+
+// cachedGoList returns the output of go list, with the arguments given, when
+// run in the working directory, for the platform of the build context ctx.
+// The output is cached across the invocations, keyed by the arguments, the
+// environment, and the go command, for as long as the directories it was
+// listed from are unchanged, see fingerprintDirs. These are the directories of
+// the packages listed, as reported in their Dir, along with the root of the
+// main module, or, if tree is true, every directory in the main module, for
+// the commands whose output depends on all of them, such as the dependencies
+// of a package. Nothing is cached outside of a module, or in a workspace.
+func cachedGoList(ctx *build.Context, tree bool, args ...string) ([]byte, error) {
+	env := goEnv(ctx)
+	return cachedList(env, tree, args, func() ([]byte, error) {
+		return runCommand("", env, "go", append([]string{"list"}, args...)...)
+	})
+}
+
+// cachedList returns the output of list, which lists the packages, or the
+// modules, with the arguments args, in the environment env, as go list -json
+// does, from the cache, as cachedGoList does, or caches it.
+func cachedList(env []string, tree bool, args []string, list func() ([]byte, error)) ([]byte, error) {
+	dir := listCacheDir()
+	root := listCacheRoot()
+	if dir == "" || root == "" {
+		return list()
+	}
+	key, err := listCacheKey(env, args)
+	if err != nil {
+		return list()
+	}
+	path := filepath.Join(dir, key+".json")
+	if contents, err := os.ReadFile(path); err == nil {
+		e := &listCacheEntry{}
+		if json.Unmarshal(contents, e) == nil {
+			if fp, err := fingerprintDirs(e.Dirs, e.Tree); err == nil && fp == e.Fingerprint {
+				now := time.Now()
+				os.Chtimes(path, now, now)
+				return e.Output, nil
+			}
+		}
+	}
+
+	out, err := list()
+	if err != nil {
+		return nil, err
+	}
+	e := &listCacheEntry{Dirs: []string{root}, Output: out}
+	if tree {
+		e.Dirs, e.Tree = nil, root
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(out))
+		for {
+			var p struct{ Dir string }
+			if err := dec.Decode(&p); err != nil {
+				break
+			}
+			if p.Dir != "" {
+				e.Dirs = append(e.Dirs, p.Dir)
+			}
+		}
+	}
+	if e.Fingerprint, err = fingerprintDirs(e.Dirs, e.Tree); err != nil {
+		return out, nil
+	}
+	// The cache is only an optimization, so failing to write it is not an
+	// error
+	writeListCacheEntry(dir, path, e)
+	return out, nil
+}
+
+// writeListCacheEntry writes the entry e to the file at path, in the cache
+// directory dir, and removes the entries which have not been used for
+// listCacheMaxAge, once per process.
+func writeListCacheEntry(dir, path string, e *listCacheEntry) {
+	contents, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+	f, err := os.CreateTemp(dir, ".entry")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(contents)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || os.Rename(f.Name(), path) != nil {
+		os.Remove(f.Name())
+		return
+	}
+	listCachePrune.Do(func() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > listCacheMaxAge {
+				os.Remove(filepath.Join(dir, entry.Name()))
+			}
+		}
+	})
+}
+
+// listCacheKey returns the key of the output of go list with args, in the
+// environment env, from the working directory, the variables of env which the
+// go command reads, and the go command itself.
+func listCacheKey(env, args []string) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(goCmd)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "version %s\nwd %s\ngo %s %d %d\n", listCacheVersion, wd, goCmd, info.Size(), info.ModTime().UnixNano())
+	// The later values of a variable override the earlier ones
+	vars := make(map[string]string)
+	for _, kv := range env {
+		if k, v, ok := strings.Cut(kv, "="); ok && (strings.HasPrefix(k, "GO") || strings.HasPrefix(k, "CGO_") || k == "CC" || k == "CXX") {
+			vars[k] = v
+		}
+	}
+	names := make([]string, 0, len(vars))
+	for k := range vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(h, "env %s=%s\n", k, vars[k])
+	}
+	for _, arg := range args {
+		fmt.Fprintf(h, "arg %s\n", arg)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fingerprintDirs returns the fingerprint of the files in the directories
+// dirs, or, if tree is not "", in every directory in the module at tree, and
+// in the modules it replaces with local directories, but the ones the go
+// command ignores: the names of the files, and the contents of the
+// ones go list reads. The contents are hashed, rather than the modification
+// times compared, as restoring the tree, e.g., with git checkout, touches the
+// files.
+func fingerprintDirs(dirs []string, tree string) (string, error) {
+	if tree != "" {
+		dirs = nil
+		for _, root := range append([]string{tree}, localReplaceDirs(tree)...) {
+			err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !d.IsDir() {
+					return nil
+				}
+				name := d.Name()
+				if path != root && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata") {
+					return filepath.SkipDir
+				}
+				dirs = append(dirs, path)
+				return nil
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	h := sha256.New()
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "dir %s\n", dir)
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			name := entry.Name()
+			fmt.Fprintf(h, "%s\n", name)
+			if !strings.HasSuffix(name, ".go") && name != "go.mod" && name != "go.sum" && name != "modules.txt" {
+				continue
+			}
+			contents, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(h, "%d\n", len(contents))
+			h.Write(contents)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// localReplaceDirs returns the directories the module at root replaces
+// modules with in its go.mod, e.g. ../lib for
+//
+//	replace github.com/org/lib => ../lib
+func localReplaceDirs(root string) []string {
+	contents, err := os.ReadFile(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return nil
+	}
+	var dirs []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		_, target, ok := strings.Cut(line, "=>")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(target)
+		if len(fields) == 0 {
+			continue
+		}
+		dir := fields[0]
+		if dir == "." || dir == ".." || strings.HasPrefix(dir, "./") || strings.HasPrefix(dir, "../") {
+			dirs = append(dirs, filepath.Join(root, dir))
+		} else if filepath.IsAbs(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// listCacheRoot returns the root directory of the main module of the working
+// directory, or "" if it is not in a module, or it is in a workspace, whose
+// modules are not fingerprinted.
+func listCacheRoot() string {
+	if os.Getenv("GO111MODULE") == "off" {
+		return ""
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	root := ""
+	for {
+		if root == "" {
+			if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+				root = dir
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, "go.work")); err == nil && os.Getenv("GOWORK") != "off" {
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return root
+		}
+		dir = parent
+	}
+}
+
+// decodePackages decodes the stream of packages written by go list -json
+func decodePackages(out []byte) ([]*Package, error) {
+	var packages []*Package
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		p := &Package{}
+		if err := dec.Decode(p); err == io.EOF {
+			return packages, nil
+		} else if err != nil {
+			return nil, err
+		}
+		packages = append(packages, p)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// loadMode is what is loaded of the packages: their files, and module, and
+// the ones of their dependencies, without parsing, or type checking, them.
+const loadMode = packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps | packages.NeedModule
+
+// loadErrorKinds name the kinds of the errors loading the packages
+var loadErrorKinds = map[packages.ErrorKind]string{
+	packages.ListError:  "list",
+	packages.ParseError: "parse",
+	packages.TypeError:  "type",
+}
+
+// loadPackages loads the packages matching patterns, when built for the
+// platform of the build context ctx, through golang.org/x/tools/go/packages,
+// and returns them in the form of go list -e -json, with their dependencies
+// in Deps, and the errors loading these in DepsErrors. The packages are
+// cached as the output of go list is, see cachedGoList, with tree telling
+// whether they depend on every directory of the main module.
+func loadPackages(ctx *build.Context, tree bool, patterns ...string) ([]*Package, error) {
+	env := goEnv(ctx)
+	// The arguments only key the cache
+	args := append([]string{"-packages", strconv.Itoa(int(loadMode))}, patterns...)
+	out, err := cachedList(env, tree, args, func() ([]byte, error) {
+		loaded, err := packages.Load(&packages.Config{Mode: loadMode, Env: env}, patterns...)
+		if err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		enc := json.NewEncoder(&out)
+		for _, lp := range loaded {
+			if err = enc.Encode(fromLoaded(lp)); err != nil {
+				return nil, err
+			}
+		}
+		return out.Bytes(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decodePackages(out)
+}
+
+// fromLoaded returns the package lp, as loaded by go/packages, in the form of
+// go list -e -json. The files are named relative to the directory of the
+// package, the files using cgo are told apart from the rest, and the
+// dependencies are sorted, as go list does.
+func fromLoaded(lp *packages.Package) *Package {
+	p := &Package{Name: lp.Name, ImportPath: lp.PkgPath, Module: fromLoadedModule(lp.Module)}
+	for _, files := range [][]string{lp.GoFiles, lp.IgnoredFiles, lp.OtherFiles} {
+		if len(files) > 0 {
+			p.Dir = filepath.Dir(files[0])
+			break
+		}
+	}
+	for _, name := range lp.GoFiles {
+		if usesCgo(name) {
+			p.CgoFiles = append(p.CgoFiles, filepath.Base(name))
+		} else {
+			p.GoFiles = append(p.GoFiles, filepath.Base(name))
+		}
+	}
+	for _, name := range lp.IgnoredFiles {
+		if strings.HasSuffix(name, ".go") {
+			p.IgnoredGoFiles = append(p.IgnoredGoFiles, filepath.Base(name))
+		}
+	}
+	for _, name := range lp.OtherFiles {
+		if strings.HasSuffix(name, ".s") || strings.HasSuffix(name, ".S") {
+			p.SFiles = append(p.SFiles, filepath.Base(name))
+		}
+	}
+	for src, imported := range lp.Imports {
+		p.Imports = append(p.Imports, imported.PkgPath)
+		if src != imported.PkgPath {
+			if p.ImportMap == nil {
+				p.ImportMap = make(map[string]string)
+			}
+			p.ImportMap[src] = imported.PkgPath
+		}
+	}
+	sort.Strings(p.Imports)
+	errs := fromLoadedErrors(lp, nil)
+	if len(errs) > 0 {
+		p.Error, p.Errors = errs[0], errs[1:]
+	}
+
+	// The dependencies are walked breadth first, so that the import stack of
+	// the errors loading them is the shortest one
+	seen := map[*packages.Package]bool{lp: true}
+	type dep struct {
+		p     *packages.Package
+		stack []string
+	}
+	queue := []dep{{lp, []string{lp.PkgPath}}}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		paths := make([]string, 0, len(d.p.Imports))
+		for path := range d.p.Imports {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			imported := d.p.Imports[path]
+			if seen[imported] {
+				continue
+			}
+			seen[imported] = true
+			stack := append(append([]string(nil), d.stack...), imported.PkgPath)
+			p.Deps = append(p.Deps, imported.PkgPath)
+			p.DepsErrors = append(p.DepsErrors, fromLoadedErrors(imported, stack)...)
+			queue = append(queue, dep{imported, stack})
+		}
+	}
+	sort.Strings(p.Deps)
+	return p
+}
+
+// fromLoadedErrors returns the errors loading the package lp, imported
+// through the packages in stack
+func fromLoadedErrors(lp *packages.Package, stack []string) []*PackageError {
+	var errs []*PackageError
+	for _, e := range lp.Errors {
+		pos := e.Pos
+		if pos == "-" {
+			pos = ""
+		}
+		kind := loadErrorKinds[e.Kind]
+		if kind == "" {
+			kind = "unknown"
+		}
+		errs = append(errs, &PackageError{ImportStack: stack, Pos: pos, Err: e.Msg, Kind: kind})
+	}
+	return errs
+}
+
+// fromLoadedModule returns the module m, as loaded by go/packages, in the form
+// of go list -m -json
+func fromLoadedModule(m *packages.Module) *Module {
+	if m == nil {
+		return nil
+	}
+	return &Module{Path: m.Path, Version: m.Version, Dir: m.Dir, Main: m.Main, Replace: fromLoadedModule(m.Replace)}
+}
+
+// usesCgo returns true if the Go file at path imports "C", and thus is one of
+// the CgoFiles of go list
+func usesCgo(path string) bool {
+	f, err := parser.ParseFile(token.NewFileSet(), path, nil, parser.ImportsOnly)
+	if err != nil {
+		return false
+	}
+	for _, spec := range f.Imports {
+		if spec.Path.Value == `"C"` {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockFile is the lock taken, relative to the root of the main module, while
+// instrumenting, so that simultaneous runs in the same tree do not interleave
+// their file replacements.
+const lockFile = ".gobinarycoverage/lock"
+
+// lockPollInterval is how often a held lock is retried with -wait.
+const lockPollInterval = 500 * time.Millisecond
+
+// ErrLocked is returned when the tree is being instrumented by another process
+var ErrLocked = errors.New("the tree is locked by another gobinarycoverage process")
+
+// moduleRoot returns the root directory of the main module, or the working
+// directory if not in module mode.
+func moduleRoot(ctx *build.Context) (string, error) {
+	goMod, err := goEnvVar(ctx, "GOMOD")
+	if err != nil {
+		return "", err
+	}
+	if goMod == "" || goMod == os.DevNull {
+		return os.Getwd()
+	}
+	return filepath.Dir(goMod), nil
+}
+
+// acquireLock takes the lock in the root of the main module. If it is held by
+// another running process, it fails with ErrLocked, unless wait is true, in
+// which case it waits for the lock to be released. Locks left behind by
+// processes which are no longer running are taken over. The returned function
+// releases the lock.
+func acquireLock(ctx *build.Context, wait bool) (release func(), err error) {
+	root, err := moduleRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(root, lockFile)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	waiting := false
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d %s\n", os.Getpid(), time.Now().Format(time.RFC3339))
+			if err = f.Close(); err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		pid, started := readLock(path)
+		if pid > 0 && !processAlive(pid) {
+			fmt.Fprintf(stderr, "Removing the stale lock %s, left behind by pid %d, which is no longer running\n",
+				path, pid)
+			os.Remove(path)
+			continue
+		}
+		if !wait {
+			fmt.Fprintf(stderr, "Another gobinarycoverage process (pid %d, started %s) is instrumenting %s.\n"+
+				"Wait for it to finish, or rerun with -wait in order to queue behind it.\n"+
+				"If no such process is running, remove the lock: %s\n",
+				pid, started, root, path)
+			return nil, ErrLocked
+		}
+		if !waiting {
+			fmt.Fprintf(stderr, "Waiting for the gobinarycoverage process with pid %d to release the lock %s\n",
+				pid, path)
+			waiting = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// readLock returns the pid, and the start time, of the process holding the
+// lock. The pid is 0 if the lock can not be read, e.g., if it is in the middle
+// of being written.
+func readLock(path string) (pid int, started string) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return 0, "unknown"
+	}
+	fields := strings.Fields(string(contents))
+	if len(fields) != 2 {
+		return 0, "unknown"
+	}
+	pid, _ = strconv.Atoi(fields[0])
+	return pid, fields[1]
+}
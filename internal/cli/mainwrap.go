@@ -0,0 +1,194 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// coverMainName is the name the main function of the main file is renamed to,
+// in order to be run by the generated one, see wrapMain.
+const coverMainName = "coverMain"
+
+// routedExits are the functions of the standard library, by their package,
+// which exit without running the deferred functions, and the functions of the
+// runtime their uses in the main file are routed through, which write the
+// coverage before exiting the same way. The uses in the other files, and
+// packages, are left as they are, as the runtime in the main file can not be
+// called from them.
+var routedExits = map[string]map[string]string{
+	"os":  {"Exit": "coverExit"},
+	"log": {"Fatal": "coverLogFatal", "Fatalf": "coverLogFatalf", "Fatalln": "coverLogFatalln"},
+}
+
+// routedSignals are the functions of os/signal, whose uses in the main file
+// are routed through the runtime, when it writes the coverage on the exit
+// signals, see signal.go, so that it tells the signals the program handles
+// itself, and leaves it to exit on its own on them.
+var routedSignals = map[string]string{"Notify": "coverSignalNotify", "NotifyContext": "coverSignalNotifyContext"}
+
+// declaresMain returns true if the file f declares the main function.
+func declaresMain(f *ast.File) bool {
+	for _, decl := range f.Decls {
+		if d, ok := decl.(*ast.FuncDecl); ok && d.Recv == nil && d.Name.Name == "main" {
+			return true
+		}
+	}
+	return false
+}
+
+// findMainFile returns the path of the file of the main package p which
+// declares the main function, which the generated code is merged into. It is
+// main.go by convention, but need not be, e.g., cmd.go, in the main packages
+// split across several files. If none of the files built declares it, e.g.,
+// as main is declared by the file of another platform, main.go is, if the
+// package has one, and the first of its files otherwise.
+func findMainFile(p *Package) (string, error) {
+	files := append(append([]string(nil), p.GoFiles...), p.CgoFiles...)
+	if len(files) == 0 {
+		return "", fmt.Errorf("%s has no Go files", p.ImportPath)
+	}
+	sort.Strings(files)
+	// main.go is looked at first, as it is the one declaring main mostly
+	for i, name := range files {
+		if name == "main.go" {
+			files[0], files[i] = files[i], files[0]
+		}
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		f, err := parser.ParseFile(fset, filepath.Join(p.Dir, name), nil, parser.SkipObjectResolution)
+		if err != nil {
+			return "", err
+		}
+		if declaresMain(f) {
+			return filepath.Join(p.Dir, name), nil
+		}
+	}
+	return filepath.Join(p.Dir, files[0]), nil
+}
+
+// sourceEdit replaces the n bytes at offset in the source of the main file
+// with text.
+type sourceEdit struct {
+	offset int
+	n      int
+	text   string
+}
+
+// writeEdited writes src, from the offset start, to w, with the edits applied.
+// The edits are sorted by their offset, and do not overlap.
+func writeEdited(w io.Writer, src []byte, start int, edits []sourceEdit) error {
+	for _, e := range edits {
+		if e.offset < start {
+			continue
+		}
+		if _, err := w.Write(src[start:e.offset]); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, e.text); err != nil {
+			return err
+		}
+		start = e.offset + e.n
+	}
+	_, err := w.Write(src[start:])
+	return err
+}
+
+// wrapMain returns the edits of the source of the main file original, which
+// rename its main function to coverMainName, and route its uses of os.Exit,
+// and log.Fatal, through the runtime, see routedExits, and of signal.Notify,
+// if routeSignals is set, see routedSignals, along with the
+// generated main function, which runs the original one, and writes the
+// coverage as it returns, panics, or its goroutine exits through
+// runtime.Goexit. Nothing is returned, with a warning, if the main file has no
+// main function, or the name is taken in the package, given by mainNames, as
+// main is then left as it is. The functions of the runtime are referred to by
+// the names given in renamed, if they are renamed, see resolveConflicts.
+func wrapMain(fset *token.FileSet, original *ast.File, mainNames map[string]bool, renamed map[string]string, routeSignals bool) ([]sourceEdit, *ast.FuncDecl, error) {
+	runtimeName := func(name string) string {
+		if r, ok := renamed[name]; ok {
+			return r
+		}
+		return name
+	}
+	var main *ast.FuncDecl
+	for _, decl := range original.Decls {
+		if d, ok := decl.(*ast.FuncDecl); ok && d.Recv == nil && d.Name.Name == "main" {
+			main = d
+		}
+	}
+	if main == nil {
+		fmt.Fprintf(stderr, "Warning: no file of the main package declares the main function, so the coverage is only written by calling %s\n", runtimeName("coverReport"))
+		return nil, nil, nil
+	}
+	if mainNames[coverMainName] {
+		fmt.Fprintf(stderr, "Warning: %s is declared in the main package already, so the coverage is only written by calling %s\n", coverMainName, runtimeName("coverReport"))
+		return nil, nil, nil
+	}
+	file := fset.File(original.Package)
+	edits := []sourceEdit{{offset: file.Offset(main.Name.Pos()), n: len(main.Name.Name), text: coverMainName}}
+
+	// The uses of the exits are found by the name their package is imported
+	// as, unless the name is declared in the scope of the use, and thus refers
+	// to something else
+	for _, spec := range original.Imports {
+		p, _ := strconv.Unquote(spec.Path.Value)
+		routed, ok := routedExits[p]
+		if p == "os/signal" && routeSignals {
+			routed, ok = routedSignals, true
+		}
+		if !ok {
+			continue
+		}
+		name := path.Base(p)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		if name == "_" || name == "." {
+			continue
+		}
+		ast.Inspect(original, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+			if !ok || routed[sel.Sel.Name] == "" {
+				return true
+			}
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == name && x.Obj == nil {
+				edits = append(edits, sourceEdit{
+					offset: file.Offset(sel.Pos()),
+					n:      file.Offset(sel.End()) - file.Offset(sel.Pos()),
+					text:   runtimeName(routed[sel.Sel.Name]),
+				})
+			}
+			return true
+		})
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].offset < edits[j].offset })
+
+	src := "package main\n\nfunc main() {\n\tdefer " + runtimeName("coverMainReturned") + "()\n\t" + coverMainName + "()\n}\n"
+	f, err := parser.ParseFile(fset, "", src, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return edits, f.Decls[0].(*ast.FuncDecl), nil
+}
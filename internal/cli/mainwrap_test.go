@@ -0,0 +1,229 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// wrapRuntime declares the functions of the runtime which the wrapped main
+// file calls, referring to log, and os, by the names they have in the main
+// files of the tests, as resolveImports would
+const wrapRuntime = `package main
+
+func coverMainReturned()                {}
+func coverExit(code int)                { os.Exit(code) }
+func coverLogFatal(v ...any)            { log.Fatal(v...) }
+func coverLogFatalf(f string, v ...any) { log.Fatalf(f, v...) }
+func coverLogFatalln(v ...any)          { log.Fatalln(v...) }
+`
+
+func TestWrapMain(t *testing.T) {
+	tests := []struct {
+		name     string
+		main     string
+		contains []string
+		excludes []string
+	}{
+		{
+			name: "generics",
+			main: `package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+type Pair[K comparable, V any] struct {
+	Key K
+	Val V
+}
+
+func Keys[K comparable, V any](m map[K]V) []K {
+	var keys []K
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func main() {
+	p := Pair[string, int]{"a", 1}
+	fmt.Println(p, Keys(map[string]int{"a": 1}))
+	log.Print(os.Args)
+}
+`,
+			contains: []string{"func coverMain() {", "func Keys[K comparable, V any]"},
+		},
+		{
+			name: "exits",
+			main: `package main
+
+import (
+	"log"
+	"os"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		log.Fatalf("%s", os.Args[1])
+	}
+	os.Exit(2)
+}
+`,
+			contains: []string{"coverLogFatalf(\"%s\", os.Args[1])", "coverExit(2)"},
+			excludes: []string{"os.Exit(2)", "log.Fatalf(\"%s\""},
+		},
+		{
+			name: "shadowed package",
+			main: `package main
+
+import (
+	"log"
+	"os"
+)
+
+type exiter struct{}
+
+func (exiter) Exit(int) {}
+
+func main() {
+	log.Print(os.Args)
+	{
+		os := exiter{}
+		os.Exit(1)
+	}
+}
+`,
+			contains: []string{"os.Exit(1)"},
+			excludes: []string{"coverExit(1)"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fset := token.NewFileSet()
+			mainFile := filepath.Join(t.TempDir(), "main.go")
+			if err := os.WriteFile(mainFile, []byte(test.main), 0644); err != nil {
+				t.Fatal(err)
+			}
+			original, err := parser.ParseFile(fset, mainFile, nil, parser.ParseComments)
+			if err != nil {
+				t.Fatal(err)
+			}
+			generated, err := parser.ParseFile(fset, "generated.go", wrapRuntime, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			edits, wrapper, err := wrapMain(fset, original, nil, nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			generated.Decls = append(generated.Decls, wrapper)
+			var merged bytes.Buffer
+			if err = mergeASTTrees(fset, generated, original, edits, mainFile, false, &merged); err != nil {
+				t.Fatal(err)
+			}
+			fset = token.NewFileSet()
+			f, err := parser.ParseFile(fset, mainFile, merged.Bytes(), 0)
+			if err != nil {
+				t.Fatalf("the merged file does not parse: %s\n%s", err, merged.String())
+			}
+			// The generic code is type-checked, and so are the routed exits
+			conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+			if _, err = conf.Check("main", fset, []*ast.File{f}, nil); err != nil {
+				t.Fatalf("the merged file does not type-check: %s\n%s", err, merged.String())
+			}
+			body := merged.String()
+			for _, s := range test.contains {
+				if !strings.Contains(body, s) {
+					t.Errorf("%q not in\n%s", s, body)
+				}
+			}
+			for _, s := range test.excludes {
+				if strings.Contains(body, s) {
+					t.Errorf("%q in\n%s", s, body)
+				}
+			}
+		})
+	}
+}
+
+// TestMergeLineDirectives verifies that the merged main file holds the //line
+// directives naming the main file, and the merged file, only if asked to.
+func TestMergeLineDirectives(t *testing.T) {
+	const main = `package main
+
+import "os"
+
+func main() {
+	os.Exit(0)
+}
+`
+	for _, lineDirectives := range []bool{false, true} {
+		fset := token.NewFileSet()
+		mainFile := filepath.Join(t.TempDir(), "main.go")
+		if err := os.WriteFile(mainFile, []byte(main), 0644); err != nil {
+			t.Fatal(err)
+		}
+		original, err := parser.ParseFile(fset, mainFile, nil, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		generated, err := parser.ParseFile(fset, "generated.go", wrapRuntime, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		edits, wrapper, err := wrapMain(fset, original, nil, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		generated.Decls = append(generated.Decls, wrapper)
+		var merged bytes.Buffer
+		if err = mergeASTTrees(fset, generated, original, edits, mainFile, lineDirectives, &merged); err != nil {
+			t.Fatal(err)
+		}
+		body := merged.String()
+		if !lineDirectives {
+			if strings.Contains(body, "//line ") {
+				t.Errorf("a //line directive in\n%s", body)
+			}
+			continue
+		}
+		// The declarations after the imports start on line 5 of main.go, and
+		// the generated code on the line after its directive
+		for _, directive := range []string{"//line " + mainFile + ":4:1\n", "//line main.go:"} {
+			if !strings.Contains(body, directive) {
+				t.Errorf("%q not in\n%s", directive, body)
+			}
+		}
+		lines := strings.Split(body, "\n")
+		for i, line := range lines {
+			if strings.HasPrefix(line, "//line main.go:") && line != fmt.Sprintf("//line main.go:%d", i+2) {
+				t.Errorf("line %d is %q, expected it to give the next line %d", i+1, line, i+2)
+			}
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// instrumentManifest lists every file an instrumentation changes, written
+// with -manifest, so that the CI pipelines know what is instrumented without
+// parsing the messages, e.g., in order to archive the instrumented sources
+// along with the binaries, or to tell that they are the ones built.
+type instrumentManifest struct {
+	Tool  versionInfo    `json:"tool"`
+	Mains []manifestMain `json:"mains"`
+}
+
+// manifestMain is a main package instrumented
+type manifestMain struct {
+	Package  string         `json:"package"`
+	Root     string         `json:"root"`                // The root of the main module, which the paths are relative to
+	MainFile *manifestFile  `json:"main_file,omitempty"` // The merged main file, unless the main package is left as it is
+	Files    []manifestFile `json:"files"`               // The files instrumented, by package, and file
+	Skipped  []string       `json:"skipped,omitempty"`   // The packages without any code to cover, which are left as they are
+}
+
+// manifestFile is a file changed by the instrumentation
+type manifestFile struct {
+	Path    string `json:"path"` // Relative to the root of the main module, or absolute, if it is outside of it
+	Package string `json:"package,omitempty"`
+	Var     string `json:"var,omitempty"` // The GoCover variable of the file
+	SHA256  string `json:"sha256"`        // The hash of the file, as instrumented
+}
+
+// newManifestFile returns the file at path, in the main module at root, as
+// listed in the manifest, with the hash of its contents.
+func newManifestFile(path, root string) (manifestFile, error) {
+	hash, err := recordHash(path, "")
+	if err != nil {
+		return manifestFile{}, err
+	}
+	if rel, err := filepath.Rel(root, path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		path = filepath.ToSlash(rel)
+	}
+	return manifestFile{Path: path, SHA256: hash}, nil
+}
+
+// addManifest lists the main package mainPackage, of the main module at root,
+// instrumented as in cov, with its main file written to mainFile, if any, in
+// the manifest of the run.
+func (run *instrumentRun) addManifest(mainPackage, root, mainFile string, cov *Cover) error {
+	m := manifestMain{Package: mainPackage, Root: root, Files: []manifestFile{}}
+	if mainFile != "" {
+		f, err := newManifestFile(mainFile, root)
+		if err != nil {
+			return err
+		}
+		m.MainFile = &f
+	}
+	for _, ci := range cov.CoverInfo {
+		for _, cv := range ci.sortedVars() {
+			f, err := newManifestFile(cv.Path, root)
+			if err != nil {
+				return err
+			}
+			f.Package, f.Var = ci.Package, cv.Var
+			m.Files = append(m.Files, f)
+		}
+	}
+	for _, ci := range cov.Skipped {
+		m.Skipped = append(m.Skipped, ci.Package)
+	}
+	run.manifest.Mains = append(run.manifest.Mains, m)
+	return nil
+}
+
+// writeManifest writes the manifest m to path
+func writeManifest(path string, m *instrumentManifest) error {
+	contents, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(contents, '\n'), 0644)
+}
+
+// rebaseManifest moves the paths of the manifest at path, written by the
+// instrumentation of a copy of the main module at copyRoot, to the main module
+// at root, which the copy is of, e.g., with -overlay.
+func rebaseManifest(path, copyRoot, root string) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	m := &instrumentManifest{}
+	if err = json.Unmarshal(contents, m); err != nil {
+		return err
+	}
+	rebase := func(path string) string {
+		if path == copyRoot || strings.HasPrefix(path, copyRoot+string(filepath.Separator)) {
+			return root + strings.TrimPrefix(path, copyRoot)
+		}
+		return path
+	}
+	for i := range m.Mains {
+		main := &m.Mains[i]
+		main.Root = rebase(main.Root)
+		if main.MainFile != nil {
+			main.MainFile.Path = rebase(main.MainFile.Path)
+		}
+		for j := range main.Files {
+			main.Files[j].Path = rebase(main.Files[j].Path)
+		}
+	}
+	return writeManifest(path, m)
+}
+
+// The checks of -verify
+const (
+	verifyBuild = "build"
+	verifyVet   = "vet"
+)
+
+// compileError matches the errors of go build, and go vet, at a position in
+// the sources, e.g. "lib/lib.go:12:2: undefined: x"
+var compileError = regexp.MustCompile(`^(?:vet: )?(.+?\.go):(\d+)(?::\d+)?: `)
+
+// ErrVerifyFailed is returned when the instrumented packages do not build, or
+// pass go vet, with -verify
+var ErrVerifyFailed = errors.New("the instrumented packages do not pass the check")
+
+// verifyMains checks that the main packages instrumented, mains, and the
+// packages instrumented along with them, still build, or pass go vet, as
+// -verify is, and fails with ErrVerifyFailed, after reporting the errors,
+// unless they do.
+func verifyMains(mains []InstrumentedMain, opts options) error {
+	failed := 0
+	for _, m := range mains {
+		// The go command is run in the module of the main package
+		var dir string
+		packages := m.Packages
+		if m.MainFile != "" {
+			dir = filepath.Dir(m.MainFile)
+			// The main package is left as it is, when its main file is
+			// written elsewhere
+			if opts.mainOutput == "" {
+				packages = append([]string{m.Package}, packages...)
+			}
+		} else if len(m.Files) > 0 {
+			dir = filepath.Dir(m.Files[0])
+		}
+		if len(packages) == 0 {
+			continue
+		}
+		var report strings.Builder
+		n, err := verifyInstrumented(opts.verify, dir, packages, opts, &report)
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to verify the instrumentation of %s. Error: %s\n", m.Package, err.Error())
+			return err
+		}
+		if n > 0 {
+			failed++
+			fmt.Fprintf(stderr, "go %s fails on %s, or the packages instrumented along with it:\n%s",
+				opts.verify, m.Package, report.String())
+			continue
+		}
+		fmt.Fprintf(stderr, "Verified that %s, and the packages instrumented along with it, pass go %s\n", m.Package, opts.verify)
+	}
+	if failed > 0 {
+		return ErrVerifyFailed
+	}
+	return nil
+}
+
+// verifyInstrumented runs go build, or go vet, as check is, on the packages
+// instrumented, in the directory dir, and reports the errors to w, with the
+// lines of the sources they are on, so that a broken instrumentation fails the
+// pipeline at once, rather than at the build of the binaries, or the tests
+// after it. The errors are at the positions in the sources before the
+// instrumentation, as given by the //line directives. It returns the number of
+// the errors.
+func verifyInstrumented(check, dir string, packages []string, opts options, w io.Writer) (int, error) {
+	args := []string{check}
+	if opts.tags != "" {
+		args = append(args, "-tags="+strings.Join(splitTags(opts.tags), ","))
+	}
+	if check == verifyBuild {
+		// The binaries are thrown away
+		dir, err := ioutil.TempDir("", "gobinarycoverage-verify")
+		if err != nil {
+			return 0, err
+		}
+		defer os.RemoveAll(dir)
+		args = append(args, "-o", dir+string(filepath.Separator))
+	}
+	_, err := runCommand(dir, goEnv(opts.buildContext()), "go", append(args, packages...)...)
+	var cerr *commandError
+	if err == nil {
+		return 0, nil
+	} else if !errors.As(err, &cerr) || cerr.TimedOut {
+		return 0, err
+	}
+	errs := 0
+	for _, line := range strings.Split(cerr.Stderr, "\n") {
+		m := compileError.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		errs++
+		fmt.Fprintf(w, "  %s\n", strings.TrimPrefix(line, "vet: "))
+		file := m[1]
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		if n, err := strconv.Atoi(m[2]); err == nil {
+			if src, ok := directedSourceLine(file, n); ok {
+				fmt.Fprintf(w, "    %s\n", strings.TrimSpace(src))
+			}
+		}
+	}
+	if errs == 0 {
+		// E.g., a package which can not be loaded
+		fmt.Fprintf(w, "%s", cerr.Stderr)
+		errs = 1
+	}
+	return errs, nil
+}
+
+// directedSourceLine returns the line of the file at path, which its //line
+// directives give the line'th line of it, as in the positions the compiler
+// reports, e.g., in the merged main file, whose declarations keep the lines
+// they have in the main file, or the line'th line itself, if there are none.
+// The last such line is returned, as the imports of the generated code, which
+// are before the directives, take the lines of the declarations of the main
+// file.
+func directedSourceLine(path string, line int) (string, bool) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	file, n := abs, 1
+	found, ok := "", false
+	for _, text := range strings.Split(string(contents), "\n") {
+		if strings.HasPrefix(text, "//line ") {
+			// The filename may hold colons, which the line, and the column,
+			// do not
+			name := strings.TrimPrefix(text, "//line ")
+			var nums []int
+			for len(nums) < 2 {
+				i := strings.LastIndexByte(name, ':')
+				if i < 0 {
+					break
+				}
+				num, err := strconv.Atoi(name[i+1:])
+				if err != nil {
+					break
+				}
+				nums = append([]int{num}, nums...)
+				name = name[:i]
+			}
+			if len(nums) > 0 {
+				if !filepath.IsAbs(name) {
+					name = filepath.Join(filepath.Dir(abs), name)
+				}
+				file, n = filepath.Clean(name), nums[0]
+				continue
+			}
+		}
+		if file == abs && n == line {
+			found, ok = text, true
+		}
+		n++
+	}
+	return found, ok
+}
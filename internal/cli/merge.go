@@ -0,0 +1,149 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// mergeArgs returns the profiles given, leaving out the sidecars, and the
+// reports, of the ones given as well, as a glob like coverage* matches both the
+// profiles written by the binaries, and their sidecars, <profile>.json, which
+// are read along with them, and reports, see binaryReportFormats.
+func mergeArgs(args []string) []string {
+	given := make(map[string]bool, len(args))
+	for _, arg := range args {
+		given[arg] = true
+	}
+	var profiles []string
+	for _, arg := range args {
+		if isProfileCompanion(arg, given) {
+			continue
+		}
+		profiles = append(profiles, arg)
+	}
+	return profiles
+}
+
+// checkBlocksLineUp fails if the blocks of a file in the profile q are not the
+// ones of the same file in the profiles merged before it, whose blocks are in
+// blocks, by file, as the profiles are then written by binaries instrumented
+// from different sources, and their counts do not add up. It is checked even
+// if the builds of the profiles are not known.
+func checkBlocksLineUp(blocks map[string]map[profile.BlockKey]bool, q *profile.Profile) error {
+	own := make(map[string]map[profile.BlockKey]bool)
+	for _, b := range q.Blocks {
+		if own[b.File] == nil {
+			own[b.File] = make(map[profile.BlockKey]bool)
+		}
+		own[b.File][b.Key()] = true
+	}
+	for file, keys := range own {
+		seen, ok := blocks[file]
+		if !ok {
+			blocks[file] = keys
+			continue
+		}
+		if len(seen) != len(keys) {
+			return fmt.Errorf("%s has %d blocks, and %d in the profiles before it, "+
+				"are the profiles written by the same build?", file, len(keys), len(seen))
+		}
+		for key := range keys {
+			if !seen[key] {
+				return fmt.Errorf("%s has a block at %d.%d,%d.%d, which the profiles before it do not have, "+
+					"are the profiles written by the same build?", file, key.StartLine, key.StartCol, key.EndLine, key.EndCol)
+			}
+		}
+	}
+	return nil
+}
+
+// mergeUsage is the help of the merge subcommand.
+const mergeUsage = `
+   gobinarycoverage merge [-o merged.out] profile.out|dir [profile.out|dir...]
+
+       Merges the profiles given, and the ones in the directories given,
+       into one, written to stdout, or, along with its sidecar, to the file
+       given with -o. The counts of the blocks are added, or, in the set
+       mode, or'ed. The profiles must be of the same mode, and build, and
+       have the same blocks in the files they have in common, i.e., be
+       written by binaries of the same instrumented build. The sidecars
+       matched by a glob, e.g., coverage*, are skipped.
+`
+
+// mergeCommand merges the profiles given into one, as configured by the
+// arguments of the merge subcommand. The counts of the blocks are added, or,
+// in the set mode, or'ed, and the profiles must be of the same mode, and build,
+// see profile.Merge, with the same blocks in the files they have in common.
+func mergeCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, mergeUsage)
+	out := fs.String("o", "", "Write the merged profile, and its sidecar, to this file, instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: gobinarycoverage merge [-o merged.out] profile|dir [profile|dir...]")
+	}
+	paths, err := profilePaths(mergeArgs(fs.Args()))
+	if err != nil {
+		return err
+	}
+	merged := &profile.Profile{}
+	blocks := make(map[string]map[profile.BlockKey]bool)
+	for _, name := range paths {
+		p, err := profile.ParseFile(name)
+		if err == nil {
+			err = checkBuild(p.Build)
+		}
+		if err == nil {
+			err = checkBlocksLineUp(blocks, p)
+		}
+		if err == nil {
+			err = merged.Merge(p)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	if *out == "" {
+		return merged.Write(w)
+	}
+	// The profiles are read already, so the merged profile may be one of them
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err = merged.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if merged.Schema > 0 {
+		if err = merged.WriteSidecar(*out + ".json"); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(stderr, "merge: merged %d profiles into %s\n", len(paths), *out)
+	return nil
+}
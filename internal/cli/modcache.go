@@ -0,0 +1,205 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// modCacheCopyDir is the directory, relative to the root of the main module,
+// into which modules are copied out of the module cache. Directories starting
+// with a '.' are ignored by the go command when matching packages.
+const modCacheCopyDir = ".gobinarycoverage/modcache"
+
+// goEnvVar returns the value of the go environment variable name, as reported
+// by `go env`.
+func goEnvVar(ctx *build.Context, name string) (string, error) {
+	out, err := runCommand("", goEnv(ctx), "go", "env", name)
+	if err != nil {
+		fmt.Fprintf(stderr, "`go env %s` failed. Error: %s\n", name, err.Error())
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// listPackages lists the packages with the given import paths, as loaded by
+// loadPackages.
+func listPackages(ctx *build.Context, paths []string) ([]*Package, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	listed, err := loadPackages(ctx, false, paths...)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to load the packages %s. Error: %s\n", strings.Join(paths, " "), err.Error())
+		return nil, err
+	}
+	return listed, nil
+}
+
+// isInDir returns true if path is dir, or is located within it.
+func isInDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// copyOnWriteModules makes sure that none of the packages to be instrumented
+// are located in the module cache, which is read-only, so that rewriting them
+// in place would fail with permission errors halfway through the
+// instrumentation.
+//
+// The modules of the packages which are, are copied into modCacheCopyDir in the
+// main module, and replaced by the copies in go.mod, so that both the
+// instrumentation, and the build, use the writable copies instead.
+func copyOnWriteModules(ctx *build.Context, packages []string, backup *treeBackup) error {
+	modCache, err := goEnvVar(ctx, "GOMODCACHE")
+	if err != nil {
+		return err
+	}
+	goMod, err := goEnvVar(ctx, "GOMOD")
+	if err != nil {
+		return err
+	}
+	if modCache == "" || goMod == "" || goMod == os.DevNull {
+		// Not in module mode
+		return nil
+	}
+	resolvedModCache, err := filepath.EvalSymlinks(modCache)
+	if err != nil {
+		resolvedModCache = modCache
+	}
+	listed, err := listPackages(ctx, packages)
+	if err != nil {
+		return err
+	}
+	// The module cache may be reached through a symlink, e.g., to a cache
+	// mounted in CI, in which case the packages may be listed through either
+	inModCache := func(dir string) bool {
+		return isInDir(dir, modCache) || isInDir(dir, resolvedModCache)
+	}
+	copied := make(map[string]bool)
+	for _, p := range listed {
+		if !inModCache(p.Dir) || p.Module == nil || copied[p.Module.Path] {
+			continue
+		}
+		copied[p.Module.Path] = true
+		m := p.Module
+		if m.Replace != nil {
+			m = m.Replace
+		}
+		rel := filepath.Join(modCacheCopyDir, m.Path+"@"+m.Version)
+		dst := filepath.Join(filepath.Dir(goMod), rel)
+		fmt.Fprintf(stderr, "The package %s is located in the read-only module cache. "+
+			"Copying the module %s@%s to %s\n", p.ImportPath, m.Path, m.Version, dst)
+		if err = os.RemoveAll(dst); err != nil {
+			return err
+		}
+		if err = copyDir(m.Dir, dst); err != nil {
+			fmt.Fprintf(stderr, "Failed to copy the module %s. Error: %s\n", m.Path, err.Error())
+			return err
+		}
+		// Modules without a go.mod file have one synthesized by the go
+		// command, but a replacement directory needs a real one
+		if _, err = os.Stat(filepath.Join(dst, "go.mod")); os.IsNotExist(err) {
+			err = os.WriteFile(filepath.Join(dst, "go.mod"), []byte("module "+m.Path+"\n"), 0644)
+		}
+		if err != nil {
+			return err
+		}
+		if err = backup.save(goMod); err != nil {
+			return err
+		}
+		if _, err := runCommand(filepath.Dir(goMod), goEnv(ctx), "go", "mod", "edit",
+			"-replace="+p.Module.Path+"@"+p.Module.Version+"=./"+filepath.ToSlash(rel)); err != nil {
+			fmt.Fprintf(stderr, "Failed to replace the module %s with its copy. Error: %s\n",
+				p.Module.Path, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// inModuleCopy copies the main module of the build context ctx into dir, and
+// runs f in the copy, in the same directory as the working directory is in the
+// module. It returns the root of the module, and the working directory of f in
+// the copy.
+func inModuleCopy(dir string, ctx *build.Context, f func() error) (root, workdir string, err error) {
+	if root, err = moduleRoot(ctx); err != nil {
+		return "", "", err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", "", err
+	}
+	rel, err := filepath.Rel(root, wd)
+	if err != nil {
+		return "", "", err
+	}
+	if err = copyDir(root, dir); err != nil {
+		return "", "", fmt.Errorf("copy the module: %s", err.Error())
+	}
+	workdir = filepath.Join(dir, rel)
+	if err = os.Chdir(workdir); err != nil {
+		return "", "", err
+	}
+	err = f()
+	if cerr := os.Chdir(wd); err == nil {
+		err = cerr
+	}
+	return root, workdir, err
+}
+
+// copyDir copies the directory tree src to dst, but for the .git directories.
+// Everything copied is made writable by the owner, as the module cache is
+// read-only.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm()|0200)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"io"
+	"strings"
+)
+
+// Module is for use with `go list -m -json`
+type Module struct {
+	Path    string  // module path
+	Version string  // module version
+	Dir     string  // directory holding files for this module, if any
+	Main    bool    // is this the main module?
+	Replace *Module // replaced by this module
+}
+
+// listModules lists all the modules in the build list of the main module, as
+// reported by `go list -m -json all`.
+func listModules(ctx *build.Context) ([]*Module, error) {
+	out, err := cachedGoList(ctx, false, "-m", "-json", "all")
+	if err != nil {
+		fmt.Fprintf(stderr, "`go list -m -json all` failed. Error: %s\n", err.Error())
+		return nil, err
+	}
+	var modules []*Module
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		m := &Module{}
+		if err := dec.Decode(m); err == io.EOF {
+			return modules, nil
+		} else if err != nil {
+			return nil, err
+		}
+		modules = append(modules, m)
+	}
+}
+
+// listLocallyReplacedModules returns the paths of the modules which are
+// replaced by a local directory in go.mod, e.g.,
+//
+//	replace github.com/org/lib => ../lib
+//
+// These are first-party in practice, and their directories are writable, as
+// opposed to modules replaced by other module versions, which are in the
+// module cache.
+func listLocallyReplacedModules(ctx *build.Context) ([]string, error) {
+	modules, err := listModules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, m := range modules {
+		if m.Replace != nil && m.Replace.Version == "" {
+			paths = append(paths, m.Path)
+		}
+	}
+	return paths, nil
+}
+
+// inModule returns true if the package with the import path importPath belongs
+// to the module with the path modulePath.
+func inModule(importPath, modulePath string) bool {
+	return importPath == modulePath || strings.HasPrefix(importPath, modulePath+"/")
+}
@@ -0,0 +1,283 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// mqttKeepAlive is the keep alive of the connection of the collector to the
+// broker, in seconds, which is pinged at half of it.
+const mqttKeepAlive = 60
+
+// mqttMessage is the payload of the messages published by the binaries
+// instrumented with -mqtt-broker, see runtimesrc/mqtt.go.
+type mqttMessage struct {
+	Device  string            `json:"device"`
+	Module  string            `json:"module,omitempty"`
+	Label   string            `json:"label,omitempty"`
+	Build   string            `json:"build,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Format  string            `json:"format"`  // text, or compact
+	Profile []byte            `json:"profile"` // The contents of the profile file
+}
+
+// mqttSubscriber ingests the profiles published to a topic of an MQTT 3.1.1
+// broker into a collector.
+type mqttSubscriber struct {
+	broker   string
+	topic    string // The topic filter subscribed to, e.g., gobinarycoverage/#
+	username string
+	password string
+	meta     *compactMeta // Decodes the profiles in the compact format, if set
+}
+
+// run subscribes to the topic, and ingests the profiles published to it into
+// c, reconnecting whenever the connection is lost. It only returns if the
+// broker refuses the connection.
+func (s *mqttSubscriber) run(c *collector) error {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := s.subscribe(c)
+		var refused *mqttRefusedError
+		if errors.As(err, &refused) {
+			return err
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		fmt.Fprintf(stderr, "collect: lost the connection to the MQTT broker %s, reconnecting in %s. Error: %s\n",
+			s.broker, backoff, err.Error())
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// mqttRefusedError is returned when the broker refuses the connection
+type mqttRefusedError struct {
+	Code byte
+}
+
+func (e *mqttRefusedError) Error() string {
+	return fmt.Sprintf("the MQTT broker refused the connection, with the return code %d", e.Code)
+}
+
+// subscribe connects to the broker, subscribes to the topic, and ingests the
+// profiles published to it, until the connection is lost.
+func (s *mqttSubscriber) subscribe(c *collector) error {
+	conn, err := net.DialTimeout("tcp", s.broker, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var mu sync.Mutex // Serializes the writes of the pings, and the acknowledgements
+	write := func(header byte, body []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return mqttWrite(conn, header, body)
+	}
+
+	// CONNECT, with a clean session
+	flags := byte(0x02)
+	connect := mqttString(nil, "MQTT")
+	connect = append(connect, 4, 0, 0, mqttKeepAlive)
+	connect = mqttString(connect, fmt.Sprintf("gobinarycoverage-collect-%d", os.Getpid()))
+	if s.username != "" {
+		flags |= 0x80
+		connect = mqttString(connect, s.username)
+	}
+	if s.password != "" {
+		flags |= 0x40
+		connect = mqttString(connect, s.password)
+	}
+	connect[7] = flags
+	if err = write(0x10, connect); err != nil {
+		return err
+	}
+	header, body, err := mqttRead(r)
+	if err != nil {
+		return err
+	}
+	if header>>4 != 2 || len(body) != 2 {
+		return errors.New("unexpected response to CONNECT")
+	}
+	if body[1] != 0 {
+		return &mqttRefusedError{Code: body[1]}
+	}
+
+	// SUBSCRIBE, with QoS 1, and the packet identifier 1
+	subscribe := append([]byte{0, 1}, mqttString(nil, s.topic)...)
+	if err = write(0x82, append(subscribe, 1)); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "collect: subscribed to %s on the MQTT broker %s\n", s.topic, s.broker)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(mqttKeepAlive / 2 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// PINGREQ
+				if write(0xc0, nil) != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		header, body, err := mqttRead(r)
+		if err != nil {
+			return err
+		}
+		switch header >> 4 {
+		case 9: // SUBACK
+			if len(body) == 3 && body[2] == 0x80 {
+				return &mqttRefusedError{Code: body[2]}
+			}
+		case 3: // PUBLISH
+			if len(body) < 2 {
+				return errors.New("malformed PUBLISH")
+			}
+			n := int(binary.BigEndian.Uint16(body))
+			if len(body) < 2+n {
+				return errors.New("malformed PUBLISH")
+			}
+			topic, payload := string(body[2:2+n]), body[2+n:]
+			if qos := header >> 1 & 3; qos > 0 {
+				if len(payload) < 2 {
+					return errors.New("malformed PUBLISH")
+				}
+				id := payload[:2]
+				payload = payload[2:]
+				// PUBACK for QoS 1, and PUBREC for QoS 2
+				ack := byte(0x40)
+				if qos == 2 {
+					ack = 0x50
+				}
+				if err = write(ack, id); err != nil {
+					return err
+				}
+			}
+			s.ingest(c, topic, payload)
+		case 6: // PUBREL, completing QoS 2
+			if err = write(0x70, body); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ingest ingests the profile in the message payload, published on topic,
+// into c.
+func (s *mqttSubscriber) ingest(c *collector, topic string, payload []byte) {
+	msg := mqttMessage{}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		fmt.Fprintf(stderr, "collect: skipping the message on %s. Error: %s\n", topic, err.Error())
+		return
+	}
+	p, body, err := s.decode(&msg)
+	if err == nil {
+		err = checkModuleDir(msg.Module)
+	}
+	if err == nil {
+		err = checkBuild(msg.Build)
+	}
+	var name string
+	if err == nil {
+		p.Tags = msg.Tags
+		name, err = c.ingest(collectKey{msg.Module, msg.Build}, p, body)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "collect: skipping the profile of %s on %s. Error: %s\n", msg.Device, topic, err.Error())
+		return
+	}
+	fmt.Fprintf(stderr, "collect: received %s from %s, on %s\n", name, msg.Device, topic)
+}
+
+// decode returns the profile in msg, and its contents in the text format
+func (s *mqttSubscriber) decode(msg *mqttMessage) (*profile.Profile, []byte, error) {
+	switch msg.Format {
+	case "text":
+		p, err := profile.Parse(bytes.NewReader(msg.Profile))
+		return p, msg.Profile, err
+	case "compact":
+		if s.meta == nil {
+			return nil, nil, errors.New("the profile is in the compact format, give -meta in order to decode it")
+		}
+		p, err := decodeCompactProfile(bytes.NewReader(msg.Profile), s.meta)
+		if err != nil {
+			return nil, nil, err
+		}
+		var text bytes.Buffer
+		if err = p.Write(&text); err != nil {
+			return nil, nil, err
+		}
+		return p, text.Bytes(), nil
+	}
+	return nil, nil, fmt.Errorf("unknown format: %q", msg.Format)
+}
+
+// mqttString appends the length prefixed string s to b
+func mqttString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// mqttWrite writes the packet of type, and flags, header, with body
+func mqttWrite(w io.Writer, header byte, body []byte) error {
+	// The remaining length is encoded 7 bits at a time, as a uvarint
+	var length [binary.MaxVarintLen64]byte
+	packet := append([]byte{header}, length[:binary.PutUvarint(length[:], uint64(len(body)))]...)
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+// mqttRead reads a packet, and returns its header, and body
+func mqttRead(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
@@ -0,0 +1,282 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMQTTPacket(t *testing.T) {
+	tests := []struct {
+		size   int
+		length []byte // The remaining length, as encoded in the packet
+	}{
+		{size: 0, length: []byte{0x00}},
+		{size: 127, length: []byte{0x7f}},
+		{size: 128, length: []byte{0x80, 0x01}},
+		{size: 321, length: []byte{0xc1, 0x02}},
+		{size: 16383, length: []byte{0xff, 0x7f}},
+		{size: 16384, length: []byte{0x80, 0x80, 0x01}},
+		{size: 2097152, length: []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+	for _, test := range tests {
+		body := bytes.Repeat([]byte{'x'}, test.size)
+		var packet bytes.Buffer
+		if err := mqttWrite(&packet, 0x32, body); err != nil {
+			t.Fatal(err)
+		}
+		encoded := packet.Bytes()
+		if encoded[0] != 0x32 || !bytes.Equal(encoded[1:1+len(test.length)], test.length) {
+			t.Errorf("%d bytes: the packet starts with % x, expected 32 % x", test.size, encoded[:1+len(test.length)], test.length)
+		}
+		header, read, err := mqttRead(bufio.NewReader(&packet))
+		if err != nil {
+			t.Fatalf("%d bytes: %s", test.size, err)
+		}
+		if header != 0x32 || !bytes.Equal(read, body) {
+			t.Errorf("%d bytes: read the header %#x, and %d bytes", test.size, header, len(read))
+		}
+	}
+	if s := mqttString([]byte{1}, "MQTT"); !bytes.Equal(s, []byte{1, 0, 4, 'M', 'Q', 'T', 'T'}) {
+		t.Errorf("mqttString = % x", s)
+	}
+	// A truncated packet
+	if _, _, err := mqttRead(bufio.NewReader(bytes.NewReader([]byte{0x30, 0x05, 'a'}))); err == nil {
+		t.Error("expected an error reading a truncated packet")
+	}
+}
+
+// mqttBroker is a broker serving a single connection of the subscriber, as
+// scripted by the test, on the address it listens on.
+func mqttBroker(t *testing.T, serve func(r *bufio.Reader, conn net.Conn) error) (string, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		errs <- serve(bufio.NewReader(conn), conn)
+	}()
+	return l.Addr().String(), errs
+}
+
+func TestMQTTSubscribe(t *testing.T) {
+	c, err := newCollector(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func(conn net.Conn, topic string, id uint16, msg interface{}) error {
+		payload, ok := msg.([]byte)
+		if !ok {
+			if payload, err = json.Marshal(msg); err != nil {
+				return err
+			}
+		}
+		body := mqttString(nil, topic)
+		body = binary.BigEndian.AppendUint16(body, id)
+		return mqttWrite(conn, 0x32, append(body, payload...))
+	}
+	addr, errs := mqttBroker(t, func(r *bufio.Reader, conn net.Conn) error {
+		header, body, err := mqttRead(r)
+		if err != nil {
+			return err
+		}
+		// The protocol name, level 4, and the flags: a clean session, with
+		// the username, and the password
+		if header != 0x10 || !bytes.HasPrefix(body, []byte{0, 4, 'M', 'Q', 'T', 'T', 4, 0xc2}) ||
+			!bytes.HasSuffix(body, append(mqttString(nil, "user"), mqttString(nil, "secret")...)) {
+			return errors.New("unexpected CONNECT")
+		}
+		if err = mqttWrite(conn, 0x20, []byte{0, 0}); err != nil {
+			return err
+		}
+		header, body, err = mqttRead(r)
+		if err != nil {
+			return err
+		}
+		if header != 0x82 || !bytes.Equal(body, append(append([]byte{0, 1}, mqttString(nil, "gobinarycoverage/#")...), 1)) {
+			return errors.New("unexpected SUBSCRIBE")
+		}
+		if err = mqttWrite(conn, 0x90, []byte{0, 1, 1}); err != nil {
+			return err
+		}
+		messages := []interface{}{
+			mqttMessage{
+				Device:  "device-1",
+				Module:  "example.com/m",
+				Build:   "v1",
+				Tags:    map[string]string{"device": "rpi"},
+				Format:  "text",
+				Profile: []byte("mode: set\nexample.com/m/a.go:3.14,5.2 1 1\n"),
+			},
+			// Skipped, but acknowledged
+			[]byte("not json"),
+			mqttMessage{Device: "device-2", Format: "compact", Profile: []byte{1}},
+			mqttMessage{Device: "device-3", Module: "../m", Format: "text", Profile: []byte("mode: set\n")},
+		}
+		for i, msg := range messages {
+			id := uint16(i + 7)
+			if err = publish(conn, "gobinarycoverage/device", id, msg); err != nil {
+				return err
+			}
+			header, body, err = mqttRead(r)
+			if err != nil {
+				return err
+			}
+			if header != 0x40 || binary.BigEndian.Uint16(body) != id {
+				return errors.New("unexpected PUBACK")
+			}
+		}
+		return nil
+	})
+	s := &mqttSubscriber{broker: addr, topic: "gobinarycoverage/#", username: "user", password: "secret"}
+	// The broker closes the connection once it is done
+	if err = s.subscribe(c); err == nil {
+		t.Fatal("expected the connection to be lost")
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	summary := c.summary(collectKey{"example.com/m", "v1"})
+	if summary.Profiles != 1 || summary.Covered != 1 {
+		t.Errorf("merged %d profiles, covering %d blocks, expected 1, and 1", summary.Profiles, summary.Covered)
+	}
+	if len(c.modules) != 1 {
+		t.Errorf("merged the profiles of %d modules, and builds, expected 1", len(c.modules))
+	}
+	if tags := c.modules[collectKey{"example.com/m", "v1"}].merged.Tags; tags["device"] != "rpi" {
+		t.Errorf("merged the tags %v", tags)
+	}
+}
+
+func TestMQTTRefused(t *testing.T) {
+	addr, errs := mqttBroker(t, func(r *bufio.Reader, conn net.Conn) error {
+		if _, _, err := mqttRead(r); err != nil {
+			return err
+		}
+		// Not authorized
+		return mqttWrite(conn, 0x20, []byte{0, 5})
+	})
+	s := &mqttSubscriber{broker: addr, topic: "gobinarycoverage/#"}
+	err := s.subscribe(nil)
+	var refused *mqttRefusedError
+	if !errors.As(err, &refused) || refused.Code != 5 {
+		t.Errorf("subscribe: %v, expected the connection to be refused with 5", err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMQTTPublish runs a binary instrumented with -mqtt-broker, and verifies
+// that the profile it publishes, on the topic followed by its device, is the
+// one the collector ingests.
+func TestMQTTPublish(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds, and runs, an instrumented binary")
+	}
+	var topic string
+	var payload []byte
+	addr, errs := mqttBroker(t, func(r *bufio.Reader, conn net.Conn) error {
+		if header, _, err := mqttRead(r); err != nil || header != 0x10 {
+			return fmt.Errorf("unexpected CONNECT: %v", err)
+		}
+		if err := mqttWrite(conn, 0x20, []byte{0, 0}); err != nil {
+			return err
+		}
+		// PUBLISH, with QoS 1
+		header, body, err := mqttRead(r)
+		if err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(body))
+		if header != 0x32 || len(body) < 4+n {
+			return errors.New("unexpected PUBLISH")
+		}
+		topic, payload = string(body[2:2+n]), body[4+n:]
+		if err = mqttWrite(conn, 0x40, body[2+n:4+n]); err != nil {
+			return err
+		}
+		if header, _, err = mqttRead(r); err != nil || header != 0xe0 {
+			return fmt.Errorf("unexpected DISCONNECT: %v", err)
+		}
+		return nil
+	})
+
+	files := map[string]string{
+		"go.mod":     "module example.com/mqtt\n\ngo 1.18\n",
+		"main.go":    "package main\n\nimport \"example.com/mqtt/lib\"\n\nfunc main() {\n\tlib.Hello()\n}\n",
+		"lib/lib.go": "package lib\n\nfunc Hello() {\n\tprintln(\"hello\")\n}\n",
+	}
+	dir := t.TempDir()
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chdir(t, dir)
+	if err := instrument("example.com/mqtt", options{force: true, mqttBroker: addr, mqttTopic: "coverage/lab"}); err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(dir, "mqtt")
+	if _, err := runCommand(dir, nil, "go", "build", "-o", binary, "."); err != nil {
+		t.Fatal(err)
+	}
+	env := append(os.Environ(), "COVERAGE_FILEPATH="+dir, "COVERAGE_DEVICE_ID=device-1")
+	if _, err := runCommand(dir, env, binary); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the binary did not publish its profile")
+	}
+	if topic != "coverage/lab/device-1" {
+		t.Errorf("published on %s, expected coverage/lab/device-1", topic)
+	}
+	c, err := newCollector(filepath.Join(dir, "collected"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	(&mqttSubscriber{}).ingest(c, topic, payload)
+	if summary := c.summary(collectKey{"", ""}); summary.Profiles != 1 || summary.Covered != 1 {
+		t.Errorf("merged %d profiles, covering %d blocks, expected 1, and 1", summary.Profiles, summary.Covered)
+	}
+}
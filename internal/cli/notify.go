@@ -0,0 +1,98 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// notifyURLEnv is the environment variable holding the URL of the webhook
+// the summaries are posted to, unless one is given through -notify, so that
+// it does not end up in the logs of CI.
+const notifyURLEnv = "GOBINARYCOVERAGE_WEBHOOK_URL"
+
+// notifyTimeout is how long to wait for the webhook to accept a summary
+const notifyTimeout = 10 * time.Second
+
+// notification is the summary of a check, or a compare, posted to the
+// webhook. Text is the summary as a message, as shown by Slack, and
+// compatible webhooks, and the rest is for the ones which parse it.
+type notification struct {
+	Text      string   `json:"text"`
+	Command   string   `json:"command"`
+	Passed    bool     `json:"passed"`
+	Total     float64  `json:"total"`
+	Delta     *float64 `json:"delta,omitempty"`   // compare only
+	Failing   []string `json:"failing,omitempty"` // The packages, files, or teams below their threshold, or whose coverage dropped
+	ReportURL string   `json:"report_url,omitempty"`
+}
+
+// notifyFlags adds the -notify, and -report-url flags to fs. The function
+// returned posts a summary to the webhook, once fs is parsed, if one is given
+// through -notify, or GOBINARYCOVERAGE_WEBHOOK_URL. A failure to post it is
+// only warned about, so that it does not change the outcome of the command.
+func notifyFlags(fs *flag.FlagSet) func(n *notification) {
+	url := fs.String("notify", "", "Post a summary to this webhook, e.g. a Slack incoming webhook, overriding "+notifyURLEnv)
+	reportURL := fs.String("report-url", "", "The link to the full report, included in the summary")
+	return func(n *notification) {
+		if *url == "" {
+			*url = os.Getenv(notifyURLEnv)
+		}
+		if *url == "" {
+			return
+		}
+		n.ReportURL = *reportURL
+		if n.ReportURL != "" {
+			n.Text += "\nReport: " + n.ReportURL
+		}
+		if err := postNotification(*url, n); err != nil {
+			fmt.Fprintf(stderr, "Failed to post the summary to the webhook. Error: %s\n", err.Error())
+		}
+	}
+}
+
+// postNotification posts n to the webhook at url, as JSON
+func postNotification(url string, n *notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("the webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// notificationText returns the summary of the command, as a message
+func notificationText(command, outcome, details string, failing []string) string {
+	text := fmt.Sprintf("gobinarycoverage %s: %s, %s", command, outcome, details)
+	if len(failing) > 0 {
+		text += "\n" + strings.Join(failing, "\n")
+	}
+	return text
+}
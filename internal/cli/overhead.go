@@ -0,0 +1,189 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+// The estimated overhead of every block instrumented, in bytes. The GoCover
+// variable of a file holds the counter (an uint32), the position (three
+// uint32) and the number of statements (an uint16) of every block, in the
+// data of the binary, and the runtime copies the position of every block
+// into a coverBlock on the heap when the file is registered.
+const (
+	overheadDataBytes  = 4 + 3*4 + 2
+	overheadBlockBytes = 16
+	overheadFileBytes  = 128 // The registration of the file, and its entries in the maps of the runtime
+)
+
+// overheadCodeBytes is the estimated machine code incrementing a counter, per
+// mode. It is larger on the load/store architectures than on x86, and in the
+// atomic mode, which is a locked instruction, or a loop, instead of a store.
+var overheadCodeBytes = map[string]int64{
+	"set":    12,
+	"count":  12,
+	"atomic": 24,
+}
+
+// packageOverhead is the estimated overhead of the instrumentation of a package
+type packageOverhead struct {
+	Package    string `json:"package"`
+	Files      int    `json:"files"`
+	Blocks     int    `json:"blocks"`
+	Statements int    `json:"statements"`
+	RSS        int64  `json:"rss"`         // The added memory of the counters, and the blocks, in bytes
+	BinarySize int64  `json:"binary_size"` // The added size of the binary, in bytes
+}
+
+// estimateOverhead returns the estimated overhead of the instrumentation
+// described by meta, per package, the largest binary size growth first.
+func estimateOverhead(meta *compactMeta) []*packageOverhead {
+	code, ok := overheadCodeBytes[meta.Mode]
+	if !ok {
+		code = overheadCodeBytes["atomic"]
+	}
+	byPackage := make(map[string]*packageOverhead)
+	var packages []*packageOverhead
+	for _, file := range meta.Files {
+		pkg := path.Dir(file.Name)
+		o := byPackage[pkg]
+		if o == nil {
+			o = &packageOverhead{Package: pkg}
+			byPackage[pkg] = o
+			packages = append(packages, o)
+		}
+		blocks := int64(len(file.Blocks))
+		o.Files++
+		o.Blocks += len(file.Blocks)
+		for _, b := range file.Blocks {
+			o.Statements += b[4]
+		}
+		o.RSS += overheadFileBytes + blocks*(overheadDataBytes+overheadBlockBytes)
+		o.BinarySize += overheadFileBytes + int64(len(file.Name)) + blocks*(overheadDataBytes+code)
+	}
+	sort.SliceStable(packages, func(i, j int) bool { return packages[i].BinarySize > packages[j].BinarySize })
+	return packages
+}
+
+// overheadUsage is the help of the overhead subcommand.
+const overheadUsage = `
+   gobinarycoverage overhead [-mode mode] [-granularity block|func] [-sample percent] [-exclude-pkg patterns] [-json] package
+   gobinarycoverage overhead -meta meta.json [-json]
+
+       Estimates the memory, and the binary size, the instrumentation adds,
+       per package, largest first, so that the costly packages can be left
+       out with -exclude-pkg. The main package is instrumented in a copy of
+       the main module, as configured by -mode, -granularity, -sample and
+       -exclude-pkg, leaving the tree untouched, or the metadata of a
+       binary instrumented with -compact is read, with -meta.
+`
+
+// overheadCommand estimates the added memory, and binary size, of the
+// instrumentation, per package, from the metadata of the compact profiles,
+// as configured by the arguments of the overhead subcommand. Without -meta,
+// the main package is instrumented in a copy of the main module, so that the
+// tree is left untouched.
+func overheadCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("overhead", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, overheadUsage)
+	metaFile := fs.String("meta", "", "Estimate the overhead of the binary instrumented with -compact, from its metadata")
+	var opts options
+	fs.StringVar(&opts.mode, "mode", "", "The coverage mode: set, count or atomic")
+	fs.StringVar(&opts.granularity, "granularity", granularityBlock, "Instrument with a counter for every block, or for every function only: block or func")
+	fs.Float64Var(&opts.sample, "sample", 100, "The percentage of the blocks to instrument")
+	fs.StringVar(&opts.excludePkg, "exclude-pkg", "", "Do not instrument the packages matching these comma separated patterns")
+	asJSON := fs.Bool("json", false, "Write the estimate as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (*metaFile == "") == (fs.NArg() != 1) {
+		return errors.New("usage: gobinarycoverage overhead [-mode mode] [-granularity block|func] [-sample percent] [-exclude-pkg patterns] [-json] package\n" +
+			"       gobinarycoverage overhead -meta meta.json [-json]")
+	}
+
+	var meta *compactMeta
+	var err error
+	if *metaFile != "" {
+		meta, err = readCompactMeta(*metaFile)
+	} else {
+		meta, err = instrumentedMeta(fs.Arg(0), opts)
+	}
+	if err != nil {
+		return err
+	}
+	packages := estimateOverhead(meta)
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(packages)
+	}
+	return writeOverheadReport(w, meta.Mode, packages)
+}
+
+// instrumentedMeta instruments the main package mainPackage in a copy of the
+// main module, as configured by opts, and returns the metadata of the compact
+// profiles, which lists every block instrumented.
+func instrumentedMeta(mainPackage string, opts options) (*compactMeta, error) {
+	dir, err := ioutil.TempDir("", "gobinarycoverage-overhead")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	// The copy is thrown away, even if the module is in a git work tree
+	opts.force = true
+	opts.compactMeta = filepath.Join(dir, "meta.json")
+	_, _, err = inModuleCopy(filepath.Join(dir, "module"), opts.buildContext(), func() error {
+		return instrument(mainPackage, opts)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("instrument: %s", err.Error())
+	}
+	return readCompactMeta(opts.compactMeta)
+}
+
+// writeOverheadReport writes the estimated overhead of every package, and
+// their total, as a table.
+func writeOverheadReport(w io.Writer, mode string, packages []*packageOverhead) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "package\tfiles\tblocks\tstatements\trss\tbinary size")
+	total := &packageOverhead{Package: "total"}
+	for _, o := range packages {
+		total.Files += o.Files
+		total.Blocks += o.Blocks
+		total.Statements += o.Statements
+		total.RSS += o.RSS
+		total.BinarySize += o.BinarySize
+	}
+	for _, o := range append(packages, total) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t+%s\t+%s\n",
+			o.Package, o.Files, o.Blocks, o.Statements, formatBytes(o.RSS), formatBytes(o.BinarySize))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\nEstimated for the %s mode, without the runtime, which adds a fixed amount; see bench for the measured overhead.\n", mode)
+	return err
+}
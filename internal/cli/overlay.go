@@ -0,0 +1,117 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// overlayFile is the name of the overlay file written into the -overlay
+// directory
+const overlayFile = "overlay.json"
+
+// overlay is the file read by go build -overlay. The files at the paths of
+// Replace are replaced with the ones they map to, or removed if they map to
+// "", and added if they do not exist.
+type overlay struct {
+	Replace map[string]string
+}
+
+// instrumentOverlay instruments the main packages given by args in a copy of
+// the main module, as emitPatch does, and writes every file changed into the
+// directory dir, at its path relative to the root of the main module, along
+// with the overlay file of go build -overlay, which maps the files of the tree
+// to them. The tree is left untouched, and the binaries are built with go build
+// -overlay dir/overlay.json. The main packages instrumented are returned, with
+// the paths of the files in the tree.
+func instrumentOverlay(args []string, dir string, opts options) ([]InstrumentedMain, error) {
+	if opts.mainOutput != "" || opts.emitPatch != "" {
+		err := errors.New("-overlay writes the main file into the overlay, and cannot be combined with -o, or -emit-patch")
+		fmt.Fprintf(stderr, "Failed to instrument. Error: %s\n", err.Error())
+		return nil, err
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	var root, copyRoot string
+	var changes []changedFile
+	mains, err := inInstrumentedCopy(args, opts, "gobinarycoverage-overlay", func(r, c string) (err error) {
+		root, copyRoot = r, c
+		changes, err = changedFiles(root, copyRoot)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = writeOverlay(dir, root, changes); err != nil {
+		fmt.Fprintf(stderr, "Failed to write the overlay. Error: %s\n", err.Error())
+		return nil, err
+	}
+	fmt.Fprintf(stderr, "Wrote the overlay of %d files to: %s, build with: go build -overlay %s\n",
+		len(changes), dir, filepath.Join(dir, overlayFile))
+
+	return mainsInTree(mains, root, copyRoot), nil
+}
+
+// mainsInTree returns the main packages instrumented in the copy of the main
+// module at copyRoot, with the paths of their files moved to the main module
+// at root.
+func mainsInTree(mains []InstrumentedMain, root, copyRoot string) []InstrumentedMain {
+	for i := range mains {
+		m := &mains[i]
+		if m.MainFile != "" {
+			m.MainFile = strings.Replace(m.MainFile, copyRoot, root, 1)
+		}
+		for j, file := range m.Files {
+			m.Files[j] = strings.Replace(file, copyRoot, root, 1)
+		}
+	}
+	return mains
+}
+
+// writeOverlay writes the files changed in the main module at root into the
+// directory dir, and the overlay file mapping them.
+func writeOverlay(dir, root string, changes []changedFile) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	ov := overlay{Replace: make(map[string]string)}
+	for _, c := range changes {
+		path := filepath.Join(root, filepath.FromSlash(c.path))
+		if !c.exists {
+			ov.Replace[path] = ""
+			continue
+		}
+		shadow := filepath.Join(dir, filepath.FromSlash(c.path))
+		if err := os.MkdirAll(filepath.Dir(shadow), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(shadow, c.after, 0644); err != nil {
+			return err
+		}
+		ov.Replace[path] = shadow
+	}
+	data, err := json.MarshalIndent(ov, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, overlayFile), append(data, '\n'), 0644)
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// coverJob is the instrumentation of a file into the temporary directory, by
+// coverBlocks, or coverFuncs, with its GoCover variable, which is named
+// before, so that the numbering does not depend on the order the jobs finish
+// in. The jobs of all the packages instrumented run concurrently, see
+// runCoverJobs, while the files are only replaced after all of them are done.
+type coverJob struct {
+	fname      string // The file instrumented
+	tname      string // The file instrumented into, in the temporary directory
+	rname      string // The name of the file, by the import path of its package, in the profiles
+	importPath string
+	varName    string
+
+	// The outcome of the job
+	hot    []string // The hot functions of the file, see hotBlocks
+	kept   int      // The blocks kept, when sampling
+	total  int      // The blocks of the file, when sampling
+	failed string   // What failed, along with err
+	err    error
+}
+
+// run instruments the file of the job, in the mode, and at the granularity,
+// given, and keeps the counters out of the hot functions, and the blocks not
+// sampled, if asked to.
+func (j *coverJob) run(mode, granularity string, sample float64, hot *hotFunctions) {
+	if granularity == granularityFunc {
+		if j.err = coverFuncs(j.fname, j.tname, mode, j.varName); j.err != nil {
+			j.failed = "Failed to instrument the functions of " + j.fname
+			return
+		}
+	} else if j.err = coverBlocks(j.fname, j.tname, mode, j.varName); j.err != nil {
+		j.failed = "Failed to instrument the blocks of " + j.fname
+		return
+	}
+	if hot != nil {
+		if j.hot, j.err = hotBlocks(j.tname, j.fname, j.importPath, j.varName, hot); j.err != nil {
+			j.failed = "Failed to keep the counters out of the hot functions of " + j.fname
+			return
+		}
+	}
+	if sample < 100 {
+		if j.kept, j.total, j.err = sampleBlocks(j.tname, j.rname, j.varName, sample); j.err != nil {
+			j.failed = "Failed to sample the blocks of " + j.fname
+		}
+	}
+}
+
+// coverJobs returns the number of the jobs run at once, given by -j, or
+// GOMAXPROCS, if it is not.
+func coverJobs(n int) int {
+	if n > 0 {
+		return n
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// runCoverJobs runs the jobs, n at once, and returns the error of the first
+// of them which fails, in their order, after writing what failed to stderr.
+// The jobs not started yet are left out as one fails.
+func runCoverJobs(jobs []*coverJob, n int, mode, granularity string, sample float64, hot *hotFunctions) error {
+	var failed int32
+	queue := make(chan *coverJob)
+	var wg sync.WaitGroup
+	for i := 0; i < coverJobs(n) && i < len(jobs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				if atomic.LoadInt32(&failed) != 0 {
+					continue
+				}
+				if j.run(mode, granularity, sample, hot); j.err != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	for _, j := range jobs {
+		queue <- j
+	}
+	close(queue)
+	wg.Wait()
+	for _, j := range jobs {
+		if j.err != nil {
+			fmt.Fprintf(stderr, "%s. Error: %s\n", j.failed, j.err.Error())
+			return j.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,495 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// emitPatch instruments the main packages given by args, as instrumentPackages
+// does, but in a copy of the main module, and writes every change made to the
+// copy as a unified diff to the file out, or to stdout if it is -, leaving the
+// tree untouched, and returns the main packages instrumented, with the paths
+// of the files in the tree. The paths in the diff are relative to the root of
+// the main module, prefixed by a/ and b/, so that it applies with git apply, or
+// patch -p1, in it, or with the apply subcommand, which verifies the manifest
+// of it as well, see writePatch.
+func emitPatch(args []string, out string, opts options) (mains []InstrumentedMain, err error) {
+	var root, copyRoot string
+	var changes []changedFile
+	mains, err = inInstrumentedCopy(args, opts, "gobinarycoverage-patch", func(r, c string) (err error) {
+		root, copyRoot = r, c
+		changes, err = changedFiles(root, copyRoot)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if out != "-" {
+		if f, err = os.Create(out); err != nil {
+			fmt.Fprintf(stderr, "Failed to create the patch file. Error: %s\n", err.Error())
+			return nil, err
+		}
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	err = writePatch(bw, changes)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if f != nil {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to write the patch. Error: %s\n", err.Error())
+		return nil, err
+	}
+	if out != "-" {
+		fmt.Fprintf(stderr, "Wrote the changes to %d files to the patch: %s\n", len(changes), out)
+	}
+	return mainsInTree(mains, root, copyRoot), nil
+}
+
+// inInstrumentedCopy instruments the main packages given by args, as
+// instrumentPackages does, but in a temporary copy of the main module, named by
+// prefix, and calls f with the roots of the main module, and of the copy,
+// before the copy is removed. The tree is left untouched.
+func inInstrumentedCopy(args []string, opts options, prefix string, f func(root, copyRoot string) error) ([]InstrumentedMain, error) {
+	// The packages are read before changing to the copy, as they are given
+	// relative to the working directory
+	patterns, err := readPackageArgs(args, os.Stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read the packages to instrument. Error: %s\n", err.Error())
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	// The decisions are recorded, and replayed, and the manifest written,
+	// outside of the copy
+	for _, path := range []*string{&opts.record, &opts.replay, &opts.manifest} {
+		if *path != "" {
+			if *path, err = filepath.Abs(*path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// The copy is thrown away, even if the module is in a git work tree
+	opts.force, opts.stash = true, false
+	var mains []InstrumentedMain
+	copyRoot := filepath.Join(dir, "module")
+	root, _, err := inModuleCopy(copyRoot, opts.buildContext(), func() (err error) {
+		mains, err = instrumentPackages(patterns, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opts.manifest != "" {
+		if err = rebaseManifest(opts.manifest, copyRoot, root); err != nil {
+			fmt.Fprintf(stderr, "Failed to write the manifest. Error: %s\n", err.Error())
+			return nil, err
+		}
+	}
+	return mains, f(root, copyRoot)
+}
+
+// patchHeader is the first line of the patches written by -emit-patch
+const patchHeader = "# gobinarycoverage patch, apply with: gobinarycoverage apply <patch>"
+
+// patchNoFile is the hash in the manifest of a patch of a file which does not
+// exist
+const patchNoFile = "-"
+
+// changedFile is a file changed by the instrumentation
+type changedFile struct {
+	path          string // The path, relative to the root of the main module, with forward slashes
+	before, after []byte // The contents of the file before, and after the change
+	existed       bool   // The file existed before the change
+	exists        bool   // The file exists after the change
+}
+
+// fileHash returns the hash of the contents of a file in the manifest of a
+// patch, or patchNoFile if the file does not exist.
+func fileHash(contents []byte, exists bool) string {
+	if !exists {
+		return patchNoFile
+	}
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
+}
+
+// changedFiles returns the files which differ between the directory trees
+// oldRoot and newRoot, but for the .git directories, and the backup of the
+// instrumentation, sorted by their path. The paths of newRoot in the files in
+// it, such as the ones of the //line directives of go tool cover, are replaced
+// with the ones of oldRoot, as if the files had been changed in place.
+func changedFiles(oldRoot, newRoot string) ([]changedFile, error) {
+	paths := make(map[string]bool)
+	for _, root := range []string{oldRoot, newRoot} {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			// The backup of the copy is thrown away with it
+			if info.IsDir() && filepath.ToSlash(rel) == backupDir {
+				return filepath.SkipDir
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			paths[filepath.ToSlash(rel)] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	var changes []changedFile
+	for _, path := range sorted {
+		c := changedFile{path: path, existed: true, exists: true}
+		var err error
+		c.before, err = os.ReadFile(filepath.Join(oldRoot, filepath.FromSlash(path)))
+		if os.IsNotExist(err) {
+			c.existed, err = false, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.after, err = os.ReadFile(filepath.Join(newRoot, filepath.FromSlash(path)))
+		if os.IsNotExist(err) {
+			c.exists, err = false, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.after = bytes.ReplaceAll(c.after, []byte(newRoot), []byte(oldRoot))
+		if c.existed == c.exists && bytes.Equal(c.before, c.after) {
+			continue
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// writePatch writes the unified diffs of the changes, preceded by the
+// manifest of them: the sha256 of every file changed, before and after the
+// change, or - if it does not exist, on comment lines, which git apply, and
+// patch, skip.
+func writePatch(w io.Writer, changes []changedFile) error {
+	fmt.Fprintln(w, patchHeader)
+	for _, c := range changes {
+		fmt.Fprintf(w, "# sha256 %s %s %s\n", fileHash(c.before, c.existed), fileHash(c.after, c.exists), c.path)
+	}
+	for _, c := range changes {
+		oldName, newName := "a/"+c.path, "b/"+c.path
+		if !c.existed {
+			oldName = "/dev/null"
+		}
+		if !c.exists {
+			newName = "/dev/null"
+		}
+		if err := writeUnifiedDiff(w, oldName, newName, c.before, c.after); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patchedFile is a file in a patch, as read by readPatch
+type patchedFile struct {
+	path          string
+	before, after string // The hashes of the file in the manifest
+	hunks         []patchHunk
+}
+
+// patchHunk is a hunk of the unified diff of a file
+type patchHunk struct {
+	oldStart, oldLines int
+	newLines           int
+	ops                []diffOp
+}
+
+// patchHunkHeader matches the header of a hunk, e.g., @@ -1,9 +1,27 @@
+var patchHunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+\d+(?:,(\d+))? @@`)
+
+// readPatch reads a patch written by -emit-patch, and returns the files in
+// it, in the order of the manifest.
+func readPatch(r io.Reader) ([]*patchedFile, error) {
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	lines := splitLines(contents)
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != patchHeader {
+		return nil, errors.New("not a patch written by gobinarycoverage -emit-patch")
+	}
+	var files []*patchedFile
+	byPath := make(map[string]*patchedFile)
+	var file *patchedFile
+	var hunk *patchHunk
+	// The lines of the hunk yet to be read, which are told apart from the
+	// headers by their number only, as they can start alike
+	oldLeft, newLeft := 0, 0
+	for i := 1; i < len(lines); i++ {
+		line := lines[i]
+		text := strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(text, "\\"):
+			// No newline at end of file, in the preceding line
+			if hunk == nil || len(hunk.ops) == 0 {
+				return nil, fmt.Errorf("line %d: misplaced %q", i+1, text)
+			}
+			op := &hunk.ops[len(hunk.ops)-1]
+			op.line = strings.TrimSuffix(op.line, "\n")
+		case oldLeft > 0 || newLeft > 0:
+			if line == "" || !strings.ContainsRune(" -+", rune(line[0])) {
+				return nil, fmt.Errorf("line %d: the hunk is truncated", i+1)
+			}
+			op := diffOp{line[0], line[1:]}
+			if op.kind != '+' {
+				oldLeft--
+			}
+			if op.kind != '-' {
+				newLeft--
+			}
+			if oldLeft < 0 || newLeft < 0 {
+				return nil, fmt.Errorf("line %d: the hunk is longer than its header says", i+1)
+			}
+			hunk.ops = append(hunk.ops, op)
+		case strings.HasPrefix(text, "# sha256 "):
+			fields := strings.Fields(text)
+			if len(fields) != 5 {
+				return nil, fmt.Errorf("line %d: malformed manifest entry", i+1)
+			}
+			f := &patchedFile{path: fields[4], before: fields[2], after: fields[3]}
+			files = append(files, f)
+			byPath[f.path] = f
+		case strings.HasPrefix(text, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			// A removed file is named by the old name only
+			name := strings.TrimPrefix(strings.TrimSuffix(lines[i+1], "\n"), "+++ ")
+			if name == "/dev/null" {
+				name = strings.TrimPrefix(text, "--- ")
+			}
+			name = strings.TrimPrefix(strings.TrimPrefix(name, "a/"), "b/")
+			if file = byPath[name]; file == nil {
+				return nil, fmt.Errorf("line %d: %s is not in the manifest", i+1, name)
+			}
+			hunk = nil
+			i++
+		case patchHunkHeader.MatchString(text):
+			if file == nil {
+				return nil, fmt.Errorf("line %d: hunk outside of a file", i+1)
+			}
+			m := patchHunkHeader.FindStringSubmatch(text)
+			h := patchHunk{oldLines: 1, newLines: 1}
+			h.oldStart, _ = strconv.Atoi(m[1])
+			if m[2] != "" {
+				h.oldLines, _ = strconv.Atoi(m[2])
+			}
+			if m[3] != "" {
+				h.newLines, _ = strconv.Atoi(m[3])
+			}
+			file.hunks = append(file.hunks, h)
+			hunk = &file.hunks[len(file.hunks)-1]
+			oldLeft, newLeft = h.oldLines, h.newLines
+		case strings.HasPrefix(text, "#") || text == "":
+		default:
+			return nil, fmt.Errorf("line %d: unexpected %q", i+1, text)
+		}
+	}
+	if oldLeft > 0 || newLeft > 0 {
+		return nil, errors.New("the last hunk is truncated")
+	}
+	return files, nil
+}
+
+// applyHunks applies the hunks to the lines of a file, and returns the
+// contents of the file patched. The hunks have to apply exactly, at the lines
+// they are at.
+func applyHunks(contents []byte, hunks []patchHunk) ([]byte, error) {
+	lines := splitLines(contents)
+	var out bytes.Buffer
+	pos := 0
+	for _, h := range hunks {
+		start := h.oldStart - 1
+		if h.oldLines == 0 {
+			// An empty range is the line before it
+			start = h.oldStart
+		}
+		if start < pos || start > len(lines) {
+			return nil, fmt.Errorf("the hunk at line %d is out of order, or beyond the end of the file", h.oldStart)
+		}
+		for _, line := range lines[pos:start] {
+			out.WriteString(line)
+		}
+		pos = start
+		for _, op := range h.ops {
+			if op.kind == '+' {
+				out.WriteString(op.line)
+				continue
+			}
+			if pos >= len(lines) || lines[pos] != op.line {
+				return nil, fmt.Errorf("the hunk at line %d does not match the file at line %d", h.oldStart, pos+1)
+			}
+			if op.kind == ' ' {
+				out.WriteString(op.line)
+			}
+			pos++
+		}
+	}
+	for _, line := range lines[pos:] {
+		out.WriteString(line)
+	}
+	return out.Bytes(), nil
+}
+
+// applyUsage is the help of the apply subcommand.
+const applyUsage = `
+   gobinarycoverage apply patch.diff
+
+       Applies a patch written by -emit-patch, or read from stdin if it is
+       -, to the main module. The sha256 of every file in it, before and
+       after the change, is recorded in the patch, and every file has to
+       match them, so that the instrumentation computed on one machine is
+       reproduced exactly on another, e.g., the build machine, or nothing
+       is changed.
+`
+
+// applyCommand applies a patch written by -emit-patch to the main module, as
+// configured by the arguments of the apply subcommand. Every file in the patch
+// has to be as it was when the patch was written, and be as it was in the
+// instrumented copy after applying it, as the hashes in the manifest of the
+// patch say, so that the instrumentation is reproduced exactly. Nothing is
+// written unless all of the files are.
+func applyCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, applyUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: gobinarycoverage apply patch.diff")
+	}
+	var r io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	files, err := readPatch(r)
+	if err != nil {
+		return fmt.Errorf("%s: %s", fs.Arg(0), err.Error())
+	}
+	ctx := options{}.buildContext()
+	release, err := acquireLock(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer release()
+	root, err := moduleRoot(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Patch all of the files in memory, before writing any of them
+	patched := make([][]byte, len(files))
+	var mismatched []string
+	for i, f := range files {
+		path := filepath.Join(root, filepath.FromSlash(f.path))
+		contents, err := os.ReadFile(path)
+		exists := err == nil
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if fileHash(contents, exists) != f.before {
+			mismatched = append(mismatched, f.path)
+			continue
+		}
+		if patched[i], err = applyHunks(contents, f.hunks); err != nil {
+			return fmt.Errorf("%s: %s", f.path, err.Error())
+		}
+		if fileHash(patched[i], f.after != patchNoFile) != f.after {
+			return fmt.Errorf("%s: the file patched does not match the manifest", f.path)
+		}
+	}
+	if len(mismatched) > 0 {
+		return fmt.Errorf("the files differ from the ones the patch was written against: %s",
+			strings.Join(mismatched, ", "))
+	}
+	for i, f := range files {
+		path := filepath.Join(root, filepath.FromSlash(f.path))
+		if f.after == patchNoFile {
+			if err = os.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if f.before == patchNoFile {
+			err = os.WriteFile(path, patched[i], 0644)
+		} else {
+			err = writeFileAtomic(path, func(w io.Writer) error {
+				_, err := w.Write(patched[i])
+				return err
+			})
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, f.path)
+	}
+	return nil
+}
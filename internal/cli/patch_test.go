@@ -0,0 +1,172 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPatchRoundTrip(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after string
+		existed       bool
+		exists        bool
+	}{
+		{
+			name:    "changed",
+			before:  "package a\n\nfunc A() {\n\tprintln(1)\n}\n",
+			after:   "package a\n\nfunc A() {\n\tGoCover.Count[0]++\n\tprintln(1)\n}\n",
+			existed: true, exists: true,
+		},
+		{
+			name:    "insertion at line 1",
+			before:  "package a\n",
+			after:   "//line /root/a.go:1\npackage a\n",
+			existed: true, exists: true,
+		},
+		{
+			name:    "lines far apart",
+			before:  strings.Repeat("// x\n", 20) + "package a\n" + strings.Repeat("// y\n", 20),
+			after:   "// z\n" + strings.Repeat("// x\n", 20) + "package b\n" + strings.Repeat("// y\n", 20) + "// z\n",
+			existed: true, exists: true,
+		},
+		{
+			name:    "no newline at the end",
+			before:  "package a\n\nvar x = 1",
+			after:   "package a\n\nvar x = 2",
+			existed: true, exists: true,
+		},
+		{
+			name:    "newline added at the end",
+			before:  "package a",
+			after:   "package a\n",
+			existed: true, exists: true,
+		},
+		{
+			name:   "created",
+			after:  "package main\n\nvar coverRegistered = coverRegister()\n",
+			exists: true,
+		},
+		{
+			name:    "removed",
+			before:  "package a\n",
+			existed: true,
+		},
+		{
+			name:    "emptied",
+			before:  "package a\n",
+			existed: true, exists: true,
+		},
+	}
+	for _, test := range tests {
+		c := changedFile{
+			path:    "lib/a.go",
+			before:  []byte(test.before),
+			after:   []byte(test.after),
+			existed: test.existed,
+			exists:  test.exists,
+		}
+		var patch bytes.Buffer
+		if err := writePatch(&patch, []changedFile{c}); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		files, err := readPatch(&patch)
+		if err != nil {
+			t.Fatalf("%s: %s\n%s", test.name, err, patch.String())
+		}
+		if len(files) != 1 || files[0].path != c.path {
+			t.Fatalf("%s: read %d files from the patch, expected %s", test.name, len(files), c.path)
+		}
+		f := files[0]
+		if f.before != fileHash(c.before, c.existed) || f.after != fileHash(c.after, c.exists) {
+			t.Errorf("%s: the manifest is %s %s", test.name, f.before, f.after)
+		}
+		patched, err := applyHunks(c.before, f.hunks)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if string(patched) != test.after {
+			t.Errorf("%s: patched to %q, expected %q", test.name, patched, test.after)
+		}
+	}
+}
+
+// TestEmitPatchApply writes the patch of the instrumentation of a main
+// package, applies it to the tree, and compares the tree to one instrumented
+// in place.
+func TestEmitPatchApply(t *testing.T) {
+	if testing.Short() {
+		t.Skip("instruments a module twice")
+	}
+	files := map[string]string{
+		"go.mod":     "module example.com/patch\n\ngo 1.18\n",
+		"main.go":    "package main\n\nimport \"example.com/patch/lib\"\n\nfunc main() {\n\tlib.Hello()\n}\n",
+		"lib/lib.go": "package lib\n\nimport \"fmt\"\n\nfunc Hello() {\n\tfmt.Println(\"hello\")\n}\n",
+	}
+	base := t.TempDir()
+	root, twin := filepath.Join(base, "root"), filepath.Join(base, "twin")
+	for _, dir := range []string{root, twin} {
+		for name, src := range files {
+			path := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// The paths of the twin in its files, such as the ones of the //line
+	// directives, are compared as the ones of the tree, see changedFiles
+	chdir(t, twin)
+	if err := instrument("example.com/patch", options{force: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	chdir(t, root)
+	patch := filepath.Join(base, "instrument.diff")
+	if _, err := emitPatch([]string{"example.com/patch"}, patch, options{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		contents, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil || string(contents) != src {
+			t.Fatalf("%s is changed by -emit-patch", name)
+		}
+	}
+	if err := applyCommand([]string{patch}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := changedFiles(root, twin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		t.Errorf("%s differs from the one instrumented in place", c.path)
+	}
+	if _, err = runCommand(root, nil, "go", "build", "-o", filepath.Join(base, "patch"), "."); err != nil {
+		t.Errorf("the patched tree does not build: %s", err)
+	}
+	// The files no longer match the manifest
+	if err = applyCommand([]string{patch}, io.Discard); err == nil {
+		t.Error("expected the patch to fail to apply twice")
+	}
+}
@@ -0,0 +1,424 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// instrumentRun is shared by the instrumentations of the main packages given
+// in one invocation, so that the packages they have in common are instrumented
+// once, and the GoCover variables are numbered across all of them.
+type instrumentRun struct {
+	counter  int                   // The number of the next GoCover variable
+	packages map[string]*coverInfo // The packages instrumented already, by their import path
+	record   *instrumentRecord     // The decisions recorded, or replayed, or nil
+	replay   bool                  // The decisions in record are replayed
+	tempDir  string                // The files instrumented, by package and file, see packageTempDir
+	keepTemp bool                  // Keep tempDir, instead of removing it, see removeTemp
+	mains    []InstrumentedMain    // The main packages instrumented so far
+	manifest *instrumentManifest   // The files changed so far, with -manifest, or nil
+}
+
+// InstrumentedMain is a main package instrumented in a run
+type InstrumentedMain struct {
+	Package  string
+	MainFile string   // The merged main file written, or empty if the main package is left as it is
+	Packages []string // The packages instrumented, along with the main package
+	Skipped  []string // The packages without any code to cover, which are left as they are
+	Files    []string // The paths of the files instrumented
+
+	BuildFlags []string // The flags of go build building the coverage binary natively, with the native backend, which changes no file
+}
+
+// add records the main package mainPackage, instrumented as in cov, with its
+// main file written to mainFile, if any.
+func (run *instrumentRun) add(mainPackage, mainFile string, cov *Cover) {
+	m := InstrumentedMain{Package: mainPackage, MainFile: mainFile}
+	for _, ci := range cov.CoverInfo {
+		m.Packages = append(m.Packages, ci.Package)
+		for _, cv := range ci.sortedVars() {
+			m.Files = append(m.Files, cv.Path)
+		}
+	}
+	for _, ci := range cov.Skipped {
+		m.Skipped = append(m.Skipped, ci.Package)
+	}
+	run.mains = append(run.mains, m)
+}
+
+// MainError is returned when instrumenting one of the main packages given
+// fails, after the ones before it are instrumented.
+type MainError struct {
+	Package string
+	Err     error
+}
+
+func (e *MainError) Error() string {
+	return e.Package + ": " + e.Err.Error()
+}
+
+func (e *MainError) Unwrap() error {
+	return e.Err
+}
+
+// packageTempDir returns the directory the files of the package importPath are
+// instrumented into, before they replace the sources, i.e., the directory
+// named by the import path in the temporary directory of the run, which is
+// created by the first call.
+func (run *instrumentRun) packageTempDir(importPath string) (string, error) {
+	if run.tempDir == "" {
+		dir, err := ioutil.TempDir("", "gobinarycoverage-instrument")
+		if err != nil {
+			return "", err
+		}
+		run.tempDir = dir
+	}
+	dir := filepath.Join(run.tempDir, filepath.FromSlash(importPath))
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// removeTemp removes the temporary directory of the run, unless it is kept,
+// for debugging, in which case it is printed instead.
+func (run *instrumentRun) removeTemp() {
+	if run.tempDir == "" {
+		return
+	}
+	if run.keepTemp {
+		fmt.Fprintf(stderr, "Kept the files instrumented in: %s\n", run.tempDir)
+		return
+	}
+	if err := os.RemoveAll(run.tempDir); err != nil {
+		fmt.Fprintf(stderr, "Warning: failed to remove the temporary directory %s. Error: %s\n", run.tempDir, err.Error())
+	}
+}
+
+// readPackageArgs returns the package patterns given by args, where @file is
+// replaced by the patterns listed in file, and - by the ones read from stdin.
+// The patterns are listed one per line, and the empty lines, and the ones
+// starting with #, are skipped.
+func readPackageArgs(args []string, stdin io.Reader) ([]string, error) {
+	var patterns []string
+	for _, arg := range args {
+		var r io.Reader
+		switch {
+		case arg == "-":
+			r = stdin
+		case strings.HasPrefix(arg, "@"):
+			f, err := os.Open(arg[1:])
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			r = f
+		default:
+			patterns = append(patterns, arg)
+			continue
+		}
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			patterns = append(patterns, line)
+		}
+		if err := s.Err(); err != nil {
+			return nil, fmt.Errorf("%s: %s", arg, err.Error())
+		}
+	}
+	return patterns, nil
+}
+
+// expandPackages returns the main packages matched by the patterns, through go
+// list, for the patterns with wildcards, e.g., ./cmd/.... The rest are
+// returned as they are, and are resolved when instrumenting them.
+func expandPackages(patterns []string, opts options) ([]string, error) {
+	var packages []string
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches := []string{pattern}
+		if strings.Contains(pattern, "...") {
+			out, err := runCommand("", goEnv(opts.buildContext()), "go", "list",
+				"-f", `{{if eq .Name "main"}}{{.ImportPath}}{{end}}`, pattern)
+			if err != nil {
+				return nil, err
+			}
+			matches = strings.Fields(string(out))
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("%s matches no main packages", pattern)
+			}
+		}
+		for _, p := range matches {
+			if !seen[p] {
+				seen[p] = true
+				packages = append(packages, p)
+			}
+		}
+	}
+	return packages, nil
+}
+
+// instrumentPackages instruments every one of the main packages given by
+// args, as read by readPackageArgs, or the ones recorded, with -replay, and
+// returns them. The tree is checked for uncommitted changes before the first
+// one only, as the rest are instrumented in the tree changed by it. The
+// failure of a main package is returned as a MainError.
+func instrumentPackages(args []string, opts options) ([]InstrumentedMain, error) {
+	run := &instrumentRun{counter: 1, packages: make(map[string]*coverInfo), keepTemp: opts.keepTemp}
+	defer run.removeTemp()
+	var patterns []string
+	var err error
+	switch {
+	case opts.record != "" && opts.replay != "":
+		err = fmt.Errorf("-record and -replay can not be given together")
+	case opts.replay != "" && len(args) > 0:
+		err = fmt.Errorf("the packages are replayed from %s, and can not be given", opts.replay)
+	case opts.replay != "":
+		if run.record, err = readRecord(opts.replay); err == nil {
+			run.replay = true
+			for _, m := range run.record.Mains {
+				patterns = append(patterns, m.Package)
+			}
+		}
+	default:
+		patterns, err = readPackageArgs(args, os.Stdin)
+		if err == nil {
+			patterns, err = expandPackages(patterns, opts)
+		}
+		if opts.record != "" {
+			run.record = &instrumentRecord{Tool: getVersionInfo()}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read the packages to instrument. Error: %s\n", err.Error())
+		return nil, err
+	}
+	if len(patterns) == 0 {
+		err = fmt.Errorf("no packages given")
+		fmt.Fprintf(stderr, "Failed to read the packages to instrument. Error: %s\n", err.Error())
+		return nil, err
+	}
+	switch opts.verify {
+	case "", verifyBuild, verifyVet:
+	default:
+		err = fmt.Errorf("unknown check: %s, expected build or vet", opts.verify)
+		fmt.Fprintf(stderr, "Invalid -verify. Error: %s\n", err.Error())
+		return nil, err
+	}
+	if len(patterns) > 1 && opts.mainOutput != "" && !isDirOutput(opts.mainOutput) {
+		err = fmt.Errorf("-o %s is a single file, give a directory ending in / for several main packages", opts.mainOutput)
+		fmt.Fprintf(stderr, "Invalid output. Error: %s\n", err.Error())
+		return nil, err
+	}
+	if opts.manifest != "" {
+		// The main packages may be instrumented in the modules they are in
+		if opts.manifest, err = filepath.Abs(opts.manifest); err != nil {
+			return nil, err
+		}
+		run.manifest = &instrumentManifest{Tool: getVersionInfo(), Mains: []manifestMain{}}
+	}
+	opts.run = run
+	for i, mainPackage := range patterns {
+		if len(patterns) > 1 {
+			fmt.Fprintf(stderr, "Instrumenting %s (%d/%d)\n", mainPackage, i+1, len(patterns))
+		}
+		mainOpts := opts
+		if run.replay {
+			if mainOpts, err = run.record.Mains[i].options(opts); err != nil {
+				fmt.Fprintf(stderr, "Failed to replay the decisions for %s. Error: %s\n", mainPackage, err.Error())
+				return nil, err
+			}
+		}
+		if err = instrument(mainPackage, mainOpts); err != nil {
+			return nil, &MainError{Package: mainPackage, Err: err}
+		}
+		opts.force, opts.stash = true, false
+	}
+	if opts.record != "" {
+		if err = writeRecord(opts.record, run.record); err != nil {
+			fmt.Fprintf(stderr, "Failed to write the decisions. Error: %s\n", err.Error())
+			return nil, err
+		}
+		fmt.Fprintf(stderr, "Recorded the decisions in: %s\n", opts.record)
+	}
+	if run.replay {
+		fmt.Fprintf(stderr, "Replayed the decisions in %s, the instrumented tree is the one recorded\n", opts.replay)
+	}
+	if opts.manifest != "" {
+		if err = writeManifest(opts.manifest, run.manifest); err != nil {
+			fmt.Fprintf(stderr, "Failed to write the manifest. Error: %s\n", err.Error())
+			return nil, err
+		}
+		fmt.Fprintf(stderr, "Wrote the manifest to: %s\n", opts.manifest)
+	}
+	if opts.verify != "" {
+		if err = verifyMains(run.mains, opts); err != nil {
+			return nil, err
+		}
+	}
+	return run.mains, nil
+}
+
+// excludePackages returns the packages which match none of the patterns, see
+// matchPackagePattern. The packages left out are reported, and so are the
+// patterns matching none of them, as they are likely mistyped.
+func excludePackages(packages, patterns []string) []string {
+	var kept, excluded []string
+	matched := make(map[string]bool)
+	for _, p := range packages {
+		exclude := false
+		for _, pattern := range patterns {
+			if pattern = strings.TrimSpace(pattern); pattern != "" && matchPackagePattern(pattern, p) {
+				matched[pattern] = true
+				exclude = true
+			}
+		}
+		if exclude {
+			excluded = append(excluded, p)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern != "" && !matched[pattern] {
+			fmt.Fprintf(stderr, "Warning: -exclude-pkg %s matches none of the packages\n", pattern)
+		}
+	}
+	if len(excluded) > 0 {
+		fmt.Fprintf(stderr, "Excluded the packages: %s\n", strings.Join(excluded, ", "))
+	}
+	return kept
+}
+
+// includePackages returns the packages which match any of the patterns, as
+// given by -include-pkg, see matchPackagePattern. The packages left out are
+// reported, and the patterns matching none of them are warned about, while
+// none of them matching any is an error, as nothing would be instrumented.
+func includePackages(packages, patterns []string) ([]string, error) {
+	var included, left []string
+	matched := make(map[string]bool)
+	for _, p := range packages {
+		include := false
+		for _, pattern := range patterns {
+			if pattern = strings.TrimSpace(pattern); pattern != "" && matchPackagePattern(pattern, p) {
+				matched[pattern] = true
+				include = true
+			}
+		}
+		if include {
+			included = append(included, p)
+		} else {
+			left = append(left, p)
+		}
+	}
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern != "" && !matched[pattern] {
+			fmt.Fprintf(stderr, "Warning: -include-pkg %s matches none of the packages\n", pattern)
+		}
+	}
+	if len(included) == 0 {
+		return nil, fmt.Errorf("-include-pkg %s matches none of the packages imported", strings.Join(patterns, ","))
+	}
+	if len(left) > 0 {
+		fmt.Fprintf(stderr, "Left out the packages not included: %s\n", strings.Join(left, ", "))
+	}
+	return included, nil
+}
+
+// fileFilter selects the files instrumented in the packages, as given by
+// -include-file, and -exclude-file. The patterns are globs, as matched by
+// path.Match, against the name of the file, e.g., *_gen.go, or its import
+// path, e.g., example.com/app/api/*.pb.go.
+type fileFilter struct {
+	include []string // Only the files matching any of these are instrumented, if any are given
+	exclude []string // The files matching any of these are not instrumented
+}
+
+// newFileFilter returns the filter of the comma separated patterns include,
+// and exclude, which fails on the malformed ones.
+func newFileFilter(include, exclude string) (fileFilter, error) {
+	var f fileFilter
+	for _, list := range []struct {
+		patterns string
+		to       *[]string
+	}{{include, &f.include}, {exclude, &f.exclude}} {
+		for _, pattern := range strings.Split(list.patterns, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fileFilter{}, fmt.Errorf("invalid file pattern: %s", pattern)
+			}
+			*list.to = append(*list.to, pattern)
+		}
+	}
+	return f, nil
+}
+
+// skip returns true if the file name of the package importPath is not to be
+// instrumented.
+func (f fileFilter) skip(importPath, name string) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+			if ok, _ := path.Match(pattern, importPath+"/"+name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return len(f.include) > 0 && !matches(f.include) || matches(f.exclude)
+}
+
+// countedPackages returns the packages matching any of the patterns, which
+// are counted in the totals, as given by -total-pkg. The patterns matching
+// none of the packages are warned about, and none of them matching any is an
+// error, as nothing would be counted.
+func countedPackages(packages, patterns []string) ([]string, error) {
+	var counted []string
+	matched := make(map[string]bool)
+	for _, p := range packages {
+		count := false
+		for _, pattern := range patterns {
+			if pattern = strings.TrimSpace(pattern); pattern != "" && matchPackagePattern(pattern, p) {
+				matched[pattern] = true
+				count = true
+			}
+		}
+		if count {
+			counted = append(counted, p)
+		}
+	}
+	for _, pattern := range patterns {
+		if pattern = strings.TrimSpace(pattern); pattern != "" && !matched[pattern] {
+			fmt.Fprintf(stderr, "Warning: -total-pkg %s matches none of the packages\n", pattern)
+		}
+	}
+	if len(counted) == 0 {
+		return nil, fmt.Errorf("-total-pkg %s matches none of the packages instrumented", strings.Join(patterns, ","))
+	}
+	fmt.Fprintf(stderr, "Counting the packages in the totals: %s\n", strings.Join(counted, ", "))
+	return counted, nil
+}
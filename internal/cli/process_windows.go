@@ -0,0 +1,38 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+//go:build windows
+
+package cli
+
+import (
+	"os"
+)
+
+// processAlive returns true if a process with the given pid is running. On
+// Windows, finding a process fails if it is not running.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// maxRSS returns 0, as the resident set size of an exited process is unknown
+// on Windows.
+func maxRSS(ps *os.ProcessState) int64 {
+	return 0
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// staleProfileFiles returns the files in the profile p which are no longer in
+// the source tree, as their package, or the file itself, is gone, e.g., after
+// it is moved, or renamed. The packages are listed with the module proxy
+// disabled, so that the ones which are gone are not looked up remotely. The
+// packages which are not found outside of the main module, and the modules
+// replaced by a local directory, are kept, with a warning, as their module may
+// just not be downloaded.
+func staleProfileFiles(ctx *build.Context, p *profile.Profile) ([]string, error) {
+	modules, err := listModules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	local := func(pkg string) bool {
+		for _, m := range modules {
+			if (m.Main || m.Replace != nil && m.Replace.Version == "") && inModule(pkg, m.Path) {
+				return true
+			}
+		}
+		return false
+	}
+	files := p.Files()
+	var packages []string
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if pkg := path.Dir(file); !filepath.IsAbs(file) && !seen[pkg] {
+			seen[pkg] = true
+			packages = append(packages, pkg)
+		}
+	}
+	dirs := make(map[string]string)
+	if len(packages) > 0 {
+		out, err := runCommand("", append(goEnv(ctx), "GOPROXY=off"), "go", append([]string{"list", "-e", "-json"}, packages...)...)
+		if err != nil {
+			return nil, err
+		}
+		listed, err := decodePackages(out)
+		if err != nil {
+			return nil, err
+		}
+		for _, pkg := range listed {
+			dirs[pkg.ImportPath] = pkg.Dir
+		}
+	}
+	var stale []string
+	for _, file := range files {
+		name := file
+		if !filepath.IsAbs(file) {
+			dir := dirs[path.Dir(file)]
+			if dir == "" && local(path.Dir(file)) {
+				stale = append(stale, file)
+				continue
+			}
+			if dir == "" {
+				fmt.Fprintf(stderr, "prune: skipping %s, as the module of its package is not found\n", file)
+				continue
+			}
+			name = filepath.Join(dir, path.Base(file))
+		}
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			stale = append(stale, file)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return stale, nil
+}
+
+// pruneUsage is the help of the prune subcommand.
+const pruneUsage = `
+   gobinarycoverage prune [-o file] [-n] profile
+
+       Removes the blocks of the files which are no longer in the source
+       tree of the main module from the profile, rewriting it in place, or
+       writing it to -o, and lists the files removed. With -n, it lists
+       them only. The files of the modules which are not found are kept.
+`
+
+// pruneCommand removes the blocks of the files which are no longer in the
+// source tree from a profile, as configured by the arguments of the prune
+// subcommand, so that the profiles accumulated over a long time do not report
+// the coverage of files which are gone. The names of the files removed are
+// written to w.
+func pruneCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, pruneUsage)
+	out := fs.String("o", "", "Write the pruned profile to this file, instead of over the profile")
+	dryRun := fs.Bool("n", false, "List the files which would be removed, without writing the profile")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: gobinarycoverage prune [-o file] [-n] profile")
+	}
+	p, err := profile.ParseFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	stale, err := staleProfileFiles(options{}.buildContext(), p)
+	if err != nil {
+		return err
+	}
+	gone := make(map[string]bool, len(stale))
+	for _, file := range stale {
+		gone[file] = true
+		fmt.Fprintln(w, file)
+	}
+	if *dryRun {
+		return nil
+	}
+	if len(stale) == 0 && *out == "" {
+		return nil
+	}
+	blocks := p.Blocks[:0]
+	for _, b := range p.Blocks {
+		if !gone[b.File] {
+			blocks = append(blocks, b)
+		}
+	}
+	p.Blocks = blocks
+
+	if *out == "" {
+		// The sidecar of the profile is still valid, as it is pruned in place
+		if err = writeFileAtomic(fs.Arg(0), p.Write); err == nil {
+			fmt.Fprintf(stderr, "prune: removed %d files from %s\n", len(stale), fs.Arg(0))
+		}
+		return err
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err = p.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if p.Schema > 0 {
+		return p.WriteSidecar(*out + ".json")
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// diffHunk is a hunk of a diff without context, i.e., the lines oldCount lines
+// from oldStart replaced by the newCount lines from newStart. If oldCount is
+// 0, the lines are inserted after the line oldStart.
+type diffHunk struct {
+	oldStart, oldCount int
+	newStart, newCount int
+}
+
+// fileDiff is the diff of a file in the repository, by its path relative to
+// the top level of the work tree, at the old and the new commit.
+type fileDiff struct {
+	oldPath string
+	newPath string // "" if the file is deleted
+	hunks   []diffHunk
+}
+
+// rebaseLine returns the line in the new version of the file of the block from
+// the line start to the line end in the old version, shifted by the lines
+// inserted, and removed, above it, and false if any of its lines changed.
+func (d *fileDiff) rebaseLine(start, end int) (int, bool) {
+	shift := 0
+	for _, h := range d.hunks {
+		if h.oldCount == 0 {
+			// An insertion between the lines of the block changes it
+			if h.oldStart >= start && h.oldStart < end {
+				return 0, false
+			}
+			if h.oldStart < start {
+				shift += h.newCount
+			}
+			continue
+		}
+		last := h.oldStart + h.oldCount - 1
+		if h.oldStart <= end && last >= start {
+			return 0, false
+		}
+		if last < start {
+			shift += h.newCount - h.oldCount
+		}
+	}
+	return start + shift, true
+}
+
+// gitDiff returns the diffs of the files changed between the commits from
+// and to, in the work tree at top, by their path at from. Renames are
+// detected, so that the blocks of a file moved follow it.
+func gitDiff(top, from, to string) (map[string]*fileDiff, error) {
+	out, err := runCommand(top, nil, "git", "-c", "core.quotePath=false", "diff",
+		"--no-color", "--no-ext-diff", "-U0", "-M", from, to, "--")
+	if err != nil {
+		return nil, err
+	}
+	diffs := make(map[string]*fileDiff)
+	var d *fileDiff
+	s := bufio.NewScanner(bytes.NewReader(out))
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		text := s.Text()
+		switch {
+		case strings.HasPrefix(text, "diff --git "):
+			d = nil
+		case strings.HasPrefix(text, "rename from "):
+			d = &fileDiff{oldPath: strings.TrimPrefix(text, "rename from ")}
+			diffs[d.oldPath] = d
+		case strings.HasPrefix(text, "rename to ") && d != nil:
+			d.newPath = strings.TrimPrefix(text, "rename to ")
+		case strings.HasPrefix(text, "--- "):
+			if name := strings.TrimPrefix(text, "--- "); d == nil && strings.HasPrefix(name, "a/") {
+				d = &fileDiff{oldPath: name[2:], newPath: name[2:]}
+				diffs[d.oldPath] = d
+			}
+		case strings.HasPrefix(text, "+++ ") && d != nil:
+			if strings.TrimPrefix(text, "+++ ") == "/dev/null" {
+				d.newPath = ""
+			}
+		case strings.HasPrefix(text, "@@ ") && d != nil:
+			h, err := parseHunkHeader(text)
+			if err != nil {
+				return nil, err
+			}
+			d.hunks = append(d.hunks, h)
+		}
+	}
+	return diffs, s.Err()
+}
+
+// parseHunkHeader parses the header of a hunk, @@ -a,b +c,d @@, where the
+// counts are left out if they are 1.
+func parseHunkHeader(text string) (diffHunk, error) {
+	fields := strings.Fields(text)
+	if len(fields) < 3 || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return diffHunk{}, fmt.Errorf("unexpected output of git diff: %s", text)
+	}
+	parse := func(r string) (int, int, error) {
+		start, count, found := strings.Cut(r, ",")
+		if !found {
+			count = "1"
+		}
+		s, err := strconv.Atoi(start)
+		if err != nil {
+			return 0, 0, err
+		}
+		c, err := strconv.Atoi(count)
+		return s, c, err
+	}
+	var h diffHunk
+	var err error
+	if h.oldStart, h.oldCount, err = parse(fields[1][1:]); err == nil {
+		h.newStart, h.newCount, err = parse(fields[2][1:])
+	}
+	if err != nil {
+		return diffHunk{}, fmt.Errorf("unexpected output of git diff: %s", text)
+	}
+	return h, nil
+}
+
+// repoModule is a module in the work tree, i.e., the main module, or a module
+// replaced by a local directory in it, with its directory relative to the top
+// level of the work tree.
+type repoModule struct {
+	path string
+	dir  string
+}
+
+// listRepoModules returns the modules in the work tree at top, the longest
+// paths first, so that the first one a file is in is the innermost.
+func listRepoModules(ctx *build.Context, top string) ([]repoModule, error) {
+	modules, err := listModules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var repo []repoModule
+	for _, m := range modules {
+		dir := m.Dir
+		if m.Replace != nil && m.Replace.Version == "" {
+			dir = m.Replace.Dir
+		} else if !m.Main {
+			continue
+		}
+		// git reports the top level with the symlinks resolved
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = resolved
+		}
+		rel, err := filepath.Rel(top, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		repo = append(repo, repoModule{path: m.Path, dir: filepath.ToSlash(rel)})
+	}
+	sort.SliceStable(repo, func(i, j int) bool { return len(repo[i].path) > len(repo[j].path) })
+	return repo, nil
+}
+
+// repoPath returns the path of the file, named as in a profile, relative to
+// the top level of the work tree, and false if it is not in any of modules.
+func repoPath(modules []repoModule, file string) (string, bool) {
+	for _, m := range modules {
+		if inModule(path.Dir(file), m.path) {
+			return path.Join(m.dir, strings.TrimPrefix(file, m.path+"/")), true
+		}
+	}
+	return "", false
+}
+
+// profileName returns the name in a profile of the file at name, relative to
+// the top level of the work tree, and false if it is not in any of modules.
+func profileName(modules []repoModule, name string) (string, bool) {
+	var best *repoModule
+	for i, m := range modules {
+		if (m.dir == "." || name == m.dir || strings.HasPrefix(name, m.dir+"/")) && (best == nil || len(m.dir) > len(best.dir)) {
+			best = &modules[i]
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	rel := name
+	if best.dir != "." {
+		rel = strings.TrimPrefix(name, best.dir+"/")
+	}
+	return best.path + "/" + rel, true
+}
+
+// rebaseProfile remaps the blocks of the profile p, collected on the commit
+// the diffs are from, onto the commit they are to. The blocks are shifted by
+// the lines inserted, and removed, above them, and follow their file if it is
+// renamed, while the blocks any of whose lines changed, and the ones of the
+// files deleted, are dropped. It returns the number of blocks shifted, and
+// dropped.
+func rebaseProfile(p *profile.Profile, modules []repoModule, diffs map[string]*fileDiff) (shifted, dropped int) {
+	blocks := p.Blocks[:0]
+	for _, b := range p.Blocks {
+		name, ok := repoPath(modules, b.File)
+		d := diffs[name]
+		if !ok || d == nil {
+			blocks = append(blocks, b)
+			continue
+		}
+		if d.newPath == "" {
+			dropped++
+			continue
+		}
+		line, ok := d.rebaseLine(b.StartLine, b.EndLine)
+		if !ok {
+			dropped++
+			continue
+		}
+		if file, ok := profileName(modules, d.newPath); ok {
+			b.File = file
+		}
+		if line != b.StartLine || d.newPath != d.oldPath {
+			shifted++
+		}
+		b.EndLine += line - b.StartLine
+		b.StartLine = line
+		blocks = append(blocks, b)
+	}
+	p.Blocks = blocks
+	return shifted, dropped
+}
+
+// rebaseUsage is the help of the rebase subcommand.
+const rebaseUsage = `
+   gobinarycoverage rebase -from commit [-to commit] [-o file] profile
+
+       Remaps the profile collected on the commit -from onto the sources of
+       the commit -to (default HEAD), as told by git diff between them, and
+       writes it to stdout, or to -o. The blocks are shifted by the lines
+       inserted, and removed, above them, and follow their file if it is
+       renamed. The blocks any of whose lines changed are dropped.
+`
+
+// rebaseCommand remaps a profile collected on one commit onto the sources of
+// another, as configured by the arguments of the rebase subcommand, so that
+// the coverage of the binaries of both can be accumulated across small
+// changes of the sources. It is a best effort, as told by the diff between
+// them: the blocks which changed are dropped, and the ones added are not in
+// the profile.
+func rebaseCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("rebase", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, rebaseUsage)
+	from := fs.String("from", "", "The commit the profile is collected on")
+	to := fs.String("to", "HEAD", "The commit to remap the profile onto")
+	out := fs.String("o", "", "Write the profile to this file, instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || fs.NArg() != 1 {
+		return errors.New("usage: gobinarycoverage rebase -from commit [-to commit] [-o file] profile")
+	}
+	p, err := profile.ParseFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	top, err := runCommand("", nil, "git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return fmt.Errorf("not in a git work tree: %s", err.Error())
+	}
+	modules, err := listRepoModules(options{}.buildContext(), strings.TrimSpace(string(top)))
+	if err != nil {
+		return err
+	}
+	diffs, err := gitDiff(strings.TrimSpace(string(top)), *from, *to)
+	if err != nil {
+		return err
+	}
+	total := len(p.Blocks)
+	shifted, dropped := rebaseProfile(p, modules, diffs)
+	// The profile is of neither build now
+	p.Build = ""
+	fmt.Fprintf(stderr, "rebase: %d of %d blocks shifted, %d dropped as they changed\n", shifted, total, dropped)
+
+	if *out == "" {
+		return p.Write(w)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err = p.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if p.Schema > 0 {
+		return p.WriteSidecar(*out + ".json")
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHunkHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		hunk   diffHunk
+		err    bool
+	}{
+		{header: "@@ -3,0 +4,2 @@", hunk: diffHunk{3, 0, 4, 2}},
+		{header: "@@ -4,2 +3,0 @@ func main() {", hunk: diffHunk{4, 2, 3, 0}},
+		{header: "@@ -1 +1,2 @@", hunk: diffHunk{1, 1, 1, 2}},
+		{header: "@@ -0,0 +1,3 @@", hunk: diffHunk{0, 0, 1, 3}},
+		{header: "@@ -7 +7 @@", hunk: diffHunk{7, 1, 7, 1}},
+		{header: "@@ -a,1 +1 @@", err: true},
+		{header: "@@ +1 -1 @@", err: true},
+		{header: "@@", err: true},
+	}
+	for _, test := range tests {
+		h, err := parseHunkHeader(test.header)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseHunkHeader(%q): expected an error", test.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseHunkHeader(%q): %s", test.header, err)
+			continue
+		}
+		if h != test.hunk {
+			t.Errorf("parseHunkHeader(%q) = %+v, expected %+v", test.header, h, test.hunk)
+		}
+	}
+}
+
+func TestRebaseLine(t *testing.T) {
+	tests := []struct {
+		name       string
+		hunks      []string
+		start, end int
+		line       int // 0 if the block changed
+	}{
+		{name: "insertion above", hunks: []string{"@@ -3,0 +4,2 @@"}, start: 5, end: 7, line: 7},
+		{name: "insertion below", hunks: []string{"@@ -3,0 +4,2 @@"}, start: 1, end: 3, line: 1},
+		{name: "insertion inside", hunks: []string{"@@ -3,0 +4,2 @@"}, start: 3, end: 5},
+		{name: "insertion at the end", hunks: []string{"@@ -5,0 +6 @@"}, start: 3, end: 5, line: 3},
+		{name: "deletion above", hunks: []string{"@@ -4,2 +3,0 @@"}, start: 7, end: 9, line: 5},
+		{name: "deletion below", hunks: []string{"@@ -4,2 +3,0 @@"}, start: 1, end: 3, line: 1},
+		{name: "deletion inside", hunks: []string{"@@ -4,2 +3,0 @@"}, start: 5, end: 6},
+		{name: "insertion at line 1", hunks: []string{"@@ -0,0 +1,3 @@"}, start: 1, end: 2, line: 4},
+		{name: "change of line 1", hunks: []string{"@@ -1 +1,2 @@"}, start: 1, end: 3},
+		{name: "change of line 1 above", hunks: []string{"@@ -1 +1,2 @@"}, start: 2, end: 4, line: 3},
+		{name: "straddling the start", hunks: []string{"@@ -5,3 +5 @@"}, start: 3, end: 5},
+		{name: "straddling the end", hunks: []string{"@@ -5,3 +5 @@"}, start: 7, end: 9},
+		{name: "after a replacement", hunks: []string{"@@ -5,3 +5 @@"}, start: 8, end: 10, line: 6},
+		{name: "hunks above and below", hunks: []string{"@@ -2,0 +3 @@", "@@ -10,2 +11,0 @@"}, start: 5, end: 6, line: 6},
+		{name: "hunks above", hunks: []string{"@@ -2,0 +3 @@", "@@ -10,2 +11,0 @@"}, start: 12, end: 13, line: 11},
+	}
+	for _, test := range tests {
+		d := &fileDiff{oldPath: "a.go", newPath: "a.go"}
+		for _, header := range test.hunks {
+			h, err := parseHunkHeader(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.hunks = append(d.hunks, h)
+		}
+		line, ok := d.rebaseLine(test.start, test.end)
+		if ok != (test.line != 0) || line != test.line {
+			t.Errorf("%s: rebaseLine(%d, %d) = %d, %t, expected %d", test.name, test.start, test.end, line, ok, test.line)
+		}
+	}
+}
+
+// TestGitDiff verifies the hunks, and the renames, parsed from the output of
+// git diff -U0.
+func TestGitDiff(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not found")
+	}
+	top := t.TempDir()
+	git := func(args ...string) {
+		args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+		if out, err := runCommand(top, nil, "git", args...); err != nil {
+			t.Fatalf("git %s: %s: %s", strings.Join(args, " "), err, out)
+		}
+	}
+	write := func(name string, lines ...string) {
+		path := filepath.Join(top, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	long := []string{"package b", "", "func B() {", "\tprintln(1)", "\tprintln(2)", "\tprintln(3)", "\tprintln(4)", "}"}
+	git("init", "-q")
+	write("a.go", "package a", "", "func A() {", "\tprintln(1)", "}", "", "func C() {", "\tprintln(2)", "}")
+	write("b.go", long...)
+	write("gone.go", "package gone")
+	git("add", "-A")
+	git("commit", "-q", "-m", "from")
+	// An insertion at line 1, and a deletion, of a.go, and a rename of b.go
+	write("a.go", "// Package a", "package a", "", "func C() {", "\tprintln(2)", "}")
+	if err := os.Remove(filepath.Join(top, "b.go")); err != nil {
+		t.Fatal(err)
+	}
+	write("lib/b.go", append(long, "", "func D() {}")...)
+	if err := os.Remove(filepath.Join(top, "gone.go")); err != nil {
+		t.Fatal(err)
+	}
+	git("add", "-A")
+	git("commit", "-q", "-m", "to")
+
+	diffs, err := gitDiff(top, "HEAD~1", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]*fileDiff{
+		"a.go":    {oldPath: "a.go", newPath: "a.go", hunks: []diffHunk{{0, 0, 1, 1}, {3, 4, 3, 0}}},
+		"b.go":    {oldPath: "b.go", newPath: "lib/b.go", hunks: []diffHunk{{8, 0, 9, 2}}},
+		"gone.go": {oldPath: "gone.go", newPath: "", hunks: []diffHunk{{1, 1, 0, 0}}},
+	}
+	if !reflect.DeepEqual(diffs, expected) {
+		for name, d := range diffs {
+			t.Logf("%s: %+v", name, *d)
+		}
+		t.Fatal("unexpected diffs")
+	}
+	// func C() moves up by 3 lines
+	if line, ok := diffs["a.go"].rebaseLine(7, 9); !ok || line != 4 {
+		t.Errorf("rebaseLine(7, 9) = %d, %t, expected 4", line, ok)
+	}
+}
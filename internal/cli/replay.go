@@ -0,0 +1,390 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// recordRootToken replaces the root of the main module in the instrumented
+// files, e.g., in the //line directives, before they are hashed, so that the
+// checkouts the decisions are replayed in can be anywhere.
+const recordRootToken = "$GOBINARYCOVERAGE_ROOT"
+
+// instrumentRecord holds every decision of an instrumentation, recorded with
+// -record, so that -replay makes the same ones in another checkout of the same
+// commit, e.g., on every machine of a build farm, without listing the packages,
+// selecting the files, or reading the CPU profile again, and verifies that the
+// instrumented tree is bit for bit the one recorded.
+type instrumentRecord struct {
+	Tool     versionInfo        `json:"tool"`
+	Mains    []*recordedMain    `json:"mains"`
+	Packages []*recordedPackage `json:"packages"` // In the order they are instrumented
+}
+
+// recordedMain holds the decisions of the instrumentation of a main package
+type recordedMain struct {
+	Package         string             `json:"package"`
+	Commit          string             `json:"commit,omitempty"` // The HEAD of the git work tree, if the module is in one
+	GOOS            string             `json:"goos,omitempty"`
+	GOARCH          string             `json:"goarch,omitempty"`
+	Tags            string             `json:"tags,omitempty"`
+	Mode            string             `json:"mode"`
+	Granularity     string             `json:"granularity"`
+	Sample          float64            `json:"sample"`
+	Label           string             `json:"label"`
+	EnvPrefix       string             `json:"env_prefix"`
+	PerModule       bool               `json:"per_module,omitempty"`
+	IncludeReplaced bool               `json:"include_replaced,omitempty"`
+	ExcludePkg      string             `json:"exclude_pkg,omitempty"`  // The packages are recorded after the exclusion, it is stamped into the binary only
+	IncludePkg      string             `json:"include_pkg,omitempty"`  // As ExcludePkg
+	ExcludeFile     string             `json:"exclude_file,omitempty"` // The files are recorded after the exclusion, as the packages
+	IncludeFile     string             `json:"include_file,omitempty"`
+	TotalPkg        string             `json:"total_pkg,omitempty"`
+	HotAction       string             `json:"hot_action,omitempty"`
+	Hot             map[string]float64 `json:"hot,omitempty"` // The share of the CPU of the hot functions, by their name, see hotFuncName
+	Template        string             `json:"template,omitempty"`
+	TemplateHash    string             `json:"template_hash,omitempty"`
+	Runtime         recordedRuntime    `json:"runtime"`
+	Output          string             `json:"output,omitempty"` // -o
+	LineDirectives  bool               `json:"line_directives,omitempty"`
+	Packages        []string           `json:"packages"`  // The packages covered, in the order they are in the main file
+	MainHash        string             `json:"main_hash"` // The hash of the main file written, see recordHash
+	GoModHash       string             `json:"go_mod_hash,omitempty"`
+}
+
+// recordedRuntime holds the options of the coverage runtime
+type recordedRuntime struct {
+	SystemdNotify   bool   `json:"systemd_notify,omitempty"`
+	FlushOnSIGTERM  bool   `json:"flush_on_sigterm,omitempty"`
+	ExitSignals     string `json:"exit_signals,omitempty"`
+	FlushSignals    string `json:"flush_signals,omitempty"`
+	DumpAddr        string `json:"dump_addr,omitempty"`
+	FlushTrigger    string `json:"flush_trigger,omitempty"`
+	LiveAddr        string `json:"live_addr,omitempty"`
+	Serve           bool   `json:"serve,omitempty"`
+	ReportFormats   string `json:"report_formats,omitempty"`
+	Expvar          bool   `json:"expvar,omitempty"`
+	Pprof           bool   `json:"pprof,omitempty"`
+	Rotate          string `json:"rotate,omitempty"`
+	SubcommandDepth int    `json:"subcommand_depth,omitempty"`
+	MaxProfiles     int    `json:"max_profiles,omitempty"`
+	MaxProfilesSize int64  `json:"max_profiles_size,omitempty"`
+	Lock            bool   `json:"lock,omitempty"`
+	SyslogFallback  bool   `json:"syslog_fallback,omitempty"`
+	MQTTBroker      string `json:"mqtt_broker,omitempty"`
+	MQTTTopic       string `json:"mqtt_topic,omitempty"`
+	CompactMeta     string `json:"compact_meta,omitempty"`
+	LogFile         string `json:"log,omitempty"`
+	Dir             string `json:"dir,omitempty"`
+	Persist         string `json:"persist,omitempty"`
+}
+
+// recordedPackage holds the files of a package instrumented, and the GoCover
+// variables they are instrumented with.
+type recordedPackage struct {
+	Package string         `json:"package"`
+	Files   []recordedFile `json:"files"`
+}
+
+// recordedFile is a file instrumented
+type recordedFile struct {
+	Name string `json:"name"`
+	Var  string `json:"var"`
+	Hash string `json:"hash"` // The hash of the instrumented file, see recordHash
+}
+
+// recordHash returns the hash of the file at path, with the root of the main
+// module replaced by recordRootToken, unless it is "", or "" if the file does
+// not exist.
+func recordHash(path, root string) (string, error) {
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if root != "" {
+		contents = bytes.ReplaceAll(contents, []byte(root), []byte(recordRootToken))
+	}
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// gitHead returns the commit checked out in the git work tree at root, or ""
+// if it is not in one.
+func gitHead(root string) string {
+	out, err := runCommand(root, nil, "git", "rev-parse", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// readRecord reads the decisions recorded with -record from path
+func readRecord(path string) (*instrumentRecord, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &instrumentRecord{}
+	if err = json.Unmarshal(contents, r); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if len(r.Mains) == 0 {
+		return nil, fmt.Errorf("%s: no main packages recorded", path)
+	}
+	if tool := getVersionInfo(); r.Tool.Version != tool.Version || r.Tool.Commit != tool.Commit {
+		fmt.Fprintf(stderr, "Warning: the decisions are recorded by gobinarycoverage %s, and replayed by %s, "+
+			"which can instrument differently\n", r.Tool.Version, tool.Version)
+	}
+	return r, nil
+}
+
+// writeRecord writes the decisions recorded to path
+func writeRecord(path string, r *instrumentRecord) error {
+	contents, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(contents, '\n'), 0644)
+}
+
+// main returns the decisions recorded for the main package mainPackage
+func (r *instrumentRecord) main(mainPackage string) (*recordedMain, error) {
+	for _, m := range r.Mains {
+		if m.Package == mainPackage {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("no decisions are recorded for %s", mainPackage)
+}
+
+// pkg returns the decisions recorded for the package importPath
+func (r *instrumentRecord) pkg(importPath string) (*recordedPackage, error) {
+	for _, p := range r.Packages {
+		if p.Package == importPath {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("no decisions are recorded for %s", importPath)
+}
+
+// recordOptions returns the decisions of the options opts, and of the
+// instrumentation described by cov, of the main package mainPackage.
+func recordOptions(mainPackage string, opts options, cov *Cover, hot *hotFunctions) (*recordedMain, error) {
+	m := &recordedMain{
+		Package:         mainPackage,
+		GOOS:            opts.goos,
+		GOARCH:          opts.goarch,
+		Tags:            opts.tags,
+		Mode:            cov.Mode,
+		Granularity:     cov.Granularity,
+		Sample:          cov.Sample,
+		Label:           cov.Label,
+		EnvPrefix:       cov.EnvPrefix,
+		PerModule:       opts.perModule,
+		IncludeReplaced: opts.includeReplaced,
+		ExcludePkg:      opts.excludePkg,
+		IncludePkg:      opts.includePkg,
+		ExcludeFile:     opts.excludeFile,
+		IncludeFile:     opts.includeFile,
+		TotalPkg:        opts.totalPkg,
+		Template:        opts.templateFile,
+		Output:          opts.mainOutput,
+		LineDirectives:  opts.lineDirectives,
+		Runtime: recordedRuntime{
+			SystemdNotify:   opts.systemdNotify,
+			FlushOnSIGTERM:  opts.flushOnSIGTERM,
+			ExitSignals:     opts.exitSignals,
+			FlushSignals:    opts.flushSignals,
+			DumpAddr:        opts.dumpAddr,
+			FlushTrigger:    opts.flushTrigger,
+			LiveAddr:        opts.liveAddr,
+			Serve:           opts.serve,
+			ReportFormats:   opts.reportFormats,
+			Expvar:          opts.expvar,
+			Pprof:           opts.pprof,
+			Rotate:          opts.rotate,
+			SubcommandDepth: opts.subcommandDepth,
+			MaxProfiles:     opts.maxProfiles,
+			MaxProfilesSize: opts.maxProfilesSize,
+			Lock:            opts.lock,
+			SyslogFallback:  opts.syslogFallback,
+			MQTTBroker:      opts.mqttBroker,
+			MQTTTopic:       opts.mqttTopic,
+			CompactMeta:     opts.compactMeta,
+			LogFile:         opts.logFile,
+			Dir:             opts.dir,
+			Persist:         opts.persist,
+		},
+	}
+	if hot != nil {
+		m.HotAction, m.Hot = hot.action, hot.share
+	}
+	for _, ci := range cov.CoverInfo {
+		m.Packages = append(m.Packages, ci.Package)
+	}
+	if m.Template != "" {
+		var err error
+		if m.TemplateHash, err = recordHash(m.Template, ""); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// options returns opts, with the options replaced by the ones recorded. The
+// template has to be the one recorded.
+func (m *recordedMain) options(opts options) (options, error) {
+	opts.goos, opts.goarch, opts.tags = m.GOOS, m.GOARCH, m.Tags
+	opts.mode, opts.race = m.Mode, false
+	opts.granularity, opts.sample = m.Granularity, m.Sample
+	opts.label, opts.envPrefix = m.Label, m.EnvPrefix
+	opts.perModule, opts.includeReplaced, opts.excludePkg = m.PerModule, m.IncludeReplaced, m.ExcludePkg
+	opts.includePkg, opts.excludeFile, opts.includeFile = m.IncludePkg, m.ExcludeFile, m.IncludeFile
+	opts.totalPkg = m.TotalPkg
+	// The hot functions are recorded, so the CPU profile is not needed
+	opts.hotProfile, opts.hotAction = "", m.HotAction
+	opts.templateFile, opts.mainOutput, opts.lineDirectives = m.Template, m.Output, m.LineDirectives
+	r := m.Runtime
+	opts.systemdNotify, opts.flushOnSIGTERM = r.SystemdNotify, r.FlushOnSIGTERM
+	opts.exitSignals, opts.flushSignals = r.ExitSignals, r.FlushSignals
+	opts.dumpAddr, opts.flushTrigger, opts.liveAddr = r.DumpAddr, r.FlushTrigger, r.LiveAddr
+	opts.serve, opts.reportFormats = r.Serve, r.ReportFormats
+	opts.expvar, opts.pprof, opts.rotate = r.Expvar, r.Pprof, r.Rotate
+	opts.subcommandDepth = r.SubcommandDepth
+	opts.maxProfiles, opts.maxProfilesSize, opts.lock = r.MaxProfiles, r.MaxProfilesSize, r.Lock
+	opts.syslogFallback, opts.mqttBroker, opts.mqttTopic = r.SyslogFallback, r.MQTTBroker, r.MQTTTopic
+	opts.compactMeta, opts.logFile, opts.persist = r.CompactMeta, r.LogFile, r.Persist
+	opts.dir = r.Dir
+	if m.Template != "" {
+		hash, err := recordHash(m.Template, "")
+		if err != nil {
+			return opts, err
+		}
+		if hash != m.TemplateHash {
+			return opts, fmt.Errorf("the template %s differs from the one recorded", m.Template)
+		}
+	}
+	return opts, nil
+}
+
+// hotFunctions returns the hot functions recorded, or nil if there are none
+func (m *recordedMain) hotFunctions() *hotFunctions {
+	if m.HotAction == "" {
+		return nil
+	}
+	return &hotFunctions{action: m.HotAction, share: m.Hot}
+}
+
+// recordPackage returns the decisions of the instrumentation of the package
+// described by ci, in the tree at root.
+func recordPackage(ci *coverInfo, root string) (*recordedPackage, error) {
+	p := &recordedPackage{Package: ci.Package}
+	for _, cv := range ci.sortedVars() {
+		hash, err := recordHash(cv.Path, root)
+		if err != nil {
+			return nil, err
+		}
+		p.Files = append(p.Files, recordedFile{Name: filepath.Base(cv.Path), Var: cv.Var, Hash: hash})
+	}
+	return p, nil
+}
+
+// verify fails unless the package instrumented, as described by ci, in the
+// tree at root, is the one recorded.
+func (p *recordedPackage) verify(ci *coverInfo, root string) error {
+	got, err := recordPackage(ci, root)
+	if err != nil {
+		return err
+	}
+	if len(got.Files) != len(p.Files) {
+		return fmt.Errorf("%d files of %s are instrumented, instead of the %d recorded", len(got.Files), p.Package, len(p.Files))
+	}
+	for i, f := range got.Files {
+		if f != p.Files[i] {
+			return fmt.Errorf("the instrumented %s/%s differs from the one recorded", p.Package, f.Name)
+		}
+	}
+	return nil
+}
+
+// recordInstrumentedPackage records the decisions of the instrumentation of
+// the package described by ci, in the tree at root, or verifies that it is the
+// one recorded, when replaying them.
+func recordInstrumentedPackage(run *instrumentRun, ci *coverInfo, recorded *recordedPackage, root string) error {
+	if run.record == nil {
+		return nil
+	}
+	if run.replay {
+		if err := recorded.verify(ci, root); err != nil {
+			fmt.Fprintf(stderr, "Failed to replay the decisions. Error: %s\n", err.Error())
+			return err
+		}
+		return nil
+	}
+	p, err := recordPackage(ci, root)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to record the decisions. Error: %s\n", err.Error())
+		return err
+	}
+	run.record.Packages = append(run.record.Packages, p)
+	return nil
+}
+
+// recordInstrumentedMain records the decisions of the instrumentation of the
+// main package mainPackage, described by opts, cov and hot, whose main file is
+// written to mainFile, in the tree at root, or verifies that the main file, and
+// go.mod, are the ones recorded, when replaying them.
+func recordInstrumentedMain(run *instrumentRun, recorded *recordedMain, mainPackage string, opts options, cov *Cover, hot *hotFunctions, root, mainFile string) error {
+	mainHash, err := recordHash(mainFile, root)
+	var goModHash string
+	if err == nil {
+		goModHash, err = recordHash(filepath.Join(root, "go.mod"), root)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to hash the main file, and go.mod. Error: %s\n", err.Error())
+		return err
+	}
+	if run.replay {
+		switch {
+		case mainHash != recorded.MainHash:
+			err = fmt.Errorf("the main file of %s differs from the one recorded", mainPackage)
+		case goModHash != recorded.GoModHash:
+			err = fmt.Errorf("go.mod differs from the one recorded, after instrumenting %s", mainPackage)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to replay the decisions. Error: %s\n", err.Error())
+		}
+		return err
+	}
+	m, err := recordOptions(mainPackage, opts, cov, hot)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to record the decisions. Error: %s\n", err.Error())
+		return err
+	}
+	m.Commit, m.MainHash, m.GoModHash = gitHead(root), mainHash, goModHash
+	run.record.Mains = append(run.record.Mains, m)
+	return nil
+}
@@ -0,0 +1,298 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// reportFormats are the formats the report can be written in
+var reportFormats = map[string]func(w io.Writer, r *profile.Summary) error{
+	"text":      writeTextReport,
+	"json":      writeJSONReport,
+	"csv":       writeCSVReport,
+	"html":      writeHTMLReport,
+	"cobertura": writeCoberturaReport,
+}
+
+// reportUsage is the help of the report subcommand.
+const reportUsage = `
+   gobinarycoverage report [-format text|json|csv|html|cobertura] [-o file] [-api | -teams [-codeowners file]] [-uninstrumented [-main package]]
+           [-tag key=value,...] [-facet key] [-color auto|always|never] [-no-color] profile.out [profile.out...]
+   gobinarycoverage report -serve addr [-watch dir] [-tag key=value,...] [-facet key] [profile.out...]
+
+       Reports the coverage of the merge of the profiles given, per
+       package, and per file, along with the totals. The json format
+       holds every block, with its position and count, as well. The csv
+       format holds a row per file: file, statements, covered, percent.
+       The cobertura format is Cobertura XML, with the files relative to
+       the top level of the git work tree, for the coverage views of CI
+       systems.
+       The text report on a terminal is colored by the coverage: green
+       from 80%, yellow from 50%, and red below. The html format is a page
+       with a bar for every package and file. With -api, the coverage of
+       the exported functions and methods of every package is reported
+       apart from the unexported ones, as text, json or csv, with the
+       sources found through go list. With -teams, the coverage of the
+       files owned by every team is reported, as given by the CODEOWNERS
+       file of the repository, or the one given with -codeowners.
+
+       -uninstrumented counts the statements of the files built into the
+       binary of the main package given with -main (default .), which are
+       not instrumented, e.g., as their packages are excluded, or as they
+       use cgo, as uncovered, marked as not instrumented.
+
+       -tag only reads the profiles with all of the tags given in their
+       sidecars, e.g., goarch=arm64,target=qemu, and -facet reports the
+       profiles by the value of a tag, e.g., target, or device, each into
+       its own subdirectory, with -o.
+
+       With -serve, the HTML report is served on addr, e.g., :8080, with
+       the JSON of it on /report.json. With -watch, the profiles in dir,
+       and the ones given, are read again whenever they change, or new
+       ones land, and the page reloads itself, for a dashboard showing the
+       latest merged coverage during a test campaign.
+`
+
+// reportCommand writes the report of the merge of the profiles given, as
+// configured by the arguments of the report subcommand.
+func reportCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, reportUsage)
+	var formats []string
+	for name := range reportFormats {
+		formats = append(formats, name)
+	}
+	sort.Strings(formats)
+	format := fs.String("format", "text", "The format of the report: "+strings.Join(formats, ", "))
+	out := fs.String("o", "", "Write the report to this file, instead of stdout")
+	serve := fs.String("serve", "", "Serve the HTML report on this address, e.g. :8080, instead of writing it")
+	watch := fs.String("watch", "", "Read the profiles in this directory, and the ones given, again whenever they change, with -serve")
+	api := fs.Bool("api", false, "Report the coverage of the exported functions, and methods, of every package apart from the unexported ones")
+	teams := fs.Bool("teams", false, "Report the coverage of every team owning the files, as given by CODEOWNERS")
+	codeownersFile := fs.String("codeowners", "", "With -teams, read the owners from this file, instead of the CODEOWNERS in the repository")
+	selection := selectionFlags(fs)
+	colors := colorFlags(fs)
+	addUninstrumented, uninstrumented := uninstrumentedFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 && *watch == "" {
+		return errors.New("usage: gobinarycoverage report [-format " + strings.Join(formats, "|") +
+			"] [-o file] [-api | -teams [-codeowners file]] [-uninstrumented [-main package]] [-tag key=value,...] [-facet key] [-color auto|always|never] [-no-color] [-serve addr [-watch dir]] profile.out [profile.out...]")
+	}
+	if *uninstrumented && (*api || *teams || *serve != "") {
+		return errors.New("the files which are not instrumented are only added to the report of the packages, -uninstrumented is only used without -api, -teams and -serve")
+	}
+	sel, err := selection()
+	if err != nil {
+		return err
+	}
+	if sel.facet != "" && (*api || *teams) {
+		return errors.New("the API, and the team reports are of a single group of profiles, -facet is only used without -api and -teams")
+	}
+	if *serve != "" {
+		if *api || *teams {
+			return errors.New("the API, and the team reports are not served, -api and -teams are only used without -serve")
+		}
+		profiles := mergeArgs(fs.Args())
+		if *watch != "" {
+			profiles = append(profiles, *watch)
+		}
+		return serveReport(*serve, profiles, sel, *watch != "")
+	}
+	if *watch != "" {
+		return errors.New("-watch is only used with -serve")
+	}
+	write, ok := reportFormats[*format]
+	if !ok {
+		return fmt.Errorf("unknown format: %s, expected one of: %s", *format, strings.Join(formats, ", "))
+	}
+	colored, err := colors(w)
+	if err != nil {
+		return err
+	}
+	if *api && *teams {
+		return errors.New("-api and -teams are different reports, give one of them")
+	}
+	if *api {
+		return reportAPI(w, *out, *format, fs.Args(), sel, colored)
+	}
+	if *teams {
+		return reportTeams(w, *out, *format, *codeownersFile, fs.Args(), sel, colored)
+	}
+	// The text report is colored on stdout only
+	if *format == "text" && *out == "" && colored {
+		write = func(w io.Writer, r *profile.Summary) error {
+			return writeTextTable(w, r, colored)
+		}
+	}
+	groups, err := loadProfileGroups(fs.Args(), sel)
+	if err != nil {
+		return err
+	}
+	if *uninstrumented && len(groups) > 1 {
+		return errors.New("the files which are not instrumented are found for a single build, -uninstrumented is not used with profiles of several modules, or builds")
+	}
+	if len(groups) == 1 {
+		r := profile.Summarize(groups[0].Profile)
+		if err = addUninstrumented(groups[0].Profile, r); err != nil {
+			return err
+		}
+		if *out == "" {
+			return write(w, r)
+		}
+		return writeReportFile(*out, write, r)
+	}
+
+	//
+	// The profiles are of several modules, or builds, so every one of them
+	// gets its own report, written to the subdirectory named by it, next to -o
+	//
+	if *out == "" {
+		if *format != "text" {
+			return fmt.Errorf("the profiles are of several modules, or builds, give -o in order to write the %s report of each into its own subdirectory", *format)
+		}
+		for i, g := range groups {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintf(w, "# %s\n", g.name())
+			if err = write(w, profile.Summarize(g.Profile)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, g := range groups {
+		dir := filepath.Join(filepath.Dir(*out), g.dir())
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err = writeReportFile(filepath.Join(dir, filepath.Base(*out)), write, profile.Summarize(g.Profile)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReportFile writes the report r to the file at path, in the format of
+// write.
+func writeReportFile(path string, write func(w io.Writer, r *profile.Summary) error, r *profile.Summary) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = write(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeTextReport writes the coverage of every package, and the files in it,
+// as a table.
+func writeTextReport(w io.Writer, r *profile.Summary) error {
+	return writeTextTable(w, r, false)
+}
+
+// writeTextTable writes the text report, with every row colored by its
+// coverage, see percentColor, if c is true.
+func writeTextTable(w io.Writer, r *profile.Summary, c colorizer) error {
+	approx := ""
+	if r.Sample > 0 {
+		fmt.Fprintln(w, sampledNote(r.Sample))
+		approx = "~"
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	row := func(name string, t profile.Totals) {
+		fmt.Fprint(tw, c.row(percentColor(t.Percent),
+			fmt.Sprintf("%s\t%d/%d\t%s%.1f%%\n", name, t.Covered, t.Statements, approx, t.Percent)))
+	}
+	for _, pr := range r.Packages {
+		name := pr.ImportPath
+		if pr.Uninstrumented {
+			name += " (not instrumented)"
+		}
+		if pr.Uncounted {
+			name += " (not in the total)"
+		}
+		row(name, pr.Totals)
+		for _, fr := range pr.Files {
+			name := "    " + path.Base(fr.Name)
+			if fr.Uninstrumented && !pr.Uninstrumented {
+				name += " (not instrumented)"
+			}
+			row(name, fr.Totals)
+		}
+	}
+	row("total", r.Totals)
+	return tw.Flush()
+}
+
+// writeJSONReport writes the full report, down to the blocks, as JSON
+func writeJSONReport(w io.Writer, r *profile.Summary) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// writeCSVReport writes the coverage of every file as CSV, with a header row,
+// for spreadsheets and BI tooling. The percentage of the blocks sampled is
+// added as the last column, for the sampled profiles only.
+func writeCSVReport(w io.Writer, r *profile.Summary) error {
+	cw := csv.NewWriter(w)
+	header := []string{"file", "statements", "covered", "percent"}
+	if r.Sample > 0 {
+		header = append(header, "sample")
+	}
+	cw.Write(header)
+	for _, pr := range r.Packages {
+		for _, fr := range pr.Files {
+			record := []string{
+				fr.Name,
+				strconv.Itoa(fr.Totals.Statements),
+				strconv.Itoa(fr.Totals.Covered),
+				strconv.FormatFloat(fr.Totals.Percent, 'f', 1, 64),
+			}
+			if r.Sample > 0 {
+				record = append(record, strconv.FormatFloat(r.Sample, 'g', -1, 64))
+			}
+			cw.Write(record)
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// sampledNote returns the line marking the coverage of a profile sampled at
+// sample percent as extrapolated.
+func sampledNote(sample float64) string {
+	return fmt.Sprintf("# sampled: the coverage is extrapolated from the %g%% of the blocks instrumented", sample)
+}
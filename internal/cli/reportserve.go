@@ -0,0 +1,258 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// reportWatchInterval is how often the profiles of the report served are
+// checked for changes, and reportRefresh how often the page reloads itself,
+// in seconds.
+const (
+	reportWatchInterval = 2 * time.Second
+	reportRefresh       = 5
+)
+
+// htmlModule is the report of the profiles of a module
+type htmlModule struct {
+	Module string           `json:"module,omitempty"`
+	Report *profile.Summary `json:"report"`
+}
+
+// htmlReport is the data of htmlReportPage
+type htmlReport struct {
+	Modules []htmlModule
+	Refresh int    // Reload the page every this many seconds, if non-zero
+	Updated string // When the profiles were last read
+	Error   string // Why the profiles could not be read last, if they could not
+}
+
+// htmlReportPage is the HTML report, with a table of the packages, and the
+// files in them, for every module
+var htmlReportPage = template.Must(template.New("report").Funcs(template.FuncMap{
+	"base":  path.Base,
+	"class": percentClass,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+{{if .Refresh}}<meta http-equiv="refresh" content="{{.Refresh}}">
+{{end}}<title>Coverage report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+td { padding: 0.2em 1em 0.2em 0; }
+.file td:first-child { padding-left: 2em; }
+.total td { font-weight: bold; }
+.bar { width: 20em; height: 0.8em; background: #e88; }
+.covered { height: 100%; }
+.good { background: #4b4; } .fair { background: #db4; } .poor { background: #d44; }
+.error { color: #d44; }
+.updated { color: #888; }
+</style>
+</head>
+<body>
+{{if .Error}}<p class="error">{{.Error}}</p>
+{{end}}{{range .Modules}}{{$approx := ""}}{{if .Report.Sample}}{{$approx = "~"}}{{end}}
+<h1>{{if .Module}}{{.Module}}: {{end}}{{$approx}}{{printf "%.1f" .Report.Totals.Percent}}%</h1>
+{{if .Report.Sample}}<p>Sampled: the coverage is extrapolated from the {{.Report.Sample}}% of the blocks instrumented</p>
+{{end}}<table>
+{{range .Report.Packages}}<tr>
+<td>{{.ImportPath}}{{if .Uninstrumented}} (not instrumented){{end}}</td>
+<td><div class="bar"><div class="covered {{class .Totals.Percent}}" style="width: {{printf "%.1f" .Totals.Percent}}%"></div></div></td>
+<td>{{$approx}}{{printf "%.1f" .Totals.Percent}}%</td>
+<td>{{.Totals.Covered}}/{{.Totals.Statements}}</td>
+</tr>
+{{range .Files}}<tr class="file">
+<td>{{base .Name}}{{if .Uninstrumented}} (not instrumented){{end}}</td>
+<td><div class="bar"><div class="covered {{class .Totals.Percent}}" style="width: {{printf "%.1f" .Totals.Percent}}%"></div></div></td>
+<td>{{$approx}}{{printf "%.1f" .Totals.Percent}}%</td>
+<td>{{.Totals.Covered}}/{{.Totals.Statements}}</td>
+</tr>
+{{end}}{{end}}<tr class="total">
+<td>total</td>
+<td><div class="bar"><div class="covered {{class .Report.Totals.Percent}}" style="width: {{printf "%.1f" .Report.Totals.Percent}}%"></div></div></td>
+<td>{{$approx}}{{printf "%.1f" .Report.Totals.Percent}}%</td>
+<td>{{.Report.Totals.Covered}}/{{.Report.Totals.Statements}}</td>
+</tr>
+</table>
+{{end}}{{if .Updated}}<p class="updated">Updated {{.Updated}}</p>
+{{end}}</body>
+</html>
+`))
+
+// percentClass returns the CSS class of the coverage percent, as colored by
+// percentColor on the terminal.
+func percentClass(percent float64) string {
+	switch percentColor(percent) {
+	case colorGreen:
+		return "good"
+	case colorRed:
+		return "poor"
+	}
+	return "fair"
+}
+
+// writeHTMLReport writes the coverage of every package, and the files in it,
+// as an HTML page.
+func writeHTMLReport(w io.Writer, r *profile.Summary) error {
+	return htmlReportPage.Execute(w, htmlReport{Modules: []htmlModule{{Report: r}}})
+}
+
+// reportServer serves the HTML report of the profiles given, and re-renders
+// it whenever they change.
+type reportServer struct {
+	args []string         // The profiles, and the directories of profiles, reported
+	sel  profileSelection // The profiles reported, by their tags, and the facet of the report
+
+	mu        sync.RWMutex
+	signature string       // The profiles last read, see profilesSignature
+	modules   []htmlModule // The report of the profiles last read
+	page      []byte       // The HTML report of the profiles last read
+}
+
+// profilesSignature returns the path, size, and modification time of every
+// profile given by args, as loadProfileGroups finds them, so that a change to
+// any of them, or a new one, changes the signature.
+func profilesSignature(args []string) string {
+	var b strings.Builder
+	add := func(path string, info fs.FileInfo) {
+		fmt.Fprintf(&b, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+	}
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			fmt.Fprintf(&b, "%s: %s\n", arg, err.Error())
+			continue
+		}
+		if !info.IsDir() {
+			add(arg, info)
+			continue
+		}
+		filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !isProfileName(d.Name()) {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				add(path, info)
+			}
+			return nil
+		})
+	}
+	return b.String()
+}
+
+// reload reads the profiles again, and re-renders the report, if they changed
+// since they were last read. If they can not be read, e.g., while a profile is
+// being written, the last report is kept, along with the error.
+func (s *reportServer) reload(refresh int) {
+	signature := profilesSignature(s.args)
+	s.mu.RLock()
+	unchanged := s.page != nil && signature == s.signature
+	s.mu.RUnlock()
+	if unchanged {
+		return
+	}
+	data := htmlReport{Refresh: refresh, Updated: time.Now().Format(time.RFC1123)}
+	groups, err := loadProfileGroups(s.args, s.sel)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read the profiles. Error: %s\n", err.Error())
+		data.Error = "Failed to read the profiles: " + err.Error()
+		s.mu.RLock()
+		data.Modules = s.modules
+		s.mu.RUnlock()
+	} else {
+		for _, g := range groups {
+			module := g.Module
+			if g.Build != "" || g.Facet != "" {
+				module = g.name()
+			}
+			data.Modules = append(data.Modules, htmlModule{Module: module, Report: profile.Summarize(g.Profile)})
+		}
+	}
+	var page bytes.Buffer
+	if err := htmlReportPage.Execute(&page, data); err != nil {
+		fmt.Fprintf(stderr, "Failed to render the report. Error: %s\n", err.Error())
+		return
+	}
+	s.mu.Lock()
+	s.signature, s.modules, s.page = signature, data.Modules, page.Bytes()
+	s.mu.Unlock()
+	if err == nil {
+		fmt.Fprintf(stderr, "Rendered the report of the profiles, at %s\n", data.Updated)
+	}
+}
+
+// handlePage serves the HTML report
+func (s *reportServer) handlePage(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	page := s.page
+	s.mu.RUnlock()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
+
+// handleJSON serves the report of every module, as JSON
+func (s *reportServer) handleJSON(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	modules := s.modules
+	s.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(modules)
+}
+
+// serveReport serves the HTML report of the profiles given by args, selected
+// by sel, on addr, and, if watch is true, reads them again whenever they change, or new ones
+// land in the directories given, so that the page, which reloads itself,
+// always shows the latest merged coverage, e.g., during a test campaign.
+func serveReport(addr string, args []string, sel profileSelection, watch bool) error {
+	s := &reportServer{args: args, sel: sel}
+	refresh := 0
+	if watch {
+		refresh = reportRefresh
+	}
+	s.reload(refresh)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handlePage)
+	mux.HandleFunc("/report.json", s.handleJSON)
+	fmt.Fprintf(stderr, "Serving the report on http://%s/\n", ln.Addr())
+	if watch {
+		go func() {
+			for range time.Tick(reportWatchInterval) {
+				s.reload(refresh)
+			}
+		}()
+	}
+	return http.Serve(ln, mux)
+}
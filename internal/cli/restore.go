@@ -0,0 +1,406 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// backupDir is the directory in the root of the main module holding the
+// originals of the files changed by the instrumentation, and the manifest of
+// them, backupManifest, which the restore subcommand reverts them from.
+const backupDir = ".gobinarycoverage/backup"
+
+// backupManifest is the manifest in backupDir, with a backupEntry per line, so
+// that it is appended to as the files are changed, and is complete even if the
+// instrumentation is interrupted.
+const backupManifest = "manifest.jsonl"
+
+// backupEntry is a file changed by the instrumentation
+type backupEntry struct {
+	Path    string `json:"path"`             // Relative to the root of the main module, with forward slashes, or absolute if outside of it
+	Backup  string `json:"backup,omitempty"` // The copy of the original in backupDir, unless the file is created
+	Created bool   `json:"created,omitempty"`
+}
+
+// treeBackup keeps the originals of the files changed by the instrumentation
+// of the main module at root. Only the first change of a file is backed up,
+// so that the originals are kept across the instrumentations which are not
+// restored in between. A nil treeBackup backs nothing up.
+type treeBackup struct {
+	root  string
+	saved map[string]bool // The paths in the manifest
+}
+
+// openBackup opens the backup of the main module at root, reading the files
+// backed up already, if any.
+func openBackup(root string) (*treeBackup, error) {
+	b := &treeBackup{root: root, saved: make(map[string]bool)}
+	entries, err := readBackupManifest(root)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		b.saved[e.Path] = true
+	}
+	return b, nil
+}
+
+// readBackupManifest reads the manifest of the backup of the main module at
+// root.
+func readBackupManifest(root string) ([]backupEntry, error) {
+	f, err := os.Open(filepath.Join(root, backupDir, backupManifest))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []backupEntry
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		var e backupEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// The last line is cut short by an interrupted write
+			return entries, fmt.Errorf("%s:%d: %s", backupManifest, n, err.Error())
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// save backs up the file at path, before it is changed, or created. The
+// copies of the module cache in modCacheCopyDir are not backed up, as they are
+// removed as a whole.
+func (b *treeBackup) save(path string) error {
+	if b == nil {
+		return nil
+	}
+	e := backupEntry{Path: path}
+	if rel, err := filepath.Rel(b.root, path); err == nil && isInDir(path, b.root) {
+		e.Path = filepath.ToSlash(rel)
+	}
+	if b.saved[e.Path] || strings.HasPrefix(e.Path, modCacheCopyDir+"/") {
+		return nil
+	}
+	dir := filepath.Join(b.root, backupDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		e.Created = true
+	case err != nil:
+		return err
+	default:
+		// The backups are numbered, skipping the ones kept by a restore of
+		// some of the packages
+		for n := len(b.saved) + 1; ; n++ {
+			e.Backup = strconv.Itoa(n)
+			if _, err = os.Stat(filepath.Join(dir, e.Backup)); os.IsNotExist(err) {
+				break
+			}
+		}
+		if err = os.WriteFile(filepath.Join(dir, e.Backup), contents, 0644); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, backupManifest), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	b.saved[e.Path] = true
+	return nil
+}
+
+// checkNotInstrumented fails if any of the files of the packages, or the main
+// file of the main package, mainFile, are instrumented already, e.g., by an
+// earlier instrumentation which was not restored, as instrumenting them again
+// produces a main file which does not build. The packages instrumented in this
+// run, done, are skipped.
+func checkNotInstrumented(ctx *build.Context, mainFile string, packages []string, done map[string]*coverInfo) error {
+	var found []string
+	if contents, err := os.ReadFile(mainFile); err == nil && coverRegisterDecl.Match(contents) {
+		found = append(found, mainFile)
+	}
+	var pending []string
+	for _, p := range packages {
+		if done[p] == nil {
+			pending = append(pending, p)
+		}
+	}
+	listed, err := listPackages(ctx, pending)
+	if err != nil {
+		return err
+	}
+	for _, p := range listed {
+		for _, name := range append(p.GoFiles, p.CgoFiles...) {
+			path := filepath.Join(p.Dir, name)
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if coverVarDecl.Match(contents) {
+				found = append(found, path)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	if len(found) > 3 {
+		found = append(found[:3], fmt.Sprintf("and %d more", len(found)-3))
+	}
+	return fmt.Errorf("the tree is instrumented already: %s, restore it with gobinarycoverage restore, "+
+		"or give -force to instrument it again", strings.Join(found, ", "))
+}
+
+// restoreUsage is the help of the restore subcommand.
+const restoreUsage = `
+   gobinarycoverage restore [package...]
+
+       Reverts the files changed by the instrumentations of the main module
+       since it was last restored, i.e., the instrumented files, the main
+       file, and go.mod, to the originals backed up in
+       .gobinarycoverage/backup, removes the files created by them, e.g.,
+       the main file written with -o, and the copies of the module cache,
+       and runs the post_restore hook, if any. The files edited since the
+       instrumentation are reverted as well. If packages are given, as
+       patterns, e.g., ./cmd/app, or ./internal/..., @file, or -, as for
+       the instrumentation, only the Go files of the packages matching
+       them are reverted, along with the ones of the packages the main
+       packages among them depend on, unless the main packages left
+       instrumented depend on them too. The rest, e.g., go.mod, and the
+       copies of the module cache, are kept in the backup, for a later
+       restore, unless no Go file is left to restore.
+`
+
+// restoreCommand reverts the files changed by the instrumentations of the
+// main module to the originals backed up, removes the files created by them,
+// and the copies of the module cache, as configured by the arguments of the
+// restore subcommand, and runs the post_restore hook. If package patterns are
+// given, only the Go files of the packages matching them, and of the ones the
+// main packages depend on, are restored, and the rest are kept in the backup,
+// see restoreEntries.
+func restoreCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, restoreUsage)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	patterns, err := readPackageArgs(fs.Args(), os.Stdin)
+	if err != nil {
+		return err
+	}
+	ctx := options{}.buildContext()
+	release, err := acquireLock(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer release()
+	root, err := moduleRoot(ctx)
+	if err != nil {
+		return err
+	}
+	entries, err := readBackupManifest(root)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("there is no backup of an instrumentation in %s", root)
+	}
+	if err != nil {
+		return err
+	}
+	var kept []backupEntry
+	if len(patterns) > 0 {
+		if entries, kept, err = restoreEntries(ctx, root, entries, patterns); err != nil {
+			return err
+		}
+	}
+	restored, removed := 0, 0
+	for _, e := range entries {
+		path := e.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, filepath.FromSlash(path))
+		}
+		if e.Created {
+			if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			removed++
+			continue
+		}
+		contents, err := os.ReadFile(filepath.Join(root, backupDir, e.Backup))
+		if err != nil {
+			return err
+		}
+		if _, err = os.Stat(path); os.IsNotExist(err) {
+			err = os.WriteFile(path, contents, 0644)
+		} else {
+			err = writeFileAtomic(path, func(w io.Writer) error {
+				_, err := w.Write(contents)
+				return err
+			})
+		}
+		if err != nil {
+			return err
+		}
+		if len(kept) > 0 {
+			if err = os.Remove(filepath.Join(root, backupDir, e.Backup)); err != nil {
+				return err
+			}
+		}
+		restored++
+	}
+	if len(kept) > 0 {
+		// The rest of the files stay backed up, for a later restore
+		err = writeFileAtomic(filepath.Join(root, backupDir, backupManifest), func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			for _, e := range kept {
+				if err := enc.Encode(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Restored %d files, and removed %d files created, in %s, %d files are left to restore\n",
+			restored, removed, root, len(kept))
+	} else {
+		for _, dir := range []string{modCacheCopyDir, backupDir} {
+			if err = os.RemoveAll(filepath.Join(root, dir)); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(w, "Restored %d files, and removed %d files created, in %s\n", restored, removed, root)
+	}
+	c, err := loadConfig(defaultConfigFile)
+	if err != nil {
+		return err
+	}
+	return runHook(c.Hooks, hookPostRestore)
+}
+
+// restoreEntries splits the entries of the backup of the main module at root
+// into the ones which are restored, and the rest, which are kept. The Go files
+// in the directories of the packages matching the patterns are restored, and,
+// for the main packages, the ones of the packages they depend on as well, as
+// their instrumentation changes all of them, unless the main file of another
+// main package, which is not restored, depends on them too. Once no Go file is
+// left to restore, the rest, e.g., go.mod, and the files created, are restored
+// along with them.
+func restoreEntries(ctx *build.Context, root string, entries []backupEntry, patterns []string) (restore, kept []backupEntry, err error) {
+	packages, err := listPackages(ctx, patterns)
+	if err != nil {
+		return nil, nil, err
+	}
+	dirs := make(map[string]bool)
+	deps, err := packageDepDirs(ctx, packages)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, p := range packages {
+		dirs[p.Dir] = true
+	}
+	path := func(e backupEntry) string {
+		if filepath.IsAbs(e.Path) {
+			return e.Path
+		}
+		return filepath.Join(root, filepath.FromSlash(e.Path))
+	}
+	// The main files instrumented of the main packages which are not
+	// restored keep the packages they depend on instrumented
+	var others []string
+	for _, e := range entries {
+		dir := filepath.Dir(path(e))
+		if !strings.HasSuffix(e.Path, ".go") || e.Created || dirs[dir] {
+			continue
+		}
+		if contents, err := os.ReadFile(path(e)); err == nil && coverRegisterDecl.Match(contents) {
+			others = append(others, dir)
+		}
+	}
+	if len(others) > 0 {
+		listed, err := listPackages(ctx, others)
+		if err != nil {
+			return nil, nil, err
+		}
+		shared, err := packageDepDirs(ctx, listed)
+		if err != nil {
+			return nil, nil, err
+		}
+		for dir := range shared {
+			delete(deps, dir)
+		}
+	}
+	for dir := range deps {
+		dirs[dir] = true
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Path, ".go") && dirs[filepath.Dir(path(e))] {
+			restore = append(restore, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	if len(restore) == 0 {
+		return nil, nil, fmt.Errorf("no file of %s is backed up in %s", strings.Join(patterns, " "), root)
+	}
+	for _, e := range kept {
+		if strings.HasSuffix(e.Path, ".go") {
+			return restore, kept, nil
+		}
+	}
+	return entries, nil, nil
+}
+
+// packageDepDirs returns the directories of the packages the main packages
+// among packages depend on.
+func packageDepDirs(ctx *build.Context, packages []*Package) (map[string]bool, error) {
+	var deps []string
+	for _, p := range packages {
+		if p.Name == "main" {
+			deps = append(deps, p.Deps...)
+		}
+	}
+	dirs := make(map[string]bool)
+	listed, err := listPackages(ctx, deps)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range listed {
+		dirs[p.Dir] = true
+	}
+	return dirs, nil
+}
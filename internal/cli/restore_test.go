@@ -0,0 +1,135 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestorePackages(t *testing.T) {
+	files := map[string]string{
+		"go.mod":           "module example.com/restore\n\ngo 1.18\n",
+		"cmd/app/main.go":  "package main\n\nimport _ \"example.com/restore/lib/a\"\n\nfunc main() {}\n",
+		"cmd/dep/main.go":  "package main\n\nimport (\n\t_ \"example.com/restore/lib/a\"\n\t_ \"example.com/restore/lib/b\"\n)\n\nfunc main() {}\n",
+		"lib/a/a.go":       "package a\n",
+		"lib/b/b.go":       "package b\n",
+		"lib/b/b_other.go": "package b\n\nconst X = 1\n",
+	}
+	root := t.TempDir()
+	for name, src := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chdir(t, root)
+	// instrument changes the files, as the instrumentation does, backing
+	// them up first. The main files register the counters
+	instrument := func(names ...string) {
+		b, err := openBackup(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			path := filepath.Join(root, filepath.FromSlash(name))
+			if err = b.save(path); err != nil {
+				t.Fatal(err)
+			}
+			instrumented := files[name] + "// instrumented\n"
+			if strings.HasSuffix(name, "/main.go") {
+				instrumented += "var coverRegistered = coverRegister()\n"
+			}
+			if err = os.WriteFile(path, []byte(instrumented), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	files["lib/a/created.go"] = ""
+	instrument("go.mod", "cmd/app/main.go", "lib/a/a.go", "lib/b/b.go", "lib/a/created.go")
+	created := filepath.Join(root, "lib", "a", "created.go")
+
+	restored := func(name string) bool {
+		contents, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(contents) == files[name]
+	}
+	tests := []struct {
+		instrument []string // Changed again before the restore
+		args       []string
+		restored   []string
+		kept       []string
+		err        bool
+	}{
+		{args: []string{"./lib/..."}, restored: []string{"lib/a/a.go", "lib/b/b.go"}, kept: []string{"go.mod", "cmd/app/main.go"}},
+		// Nothing of lib is backed up anymore
+		{args: []string{"./lib/a"}, err: true},
+		// The backups of lib are numbered after the ones kept, and the
+		// packages the main package depends on are restored along with it
+		{
+			instrument: []string{"lib/a/a.go", "lib/b/b.go"},
+			args:       []string{"./cmd/app"},
+			restored:   []string{"cmd/app/main.go", "lib/a/a.go"},
+			kept:       []string{"go.mod", "lib/b/b.go"},
+		},
+		{restored: []string{"go.mod", "lib/b/b.go"}},
+		// lib/a stays instrumented for cmd/app, which is not restored
+		{
+			instrument: []string{"go.mod", "cmd/app/main.go", "cmd/dep/main.go", "lib/a/a.go", "lib/b/b.go"},
+			args:       []string{"./cmd/dep"},
+			restored:   []string{"cmd/dep/main.go", "lib/b/b.go"},
+			kept:       []string{"go.mod", "cmd/app/main.go", "lib/a/a.go"},
+		},
+		// go.mod is restored once nothing instrumented is left
+		{args: []string{"./cmd/app"}, restored: []string{"cmd/app/main.go", "lib/a/a.go", "go.mod"}},
+	}
+	for _, test := range tests {
+		instrument(test.instrument...)
+		err := restoreCommand(test.args, io.Discard)
+		if test.err {
+			if err == nil {
+				t.Errorf("restore %q: expected an error", test.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("restore %q: %s", test.args, err)
+		}
+		for _, name := range test.restored {
+			if !restored(name) {
+				t.Errorf("restore %q: %s is not restored", test.args, name)
+			}
+		}
+		for _, name := range test.kept {
+			if restored(name) {
+				t.Errorf("restore %q: %s is restored", test.args, name)
+			}
+		}
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Errorf("%s is not removed: %v", created, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, backupDir)); !os.IsNotExist(err) {
+		t.Errorf("the backup is left: %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// liveSnapshot is the coverage of a running binary, as served by its live
+// view at /coverage/live.json. See runtimesrc/live.go.
+type liveSnapshot struct {
+	Label    string  `json:"label"`
+	Covered  int64   `json:"covered"`
+	Total    int64   `json:"total"`
+	Percent  float64 `json:"percent"`
+	Packages []struct {
+		ImportPath string  `json:"import_path"`
+		Covered    int64   `json:"covered"`
+		Total      int64   `json:"total"`
+		Percent    float64 `json:"percent"`
+	} `json:"packages"`
+}
+
+// runUsage is the help of the run subcommand.
+const runUsage = `
+   gobinarycoverage run [-live] [-addr addr] [-interval duration] [-log file] -- binary [arg...]
+
+       Runs the binary, and exits with its exit code. With -live, the
+       coverage per package is rendered on the terminal, and refreshed
+       every interval (default 1s), while the binary runs, from the live
+       view it serves on addr (default 127.0.0.1:9097). The binary has to
+       be instrumented with -live-addr, and its output is written to file
+       (default run.log) instead of the terminal. Unless GOCOVERDIR is
+       set, the binary is run with it set to a temporary directory, and
+       the coverage data the binaries built with -backend native write
+       into it is converted into a profile, in COVERAGE_FILEPATH, or the
+       working directory, once the binary exits.
+`
+
+// runCommandLine runs an instrumented binary, as configured by the arguments of
+// the run subcommand, and returns its exit code. With -live, the coverage of
+// the binary is rendered on the terminal while it runs. Unless GOCOVERDIR is
+// set, the binary is run with it set to a temporary directory, so that the
+// coverage data of the binaries built natively is converted into a profile,
+// see covdataRunProfile.
+func runCommandLine(args []string) (int, error) {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, runUsage)
+	live := fs.Bool("live", false, "Render the coverage per package on the terminal, while the binary runs")
+	addr := fs.String("addr", "127.0.0.1:9097", "The address the binary serves the live view on")
+	interval := fs.Duration("interval", time.Second, "The interval the coverage is refreshed at")
+	logFile := fs.String("log", "run.log", "With -live, write the output of the binary to this file")
+	envPrefix := fs.String("env-prefix", defaultEnvPrefix, "The prefix of the environment variables read by the binary")
+	if err := fs.Parse(args); err != nil {
+		return 1, err
+	}
+	if fs.NArg() < 1 {
+		return 1, errors.New("usage: gobinarycoverage run [-live] [-addr addr] [-interval duration] [-log file] -- binary [arg...]")
+	}
+
+	// The binary is the user's own, and runs for as long as it likes, with
+	// the terminal attached, so it is not run through runCommand
+	cmd := exec.Command(fs.Arg(0), fs.Args()[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = os.Environ()
+	coverDir := ""
+	if os.Getenv("GOCOVERDIR") == "" {
+		dir, err := ioutil.TempDir("", "gobinarycoverage-run")
+		if err != nil {
+			return 1, err
+		}
+		defer os.RemoveAll(dir)
+		coverDir = dir
+		cmd.Env = append(cmd.Env, "GOCOVERDIR="+coverDir)
+	}
+	if *live {
+		// The dashboard takes over the terminal
+		f, err := os.Create(*logFile)
+		if err != nil {
+			return 1, err
+		}
+		defer f.Close()
+		cmd.Stdout, cmd.Stderr = f, f
+		cmd.Env = append(cmd.Env, *envPrefix+"LIVE_ADDR="+*addr)
+	}
+	if err := cmd.Start(); err != nil {
+		return 1, err
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	d := &liveDashboard{start: time.Now(), terminal: isTerminal(os.Stderr)}
+	client := &http.Client{Timeout: *interval}
+	var tick <-chan time.Time
+	if *live {
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case sig := <-sigs:
+			cmd.Process.Signal(sig)
+		case <-tick:
+			if s, err := fetchLiveSnapshot(client, *addr); err == nil {
+				d.render(s)
+			}
+		case err := <-done:
+			if *live {
+				fmt.Fprintf(stderr, "The output of the binary is in %s\n", *logFile)
+			}
+			code := 0
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				code = exitErr.ExitCode()
+			} else if err != nil {
+				return 1, err
+			}
+			if coverDir != "" && isCovdataDir(coverDir) {
+				profile, err := covdataRunProfile(coverDir, *envPrefix)
+				if err != nil {
+					if code == 0 {
+						code = 1
+					}
+					return code, fmt.Errorf("convert the coverage data: %s", err.Error())
+				}
+				fmt.Fprintf(stderr, "Wrote the coverage profile to %s\n", profile)
+			}
+			return code, nil
+		}
+	}
+}
+
+// fetchLiveSnapshot fetches the snapshot of the coverage from the live view
+// of the binary served on addr.
+func fetchLiveSnapshot(client *http.Client, addr string) (*liveSnapshot, error) {
+	rsp, err := client.Get("http://" + addr + "/coverage/live.json")
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the live view responded with: %s", rsp.Status)
+	}
+	s := &liveSnapshot{}
+	return s, json.NewDecoder(rsp.Body).Decode(s)
+}
+
+// liveDashboard renders the snapshots of the coverage on stderr. On a
+// terminal, every snapshot replaces the previous one, and otherwise only the
+// total is written, whenever it changes.
+type liveDashboard struct {
+	start    time.Time
+	terminal bool
+	lines    int // The number of lines rendered last
+	covered  int64
+}
+
+func (d *liveDashboard) render(s *liveSnapshot) {
+	elapsed := time.Since(d.start).Round(time.Second)
+	if !d.terminal {
+		if s.Covered != d.covered || d.lines == 0 {
+			fmt.Fprintf(stderr, "%s: %.1f%% (%d/%d statements) after %s\n",
+				s.Label, s.Percent, s.Covered, s.Total, elapsed)
+			d.covered, d.lines = s.Covered, 1
+		}
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s: %.1f%% (%d/%d statements), running for %s\n",
+		s.Label, s.Percent, s.Covered, s.Total, elapsed)
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	for _, p := range s.Packages {
+		fmt.Fprintf(tw, "  %s\t%s\t%5.1f%%\t%d/%d\n", p.ImportPath, liveBar(p.Percent), p.Percent, p.Covered, p.Total)
+	}
+	tw.Flush()
+	if d.lines > 0 {
+		// Move up to the previous snapshot, and clear it
+		fmt.Fprintf(stderr, "\x1b[%dA\x1b[J", d.lines)
+	}
+	os.Stderr.Write(buf.Bytes())
+	d.lines = bytes.Count(buf.Bytes(), []byte("\n"))
+}
+
+// liveBar renders percent as a bar of 20 characters
+func liveBar(percent float64) string {
+	n := int(percent / 5)
+	return "[" + strings.Repeat("#", n) + strings.Repeat(".", 20-n) + "]"
+}
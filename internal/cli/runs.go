@@ -0,0 +1,300 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// defaultRunIndexFile is the file the index of the runs is kept in, unless
+// another one is given through -index
+const defaultRunIndexFile = "coverage-runs.json"
+
+// runIndex maps every block to the runs which covered it. A run is the merge
+// of the profiles with the same value of the tag naming the runs, e.g., of all
+// the devices a test ran on, see profile.Profile.Tags.
+type runIndex struct {
+	Tag    string         `json:"tag"`  // The tag naming the runs
+	Mode   string         `json:"mode"` // The mode of the profiles
+	Runs   []string       `json:"runs"` // The names of the runs, sorted
+	Blocks []indexedBlock `json:"blocks"`
+}
+
+// indexedBlock is a block, and the runs which covered it, by their index in
+// runIndex.Runs. The blocks no run covered are indexed too, with no runs.
+type indexedBlock struct {
+	File      string `json:"file"`
+	StartLine int    `json:"start_line"`
+	StartCol  int    `json:"start_col"`
+	EndLine   int    `json:"end_line"`
+	EndCol    int    `json:"end_col"`
+	NumStmt   int    `json:"num_stmt"`
+	Runs      []int  `json:"runs,omitempty"`
+}
+
+// buildRunIndex indexes the profiles at paths by the value of their tag. The
+// profiles without the tag are skipped, with a warning.
+func buildRunIndex(paths []string, tag string) (*runIndex, error) {
+	runs := make(map[string]*profile.Profile)
+	for _, name := range paths {
+		p, err := profile.ParseFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+		run, ok := p.Tags[tag]
+		if !ok {
+			fmt.Fprintf(stderr, "runs: skipping %s, as it is not tagged %s\n", name, tag)
+			continue
+		}
+		if runs[run] == nil {
+			runs[run] = &profile.Profile{}
+		}
+		if err = runs[run].Merge(p); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("no profiles tagged %s found", tag)
+	}
+	index := &runIndex{Tag: tag}
+	for run := range runs {
+		index.Runs = append(index.Runs, run)
+	}
+	sort.Strings(index.Runs)
+	// The blocks of different builds do not line up
+	build := ""
+	blocks := make(map[profile.BlockKey]int)
+	for i, run := range index.Runs {
+		p := runs[run]
+		if index.Mode == "" {
+			index.Mode = p.Mode
+		} else if p.Mode != index.Mode {
+			return nil, fmt.Errorf("the run %s is in mode %q, expected %q", run, p.Mode, index.Mode)
+		}
+		if build != "" && p.Build != "" && p.Build != build {
+			return nil, fmt.Errorf("the run %s is of the build %s, and another of the build %s, index the profiles of one build", run, p.Build, build)
+		}
+		if build == "" {
+			build = p.Build
+		}
+		for _, b := range p.Blocks {
+			j, ok := blocks[b.Key()]
+			if !ok {
+				j = len(index.Blocks)
+				blocks[b.Key()] = j
+				index.Blocks = append(index.Blocks, indexedBlock{
+					File: b.File, StartLine: b.StartLine, StartCol: b.StartCol,
+					EndLine: b.EndLine, EndCol: b.EndCol, NumStmt: b.NumStmt,
+				})
+			}
+			if b.Count > 0 {
+				index.Blocks[j].Runs = append(index.Blocks[j].Runs, i)
+			}
+		}
+	}
+	sort.SliceStable(index.Blocks, func(i, j int) bool {
+		a, b := index.Blocks[i], index.Blocks[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.StartLine != b.StartLine {
+			return a.StartLine < b.StartLine
+		}
+		return a.StartCol < b.StartCol
+	})
+	return index, nil
+}
+
+// readRunIndex reads the index written by runs index from path
+func readRunIndex(path string) (*runIndex, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	index := &runIndex{}
+	if err = json.Unmarshal(contents, index); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return index, nil
+}
+
+// run returns the index of the run named name
+func (x *runIndex) run(name string) (int, error) {
+	i := sort.SearchStrings(x.Runs, name)
+	if i == len(x.Runs) || x.Runs[i] != name {
+		return 0, fmt.Errorf("no run %s=%s in the index", x.Tag, name)
+	}
+	return i, nil
+}
+
+// runsUsage is the help of the runs subcommand.
+const runsUsage = `
+   gobinarycoverage runs index [-index file] -tag tag profile.out|dir [profile.out|dir...]
+   gobinarycoverage runs only [-index file] run
+   gobinarycoverage runs covering [-index file] package-pattern
+
+       index maps every block to the runs covering it, i.e., the merges of
+       the profiles with the same value of the tag -tag, and writes the
+       index to -index (default ./coverage-runs.json). only lists the
+       blocks covered by the run given only. covering lists the runs
+       covering the packages matching the pattern, the most first, along
+       with the statements they are the only ones covering.
+`
+
+// runsCommand indexes the runs in the profiles, or queries the index, as
+// configured by the arguments of the runs subcommand, so that it is told which
+// runs, e.g., which tests, cover what, as for test impact analysis.
+func runsCommand(args []string, w io.Writer) error {
+	const usage = "usage: gobinarycoverage runs index [-index file] -tag tag profile.out|dir [profile.out|dir...]\n" +
+		"       gobinarycoverage runs only [-index file] run\n" +
+		"       gobinarycoverage runs covering [-index file] package-pattern"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	switch args[0] {
+	case "index":
+		return runsIndex(args[1:], usage)
+	case "only":
+		return runsOnly(args[1:], w, usage)
+	case "covering":
+		return runsCovering(args[1:], w, usage)
+	}
+	return errors.New(usage)
+}
+
+// runsIndex writes the index of the runs in the profiles given
+func runsIndex(args []string, usage string) error {
+	fs := flag.NewFlagSet("runs index", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, runsUsage)
+	file := fs.String("index", defaultRunIndexFile, "The file the index is written to")
+	tag := fs.String("tag", "", "The tag naming the run of every profile, e.g. test")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *tag == "" || fs.NArg() < 1 {
+		return errors.New(usage)
+	}
+	paths, err := profilePaths(mergeArgs(fs.Args()))
+	if err != nil {
+		return err
+	}
+	index, err := buildRunIndex(paths, *tag)
+	if err != nil {
+		return err
+	}
+	contents, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(*file, append(contents, '\n'), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "runs: indexed %d blocks of %d runs in %s\n", len(index.Blocks), len(index.Runs), *file)
+	return nil
+}
+
+// runsOnly lists the blocks covered by the run given only
+func runsOnly(args []string, w io.Writer, usage string) error {
+	fs := flag.NewFlagSet("runs only", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, runsUsage)
+	file := fs.String("index", defaultRunIndexFile, "The file the index is kept in")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New(usage)
+	}
+	index, err := readRunIndex(*file)
+	if err != nil {
+		return err
+	}
+	run, err := index.run(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	blocks, statements := 0, 0
+	for _, b := range index.Blocks {
+		if len(b.Runs) != 1 || b.Runs[0] != run {
+			continue
+		}
+		fmt.Fprintf(tw, "%s:%d.%d,%d.%d\t%d statements\n", b.File, b.StartLine, b.StartCol, b.EndLine, b.EndCol, b.NumStmt)
+		blocks++
+		statements += b.NumStmt
+	}
+	fmt.Fprintf(tw, "%d blocks, %d statements, are covered by %s=%s only\n", blocks, statements, index.Tag, index.Runs[run])
+	return tw.Flush()
+}
+
+// runsCovering lists the runs covering the packages matching the pattern
+// given, by the number of statements of them they cover, the most first, along
+// with the number of statements they are the only ones covering.
+func runsCovering(args []string, w io.Writer, usage string) error {
+	fs := flag.NewFlagSet("runs covering", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, runsUsage)
+	file := fs.String("index", defaultRunIndexFile, "The file the index is kept in")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New(usage)
+	}
+	index, err := readRunIndex(*file)
+	if err != nil {
+		return err
+	}
+	covered := make([]int, len(index.Runs))
+	only := make([]int, len(index.Runs))
+	total := 0
+	for _, b := range index.Blocks {
+		if !matchPackagePattern(fs.Arg(0), path.Dir(b.File)) {
+			continue
+		}
+		total += b.NumStmt
+		for _, run := range b.Runs {
+			covered[run] += b.NumStmt
+		}
+		if len(b.Runs) == 1 {
+			only[b.Runs[0]] += b.NumStmt
+		}
+	}
+	if total == 0 {
+		return fmt.Errorf("no package in the index matches %s", fs.Arg(0))
+	}
+	var runs []int
+	for run := range index.Runs {
+		if covered[run] > 0 {
+			runs = append(runs, run)
+		}
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return covered[runs[i]] > covered[runs[j]] })
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tcovered\tonly by it\n", index.Tag)
+	for _, run := range runs {
+		fmt.Fprintf(tw, "%s\t%.1f%%\t%d statements\n", index.Runs[run], 100*float64(covered[run])/float64(total), only[run])
+	}
+	fmt.Fprintf(tw, "%d of %d runs cover %s, of %d statements\n", len(runs), len(index.Runs), fs.Arg(0), total)
+	return tw.Flush()
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// writeTaggedProfile writes the profile text, with the build, and the tags, in
+// its sidecar, if any, to the file name in dir.
+func writeTaggedProfile(t *testing.T, dir, name, text, build string, tags map[string]string) {
+	p, err := profile.Parse(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err = os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if build != "" || tags != nil {
+		p.Build, p.Tags = build, tags
+		if err = p.WriteSidecar(path + ".json"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRuns(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	profiles := filepath.Join(dir, "profiles")
+	if err := os.Mkdir(profiles, 0755); err != nil {
+		t.Fatal(err)
+	}
+	const blocks = "mode: set\n" +
+		"example.com/app/installer/a.go:3.14,5.2 2 %d\n" +
+		"example.com/app/installer/a.go:7.14,9.2 3 %d\n" +
+		"example.com/app/installer/a.go:11.14,13.2 5 %d\n" +
+		"example.com/app/cli/b.go:3.14,5.2 4 %d\n"
+	counted := func(counts ...int) string {
+		args := make([]interface{}, len(counts))
+		for i, c := range counts {
+			args[i] = c
+		}
+		return fmt.Sprintf(blocks, args...)
+	}
+	// The install test ran on two devices, and is merged into one run
+	writeTaggedProfile(t, profiles, "coverage1.out", counted(1, 1, 0, 0), "", map[string]string{"test": "install", "device": "a"})
+	writeTaggedProfile(t, profiles, "coverage2.out", counted(0, 1, 0, 1), "", map[string]string{"test": "install", "device": "b"})
+	writeTaggedProfile(t, profiles, "coverage3.out", counted(0, 0, 1, 1), "", map[string]string{"test": "rollback"})
+	// Skipped, as it is not tagged
+	writeTaggedProfile(t, profiles, "coverage4.out", counted(1, 1, 1, 1), "", nil)
+
+	// The sidecars given along with the profiles are skipped
+	args, err := filepath.Glob(filepath.Join(profiles, "coverage*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = runsCommand(append([]string{"index", "-tag", "test"}, args...), &out); err != nil {
+		t.Fatal(err)
+	}
+	index, err := readRunIndex(defaultRunIndexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Tag != "test" || index.Mode != "set" || strings.Join(index.Runs, ",") != "install,rollback" || len(index.Blocks) != 4 {
+		t.Fatalf("unexpected index: %+v", index)
+	}
+
+	tests := []struct {
+		args     []string
+		expected string
+		err      bool
+	}{
+		{
+			args: []string{"only", "rollback"},
+			expected: "example.com/app/installer/a.go:11.14,13.2  5 statements\n" +
+				"1 blocks, 5 statements, are covered by test=rollback only\n",
+		},
+		{
+			args: []string{"only", "install"},
+			expected: "example.com/app/installer/a.go:3.14,5.2  2 statements\n" +
+				"example.com/app/installer/a.go:7.14,9.2  3 statements\n" +
+				"2 blocks, 5 statements, are covered by test=install only\n",
+		},
+		{
+			args: []string{"covering", "example.com/app/installer/..."},
+			expected: "test      covered  only by it\n" +
+				"install   50.0%    5 statements\n" +
+				"rollback  50.0%    5 statements\n" +
+				"2 of 2 runs cover example.com/app/installer/..., of 10 statements\n",
+		},
+		{
+			args: []string{"covering", "example.com/app/cli"},
+			expected: "test      covered  only by it\n" +
+				"install   100.0%   0 statements\n" +
+				"rollback  100.0%   0 statements\n" +
+				"2 of 2 runs cover example.com/app/cli, of 4 statements\n",
+		},
+		{args: []string{"only", "upgrade"}, err: true},
+		{args: []string{"covering", "example.com/other/..."}, err: true},
+		{args: []string{"only"}, err: true},
+		{args: []string{"unknown"}, err: true},
+	}
+	for _, test := range tests {
+		out.Reset()
+		err := runsCommand(test.args, &out)
+		if test.err {
+			if err == nil {
+				t.Errorf("runs %s: expected an error", strings.Join(test.args, " "))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("runs %s: %s", strings.Join(test.args, " "), err)
+			continue
+		}
+		if out.String() != test.expected {
+			t.Errorf("runs %s:\n%s\nexpected:\n%s", strings.Join(test.args, " "), out.String(), test.expected)
+		}
+	}
+
+	// The runs of different builds are not indexed together
+	other := filepath.Join(dir, "other")
+	if err = os.Mkdir(other, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTaggedProfile(t, other, "coverage1.out", counted(1, 0, 0, 0), "v1", map[string]string{"test": "install"})
+	writeTaggedProfile(t, other, "coverage2.out", counted(1, 0, 0, 0), "v2", map[string]string{"test": "rollback"})
+	if err = runsCommand([]string{"index", "-tag", "test", "-index", "other.json", other}, &out); err == nil {
+		t.Error("expected the runs of different builds to fail to be indexed")
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// The constraint keeps the file out of the build of this package, as
+// gobinarycoverage does not depend on cobra. It is merged all the same.
+
+//go:build gobinarycoverage_cobra
+
+package runtimesrc
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// This file is only merged into the main file of binaries which depend on a
+// version of cobra with OnFinalize, see wireCobra, as it would otherwise add
+// the dependency.
+
+func init() {
+	// The finalizers run once the command given is executed, so that the
+	// coverage is written after every command run, whichever way main exits
+	cobra.OnFinalize(func() { coverFlush() })
+}
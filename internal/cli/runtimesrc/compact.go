@@ -0,0 +1,90 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// coverCompactID identifies the metadata the counters are decoded with on the
+// host, and is replaced in the generated main file.
+var coverCompactID = ""
+
+func init() {
+	coverWriteProfile = coverWriteCompactProfile
+}
+
+// coverWriteCompactProfile writes the counters into dir, in the compact format
+// decoded by gobinarycoverage decode, instead of the text profile. The blocks
+// are not written, as they are in the metadata kept on the host.
+//
+// The format is the magic "GBCC", the version 1, the 8 byte ID of the metadata,
+// and the number of counters as a uvarint, followed by a pair of uvarints for
+// every counter which is hit: the number of counters skipped before it, and
+// its count. The counters are in the order the files are registered in.
+//
+// The uvarints are unsigned LEB128, as in encoding/binary: seven bits a byte,
+// the least significant first. As nothing is written in the byte order, or the
+// word size, of the target, and nothing is aligned, the profiles written on a
+// big endian, or a 32 bit, target decode the same on the host.
+func coverWriteCompactProfile(dir string) (string, error) {
+	profile := coverProfileName(dir, ".cov")
+	f, err := coverCreateTemp(profile)
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to create the coverage profile. Error: %s\n", err.Error())
+		return "", err
+	}
+	id, _ := hex.DecodeString(coverCompactID)
+	w := bufio.NewWriter(f)
+	w.WriteString("GBCC\x01")
+	w.Write(id)
+	var buf [binary.MaxVarintLen64]byte
+	uvarint := func(v uint64) {
+		w.Write(buf[:binary.PutUvarint(buf[:], v)])
+	}
+	n := 0
+	for _, name := range coverFiles {
+		n += len(coverCounters[name])
+	}
+	uvarint(uint64(n))
+	var skipped uint64
+	for _, name := range coverFiles {
+		counts := coverCounters[name]
+		for i := range counts {
+			count := coverCount(counts, i)
+			if count == 0 {
+				skipped++
+				continue
+			}
+			uvarint(skipped)
+			uvarint(uint64(count))
+			skipped = 0
+		}
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		fmt.Fprintf(coverLog(), "Failed to write the coverage profile. Error: %s\n", err.Error())
+		return "", err
+	}
+	if err = coverCommit(f, profile); err != nil {
+		return "", err
+	}
+	return profile, nil
+}
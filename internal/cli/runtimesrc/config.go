@@ -0,0 +1,260 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The configuration of the runtime. The values are replaced in the generated
+// main file, with the ones chosen when instrumenting the binary.
+var (
+	coverLabel     = ""          // The project label in the summary line
+	coverEnvPrefix = "COVERAGE_" // The prefix of the environment variables read
+	coverModule    = ""          // The module whose subdirectory the profiles are written into, if any
+	coverDir       = ""          // The directory the profiles are written to, unless COVERAGE_FILEPATH is set
+	coverMode      = "set"       // The coverage mode the packages are instrumented in
+	coverSettings  = ""          // The settings the binary is instrumented with, read back by gobinarycoverage inspect
+	coverSample    = ""          // The percentage of the blocks instrumented, if not all of them are
+	coverTotal     = ""          // The comma separated packages counted in the total, if not all of them are
+	coverLogFile   = ""          // Where the messages of the runtime go: stderr if "", nowhere if off, or appended to this file
+	coverTool      = ""          // The version of gobinarycoverage the binary is instrumented by
+
+	coverSubcommandDepth = "0" // The number of words of the subcommand the binary is run with, recorded in the profiles
+)
+
+// coverSettingsSize reads coverSettings, as otherwise the linker drops it from
+// the binary.
+var coverSettingsSize = len(coverSettings)
+
+// coverGetenv returns the value of the environment variable name, prefixed by
+// coverEnvPrefix, e.g., COVERAGE_FILEPATH.
+func coverGetenv(name string) string {
+	return os.Getenv(coverEnvPrefix + name)
+}
+
+// coverReportLabel returns the project label of the summary line, which can be
+// overridden through COVERAGE_LABEL.
+func coverReportLabel() string {
+	if label := coverGetenv("LABEL"); label != "" {
+		return label
+	}
+	return coverLabel
+}
+
+// coverCounted returns whether the package pkg is counted in the total, i.e.,
+// whether it is one of coverTotal, if any.
+func coverCounted(pkg string) bool {
+	if coverTotal == "" {
+		return true
+	}
+	for _, counted := range strings.Split(coverTotal, ",") {
+		if counted == pkg {
+			return true
+		}
+	}
+	return false
+}
+
+// coverBuild returns the build of the binary, by which the profiles of the
+// binaries of different builds, e.g., the firmware versions running on a
+// device farm, are kept apart: COVERAGE_BUILD, or the version of the main
+// module, or the revision it is built from, as stamped by the go command.
+func coverBuild() string {
+	if build := coverGetenv("BUILD"); build != "" {
+		return build
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	revision, modified := "", false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if revision != "" && modified {
+		revision += "+dirty"
+	}
+	return revision
+}
+
+// coverDeviceID returns the identity of the device, i.e., COVERAGE_DEVICE_ID,
+// or the hostname.
+func coverDeviceID() string {
+	if id := coverGetenv("DEVICE_ID"); id != "" {
+		return id
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// coverSubcommand returns the subcommand the binary is run with, e.g.,
+// "install" for mender install /tmp/update.mender, of at most
+// coverSubcommandDepth words, e.g., "write rootfs-image" for mender-artifact
+// write rootfs-image -o a.mender with 2. The words are the arguments up to the
+// first one which is not a name, e.g., a path, skipping the flags, so a flag
+// with a separate value before the subcommand, e.g., -config file, must be
+// given as -config=file instead. It is empty if the binary is run without any.
+func coverSubcommand() string {
+	depth, _ := strconv.Atoi(coverSubcommandDepth)
+	var words []string
+	for _, arg := range os.Args[1:] {
+		if len(words) == depth || arg == "--" {
+			break
+		}
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		if !coverIsName(arg) {
+			break
+		}
+		words = append(words, arg)
+	}
+	return strings.Join(words, " ")
+}
+
+// coverIsName tells whether arg is the name of a subcommand, i.e., a letter,
+// followed by letters, digits, dashes and underscores.
+func coverIsName(arg string) bool {
+	for i, r := range arg {
+		letter := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+		if !letter && (i == 0 || !(r >= '0' && r <= '9' || r == '-' || r == '_')) {
+			return false
+		}
+	}
+	return arg != ""
+}
+
+// coverTags returns the tags the profiles are written with, by which the
+// reports filter, and facet, them: the device, if COVERAGE_DEVICE_ID is set,
+// the hostname, the operating system, and the architecture, the subcommand
+// the binary is run with, with -subcommand-depth, and the tags in
+// COVERAGE_TAGS, e.g., target=qemu,board=rpi4, which override them.
+func coverTags() map[string]string {
+	tags := map[string]string{"goos": runtime.GOOS, "goarch": runtime.GOARCH}
+	if hostname, err := os.Hostname(); err == nil {
+		tags["hostname"] = hostname
+	}
+	if id := coverGetenv("DEVICE_ID"); id != "" {
+		tags["device"] = id
+	}
+	if subcommand := coverSubcommand(); subcommand != "" {
+		tags["subcommand"] = subcommand
+	}
+	for _, tag := range strings.Split(coverGetenv("TAGS"), ",") {
+		if key, value, ok := strings.Cut(tag, "="); ok && strings.TrimSpace(key) != "" {
+			tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return tags
+}
+
+// coverProfilePrefix returns the prefix of the names of the profiles:
+// coverage, followed by COVERAGE_FILENAME, the window of the counters, if the
+// profiles are rotated, the subcommand, with -subcommand-depth, and
+// COVERAGE_DEVICE_ID, if set, so that the profiles of several devices can be
+// gathered in a single directory. It must be called with coverFlushMu held.
+func coverProfilePrefix() string {
+	prefix := "coverage" + coverGetenv("FILENAME") + coverWindow
+	sanitize := func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-._", r) {
+			return r
+		}
+		return '_'
+	}
+	for _, part := range []string{coverSubcommand(), coverGetenv("DEVICE_ID")} {
+		part = strings.Map(sanitize, part)
+		if part == "" {
+			continue
+		}
+		if !strings.HasSuffix(prefix, "-") {
+			prefix += "-"
+		}
+		prefix += part + "-"
+	}
+	return prefix
+}
+
+// coverOutputDir returns the directory the coverage profiles are written to,
+// i.e., COVERAGE_FILEPATH, or the one given through -dir, or the subdirectory
+// named by the path of the module in it, so that the profiles of the binaries
+// of different modules are kept apart. The subdirectory is created if need be.
+func coverOutputDir() (string, error) {
+	dir := coverGetenv("FILEPATH")
+	if dir == "" {
+		dir = coverDir
+	}
+	if coverModule == "" {
+		return dir, nil
+	}
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	dir = filepath.Join(dir, filepath.FromSlash(coverModule))
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+var (
+	coverLogOnce   sync.Once
+	coverLogOutput io.Writer
+)
+
+// coverLog returns where the messages of the runtime are written: to stderr,
+// by default, nowhere, if the log is off, or appended to the log file, as
+// chosen through -log, or COVERAGE_LOG, which overrides it, so that they stay
+// out of the output of the binary, e.g., in the assertions of acceptance tests.
+// The log file is opened once, when the first message is written, and stderr
+// is used if it can not be.
+func coverLog() io.Writer {
+	coverLogOnce.Do(func() {
+		coverLogOutput = os.Stderr
+		path := coverLogFile
+		if env := coverGetenv("LOG"); env != "" {
+			path = env
+		}
+		switch path {
+		case "":
+		case "off":
+			coverLogOutput = io.Discard
+		default:
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to open the coverage log, writing to stderr instead. Error: %s\n", err.Error())
+				return
+			}
+			coverLogOutput = f
+		}
+	})
+	return coverLogOutput
+}
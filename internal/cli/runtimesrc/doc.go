@@ -0,0 +1,29 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package runtimesrc holds the coverage runtime, which is merged into the main
+// file of the instrumented binary.
+//
+// The package is never imported. Its source files are embedded into
+// gobinarycoverage, and all the declarations in them are copied into the
+// generated main file, alongside the registration of the GoCover variables of
+// the covered packages. Thus, everything in here has to be unexported, and
+// prefixed with 'cover' in order not to collide with the declarations in the
+// main file of the package being instrumented.
+//
+// Some of the files are optional, and only merged when the binary depends on
+// the packages they import, or when the option enabling them is given. They
+// hook into the rest of the runtime through the variables set from their init
+// functions.
+package runtimesrc
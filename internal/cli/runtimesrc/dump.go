@@ -0,0 +1,50 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// This file is only merged into the main file when instrumenting with
+// -dump-addr.
+
+// coverDumpAddr is the address of the dump endpoint, which is replaced by the
+// one given through -dump-addr, and overridden by COVERAGE_DUMP_ADDR.
+var coverDumpAddr = ""
+
+func init() {
+	addr := coverDumpAddr
+	if a := coverGetenv("DUMP_ADDR"); a != "" {
+		addr = a
+	}
+	coverServe(addr, "/coverage/dump", coverHandleDump)
+}
+
+// coverHandleDump writes the coverage profile, and only responds once it is
+// synced to disk, so that it can be used as a preStop hook in Kubernetes.
+func coverHandleDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	profile, err := coverFlush()
+	if err != nil {
+		http.Error(w, "failed to write the coverage profile: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, profile)
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"expvar"
+)
+
+// This file is only merged into the main file when instrumenting with
+// -expvar.
+
+// coverExpvar is the expvar variable the coverage is published as, in
+// /debug/vars
+const coverExpvar = "coverage"
+
+func init() {
+	// Do not take the name from the binary, as expvar panics on duplicates
+	if expvar.Get(coverExpvar) != nil {
+		return
+	}
+	expvar.Publish(coverExpvar, expvar.Func(func() interface{} {
+		covered, total := coverStatements()
+		percent := 0.0
+		if total > 0 {
+			percent = 100 * float64(covered) / float64(total)
+		}
+		return map[string]interface{}{
+			"label":   coverReportLabel(),
+			"covered": covered,
+			"total":   total,
+			"percent": percent,
+		}
+	}))
+}
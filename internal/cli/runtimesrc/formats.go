@@ -0,0 +1,334 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// This file is only merged into the main file when instrumenting with
+// -report-formats.
+
+// The reports written along with every profile, which are replaced by the
+// ones given through -report-formats, and overridden by
+// COVERAGE_REPORT_FORMATS, or turned off with it set to off, along with where
+// the sources of the covered packages are, so that the CI systems find them.
+var (
+	coverReportFormats = "" // The comma separated formats: lcov, cobertura, and json
+	coverSourceRoot    = "" // The root of the main module, when instrumenting
+	coverSourceDirs    = "" // The comma separated directories of the packages, as import-path=dir, relative to coverSourceRoot
+)
+
+// coverReportWriters are the reports, by their format, with the suffix they
+// are written next to the profile with, <profile><suffix>.
+var coverReportWriters = map[string]struct {
+	suffix string
+	write  func(w io.Writer, files []coverReportFile) error
+}{
+	"lcov":      {".info", coverWriteLcov},
+	"cobertura": {".xml", coverWriteCobertura},
+	"json":      {".summary.json", coverWriteJSONSummary},
+}
+
+func init() {
+	for _, writer := range coverReportWriters {
+		coverCompanions = append(coverCompanions, writer.suffix)
+	}
+	formats := coverReportFormats
+	if s := coverGetenv("REPORT_FORMATS"); s != "" {
+		formats = s
+	}
+	if formats == "off" {
+		return
+	}
+	var enabled []string
+	for _, format := range strings.Split(formats, ",") {
+		format = strings.TrimSpace(format)
+		if _, ok := coverReportWriters[format]; !ok {
+			if format != "" {
+				fmt.Fprintf(coverLog(), "Unknown report format: %q, expected lcov, cobertura, or json\n", format)
+			}
+			continue
+		}
+		enabled = append(enabled, format)
+	}
+	if len(enabled) == 0 {
+		return
+	}
+	coverAfterFlush = append(coverAfterFlush, func(profile string) {
+		coverWriteReports(profile, enabled)
+	})
+}
+
+// coverReportFile is the coverage of every line of a covered file, as the
+// offline reports of gobinarycoverage have it: a line is covered as much as
+// the least covered of the blocks on it.
+type coverReportFile struct {
+	name    string // The name in the profile, by the import path of its package
+	path    string // The path of the source, relative to coverSourceRoot, or name, if it is not known
+	lines   []int  // The lines with statements, sorted
+	counts  map[int]uint32
+	covered int64 // The statements covered
+	total   int64 // The statements
+}
+
+// coverReportFiles returns the coverage of the covered files, sorted by name.
+func coverReportFiles() []coverReportFile {
+	dirs := make(map[string]string)
+	for _, entry := range strings.Split(coverSourceDirs, ",") {
+		if importPath, dir, ok := strings.Cut(entry, "="); ok {
+			dirs[importPath] = dir
+		}
+	}
+	var files []coverReportFile
+	for name, counts := range coverCounters {
+		f := coverReportFile{name: name, path: name, counts: make(map[int]uint32)}
+		if dir, ok := dirs[path.Dir(name)]; ok {
+			f.path = path.Join(dir, path.Base(name))
+		}
+		blocks := coverBlocks[name]
+		for i := range counts {
+			b, count := blocks[i], coverCount(counts, i)
+			f.total += int64(b.Stmts)
+			if count > 0 {
+				f.covered += int64(b.Stmts)
+			}
+			end := int(b.Line1)
+			// A block ending in the first column holds nothing on its last line
+			if end > int(b.Line0) && b.Col1 <= 1 {
+				end--
+			}
+			for line := int(b.Line0); line <= end; line++ {
+				if c, ok := f.counts[line]; !ok || count < c {
+					f.counts[line] = count
+				}
+			}
+		}
+		for line := range f.counts {
+			f.lines = append(f.lines, line)
+		}
+		sort.Ints(f.lines)
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files
+}
+
+// coverWriteReports writes the reports in the formats given next to the
+// coverage profile at profile. It is called with coverFlushMu held.
+func coverWriteReports(profile string, formats []string) {
+	files := coverReportFiles()
+	for _, format := range formats {
+		writer := coverReportWriters[format]
+		name := profile + writer.suffix
+		f, err := coverCreateTemp(name)
+		if err != nil {
+			fmt.Fprintf(coverLog(), "Failed to create the %s report. Error: %s\n", format, err.Error())
+			continue
+		}
+		w := bufio.NewWriter(f)
+		if err = writer.write(w, files); err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			fmt.Fprintf(coverLog(), "Failed to write the %s report. Error: %s\n", format, err.Error())
+			continue
+		}
+		if coverCommit(f, name) == nil {
+			fmt.Fprintf(coverLog(), "Wrote the %s report to the file: %s\n", format, name)
+		}
+	}
+}
+
+// coverLinesHit returns the number of the lines of f which are covered
+func coverLinesHit(f coverReportFile) int {
+	hit := 0
+	for _, line := range f.lines {
+		if f.counts[line] > 0 {
+			hit++
+		}
+	}
+	return hit
+}
+
+// coverWriteLcov writes the lcov tracefile of the files, with the lines only,
+// as the profiles hold no functions, or branches.
+func coverWriteLcov(w io.Writer, files []coverReportFile) error {
+	for _, f := range files {
+		fmt.Fprintf(w, "TN:\nSF:%s\n", f.path)
+		for _, line := range f.lines {
+			fmt.Fprintf(w, "DA:%d,%d\n", line, f.counts[line])
+		}
+		if _, err := fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", len(f.lines), coverLinesHit(f)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// coverCobertura is the root of the Cobertura XML report, as the one of
+// gobinarycoverage report -format cobertura.
+type coverCobertura struct {
+	XMLName         xml.Name                `xml:"coverage"`
+	LineRate        float64                 `xml:"line-rate,attr"`
+	BranchRate      float64                 `xml:"branch-rate,attr"`
+	LinesCovered    int                     `xml:"lines-covered,attr"`
+	LinesValid      int                     `xml:"lines-valid,attr"`
+	BranchesCovered int                     `xml:"branches-covered,attr"`
+	BranchesValid   int                     `xml:"branches-valid,attr"`
+	Complexity      float64                 `xml:"complexity,attr"`
+	Version         string                  `xml:"version,attr"`
+	Timestamp       int64                   `xml:"timestamp,attr"`
+	Sources         []string                `xml:"sources>source"`
+	Packages        []coverCoberturaPackage `xml:"packages>package"`
+}
+
+type coverCoberturaPackage struct {
+	Name       string                `xml:"name,attr"`
+	LineRate   float64               `xml:"line-rate,attr"`
+	BranchRate float64               `xml:"branch-rate,attr"`
+	Complexity float64               `xml:"complexity,attr"`
+	Classes    []coverCoberturaClass `xml:"classes>class"`
+}
+
+type coverCoberturaClass struct {
+	Name       string               `xml:"name,attr"`
+	Filename   string               `xml:"filename,attr"`
+	LineRate   float64              `xml:"line-rate,attr"`
+	BranchRate float64              `xml:"branch-rate,attr"`
+	Complexity float64              `xml:"complexity,attr"`
+	Methods    struct{}             `xml:"methods"`
+	Lines      []coverCoberturaLine `xml:"lines>line"`
+}
+
+type coverCoberturaLine struct {
+	Number int    `xml:"number,attr"`
+	Hits   uint32 `xml:"hits,attr"`
+}
+
+// coverLineRate returns the rate of the lines covered, 1 if there are none, as
+// Cobertura does.
+func coverLineRate(covered, valid int) float64 {
+	if valid == 0 {
+		return 1
+	}
+	return float64(covered) / float64(valid)
+}
+
+// coverWriteCobertura writes the coverage of every line of the files as
+// Cobertura XML, with a package for every covered package, and a class for
+// every file of it.
+func coverWriteCobertura(w io.Writer, files []coverReportFile) error {
+	source := coverSourceRoot
+	if source == "" {
+		source = "."
+	}
+	c := coverCobertura{Version: coverTool, Timestamp: time.Now().UnixNano() / int64(time.Millisecond), Sources: []string{source}}
+	var pkg *coverCoberturaPackage
+	pkgCovered, pkgValid := 0, 0
+	closePackage := func() {
+		if pkg != nil {
+			pkg.LineRate = coverLineRate(pkgCovered, pkgValid)
+			c.Packages = append(c.Packages, *pkg)
+		}
+	}
+	for _, f := range files {
+		if pkg == nil || pkg.Name != path.Dir(f.name) {
+			closePackage()
+			pkg, pkgCovered, pkgValid = &coverCoberturaPackage{Name: path.Dir(f.name)}, 0, 0
+		}
+		class := coverCoberturaClass{Name: path.Base(f.name), Filename: f.path}
+		for _, line := range f.lines {
+			class.Lines = append(class.Lines, coverCoberturaLine{Number: line, Hits: f.counts[line]})
+		}
+		covered := coverLinesHit(f)
+		class.LineRate = coverLineRate(covered, len(f.lines))
+		pkg.Classes = append(pkg.Classes, class)
+		pkgCovered += covered
+		pkgValid += len(f.lines)
+		c.LinesCovered += covered
+		c.LinesValid += len(f.lines)
+	}
+	closePackage()
+	c.LineRate = coverLineRate(c.LinesCovered, c.LinesValid)
+	if _, err := io.WriteString(w, xml.Header+`<!DOCTYPE coverage SYSTEM "http://cobertura.sourceforge.net/xml/coverage-04.dtd">`+"\n"); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// coverJSONSummary is the percentage of the statements covered, per file, and
+// in total, of the packages counted in the total, as the summary line.
+type coverJSONSummary struct {
+	Label   string                 `json:"label"`
+	Mode    string                 `json:"mode"`
+	Covered int64                  `json:"covered"`
+	Total   int64                  `json:"total"`
+	Percent float64                `json:"percent"`
+	Files   []coverJSONSummaryFile `json:"files"`
+}
+
+type coverJSONSummaryFile struct {
+	File    string  `json:"file"` // The name in the profile
+	Path    string  `json:"path"` // The path of the source, relative to the root of the main module
+	Covered int64   `json:"covered"`
+	Total   int64   `json:"total"`
+	Percent float64 `json:"percent"`
+}
+
+// coverPercent returns the percentage of covered of total, 0 if there are none
+func coverPercent(covered, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(covered) / float64(total)
+}
+
+// coverWriteJSONSummary writes the summary of the coverage of the files, in
+// JSON.
+func coverWriteJSONSummary(w io.Writer, files []coverReportFile) error {
+	s := coverJSONSummary{Label: coverReportLabel(), Mode: coverMode}
+	s.Covered, s.Total = coverStatements()
+	s.Percent = coverPercent(s.Covered, s.Total)
+	for _, f := range files {
+		s.Files = append(s.Files, coverJSONSummaryFile{
+			File:    f.name,
+			Path:    f.path,
+			Covered: f.covered,
+			Total:   f.total,
+			Percent: coverPercent(f.covered, f.total),
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/mendersoftware/gobinarycoverage/coverage"
+)
+
+// This file is only merged into the main file of binaries which depend on the
+// helper package already, as it would otherwise add the dependency.
+
+// coverHandoffState is the coverage handed over to the process the binary
+// re-executes itself as, see coverage.BeforeExec.
+type coverHandoffState struct {
+	Counts   map[string][]uint32 `json:"counts"`
+	Counters map[string]uint64   `json:"counters,omitempty"`
+}
+
+func init() {
+	coverage.RegisterBeforeExec(coverHandoff)
+	coverReceiveHandoff()
+}
+
+// coverHandoff writes the coverage into a temporary file, and points
+// COVERAGE_HANDOFF at it, for the process the binary re-executes itself as,
+// which inherits the environment, to pick it up.
+func coverHandoff() {
+	state := coverHandoffState{Counts: make(map[string][]uint32, len(coverCounters))}
+	for name, counts := range coverCounters {
+		snapshot := make([]uint32, len(counts))
+		for i := range counts {
+			snapshot[i] = coverCount(counts, i)
+		}
+		state.Counts[name] = snapshot
+	}
+	if coverCustomCounters != nil {
+		state.Counters = coverCustomCounters()
+	}
+	contents, err := json.Marshal(state)
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to encode the coverage handed over. Error: %s\n", err.Error())
+		return
+	}
+	f, err := ioutil.TempFile("", "coverage-handoff*.json")
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to create the coverage handoff file. Error: %s\n", err.Error())
+		return
+	}
+	if _, err = f.Write(contents); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to write the coverage handoff file. Error: %s\n", err.Error())
+		os.Remove(f.Name())
+		return
+	}
+	// The file of a previous handoff, whose exec failed, is replaced
+	if previous := coverGetenv("HANDOFF"); previous != "" {
+		os.Remove(previous)
+	}
+	os.Setenv(coverEnvPrefix+"HANDOFF", f.Name())
+}
+
+// coverReceiveHandoff adds the coverage handed over by the process the binary
+// is re-executed from, if any, to the counters. The handoff file is removed,
+// and COVERAGE_HANDOFF is unset, so that it is not passed on again.
+func coverReceiveHandoff() {
+	path := coverGetenv("HANDOFF")
+	if path == "" {
+		return
+	}
+	os.Unsetenv(coverEnvPrefix + "HANDOFF")
+	defer os.Remove(path)
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to read the coverage handed over. Error: %s\n", err.Error())
+		return
+	}
+	state := coverHandoffState{}
+	if err = json.Unmarshal(contents, &state); err != nil {
+		fmt.Fprintf(coverLog(), "Failed to decode the coverage handed over. Error: %s\n", err.Error())
+		return
+	}
+	for name, handed := range state.Counts {
+		if !coverAddCounts(name, handed) {
+			// The binary re-executed is not the same
+			fmt.Fprintf(coverLog(), "coverage: the coverage of %s handed over does not match the binary, dropping it\n", name)
+		}
+	}
+	coverHandedOver = true
+	for name, n := range state.Counters {
+		coverage.NewCounter(name).Add(n)
+	}
+}
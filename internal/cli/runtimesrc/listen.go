@@ -0,0 +1,90 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/tabwriter"
+)
+
+// This file is only merged into the main file when instrumenting with -serve.
+
+// The coverage server is only started when COVERAGE_LISTEN is set, so that the
+// binaries are instrumented with it once, and it is opted into per run.
+func init() {
+	addr := coverGetenv("LISTEN")
+	if addr == "" {
+		return
+	}
+	coverServe(addr, "/coverage/profile", coverHandleProfile)
+	coverServe(addr, "/coverage/summary", coverHandleSummary)
+	coverServe(addr, "/coverage/reset", coverHandleReset)
+}
+
+// coverHandleProfile serves the coverage profile, as the counters are right
+// now, in the format of go test -coverprofile. It is not written to disk.
+func coverHandleProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Taken in full before it is sent, so that a slow client does not hold
+	// up the writing of the profiles, or a reset
+	var profile bytes.Buffer
+	coverFlushMu.Lock()
+	coverWriteText(&profile)
+	coverFlushMu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(profile.Bytes())
+}
+
+// coverHandleSummary serves the percentage of the statements covered per
+// package, and in total, as text, or as the snapshot of the live view, with
+// ?format=json.
+func coverHandleSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s := coverTakeSnapshot()
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+	for _, p := range s.Packages {
+		fmt.Fprintf(tw, "%s\t%d/%d\t%.1f%%\n", p.ImportPath, p.Covered, p.Total, p.Percent)
+	}
+	fmt.Fprintf(tw, "total:\t%d/%d\t%.1f%%\n", s.Covered, s.Total, s.Percent)
+	tw.Flush()
+}
+
+// coverHandleReset zeroes the counters, so that the coverage pulled next is
+// of the scenarios run after it only.
+func coverHandleReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	coverFlushMu.Lock()
+	coverReset()
+	coverFlushMu.Unlock()
+	fmt.Fprintln(w, "coverage: the counters are reset")
+}
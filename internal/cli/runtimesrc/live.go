@@ -0,0 +1,80 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+// This file is only merged into the main file when instrumenting with
+// -live-addr.
+
+// coverLiveAddr is the address the live view is served on, which is replaced
+// by the one given through -live-addr, and overridden by COVERAGE_LIVE_ADDR.
+var coverLiveAddr = ""
+
+func init() {
+	addr := coverLiveAddr
+	if a := coverGetenv("LIVE_ADDR"); a != "" {
+		addr = a
+	}
+	coverServe(addr, "/coverage/live", coverHandleLive)
+	coverServe(addr, "/coverage/live.json", coverHandleLiveJSON)
+}
+
+// coverLivePage is the live view, which reloads itself every other second
+var coverLivePage = template.Must(template.New("live").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="2">
+<title>Coverage: {{.Label}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+td { padding: 0.2em 1em 0.2em 0; }
+.bar { width: 20em; height: 0.8em; background: #e88; }
+.covered { height: 100%; background: #4b4; }
+</style>
+</head>
+<body>
+<h1>{{.Label}}: {{printf "%.1f" .Percent}}% ({{.Covered}}/{{.Total}} statements)</h1>
+<table>
+{{range .Packages}}<tr>
+<td>{{.ImportPath}}</td>
+<td><div class="bar"><div class="covered" style="width: {{printf "%.1f" .Percent}}%"></div></div></td>
+<td>{{printf "%.1f" .Percent}}%</td>
+<td>{{.Covered}}/{{.Total}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// coverHandleLive serves the live view of the coverage, as HTML
+func coverHandleLive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := coverLivePage.Execute(w, coverTakeSnapshot()); err != nil {
+		fmt.Fprintf(coverLog(), "coverage: failed to serve the live view. Error: %s\n", err.Error())
+	}
+}
+
+// coverHandleLiveJSON serves the snapshot of the coverage, as JSON
+func coverHandleLiveJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coverTakeSnapshot())
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// This file is only merged into the main file when instrumenting with -lock.
+
+// coverLockStale is the age past which the lock on the coverage directory is
+// taken to be left behind by a binary killed while holding it, and broken.
+// coverLockTimeout is how long the lock is waited for, before the profile is
+// written without it.
+const (
+	coverLockStale   = time.Minute
+	coverLockTimeout = 30 * time.Second
+)
+
+func init() {
+	if coverGetenv("LOCK") == "off" {
+		return
+	}
+	coverLockFlush = coverLockDir
+}
+
+// coverLockDir locks the coverage directory, see coverOutputDir, by creating
+// the lock file .coverage.lock in it exclusively, so that the binaries sharing
+// it write their profiles, persist their counters, and prune the profiles, one
+// at a time, and returns the function unlocking it. The lock is a file, rather
+// than flock, so that it works alike on every target, and on the network
+// filesystems. The profiles are written whether the lock is taken, or not, as
+// they never overwrite each other anyway, see coverProfileName.
+func coverLockDir() func() {
+	unlocked := func() {}
+	if coverStreaming() {
+		return unlocked
+	}
+	dir, err := coverOutputDir()
+	if err != nil {
+		// Writing the profile reports it
+		return unlocked
+	}
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	name := filepath.Join(dir, ".coverage.lock")
+	deadline := time.Now().Add(coverLockTimeout)
+	delay := 10 * time.Millisecond
+	for {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			host, _ := os.Hostname()
+			fmt.Fprintf(f, "%d %s\n", os.Getpid(), host)
+			f.Close()
+			return func() { os.Remove(name) }
+		}
+		if !os.IsExist(err) {
+			fmt.Fprintf(coverLog(), "Failed to lock the coverage directory, writing the profile without the lock. Error: %s\n", err.Error())
+			return unlocked
+		}
+		if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > coverLockStale && coverBreakLock(name) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			fmt.Fprintf(coverLog(), "Timed out waiting for the lock on the coverage directory, writing the profile without the lock: %s\n", name)
+			return unlocked
+		}
+		time.Sleep(delay)
+		if delay < 200*time.Millisecond {
+			delay *= 2
+		}
+	}
+}
+
+// coverBreakLock breaks the stale lock file name, and returns true if it is
+// broken. The lock may be taken afresh by another binary, which broke it first,
+// between finding it stale, and breaking it, so it is renamed away to a unique
+// name, which only one of the binaries breaking it succeeds in, and checked
+// again, rather than removed. A fresh lock renamed away is put back.
+func coverBreakLock(name string) bool {
+	broken := fmt.Sprintf("%s.broken.%d.%d", name, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(name, broken); err != nil {
+		// Broken, or released, by another binary, if it is gone
+		return os.IsNotExist(err)
+	}
+	if info, err := os.Stat(broken); err == nil && time.Since(info.ModTime()) <= coverLockStale {
+		// Linking it back fails if the lock is taken again meanwhile, in
+		// which case the one holding it now keeps it
+		if err = os.Link(broken, name); err != nil && !os.IsExist(err) {
+			os.Rename(broken, name)
+		}
+		os.Remove(broken)
+		return false
+	}
+	fmt.Fprintf(coverLog(), "Breaking the stale lock on the coverage directory: %s\n", name)
+	os.Remove(broken)
+	return true
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// This file is only merged into the main file when instrumenting with
+// -mqtt-broker.
+
+// The broker, and the topic, the profiles are published to, which are
+// replaced by the ones given through -mqtt-broker and -mqtt-topic, and
+// overridden by COVERAGE_MQTT_BROKER and COVERAGE_MQTT_TOPIC. Every device
+// publishes to the topic followed by its identity, e.g.,
+// gobinarycoverage/device-1.
+var (
+	coverMQTTBroker = ""
+	coverMQTTTopic  = "gobinarycoverage"
+)
+
+// coverMQTTTimeout bounds the publishing of a profile
+const coverMQTTTimeout = 10 * time.Second
+
+// coverMQTTMessage is the payload of the messages published, which is
+// ingested by gobinarycoverage collect -mqtt-broker.
+type coverMQTTMessage struct {
+	Device  string            `json:"device"`
+	Module  string            `json:"module,omitempty"`
+	Label   string            `json:"label,omitempty"`
+	Build   string            `json:"build,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	Format  string            `json:"format"`  // text, or compact
+	Profile []byte            `json:"profile"` // The contents of the profile file
+}
+
+func init() {
+	coverAfterFlush = append(coverAfterFlush, coverPublishMQTT)
+}
+
+// coverPublishMQTT publishes the profile written to the path profile
+func coverPublishMQTT(profile string) {
+	broker, topic := coverMQTTBroker, coverMQTTTopic
+	if s := coverGetenv("MQTT_BROKER"); s != "" {
+		broker = s
+	}
+	if s := coverGetenv("MQTT_TOPIC"); s != "" {
+		topic = s
+	}
+	contents, err := ioutil.ReadFile(profile)
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to read the coverage profile. Error: %s\n", err.Error())
+		return
+	}
+	msg := coverMQTTMessage{
+		Device:  coverDeviceID(),
+		Module:  coverModule,
+		Label:   coverReportLabel(),
+		Build:   coverBuild(),
+		Tags:    coverTags(),
+		Format:  "text",
+		Profile: contents,
+	}
+	if filepath.Ext(profile) == ".cov" {
+		msg.Format = "compact"
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	topic += "/" + msg.Device
+	if err = coverMQTTPublish(broker, topic, payload); err != nil {
+		fmt.Fprintf(coverLog(), "Failed to publish the coverage profile to %s. Error: %s\n", broker, err.Error())
+		return
+	}
+	fmt.Fprintf(coverLog(), "Published the coverage profile to %s, on %s\n", broker, topic)
+}
+
+// coverMQTTPublish publishes payload on topic, with QoS 1, to the MQTT 3.1.1
+// broker at addr, authenticating with COVERAGE_MQTT_USERNAME and
+// COVERAGE_MQTT_PASSWORD, if set.
+func coverMQTTPublish(addr, topic string, payload []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, coverMQTTTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(coverMQTTTimeout))
+	r := bufio.NewReader(conn)
+
+	// CONNECT, with a clean session, and a keep alive of 60 seconds
+	username, password := coverGetenv("MQTT_USERNAME"), coverGetenv("MQTT_PASSWORD")
+	flags := byte(0x02)
+	connect := coverMQTTString(nil, "MQTT")
+	connect = append(connect, 4, 0, 0, 60)
+	connect = coverMQTTString(connect, fmt.Sprintf("gbc-%d-%d", os.Getpid(), time.Now().UnixNano()))
+	if username != "" {
+		flags |= 0x80
+		connect = coverMQTTString(connect, username)
+	}
+	if password != "" {
+		flags |= 0x40
+		connect = coverMQTTString(connect, password)
+	}
+	connect[7] = flags
+	if err = coverMQTTWrite(conn, 0x10, connect); err != nil {
+		return err
+	}
+	packet, body, err := coverMQTTRead(r)
+	if err != nil {
+		return err
+	}
+	if packet>>4 != 2 || len(body) != 2 {
+		return errors.New("unexpected response to CONNECT")
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("the connection is refused, with the return code %d", body[1])
+	}
+
+	// PUBLISH, with QoS 1, and the packet identifier 1, acknowledged by PUBACK
+	publish := coverMQTTString(nil, topic)
+	publish = append(publish, 0, 1)
+	publish = append(publish, payload...)
+	if err = coverMQTTWrite(conn, 0x32, publish); err != nil {
+		return err
+	}
+	packet, body, err = coverMQTTRead(r)
+	if err != nil {
+		return err
+	}
+	if packet>>4 != 4 || len(body) != 2 || binary.BigEndian.Uint16(body) != 1 {
+		return errors.New("unexpected response to PUBLISH")
+	}
+	return coverMQTTWrite(conn, 0xe0, nil)
+}
+
+// coverMQTTString appends the length prefixed string s to b
+func coverMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// coverMQTTWrite writes the packet of type, and flags, header, with body
+func coverMQTTWrite(w io.Writer, header byte, body []byte) error {
+	// The remaining length is encoded 7 bits at a time, as a uvarint
+	var length [binary.MaxVarintLen64]byte
+	packet := append([]byte{header}, length[:binary.PutUvarint(length[:], uint64(len(body)))]...)
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+// coverMQTTRead reads a packet, and returns its header, and body
+func coverMQTTRead(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
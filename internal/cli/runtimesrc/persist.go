@@ -0,0 +1,180 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// This file is only merged into the main file when instrumenting with
+// -persist.
+
+// coverPersist is the path of the file the counters are persisted in, which
+// is replaced by the one given through -persist, and overridden by
+// COVERAGE_PERSIST.
+var coverPersist = ""
+
+func init() {
+	path := coverPersist
+	if p := coverGetenv("PERSIST"); p != "" {
+		path = p
+	}
+	// The coverage handed over holds the coverage persisted already
+	if !coverHandedOver {
+		coverLoadPersisted(path)
+	}
+	coverBeforeFlush = append(coverBeforeFlush, func() { coverSavePersisted(path) })
+}
+
+// coverLoadPersisted adds the counters persisted at path, by an earlier run
+// of the binary, to the counters, so that the profiles written accumulate the
+// coverage of all the runs, e.g., across the reboots of a device. The files
+// which have changed since, e.g., in an update, are dropped.
+func coverLoadPersisted(path string) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to read the persisted coverage. Error: %s\n", err.Error())
+		return
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, 5)
+	if _, err = io.ReadFull(r, magic); err != nil || string(magic) != "GBCS\x01" {
+		fmt.Fprintf(coverLog(), "Failed to read the persisted coverage. Error: %s is not a persisted coverage file\n", path)
+		return
+	}
+	files, err := binary.ReadUvarint(r)
+	for ; err == nil && files > 0; files-- {
+		var name string
+		var hash uint64
+		var counts []uint32
+		if name, hash, counts, err = coverReadPersistedFile(r); err != nil {
+			break
+		}
+		if hash != coverBlocksHash(name) || !coverAddCounts(name, counts) {
+			fmt.Fprintf(coverLog(), "coverage: the persisted coverage of %s does not match the binary, dropping it\n", name)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to read the persisted coverage. Error: %s\n", err.Error())
+		return
+	}
+	fmt.Fprintf(coverLog(), "Loaded the persisted coverage from the file: %s\n", path)
+}
+
+// coverReadPersistedFile reads the name, the hash of the blocks, and the
+// counts, of a file persisted by coverSavePersisted.
+func coverReadPersistedFile(r *bufio.Reader) (string, uint64, []uint32, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if n > 1<<16 {
+		return "", 0, nil, errors.New("malformed file name")
+	}
+	name := make([]byte, n)
+	if _, err = io.ReadFull(r, name); err != nil {
+		return "", 0, nil, err
+	}
+	var hash uint64
+	if err = binary.Read(r, binary.LittleEndian, &hash); err != nil {
+		return "", 0, nil, err
+	}
+	if n, err = binary.ReadUvarint(r); err != nil {
+		return "", 0, nil, err
+	}
+	if n > 1<<24 {
+		return "", 0, nil, fmt.Errorf("malformed number of counters of %s", name)
+	}
+	counts := make([]uint32, n)
+	for i := range counts {
+		count, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		counts[i] = uint32(count)
+	}
+	return string(name), hash, counts, nil
+}
+
+// coverSavePersisted writes the counters to the file at path, replacing it
+// atomically, so that a reboot while it is written leaves the previous one.
+//
+// The format is the magic "GBCS", the version 1, and the number of files as a
+// uvarint, followed by every file: the length of its name as a uvarint, the
+// name, the hash of its blocks, see coverBlocksHash, as 8 bytes in little
+// endian, the number of its counters as a uvarint, and every count as a
+// uvarint.
+func coverSavePersisted(path string) {
+	var buf bytes.Buffer
+	buf.WriteString("GBCS\x01")
+	var varint [binary.MaxVarintLen64]byte
+	uvarint := func(v uint64) {
+		buf.Write(varint[:binary.PutUvarint(varint[:], v)])
+	}
+	uvarint(uint64(len(coverFiles)))
+	for _, name := range coverFiles {
+		uvarint(uint64(len(name)))
+		buf.WriteString(name)
+		binary.Write(&buf, binary.LittleEndian, coverBlocksHash(name))
+		counts := coverCounters[name]
+		uvarint(uint64(len(counts)))
+		for i := range counts {
+			uvarint(uint64(coverCount(counts, i)))
+		}
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"*")
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to persist the coverage. Error: %s\n", err.Error())
+		return
+	}
+	if _, err = f.Write(buf.Bytes()); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		fmt.Fprintf(coverLog(), "Failed to persist the coverage. Error: %s\n", err.Error())
+	}
+}
+
+// coverBlocksHash returns the hash of the positions, and the number of
+// statements, of the blocks of the file name, which tells whether the counters
+// persisted by another build of the binary count the same blocks.
+func coverBlocksHash(name string) uint64 {
+	h := fnv.New64a()
+	for _, b := range coverBlocks[name] {
+		binary.Write(h, binary.LittleEndian, b)
+	}
+	return h.Sum64()
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"runtime/pprof"
+)
+
+// This file is only merged into the main file when instrumenting with -pprof.
+
+// coverPprofPath is the page of the coverage, next to the profiles served by
+// net/http/pprof on the default mux.
+const coverPprofPath = "/debug/pprof/coverage"
+
+func init() {
+	// The index of net/http/pprof lists the registered profiles, so the
+	// (empty) coverage profile puts the link to the page in it. The page is
+	// served by the handler below, instead of the one of the profile.
+	if pprof.Lookup("coverage") == nil {
+		pprof.NewProfile("coverage")
+	}
+	http.HandleFunc(coverPprofPath, coverHandlePprof)
+	http.HandleFunc(coverPprofPath+"/dump", coverHandlePprofDump)
+	http.HandleFunc(coverPprofPath+"/reset", coverHandlePprofReset)
+}
+
+// coverHandlePprof serves the page of the coverage, with the buttons writing
+// the profile, and resetting the counters.
+func coverHandlePprof(w http.ResponseWriter, r *http.Request) {
+	covered, total := coverStatements()
+	percent := 0.0
+	if total > 0 {
+		percent = 100 * float64(covered) / float64(total)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head><title>/debug/pprof/coverage</title></head>
+<body>
+<p>%s: %.1f%% of statements (%d/%d)</p>
+<form method="post" action="%s/dump"><button>Write the coverage profile</button></form>
+<form method="post" action="%s/reset"><button>Reset the counters</button></form>
+<p><a href="/debug/pprof/">Back to the index</a></p>
+</body>
+</html>
+`, html.EscapeString(coverReportLabel()), percent, covered, total, coverPprofPath, coverPprofPath)
+}
+
+// coverHandlePprofDump writes the coverage profile, and responds with its path
+func coverHandlePprofDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	profile, err := coverFlush()
+	if err != nil {
+		http.Error(w, "failed to write the coverage profile: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, profile)
+}
+
+// coverHandlePprofReset zeroes the counters
+func coverHandlePprofReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	coverReset()
+	fmt.Fprintln(w, "The coverage counters are reset")
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import "sync/atomic"
+
+// coverBlock is a block of a covered file, as testing.CoverBlock. It is
+// defined here, so that the instrumented binary does not import testing, which
+// registers its -test.* flags in some configurations, changing the flags of the
+// program.
+type coverBlock struct {
+	Line0 uint32 // Line number for block start.
+	Col0  uint16 // Column number for block start.
+	Line1 uint32 // Line number for block end.
+	Col1  uint16 // Column number for block end.
+	Stmts uint16 // Number of statements included in this block.
+}
+
+var (
+	coverCounters = make(map[string][]uint32)
+	coverBlocks   = make(map[string][]coverBlock)
+	coverFiles    []string // The files, in the order they are registered
+
+	// coverHandedOver is set once the coverage handed over by the process the
+	// binary is re-executed from is added to the counters, see handoff.go,
+	// as it holds the coverage persisted by it already, see persist.go.
+	coverHandedOver bool
+)
+
+// coverRegisterFile is called from the generated init function, once for every
+// GoCover variable in the covered packages.
+func coverRegisterFile(fileName string, counter []uint32, pos []uint32, numStmts []uint16) {
+	if 3*len(counter) != len(pos) || len(counter) != len(numStmts) {
+		panic("coverage: mismatched sizes")
+	}
+	if coverCounters[fileName] != nil {
+		// Already registered.
+		return
+	}
+	coverCounters[fileName] = counter
+	coverFiles = append(coverFiles, fileName)
+	block := make([]coverBlock, len(counter))
+	for i := range counter {
+		block[i] = coverBlock{
+			Line0: pos[3*i+0],
+			Col0:  uint16(pos[3*i+2]),
+			Line1: pos[3*i+1],
+			Col1:  uint16(pos[3*i+2] >> 16),
+			Stmts: numStmts[i],
+		}
+	}
+	coverBlocks[fileName] = block
+}
+
+// coverCount returns the i'th count of counts. The counters are loaded
+// atomically, as they are incremented atomically in the atomic mode.
+func coverCount(counts []uint32, i int) uint32 {
+	return atomic.LoadUint32(&counts[i])
+}
+
+// coverAddCounts adds counts, of an earlier process, to the counters of the
+// file name, or sets them, in the set mode. It returns false, leaving the
+// counters as they are, if the file has a different number of them, i.e., the
+// earlier process is not the same binary.
+func coverAddCounts(name string, counts []uint32) bool {
+	counters := coverCounters[name]
+	if len(counters) != len(counts) {
+		return false
+	}
+	for i, count := range counts {
+		if coverMode == "set" {
+			if count > 0 {
+				atomic.StoreUint32(&counters[i], 1)
+			}
+			continue
+		}
+		atomic.AddUint32(&counters[i], count)
+	}
+	return true
+}
+
+// coverReset zeroes all the counters, e.g., in order to measure the coverage
+// of a single scenario.
+func coverReset() {
+	for _, counts := range coverCounters {
+		for i := range counts {
+			atomic.StoreUint32(&counts[i], 0)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coverCustomCounters returns the custom counters registered through the
+// helper package, or is nil if the binary does not use it. See counters.go.
+var coverCustomCounters func() map[string]uint64
+
+// The hooks of the optional parts of the runtime, which are called before the
+// coverage profile is written, and with its path after it is written.
+var (
+	coverBeforeFlush []func()
+	coverAfterFlush  []func(profile string)
+)
+
+// coverCompanions are the suffixes of the files written next to the coverage
+// profile, as <profile><suffix>, e.g., the sidecar, which are removed along
+// with it.
+var coverCompanions = []string{".json"}
+
+// coverSidecarSchema is the version of the format of the sidecar, as
+// profile.SidecarSchema. It is bumped whenever the profiles change in a way the
+// readers of the older versions can not merge them safely.
+const coverSidecarSchema = 1
+
+// coverSidecar is written next to the coverage profile, as <profile>.json,
+// and holds what does not fit in the profile format: the schema of the
+// sidecar, the version of gobinarycoverage, and the mode, the profile is
+// written by, so that the profiles of binaries instrumented by different
+// versions are merged safely, the build of the binary, so that the profiles
+// of different builds are not, the tags the reports filter the profiles by,
+// and the coverage beyond the statements.
+type coverSidecar struct {
+	Schema   int               `json:"schema"`
+	Tool     string            `json:"tool,omitempty"`
+	Mode     string            `json:"mode"`
+	Build    string            `json:"build,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Counters map[string]uint64 `json:"counters,omitempty"`
+	Sample   float64           `json:"sample,omitempty"`
+	Total    []string          `json:"total_packages,omitempty"`
+}
+
+// coverWriteProfile writes the coverage profile into dir, and returns its
+// path. It writes the text format of go test -coverprofile, unless the
+// compact format is linked in, see compact.go.
+var coverWriteProfile = coverWriteTextProfile
+
+// coverWriteSinks writes the coverage profile, written to the path profile, if
+// any, to the sinks registered through the helper package, or is nil if the
+// binary does not use it. See sinks.go.
+var coverWriteSinks func(profile string)
+
+// coverCloseSinks closes the sinks registered through the helper package, once
+// the last profile is written, or is nil if the binary does not use it.
+var coverCloseSinks func()
+
+// coverFallbackSink writes the coverage profile somewhere else than to a file,
+// when no directory is writable, and returns where it is written to, or is nil
+// if there is nowhere else to write it. See syslog.go.
+var coverFallbackSink func() (string, error)
+
+// coverFlushMu serializes the writing of the coverage profiles
+var coverFlushMu sync.Mutex
+
+// coverLockFlush locks the coverage directory against the other binaries
+// writing into it, and returns the function unlocking it, or is nil if the
+// directory is not locked. See lock.go.
+var coverLockFlush func() (unlock func())
+
+// coverWindow names the window of time the counters are of in the profile
+// names, when the profiles are rotated, see rotate.go. It is guarded by
+// coverFlushMu.
+var coverWindow = ""
+
+// coverReportOnce writes the coverage once, as the first of main returning,
+// an exit, a signal, or an explicit call of coverReport, comes. The others
+// wait for it to be written, rather than skipping it, so that the binary does
+// not exit while another goroutine, e.g., the one handling a signal, is still
+// writing it.
+var coverReportOnce sync.Once
+
+// coverReport writes the coverage profile to a file in COVERAGE_FILEPATH, see
+// coverOutputDir. It is called as the main function of the instrumented binary
+// returns, or exits through os.Exit, and can be called explicitly before it
+// exits in any other way. The coverage is only written by the first call, and
+// the calls after it return once it is written.
+func coverReport() {
+	coverReportOnce.Do(func() {
+		coverFlush()
+		if coverCloseSinks != nil {
+			coverCloseSinks()
+		}
+	})
+}
+
+// coverMainReturned is deferred by the generated main function, which runs the
+// original one, so that the coverage is written as it returns, panics, or its
+// goroutine exits through runtime.Goexit, unless it is written already.
+func coverMainReturned() {
+	coverReport()
+}
+
+// coverExit writes the coverage, unless it is written already, and exits with
+// code. The uses of os.Exit in the main file are routed through it, as the
+// deferred functions do not run on os.Exit.
+func coverExit(code int) {
+	coverMainReturned()
+	os.Exit(code)
+}
+
+// coverLogFatal, coverLogFatalf and coverLogFatalln are log.Fatal, log.Fatalf
+// and log.Fatalln, writing the coverage before exiting. The uses of them in the
+// main file are routed through these. The message is logged at the position of
+// the caller, as by the originals.
+func coverLogFatal(v ...interface{}) {
+	log.Output(2, fmt.Sprint(v...))
+	coverExit(1)
+}
+
+func coverLogFatalf(format string, v ...interface{}) {
+	log.Output(2, fmt.Sprintf(format, v...))
+	coverExit(1)
+}
+
+func coverLogFatalln(v ...interface{}) {
+	log.Output(2, fmt.Sprintln(v...))
+	coverExit(1)
+}
+
+// coverFlush writes the coverage profile, and returns the path of it. The
+// profile is written to the sinks registered as well, whether it could be
+// written, or not. Nothing is written if none of the blocks is sampled, as
+// the profile would be empty, and the path is "".
+func coverFlush() (string, error) {
+	coverFlushMu.Lock()
+	defer coverFlushMu.Unlock()
+	if coverSample != "" && coverBlockCount() == 0 {
+		fmt.Fprintf(coverLog(), "coverage: none of the blocks is sampled at %s%%, so no profile is written\n", coverSample)
+		return "", nil
+	}
+	if coverLockFlush != nil {
+		defer coverLockFlush()()
+	}
+	for _, hook := range coverBeforeFlush {
+		hook()
+	}
+	profile, err := coverWriteAll()
+	if coverWriteSinks != nil {
+		coverWriteSinks(profile)
+	}
+	return profile, err
+}
+
+// coverWriteAll writes the coverage profile, streams it, or writes it to the
+// fallback sink, and returns where it is written to. It must be called with
+// coverFlushMu held.
+func coverWriteAll() (string, error) {
+	if coverStreaming() {
+		return coverWriteStream()
+	}
+	profile, err := coverWriteWithRetries()
+	if err != nil {
+		if coverFallbackSink == nil {
+			return "", err
+		}
+		return coverFallbackSink()
+	}
+
+	active, total := coverStatements()
+	if total == 0 {
+		fmt.Fprintln(coverLog(), "coverage: [no statements]")
+		return profile, nil
+	}
+	label := coverReportLabel()
+	if coverTotal != "" {
+		label += " (of the packages counted in the total)"
+	}
+	if coverSample != "" {
+		// Only the blocks sampled are counted, so the percentage of them
+		// covered is an estimate of the coverage of all of them
+		fmt.Fprintf(coverLog(), "coverage: ~%.1f%% of statements %s (extrapolated from the %s%% sampled)\n",
+			100*float64(active)/float64(total), label, coverSample)
+	} else {
+		fmt.Fprintf(coverLog(), "coverage: %.1f%% of statements %s\n", 100*float64(active)/float64(total), label)
+	}
+	fmt.Fprintf(coverLog(), "Wrote coverage to the file: %s\n", profile)
+	coverWriteSidecar(profile)
+	for _, hook := range coverAfterFlush {
+		hook(profile)
+	}
+	return profile, nil
+}
+
+// coverWriteRetries is the number of times writing the profile is retried,
+// unless it is set through COVERAGE_WRITE_RETRIES, and coverWriteBackoff the
+// delay before the first retry, which is doubled for every retry after it.
+const (
+	coverWriteRetries = 3
+	coverWriteBackoff = 100 * time.Millisecond
+)
+
+// coverWriteWithRetries writes the coverage profile into the coverage
+// directory, see coverOutputDir, and returns its path. Writing it is retried,
+// as networked filesystems, e.g., NFS or 9p shares in virtual machines, can
+// fail transiently. If all the retries fail, the profile is written into
+// COVERAGE_FALLBACK_FILEPATH, or the temporary directory, instead, rather than
+// losing the coverage of the whole run.
+func coverWriteWithRetries() (string, error) {
+	retries := coverWriteRetries
+	if s := coverGetenv("WRITE_RETRIES"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			retries = n
+		}
+	}
+	backoff := coverWriteBackoff
+	for attempt := 0; ; attempt++ {
+		dir, err := coverOutputDir()
+		if err != nil {
+			fmt.Fprintf(coverLog(), "Failed to create the coverage directory. Error: %s\n", err.Error())
+		} else if profile, err := coverWriteProfile(dir); err == nil {
+			return profile, nil
+		} else if profile != "" {
+			// Do not leave the partial profile behind
+			os.Remove(profile)
+		}
+		if attempt == retries {
+			break
+		}
+		fmt.Fprintf(coverLog(), "Retrying writing the coverage profile in %s\n", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	fallback := coverGetenv("FALLBACK_FILEPATH")
+	if fallback == "" {
+		fallback = os.TempDir()
+	}
+	fmt.Fprintf(coverLog(), "Failed to write the coverage profile to the coverage directory, writing it to %s instead\n", fallback)
+	if err := os.MkdirAll(fallback, 0755); err != nil {
+		fmt.Fprintf(coverLog(), "Failed to create the coverage directory. Error: %s\n", err.Error())
+		return "", err
+	}
+	return coverWriteProfile(fallback)
+}
+
+// coverStatements returns the number of statements covered, and in total, of
+// the packages counted in the total, see coverCounted
+func coverStatements() (covered, total int64) {
+	for name, counts := range coverCounters {
+		if !coverCounted(path.Dir(name)) {
+			continue
+		}
+		blocks := coverBlocks[name]
+		for i := range counts {
+			total += int64(blocks[i].Stmts)
+			if coverCount(counts, i) > 0 {
+				covered += int64(blocks[i].Stmts)
+			}
+		}
+	}
+	return covered, total
+}
+
+// coverBlockCount returns the number of the blocks instrumented in all the
+// files registered.
+func coverBlockCount() int {
+	n := 0
+	for _, blocks := range coverBlocks {
+		n += len(blocks)
+	}
+	return n
+}
+
+// coverWriteTextProfile writes the coverage profile into dir, in the format of
+// go test -coverprofile.
+func coverWriteTextProfile(dir string) (string, error) {
+	profile := coverProfileName(dir, ".out")
+	reportFile, err := coverCreateTemp(profile)
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to create the coverage profile. Error: %s\n", err.Error())
+		return "", err
+	}
+
+	w := bufio.NewWriter(reportFile)
+	coverWriteText(w)
+	if err = w.Flush(); err != nil {
+		reportFile.Close()
+		os.Remove(reportFile.Name())
+		fmt.Fprintf(coverLog(), "Failed to write the coverage profile. Error: %s\n", err.Error())
+		return "", err
+	}
+	if err = coverCommit(reportFile, profile); err != nil {
+		return "", err
+	}
+	return profile, nil
+}
+
+// coverProfileName returns the path of a new profile in dir, or in the
+// temporary directory, if dir is empty, with the extension ext. The name is
+// unique to the process, and the time the profile is written at, with a random
+// part, so that the binaries writing into a shared directory at once, or the
+// processes a binary forks, never overwrite each other's profiles:
+// <prefix><pid>-<unix time in nanoseconds>-<random><ext>.
+func coverProfileName(dir, ext string) string {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	var random [4]byte
+	rand.Read(random[:])
+	name := fmt.Sprintf("%s%d-%d-%x%s", coverProfilePrefix(), os.Getpid(), time.Now().UnixNano(), random[:], ext)
+	return filepath.Join(dir, name)
+}
+
+// coverCreateTemp creates the hidden temporary file next to name, which is
+// written, and renamed to name once it is complete, by coverCommit, so that the
+// readers of the coverage directory never see name half written, nor anything
+// written over it. The temporary files are named .<name><random>.tmp, which
+// the patterns of the profiles, e.g., coverage*.out, do not match.
+func coverCreateTemp(name string) (*os.File, error) {
+	return ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+"*.tmp")
+}
+
+// coverCommit syncs, and closes, the temporary file f, created by
+// coverCreateTemp, and renames it to name, which is atomic within a
+// filesystem. f is removed if any of it fails.
+func coverCommit(f *os.File, name string) error {
+	err := coverSyncClose(f)
+	if err == nil {
+		if err = os.Rename(f.Name(), name); err != nil {
+			fmt.Fprintf(coverLog(), "Failed to rename %s to %s. Error: %s\n", f.Name(), name, err.Error())
+		}
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// coverWriteText writes the coverage profile to w, in the format of go test
+// -coverprofile.
+func coverWriteText(w io.Writer) {
+	fmt.Fprintf(w, "mode: %s\n", coverMode)
+
+	for name, counts := range coverCounters {
+		blocks := coverBlocks[name]
+		for i := range counts {
+			fmt.Fprintf(w, "%s:%d.%d,%d.%d %d %d\n", name,
+				blocks[i].Line0, blocks[i].Col0,
+				blocks[i].Line1, blocks[i].Col1,
+				blocks[i].Stmts,
+				coverCount(counts, i))
+		}
+	}
+}
+
+// coverSyncClose syncs, and closes, the profile f. Make sure the profile lands
+// on disk, as volumes mounted into containers may buffer the writes past the
+// exit of the binary.
+func coverSyncClose(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		fmt.Fprintf(coverLog(), "Failed to sync the coverage profile. Error: %s\n", err.Error())
+	}
+	if err := f.Close(); err != nil {
+		fmt.Fprintf(coverLog(), "Failed to write the coverage profile. Error: %s\n", err.Error())
+		return err
+	}
+	return nil
+}
+
+// coverSidecarJSON returns the sidecar of the coverage profile, in JSON
+func coverSidecarJSON() ([]byte, error) {
+	sidecar := coverSidecar{
+		Schema: coverSidecarSchema,
+		Tool:   coverTool,
+		Mode:   coverMode,
+		Build:  coverBuild(),
+		Tags:   coverTags(),
+	}
+	if coverCustomCounters != nil {
+		sidecar.Counters = coverCustomCounters()
+	}
+	sidecar.Sample, _ = strconv.ParseFloat(coverSample, 64)
+	if coverTotal != "" {
+		sidecar.Total = strings.Split(coverTotal, ",")
+	}
+	return json.MarshalIndent(sidecar, "", "  ")
+}
+
+// coverWriteSidecar writes the sidecar of the coverage profile at profile
+func coverWriteSidecar(profile string) {
+	contents, err := coverSidecarJSON()
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to encode the coverage sidecar. Error: %s\n", err.Error())
+		return
+	}
+	f, err := coverCreateTemp(profile + ".json")
+	if err == nil {
+		if _, err = f.Write(append(contents, '\n')); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		} else {
+			err = coverCommit(f, profile+".json")
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to write the coverage sidecar. Error: %s\n", err.Error())
+		return
+	}
+	fmt.Fprintf(coverLog(), "Wrote the sidecar to the file: %s.json\n", profile)
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This file is only merged into the main file when instrumenting with
+// -max-profiles, or -max-profiles-size.
+
+// The limits of the profiles kept in the coverage directory, which are
+// replaced by the ones given when instrumenting, and overridden by
+// COVERAGE_MAX_PROFILES and COVERAGE_MAX_PROFILES_SIZE. Zero is no limit.
+var (
+	coverMaxProfiles     = "0" // The number of profiles
+	coverMaxProfilesSize = "0" // The total size of the profiles, and their sidecars, in bytes
+)
+
+func init() {
+	maxProfiles := coverLimit("MAX_PROFILES", coverMaxProfiles)
+	maxSize := coverLimit("MAX_PROFILES_SIZE", coverMaxProfilesSize)
+	if maxProfiles == 0 && maxSize == 0 {
+		return
+	}
+	coverAfterFlush = append(coverAfterFlush, func(profile string) {
+		coverPruneProfiles(profile, maxProfiles, maxSize)
+	})
+}
+
+// coverLimit returns the limit in the environment variable name, or value, if
+// it is not set.
+func coverLimit(name, value string) int64 {
+	if s := coverGetenv(name); s != "" {
+		value = s
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit < 0 {
+		fmt.Fprintf(coverLog(), "Invalid %s%s: %q, the profiles are not limited by it\n", coverEnvPrefix, name, value)
+		return 0
+	}
+	return limit
+}
+
+// coverProfileFile is a profile in the coverage directory
+type coverProfileFile struct {
+	path string
+	size int64 // Including the sidecar, and the other companions
+	info os.FileInfo
+}
+
+// coverPruneProfiles removes the oldest profiles next to profile, and their
+// sidecars, and other companions, until there are at most maxProfiles of them, and they take at
+// most maxSize bytes. The profile just written is always kept.
+func coverPruneProfiles(profile string, maxProfiles, maxSize int64) {
+	dir := filepath.Dir(profile)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to list the coverage profiles. Error: %s\n", err.Error())
+		return
+	}
+	prefix := "coverage" + coverGetenv("FILENAME")
+	var profiles []coverProfileFile
+	for _, info := range entries {
+		name := info.Name()
+		ext := filepath.Ext(name)
+		if !info.Mode().IsRegular() || !strings.HasPrefix(name, prefix) || ext != ".out" && ext != ".cov" {
+			continue
+		}
+		p := coverProfileFile{path: filepath.Join(dir, name), size: info.Size(), info: info}
+		for _, suffix := range coverCompanions {
+			if companion, err := os.Stat(p.path + suffix); err == nil {
+				p.size += companion.Size()
+			}
+		}
+		profiles = append(profiles, p)
+	}
+	// Newest first
+	sort.Slice(profiles, func(i, j int) bool {
+		if !profiles[i].info.ModTime().Equal(profiles[j].info.ModTime()) {
+			return profiles[i].info.ModTime().After(profiles[j].info.ModTime())
+		}
+		return profiles[i].path > profiles[j].path
+	})
+	// Once a limit is reached, all the older profiles are removed
+	var kept, size int64
+	full := false
+	for _, p := range profiles {
+		written := filepath.Base(p.path) == filepath.Base(profile)
+		if !written {
+			full = full || maxProfiles > 0 && kept >= maxProfiles || maxSize > 0 && size+p.size > maxSize
+		}
+		if !full || written {
+			kept++
+			size += p.size
+			continue
+		}
+		if err = os.Remove(p.path); err != nil {
+			fmt.Fprintf(coverLog(), "Failed to remove the coverage profile. Error: %s\n", err.Error())
+			continue
+		}
+		for _, suffix := range coverCompanions {
+			os.Remove(p.path + suffix)
+		}
+		fmt.Fprintf(coverLog(), "Removed the coverage profile %s, in order to stay within the limits\n", p.path)
+	}
+}
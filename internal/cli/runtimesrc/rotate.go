@@ -0,0 +1,79 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"fmt"
+	"time"
+)
+
+// This file is only merged into the main file when instrumenting with -rotate.
+
+// coverRotate is the interval the profiles are rotated at, i.e., hourly,
+// daily, or a duration, which is replaced by the one given through -rotate,
+// and overridden by COVERAGE_ROTATE.
+var coverRotate = ""
+
+func init() {
+	rotate := coverRotate
+	if s := coverGetenv("ROTATE"); s != "" {
+		rotate = s
+	}
+	interval, err := coverRotateInterval(rotate)
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to rotate the coverage profiles. Error: %s\n", err.Error())
+		return
+	}
+	coverFlushMu.Lock()
+	coverWindow = coverWindowName(time.Now().Truncate(interval))
+	coverFlushMu.Unlock()
+	go coverRotateProfiles(interval)
+}
+
+// coverRotateInterval parses the rotation interval s
+func coverRotateInterval(s string) (time.Duration, error) {
+	switch s {
+	case "hourly":
+		return time.Hour, nil
+	case "daily":
+		return 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("the interval has to be positive: %s", s)
+	}
+	return d, err
+}
+
+// coverWindowName names the window starting at start in the profile names, so
+// that they sort in the order of the windows.
+func coverWindowName(start time.Time) string {
+	return "-" + start.UTC().Format("20060102T150405Z") + "-"
+}
+
+// coverRotateProfiles writes the coverage profile at the end of every window
+// of interval, aligned to UTC, and resets the counters, so that every profile
+// holds the coverage of its own window only.
+func coverRotateProfiles(interval time.Duration) {
+	for {
+		next := time.Now().Truncate(interval).Add(interval)
+		time.Sleep(time.Until(next))
+		coverFlush()
+		coverFlushMu.Lock()
+		coverReset()
+		coverWindow = coverWindowName(next)
+		coverFlushMu.Unlock()
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+)
+
+// This file is only merged into the main file when instrumenting with one of
+// the options serving an endpoint, i.e., -dump-addr, -live-addr and -serve.
+
+var (
+	coverServeMu    sync.Mutex
+	coverServeMuxes = make(map[string]*http.ServeMux)
+)
+
+// coverServe serves handler at pattern on addr. The endpoints on the same
+// address share a server, which is started along with the first of them.
+func coverServe(addr, pattern string, handler http.HandlerFunc) {
+	coverServeMu.Lock()
+	defer coverServeMu.Unlock()
+	mux, ok := coverServeMuxes[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		coverServeMuxes[addr] = mux
+		go func() {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				fmt.Fprintf(coverLog(), "coverage: the endpoints on %s failed. Error: %s\n", addr, err.Error())
+			}
+		}()
+	}
+	mux.HandleFunc(pattern, handler)
+}
+
+// coverLiveSnapshot is the coverage of the running binary, per package
+type coverLiveSnapshot struct {
+	Label    string             `json:"label"`
+	Covered  int64              `json:"covered"`
+	Total    int64              `json:"total"`
+	Percent  float64            `json:"percent"`
+	Packages []coverLivePackage `json:"packages"`
+}
+
+type coverLivePackage struct {
+	ImportPath string  `json:"import_path"`
+	Covered    int64   `json:"covered"`
+	Total      int64   `json:"total"`
+	Percent    float64 `json:"percent"`
+}
+
+// coverTakeSnapshot sums up the counters of every covered package, as they are
+// right now.
+func coverTakeSnapshot() coverLiveSnapshot {
+	s := coverLiveSnapshot{Label: coverReportLabel()}
+	packages := make(map[string]*coverLivePackage)
+	for name, counts := range coverCounters {
+		p, ok := packages[path.Dir(name)]
+		if !ok {
+			p = &coverLivePackage{ImportPath: path.Dir(name)}
+			packages[p.ImportPath] = p
+		}
+		blocks := coverBlocks[name]
+		for i := range counts {
+			p.Total += int64(blocks[i].Stmts)
+			if coverCount(counts, i) > 0 {
+				p.Covered += int64(blocks[i].Stmts)
+			}
+		}
+	}
+	for _, p := range packages {
+		if p.Total > 0 {
+			p.Percent = 100 * float64(p.Covered) / float64(p.Total)
+		}
+		if coverCounted(p.ImportPath) {
+			s.Covered += p.Covered
+			s.Total += p.Total
+		}
+		s.Packages = append(s.Packages, *p)
+	}
+	if s.Total > 0 {
+		s.Percent = 100 * float64(s.Covered) / float64(s.Total)
+	}
+	sort.Slice(s.Packages, func(i, j int) bool {
+		return s.Packages[i].ImportPath < s.Packages[j].ImportPath
+	})
+	return s
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// This file is only merged into the main file when instrumenting with
+// -flush-on-sigterm, -exit-signals, or -flush-signals.
+
+// coverExitSignals, and coverFlushSignals, are the comma separated numbers of
+// the signals on which the coverage is written, and the binary exits, or keeps
+// running, respectively. They are replaced by the ones given through
+// -exit-signals, along with SIGTERM for -flush-on-sigterm, and -flush-signals,
+// as numbered on the platform instrumented for.
+var (
+	coverExitSignals  = ""
+	coverFlushSignals = ""
+)
+
+// coverFlushBudget bounds the time spent writing the coverage on the exit
+// signals, before the binary is terminated by the signal, unless it is set
+// through COVERAGE_FLUSH_BUDGET. Container runtimes send SIGKILL after a grace
+// period, which is 10 seconds by default in both docker and Kubernetes.
+const coverFlushBudget = 5 * time.Second
+
+// coverHandledSignals are the signals the program handles itself, as
+// registered through the uses of signal.Notify, and signal.NotifyContext, in
+// the main file, which are routed through coverSignalNotify, and
+// coverSignalNotifyContext. The program is left to exit on its own on these.
+// coverHandlesAll is set if it handles every signal.
+var (
+	coverHandledMu      sync.Mutex
+	coverHandledSignals = map[os.Signal]bool{}
+	coverHandlesAll     = false
+)
+
+func init() {
+	if exit := coverSignals(coverExitSignals); len(exit) > 0 {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, exit...)
+		go coverExitOnSignal(sigs)
+	}
+	if flush := coverSignals(coverFlushSignals); len(flush) > 0 {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, flush...)
+		go func() {
+			for sig := range sigs {
+				fmt.Fprintf(coverLog(), "coverage: writing the profile on %s\n", sig)
+				coverFlush()
+			}
+		}()
+	}
+}
+
+// coverSignals returns the signals numbered in list
+func coverSignals(list string) []os.Signal {
+	var sigs []os.Signal
+	for _, s := range strings.Split(list, ",") {
+		if n, err := strconv.Atoi(s); err == nil {
+			sigs = append(sigs, syscall.Signal(n))
+		}
+	}
+	return sigs
+}
+
+// coverSignalNotify is signal.Notify, which records the signals the program
+// handles itself.
+func coverSignalNotify(c chan<- os.Signal, sig ...os.Signal) {
+	coverHandleSignals(sig)
+	signal.Notify(c, sig...)
+}
+
+// coverSignalNotifyContext is signal.NotifyContext, which records the signals
+// the program handles itself.
+func coverSignalNotifyContext(parent context.Context, sig ...os.Signal) (context.Context, context.CancelFunc) {
+	coverHandleSignals(sig)
+	return signal.NotifyContext(parent, sig...)
+}
+
+// coverHandleSignals records that the program handles the signals sigs, or
+// every signal, if there are none, as with signal.Notify.
+func coverHandleSignals(sigs []os.Signal) {
+	coverHandledMu.Lock()
+	defer coverHandledMu.Unlock()
+	if len(sigs) == 0 {
+		coverHandlesAll = true
+	}
+	for _, sig := range sigs {
+		coverHandledSignals[sig] = true
+	}
+}
+
+// coverHandlesSignal returns true if the program handles sig itself
+func coverHandlesSignal(sig os.Signal) bool {
+	coverHandledMu.Lock()
+	defer coverHandledMu.Unlock()
+	return coverHandlesAll || coverHandledSignals[sig]
+}
+
+// coverExitOnSignal writes the coverage as the first of the signals is
+// received on sigs. If the program handles the signal itself, it is left to
+// shut down, and exit, on its own, as the exit waits for the coverage to be
+// written, see coverReport. Otherwise the binary is terminated by the signal,
+// as it would have been without the coverage, once it is written, or once the
+// flush budget is spent.
+func coverExitOnSignal(sigs chan os.Signal) {
+	sig := <-sigs
+	if coverHandlesSignal(sig) {
+		signal.Stop(sigs)
+		coverReport()
+		return
+	}
+	budget := coverFlushBudget
+	if s := coverGetenv("FLUSH_BUDGET"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			budget = d
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		coverReport()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(budget):
+		fmt.Fprintf(coverLog(), "coverage: the profile was not written within %s of %s\n", budget, sig)
+	}
+	// The signal is no longer received on sigs, while the handlers of the
+	// program, if any, are kept, which signal.Reset would remove
+	signal.Stop(sigs)
+	coverRaise(sig)
+}
+
+// coverRaise terminates the binary by the signal sig, which is no longer
+// notified of, so that it exits with the status of a process terminated by
+// it, as without the coverage written on it. The platforms which can not
+// signal the process itself, i.e., windows, exit with 128 plus the number of
+// the signal instead.
+func coverRaise(sig os.Signal) {
+	p, err := os.FindProcess(os.Getpid())
+	if err == nil {
+		err = p.Signal(sig)
+	}
+	if err != nil {
+		status := 1
+		if n, ok := sig.(syscall.Signal); ok {
+			status = 128 + int(n)
+		}
+		os.Exit(status)
+	}
+}
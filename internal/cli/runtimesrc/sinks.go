@@ -0,0 +1,53 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/mendersoftware/gobinarycoverage/coverage"
+)
+
+// This file is only merged into the main file of binaries which depend on the
+// helper package already, as it would otherwise add the dependency.
+
+func init() {
+	coverWriteSinks = coverWriteToSinks
+	coverCloseSinks = func() {
+		if err := coverage.CloseSinks(); err != nil {
+			fmt.Fprintf(coverLog(), "Failed to close the coverage sink. Error: %s\n", err.Error())
+		}
+	}
+}
+
+// coverWriteToSinks writes the coverage profile, in the text format, and its
+// sidecar, to the sinks registered through coverage.RegisterSink, if any. The
+// profile is the path the profile is written to, or empty if it could not be.
+func coverWriteToSinks(profile string) {
+	if !coverage.HasSinks() {
+		return
+	}
+	var data bytes.Buffer
+	coverWriteText(&data)
+	sidecar, err := coverSidecarJSON()
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to encode the coverage sidecar. Error: %s\n", err.Error())
+	}
+	p := &coverage.Profile{Name: profile, Data: data.Bytes(), Sidecar: sidecar}
+	if err = coverage.WriteSinks(p); err != nil {
+		fmt.Fprintf(coverLog(), "Failed to write the coverage profile to a sink. Error: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// coverStreamChunk is the number of base64 characters of the profile in every
+// line streamed, which keeps the lines below the limits of the log collectors,
+// e.g., the 16KiB of docker.
+const coverStreamChunk = 4096
+
+// coverStreaming tells whether the profile is streamed, instead of written to
+// a file, i.e., whether COVERAGE_FILEPATH is -.
+func coverStreaming() bool {
+	return coverGetenv("FILEPATH") == "-"
+}
+
+// coverProfileChunks returns a new identity of the profile, and the base64 of
+// the gzipped profile, split into chunks of at most size characters.
+func coverProfileChunks(size int) (string, []string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	coverWriteText(zw)
+	if err := zw.Close(); err != nil {
+		return "", nil, err
+	}
+	data := base64.StdEncoding.EncodeToString(buf.Bytes())
+	var id [8]byte
+	rand.Read(id[:])
+
+	var chunks []string
+	for len(data) > size {
+		chunks = append(chunks, data[:size])
+		data = data[size:]
+	}
+	return hex.EncodeToString(id[:]), append(chunks, data), nil
+}
+
+// coverWriteStream writes the coverage profile to stderr, or to stdout if
+// COVERAGE_STREAM is stdout, for the containers without any writable mount.
+// The profile is compressed, and split into the lines
+//
+//	coverage-profile <id> <n>/<total> <base64 of the gzipped profile>
+//
+// of the messages written to syslog, between the lines marking its beginning,
+// and end, so that gobinarycoverage extract finds it in the captured logs, even
+// if the lines are prefixed, e.g., by timestamps, or interleaved with others.
+func coverWriteStream() (string, error) {
+	var w io.Writer = os.Stderr
+	if coverGetenv("STREAM") == "stdout" {
+		w = os.Stdout
+	}
+	name, chunks, err := coverProfileChunks(coverStreamChunk)
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to encode the coverage profile. Error: %s\n", err.Error())
+		return "", err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "gobinarycoverage: begin coverage-profile %s\n", name)
+	for n, chunk := range chunks {
+		fmt.Fprintf(&buf, "coverage-profile %s %d/%d %s\n", name, n+1, len(chunks), chunk)
+	}
+	fmt.Fprintf(&buf, "gobinarycoverage: end coverage-profile %s\n", name)
+	if _, err = w.Write(buf.Bytes()); err != nil {
+		fmt.Fprintf(coverLog(), "Failed to stream the coverage profile. Error: %s\n", err.Error())
+		return "", err
+	}
+	fmt.Fprintf(coverLog(), "Streamed the coverage profile, as %s, in %d lines\n", name, len(chunks))
+	return "stream:" + name, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// This file is only merged into the main file when instrumenting with
+// -syslog-fallback.
+
+// coverSyslogTag is the tag of the syslog messages holding the profile, which
+// gobinarycoverage scrape-journal looks for.
+const coverSyslogTag = "gobinarycoverage"
+
+// coverSyslogChunk is the number of base64 characters of the profile in every
+// message, which keeps the messages below the 1024 bytes of RFC 3164.
+const coverSyslogChunk = 768
+
+func init() {
+	coverFallbackSink = coverWriteSyslog
+}
+
+// coverWriteSyslog writes the coverage profile to syslog, or journald, through
+// the socket at COVERAGE_SYSLOG_SOCKET, or /dev/log, for devices on which no
+// directory is writable, e.g., with a read-only root filesystem. The profile
+// is compressed, and split into messages of the form
+//
+//	coverage-profile <id> <n>/<total> <base64 of the gzipped profile>
+//
+// which are reassembled by gobinarycoverage scrape-journal.
+func coverWriteSyslog() (string, error) {
+	socket := coverGetenv("SYSLOG_SOCKET")
+	if socket == "" {
+		socket = "/dev/log"
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		conn, err = net.Dial("unix", socket)
+	}
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to connect to syslog. Error: %s\n", err.Error())
+		return "", err
+	}
+	defer conn.Close()
+
+	name, chunks, err := coverProfileChunks(coverSyslogChunk)
+	if err != nil {
+		return "", err
+	}
+	total := len(chunks)
+	for n, chunk := range chunks {
+		// The facility user, and the severity info
+		msg := fmt.Sprintf("<14>%s %s[%d]: coverage-profile %s %d/%d %s\n",
+			time.Now().Format(time.Stamp), coverSyslogTag, os.Getpid(), name, n+1, total, chunk)
+		if _, err = conn.Write([]byte(msg)); err != nil {
+			fmt.Fprintf(coverLog(), "Failed to write the coverage profile to syslog. Error: %s\n", err.Error())
+			return "", err
+		}
+	}
+	fmt.Fprintf(coverLog(), "Wrote the coverage profile to syslog, as %s, in %d messages tagged %s\n", name, total, coverSyslogTag)
+	return "syslog:" + name, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// This file is only merged into the main file when instrumenting with
+// -systemd-notify.
+
+// coverSystemdExtendTimeout is how much the stop timeout of the unit is
+// extended by, while the coverage is written, unless it is set through
+// COVERAGE_SYSTEMD_EXTEND_TIMEOUT.
+const coverSystemdExtendTimeout = 30 * time.Second
+
+func init() {
+	coverBeforeFlush = append(coverBeforeFlush, func() {
+		timeout := coverSystemdExtendTimeout
+		if s := coverGetenv("SYSTEMD_EXTEND_TIMEOUT"); s != "" {
+			if d, err := time.ParseDuration(s); err == nil {
+				timeout = d
+			}
+		}
+		coverSystemdNotify(fmt.Sprintf("STATUS=Writing the coverage profile\nEXTEND_TIMEOUT_USEC=%d",
+			timeout.Microseconds()))
+	})
+	coverAfterFlush = append(coverAfterFlush, func(profile string) {
+		coverSystemdNotify("STATUS=Wrote the coverage profile: " + profile)
+	})
+}
+
+// coverSystemdNotify sends state to the service manager, through the socket
+// in NOTIFY_SOCKET, as described in sd_notify(3). It does nothing if the
+// binary is not run by systemd.
+func coverSystemdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// Sockets in the abstract namespace start with '@'
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		fmt.Fprintf(coverLog(), "Failed to notify systemd. Error: %s\n", err.Error())
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		fmt.Fprintf(coverLog(), "Failed to notify systemd. Error: %s\n", err.Error())
+	}
+}
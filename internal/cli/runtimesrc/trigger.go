@@ -0,0 +1,66 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package runtimesrc
+
+import (
+	"os"
+	"time"
+)
+
+// This file is only merged into the main file when instrumenting with
+// -flush-trigger.
+
+// coverFlushTrigger is the path of the trigger file, which is replaced by the
+// one given through -flush-trigger, and overridden by
+// COVERAGE_FLUSH_TRIGGER.
+var coverFlushTrigger = ""
+
+// coverTriggerInterval is the interval the trigger file is polled at, unless
+// it is set through COVERAGE_FLUSH_TRIGGER_INTERVAL.
+const coverTriggerInterval = time.Second
+
+func init() {
+	path := coverFlushTrigger
+	if p := coverGetenv("FLUSH_TRIGGER"); p != "" {
+		path = p
+	}
+	interval := coverTriggerInterval
+	if s := coverGetenv("FLUSH_TRIGGER_INTERVAL"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			interval = d
+		}
+	}
+	go coverPollTrigger(path, interval)
+}
+
+// coverPollTrigger writes the coverage profile whenever the trigger file at
+// path is created, or touched. The trigger file is removed after the profile
+// is written, so that it can be created again. If it can not be removed, it
+// is touched in order to write the profile again.
+func coverPollTrigger(path string, interval time.Duration) {
+	var handled time.Time
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(handled) {
+			continue
+		}
+		coverFlush()
+		if err = os.Remove(path); err != nil {
+			handled = info.ModTime()
+		} else {
+			handled = time.Time{}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// isSampled returns true if the block b of file, as named in the profile, is
+// sampled, when sample percent of the blocks are. The blocks are selected by
+// the hash of their position, so that the same blocks are sampled every time
+// the same sources are instrumented.
+func isSampled(file string, b [5]int, sample float64) bool {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s:%d.%d,%d.%d", file, b[0], b[1], b[2], b[3])
+	return float64(h.Sum32()%10000) < sample*100
+}
+
+// sampleBlocks removes the counters of the blocks which are not sampled from
+// the file at path, as instrumented by go tool cover, or coverFuncs, with the
+// variable varName, and the file named file in the profile. The blocks which
+// are not sampled are not in the profile at all, so the coverage of the ones
+// which are is an estimate of the coverage of all of them. It returns the
+// number of blocks kept, and the number of blocks in total.
+func sampleBlocks(path, file, varName string, sample float64) (kept, total int, err error) {
+	blocks, err := parseCoverBlocks(path, varName)
+	if err != nil {
+		return 0, 0, err
+	}
+	index := make([]int, len(blocks)) // The index of the kept blocks, or -1
+	var keep [][5]int
+	for i, b := range blocks {
+		index[i] = -1
+		if isSampled(file, b, sample) {
+			index[i] = len(keep)
+			keep = append(keep, b)
+		}
+	}
+	return len(keep), len(blocks), keepBlocks(path, varName, index, keep)
+}
+
+// keepBlocks rewrites the file at path, as instrumented by go tool cover, or
+// coverFuncs, with the variable varName, to keep only some of its blocks.
+// index holds the index of every block of the file among the blocks kept, or
+// -1 if it is not kept, and keep the blocks kept. The increments of the
+// counters of the blocks not kept are removed, and the rest are renumbered.
+func keepBlocks(path, varName string, index []int, keep [][5]int) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Remove the increments of the counters of the blocks not kept, and
+	// renumber the rest
+	counter := regexp.MustCompile(`_cover_atomic_\.AddUint32\(&` + varName + `\.Count\[(\d+)\], 1\);|` +
+		varName + `\.Count\[(\d+)\](?: = 1;|\+\+;)`)
+	contents = counter.ReplaceAllFunc(contents, func(m []byte) []byte {
+		sub := counter.FindSubmatch(m)
+		n := sub[1]
+		if n == nil {
+			n = sub[2]
+		}
+		i, _ := strconv.Atoi(string(n))
+		if i >= len(index) || index[i] < 0 {
+			return nil
+		}
+		return bytes.Replace(m, []byte("["+string(n)+"]"), []byte("["+strconv.Itoa(index[i])+"]"), 1)
+	})
+
+	// Replace the declaration of the variable with the one of the blocks kept
+	decl := []byte("\nvar " + varName + " = struct {")
+	start := bytes.Index(contents, decl)
+	if start < 0 {
+		return fmt.Errorf("the declaration of %s is not found", varName)
+	}
+	end := bytes.Index(contents[start:], []byte("\n}\n"))
+	if end < 0 {
+		return fmt.Errorf("the declaration of %s is not terminated", varName)
+	}
+	var out bytes.Buffer
+	out.Write(contents[:start+1])
+	writeCoverVar(&out, varName, keep)
+	out.Write(contents[start+end+3:])
+	return os.WriteFile(path, out.Bytes(), 0644)
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestSampleNone instruments, and runs, a binary none of whose blocks is
+// sampled, and verifies that it writes no profile, rather than an empty one.
+func TestSampleNone(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds, and runs, an instrumented binary")
+	}
+	files := map[string]string{
+		"go.mod":     "module example.com/sample\n\ngo 1.22\n",
+		"main.go":    "package main\n\nimport \"example.com/sample/lib\"\n\nfunc main() {\n\tlib.F()\n}\n",
+		"lib/lib.go": "package lib\n\nvar x int\n\nfunc F() {\n\tx = 1\n}\n",
+	}
+	dir := t.TempDir()
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The one block of F is not sampled at 0.01%
+	if isSampled("example.com/sample/lib/lib.go", [5]int{5, 10, 7, 2, 1}, 0.01) {
+		t.Fatal("the block of F is sampled")
+	}
+	chdir(t, dir)
+	log := filepath.Join(dir, "runtime.log")
+	if err := instrument("example.com/sample", options{force: true, sample: 0.01, logFile: log}); err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(dir, "sample")
+	if _, err := runCommand(dir, nil, "go", "build", "-o", binary, "."); err != nil {
+		t.Fatal(err)
+	}
+	env := append(os.Environ(), "COVERAGE_FILEPATH="+dir)
+	if _, err := runCommand(dir, env, binary); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "none of the blocks is sampled") {
+		t.Errorf("the binary does not report that nothing is sampled:\n%s", out)
+	}
+	profiles, err := filepath.Glob(filepath.Join(dir, "coverage*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) > 0 {
+		t.Errorf("expected no profile, found %v", profiles)
+	}
+}
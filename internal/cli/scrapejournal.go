@@ -0,0 +1,247 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// syslogTag is the tag of the syslog messages the instrumented binaries write
+// their profile in, see runtimesrc/syslog.go.
+const syslogTag = "gobinarycoverage"
+
+// syslogChunk matches the messages holding a chunk of a profile, anywhere in
+// the line, so that both the messages alone, and the lines of syslog files,
+// are matched.
+var syslogChunk = regexp.MustCompile(`coverage-profile ([0-9a-f]+) (\d+)/(\d+) ([A-Za-z0-9+/=]+)`)
+
+// journalProfile is a profile being reassembled from its chunks
+type journalProfile struct {
+	total  int
+	chunks map[int]string
+}
+
+// scrapeJournal reassembles the profiles written to syslog in r, and returns
+// them by their IDs, and the IDs of the ones with chunks missing.
+func scrapeJournal(r io.Reader) (map[string]*profile.Profile, []string, error) {
+	parts := make(map[string]*journalProfile)
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		m := syslogChunk.FindStringSubmatch(s.Text())
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		total, _ := strconv.Atoi(m[3])
+		jp, ok := parts[m[1]]
+		if !ok {
+			jp = &journalProfile{total: total, chunks: make(map[int]string)}
+			parts[m[1]] = jp
+		}
+		jp.chunks[n] = m[4]
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+	profiles := make(map[string]*profile.Profile)
+	var incomplete []string
+	for id, jp := range parts {
+		var data strings.Builder
+		for n := 1; n <= jp.total; n++ {
+			chunk, ok := jp.chunks[n]
+			if !ok {
+				break
+			}
+			data.WriteString(chunk)
+		}
+		if len(jp.chunks) != jp.total || data.Len() == 0 {
+			incomplete = append(incomplete, id)
+			continue
+		}
+		p, err := decodeJournalProfile(data.String())
+		if err != nil {
+			return nil, nil, fmt.Errorf("profile %s: %s", id, err.Error())
+		}
+		profiles[id] = p
+	}
+	sort.Strings(incomplete)
+	return profiles, incomplete, nil
+}
+
+// decodeJournalProfile decodes the base64 of the gzipped profile in data
+func decodeJournalProfile(data string) (*profile.Profile, error) {
+	compressed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return profile.Parse(zr)
+}
+
+// readLogs reads the logs in the files named, or in stdin for -, into logs.
+func readLogs(logs *bytes.Buffer, names []string) error {
+	for _, name := range names {
+		if name == "-" {
+			if _, err := logs.ReadFrom(os.Stdin); err != nil {
+				return err
+			}
+			continue
+		}
+		contents, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		logs.Write(contents)
+		logs.WriteByte('\n')
+	}
+	return nil
+}
+
+// mergeScraped merges the profiles reassembled from the logs, as returned by
+// scrapeJournal, warning about the incomplete ones, and writes the merge to w,
+// or to the file out if given.
+func mergeScraped(profiles map[string]*profile.Profile, incomplete []string, out string, w io.Writer) error {
+	for _, id := range incomplete {
+		fmt.Fprintf(stderr, "Warning: the profile %s is missing messages, and is skipped\n", id)
+	}
+	if len(profiles) == 0 {
+		return errors.New("no complete profiles found")
+	}
+	ids := make([]string, 0, len(profiles))
+	for id := range profiles {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	merged := &profile.Profile{}
+	for _, id := range ids {
+		if err := merged.Merge(profiles[id]); err != nil {
+			return fmt.Errorf("profile %s: %s", id, err.Error())
+		}
+	}
+	fmt.Fprintf(stderr, "Merged %d profiles\n", len(profiles))
+	if out == "" {
+		return merged.Write(w)
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err = merged.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// scrapeJournalUsage is the help of the scrape-journal subcommand.
+const scrapeJournalUsage = `
+   gobinarycoverage scrape-journal [-o file] [log...]
+
+       Reassembles the profiles written to syslog by binaries instrumented
+       with -syslog-fallback, from the journal, through journalctl, or from
+       the log files given, e.g., a copy of /var/log/messages of a device,
+       or - for stdin. The complete profiles are merged, and written to
+       file, or stdout.
+`
+
+// scrapeJournalCommand reassembles the profiles written to syslog by binaries
+// instrumented with -syslog-fallback, from the journal, or the log files
+// given, as configured by the arguments of the scrape-journal subcommand, and
+// writes their merge.
+func scrapeJournalCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("scrape-journal", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, scrapeJournalUsage)
+	out := fs.String("o", "", "Write the profile to this file, instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var logs bytes.Buffer
+	if fs.NArg() == 0 {
+		contents, err := runCommand("", nil, "journalctl", "--no-pager", "-o", "cat", "-t", syslogTag)
+		if err != nil {
+			return err
+		}
+		logs.Write(contents)
+	}
+	if err := readLogs(&logs, fs.Args()); err != nil {
+		return err
+	}
+	profiles, incomplete, err := scrapeJournal(&logs)
+	if err != nil {
+		return err
+	}
+	return mergeScraped(profiles, incomplete, *out, w)
+}
+
+// extractUsage is the help of the extract subcommand.
+const extractUsage = `
+   gobinarycoverage extract [-o file] [log...]
+
+       Reassembles the profiles streamed by binaries run with
+       COVERAGE_FILEPATH=-, e.g., in containers without any writable
+       mount, from the logs captured, in the files given, or in stdin.
+       The profile is streamed to stderr, or to stdout with
+       COVERAGE_STREAM=stdout, compressed, in lines of the form of the
+       syslog messages of -syslog-fallback, between the lines marking its
+       beginning, and end. The lines may be prefixed, e.g., by timestamps,
+       and interleaved with the output of the binary. The complete
+       profiles are merged, and written to file, or stdout.
+`
+
+// extractCommand reassembles the profiles streamed by the binaries run with
+// COVERAGE_FILEPATH=-, see runtimesrc/stream.go, from the logs captured, in
+// the files given, or in stdin, as configured by the arguments of the extract
+// subcommand, and writes their merge.
+func extractCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("extract", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, extractUsage)
+	out := fs.String("o", "", "Write the profile to this file, instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	names := fs.Args()
+	if len(names) == 0 {
+		names = []string{"-"}
+	}
+	var logs bytes.Buffer
+	if err := readLogs(&logs, names); err != nil {
+		return err
+	}
+	// The lines streamed are the ones of the syslog messages
+	profiles, incomplete, err := scrapeJournal(&logs)
+	if err != nil {
+		return err
+	}
+	return mergeScraped(profiles, incomplete, *out, w)
+}
@@ -0,0 +1,203 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// journalChunks splits the profile into the chunks of the messages written to
+// syslog, as coverWriteSyslog does, of size base64 characters.
+func journalChunks(t *testing.T, text string, size int) []string {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(text))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := base64.StdEncoding.EncodeToString(buf.Bytes())
+	var chunks []string
+	for len(data) > size {
+		chunks = append(chunks, data[:size])
+		data = data[size:]
+	}
+	return append(chunks, data)
+}
+
+func TestScrapeJournal(t *testing.T) {
+	first := journalChunks(t, "mode: count\nexample.com/m/a.go:3.14,5.2 1 2\nexample.com/m/a.go:7.14,9.2 1 0\n", 16)
+	second := journalChunks(t, "mode: count\nexample.com/m/a.go:3.14,5.2 1 1\nexample.com/m/a.go:7.14,9.2 1 3\n", 16)
+	if len(first) < 3 || len(second) < 3 {
+		t.Fatalf("the profiles are split into %d, and %d chunks, expected 3 or more", len(first), len(second))
+	}
+	// The lines of the journal, as journalctl -o short prints them, and of
+	// syslog files, with the messages of other programs in between
+	var logs strings.Builder
+	fmt.Fprintf(&logs, "-- Logs begin at Thu 2026-10-15 09:00:00 UTC. --\n")
+	for n := len(first); n >= 1; n-- {
+		fmt.Fprintf(&logs, "Oct 15 10:00:0%d device gobinarycoverage[812]: coverage-profile 0a1b %d/%d %s\n", n, n, len(first), first[n-1])
+		fmt.Fprintf(&logs, "Oct 15 10:00:0%d device mender[811]: level=info msg=\"installing\"\n", n)
+	}
+	for n, chunk := range second {
+		fmt.Fprintf(&logs, "<14>Oct 15 10:01:00 gobinarycoverage[813]: coverage-profile 2c3d %d/%d %s\n", n+1, len(second), chunk)
+	}
+	// A profile whose last message is lost
+	for n, chunk := range second[:len(second)-1] {
+		fmt.Fprintf(&logs, "coverage-profile 4e5f %d/%d %s\n", n+1, len(second), chunk)
+	}
+
+	profiles, incomplete, err := scrapeJournal(strings.NewReader(logs.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(incomplete, []string{"4e5f"}) {
+		t.Errorf("incomplete %v, expected [4e5f]", incomplete)
+	}
+	if len(profiles) != 2 || profiles["0a1b"] == nil || profiles["2c3d"] == nil {
+		t.Fatalf("reassembled %d profiles, expected 0a1b, and 2c3d", len(profiles))
+	}
+	if b := profiles["0a1b"].Blocks; len(b) != 2 || b[0].Count != 2 || b[1].Count != 0 {
+		t.Errorf("reassembled 0a1b as %+v", b)
+	}
+
+	dir := t.TempDir()
+	log, out := filepath.Join(dir, "messages"), filepath.Join(dir, "merged.out")
+	if err = os.WriteFile(log, []byte(logs.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = scrapeJournalCommand([]string{"-o", out, log}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := profile.ParseFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := merged.Blocks; len(b) != 2 || b[0].Count != 3 || b[1].Count != 3 {
+		t.Errorf("merged %+v", b)
+	}
+
+	// A corrupted chunk fails the scrape, rather than the profile being
+	// merged in part
+	corrupted := strings.Replace(logs.String(), first[0], "AAAA"+first[0][4:], 1)
+	if _, _, err = scrapeJournal(strings.NewReader(corrupted)); err == nil {
+		t.Error("expected an error scraping a corrupted profile")
+	}
+}
+
+// TestSyslogSink runs a binary instrumented with -syslog-fallback, which can
+// not write its profile to any directory, and reassembles the profile from the
+// messages it writes to the syslog socket.
+func TestSyslogSink(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds, and runs, an instrumented binary")
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("syslog is not available")
+	}
+	files := map[string]string{
+		"go.mod":     "module example.com/syslog\n\ngo 1.18\n",
+		"main.go":    "package main\n\nimport \"example.com/syslog/lib\"\n\nfunc main() {\n\tlib.Hello(3)\n}\n",
+		"lib/lib.go": "package lib\n\nfunc Hello(n int) {\n\tfor i := 0; i < n; i++ {\n\t\tprintln(\"hello\")\n\t}\n}\n",
+	}
+	dir := t.TempDir()
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chdir(t, dir)
+	if err := instrument("example.com/syslog", options{force: true, mode: "count", syslogFallback: true}); err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(dir, "syslog")
+	if _, err := runCommand(dir, nil, "go", "build", "-o", binary, "."); err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "log")
+	conn, err := net.ListenPacket("unixgram", socket)
+	if err != nil {
+		t.Skipf("unix datagram sockets are not available: %s", err)
+	}
+	defer conn.Close()
+	// No directory is writable, as a file is in the way of all of them
+	blocked := filepath.Join(dir, "blocked")
+	if err = os.WriteFile(blocked, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := append(os.Environ(),
+		"COVERAGE_FILEPATH="+filepath.Join(blocked, "coverage"),
+		"COVERAGE_FALLBACK_FILEPATH="+filepath.Join(blocked, "fallback"),
+		"COVERAGE_WRITE_RETRIES=0",
+		"COVERAGE_SYSLOG_SOCKET="+socket)
+	if _, err = runCommand(dir, env, binary); err != nil {
+		t.Fatal(err)
+	}
+
+	// The messages are captured as the lines of a syslog file
+	var logs bytes.Buffer
+	buf := make([]byte, 4096)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		if n > 1024 {
+			t.Errorf("a message of %d bytes, longer than the 1024 of RFC 3164", n)
+		}
+		if !bytes.HasPrefix(buf[:n], []byte("<14>")) || !bytes.Contains(buf[:n], []byte(" "+syslogTag+"[")) {
+			t.Errorf("unexpected message: %q", buf[:n])
+		}
+		logs.Write(buf[:n])
+	}
+	profiles, incomplete, err := scrapeJournal(&logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 1 || len(incomplete) != 0 {
+		t.Fatalf("reassembled %d profiles, and %d incomplete, expected 1, and none", len(profiles), len(incomplete))
+	}
+	for _, p := range profiles {
+		// The body of the loop, from its brace on line 4
+		found := false
+		for _, b := range p.Blocks {
+			if b.File == "example.com/syslog/lib/lib.go" && b.StartLine == 4 && b.Count == 3 {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("the loop is not counted 3 times in %+v", p.Blocks)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// selftestModule is the module path of the sample project scaffolded by the
+// selftest subcommand.
+const selftestModule = "example.com/selftest"
+
+// selftestFiles is the sample project scaffolded by the selftest subcommand.
+// The main file calls coverReport explicitly, as it is only present after the
+// instrumentation has merged it into main.go. Both the main file, and the
+// covered lib package use type parameters, in order to verify that the
+// pipeline handles generic code. The init functions verify that the counters
+// are registered before the init functions of the main package run, and that
+// the statements run from the init functions of the covered packages are
+// counted, and the main function that the instrumentation does not register
+// any flags, as importing testing would. The files with spaces, and non-ASCII
+// letters, in their names, and the nested package, verify that the paths of
+// the sources are handled as such.
+var selftestFiles = map[string]string{
+	"go.mod": `module ` + selftestModule + `
+
+go 1.18
+`,
+	"main.go": `package main
+
+import (
+	"flag"
+	"os"
+
+	"` + selftestModule + `/lib"
+)
+
+// number is the constraint of double
+type number interface {
+	~int | ~float64
+}
+
+func double[T number](t T) T {
+	return t * 2
+}
+
+func main() {
+	flag.VisitAll(func(*flag.Flag) {
+		os.Exit(4)
+	})
+	ret := lib.Covered(1)
+	if lib.OS() == "" {
+		os.Exit(1)
+	}
+	if lib.Ünïcode() != 1 {
+		os.Exit(1)
+	}
+	s := &lib.Stack[int]{}
+	s.Push(ret)
+	doubled := lib.Map([]int{s.Len()}, double[int])
+	coverReport()
+	if ret != 2 || doubled[0] != 2 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+`,
+	"init.go": `package main
+
+import (
+	"os"
+
+	"` + selftestModule + `/lib"
+)
+
+// init is declared in a file sorted before main.go, so it runs before any
+// init function in it
+func init() {
+	if len(coverCounters) == 0 || !lib.Initialized() {
+		os.Exit(3)
+	}
+}
+`,
+	"lib/lib.go": `package lib
+
+// initialized is set from init, before the counters are registered
+var initialized bool
+
+func init() {
+	initialized = true
+}
+
+// Initialized returns true if init has run
+func Initialized() bool {
+	return initialized
+}
+
+// Covered is called by the selftest binary
+func Covered(n int) int {
+	if n > 0 {
+		return n * 2
+	}
+	return 0
+}
+
+// Uncovered is never called by the selftest binary
+func Uncovered() string {
+	return "uncovered"
+}
+
+// OS returns the name of the operating system, from the file compiled for it
+func OS() string {
+	return osName()
+}
+
+// Stack is a generic type, used by the selftest binary
+type Stack[T any] struct {
+	items []T
+}
+
+// Push pushes t onto the stack
+func (s *Stack[T]) Push(t T) {
+	s.items = append(s.items, t)
+}
+
+// Len returns the number of items on the stack
+func (s *Stack[T]) Len() int {
+	return len(s.items)
+}
+
+// Map is a generic function, called by the selftest binary
+func Map[T, U any](ts []T, f func(T) U) []U {
+	us := make([]U, 0, len(ts))
+	for _, t := range ts {
+		us = append(us, f(t))
+	}
+	return us
+}
+`,
+	"lib/ünïcode names.go": `package lib
+
+import "` + selftestModule + `/lib/nested/deep"
+
+// Ünïcode is declared in a file whose name has a space, and non-ASCII letters
+func Ünïcode() int {
+	return deep.Deep()
+}
+`,
+	"lib/nested/deep/déep.go": `package deep
+
+// Deep is declared in a nested package
+func Deep() int {
+	return 1
+}
+`,
+	"lib/os_linux.go": `package lib
+
+func osName() string {
+	return "linux"
+}
+`,
+	"lib/os_windows.go": `package lib
+
+func osName() string {
+	return "windows"
+}
+`,
+	"lib/os_darwin.go": `package lib
+
+func osName() string {
+	return "darwin"
+}
+`,
+	"lib/os_other.go": `//go:build !linux && !windows && !darwin
+
+package lib
+
+func osName() string {
+	return "other"
+}
+`,
+}
+
+// selftestCrossTargets are the platforms for which the sample project is
+// instrumented and cross compiled, in order to verify that only the files
+// compiled for the target platform are instrumented.
+var selftestCrossTargets = []string{"linux/amd64", "windows/amd64", "darwin/amd64"}
+
+// selftestCompactTargets are the platforms for which the sample project is
+// instrumented with -compact, in order to verify that the compact profiles
+// written on big endian, and 32 bit, targets decode the same on the host. The
+// binaries are run through QEMU user emulation, if it is installed.
+var selftestCompactTargets = []string{"linux/mips", "linux/s390x", "linux/arm"}
+
+// selftestQEMU is the QEMU user emulator of each GOARCH, where it differs
+var selftestQEMU = map[string]string{"amd64": "x86_64", "arm64": "aarch64", "386": "i386"}
+
+// The coverage expected from running the selftest binary on the lib package,
+// and the package nested in it.
+const (
+	selftestCoveredStmts = 14
+	selftestTotalStmts   = 16
+)
+
+// selftest scaffolds the sample project in a temporary directory, and runs the
+// full instrument, build, run, and report pipeline against it. Then it is
+// instrumented, and cross compiled, for each of the selftestCrossTargets, and
+// the compact profiles are round tripped on the host, and on each of the
+// selftestCompactTargets. The temporary directory is kept on failure, for inspection.
+func selftest() (err error) {
+	dir, err := ioutil.TempDir("", "gobinarycoverage-selftest")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			fmt.Fprintf(stderr, "The selftest project is kept in: %s\n", dir)
+			return
+		}
+		os.RemoveAll(dir)
+	}()
+	// The directory has a space, and a non-ASCII letter, in its name, like
+	// the paths of the sources may have
+	if err = selftestHost(filepath.Join(dir, "host ü")); err != nil {
+		return err
+	}
+	for _, target := range selftestCrossTargets {
+		if err = selftestCross(filepath.Join(dir, strings.Replace(target, "/", "_", 1)), target); err != nil {
+			return fmt.Errorf("%s: %s", target, err.Error())
+		}
+	}
+	host := runtime.GOOS + "/" + runtime.GOARCH
+	for _, target := range append([]string{host}, selftestCompactTargets...) {
+		if err = selftestCompact(filepath.Join(dir, "compact_"+strings.Replace(target, "/", "_", 1)), target); err != nil {
+			return fmt.Errorf("%s: %s", target, err.Error())
+		}
+	}
+	fmt.Fprintln(stderr, "selftest: OK")
+	return nil
+}
+
+// scaffoldSelftest writes the sample project to dir, and instruments it.
+func scaffoldSelftest(dir string, opts options) error {
+	for name, contents := range selftestFiles {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			return err
+		}
+	}
+
+	// go list resolves the package relative to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err = os.Chdir(dir); err != nil {
+		return err
+	}
+	// The scaffold is thrown away, even if it is in a git work tree
+	opts.force = true
+	err = instrument(selftestModule, opts)
+	if cerr := os.Chdir(wd); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("instrument: %s", err.Error())
+	}
+	return nil
+}
+
+// selftestHost instruments, builds and runs the sample project on the host,
+// and verifies the coverage reported.
+func selftestHost(dir string) error {
+	if err := scaffoldSelftest(dir, options{}); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "selftest: instrumented %s\n", selftestModule)
+
+	binary := filepath.Join(dir, "selftest")
+	if err := runSelftestCommand(dir, nil, "go", "build", "-o", binary, "."); err != nil {
+		return fmt.Errorf("build: %s", err.Error())
+	}
+	fmt.Fprintf(stderr, "selftest: built %s\n", binary)
+
+	env := []string{"COVERAGE_FILEPATH=" + dir, "COVERAGE_FILENAME=selftest"}
+	if err := runSelftestCommand(dir, env, binary); err != nil {
+		return fmt.Errorf("run: %s", err.Error())
+	}
+	profiles, err := filepath.Glob(filepath.Join(dir, "coverageselftest*.out"))
+	if err != nil {
+		return err
+	}
+	if len(profiles) != 1 {
+		return fmt.Errorf("expected one coverage profile, found %d", len(profiles))
+	}
+	fmt.Fprintf(stderr, "selftest: ran %s\n", binary)
+
+	p, err := profile.ParseFile(profiles[0])
+	if err != nil {
+		return fmt.Errorf("report: %s", err.Error())
+	}
+	return selftestCoverage("report", p)
+}
+
+// selftestCoverage verifies the coverage of the lib package in p, which the
+// step of the selftest produced.
+func selftestCoverage(step string, p *profile.Profile) error {
+	covered, total := p.Coverage(func(file string) bool {
+		return strings.HasPrefix(file, selftestModule+"/lib/")
+	})
+	if covered != selftestCoveredStmts || total != selftestTotalStmts {
+		return fmt.Errorf("%s: expected %d of %d statements covered, got %d of %d",
+			step, selftestCoveredStmts, selftestTotalStmts, covered, total)
+	}
+	fmt.Fprintf(stderr, "selftest: %d of %d statements covered, as expected\n", covered, total)
+	return nil
+}
+
+// selftestCross instruments the sample project for the target platform
+// (GOOS/GOARCH), verifies that exactly the files compiled for it are
+// instrumented, and cross compiles it.
+func selftestCross(dir, target string) error {
+	goos, goarch, _ := strings.Cut(target, "/")
+	if err := scaffoldSelftest(dir, options{goos: goos, goarch: goarch}); err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "lib", "os_*.go"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		expected := filepath.Base(name) == "os_"+goos+".go"
+		if instrumented := bytes.Contains(contents, []byte("GoCover")); instrumented != expected {
+			return fmt.Errorf("instrument: expected %s to be instrumented: %t, but was: %t",
+				filepath.Base(name), expected, instrumented)
+		}
+	}
+	fmt.Fprintf(stderr, "selftest: instrumented %s for %s\n", selftestModule, target)
+
+	env := []string{"GOOS=" + goos, "GOARCH=" + goarch, "CGO_ENABLED=0"}
+	if err := runSelftestCommand(dir, env, "go", "build", "-o", filepath.Join(dir, "selftest"), "."); err != nil {
+		return fmt.Errorf("build: %s", err.Error())
+	}
+	fmt.Fprintf(stderr, "selftest: cross compiled for %s\n", target)
+	return nil
+}
+
+// selftestCompact instruments the sample project with -compact for the target
+// platform (GOOS/GOARCH), cross compiles it, runs it, natively on the host, and
+// through QEMU otherwise, and verifies the coverage of the compact profile it
+// writes, as decoded on the host. Running is skipped if QEMU is not installed.
+func selftestCompact(dir, target string) error {
+	goos, goarch, _ := strings.Cut(target, "/")
+	meta := filepath.Join(dir, "compact.json")
+	if err := scaffoldSelftest(dir, options{goos: goos, goarch: goarch, compactMeta: meta}); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "selftest: instrumented %s with -compact for %s\n", selftestModule, target)
+
+	binary := filepath.Join(dir, "selftest")
+	env := []string{"GOOS=" + goos, "GOARCH=" + goarch, "CGO_ENABLED=0"}
+	if err := runSelftestCommand(dir, env, "go", "build", "-o", binary, "."); err != nil {
+		return fmt.Errorf("build: %s", err.Error())
+	}
+	fmt.Fprintf(stderr, "selftest: built %s for %s\n", binary, target)
+
+	name, args := binary, []string(nil)
+	if target != runtime.GOOS+"/"+runtime.GOARCH {
+		qemu := "qemu-" + goarch
+		if arch, ok := selftestQEMU[goarch]; ok {
+			qemu = "qemu-" + arch
+		}
+		path, err := exec.LookPath(qemu)
+		if goos != runtime.GOOS || err != nil {
+			fmt.Fprintf(stderr, "selftest: %s is not available, not running the binary for %s\n", qemu, target)
+			return nil
+		}
+		name, args = path, []string{binary}
+	}
+	env = []string{"COVERAGE_FILEPATH=" + dir, "COVERAGE_FILENAME=selftest"}
+	if err := runSelftestCommand(dir, env, name, args...); err != nil {
+		return fmt.Errorf("run: %s", err.Error())
+	}
+	profiles, err := filepath.Glob(filepath.Join(dir, "coverageselftest*.cov"))
+	if err != nil {
+		return err
+	}
+	if len(profiles) != 1 {
+		return fmt.Errorf("expected one compact coverage profile, found %d", len(profiles))
+	}
+	fmt.Fprintf(stderr, "selftest: ran %s for %s\n", binary, target)
+
+	m, err := readCompactMeta(meta)
+	if err != nil {
+		return fmt.Errorf("decode: %s", err.Error())
+	}
+	f, err := os.Open(profiles[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p, err := decodeCompactProfile(f, m)
+	if err != nil {
+		return fmt.Errorf("decode: %s", err.Error())
+	}
+	return selftestCoverage("decode", p)
+}
+
+// runSelftestCommand runs the command in dir, with env added to the
+// environment. The error output is included in the returned error.
+func runSelftestCommand(dir string, env []string, name string, args ...string) error {
+	_, err := runCommand(dir, append(os.Environ(), env...), name, args...)
+	return err
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// TestInitCounted instruments, builds, and runs the selftest project, whose
+// main package checks from an init function that the counters are registered
+// before it runs, and exits with 3 otherwise, and verifies that the statement
+// run from the init function of the covered lib package is counted.
+func TestInitCounted(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds, and runs, an instrumented binary")
+	}
+	dir := filepath.Join(t.TempDir(), "host ü")
+	if err := selftestHost(dir); err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := filepath.Glob(filepath.Join(dir, "coverageselftest*.out"))
+	if err != nil || len(profiles) != 1 {
+		t.Fatalf("expected one coverage profile, found %d (%v)", len(profiles), err)
+	}
+	p, err := profile.ParseFile(profiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The body of init, in lib/lib.go, starts on line 6, and the one of
+	// Uncovered, which is never called, on line 24
+	tests := []struct {
+		file  string
+		line  int
+		count bool
+	}{
+		{selftestModule + "/lib/lib.go", 6, true},
+		{selftestModule + "/lib/lib.go", 24, false},
+	}
+	for _, test := range tests {
+		found := false
+		for _, b := range p.Blocks {
+			if b.File != test.file || b.StartLine != test.line {
+				continue
+			}
+			found = true
+			if counted := b.Count > 0; counted != test.count {
+				t.Errorf("%s:%d counted: %t, want %t", test.file, test.line, counted, test.count)
+			}
+		}
+		if !found {
+			t.Errorf("no block starts at %s:%d in %s", test.file, test.line, profiles[0])
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// portableSignals are the numbers of the signals which are the same on every
+// platform with signals, including windows
+var portableSignals = map[string]int{
+	"HUP":  1,
+	"INT":  2,
+	"QUIT": 3,
+	"TERM": 15,
+}
+
+// userSignals returns the numbers of SIGUSR1, and SIGUSR2, on the platform
+// goos/goarch, or false if it has none. The runtime refers to the signals by
+// their numbers, as the syscall package of windows has no SIGUSR1.
+func userSignals(goos, goarch string) (usr1, usr2 int, ok bool) {
+	switch goos {
+	case "linux", "android":
+		if strings.HasPrefix(goarch, "mips") {
+			return 16, 17, true
+		}
+		return 10, 12, true
+	case "solaris", "illumos":
+		return 16, 17, true
+	case "darwin", "ios", "freebsd", "netbsd", "openbsd", "dragonfly", "aix":
+		return 30, 31, true
+	}
+	return 0, 0, false
+}
+
+// checkSignals fails if any of the signals the coverage is written on, and the
+// binary exits, is one it keeps running on as well.
+func checkSignals(exit, flush string) error {
+	for _, e := range strings.Split(exit, ",") {
+		for _, f := range strings.Split(flush, ",") {
+			if e != "" && e == f {
+				return fmt.Errorf("the signal %s is given to both -exit-signals, and -flush-signals", e)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveSignals returns the comma separated numbers of the signals in list,
+// given by their names, with or without the SIG prefix, e.g., SIGTERM,USR1, or
+// by their numbers, on the platform goos/goarch.
+func resolveSignals(list, goos, goarch string) (string, error) {
+	var numbers []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")
+		if name == "" {
+			continue
+		}
+		n, err := strconv.Atoi(name)
+		if err != nil {
+			var ok bool
+			if n, ok = portableSignals[name]; !ok {
+				usr1, usr2, hasUser := userSignals(goos, goarch)
+				switch {
+				case name != "USR1" && name != "USR2":
+					return "", fmt.Errorf("unknown signal: %s, expected HUP, INT, QUIT, TERM, USR1, USR2, or a number", name)
+				case !hasUser:
+					return "", fmt.Errorf("%s/%s has no SIG%s", goos, goarch, name)
+				case name == "USR1":
+					n = usr1
+				default:
+					n = usr2
+				}
+			}
+		}
+		if n <= 0 || n == 9 {
+			return "", fmt.Errorf("invalid signal: %d, which can not be caught", n)
+		}
+		numbers = append(numbers, strconv.Itoa(n))
+	}
+	return strings.Join(numbers, ","), nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"go/build"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// selectProfileFiles returns the files in the profile p matching the patterns,
+// which are either the names in the profile, e.g. example.com/app/lib/lib.go,
+// or a suffix of them, e.g. lib/lib.go. All the files are returned if there
+// are no patterns.
+func selectProfileFiles(p *profile.Profile, patterns []string) ([]string, error) {
+	files := p.Files()
+	if len(patterns) == 0 {
+		return files, nil
+	}
+	var selected []string
+	for _, pattern := range patterns {
+		pattern = filepath.ToSlash(pattern)
+		found := false
+		for _, file := range files {
+			if file == pattern || strings.HasSuffix(file, "/"+pattern) {
+				selected = append(selected, file)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no file in the profile matches %s", pattern)
+		}
+	}
+	return selected, nil
+}
+
+// resolveProfileFiles returns the paths on disk of the files in a profile,
+// which are named by the import path of their package, keyed by the names.
+func resolveProfileFiles(ctx *build.Context, files []string) (map[string]string, error) {
+	var packages []string
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if pkg := path.Dir(file); !seen[pkg] {
+			seen[pkg] = true
+			packages = append(packages, pkg)
+		}
+	}
+	listed, err := listPackages(ctx, packages)
+	if err != nil {
+		return nil, err
+	}
+	dirs := make(map[string]string, len(listed))
+	for _, p := range listed {
+		dirs[p.ImportPath] = p.Dir
+	}
+	paths := make(map[string]string, len(files))
+	for _, file := range files {
+		dir, ok := dirs[path.Dir(file)]
+		if !ok {
+			return nil, fmt.Errorf("the package of %s is not found", file)
+		}
+		paths[file] = filepath.Join(dir, path.Base(file))
+	}
+	return paths, nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The limits of the subprocesses run, set through the -timeout and -retries
+// flags.
+var (
+	subprocessTimeout = 5 * time.Minute // Zero disables the timeout
+	subprocessRetries = 2               // The number of retries after a transient failure
+)
+
+// subprocessWaitDelay is how long to wait for the output of a subprocess
+// which is killed on timeout. The go command starts subprocesses of its own,
+// which may keep the output open after it is killed.
+const subprocessWaitDelay = 5 * time.Second
+
+// transientFailures are the messages, in lower case, in the output of the go
+// command, which signal that a failure is caused by the network, and is likely
+// to succeed when retried.
+var transientFailures = []string{
+	"i/o timeout",
+	"tls handshake timeout",
+	"connection reset by peer",
+	"connection refused",
+	"temporary failure in name resolution",
+	"unexpected eof",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+}
+
+// commandError is returned when a subprocess fails, and carries its error
+// output for the diagnostics.
+type commandError struct {
+	Command  string
+	Err      error
+	Stderr   string
+	TimedOut bool
+}
+
+func (e *commandError) Error() string {
+	msg := fmt.Sprintf("`%s` failed: %s", e.Command, e.Err.Error())
+	if e.TimedOut {
+		msg = fmt.Sprintf("`%s` timed out after %s", e.Command, subprocessTimeout)
+	}
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += "\nOutput: " + stderr
+	}
+	return msg
+}
+
+func (e *commandError) Unwrap() error {
+	return e.Err
+}
+
+// transient returns true if the failure is likely to go away when the command
+// is retried.
+func (e *commandError) transient() bool {
+	if e.TimedOut {
+		return true
+	}
+	stderr := strings.ToLower(e.Stderr)
+	for _, msg := range transientFailures {
+		if strings.Contains(stderr, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// runCommand runs the command name in dir, with the environment env (or the
+// one of the process if nil), and returns its standard output. The command is
+// killed if it runs for longer than subprocessTimeout, and transient failures
+// are retried up to subprocessRetries times, with an exponential backoff. The
+// standard error of a failed command is included in the returned error.
+func runCommand(dir string, env []string, name string, args ...string) ([]byte, error) {
+	var out bytes.Buffer
+	err := streamCommand(dir, env, func(r io.Reader) error {
+		out.Reset()
+		_, err := out.ReadFrom(r)
+		return err
+	}, name, args...)
+	return out.Bytes(), err
+}
+
+// streamCommand is like runCommand, but streams the standard output of the
+// command to consume while it runs, instead of buffering all of it, as the
+// output of go list -json is large for big dependency graphs. consume is
+// called once per attempt, so it must start over from a clean state.
+func streamCommand(dir string, env []string, consume func(io.Reader) error, name string, args ...string) error {
+	for attempt := 0; ; attempt++ {
+		err := streamCommandOnce(dir, env, consume, name, args...)
+		var cerr *commandError
+		if err == nil || attempt >= subprocessRetries || !errors.As(err, &cerr) || !cerr.transient() {
+			return err
+		}
+		backoff := time.Second << attempt
+		fmt.Fprintf(stderr, "%s\nRetrying in %s (%d/%d)\n", err.Error(), backoff, attempt+1, subprocessRetries)
+		time.Sleep(backoff)
+	}
+}
+
+func streamCommandOnce(dir string, env []string, consume func(io.Reader) error, name string, args ...string) error {
+	ctx := context.Background()
+	if subprocessTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, subprocessTimeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.WaitDelay = subprocessWaitDelay
+	// The output is piped through an io.Pipe, and not cmd.StdoutPipe, so that
+	// the output is closed by Wait after subprocessWaitDelay on a timeout,
+	// even if a subprocess of the command keeps it open.
+	pr, pw := io.Pipe()
+	stderr := &limitedBuffer{max: maxStderrSize}
+	cmd.Stdout = pw
+	cmd.Stderr = stderr
+	newError := func(err error) error {
+		return &commandError{
+			Command:  strings.Join(append([]string{name}, args...), " "),
+			Err:      err,
+			Stderr:   stderr.String(),
+			TimedOut: ctx.Err() == context.DeadlineExceeded,
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return newError(err)
+	}
+	consumed := make(chan error, 1)
+	go func() {
+		err := consume(pr)
+		// Drain the rest of the output, so that the command is not blocked
+		// on writing it
+		io.Copy(io.Discard, pr)
+		consumed <- err
+	}()
+	err := cmd.Wait()
+	pw.Close()
+	cerr := <-consumed
+	if err != nil {
+		// The output is incomplete, so the error of the command takes
+		// precedence over the one from consuming it
+		return newError(err)
+	}
+	return cerr
+}
+
+// maxStderrSize is the amount of the error output of a command kept for the
+// diagnostics.
+const maxStderrSize = 64 << 10
+
+// limitedBuffer is a buffer which keeps the first max bytes written to it, and
+// discards the rest.
+type limitedBuffer struct {
+	buf     bytes.Buffer
+	max     int
+	dropped int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.max - b.buf.Len(); len(p) > room {
+		b.dropped += len(p) - room
+		p = p[:room]
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+func (b *limitedBuffer) String() string {
+	if b.dropped > 0 {
+		return fmt.Sprintf("%s\n[%d more bytes of output discarded]", b.buf.String(), b.dropped)
+	}
+	return b.buf.String()
+}
@@ -0,0 +1,270 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// traceLocation matches the lines of a Go stack trace holding the location of
+// a frame, e.g. "	/src/app/main.go:42 +0x1d"
+var traceLocation = regexp.MustCompile(`^(\s+)(.+):(\d+)( \+0x[0-9a-f]+)?$`)
+
+// symbolizer rewrites the frames of the stack traces of an instrumented
+// binary to the sources they are in locally.
+type symbolizer struct {
+	buildRoot string            // The root of the main module, as instrumented
+	root      string            // The root of the main module locally
+	modCache  string            // The local module cache, or "" if unknown
+	runtime   map[string]string // The runtime file declaring every name of the generated code
+}
+
+// symbolizeUsage is the help of the symbolize subcommand.
+const symbolizeUsage = `
+   gobinarycoverage symbolize -binary binary | -manifest file.json [-root dir] [-build-root dir] [trace]
+
+       Rewrites the stack traces of an instrumented binary, in the file
+       trace, or stdin, to the local sources: the paths under the root the
+       binary was instrumented in are moved to -root (default: the root of
+       the main module), the copies of the modules in the module cache to
+       the local module cache, and the frames of the coverage runtime are
+       marked as such. The settings are read from the binary, or from the
+       manifest written by build.
+`
+
+// symbolizeCommand rewrites the stack traces of a binary, as configured by
+// the arguments of the symbolize subcommand.
+func symbolizeCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("symbolize", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, symbolizeUsage)
+	binary := fs.String("binary", "", "Read the settings from this instrumented binary")
+	manifest := fs.String("manifest", "", "Read the settings from this manifest, as written by build, or by inspect -json")
+	root := fs.String("root", "", "The root of the main module locally (default: the one of the working directory)")
+	buildRoot := fs.String("build-root", "", "The root of the main module, as instrumented, if the settings do not hold it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 || (*binary == "") == (*manifest == "") {
+		return errors.New("usage: gobinarycoverage symbolize -binary binary | -manifest file.json [-root dir] [-build-root dir] [trace]")
+	}
+	var settings *instrumentSettings
+	var err error
+	if *binary != "" {
+		settings, err = readBinarySettings(*binary)
+	} else {
+		settings, err = readManifestSettings(*manifest)
+	}
+	if err != nil {
+		return err
+	}
+	s := &symbolizer{buildRoot: settings.Root}
+	if *buildRoot != "" {
+		s.buildRoot = *buildRoot
+	}
+	if s.buildRoot == "" {
+		return errors.New("the settings do not hold the root the binary was instrumented in, give it with -build-root")
+	}
+	ctx := options{}.buildContext()
+	if s.root = *root; s.root == "" {
+		if s.root, err = moduleRoot(ctx); err != nil {
+			return err
+		}
+	}
+	if s.root, err = filepath.Abs(s.root); err != nil {
+		return err
+	}
+	if modCache, err := goEnvVar(ctx, "GOMODCACHE"); err == nil {
+		s.modCache = modCache
+	}
+	if s.runtime, err = runtimeNames(); err != nil {
+		return err
+	}
+
+	in := os.Stdin
+	if fs.NArg() == 1 {
+		if in, err = os.Open(fs.Arg(0)); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	return s.symbolize(in, w)
+}
+
+// readBinarySettings returns the settings stamped into the binary at path
+func readBinarySettings(path string) (*instrumentSettings, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := readSettings(contents)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return settings, nil
+}
+
+// readManifestSettings returns the settings in the manifest at path, which is
+// either the one of a binary built by build, or the settings as printed by
+// inspect -json.
+func readManifestSettings(path string) (*instrumentSettings, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m platformManifest
+	if err = json.Unmarshal(contents, &m); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if m.Settings != nil {
+		return m.Settings, nil
+	}
+	settings := &instrumentSettings{}
+	if err = json.Unmarshal(contents, settings); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return settings, nil
+}
+
+// runtimeNames returns the names declared by the coverage runtime, which is
+// copied into the main file, and the runtime file declaring each of them.
+func runtimeNames() (map[string]string, error) {
+	files, err := fs.Glob(runtimeSources, "runtimesrc/*.go")
+	if err != nil {
+		return nil, err
+	}
+	// Declared by generateMain, rather than the runtime
+	names := map[string]string{"coverRegister": "generated", "coverRegistered": "generated"}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		src, err := runtimeSources.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		f, err := parser.ParseFile(fset, file, src, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if d.Recv == nil {
+					names[d.Name.Name] = file
+				}
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					if ts, ok := spec.(*ast.TypeSpec); ok {
+						names[ts.Name.Name] = file
+					}
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+// symbolize copies the stack traces in r to w, with the frames rewritten:
+//
+//   - The paths under the root the binary was instrumented in, are moved to
+//     the local root, as the binaries are usually instrumented elsewhere, e.g.,
+//     in a copy of the module by build, or bench, which is gone.
+//
+//   - The paths of the copies of the modules in the module cache, which are
+//     instrumented in place of them, are moved to the local module cache.
+//
+//   - The frames of the generated code are marked as such, along with the
+//     runtime file the function is from.
+func (s *symbolizer) symbolize(r io.Reader, w io.Writer) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1024*1024)
+	bw := bufio.NewWriter(w)
+	generated := ""
+	for sc.Scan() {
+		line := sc.Text()
+		m := traceLocation.FindStringSubmatch(line)
+		if m == nil {
+			// The function of the frame precedes its location
+			generated = s.generatedFunc(line)
+			fmt.Fprintln(bw, line)
+			continue
+		}
+		fmt.Fprintf(bw, "%s%s:%s%s", m[1], s.localPath(m[2]), m[3], m[4])
+		if generated != "" {
+			fmt.Fprintf(bw, " (gobinarycoverage runtime, %s)", generated)
+		}
+		fmt.Fprintln(bw)
+		generated = ""
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// localPath returns the local path of the file at path in the binary
+func (s *symbolizer) localPath(path string) string {
+	rel, err := filepath.Rel(s.buildRoot, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	if copied := filepath.FromSlash(modCacheCopyDir) + string(filepath.Separator); s.modCache != "" && strings.HasPrefix(rel, copied) {
+		return filepath.Join(s.modCache, escapeModulePath(strings.TrimPrefix(rel, copied)))
+	}
+	return filepath.Join(s.root, rel)
+}
+
+// generatedFunc returns the runtime file declaring the function of the frame
+// line, e.g. "main.coverReport(...)", or "created by main.coverServe in
+// goroutine 1", if it is generated, or "" otherwise.
+func (s *symbolizer) generatedFunc(line string) string {
+	name := strings.TrimPrefix(strings.TrimSpace(line), "created by ")
+	if !strings.HasPrefix(name, "main.") {
+		return ""
+	}
+	// E.g. coverReport.func1, or (*coverWriter).Write
+	name = strings.TrimLeft(strings.TrimPrefix(name, "main."), "(*")
+	if i := strings.IndexAny(name, "(.[) "); i >= 0 {
+		name = name[:i]
+	}
+	return s.runtime[name]
+}
+
+// escapeModulePath returns the path of a module, as it is in the module cache,
+// where the upper case letters are escaped as '!' followed by the lower case
+// letter, so that it is the same on case insensitive file systems.
+func escapeModulePath(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if unicode.IsUpper(r) {
+			b.WriteByte('!')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
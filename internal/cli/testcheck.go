@@ -0,0 +1,136 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// vetTypeError matches the errors reported by go vet for the packages, or
+	// their test files, which do not type-check, as opposed to its findings
+	vetTypeError = regexp.MustCompile(`^vet: (.+?):(\d+):(\d+): (.*)$`)
+	// redeclared matches the type error of a name declared twice
+	redeclared = regexp.MustCompile(`^(\w+) redeclared in this block`)
+)
+
+// testBreakage is a type error in an instrumented package, or its tests
+type testBreakage struct {
+	File    string
+	Line    int
+	Col     int
+	Message string
+}
+
+// checkTests runs go vet on the instrumented packages, including their test
+// files, and reports the type errors in them, along with the generated code
+// causing them, to w, so that the breakages of go test are not discovered
+// only when the tests run. It returns the number of the packages broken.
+// go vet reports the first type error of a package only.
+func checkTests(ctx *build.Context, mainFile string, packages []string, w io.Writer) (int, error) {
+	_, err := runCommand("", goEnv(ctx), "go", append([]string{"vet"}, packages...)...)
+	var cerr *commandError
+	if err == nil {
+		return 0, nil
+	} else if !errors.As(err, &cerr) || cerr.TimedOut {
+		return 0, err
+	}
+	var breakages []testBreakage
+	s := bufio.NewScanner(strings.NewReader(cerr.Stderr))
+	for s.Scan() {
+		m := vetTypeError.FindStringSubmatch(s.Text())
+		if m == nil {
+			continue
+		}
+		line, _ := strconv.Atoi(m[2])
+		col, _ := strconv.Atoi(m[3])
+		breakages = append(breakages, testBreakage{File: m[1], Line: line, Col: col, Message: m[4]})
+	}
+	for _, b := range breakages {
+		fmt.Fprintf(w, "  %s:%d:%d: %s\n", b.File, b.Line, b.Col, b.Message)
+		if m := redeclared.FindStringSubmatch(b.Message); m != nil {
+			if line, ok := declarationLine(mainFile, m[1]); ok {
+				fmt.Fprintf(w, "    %s is declared by the generated code at %s:%d\n", m[1], mainFile, line)
+				continue
+			}
+		}
+		if src, ok := sourceLine(b.File, b.Line); ok {
+			fmt.Fprintf(w, "    %s\n", strings.TrimSpace(src))
+		}
+	}
+	return len(breakages), nil
+}
+
+// declarationLine returns the line of the package level declaration of name
+// in the file at path, as it is in the file, whatever its //line directives.
+func declarationLine(path, name string) (int, bool) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return 0, false
+	}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil && d.Name.Name == name {
+				return fset.PositionFor(d.Name.Pos(), false).Line, true
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.ValueSpec:
+					for _, n := range s.Names {
+						if n.Name == name {
+							return fset.PositionFor(n.Pos(), false).Line, true
+						}
+					}
+				case *ast.TypeSpec:
+					if s.Name.Name == name {
+						return fset.PositionFor(s.Name.Pos(), false).Line, true
+					}
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// sourceLine returns the line'th line of the file at path
+func sourceLine(path string, line int) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for i := 1; s.Scan(); i++ {
+		if i == line {
+			return s.Text(), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,291 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// defaultHistoryFile is the file the coverage history is kept in, unless
+// another one is given through -history
+const defaultHistoryFile = "coverage-history.jsonl"
+
+// trendEntry is the coverage of a single run of the tests, as recorded in the
+// history, one JSON object per line.
+type trendEntry struct {
+	Time     time.Time                 `json:"time"`
+	Commit   string                    `json:"commit,omitempty"`
+	Label    string                    `json:"label,omitempty"`
+	Totals   profile.Totals            `json:"totals"`
+	Packages map[string]profile.Totals `json:"packages"`
+}
+
+// The size of the trend graph, and the margins around the plot in it, in
+// pixels
+const (
+	trendWidth   = 800
+	trendHeight  = 400
+	trendMargin  = 50
+	trendLegendY = 20
+)
+
+// trendColors are the colors of the lines of the subsystems in the trend
+// graph, in turn. The total is drawn in black.
+var trendColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#17becf"}
+
+// trendCommand records the coverage of profiles in the history, or graphs the
+// history, as configured by the arguments of the trend subcommand.
+func trendCommand(args []string, w io.Writer) error {
+	const usage = "usage: gobinarycoverage trend record [-history file] [-label label] profile.out [profile.out...]\n" +
+		"       gobinarycoverage trend graph [-history file] [-o trend.svg] [-subsystems patterns] [-title title]"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	switch args[0] {
+	case "record":
+		return trendRecord(args[1:], usage)
+	case "graph":
+		return trendGraph(args[1:], usage)
+	}
+	return errors.New(usage)
+}
+
+// trendUsage is the help of the trend subcommand.
+const trendUsage = `
+   gobinarycoverage trend record [-history file] [-label label] profile.out [profile.out...]
+   gobinarycoverage trend graph [-history file] [-o trend.svg] [-subsystems patterns] [-title title]
+
+       record appends the coverage of the merge of the profiles given,
+       in total and per package, along with the commit checked out, to
+       the history (default ./coverage-history.jsonl). graph renders the
+       history as an SVG line chart of the total coverage, and of the
+       packages matching each of the comma separated -subsystems.
+`
+
+// trendRecord appends the coverage of the merge of the profiles given to the
+// history, along with the commit checked out, if any.
+func trendRecord(args []string, usage string) error {
+	fs := flag.NewFlagSet("trend record", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, trendUsage)
+	history := fs.String("history", defaultHistoryFile, "The file the history is kept in")
+	label := fs.String("label", "", "The label of the entry, e.g. the version under test")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New(usage)
+	}
+	merged, err := loadProfile(fs.Args())
+	if err != nil {
+		return err
+	}
+	r := profile.Summarize(merged)
+	e := trendEntry{
+		Time:     time.Now().UTC(),
+		Commit:   gitHead(""),
+		Label:    *label,
+		Totals:   r.Totals,
+		Packages: make(map[string]profile.Totals),
+	}
+	for _, pr := range r.Packages {
+		e.Packages[pr.ImportPath] = pr.Totals
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*history, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readHistory returns the entries of the history at path, in the order they
+// were recorded
+func readHistory(path string) ([]trendEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []trendEntry
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 16*1024*1024)
+	for n := 1; s.Scan(); n++ {
+		if strings.TrimSpace(s.Text()) == "" {
+			continue
+		}
+		var e trendEntry
+		if err = json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err.Error())
+		}
+		entries = append(entries, e)
+	}
+	return entries, s.Err()
+}
+
+// trendSeries is a line of the trend graph: the coverage, in percent, at every
+// entry of the history, or -1 where it has no statements
+type trendSeries struct {
+	name    string
+	color   string
+	percent []float64
+}
+
+// trendGraph renders the history as an SVG line chart of the total coverage,
+// and of the coverage of every subsystem, i.e., of the packages matching each
+// of the patterns given.
+func trendGraph(args []string, usage string) error {
+	fs := flag.NewFlagSet("trend graph", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, trendUsage)
+	history := fs.String("history", defaultHistoryFile, "The file the history is kept in")
+	out := fs.String("o", "trend.svg", "Write the graph to this file")
+	subsystems := fs.String("subsystems", "", "Draw a line for the packages matching each of these comma separated patterns as well, e.g. example.com/app/installer/...")
+	title := fs.String("title", "Coverage", "The title of the graph")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New(usage)
+	}
+	if ext := strings.ToLower(filepath.Ext(*out)); ext != ".svg" {
+		return fmt.Errorf("the graph is written as SVG only, not %s, convert it with e.g. rsvg-convert", ext)
+	}
+	entries, err := readHistory(*history)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no entries in the history %s, add them with trend record", *history)
+	}
+
+	series := []trendSeries{{name: "total", color: "#000000"}}
+	for _, e := range entries {
+		series[0].percent = append(series[0].percent, e.Totals.Percent)
+	}
+	if *subsystems != "" {
+		for i, pattern := range strings.Split(*subsystems, ",") {
+			s := trendSeries{name: pattern, color: trendColors[i%len(trendColors)]}
+			for _, e := range entries {
+				var t profile.Totals
+				for pkg, pt := range e.Packages {
+					if matchPackagePattern(pattern, pkg) {
+						t.Add(pt.Statements, pt.Covered)
+					}
+				}
+				if t.Statements == 0 {
+					s.percent = append(s.percent, -1)
+					continue
+				}
+				s.percent = append(s.percent, t.Percent)
+			}
+			series = append(series, s)
+		}
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err = writeTrendSVG(f, *title, entries, series); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeTrendSVG writes the series over the entries of the history as an SVG
+// line chart, with the coverage from 0 to 100% upwards, and the entries
+// evenly spaced to the right, labeled by their label, or else their date.
+func writeTrendSVG(w io.Writer, title string, entries []trendEntry, series []trendSeries) error {
+	plotWidth, plotHeight := float64(trendWidth-2*trendMargin), float64(trendHeight-2*trendMargin)
+	x := func(i int) float64 {
+		if len(entries) == 1 {
+			return trendMargin + plotWidth/2
+		}
+		return trendMargin + plotWidth*float64(i)/float64(len(entries)-1)
+	}
+	y := func(percent float64) float64 {
+		return trendMargin + plotHeight*(100-percent)/100
+	}
+	label := func(e trendEntry) string {
+		if e.Label != "" {
+			return e.Label
+		}
+		return e.Time.Format("2006-01-02")
+	}
+
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="12">`+"\n",
+		trendWidth, trendHeight)
+	fmt.Fprintf(w, `<rect width="%d" height="%d" fill="#ffffff"/>`+"\n", trendWidth, trendHeight)
+	fmt.Fprintf(w, `<text x="%d" y="%d" font-size="16">%s</text>`+"\n", trendMargin, trendLegendY+5, html.EscapeString(title))
+	// The grid, every 20%
+	for p := 0; p <= 100; p += 20 {
+		fmt.Fprintf(w, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#dddddd"/>`+"\n",
+			trendMargin, y(float64(p)), trendWidth-trendMargin, y(float64(p)))
+		fmt.Fprintf(w, `<text x="%d" y="%.1f" text-anchor="end">%d%%</text>`+"\n", trendMargin-5, y(float64(p))+4, p)
+	}
+	// The labels of the first, and the last entry
+	fmt.Fprintf(w, `<text x="%.1f" y="%d" text-anchor="start">%s</text>`+"\n",
+		x(0), trendHeight-trendMargin+20, html.EscapeString(label(entries[0])))
+	if len(entries) > 1 {
+		fmt.Fprintf(w, `<text x="%.1f" y="%d" text-anchor="end">%s</text>`+"\n",
+			x(len(entries)-1), trendHeight-trendMargin+20, html.EscapeString(label(entries[len(entries)-1])))
+	}
+	for i, s := range series {
+		// The line is broken where the subsystem has no statements
+		var points []string
+		flush := func() {
+			if len(points) > 1 {
+				fmt.Fprintf(w, `<polyline fill="none" stroke="%s" stroke-width="2" points="%s"/>`+"\n", s.color, strings.Join(points, " "))
+			}
+			points = points[:0]
+		}
+		for j, p := range s.percent {
+			if p < 0 {
+				flush()
+				continue
+			}
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x(j), y(p)))
+			fmt.Fprintf(w, `<circle cx="%.1f" cy="%.1f" r="3" fill="%s"><title>%s: %.1f%%</title></circle>`+"\n",
+				x(j), y(p), s.color, html.EscapeString(label(entries[j])), p)
+		}
+		flush()
+		// The legend, to the right of the title
+		legendX := trendWidth/3 + (i%4)*150
+		legendY := trendLegendY - 10 + (i/4)*14
+		fmt.Fprintf(w, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/>`+"\n", legendX, legendY, s.color)
+		fmt.Fprintf(w, `<text x="%d" y="%d">%s</text>`+"\n", legendX+14, legendY+10, html.EscapeString(s.name))
+	}
+	_, err := io.WriteString(w, "</svg>\n")
+	return err
+}
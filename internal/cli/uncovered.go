@@ -0,0 +1,221 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"path"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// funcCoverage is the coverage of a single function
+type funcCoverage struct {
+	File       string // As in the profile
+	Line       int
+	Name       string // E.g. (*Stack).Push
+	Exported   bool   // Whether the function, and the type of its receiver, if any, are exported
+	Statements int
+	Covered    int
+	Calls      int // The count of the first block, i.e., the number of calls in the count modes
+}
+
+// uncoveredUsage is the help of the uncovered subcommand.
+const uncoveredUsage = `
+   gobinarycoverage uncovered [-pkg pattern] [-partial] [-n count] profile.out [profile.out...]
+
+       Lists the functions which are not covered at all, sorted by their
+       number of statements, as a prioritized list of what to test next.
+       -pkg only lists the functions in the packages matching the
+       pattern, and -partial lists the partially covered functions too,
+       by their uncovered statements. At most count (default 20)
+       functions are listed, or all of them if it is 0.
+`
+
+// uncoveredCommand lists the functions which are not covered, largest first,
+// as configured by the arguments of the uncovered subcommand.
+func uncoveredCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("uncovered", flag.ContinueOnError)
+	fs.Usage = subcommandUsage(fs, uncoveredUsage)
+	pkg := fs.String("pkg", "", "Only list the functions in the packages matching this pattern, e.g. example.com/app/...")
+	partial := fs.Bool("partial", false, "List the partially covered functions as well, by their uncovered statements")
+	limit := fs.Int("n", 20, "The number of functions to list, or 0 for all")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return errors.New("usage: gobinarycoverage uncovered [-pkg pattern] [-partial] [-n count] profile.out [profile.out...]")
+	}
+	merged, err := loadProfile(fs.Args())
+	if err != nil {
+		return err
+	}
+	all, err := profileFuncCoverage(merged, *pkg)
+	if err != nil {
+		return err
+	}
+	var funcs []funcCoverage
+	for _, f := range all {
+		if f.Statements > f.Covered && (f.Covered == 0 || *partial) {
+			funcs = append(funcs, f)
+		}
+	}
+	sort.SliceStable(funcs, func(i, j int) bool {
+		return funcs[i].Statements-funcs[i].Covered > funcs[j].Statements-funcs[j].Covered
+	})
+	if *limit > 0 && len(funcs) > *limit {
+		funcs = funcs[:*limit]
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, f := range funcs {
+		fmt.Fprintf(tw, "%s:%d\t%s\t%d/%d uncovered\n", f.File, f.Line, f.Name, f.Statements-f.Covered, f.Statements)
+	}
+	return tw.Flush()
+}
+
+// profileFuncCoverage returns the coverage of all the functions in the files of
+// the profile p, in the packages matching the package pattern pkg, if any. The
+// sources are found through go list.
+func profileFuncCoverage(p *profile.Profile, pkg string) ([]funcCoverage, error) {
+	blocks := make(map[string][]profile.Block)
+	var files []string
+	for _, b := range p.Blocks {
+		if pkg != "" && !matchPackagePattern(pkg, path.Dir(b.File)) {
+			continue
+		}
+		if _, ok := blocks[b.File]; !ok {
+			files = append(files, b.File)
+		}
+		blocks[b.File] = append(blocks[b.File], b)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files in the profile match the package pattern %s", pkg)
+	}
+	sort.Strings(files)
+	paths, err := resolveProfileFiles(options{}.buildContext(), files)
+	if err != nil {
+		return nil, err
+	}
+	var funcs []funcCoverage
+	for _, file := range files {
+		fc, err := fileFuncCoverage(blocks[file], file, paths[file])
+		if err != nil {
+			return nil, err
+		}
+		funcs = append(funcs, fc...)
+	}
+	return funcs, nil
+}
+
+// fileFuncCoverage returns the coverage of the functions in the source file at
+// src, named file in the profile, from its blocks, in the order they are
+// declared.
+func fileFuncCoverage(blocks []profile.Block, file, src string) ([]funcCoverage, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, src, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	type position struct{ line, col int }
+	before := func(a, b position) bool {
+		return a.line < b.line || a.line == b.line && a.col < b.col
+	}
+	var funcs []funcCoverage
+	var ranges [][2]position
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil {
+			continue
+		}
+		start, end := fset.Position(fn.Pos()), fset.Position(fn.End())
+		funcs = append(funcs, funcCoverage{File: file, Line: start.Line, Name: funcName(fn), Exported: funcExported(fn)})
+		ranges = append(ranges, [2]position{{start.Line, start.Column}, {end.Line, end.Column}})
+	}
+	first := make([]position, len(funcs))
+	for _, b := range blocks {
+		start := position{b.StartLine, b.StartCol}
+		for i, r := range ranges {
+			if !before(start, r[0]) && before(start, r[1]) {
+				funcs[i].Statements += b.NumStmt
+				if b.Count > 0 {
+					funcs[i].Covered += b.NumStmt
+				}
+				// The first block runs once for every call
+				if first[i].line == 0 || before(start, first[i]) {
+					first[i] = start
+					funcs[i].Calls = b.Count
+				}
+				break
+			}
+		}
+	}
+	return funcs, nil
+}
+
+// funcName returns the name of the function, qualified by the type of its
+// receiver, if it is a method, e.g. (*Stack).Push
+func funcName(fn *ast.FuncDecl) string {
+	star, recv := funcReceiver(fn)
+	if recv == "" {
+		return fn.Name.Name
+	}
+	return "(" + star + recv + ")." + fn.Name.Name
+}
+
+// funcExported returns whether the function is a part of the API of its
+// package, i.e., whether it is exported, and so is the type of its receiver,
+// if it is a method.
+func funcExported(fn *ast.FuncDecl) bool {
+	if !fn.Name.IsExported() {
+		return false
+	}
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return true
+	}
+	_, recv := funcReceiver(fn)
+	return ast.IsExported(recv)
+}
+
+// funcReceiver returns the name of the type of the receiver of the function,
+// without its type parameters, and "*" if it is a pointer, or "" if the
+// function is not a method.
+func funcReceiver(fn *ast.FuncDecl) (star, name string) {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return "", ""
+	}
+	typ := fn.Recv.List[0].Type
+	if s, ok := typ.(*ast.StarExpr); ok {
+		star, typ = "*", s.X
+	}
+	// Drop the type parameters of generic types
+	switch t := typ.(type) {
+	case *ast.IndexExpr:
+		typ = t.X
+	case *ast.IndexListExpr:
+		typ = t.X
+	}
+	if id, ok := typ.(*ast.Ident); ok {
+		return star, id.Name
+	}
+	return "", ""
+}
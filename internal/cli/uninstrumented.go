@@ -0,0 +1,129 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"flag"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"path/filepath"
+
+	"github.com/mendersoftware/gobinarycoverage/pkg/profile"
+)
+
+// uninstrumentedFile is a file built into the binary, which is not
+// instrumented, and the number of statements in it
+type uninstrumentedFile struct {
+	name       string // As in the profile, i.e., prefixed by the import path
+	statements int
+}
+
+// findUninstrumented lists the files built into the binary of the main package
+// mainPkg, for the platform of the profile p, which are not instrumented: the
+// files of the packages instrumented without any of them excluded, and of the
+// packages in p, which are not in p, e.g., as their packages are excluded, or
+// as they use cgo. The files without any statements are left out.
+func findUninstrumented(mainPkg string, p *profile.Profile) ([]uninstrumentedFile, error) {
+	opts := options{goos: p.Tags["goos"], goarch: p.Tags["goarch"]}
+	paths, err := coverPackages(mainPkg, opts)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(paths))
+	for _, pkg := range paths {
+		seen[pkg] = true
+	}
+	instrumented := make(map[string]bool)
+	for _, file := range p.Files() {
+		instrumented[file] = true
+		if pkg := path.Dir(file); !filepath.IsAbs(file) && !seen[pkg] {
+			seen[pkg] = true
+			paths = append(paths, pkg)
+		}
+	}
+	ctx := opts.buildContext()
+	listed, err := listPackages(ctx, paths)
+	if err != nil {
+		return nil, err
+	}
+	var files []uninstrumentedFile
+	fset := token.NewFileSet()
+	for _, pkg := range listed {
+		names, err := selectGoFiles(ctx, pkg)
+		if err != nil {
+			return nil, err
+		}
+		if ctx.CgoEnabled {
+			names = append(names, pkg.CgoFiles...)
+		}
+		for _, name := range names {
+			file := pkg.ImportPath + "/" + name
+			if instrumented[file] {
+				continue
+			}
+			f, err := parser.ParseFile(fset, filepath.Join(pkg.Dir, name), nil, 0)
+			if err != nil {
+				return nil, err
+			}
+			if n := countFileStmts(f); n > 0 {
+				files = append(files, uninstrumentedFile{name: file, statements: n})
+			}
+		}
+	}
+	return files, nil
+}
+
+// countFileStmts returns the number of statements in the function bodies of f,
+// as counted by go tool cover.
+func countFileStmts(f *ast.File) int {
+	n := 0
+	ast.Inspect(f, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FuncDecl:
+			if node.Body != nil {
+				n += countStmts(node.Body)
+			}
+		case *ast.FuncLit:
+			n += countStmts(node.Body)
+		}
+		return true
+	})
+	return n
+}
+
+// uninstrumentedFlags adds the -uninstrumented, and -main flags to fs. The
+// function returned adds the files which are not instrumented, as found by
+// findUninstrumented, to the summary r of the profile p, with all of their
+// statements uncovered, once fs is parsed, if -uninstrumented is given, so that
+// the totals are of all the statements built into the binary.
+func uninstrumentedFlags(fs *flag.FlagSet) (func(p *profile.Profile, r *profile.Summary) error, *bool) {
+	include := fs.Bool("uninstrumented", false, "Count the statements of the files which are not instrumented, e.g., excluded, or using cgo, as uncovered")
+	mainPkg := fs.String("main", ".", "With -uninstrumented, the main package the binary is built from")
+	return func(p *profile.Profile, r *profile.Summary) error {
+		if !*include {
+			return nil
+		}
+		files, err := findUninstrumented(*mainPkg, p)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			r.AddUninstrumented(f.name, f.statements, p.Counted(f.name))
+		}
+		return nil
+	}, include
+}
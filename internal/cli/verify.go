@@ -0,0 +1,142 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// coverVarDecl matches the GoCover variables declared by go tool cover
+	coverVarDecl = regexp.MustCompile(`(?m)^var GoCover\d+ = struct \{`)
+	// coverRegisterDecl matches the registration in the generated main file
+	coverRegisterDecl = regexp.MustCompile(`(?m)^var coverRegistered = coverRegister\(\)`)
+)
+
+// findInstrumented returns the instrumentation artifacts left in the tree at
+// root, i.e., instrumented files, the generated main file, the copies of the
+// module cache, and the go.mod replacements of them, and the lock, with a
+// description of each, relative to root.
+func findInstrumented(root string) ([]string, error) {
+	var found []string
+	if _, err := os.Stat(filepath.Join(root, lockFile)); err == nil {
+		found = append(found, lockFile+": an instrumentation is running, or was interrupted")
+	}
+	if _, err := os.Stat(filepath.Join(root, modCacheCopyDir)); err == nil {
+		found = append(found, modCacheCopyDir+": the copies of the modules in the module cache")
+	}
+	if _, err := os.Stat(filepath.Join(root, backupDir)); err == nil {
+		found = append(found, backupDir+": the originals of the files instrumented, which gobinarycoverage restore reverts")
+	}
+	if contents, err := os.ReadFile(filepath.Join(root, "go.mod")); err == nil &&
+		bytes.Contains(contents, []byte("./"+modCacheCopyDir)) {
+		found = append(found, "go.mod: replaces modules with their copies in "+modCacheCopyDir)
+	}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// The directories ignored by the go command
+			name := d.Name()
+			if path != root && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") {
+			return nil
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if coverRegisterDecl.Match(contents) {
+			found = append(found, rel+": holds the generated main file")
+		} else if coverVarDecl.Match(contents) {
+			found = append(found, rel+": is instrumented")
+		}
+		return nil
+	})
+	return found, err
+}
+
+// verifyUsage is the help of the verify subcommand.
+const verifyUsage = `
+   gobinarycoverage verify [-git] [dir]
+
+       Fails if anything instrumented is left in the tree at dir (default:
+       the root of the main module) after restoring it: instrumented files,
+       the generated main file, the copies of the module cache, and their
+       replacements in go.mod, or the lock. With -git, it fails if
+       git status --porcelain reports any changes too. Run it before the
+       release builds, so that they are never built from a tree which is
+       only partly restored.
+`
+
+// verifyCommand fails if anything instrumented is left in the tree, and with
+// -git, if git reports any changes in it, as configured by the arguments of
+// the verify subcommand. It guards the release builds against trees which
+// are only partly restored.
+func verifyCommand(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.Usage = subcommandUsage(flags, verifyUsage)
+	checkGit := flags.Bool("git", false, "Fail if git status --porcelain reports any changes too")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return errors.New("usage: gobinarycoverage verify [-git] [dir]")
+	}
+	root := flags.Arg(0)
+	if root == "" {
+		var err error
+		if root, err = moduleRoot(options{}.buildContext()); err != nil {
+			return err
+		}
+	}
+	found, err := findInstrumented(root)
+	if err != nil {
+		return err
+	}
+	for _, f := range found {
+		fmt.Fprintln(w, f)
+	}
+	if *checkGit {
+		out, err := runCommand(root, nil, "git", "status", "--porcelain")
+		if err != nil {
+			return err
+		}
+		if len(out) > 0 {
+			fmt.Fprintf(w, "git status --porcelain:\n%s", out)
+			found = append(found, "git")
+		}
+	}
+	if len(found) > 0 {
+		return fmt.Errorf("%s is not pristine", root)
+	}
+	fmt.Fprintf(w, "%s is pristine\n", root)
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// version is the version of gobinarycoverage. Release builds set it with
+//
+//	go build -ldflags "-X main.version=1.2.3"
+//
+// and otherwise it is taken from the module version, when installed with
+// `go install github.com/mendersoftware/gobinarycoverage@version`.
+var version = ""
+
+// minGoMinorVersion is the oldest Go toolchain supported, i.e., go1.18, as
+// generic code can not be parsed by older ones. There is no upper bound.
+const minGoMinorVersion = 18
+
+// versionInfo identifies the build of gobinarycoverage, for traceability of
+// the instrumented binaries and the coverage it produces.
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`     // The toolchain gobinarycoverage is built with
+	GoMin     string `json:"go_min_version"` // The oldest toolchain supported
+}
+
+// getVersionInfo returns the version of gobinarycoverage, and the git commit
+// it is built from, as embedded by the go command.
+func getVersionInfo() versionInfo {
+	v := versionInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		GoMin:     "go1." + strconv.Itoa(minGoMinorVersion),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if v.Version == "" && bi.Main.Version != "(devel)" {
+			v.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				v.Commit = s.Value
+			case "vcs.modified":
+				v.Modified = s.Value == "true"
+			}
+		}
+	}
+	if v.Version == "" {
+		v.Version = "devel"
+	}
+	return v
+}
+
+// goMinorVersion returns the minor version of a Go version string such as
+// go1.21.3, or false if it is not a release version.
+func goMinorVersion(v string) (int, bool) {
+	v = strings.TrimPrefix(v, "go1.")
+	if i := strings.IndexAny(v, ".rcbeta "); i >= 0 {
+		v = v[:i]
+	}
+	minor, err := strconv.Atoi(v)
+	return minor, err == nil
+}
+
+// printVersion prints the version information, along with the version of the
+// go toolchain in the environment, and whether it is supported.
+func printVersion(w io.Writer) {
+	v := getVersionInfo()
+	commit := v.Commit
+	if commit == "" {
+		commit = "unknown"
+	} else if v.Modified {
+		commit += " (modified)"
+	}
+	fmt.Fprintf(w, "gobinarycoverage %s\n", v.Version)
+	fmt.Fprintf(w, "commit:            %s\n", commit)
+	fmt.Fprintf(w, "built with:        %s\n", v.GoVersion)
+	fmt.Fprintf(w, "supported go:      %s and later\n", v.GoMin)
+	toolchain, err := goEnvVar(&goContext, "GOVERSION")
+	if err != nil {
+		return
+	}
+	supported := "supported"
+	if minor, ok := goMinorVersion(toolchain); ok && minor < minGoMinorVersion {
+		supported = "not supported"
+	} else if !ok {
+		supported = "development version"
+	}
+	fmt.Fprintf(w, "go toolchain:      %s (%s)\n", toolchain, supported)
+}
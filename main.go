@@ -0,0 +1,29 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Gobinarycoverage instruments the main packages, and the packages they
+// import, with coverage, so that their binaries gather the coverage while
+// running, just like regular binaries. See gobinarycoverage -h, and the Readme.
+//
+// The instrumentation is available as a library as well, see the instrument
+// package.
+package main
+
+import (
+	"github.com/mendersoftware/gobinarycoverage/internal/cli"
+)
+
+func main() {
+	cli.Main()
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package instrument instruments the main packages, and the packages they
+// import, with coverage, as gobinarycoverage instrument does, for the build
+// tooling, and the test harnesses, calling it from Go:
+//
+//	res, err := instrument.Package(instrument.Options{
+//		Packages: []string{"./cmd/app"},
+//		Mode:     "count",
+//	})
+//	var ierr *instrument.Error
+//	if errors.As(err, &ierr) {
+//		for _, c := range ierr.Conflicts {
+//			...
+//		}
+//	}
+//
+// The files of the packages are changed in place, as by the command, and the
+// diagnostics are written to Options.Diagnostics, or to stderr if it is nil.
+// Package must not be called concurrently.
+package instrument
+
+import (
+	"errors"
+	"io"
+
+	"github.com/mendersoftware/gobinarycoverage/internal/cli"
+)
+
+// The errors the instrumentation fails with, which Error wraps
+var (
+	// ErrDirtyTree is returned when the tree has uncommitted changes, unless
+	// Options.Force is set
+	ErrDirtyTree = cli.ErrDirtyTree
+	// ErrLocked is returned when the tree is being instrumented by another
+	// process, unless Options.Wait is set
+	ErrLocked = cli.ErrLocked
+	// ErrConflict is returned when the generated code conflicts with the
+	// declarations of the main package, see Error.Conflicts
+	ErrConflict = errors.New("the generated code conflicts with the main package")
+	// ErrVerifyFailed is returned when the instrumented packages do not
+	// build, or pass go vet, with Options.Verify. The errors are written to
+	// Options.Diagnostics
+	ErrVerifyFailed = cli.ErrVerifyFailed
+)
+
+// Options are the options of the instrumentation, as the flags of
+// gobinarycoverage instrument, e.g., Mode is -mode. The zero values are the
+// defaults of the flags. The configuration file is not read.
+type Options struct {
+	Packages        []string // The main packages, by import path, directory, or pattern, e.g., ./cmd/...
+	Mode            string   // set, count, or atomic
+	Race            bool     // The binary is built with the race detector
+	Granularity     string   // block, or func
+	Sample          float64  // The percentage of the blocks instrumented
+	Label           string   // The project label in the summary line of the binary
+	EnvPrefix       string   // The prefix of the environment variables read by the binary, instead of COVERAGE_
+	PerModule       bool     // Write the profiles into the subdirectory named by the main module
+	ExcludePkg      []string // The patterns of the packages not to instrument
+	IncludePkg      []string // The patterns of the packages to instrument, if not all of them
+	ExcludeFile     []string // The globs of the files not to instrument, e.g., *_gen.go
+	IncludeFile     []string // The globs of the files to instrument, if not all of them
+	TotalPkg        []string // The patterns of the packages counted in the totals
+	IncludeReplaced bool     // Instrument the modules replaced by local directories as well
+	Template        string   // Generate the main file from this text/template
+	Output          string   // Write the merged main file to this path, or into this shadow directory
+	Overlay         string   // Write the files changed, and the overlay.json of go build -overlay, into this directory, leaving the tree untouched
+	GOOS            string   // Instrument for this GOOS, instead of the one in the environment
+	GOARCH          string   // Instrument for this GOARCH, instead of the one in the environment
+	Tags            []string // Instrument the files compiled with these build tags, instead of the ones in GOFLAGS
+	Dir             string   // The directory the binary writes the profiles to, unless COVERAGE_FILEPATH is set
+	FlushOnSIGTERM  bool     // Write the coverage, and exit, on SIGTERM
+	ExitSignals     []string // Write the coverage, and exit, on these signals, e.g., TERM
+	FlushSignals    []string // Write the coverage, and keep running, on these signals, e.g., USR1
+	DumpAddr        string   // Serve the endpoint writing the coverage on this address
+	Serve           bool     // Serve the coverage profile, summary, and reset, on the address in COVERAGE_LISTEN
+	ReportFormats   []string // Write these reports along with every profile: lcov, cobertura, or json
+	OnConflict      string   // abort, rename, or skip, on the conflicts with the main package
+	Force           bool     // Instrument the tree even if it has uncommitted changes, or is instrumented already
+	Wait            bool     // Wait for the lock on the tree, instead of failing with ErrLocked
+	SkipTestCheck   bool     // Do not check that the tests of the instrumented packages still compile
+	KeepTemp        bool     // Keep the files instrumented by go tool cover, for debugging
+	Jobs            int      // The files instrumented at once, or GOMAXPROCS if 0
+	Manifest        string   // Write the files changed, with their packages, GoCover variables, and hashes, to this file, as JSON
+	Verify          string   // Check that the instrumented packages still build, or pass go vet: build, or vet, failing with ErrVerifyFailed
+	Backend         string   // legacy, native, to return the go build flags of the native coverage in Main.BuildFlags, or auto, to pick by the toolchain
+	EmitPatch       string   // Write every change as a unified diff to this file, leaving the tree untouched
+	Record          string   // Record every decision of the instrumentation to this file
+	Replay          string   // Replay the decisions recorded in this file, instead of instrumenting Packages
+	Stash           bool     // Save the uncommitted changes in the git stash before instrumenting, instead of failing with ErrDirtyTree
+	HotProfile      string   // Keep the counters out of the hot functions in this CPU profile
+	HotThreshold    float64  // The share of the CPU, in percent, of the hot functions, or 1 if 0
+	HotAction       string   // exclude, or func, the hot functions
+	SystemdNotify   bool     // Notify systemd when the coverage is written
+	FlushTrigger    string   // Write the coverage whenever this file is created, or touched
+	LiveAddr        string   // Serve the live view of the coverage on this address
+	Expvar          bool     // Publish the covered and total statements through expvar
+	Pprof           bool     // Serve the page of the coverage in the index of net/http/pprof
+	Rotate          string   // Write the coverage into a new profile, and reset the counters, hourly, daily, or at this interval
+	SubcommandDepth int      // Record the subcommand the binary is run with, of at most this many words
+	MaxProfiles     int      // Remove the oldest profiles beyond this many
+	MaxProfilesSize int64    // Remove the oldest profiles beyond this total size in bytes
+	Lock            bool     // Lock the coverage directory while writing the profiles
+	SyslogFallback  bool     // Write the profile to syslog when no directory is writable
+	MQTTBroker      string   // Publish the profiles to this MQTT broker
+	MQTTTopic       string   // The MQTT topic the profiles are published to, or gobinarycoverage if empty
+	Log             string   // Write the messages of the binary to this file, or nowhere if off, instead of stderr
+	Persist         string   // Load the counters from this file at startup, and save them to it whenever the coverage is written
+	Compact         string   // Write the counters in the compact format, and the metadata decoding them to this file
+
+	Diagnostics io.Writer // Write the warnings, and the failures, of the instrumentation to this writer, instead of stderr
+}
+
+// Result is the outcome of the instrumentation
+type Result struct {
+	Mains []Main
+}
+
+// Main is a main package instrumented
+type Main struct {
+	Package  string   // The import path of the main package
+	MainFile string   // The merged main file written, or empty if the main package is left as it is
+	Packages []string // The packages instrumented, by import path
+	Skipped  []string // The packages without any code to cover, which are left as they are
+	Files    []string // The paths of the files instrumented
+
+	BuildFlags []string // The flags of go build building the coverage binary, e.g., -cover, with Options.Backend native, which changes no file
+}
+
+// Conflict is a declaration of the generated code, whose name is declared in
+// the main package already.
+type Conflict struct {
+	Symbol   string
+	Location string // The position of the declaration in the main package
+	Reason   string
+}
+
+// Error is the failure of the instrumentation of a main package, which wraps
+// one of ErrDirtyTree, ErrLocked, ErrConflict, or ErrVerifyFailed, if any of
+// them is the cause. The main packages before it are instrumented.
+type Error struct {
+	Package   string     // The main package, as given, or empty if the failure is not of one of them
+	Conflicts []Conflict // The conflicts with the main package, with ErrConflict
+	Err       error
+}
+
+func (e *Error) Error() string {
+	if e.Package == "" {
+		return e.Err.Error()
+	}
+	return e.Package + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Package instruments the main packages given by opts, and the packages they
+// import, and merges the coverage runtime into their main files. The failures
+// are returned as an *Error.
+func Package(opts Options) (*Result, error) {
+	mains, err := cli.Instrument(cli.LibraryOptions(opts))
+	if err != nil {
+		return nil, newError(err)
+	}
+	res := &Result{}
+	for _, m := range mains {
+		res.Mains = append(res.Mains, Main(m))
+	}
+	return res, nil
+}
+
+// newError returns the error err of the instrumentation as an *Error
+func newError(err error) *Error {
+	e := &Error{Err: err}
+	var mainErr *cli.MainError
+	if errors.As(err, &mainErr) {
+		e.Package, e.Err = mainErr.Package, mainErr.Err
+	}
+	var conflictErr *cli.ConflictError
+	if errors.As(err, &conflictErr) {
+		e.Err = &conflictError{err: e.Err}
+		for _, c := range conflictErr.Conflicts {
+			e.Conflicts = append(e.Conflicts, Conflict{Symbol: c.Symbol, Location: c.Location, Reason: c.Reason})
+		}
+	}
+	return e
+}
+
+// conflictError is the error of the conflicts with the main package, which
+// is ErrConflict.
+type conflictError struct {
+	err error
+}
+
+func (e *conflictError) Error() string {
+	return e.err.Error()
+}
+
+func (e *conflictError) Is(target error) bool {
+	return target == ErrConflict
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package profile
+
+// Drop is a package or file whose coverage dropped
+type Drop struct {
+	Name     string
+	Old, New Totals
+}
+
+// Diff is the difference in the coverage of two profiles of the same code
+type Diff struct {
+	Old, New  *Summary
+	Drops     []Drop  // The packages and files whose coverage dropped by more than the tolerance
+	Uncovered []Block // The blocks covered in the old profile, which no longer are, sorted
+}
+
+// Compare compares the coverage of the profile newer to the one of older. The
+// packages and files whose coverage dropped by more than tolerance
+// percentage points are reported as drops.
+func Compare(older, newer *Profile, tolerance float64) *Diff {
+	d := &Diff{Old: Summarize(older), New: Summarize(newer)}
+
+	// Find the packages and files whose coverage dropped
+	oldTotals := make(map[string]Totals)
+	for _, ps := range d.Old.Packages {
+		oldTotals[ps.ImportPath] = ps.Totals
+		for _, fs := range ps.Files {
+			oldTotals[fs.Name] = fs.Totals
+		}
+	}
+	dropped := func(name string, t Totals) {
+		if old, ok := oldTotals[name]; ok && t.Percent < old.Percent-tolerance {
+			d.Drops = append(d.Drops, Drop{Name: name, Old: old, New: t})
+		}
+	}
+	for _, ps := range d.New.Packages {
+		dropped(ps.ImportPath, ps.Totals)
+		for _, fs := range ps.Files {
+			dropped(fs.Name, fs.Totals)
+		}
+	}
+
+	// Find the blocks which were covered, and no longer are
+	covered := make(map[BlockKey]bool)
+	for _, b := range older.Blocks {
+		if b.Count > 0 {
+			covered[b.Key()] = true
+		}
+	}
+	for _, b := range newer.Blocks {
+		if b.Count == 0 && covered[b.Key()] {
+			d.Uncovered = append(d.Uncovered, b)
+		}
+	}
+	sortBlocks(d.Uncovered)
+	return d
+}
+
+// Delta returns the change of the total coverage, in percentage points
+func (d *Diff) Delta() float64 {
+	return d.New.Totals.Percent - d.Old.Totals.Percent
+}
+
+// Regressed returns true if the coverage of any package or file dropped, any
+// block is no longer covered, or the total coverage dropped by more than
+// tolerance percentage points.
+func (d *Diff) Regressed(tolerance float64) bool {
+	return len(d.Drops) > 0 || len(d.Uncovered) > 0 || d.Delta() < -tolerance
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package profile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	a := func(line, count int) Block {
+		return Block{File: "example.com/a/a.go", StartLine: line, EndLine: line, NumStmt: 1, Count: count}
+	}
+	b := func(line, count int) Block {
+		return Block{File: "example.com/b/b.go", StartLine: line, EndLine: line, NumStmt: 1, Count: count}
+	}
+	tests := []struct {
+		name      string
+		older     []Block
+		newer     []Block
+		tolerance float64
+		drops     []string
+		uncovered []Block
+		delta     float64
+		regressed bool
+	}{
+		{
+			name:  "same",
+			older: []Block{a(1, 1), a(2, 0)},
+			newer: []Block{a(1, 1), a(2, 0)},
+		},
+		{
+			name:  "more covered",
+			older: []Block{a(1, 1), a(2, 0)},
+			newer: []Block{a(1, 1), a(2, 1)},
+			delta: 50,
+		},
+		{
+			name:      "block no longer covered",
+			older:     []Block{a(1, 1), a(2, 0), b(1, 0)},
+			newer:     []Block{a(1, 0), a(2, 1), b(1, 0)},
+			uncovered: []Block{a(1, 0)},
+			regressed: true,
+		},
+		{
+			name:      "package dropped",
+			older:     []Block{a(1, 1), a(2, 1), b(1, 0), b(2, 0)},
+			newer:     []Block{a(1, 1), a(2, 1), a(3, 0), b(1, 0), b(2, 0)},
+			drops:     []string{"example.com/a", "example.com/a/a.go"},
+			delta:     -10,
+			regressed: true,
+		},
+		{
+			name:      "package dropped within the tolerance",
+			older:     []Block{a(1, 1), a(2, 1), a(3, 1), a(4, 0)},
+			newer:     []Block{a(1, 1), a(2, 1), a(3, 1), a(4, 0), a(5, 0)},
+			tolerance: 20,
+			delta:     -15,
+		},
+		{
+			name:  "new package",
+			older: []Block{a(1, 1)},
+			newer: []Block{a(1, 1), b(1, 1)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := Compare(&Profile{Mode: "set", Blocks: test.older}, &Profile{Mode: "set", Blocks: test.newer}, test.tolerance)
+			var drops []string
+			for _, drop := range d.Drops {
+				drops = append(drops, drop.Name)
+			}
+			if !reflect.DeepEqual(drops, test.drops) {
+				t.Errorf("drops %q, want %q", drops, test.drops)
+			}
+			if !reflect.DeepEqual(d.Uncovered, test.uncovered) {
+				t.Errorf("uncovered %+v, want %+v", d.Uncovered, test.uncovered)
+			}
+			if delta := d.Delta(); delta < test.delta-0.01 || delta > test.delta+0.01 {
+				t.Errorf("Delta() = %g, want %g", delta, test.delta)
+			}
+			if regressed := d.Regressed(test.tolerance); regressed != test.regressed {
+				t.Errorf("Regressed() = %t, want %t", regressed, test.regressed)
+			}
+		})
+	}
+}
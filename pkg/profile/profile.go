@@ -0,0 +1,410 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package profile parses, writes, merges, and analyses coverage profiles, in
+// the format written by the binaries instrumented by gobinarycoverage, and by
+// `go test -coverprofile`, so that test frameworks can work with the coverage
+// without running the gobinarycoverage subcommands.
+package profile
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SidecarSchema is the version of the format of the sidecars, <profile>.json,
+// written next to the profiles by the instrumented binaries, which this package
+// reads. The sidecars of older versions, and the profiles without one, are read
+// as well, while the ones of newer versions are refused, as their profiles may
+// not be merged safely with the others.
+const SidecarSchema = 1
+
+// Profile is a parsed coverage profile, as written by the coverReport function
+// in the instrumented binary, or by `go test -coverprofile`.
+type Profile struct {
+	Mode   string
+	Blocks []Block
+	// Sample is the percentage of the statements instrumented, if the binary
+	// is instrumented with -sample, or 0 if all of them are. The blocks are
+	// the ones instrumented only, so the coverage of them is an estimate of
+	// the coverage of all of them.
+	Sample float64
+	// Schema is the version of the format of the sidecar of the profile, or 0
+	// if it has none, or one written before the format was versioned. It is
+	// the oldest one of all the profiles merged into it.
+	Schema int
+	// Tool is the version of gobinarycoverage the binary writing the profile
+	// is instrumented by, if known, and the same for all the profiles merged
+	// into it.
+	Tool string
+	// Build is the build of the binary writing the profile, e.g., its version,
+	// or the revision it is built from, if known. The profiles of different
+	// builds are not merged, as their blocks do not line up.
+	Build string
+	// Tags are the tags of the profile, e.g., the device, or the architecture,
+	// it is written on, which are the same for all the profiles merged into
+	// it.
+	Tags map[string]string
+	// TotalPackages are the packages counted in the totals, if not all of
+	// them are, as the binary is instrumented with -total-pkg, so that the
+	// rest are only reported per package.
+	TotalPackages []string
+}
+
+// Block is a single line in a coverage profile, i.e.,
+//
+//	name.go:line.column,line.column numberOfStatements count
+type Block struct {
+	File      string
+	StartLine int
+	StartCol  int
+	EndLine   int
+	EndCol    int
+	NumStmt   int
+	Count     int
+}
+
+// ParseFile parses the coverage profile in the file at path, and its sidecar,
+// <path>.json, if any, which holds the percentage of the statements sampled,
+// the packages counted in the totals, the build of the binary, its tags, and
+// the version of the schema, and of gobinarycoverage, it is written by.
+func ParseFile(path string) (*Profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := Parse(f)
+	if err != nil {
+		return nil, err
+	}
+	sidecar, err := os.ReadFile(path + ".json")
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	var s struct {
+		Schema int               `json:"schema"`
+		Tool   string            `json:"tool"`
+		Mode   string            `json:"mode"`
+		Build  string            `json:"build"`
+		Tags   map[string]string `json:"tags"`
+		Sample float64           `json:"sample"`
+		Total  []string          `json:"total_packages"`
+	}
+	if err == nil {
+		err = json.Unmarshal(sidecar, &s)
+	}
+	if err == nil {
+		err = checkSidecar(s.Schema, s.Tool, s.Mode, p.Mode)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s.json: %s", path, err.Error())
+	}
+	p.Sample, p.Schema, p.Tool, p.Build, p.Tags = s.Sample, s.Schema, s.Tool, s.Build, s.Tags
+	p.TotalPackages = s.Total
+	return p, nil
+}
+
+// WriteSidecar writes the sidecar of the profile, as read by ParseFile, to
+// the file at path, i.e., <profile>.json, so that the build, the tags, the
+// percentage sampled, and the packages counted in the totals, of the profile
+// written by Write are kept.
+func (p *Profile) WriteSidecar(path string) error {
+	contents, err := json.MarshalIndent(struct {
+		Schema int               `json:"schema"`
+		Tool   string            `json:"tool,omitempty"`
+		Mode   string            `json:"mode"`
+		Build  string            `json:"build,omitempty"`
+		Tags   map[string]string `json:"tags,omitempty"`
+		Sample float64           `json:"sample,omitempty"`
+		Total  []string          `json:"total_packages,omitempty"`
+	}{SidecarSchema, p.Tool, p.Mode, p.Build, p.Tags, p.Sample, p.TotalPackages}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(contents, '\n'), 0644)
+}
+
+// checkSidecar returns an error if the sidecar in schema, written by the
+// gobinarycoverage version tool, of a profile in mode, can not be read along
+// with the profile in profileMode. The fields missing in the sidecars of the
+// older versions are not checked.
+func checkSidecar(schema int, tool, mode, profileMode string) error {
+	if schema > SidecarSchema {
+		if tool == "" {
+			tool = "a newer version"
+		}
+		return fmt.Errorf("the sidecar is in schema %d, written by gobinarycoverage %s, newer than schema %d: upgrade gobinarycoverage",
+			schema, tool, SidecarSchema)
+	}
+	if mode != "" && mode != profileMode {
+		return fmt.Errorf("the sidecar is of a profile in mode %q, while the profile is in mode %q", mode, profileMode)
+	}
+	return nil
+}
+
+// Parse parses a coverage profile. The first line has to be the mode line, and
+// every following line a block.
+func Parse(r io.Reader) (*Profile, error) {
+	p := &Profile{}
+	s := bufio.NewScanner(r)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if p.Mode == "" {
+			if !strings.HasPrefix(line, "mode: ") {
+				return nil, fmt.Errorf("line %d: expected the mode line, got: %q", lineno, line)
+			}
+			p.Mode = strings.TrimPrefix(line, "mode: ")
+			continue
+		}
+		b, err := parseBlock(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err.Error())
+		}
+		p.Blocks = append(p.Blocks, b)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if p.Mode == "" {
+		return nil, fmt.Errorf("no mode line found in the profile")
+	}
+	return p, nil
+}
+
+func parseBlock(line string) (Block, error) {
+	b := Block{}
+	i := strings.LastIndex(line, ":")
+	if i < 0 {
+		return b, fmt.Errorf("malformed block: %q", line)
+	}
+	b.File = line[:i]
+	var err error
+	fields := strings.FieldsFunc(line[i+1:], func(r rune) bool {
+		return r == '.' || r == ',' || r == ' '
+	})
+	if len(fields) != 6 {
+		return b, fmt.Errorf("malformed block: %q", line)
+	}
+	ints := make([]int, len(fields))
+	for j, field := range fields {
+		if ints[j], err = strconv.Atoi(field); err != nil {
+			return b, fmt.Errorf("malformed block: %q", line)
+		}
+	}
+	b.StartLine, b.StartCol, b.EndLine, b.EndCol = ints[0], ints[1], ints[2], ints[3]
+	b.NumStmt, b.Count = ints[4], ints[5]
+	return b, nil
+}
+
+// Coverage returns the number of covered statements, and the total number of
+// statements in the blocks belonging to the files for which include returns
+// true. A nil include function includes all the files.
+func (p *Profile) Coverage(include func(file string) bool) (covered, total int) {
+	for _, b := range p.Blocks {
+		if include != nil && !include(b.File) {
+			continue
+		}
+		total += b.NumStmt
+		if b.Count > 0 {
+			covered += b.NumStmt
+		}
+	}
+	return covered, total
+}
+
+// BlockKey identifies a block across profiles
+type BlockKey struct {
+	File                                 string
+	StartLine, StartCol, EndLine, EndCol int
+}
+
+// Key returns the key identifying b across profiles
+func (b Block) Key() BlockKey {
+	return BlockKey{b.File, b.StartLine, b.StartCol, b.EndLine, b.EndCol}
+}
+
+// Merge merges the blocks in q into p. The counts of the blocks present in
+// both are added, or, in set mode, or'ed. Both profiles must have the same
+// mode, be sampled the same, count the same packages in the totals, and be of
+// the same build, if known, unless p is empty. The profiles written by
+// different versions of gobinarycoverage are merged, as long as their
+// sidecars are read, see SidecarSchema.
+func (p *Profile) Merge(q *Profile) error {
+	if p.Mode == "" {
+		p.Mode, p.Sample, p.Schema, p.Tool, p.Build = q.Mode, q.Sample, q.Schema, q.Tool, q.Build
+		p.Tags = make(map[string]string, len(q.Tags))
+		for key, value := range q.Tags {
+			p.Tags[key] = value
+		}
+		p.TotalPackages = append([]string(nil), q.TotalPackages...)
+	} else if p.Mode != q.Mode {
+		return fmt.Errorf("cannot merge a profile in mode %q into one in mode %q", q.Mode, p.Mode)
+	} else if p.Sample != q.Sample {
+		return fmt.Errorf("cannot merge a profile sampling %g%% of the statements into one sampling %g%%",
+			sampled(q.Sample), sampled(p.Sample))
+	} else if p.Build != "" && q.Build != "" && p.Build != q.Build {
+		return fmt.Errorf("cannot merge a profile of the build %s into one of the build %s", q.Build, p.Build)
+	} else if totalPackages(p.TotalPackages) != totalPackages(q.TotalPackages) {
+		return fmt.Errorf("cannot merge a profile counting %s in the totals into one counting %s",
+			totalPackages(q.TotalPackages), totalPackages(p.TotalPackages))
+	}
+	if q.Schema < p.Schema {
+		p.Schema = q.Schema
+	}
+	if q.Tool != p.Tool {
+		p.Tool = ""
+	}
+	if p.Build == "" {
+		p.Build = q.Build
+	}
+	for key, value := range p.Tags {
+		if q.Tags[key] != value {
+			delete(p.Tags, key)
+		}
+	}
+	index := make(map[BlockKey]int, len(p.Blocks))
+	for i, b := range p.Blocks {
+		index[b.Key()] = i
+	}
+	for _, b := range q.Blocks {
+		i, ok := index[b.Key()]
+		if !ok {
+			index[b.Key()] = len(p.Blocks)
+			p.Blocks = append(p.Blocks, b)
+			continue
+		}
+		if p.Mode == "set" {
+			if b.Count > 0 {
+				p.Blocks[i].Count = 1
+			}
+		} else {
+			p.Blocks[i].Count += b.Count
+		}
+	}
+	return nil
+}
+
+// totalPackages describes the packages counted in the totals
+func totalPackages(packages []string) string {
+	if len(packages) == 0 {
+		return "all the packages"
+	}
+	sorted := append([]string(nil), packages...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ", ")
+}
+
+// Counted returns whether the file is counted in the totals, i.e., whether its
+// package is one of the TotalPackages, if any.
+func (p *Profile) Counted(file string) bool {
+	if len(p.TotalPackages) == 0 {
+		return true
+	}
+	pkg := path.Dir(file)
+	for _, counted := range p.TotalPackages {
+		if counted == pkg {
+			return true
+		}
+	}
+	return false
+}
+
+// sampled returns the percentage of the statements instrumented, for a
+// Sample of 0 too
+func sampled(sample float64) float64 {
+	if sample == 0 {
+		return 100
+	}
+	return sample
+}
+
+// Write writes the profile to w, in the format parsed by Parse, with the
+// blocks sorted by their position. The percentage sampled is not written, as
+// the format has no room for it.
+func (p *Profile) Write(w io.Writer) error {
+	blocks := append([]Block(nil), p.Blocks...)
+	sortBlocks(blocks)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "mode: %s\n", p.Mode)
+	for _, b := range blocks {
+		fmt.Fprintf(bw, "%s:%d.%d,%d.%d %d %d\n", b.File,
+			b.StartLine, b.StartCol, b.EndLine, b.EndCol, b.NumStmt, b.Count)
+	}
+	return bw.Flush()
+}
+
+// sortBlocks sorts the blocks by file, and their position in it
+func sortBlocks(blocks []Block) {
+	sort.Slice(blocks, func(i, j int) bool {
+		a, b := blocks[i], blocks[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.StartLine != b.StartLine {
+			return a.StartLine < b.StartLine
+		}
+		return a.StartCol < b.StartCol
+	})
+}
+
+// Files returns the files in the profile, sorted
+func (p *Profile) Files() []string {
+	seen := make(map[string]bool)
+	var files []string
+	for _, b := range p.Blocks {
+		if !seen[b.File] {
+			seen[b.File] = true
+			files = append(files, b.File)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// LineCounts returns the count of every line of file which is part of a block,
+// keyed by the line number. Lines in several blocks get the lowest count of
+// them, so that a line is only counted as covered if all the code on it is.
+// Lines which are not in the map hold no statements.
+func (p *Profile) LineCounts(file string) map[int]int {
+	counts := make(map[int]int)
+	for _, b := range p.Blocks {
+		if b.File != file {
+			continue
+		}
+		end := b.EndLine
+		// A block ending in the first column holds nothing on its last line
+		if end > b.StartLine && b.EndCol <= 1 {
+			end--
+		}
+		for line := b.StartLine; line <= end; line++ {
+			if count, ok := counts[line]; !ok || b.Count < count {
+				counts[line] = b.Count
+			}
+		}
+	}
+	return counts
+}
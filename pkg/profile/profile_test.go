@@ -0,0 +1,376 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package profile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		mode   string
+		blocks []Block
+		err    string
+	}{
+		{
+			name:  "blocks",
+			input: "mode: count\nexample.com/a/a.go:1.2,3.4 5 6\nexample.com/a/b.go:7.8,9.10 1 0\n",
+			mode:  "count",
+			blocks: []Block{
+				{File: "example.com/a/a.go", StartLine: 1, StartCol: 2, EndLine: 3, EndCol: 4, NumStmt: 5, Count: 6},
+				{File: "example.com/a/b.go", StartLine: 7, StartCol: 8, EndLine: 9, EndCol: 10, NumStmt: 1, Count: 0},
+			},
+		},
+		{
+			name:  "blank lines and spaces",
+			input: "\n  mode: set  \n\nexample.com/a/a.go:1.1,2.2 1 1\n\n",
+			mode:  "set",
+			blocks: []Block{
+				{File: "example.com/a/a.go", StartLine: 1, StartCol: 1, EndLine: 2, EndCol: 2, NumStmt: 1, Count: 1},
+			},
+		},
+		{
+			name:  "file with spaces, colons, and unicode",
+			input: "mode: atomic\nexample.com/a/ünï côde:x.go:1.1,2.2 3 4\n",
+			mode:  "atomic",
+			blocks: []Block{
+				{File: "example.com/a/ünï côde:x.go", StartLine: 1, StartCol: 1, EndLine: 2, EndCol: 2, NumStmt: 3, Count: 4},
+			},
+		},
+		{
+			name:  "no blocks",
+			input: "mode: set\n",
+			mode:  "set",
+		},
+		{
+			name:  "no mode line",
+			input: "example.com/a/a.go:1.1,2.2 1 1\n",
+			err:   "line 1: expected the mode line",
+		},
+		{
+			name:  "empty",
+			input: "",
+			err:   "no mode line found",
+		},
+		{
+			name:  "missing field",
+			input: "mode: set\nexample.com/a/a.go:1.1,2.2 1\n",
+			err:   "line 2: malformed block",
+		},
+		{
+			name:  "not a number",
+			input: "mode: set\nexample.com/a/a.go:1.1,2.x 1 1\n",
+			err:   "line 2: malformed block",
+		},
+		{
+			name:  "no colon",
+			input: "mode: set\nexample.com/a/a.go 1 1\n",
+			err:   "line 2: malformed block",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := Parse(strings.NewReader(test.input))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Parse() error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Mode != test.mode || !reflect.DeepEqual(p.Blocks, test.blocks) {
+				t.Errorf("Parse() = %q %+v, want %q %+v", p.Mode, p.Blocks, test.mode, test.blocks)
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	p := &Profile{Mode: "count", Blocks: []Block{
+		{File: "example.com/b/b.go", StartLine: 1, StartCol: 1, EndLine: 2, EndCol: 2, NumStmt: 1, Count: 3},
+		{File: "example.com/a/a b.go", StartLine: 5, StartCol: 1, EndLine: 6, EndCol: 2, NumStmt: 2, Count: 0},
+		{File: "example.com/a/a b.go", StartLine: 1, StartCol: 9, EndLine: 3, EndCol: 2, NumStmt: 1, Count: 1},
+		{File: "example.com/a/a b.go", StartLine: 1, StartCol: 2, EndLine: 1, EndCol: 8, NumStmt: 1, Count: 1},
+	}}
+	want := "mode: count\n" +
+		"example.com/a/a b.go:1.2,1.8 1 1\n" +
+		"example.com/a/a b.go:1.9,3.2 1 1\n" +
+		"example.com/a/a b.go:5.1,6.2 2 0\n" +
+		"example.com/b/b.go:1.1,2.2 1 3\n"
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != want {
+		t.Errorf("Write() =\n%s\nwant\n%s", buf.String(), want)
+	}
+	// The blocks of the profile are left in their order
+	if p.Blocks[0].File != "example.com/b/b.go" {
+		t.Errorf("Write() sorted the blocks of the profile")
+	}
+	// The profile written parses to the same blocks
+	parsed, err := Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Blocks) != len(p.Blocks) || parsed.Mode != p.Mode {
+		t.Errorf("Parse(Write()) = %+v, want the blocks of %+v", parsed, p)
+	}
+}
+
+func TestParseFileSidecar(t *testing.T) {
+	tests := []struct {
+		name    string
+		sidecar string
+		want    *Profile
+		err     string
+	}{
+		{
+			name: "no sidecar",
+			want: &Profile{Mode: "set"},
+		},
+		{
+			name:    "sidecar",
+			sidecar: `{"schema": 1, "tool": "v1", "mode": "set", "build": "abc", "tags": {"arch": "arm"}, "sample": 50, "total_packages": ["example.com/a"]}`,
+			want: &Profile{Mode: "set", Schema: 1, Tool: "v1", Build: "abc", Tags: map[string]string{"arch": "arm"},
+				Sample: 50, TotalPackages: []string{"example.com/a"}},
+		},
+		{
+			name:    "sidecar before the schema",
+			sidecar: `{"sample": 25}`,
+			want:    &Profile{Mode: "set", Sample: 25},
+		},
+		{
+			name:    "newer schema",
+			sidecar: `{"schema": 2, "tool": "v9"}`,
+			err:     "written by gobinarycoverage v9, newer than schema 1",
+		},
+		{
+			name:    "other mode",
+			sidecar: `{"schema": 1, "mode": "count"}`,
+			err:     `mode "count"`,
+		},
+		{
+			name:    "malformed",
+			sidecar: `{`,
+			err:     "profile.out.json",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "profile.out")
+			if err := os.WriteFile(path, []byte("mode: set\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if test.sidecar != "" {
+				if err := os.WriteFile(path+".json", []byte(test.sidecar), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			p, err := ParseFile(path)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("ParseFile() error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(p, test.want) {
+				t.Errorf("ParseFile() = %+v, want %+v", p, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteSidecar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profile.out")
+	p := &Profile{Mode: "count", Tool: "v1", Build: "abc", Tags: map[string]string{"os": "linux"},
+		Sample: 10, TotalPackages: []string{"example.com/a"}}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WriteSidecar(path + ".json"); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Schema = SidecarSchema
+	if !reflect.DeepEqual(parsed, p) {
+		t.Errorf("ParseFile() = %+v, want %+v", parsed, p)
+	}
+}
+
+// block returns a block of the file example.com/a/a.go, on line, with count
+func block(line, count int) Block {
+	return Block{File: "example.com/a/a.go", StartLine: line, StartCol: 1, EndLine: line, EndCol: 10, NumStmt: 1, Count: count}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		p, q *Profile
+		want *Profile
+		err  string
+	}{
+		{
+			name: "into an empty profile",
+			p:    &Profile{},
+			q:    &Profile{Mode: "set", Build: "abc", Tags: map[string]string{"os": "linux"}, Blocks: []Block{block(1, 1)}},
+			want: &Profile{Mode: "set", Build: "abc", Tags: map[string]string{"os": "linux"}, Blocks: []Block{block(1, 1)}},
+		},
+		{
+			name: "counts are added",
+			p:    &Profile{Mode: "count", Blocks: []Block{block(1, 2), block(2, 0)}},
+			q:    &Profile{Mode: "count", Blocks: []Block{block(1, 3), block(3, 1)}},
+			want: &Profile{Mode: "count", Blocks: []Block{block(1, 5), block(2, 0), block(3, 1)}},
+		},
+		{
+			name: "set mode is or'ed",
+			p:    &Profile{Mode: "set", Blocks: []Block{block(1, 1), block(2, 0)}},
+			q:    &Profile{Mode: "set", Blocks: []Block{block(1, 1), block(2, 1)}},
+			want: &Profile{Mode: "set", Blocks: []Block{block(1, 1), block(2, 1)}},
+		},
+		{
+			name: "tags are intersected, and the oldest schema kept",
+			p:    &Profile{Mode: "set", Schema: 1, Tool: "v1", Tags: map[string]string{"os": "linux", "arch": "arm"}},
+			q:    &Profile{Mode: "set", Schema: 0, Tool: "v2", Build: "abc", Tags: map[string]string{"os": "linux", "arch": "mips"}},
+			want: &Profile{Mode: "set", Build: "abc", Tags: map[string]string{"os": "linux"}},
+		},
+		{
+			name: "other mode",
+			p:    &Profile{Mode: "set"},
+			q:    &Profile{Mode: "count"},
+			err:  `mode "count" into one in mode "set"`,
+		},
+		{
+			name: "other sample",
+			p:    &Profile{Mode: "set"},
+			q:    &Profile{Mode: "set", Sample: 50},
+			err:  "sampling 50% of the statements into one sampling 100%",
+		},
+		{
+			name: "other build",
+			p:    &Profile{Mode: "set", Build: "abc"},
+			q:    &Profile{Mode: "set", Build: "def"},
+			err:  "build def into one of the build abc",
+		},
+		{
+			name: "other packages in the totals",
+			p:    &Profile{Mode: "set", TotalPackages: []string{"example.com/a"}},
+			q:    &Profile{Mode: "set"},
+			err:  "counting all the packages in the totals into one counting example.com/a",
+		},
+		{
+			name: "same packages in the totals, in another order",
+			p:    &Profile{Mode: "set", TotalPackages: []string{"example.com/a", "example.com/b"}},
+			q:    &Profile{Mode: "set", TotalPackages: []string{"example.com/b", "example.com/a"}},
+			want: &Profile{Mode: "set", TotalPackages: []string{"example.com/a", "example.com/b"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.p.Merge(test.q)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Merge() error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(test.p, test.want) {
+				t.Errorf("Merge() = %+v, want %+v", test.p, test.want)
+			}
+		})
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	p := &Profile{Mode: "set", Blocks: []Block{
+		{File: "example.com/a/a.go", NumStmt: 3, Count: 1},
+		{File: "example.com/a/a.go", NumStmt: 2, Count: 0},
+		{File: "example.com/b/b.go", NumStmt: 4, Count: 1},
+	}}
+	tests := []struct {
+		name           string
+		include        func(string) bool
+		covered, total int
+	}{
+		{"all", nil, 7, 9},
+		{"one package", func(file string) bool { return strings.HasPrefix(file, "example.com/a/") }, 3, 5},
+		{"none", func(string) bool { return false }, 0, 0},
+	}
+	for _, test := range tests {
+		if covered, total := p.Coverage(test.include); covered != test.covered || total != test.total {
+			t.Errorf("%s: Coverage() = %d, %d, want %d, %d", test.name, covered, total, test.covered, test.total)
+		}
+	}
+}
+
+func TestCounted(t *testing.T) {
+	tests := []struct {
+		total []string
+		file  string
+		want  bool
+	}{
+		{nil, "example.com/a/a.go", true},
+		{[]string{"example.com/a"}, "example.com/a/a.go", true},
+		{[]string{"example.com/a"}, "example.com/a/b/b.go", false},
+		{[]string{"example.com/a", "example.com/a/b"}, "example.com/a/b/b.go", true},
+	}
+	for _, test := range tests {
+		p := &Profile{TotalPackages: test.total}
+		if got := p.Counted(test.file); got != test.want {
+			t.Errorf("Counted(%q) with %q = %t, want %t", test.file, test.total, got, test.want)
+		}
+	}
+}
+
+func TestLineCounts(t *testing.T) {
+	p := &Profile{Mode: "count", Blocks: []Block{
+		{File: "a.go", StartLine: 1, StartCol: 10, EndLine: 3, EndCol: 5, NumStmt: 2, Count: 4},
+		{File: "a.go", StartLine: 3, StartCol: 5, EndLine: 5, EndCol: 1, NumStmt: 1, Count: 0},
+		{File: "b.go", StartLine: 1, StartCol: 1, EndLine: 9, EndCol: 1, NumStmt: 1, Count: 1},
+	}}
+	want := map[int]int{1: 4, 2: 4, 3: 0, 4: 0}
+	if got := p.LineCounts("a.go"); !reflect.DeepEqual(got, want) {
+		t.Errorf("LineCounts() = %v, want %v", got, want)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	p := &Profile{Blocks: []Block{{File: "b.go"}, {File: "a.go"}, {File: "b.go"}}}
+	if got, want := p.Files(), []string{"a.go", "b.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Files() = %q, want %q", got, want)
+	}
+}
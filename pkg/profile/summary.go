@@ -0,0 +1,155 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package profile
+
+import (
+	"path"
+	"sort"
+)
+
+// Summary is the structured coverage of a profile, grouped by package and
+// file. The coverage of a sampled profile is extrapolated from the statements
+// sampled, see Profile.Sample.
+type Summary struct {
+	Mode     string           `json:"mode"`
+	Sample   float64          `json:"sample,omitempty"`
+	Totals   Totals           `json:"totals"`
+	Packages []PackageSummary `json:"packages"`
+}
+
+// Totals is the number of statements, and the number of them covered
+type Totals struct {
+	Statements int     `json:"statements"`
+	Covered    int     `json:"covered"`
+	Percent    float64 `json:"percent"`
+}
+
+// PackageSummary is the coverage of a package, and the files in it
+type PackageSummary struct {
+	ImportPath     string        `json:"import_path"`
+	Uncounted      bool          `json:"uncounted,omitempty"`      // Not counted in the total of the profile
+	Uninstrumented bool          `json:"uninstrumented,omitempty"` // None of the files are instrumented, see AddUninstrumented
+	Totals         Totals        `json:"totals"`
+	Files          []FileSummary `json:"files"`
+}
+
+// FileSummary is the coverage of a file, and the blocks in it
+type FileSummary struct {
+	Name           string         `json:"name"`                     // As in the profile, i.e., prefixed by the import path
+	Uninstrumented bool           `json:"uninstrumented,omitempty"` // Not instrumented, so without blocks, see AddUninstrumented
+	Totals         Totals         `json:"totals"`
+	Blocks         []BlockSummary `json:"blocks"`
+}
+
+// BlockSummary is a block of a file, and its count
+type BlockSummary struct {
+	StartLine  int `json:"start_line"`
+	StartCol   int `json:"start_col"`
+	EndLine    int `json:"end_line"`
+	EndCol     int `json:"end_col"`
+	Statements int `json:"statements"`
+	Count      int `json:"count"`
+}
+
+// Add adds statements, of which covered are covered, to the totals, and
+// updates the percentage
+func (t *Totals) Add(statements, covered int) {
+	t.Statements += statements
+	t.Covered += covered
+	if t.Statements > 0 {
+		t.Percent = 100 * float64(t.Covered) / float64(t.Statements)
+	}
+}
+
+// Summarize groups the blocks of p by package and file, and sums up the
+// statements covered at every level. Only the packages counted in the totals
+// are summed up in the total of the profile, see Profile.Counted. The
+// packages, the files, and the blocks are sorted.
+func Summarize(p *Profile) *Summary {
+	s := &Summary{Mode: p.Mode, Sample: p.Sample}
+	blocks := make(map[string][]Block)
+	for _, b := range p.Blocks {
+		blocks[b.File] = append(blocks[b.File], b)
+	}
+	packages := make(map[string]*PackageSummary)
+	for _, file := range p.Files() {
+		pkg := path.Dir(file)
+		ps, ok := packages[pkg]
+		if !ok {
+			ps = &PackageSummary{ImportPath: pkg, Uncounted: !p.Counted(file)}
+			packages[pkg] = ps
+		}
+		fs := FileSummary{Name: file}
+		for _, b := range blocks[file] {
+			fs.Blocks = append(fs.Blocks, BlockSummary{
+				StartLine:  b.StartLine,
+				StartCol:   b.StartCol,
+				EndLine:    b.EndLine,
+				EndCol:     b.EndCol,
+				Statements: b.NumStmt,
+				Count:      b.Count,
+			})
+			covered := 0
+			if b.Count > 0 {
+				covered = b.NumStmt
+			}
+			fs.Totals.Add(b.NumStmt, covered)
+		}
+		sort.Slice(fs.Blocks, func(i, j int) bool {
+			if fs.Blocks[i].StartLine != fs.Blocks[j].StartLine {
+				return fs.Blocks[i].StartLine < fs.Blocks[j].StartLine
+			}
+			return fs.Blocks[i].StartCol < fs.Blocks[j].StartCol
+		})
+		ps.Totals.Add(fs.Totals.Statements, fs.Totals.Covered)
+		if !ps.Uncounted {
+			s.Totals.Add(fs.Totals.Statements, fs.Totals.Covered)
+		}
+		ps.Files = append(ps.Files, fs)
+	}
+	for _, ps := range packages {
+		s.Packages = append(s.Packages, *ps)
+	}
+	sort.Slice(s.Packages, func(i, j int) bool {
+		return s.Packages[i].ImportPath < s.Packages[j].ImportPath
+	})
+	return s
+}
+
+// AddUninstrumented adds the file, named as in the profiles, which is built,
+// but not instrumented, e.g., as it uses cgo, or its package is excluded, to
+// the summary, with all of its statements uncovered. The file is counted in
+// the total of the profile if counted is true, see Profile.Counted. The
+// packages, and the files, are kept sorted.
+func (s *Summary) AddUninstrumented(file string, statements int, counted bool) {
+	pkg := path.Dir(file)
+	i := sort.Search(len(s.Packages), func(i int) bool { return s.Packages[i].ImportPath >= pkg })
+	if i == len(s.Packages) || s.Packages[i].ImportPath != pkg {
+		s.Packages = append(s.Packages, PackageSummary{})
+		copy(s.Packages[i+1:], s.Packages[i:])
+		s.Packages[i] = PackageSummary{ImportPath: pkg, Uncounted: !counted, Uninstrumented: true}
+	}
+	ps := &s.Packages[i]
+	fs := FileSummary{Name: file, Uninstrumented: true}
+	fs.Totals.Add(statements, 0)
+	j := sort.Search(len(ps.Files), func(j int) bool { return ps.Files[j].Name >= file })
+	ps.Files = append(ps.Files, FileSummary{})
+	copy(ps.Files[j+1:], ps.Files[j:])
+	ps.Files[j] = fs
+	ps.Totals.Add(statements, 0)
+	if !ps.Uncounted {
+		s.Totals.Add(statements, 0)
+	}
+}